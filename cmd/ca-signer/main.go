@@ -0,0 +1,9 @@
+// Command ca-signer is the signing service in front of step-ca. See the
+// README for its configuration and subcommands.
+package main
+
+import "github.com/Fyve-Labs/ca-signer/signer"
+
+func main() {
+	signer.Main()
+}
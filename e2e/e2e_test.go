@@ -0,0 +1,498 @@
+//go:build e2e
+
+// Package e2e runs the signer against a throwaway step-ca in Docker and
+// exercises the sign, renew and revoke paths end to end. The container is
+// managed with dockertest, and the tests are behind the e2e build tag so
+// they stay out of the regular build:
+//
+//	go test -tags e2e ./e2e
+//
+// They need a Docker daemon and the go toolchain. The step-ca container and
+// the signer are removed when the run finishes, use -keep to leave them
+// running for debugging.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/pemutil"
+)
+
+const (
+	provisionerName = "admin"
+	clientName      = "e2e-client"
+)
+
+var (
+	image = flag.String("image", "smallstep/step-ca:latest", "step-ca image")
+	keep  = flag.Bool("keep", false, "keep the container and the signer running after the run")
+)
+
+// harness holds the step-ca container and the signer process of a run.
+type harness struct {
+	dir       string
+	pool      *dockertest.Pool
+	container *dockertest.Resource
+	caURL     string
+	rootFile  string
+	password  []byte
+	signer    *exec.Cmd
+	signerURL string
+	client    *http.Client
+}
+
+// h is the environment shared by the tests, started by TestMain.
+var h *harness
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(run(m))
+}
+
+// run starts the environment and the tests, it returns the exit code.
+func run(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "ca-signer-e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	h = &harness{dir: dir}
+	defer func() {
+		if *keep {
+			fmt.Printf("kept container %s, signer at %s, files in %s\n", h.containerID(), h.signerURL, dir)
+			return
+		}
+		h.close()
+	}()
+
+	for _, step := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"start step-ca", h.startCA},
+		{"issue client certificate", h.issueClientCertificate},
+		{"start signer", h.startSigner},
+	} {
+		if err := step.fn(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", step.name, err)
+			return 1
+		}
+	}
+
+	return m.Run()
+}
+
+// TestProvisionerFlow signs a certificate through the signer, renews it
+// with the same key and reports the key as compromised.
+func TestProvisionerFlow(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first, renewed *x509.Certificate
+	if !t.Run("sign", func(t *testing.T) {
+		if first, err = h.sign(key, "e2e.example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}) {
+		t.FailNow()
+	}
+	if !t.Run("renew", func(t *testing.T) {
+		if renewed, err = h.sign(key, "e2e.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if renewed.SerialNumber.Cmp(first.SerialNumber) == 0 {
+			t.Fatal("renewed certificate has the same serial number")
+		}
+	}) {
+		t.FailNow()
+	}
+	t.Run("revoke", func(t *testing.T) {
+		if err := h.revoke(key, first, renewed); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// startCA starts step-ca with a JWK provisioner and waits until it is
+// healthy.
+func (h *harness) startCA() error {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		return errors.Wrap(err, "error connecting to docker")
+	}
+	pool.MaxWait = 60 * time.Second
+	h.pool = pool
+
+	repository, tag := docker.ParseRepositoryTag(*image)
+	h.container, err = pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: repository,
+		Tag:        tag,
+		Env: []string{
+			"DOCKER_STEPCA_INIT_NAME=ca-signer e2e",
+			"DOCKER_STEPCA_INIT_DNS_NAMES=localhost,127.0.0.1",
+			"DOCKER_STEPCA_INIT_PROVISIONER_NAME=" + provisionerName,
+		},
+		ExposedPorts: []string{"9000/tcp"},
+	}, func(c *docker.HostConfig) {
+		c.AutoRemove = !*keep
+		c.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		return errors.Wrap(err, "error starting step-ca")
+	}
+	h.caURL = "https://127.0.0.1:" + h.container.GetPort("9000/tcp")
+
+	// The password and the root are written by the init of the container.
+	var root string
+	if err := pool.Retry(func() error {
+		password, err := h.exec("cat", "/home/step/secrets/password")
+		if err != nil {
+			return err
+		}
+		h.password = []byte(strings.TrimSpace(password))
+		root, err = h.exec("cat", "/home/step/certs/root_ca.crt")
+		return err
+	}); err != nil {
+		return err
+	}
+	h.rootFile = filepath.Join(h.dir, "root_ca.crt")
+	if err := os.WriteFile(h.rootFile, []byte(root), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(h.dir, "password.txt"), h.password, 0o600); err != nil {
+		return err
+	}
+
+	client, err := ca.NewClient(h.caURL, ca.WithRootFile(h.rootFile))
+	if err != nil {
+		return err
+	}
+	return pool.Retry(func() error {
+		_, err := client.Health()
+		return err
+	})
+}
+
+// exec runs a command in the step-ca container and returns its output.
+func (h *harness) exec(cmd ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	code, err := h.container.Exec(cmd, dockertest.ExecOptions{StdOut: &stdout, StdErr: &stderr})
+	if err != nil {
+		return "", err
+	}
+	if code != 0 {
+		return "", errors.Errorf("%s exited with %d: %s", cmd[0], code, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (h *harness) containerID() string {
+	if h.container == nil {
+		return ""
+	}
+	return h.container.Container.ID
+}
+
+// issueClientCertificate gets the certificate the scenarios use for mTLS
+// directly from step-ca.
+func (h *harness) issueClientCertificate() error {
+	p, err := ca.NewProvisioner(provisionerName, "", h.caURL, h.password, ca.WithRootFile(h.rootFile))
+	if err != nil {
+		return err
+	}
+	token, err := p.Token(clientName)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := newCSR(key, clientName)
+	if err != nil {
+		return err
+	}
+	client, err := ca.NewClient(h.caURL, ca.WithRootFile(h.rootFile))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Sign(&api.SignRequest{
+		CsrPEM: api.CertificateRequest{CertificateRequest: csr},
+		OTT:    token,
+	})
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := pemutil.Serialize(key)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: resp.ServerPEM.Raw,
+	}), pem.EncodeToMemory(keyPEM))
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	rootPEM, err := os.ReadFile(h.rootFile)
+	if err != nil {
+		return err
+	}
+	roots.AppendCertsFromPEM(rootPEM)
+	h.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      roots,
+		}},
+	}
+	return nil
+}
+
+// startSigner builds the signer from the working tree and starts it with
+// the inventory enabled and the client certificate as admin.
+func (h *harness) startSigner() error {
+	bin := filepath.Join(h.dir, "ca-signer")
+	build := exec.Command("go", "build", "-o", bin, "github.com/Fyve-Labs/ca-signer/cmd/ca-signer")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		return errors.Wrap(err, "error building the signer")
+	}
+
+	addr, err := freeAddress()
+	if err != nil {
+		return err
+	}
+	h.signerURL = "https://" + addr
+	config := fmt.Sprintf(`caURL: %s
+rootCAPath: %s
+provisionerPasswordFile: %s
+address: %s
+serverSANs: ["127.0.0.1"]
+inventory:
+  path: %s
+admin:
+  clients: [%q]
+`, h.caURL, h.rootFile, filepath.Join(h.dir, "password.txt"), addr,
+		filepath.Join(h.dir, "inventory.db"), clientName)
+	configFile := filepath.Join(h.dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		return err
+	}
+
+	logFile, err := os.Create(filepath.Join(h.dir, "signer.log"))
+	if err != nil {
+		return err
+	}
+	h.signer = exec.Command(bin, configFile)
+	h.signer.Env = append(os.Environ(), "PROVISIONER_NAME="+provisionerName)
+	h.signer.Stdout, h.signer.Stderr = logFile, logFile
+	if err := h.signer.Start(); err != nil {
+		return err
+	}
+
+	if err := h.pool.Retry(func() error {
+		resp, err := h.client.Get(h.signerURL + "/healthz")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("healthz returned %s", resp.Status)
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "signer did not start, see %s", logFile.Name())
+	}
+	return nil
+}
+
+// sign requests a certificate for key through the signer and checks that
+// it chains to the root of step-ca.
+func (h *harness) sign(key crypto.Signer, name string) (*x509.Certificate, error) {
+	csr, err := newCSR(key, name)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]any{
+		"csr":      api.CertificateRequest{CertificateRequest: csr},
+		"notAfter": "1h",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp api.SignResponse
+	status, header, err := h.do(http.MethodPost, "/v1/sign", body, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusCreated {
+		return nil, errors.Errorf("sign returned %d", status)
+	}
+	if resp.ServerPEM.Certificate == nil {
+		return nil, errors.New("sign response has no certificate")
+	}
+	cert := resp.ServerPEM.Certificate
+	if header.Get("X-Certificate-Serial") == "" || header.Get("X-Renew-After") == "" {
+		return nil, errors.New("sign response is missing the certificate headers")
+	}
+
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	rootPEM, err := os.ReadFile(h.rootFile)
+	if err != nil {
+		return nil, err
+	}
+	roots.AppendCertsFromPEM(rootPEM)
+	for _, c := range resp.CertChainPEM {
+		if c.Certificate != cert {
+			intermediates.AddCert(c.Certificate)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: intermediates,
+	}); err != nil {
+		return nil, errors.Wrap(err, "issued certificate does not verify")
+	}
+	return cert, nil
+}
+
+// revoke reports the key as compromised and checks that every certificate
+// issued for it is revoked in the inventory.
+func (h *harness) revoke(key crypto.Signer, certs ...*x509.Certificate) error {
+	block, err := pemutil.Serialize(key)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{
+		"privateKey": string(pem.EncodeToMemory(block)),
+		"reason":     "e2e",
+	})
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Revoked []string `json:"revoked"`
+	}
+	status, _, err := h.do(http.MethodPost, "/v1/report-compromise", body, &result)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return errors.Errorf("report-compromise returned %d", status)
+	}
+
+	for _, cert := range certs {
+		var rec struct {
+			Status string `json:"status"`
+		}
+		serial := cert.SerialNumber.String()
+		if _, _, err := h.do(http.MethodGet, "/v1/certificates/"+serial, nil, &rec); err != nil {
+			return err
+		}
+		if rec.Status != "revoked" {
+			return errors.Errorf("certificate %s has status %q after the report", serial, rec.Status)
+		}
+	}
+	if len(result.Revoked) != len(certs) {
+		return errors.Errorf("report revoked %d certificates, want %d", len(result.Revoked), len(certs))
+	}
+	return nil
+}
+
+// do sends a request to the signer and decodes the JSON response into v.
+func (h *harness) do(method, path string, body []byte, v any) (int, http.Header, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, h.signerURL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return resp.StatusCode, resp.Header, errors.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return resp.StatusCode, resp.Header, errors.Wrapf(err, "error decoding %s response", path)
+	}
+	return resp.StatusCode, resp.Header, nil
+}
+
+// close stops the signer and removes the container and the files.
+func (h *harness) close() {
+	if h.signer != nil && h.signer.Process != nil {
+		h.signer.Process.Kill()
+		h.signer.Wait()
+	}
+	if h.container != nil {
+		h.pool.Purge(h.container)
+	}
+	os.RemoveAll(h.dir)
+}
+
+func newCSR(key crypto.Signer, name string) (*x509.CertificateRequest, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificateRequest(der)
+}
+
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
@@ -0,0 +1,218 @@
+// Package policy evaluates the names requested in a CSR against ordered
+// allow and deny rules, scoped to clients and directory groups.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the list of rules evaluated against the names requested in
+// a CSR before it is sent upstream.
+type Config struct {
+	DefaultAction string `yaml:"defaultAction"`
+	DefaultMode   string `yaml:"defaultMode"`
+	Rules         []Rule `yaml:"rules"`
+}
+
+// Rule allows or denies the names matching any of its patterns. A rule
+// with clients or groups only applies to requests from those clients or from
+// members of those directory groups. Deny rules in "report" mode only record
+// the names they would deny.
+type Rule struct {
+	ID          string   `yaml:"id" json:"id"`
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Action      string   `yaml:"action" json:"action"`
+	Mode        string   `yaml:"mode" json:"mode,omitempty"`
+	Clients     []string `yaml:"clients" json:"clients,omitempty"`
+	Groups      []string `yaml:"groups" json:"groups,omitempty"`
+	SANs        []string `yaml:"sans" json:"sans,omitempty"`
+}
+
+// Decision is the result of evaluating a policy. Matched lists the ids of the
+// rules that matched any name, and Reported contains the denials of the rules
+// in report mode, which do not block the request.
+type Decision struct {
+	Allowed  bool       `json:"allowed"`
+	RuleID   string     `json:"ruleId,omitempty"`
+	SAN      string     `json:"san,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Matched  []string   `json:"matched,omitempty"`
+	Reported []Decision `json:"reported,omitempty"`
+}
+
+// ReportOnly returns true if the rule is in report mode.
+func (r Rule) ReportOnly() bool {
+	return r.Mode == "report"
+}
+
+// GetDefaultAction returns the action applied to names not matched by any
+// rule, defaults to "allow".
+func (p Config) GetDefaultAction() string {
+	if p.DefaultAction != "" {
+		return p.DefaultAction
+	}
+
+	return "allow"
+}
+
+// Validate checks the policy rules.
+func (p Config) Validate() error {
+	if a := p.GetDefaultAction(); a != "allow" && a != "deny" {
+		return errors.Errorf("invalid policy defaultAction %q", a)
+	}
+	if !validMode(p.DefaultMode) {
+		return errors.Errorf("invalid policy defaultMode %q", p.DefaultMode)
+	}
+
+	seen := map[string]bool{}
+	for i, rule := range p.Rules {
+		if rule.ID == "" {
+			return errors.Errorf("policy rule %d is missing an id", i)
+		}
+		if seen[rule.ID] {
+			return errors.Errorf("duplicated policy rule id %q", rule.ID)
+		}
+		seen[rule.ID] = true
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return errors.Errorf("invalid action %q in policy rule %q", rule.Action, rule.ID)
+		}
+		if !validMode(rule.Mode) {
+			return errors.Errorf("invalid mode %q in policy rule %q", rule.Mode, rule.ID)
+		}
+		for _, pattern := range rule.SANs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid pattern %q in policy rule %q", pattern, rule.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Evaluate checks every name against the rules in order, for clients
+// member of the directory groups, the first rule matching a name decides
+// whether it is allowed. Names not matched by any rule
+// get the default action. Denials from rules in report mode are recorded and
+// evaluation continues with the next rules.
+func (p Config) Evaluate(clients, groups, names []string) Decision {
+	var matched []string
+	var reported []Decision
+	for _, name := range names {
+		d, decided := p.evaluateName(clients, groups, name, &matched, &reported)
+		if !decided {
+			d = Decision{
+				RuleID: "default",
+				SAN:    name,
+				Reason: fmt.Sprintf("%s is not allowed by any policy rule", name),
+			}
+			if p.GetDefaultAction() == "allow" {
+				continue
+			}
+			if p.DefaultMode == "report" {
+				reported = append(reported, d)
+				continue
+			}
+		}
+		if !d.Allowed {
+			d.Matched = matched
+			d.Reported = reported
+			return d
+		}
+	}
+
+	return Decision{Allowed: true, Matched: matched, Reported: reported}
+}
+
+// evaluateName returns the decision of the first enforced rule matching the
+// name, and false if no such rule exists.
+func (p Config) evaluateName(clients, groups []string, name string, matched *[]string, reported *[]Decision) (Decision, bool) {
+	for _, rule := range p.Rules {
+		if !rule.matches(clients, groups, name) {
+			continue
+		}
+		if !slices.Contains(*matched, rule.ID) {
+			*matched = append(*matched, rule.ID)
+		}
+		if rule.Action == "allow" {
+			return Decision{Allowed: true}, true
+		}
+
+		reason := rule.Description
+		if reason == "" {
+			reason = fmt.Sprintf("%s is denied by policy rule %s", name, rule.ID)
+		}
+		d := Decision{RuleID: rule.ID, SAN: name, Reason: reason}
+		if rule.ReportOnly() {
+			*reported = append(*reported, d)
+			continue
+		}
+		return d, true
+	}
+
+	return Decision{}, false
+}
+
+// matches returns true if the rule applies to the clients, their groups
+// and name.
+func (r Rule) matches(clients, groups []string, name string) bool {
+	if (len(r.Clients) > 0 || len(r.Groups) > 0) && !ContainsAny(r.Clients, clients) && !ContainsAny(r.Groups, groups) {
+		return false
+	}
+	for _, pattern := range r.SANs {
+		if MatchName(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UsesGroups returns true if a rule applies to directory groups.
+func (p Config) UsesGroups() bool {
+	return slices.ContainsFunc(p.Rules, func(r Rule) bool { return len(r.Groups) > 0 })
+}
+
+func validMode(mode string) bool {
+	return mode == "" || mode == "enforce" || mode == "report"
+}
+
+// MatchName matches a name against a glob pattern. IP addresses are also
+// matched against patterns in CIDR notation, and against IP patterns by
+// value, so "2001:db8:0::1" and "[2001:db8::1]" match 2001:db8::1.
+func MatchName(pattern, name string) bool {
+	if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(name)
+		return ip != nil && ipnet.Contains(ip)
+	}
+	if ip, ok := CanonicalIP(pattern); ok {
+		n, isIP := CanonicalIP(name)
+		return isIP && n == ip
+	}
+
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// CanonicalIP returns the canonical form of an IP address, e.g.
+// "2001:db8::1" for "[2001:DB8:0::1]", and whether name is an IP address.
+func CanonicalIP(name string) (string, bool) {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(name, "["), "]"))
+	if ip == nil {
+		return name, false
+	}
+
+	return ip.String(), true
+}
+
+// ContainsAny returns true if any of the values is in list.
+func ContainsAny(list, values []string) bool {
+	return slices.ContainsFunc(values, func(v string) bool {
+		return slices.Contains(list, v)
+	})
+}
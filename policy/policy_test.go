@@ -0,0 +1,108 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"empty", Config{}, false},
+		{"rules", Config{DefaultAction: "deny", Rules: []Rule{
+			{ID: "a", Action: "allow", SANs: []string{"*.example.com"}},
+			{ID: "b", Action: "deny", Mode: "report", SANs: []string{"10.0.0.0/8"}},
+		}}, false},
+		{"default action", Config{DefaultAction: "drop"}, true},
+		{"default mode", Config{DefaultMode: "audit"}, true},
+		{"missing id", Config{Rules: []Rule{{Action: "allow"}}}, true},
+		{"duplicated id", Config{Rules: []Rule{{ID: "a", Action: "allow"}, {ID: "a", Action: "deny"}}}, true},
+		{"action", Config{Rules: []Rule{{ID: "a", Action: "drop"}}}, true},
+		{"mode", Config{Rules: []Rule{{ID: "a", Action: "deny", Mode: "audit"}}}, true},
+		{"pattern", Config{Rules: []Rule{{ID: "a", Action: "allow", SANs: []string{"[a-"}}}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p := Config{
+		DefaultAction: "deny",
+		Rules: []Rule{
+			{ID: "audit", Action: "deny", Mode: "report", SANs: []string{"*.internal"}},
+			{ID: "admin", Action: "deny", SANs: []string{"admin.example.com"}},
+			{ID: "web", Action: "allow", Clients: []string{"web"}, SANs: []string{"*.example.com", "*.internal"}},
+			{ID: "ops", Action: "allow", Groups: []string{"ops"}, SANs: []string{"10.0.0.0/8"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		clients []string
+		groups  []string
+		names   []string
+		want    Decision
+	}{
+		{"allowed", []string{"web"}, nil, []string{"www.example.com"},
+			Decision{Allowed: true, Matched: []string{"web"}}},
+		{"first rule wins", []string{"web"}, nil, []string{"admin.example.com"},
+			Decision{RuleID: "admin", SAN: "admin.example.com", Reason: "admin.example.com is denied by policy rule admin", Matched: []string{"admin"}}},
+		{"other client", []string{"api"}, nil, []string{"www.example.com"},
+			Decision{RuleID: "default", SAN: "www.example.com", Reason: "www.example.com is not allowed by any policy rule"}},
+		{"group", []string{"api"}, []string{"ops"}, []string{"10.1.2.3"},
+			Decision{Allowed: true, Matched: []string{"ops"}}},
+		{"reported", []string{"web"}, nil, []string{"db.internal"},
+			Decision{Allowed: true, Matched: []string{"audit", "web"}, Reported: []Decision{
+				{RuleID: "audit", SAN: "db.internal", Reason: "db.internal is denied by policy rule audit"},
+			}}},
+	}
+	for _, tt := range tests {
+		if got := p.Evaluate(tt.clients, tt.groups, tt.names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Evaluate() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateDefaultReport(t *testing.T) {
+	p := Config{DefaultAction: "deny", DefaultMode: "report"}
+	d := p.Evaluate([]string{"web"}, nil, []string{"www.example.com"})
+	if !d.Allowed || len(d.Reported) != 1 || d.Reported[0].RuleID != "default" {
+		t.Errorf("Evaluate() = %+v, want allowed with the default denial reported", d)
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "192.168.0.1", false},
+		{"10.0.0.0/8", "www.example.com", false},
+		{"2001:db8:0::1", "2001:db8::1", true},
+		{"[2001:db8::1]", "2001:DB8::1", true},
+		{"2001:db8::1", "2001:db8::2", false},
+	}
+	for _, tt := range tests {
+		if got := MatchName(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchName(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUsesGroups(t *testing.T) {
+	if (Config{Rules: []Rule{{ID: "a"}}}).UsesGroups() {
+		t.Error("UsesGroups() = true without groups")
+	}
+	if !(Config{Rules: []Rule{{ID: "a"}, {ID: "b", Groups: []string{"ops"}}}}).UsesGroups() {
+		t.Error("UsesGroups() = false with groups")
+	}
+}
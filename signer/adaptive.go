@@ -0,0 +1,174 @@
+package signer
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+)
+
+// adaptiveBackoff is the factor applied to the concurrency limit when the
+// upstream latency is above the target.
+const adaptiveBackoff = 0.9
+
+// AdaptiveConfig adjusts the concurrency limit of the priority scheduler to
+// the upstream latency (AIMD): the limit grows by one slot per window in
+// which the latency is good, and shrinks by 10% per window in
+// which the 99th percentile of the upstream latency is above the target or
+// the upstream is overloaded. As the limit shrinks, the requests of the
+// lowest weight classes that would have to wait are shed with 503.
+type AdaptiveConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	MinConcurrent int    `yaml:"minConcurrent"`
+	TargetLatency string `yaml:"targetLatency"`
+	Window        string `yaml:"window"`
+}
+
+// GetMinConcurrent returns the lowest limit, defaults to 1.
+func (c AdaptiveConfig) GetMinConcurrent() int {
+	if c.MinConcurrent > 0 {
+		return c.MinConcurrent
+	}
+
+	return 1
+}
+
+// GetTargetLatency returns the target p99 latency of the upstream, defaults
+// to 1s.
+func (c AdaptiveConfig) GetTargetLatency() time.Duration {
+	if d, err := time.ParseDuration(c.TargetLatency); err == nil && d > 0 {
+		return d
+	}
+
+	return time.Second
+}
+
+// GetWindow returns the interval between two adjustments, defaults to 1s.
+func (c AdaptiveConfig) GetWindow() time.Duration {
+	if d, err := time.ParseDuration(c.Window); err == nil && d > 0 {
+		return d
+	}
+
+	return time.Second
+}
+
+// Validate checks the limits.
+func (c AdaptiveConfig) Validate(maxConcurrent int) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MinConcurrent < 0 || c.GetMinConcurrent() > maxConcurrent {
+		return errors.New("priority adaptive minConcurrent must be between 1 and maxConcurrent")
+	}
+
+	return nil
+}
+
+// adaptiveLimit holds the samples of the current window. It is protected by
+// the mutex of the scheduler.
+type adaptiveLimit struct {
+	min, max int
+	target   time.Duration
+	window   time.Duration
+
+	start   time.Time
+	samples int
+	slow    int
+}
+
+func newAdaptiveLimit(c AdaptiveConfig, maxConcurrent int) *adaptiveLimit {
+	return &adaptiveLimit{
+		min:    c.GetMinConcurrent(),
+		max:    maxConcurrent,
+		target: c.GetTargetLatency(),
+		window: c.GetWindow(),
+		start:  time.Now(),
+	}
+}
+
+// observe records the latency of an upstream request, and adjusts the limit
+// at the end of each window.
+func (s *priorityScheduler) observe(latency time.Duration, overloaded bool) {
+	if s.adaptive == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.adaptive
+	a.samples++
+	if overloaded || latency > a.target {
+		a.slow++
+	}
+	now := time.Now()
+	if now.Sub(a.start) < a.window {
+		return
+	}
+
+	limit := s.limit
+	switch {
+	case a.slow*100 > a.samples:
+		limit = max(a.min, int(float64(limit)*adaptiveBackoff))
+	default:
+		limit = min(a.max, limit+1)
+	}
+	a.start, a.samples, a.slow = now, 0, 0
+	if limit != s.limit {
+		s.setLimit(limit)
+	}
+}
+
+// setLimit changes the limit, and sheds the classes with the lowest weights
+// in proportion to how far the limit is below the maximum; the class with
+// the highest weight is never shed. It must be called with s.mu held.
+func (s *priorityScheduler) setLimit(limit int) {
+	a := s.adaptive
+	s.limit = limit
+	signConcurrencyLimit.Set(float64(limit))
+
+	shed := 0
+	if a.max > a.min {
+		shed = min((a.max-limit)*len(s.byWeight)/(a.max-a.min), len(s.byWeight)-1)
+	}
+	for i, q := range s.byWeight {
+		if q.shed == (i < shed) {
+			continue
+		}
+		q.shed = i < shed
+		logFor("server").WithFields(log.Fields{
+			"class": q.name,
+			"limit": limit,
+			"shed":  q.shed,
+		}).Warn("Changed load shedding of priority class")
+		if !q.shed {
+			continue
+		}
+		for e := q.waiters.Front(); e != nil; e = e.Next() {
+			e.Value.(priorityWaiter) <- errShed
+			s.queued--
+			signQueueDepth.WithLabelValues(q.name).Dec()
+		}
+		q.waiters.Init()
+	}
+	s.dispatch()
+}
+
+// observeUpstream feeds the latency of an upstream sign request to the
+// adaptive limit. Timeouts and 429, 503 and 504 responses mean the upstream
+// is overloaded.
+func (s *server) observeUpstream(start time.Time, err error) {
+	if s.priority == nil {
+		return
+	}
+	overloaded := false
+	var sc render.StatusCodedError
+	if errors.As(err, &sc) {
+		switch sc.StatusCode() {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			overloaded = true
+		}
+	}
+	s.priority.observe(time.Since(start), overloaded)
+}
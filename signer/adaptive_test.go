@@ -0,0 +1,124 @@
+package signer
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/errs"
+)
+
+func TestAdaptiveConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    PriorityConfig
+		ok   bool
+	}{
+		{"enabled", PriorityConfig{MaxConcurrent: 8, Adaptive: AdaptiveConfig{Enabled: true, MinConcurrent: 2}}, true},
+		{"disabled", PriorityConfig{MaxConcurrent: 8, Adaptive: AdaptiveConfig{MinConcurrent: 20}}, true},
+		{"min above max", PriorityConfig{MaxConcurrent: 8, Adaptive: AdaptiveConfig{Enabled: true, MinConcurrent: 20}}, false},
+		{"negative min", PriorityConfig{MaxConcurrent: 8, Adaptive: AdaptiveConfig{Enabled: true, MinConcurrent: -1}}, false},
+		{"without limit", PriorityConfig{Adaptive: AdaptiveConfig{Enabled: true}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	if c := (AdaptiveConfig{TargetLatency: "-1s"}); c.GetMinConcurrent() != 1 || c.GetTargetLatency() != time.Second || c.GetWindow() != time.Second {
+		t.Errorf("defaults = %d, %v, %v", c.GetMinConcurrent(), c.GetTargetLatency(), c.GetWindow())
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	s := newPriorityScheduler(PriorityConfig{
+		MaxConcurrent: 10,
+		Classes:       []PriorityClass{{Name: "critical", Weight: 4}, {Name: "renewal", Weight: 2}, {Name: "bulk", Weight: 1}},
+		Adaptive:      AdaptiveConfig{Enabled: true, MinConcurrent: 2, TargetLatency: "100ms", Window: "1ns"},
+	})
+	shed := func() (classes []string) {
+		for _, q := range s.order {
+			if q.shed {
+				classes = append(classes, q.name)
+			}
+		}
+		return classes
+	}
+
+	steps := []struct {
+		latency    time.Duration
+		overloaded bool
+		limit      int
+		shed       []string
+	}{
+		{time.Second, false, 9, nil},
+		{time.Millisecond, false, 10, nil},
+		{time.Millisecond, false, 10, nil},
+		{time.Millisecond, true, 9, nil},
+		{time.Second, false, 8, nil},
+		{time.Second, false, 7, []string{"bulk"}},
+		{time.Second, false, 6, []string{"bulk"}},
+		{time.Second, false, 5, []string{"bulk"}},
+		{time.Second, false, 4, []string{"renewal", "bulk"}},
+		{time.Second, false, 3, []string{"renewal", "bulk"}},
+		{time.Second, false, 2, []string{"renewal", "bulk"}},
+		{time.Second, false, 2, []string{"renewal", "bulk"}},
+		{time.Millisecond, false, 3, []string{"renewal", "bulk"}},
+		{time.Millisecond, false, 4, []string{"renewal", "bulk"}},
+		{time.Millisecond, false, 5, []string{"bulk"}},
+		{time.Millisecond, false, 6, []string{"bulk"}},
+	}
+	for i, step := range steps {
+		time.Sleep(time.Microsecond)
+		s.observe(step.latency, step.overloaded)
+		if s.limit != step.limit || !sameStrings(shed(), step.shed) {
+			t.Errorf("step %d: limit %d, shed %v, want %d, %v", i, s.limit, shed(), step.limit, step.shed)
+		}
+		if got := testutil.ToFloat64(signConcurrencyLimit); got != float64(s.limit) {
+			t.Errorf("step %d: limit metric = %v, want %d", i, got, s.limit)
+		}
+	}
+
+	for range s.limit {
+		if err := s.acquire(context.Background(), "critical"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.acquire(context.Background(), "bulk"); err != errShed {
+		t.Errorf("acquire() of a shed class = %v, want %v", err, errShed)
+	}
+	queued := make(chan error)
+	go func() { queued <- s.acquire(context.Background(), "renewal") }()
+	waitQueued(t, s, 1)
+	for s.limit > 4 {
+		time.Sleep(time.Microsecond)
+		s.observe(time.Second, false)
+	}
+	if err := <-queued; err != errShed {
+		t.Errorf("acquire() of a waiting request of a newly shed class = %v, want %v", err, errShed)
+	}
+	if s.queued != 0 {
+		t.Errorf("queued = %d after shedding, want 0", s.queued)
+	}
+}
+
+func TestObserveUpstream(t *testing.T) {
+	(&server{}).observeUpstream(time.Now(), nil)
+
+	s := &server{priority: newPriorityScheduler(PriorityConfig{
+		MaxConcurrent: 4,
+		Adaptive:      AdaptiveConfig{Enabled: true, TargetLatency: "1h", Window: "1ns"},
+	})}
+	time.Sleep(time.Microsecond)
+	s.observeUpstream(time.Now(), errs.New(http.StatusServiceUnavailable, "busy"))
+	if s.priority.limit != 3 {
+		t.Errorf("limit after an overloaded upstream = %d, want 3", s.priority.limit)
+	}
+	time.Sleep(time.Microsecond)
+	s.observeUpstream(time.Now(), errs.New(http.StatusBadRequest, "invalid"))
+	if s.priority.limit != 4 {
+		t.Errorf("limit after a rejected request = %d, want 4", s.priority.limit)
+	}
+}
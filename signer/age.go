@@ -0,0 +1,97 @@
+package signer
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+)
+
+// ageWrapper wraps data keys for age X25519 recipients, and unwraps them
+// with the age identities. A wrapped key can be decrypted with
+// "age -d -i key.txt".
+type ageWrapper struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// newAgeWrapper parses the recipients and reads the identity files.
+func newAgeWrapper(c AgeConfig) (*ageWrapper, error) {
+	w := &ageWrapper{}
+	for _, r := range c.Recipients {
+		pub, err := parseAgeRecipient(r)
+		if err != nil {
+			return nil, err
+		}
+		w.recipients = append(w.recipients, pub)
+	}
+	for _, name := range c.IdentityFiles {
+		ids, err := readAgeIdentities(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading age identities from %s", name)
+		}
+		w.identities = append(w.identities, ids...)
+	}
+
+	return w, nil
+}
+
+func (w *ageWrapper) Name() string {
+	return "age"
+}
+
+// parseAgeRecipient parses an age1... X25519 recipient.
+func parseAgeRecipient(s string) (*age.X25519Recipient, error) {
+	r, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		return nil, errors.Errorf("invalid age recipient %q", s)
+	}
+
+	return r, nil
+}
+
+// readAgeIdentities reads the AGE-SECRET-KEY-1... lines of an identity file,
+// as written by age-keygen.
+func readAgeIdentities(name string) ([]age.Identity, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return age.ParseIdentities(f)
+}
+
+// Wrap encrypts a data key to the recipients in the age format.
+func (w *ageWrapper) Wrap(plaintext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	aw, err := age.Encrypt(&buf, w.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := aw.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unwrap decrypts a data key wrapped by Wrap, or by age for one of the
+// identities.
+func (w *ageWrapper) Unwrap(data []byte) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(data), w.identities...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decrypting age wrapped key")
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid age payload")
+	}
+
+	return plaintext, nil
+}
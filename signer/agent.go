@@ -0,0 +1,473 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// Annotations of the secrets written by the agent.
+const (
+	agentRenewAfterAnnotation = "ca-signer.fyve.io/renew-after"
+	agentSerialAnnotation     = "ca-signer.fyve.io/serial"
+)
+
+// agentOptions are the flags of "ca-signer agent".
+type agentOptions struct {
+	signer    string
+	root      string
+	cert, key string
+	tokenFile string
+	subject   string
+	sans      stringList
+	keyType   string
+	notAfter  string
+	secret    string
+	dir       string
+	keyMode   string
+	once      bool
+	hook      *rotateHook
+}
+
+// agentCredentials are the certificate, chain and key written by the
+// agent.
+type agentCredentials struct {
+	chain      []*x509.Certificate
+	keyPEM     []byte
+	renewAfter time.Time
+}
+
+// certPEM returns the leaf and intermediates in PEM.
+func (c agentCredentials) certPEM() []byte {
+	var buf bytes.Buffer
+	for _, cert := range c.chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// agentStore is where the agent writes the credentials: a Kubernetes
+// secret or a directory.
+type agentStore interface {
+	// Load returns the leaf and the renewal time of the stored
+	// credentials, or a nil leaf if there are none.
+	Load(ctx context.Context) (*x509.Certificate, time.Time, error)
+	Store(ctx context.Context, c agentCredentials, ca []byte) error
+}
+
+// runAgentCommand implements "ca-signer agent". Instead of serving the
+// API, it requests a certificate for the configured identity from a signer,
+// writes it with its key to a Kubernetes secret or files, and renews it at
+// the suggested renewal time, for workloads that cannot call the signer.
+func runAgentCommand(args []string) int {
+	var o agentOptions
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.StringVar(&o.signer, "signer", "", "base URL of the signer, e.g. https://ca-signer:4443")
+	fs.StringVar(&o.root, "root", "", "root certificate trusted for the signer, also written as ca.crt")
+	fs.StringVar(&o.cert, "cert", "", "client certificate for mTLS")
+	fs.StringVar(&o.key, "key", "", "client key for mTLS")
+	fs.StringVar(&o.tokenFile, "token-file", "", "file holding a bearer token, read on each request")
+	fs.StringVar(&o.subject, "subject", "", "common name, defaults to the first SAN")
+	fs.Var(&o.sans, "san", "subject alternative name, can be repeated")
+	fs.StringVar(&o.keyType, "key-type", "EC", "key type: EC (P-256) or RSA (2048)")
+	fs.StringVar(&o.notAfter, "not-after", "", "lifetime requested, e.g. 24h")
+	fs.StringVar(&o.secret, "secret", "", "Kubernetes secret written, as name or namespace/name")
+	fs.StringVar(&o.dir, "dir", "", "directory tls.crt, tls.key and ca.crt are written to")
+	fs.StringVar(&o.keyMode, "key-mode", "0600", "file mode of tls.key with --dir, e.g. 0640 for a group shared with the application")
+	fs.BoolVar(&o.once, "once", false, "exit after the certificate is written")
+	sig := fs.String("signal", "HUP", "signal sent on rotation to the process of --pid-file or --process")
+	pidFile := fs.String("pid-file", "", "file holding the pid of the process signaled on rotation")
+	process := fs.String("process", "", "name of the process signaled on rotation, requires shareProcessNamespace")
+	command := fs.String("exec", "", "command run with /bin/sh on rotation")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if o.signer == "" || len(o.sans) == 0 || (o.secret == "") == (o.dir == "") || (o.keyType != "EC" && o.keyType != "RSA") {
+		fmt.Fprintln(os.Stderr, "usage: ca-signer agent --signer <url> --san <name>... (--secret [namespace/]name | --dir <dir>) [--root <file>] [--cert <file> --key <file> | --token-file <file>]")
+		return exitUsage
+	}
+
+	keyMode, err := strconv.ParseUint(o.keyMode, 8, 32)
+	if err != nil || keyMode&^0o777 != 0 {
+		fmt.Fprintf(os.Stderr, "invalid --key-mode %q\n", o.keyMode)
+		return exitUsage
+	}
+	if o.hook, err = newRotateHook(*sig, *pidFile, *process, *command); err != nil {
+		fmt.Fprintf(os.Stderr, "error configuring rotation hook: %v\n", err)
+		return exitUsage
+	}
+
+	client, err := benchClient(benchOptions{cert: o.cert, key: o.key, root: o.root, concurrency: 1})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error configuring TLS: %v\n", err)
+		return exitUsage
+	}
+	var ca []byte
+	if o.root != "" {
+		if ca, err = os.ReadFile(o.root); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading root: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	var store agentStore
+	if o.secret != "" {
+		if store, err = newSecretStore(o.secret); err != nil {
+			fmt.Fprintf(os.Stderr, "error configuring secret: %v\n", err)
+			return exitUsage
+		}
+	} else {
+		store = dirStore{dir: o.dir, keyMode: os.FileMode(keyMode)}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := runAgent(ctx, client, store, ca, o); err != nil {
+		logFor("agent").WithField("error", err).Error("Agent stopped")
+		return exitError
+	}
+
+	return 0
+}
+
+// runAgent issues and renews the certificate until ctx is done. Errors are
+// retried with an exponential backoff, up to 5 minutes between attempts.
+func runAgent(ctx context.Context, client *http.Client, store agentStore, ca []byte, o agentOptions) error {
+	logger := logFor("agent").WithField("sans", []string(o.sans))
+	next := time.Now()
+	if leaf, renewAfter, err := store.Load(ctx); err != nil {
+		logger.WithField("error", err).Warn("Error loading the stored certificate")
+	} else if leaf != nil && coversNames(leaf, o.sans) && time.Now().Before(leaf.NotAfter) {
+		next = renewAfter
+		logger.WithFields(log.Fields{
+			"serial":     leaf.SerialNumber.String(),
+			"renewAfter": renewAfter,
+		}).Info("Using the stored certificate")
+	}
+
+	backoff := time.Second
+	for {
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+		}
+
+		c, err := agentIssue(ctx, client, o)
+		if err == nil {
+			err = store.Store(ctx, c, ca)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger.WithFields(log.Fields{
+				"error": err,
+				"retry": backoff,
+			}).Error("Error renewing the certificate")
+			next = time.Now().Add(backoff)
+			backoff = min(backoff*2, 5*time.Minute)
+			continue
+		}
+
+		backoff = time.Second
+		next = c.renewAfter
+		logger.WithFields(log.Fields{
+			"serial":     c.chain[0].SerialNumber.String(),
+			"notAfter":   c.chain[0].NotAfter,
+			"renewAfter": c.renewAfter,
+		}).Info("Wrote the certificate")
+		if o.hook != nil {
+			if err := o.hook.run(ctx); err != nil {
+				logger.WithField("error", err).Warn("Error notifying the rotation")
+			}
+		}
+		if o.once {
+			return nil
+		}
+	}
+}
+
+// agentIssue generates a key and requests its certificate from the
+// signer.
+func agentIssue(ctx context.Context, client *http.Client, o agentOptions) (agentCredentials, error) {
+	key, csr, err := newKeyAndRequest(o.keyType, o.subject, o.sans)
+	if err != nil {
+		return agentCredentials{}, err
+	}
+	keyPEM, err := encodePEMBundle(key, nil)
+	if err != nil {
+		return agentCredentials{}, err
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"csr":      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+		"notAfter": o.notAfter,
+	})
+	if err != nil {
+		return agentCredentials{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(o.signer, "/")+"/v1/sign", bytes.NewReader(payload))
+	if err != nil {
+		return agentCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.tokenFile != "" {
+		token, err := readPasswordFromFile(o.tokenFile)
+		if err != nil {
+			return agentCredentials{}, errors.Wrap(err, "error reading token")
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return agentCredentials{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return agentCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return agentCredentials{}, errors.Errorf("signer answered %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var body renewableResponse
+	if err := json.Unmarshal(data, &body); err != nil {
+		return agentCredentials{}, errors.Wrap(err, "error decoding sign response")
+	}
+	c := agentCredentials{keyPEM: keyPEM, renewAfter: body.RenewAfter}
+	for _, cert := range body.CertChainPEM {
+		if cert.Certificate != nil {
+			c.chain = append(c.chain, cert.Certificate)
+		}
+	}
+	if len(c.chain) == 0 {
+		return agentCredentials{}, errors.New("signer returned no certificate")
+	}
+	if _, err := tls.X509KeyPair(c.certPEM(), keyPEM); err != nil {
+		return agentCredentials{}, errors.Wrap(err, "signer returned a certificate for another key")
+	}
+	if c.renewAfter.IsZero() {
+		c.renewAfter = defaultRenewAfter(c.chain[0])
+	}
+
+	return c, nil
+}
+
+// defaultRenewAfter returns the time two thirds into the lifetime of cert,
+// when the signer does not suggest one.
+func defaultRenewAfter(cert *x509.Certificate) time.Time {
+	return cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 2 / 3)
+}
+
+// coversNames returns true if cert has all the SANs.
+func coversNames(cert *x509.Certificate, sans []string) bool {
+	have := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		have = append(have, ip.String())
+	}
+	for _, u := range cert.URIs {
+		have = append(have, u.String())
+	}
+	for _, san := range sans {
+		if !policy.ContainsAny(have, []string{san}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dirStore writes tls.crt, tls.key and ca.crt to a directory. The key is
+// written first, so readers may briefly see the new key with the old
+// certificate; they should reload on changes of tls.crt, or be notified by
+// the rotation hook.
+type dirStore struct {
+	dir     string
+	keyMode os.FileMode
+}
+
+func (s dirStore) Load(context.Context) (*x509.Certificate, time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, "tls.crt"))
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, time.Time{}, errors.New("no certificate found in tls.crt")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return cert, defaultRenewAfter(cert), nil
+}
+
+func (s dirStore) Store(_ context.Context, c agentCredentials, ca []byte) error {
+	if err := writeFileAtomic(filepath.Join(s.dir, "tls.key"), c.keyPEM, s.keyMode); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, "tls.crt"), c.certPEM(), 0o644); err != nil {
+		return err
+	}
+	if len(ca) > 0 {
+		return writeFileAtomic(filepath.Join(s.dir, "ca.crt"), ca, 0o644)
+	}
+
+	return nil
+}
+
+// secret is the subset of the v1 Secret written by the agent.
+type secret struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+		Labels          map[string]string `json:"labels,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Type string            `json:"type"`
+	Data map[string][]byte `json:"data"`
+}
+
+// secretStore writes a kubernetes.io/tls secret with tls.crt, tls.key and
+// ca.crt. The service account of the pod must be able to get, create and
+// update it.
+type secretStore struct {
+	kube      *kubeClient
+	namespace string
+	name      string
+}
+
+func newSecretStore(ref string) (*secretStore, error) {
+	kube, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		namespace, name = podNamespace(), ref
+	}
+
+	return &secretStore{kube: kube, namespace: namespace, name: name}, nil
+}
+
+func (s *secretStore) path() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/secrets", s.namespace)
+}
+
+// get returns the secret, or nil if it does not exist.
+func (s *secretStore) get(ctx context.Context) (*secret, error) {
+	resp, err := s.kube.do(ctx, http.MethodGet, s.path()+"/"+s.name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var sec secret
+		if err := json.NewDecoder(resp.Body).Decode(&sec); err != nil {
+			return nil, errors.Wrap(err, "error decoding secret")
+		}
+		return &sec, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unexpected status %d getting secret", resp.StatusCode)
+	}
+}
+
+func (s *secretStore) Load(ctx context.Context) (*x509.Certificate, time.Time, error) {
+	sec, err := s.get(ctx)
+	if err != nil || sec == nil {
+		return nil, time.Time{}, err
+	}
+	block, _ := pem.Decode(sec.Data["tls.crt"])
+	if block == nil {
+		return nil, time.Time{}, nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	renewAfter, err := time.Parse(time.RFC3339, sec.Metadata.Annotations[agentRenewAfterAnnotation])
+	if err != nil {
+		renewAfter = defaultRenewAfter(cert)
+	}
+
+	return cert, renewAfter, nil
+}
+
+func (s *secretStore) Store(ctx context.Context, c agentCredentials, ca []byte) error {
+	sec, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	method, path := http.MethodPut, s.path()+"/"+s.name
+	if sec == nil {
+		sec = &secret{APIVersion: "v1", Kind: "Secret", Type: "kubernetes.io/tls"}
+		sec.Metadata.Name, sec.Metadata.Namespace = s.name, s.namespace
+		method, path = http.MethodPost, s.path()
+	}
+	if sec.Metadata.Labels == nil {
+		sec.Metadata.Labels = map[string]string{}
+	}
+	if sec.Metadata.Annotations == nil {
+		sec.Metadata.Annotations = map[string]string{}
+	}
+	if sec.Data == nil {
+		sec.Data = map[string][]byte{}
+	}
+	sec.Metadata.Labels["app.kubernetes.io/managed-by"] = "ca-signer"
+	sec.Metadata.Annotations[agentRenewAfterAnnotation] = c.renewAfter.UTC().Format(time.RFC3339)
+	sec.Metadata.Annotations[agentSerialAnnotation] = c.chain[0].SerialNumber.String()
+	sec.Data["tls.crt"], sec.Data["tls.key"] = c.certPEM(), c.keyPEM
+	if len(ca) > 0 {
+		sec.Data["ca.crt"] = ca
+	}
+
+	body, err := json.Marshal(sec)
+	if err != nil {
+		return err
+	}
+	resp, err := s.kube.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("unexpected status %d writing secret", resp.StatusCode)
+	}
+
+	return nil
+}
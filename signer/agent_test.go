@@ -0,0 +1,147 @@
+package signer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/api"
+)
+
+// newTestAgentSigner starts a signer issuing the CSRs of the sign requests
+// with a test CA for an hour, suggesting renewal after renewAfter if it is
+// set. Requests without the bearer token, if set, are rejected.
+func newTestAgentSigner(t *testing.T, token string, renewAfter time.Time) *httptest.Server {
+	t.Helper()
+	root, rootKey := newTestCert(t, "Root CA")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body SignRequest
+		if r.URL.Path != "/v1/sign" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		csr := body.CsrPEM.CertificateRequest
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, root, csr.PublicKey, rootKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cert, _ := x509.ParseCertificate(der)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(renewableResponse{
+			SignResponse: &api.SignResponse{
+				ServerPEM:    api.NewCertificate(cert),
+				CaPEM:        api.NewCertificate(root),
+				CertChainPEM: []api.Certificate{api.NewCertificate(cert), api.NewCertificate(root)},
+			},
+			RenewAfter: renewAfter,
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestAgentIssue(t *testing.T) {
+	renewAfter := time.Now().Add(30 * time.Minute).UTC().Truncate(time.Second)
+	srv := newTestAgentSigner(t, "secret", renewAfter)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := writeFile(tokenFile, "secret\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	o := agentOptions{signer: srv.URL + "/", tokenFile: tokenFile, sans: stringList{"app.example.com"}, keyType: "EC"}
+	c, err := agentIssue(context.Background(), srv.Client(), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.chain) != 2 || !coversNames(c.chain[0], o.sans) || !c.renewAfter.Equal(renewAfter) || len(c.keyPEM) == 0 {
+		t.Errorf("agentIssue() = %d certificates, renew after %v, want the chain renewed after %v", len(c.chain), c.renewAfter, renewAfter)
+	}
+	if coversNames(c.chain[0], []string{"app.example.com", "other.example.com"}) {
+		t.Error("coversNames() of a missing name = true")
+	}
+
+	o.tokenFile = ""
+	if _, err := agentIssue(context.Background(), srv.Client(), o); err == nil {
+		t.Error("agentIssue() of a rejected request error = nil")
+	}
+
+	// Without a suggestion, renew after two thirds of the lifetime.
+	srv = newTestAgentSigner(t, "", time.Time{})
+	o.signer = srv.URL
+	c, err = agentIssue(context.Background(), srv.Client(), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.renewAfter.Equal(defaultRenewAfter(c.chain[0])) {
+		t.Errorf("renewAfter = %v, want %v", c.renewAfter, defaultRenewAfter(c.chain[0]))
+	}
+}
+
+func TestRunAgentDir(t *testing.T) {
+	srv := newTestAgentSigner(t, "", time.Time{})
+	dir := filepath.Join(t.TempDir(), "tls")
+	store := dirStore{dir: dir, keyMode: 0o640}
+	if leaf, _, err := store.Load(context.Background()); leaf != nil || err != nil {
+		t.Fatalf("Load() of an empty directory = %v, %v, want nothing", leaf, err)
+	}
+
+	o := agentOptions{signer: srv.URL, sans: stringList{"app.example.com"}, keyType: "RSA", once: true}
+	if err := runAgent(context.Background(), srv.Client(), store, []byte("root"), o); err != nil {
+		t.Fatal(err)
+	}
+	leaf, renewAfter, err := store.Load(context.Background())
+	if err != nil || leaf == nil || !coversNames(leaf, o.sans) || !renewAfter.Equal(defaultRenewAfter(leaf)) {
+		t.Fatalf("Load() = %v, %v, %v, want the written certificate", leaf, renewAfter, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "tls.key")); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Errorf("tls.key = %v, %v, want mode 0640", fi, err)
+	}
+	if ca, err := os.ReadFile(filepath.Join(dir, "ca.crt")); err != nil || string(ca) != "root" {
+		t.Errorf("ca.crt = %q, %v, want the root", ca, err)
+	}
+
+	// A valid certificate for the names is kept until its renewal time.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := runAgent(ctx, srv.Client(), store, nil, o); err != nil {
+		t.Fatal(err)
+	}
+	if again, _, _ := store.Load(context.Background()); !again.Equal(leaf) {
+		t.Error("runAgent() renewed a valid certificate")
+	}
+}
+
+func TestRunAgentCommandUsage(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"-signer", "https://signer", "-san", "app.example.com"},
+		{"-signer", "https://signer", "-san", "app.example.com", "-dir", "/tmp", "-secret", "tls"},
+		{"-signer", "https://signer", "-san", "app.example.com", "-dir", "/tmp", "-key-type", "DSA"},
+		{"-signer", "https://signer", "-san", "app.example.com", "-dir", "/tmp", "-key-mode", "1777"},
+	} {
+		if got := runAgentCommand(args); got != exitUsage {
+			t.Errorf("runAgentCommand(%q) = %d, want %d", args, got, exitUsage)
+		}
+	}
+}
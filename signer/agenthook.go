@@ -0,0 +1,141 @@
+package signer
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rotateHookTimeout is the timeout of the --exec command.
+const rotateHookTimeout = time.Minute
+
+// signals are the signals --signal accepts.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"QUIT": syscall.SIGQUIT,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// rotateHook notifies the co-located process that the certificate files
+// changed, like consul-template: it sends a signal to the process in a pid
+// file or named after a command, and runs a command.
+type rotateHook struct {
+	signal  syscall.Signal
+	pidFile string
+	process string
+	command string
+}
+
+// newRotateHook returns the hook of the --signal, --pid-file, --process and
+// --exec flags, or nil if none is set.
+func newRotateHook(signal, pidFile, process, command string) (*rotateHook, error) {
+	if pidFile == "" && process == "" && command == "" {
+		return nil, nil
+	}
+	if pidFile != "" && process != "" {
+		return nil, errors.New("--pid-file and --process are mutually exclusive")
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(signal), "SIG")]
+	if !ok {
+		return nil, errors.Errorf("unsupported signal %q", signal)
+	}
+
+	return &rotateHook{signal: sig, pidFile: pidFile, process: process, command: command}, nil
+}
+
+// run signals the process and runs the command, returning the first
+// error. The command runs even if the process could not be signaled.
+func (h *rotateHook) run(ctx context.Context) error {
+	var err error
+	if h.pidFile != "" || h.process != "" {
+		err = h.kill()
+	}
+	if h.command != "" {
+		ctx, cancel := context.WithTimeout(ctx, rotateHookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if cerr := cmd.Run(); cerr != nil && err == nil {
+			err = errors.Wrapf(cerr, "error running %q", h.command)
+		}
+	}
+
+	return err
+}
+
+// kill sends the signal to the process, found when it is sent so a
+// restarted process is signaled too.
+func (h *rotateHook) kill() error {
+	var pids []int
+	if h.pidFile != "" {
+		data, err := os.ReadFile(h.pidFile)
+		if err != nil {
+			return errors.Wrap(err, "error reading pid file")
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return errors.Wrapf(err, "invalid pid file %s", h.pidFile)
+		}
+		pids = []int{pid}
+	} else {
+		var err error
+		if pids, err = findProcesses(h.process); err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return errors.Errorf("no process named %s, the pod needs shareProcessNamespace", h.process)
+		}
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, h.signal); err != nil {
+			return errors.Wrapf(err, "error signaling process %d", pid)
+		}
+	}
+
+	return nil
+}
+
+// findProcesses returns the processes other than the agent whose command
+// name, or the base name of their executable, is name.
+func findProcesses(name string) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing processes")
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", e.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+			continue
+		}
+		// comm is truncated to 15 characters.
+		cmdline, err := os.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		argv0, _, _ := strings.Cut(string(cmdline), "\x00")
+		if argv0 != "" && filepath.Base(argv0) == name {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
@@ -0,0 +1,86 @@
+package signer
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewRotateHook(t *testing.T) {
+	tests := []struct {
+		name                              string
+		signal, pidFile, process, command string
+		ok                                bool
+		want                              syscall.Signal
+	}{
+		{"none", "HUP", "", "", "", true, 0},
+		{"pid file", "sigusr1", "/run/app.pid", "", "", true, syscall.SIGUSR1},
+		{"process", "TERM", "", "nginx", "nginx -s reload", true, syscall.SIGTERM},
+		{"both", "HUP", "/run/app.pid", "nginx", "", false, 0},
+		{"signal", "KILL", "/run/app.pid", "", "", false, 0},
+	}
+	for _, tt := range tests {
+		h, err := newRotateHook(tt.signal, tt.pidFile, tt.process, tt.command)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: newRotateHook() = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if h != nil && h.signal != tt.want {
+			t.Errorf("%s: signal = %v, want %v", tt.name, h.signal, tt.want)
+		}
+	}
+}
+
+func TestRotateHookRun(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer cmd.Process.Kill()
+
+	dir := t.TempDir()
+	pidFile, marker := filepath.Join(dir, "app.pid"), filepath.Join(dir, "rotated")
+	if err := writeFile(pidFile, strconv.Itoa(cmd.Process.Pid)+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	if pids, err := findProcesses("sleep"); err != nil || !slices.Contains(pids, cmd.Process.Pid) {
+		t.Errorf("findProcesses() = %v, %v, want the sleep process", pids, err)
+	}
+
+	h, err := newRotateHook("TERM", pidFile, "", "touch "+marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.run(context.Background()); err != nil {
+		t.Fatalf("run() = %v", err)
+	}
+	select {
+	case err := <-exited:
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || ws.Signal() != syscall.SIGTERM {
+			t.Errorf("process exited with %v, want SIGTERM", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("process was not signaled")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("command did not run: %v", err)
+	}
+
+	// The command runs even if the process is gone.
+	os.Remove(marker)
+	h.pidFile = filepath.Join(dir, "missing.pid")
+	if err := h.run(context.Background()); err == nil {
+		t.Error("run() with a missing pid file error = nil")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("command did not run after the signal failed: %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Anomaly types.
+const (
+	anomalySpike        = "issuance-spike"
+	anomalyNewRequester = "new-requester"
+	anomalyLongLifetime = "long-lifetime"
+)
+
+// AnomalyConfig configures the detection of unusual issuance patterns,
+// reported to alert webhooks.
+type AnomalyConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	Webhooks       []string `yaml:"webhooks"`
+	SpikeWindow    string   `yaml:"spikeWindow"`
+	SpikeFactor    float64  `yaml:"spikeFactor"`
+	SpikeMinimum   int      `yaml:"spikeMinimum"`
+	MaxLifetime    string   `yaml:"maxLifetime"`
+	LearningPeriod string   `yaml:"learningPeriod"`
+	Timeout        string   `yaml:"timeout"`
+}
+
+// GetSpikeWindow returns the window issuance is counted in, defaults to 1h.
+func (c AnomalyConfig) GetSpikeWindow() time.Duration {
+	if d, err := time.ParseDuration(c.SpikeWindow); err == nil && d > 0 {
+		return d
+	}
+
+	return time.Hour
+}
+
+// GetSpikeFactor returns how many times the count of the previous window a
+// domain must reach to spike, defaults to 5.
+func (c AnomalyConfig) GetSpikeFactor() float64 {
+	if c.SpikeFactor > 0 {
+		return c.SpikeFactor
+	}
+
+	return 5
+}
+
+// GetSpikeMinimum returns the minimum count of a spike, defaults to 20.
+func (c AnomalyConfig) GetSpikeMinimum() int {
+	if c.SpikeMinimum > 0 {
+		return c.SpikeMinimum
+	}
+
+	return 20
+}
+
+// GetMaxLifetime returns the longest usual certificate lifetime, 0 disables
+// the detector.
+func (c AnomalyConfig) GetMaxLifetime() time.Duration {
+	d, _ := time.ParseDuration(c.MaxLifetime)
+	return d
+}
+
+// GetLearningPeriod returns how long after startup requesters are learned
+// without alerts, defaults to 24h.
+func (c AnomalyConfig) GetLearningPeriod() time.Duration {
+	if d, err := time.ParseDuration(c.LearningPeriod); err == nil {
+		return d
+	}
+
+	return 24 * time.Hour
+}
+
+// GetTimeout returns the timeout of the webhook calls, defaults to 10s.
+func (c AnomalyConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 10 * time.Second
+}
+
+// Validate checks the webhooks and durations.
+func (c AnomalyConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Webhooks) == 0 {
+		return errors.New("anomalies.webhooks is required when anomaly detection is enabled")
+	}
+	for name, v := range map[string]string{
+		"spikeWindow":    c.SpikeWindow,
+		"maxLifetime":    c.MaxLifetime,
+		"learningPeriod": c.LearningPeriod,
+		"timeout":        c.Timeout,
+	} {
+		if _, err := time.ParseDuration(v); v != "" && err != nil {
+			return errors.Errorf("invalid anomalies.%s %q", name, v)
+		}
+	}
+
+	return nil
+}
+
+// anomaly is the JSON document posted to the alert webhooks.
+type anomaly struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message"`
+	Client   []string  `json:"client"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	Subject  string    `json:"subject,omitempty"`
+	Serial   string    `json:"serial,omitempty"`
+	Domain   string    `json:"domain,omitempty"`
+	Count    int       `json:"count,omitempty"`
+	Baseline int       `json:"baseline,omitempty"`
+	Lifetime string    `json:"lifetime,omitempty"`
+}
+
+// anomalyDetector watches the issued certificates. Its state is kept in
+// memory, so each replica detects the anomalies of its own traffic.
+type anomalyDetector struct {
+	config  AnomalyConfig
+	client  *http.Client
+	started time.Time
+
+	mu         sync.Mutex
+	window     time.Time
+	counts     map[string]int
+	previous   map[string]int
+	alerted    map[string]bool
+	requesters map[string]bool
+}
+
+func newAnomalyDetector(c AnomalyConfig) *anomalyDetector {
+	return &anomalyDetector{
+		config:     c,
+		client:     &http.Client{Timeout: c.GetTimeout()},
+		started:    time.Now(),
+		counts:     map[string]int{},
+		previous:   map[string]int{},
+		alerted:    map[string]bool{},
+		requesters: map[string]bool{},
+	}
+}
+
+// Observe checks an issued certificate and alerts on the anomalies found in
+// the background.
+func (d *anomalyDetector) Observe(e hookEvent, cert *x509.Certificate) {
+	if d == nil {
+		return
+	}
+
+	base := anomaly{
+		Time:     e.Time,
+		Client:   e.Client,
+		Endpoint: e.Endpoint,
+		Subject:  e.Subject,
+		Serial:   e.Serial,
+	}
+	found := d.detect(e, base)
+	if limit := d.config.GetMaxLifetime(); limit > 0 && cert != nil {
+		if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime > limit {
+			a := base
+			a.Type = anomalyLongLifetime
+			a.Message = "certificate lifetime " + lifetime.String() + " is longer than " + limit.String()
+			a.Lifetime = lifetime.String()
+			found = append(found, a)
+		}
+	}
+
+	for _, a := range found {
+		d.Report(a)
+	}
+}
+
+// Report logs an anomaly and alerts the webhooks in the background. It is
+// used by the detectors and by the checks finding anomalies themselves.
+func (d *anomalyDetector) Report(a anomaly) {
+	if d == nil {
+		return
+	}
+
+	anomaliesDetected.WithLabelValues(a.Type).Inc()
+	logFor("anomalies").WithFields(log.Fields{
+		"type":   a.Type,
+		"client": a.Client,
+		"serial": a.Serial,
+	}).Warn(a.Message)
+	go d.alert(a)
+}
+
+// detect updates the requesters and the counts per domain and returns the
+// new requester and spike anomalies.
+func (d *anomalyDetector) detect(e hookEvent, base anomaly) []anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var found []anomaly
+	learning := time.Since(d.started) < d.config.GetLearningPeriod()
+	if len(e.Client) > 0 && !d.requesters[e.Client[0]] {
+		d.requesters[e.Client[0]] = true
+		if !learning {
+			a := base
+			a.Type = anomalyNewRequester
+			a.Message = "first certificate issued to " + e.Client[0]
+			found = append(found, a)
+		}
+	}
+
+	window := e.Time.Truncate(d.config.GetSpikeWindow())
+	if !d.window.Equal(window) {
+		d.previous = d.counts
+		if !window.Equal(d.window.Add(d.config.GetSpikeWindow())) {
+			d.previous = map[string]int{}
+		}
+		d.window = window
+		d.counts = map[string]int{}
+		d.alerted = map[string]bool{}
+	}
+	for _, domain := range registrableDomains(e.SANs) {
+		d.counts[domain]++
+		n, prev := d.counts[domain], d.previous[domain]
+		if d.alerted[domain] || n < d.config.GetSpikeMinimum() || float64(n) < d.config.GetSpikeFactor()*float64(prev) {
+			continue
+		}
+		d.alerted[domain] = true
+		a := base
+		a.Type = anomalySpike
+		a.Message = "issuance spike for " + domain
+		a.Domain = domain
+		a.Count = n
+		a.Baseline = prev
+		found = append(found, a)
+	}
+
+	return found
+}
+
+// alert posts the anomaly to every webhook.
+func (d *anomalyDetector) alert(a anomaly) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+
+	for _, url := range d.config.Webhooks {
+		err := func() error {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := d.client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				return errors.Errorf("webhook answered %s", resp.Status)
+			}
+			return nil
+		}()
+		if err != nil {
+			logFor("anomalies").WithFields(log.Fields{
+				"webhook": url,
+				"type":    a.Type,
+				"error":   err,
+			}).Error("Error sending anomaly alert")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAnomalyConfigValidate(t *testing.T) {
+	tests := []struct {
+		c  AnomalyConfig
+		ok bool
+	}{
+		{AnomalyConfig{}, true},
+		{AnomalyConfig{Enabled: true, Webhooks: []string{"https://soc"}, MaxLifetime: "2160h"}, true},
+		{AnomalyConfig{Enabled: true}, false},
+		{AnomalyConfig{Enabled: true, Webhooks: []string{"https://soc"}, SpikeWindow: "hourly"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v, want ok %v", tt.c, err, tt.ok)
+		}
+	}
+}
+
+func TestDetectSpike(t *testing.T) {
+	d := newAnomalyDetector(AnomalyConfig{SpikeWindow: "1h", SpikeFactor: 3, SpikeMinimum: 4})
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	issue := func(at time.Time, san string) []anomaly {
+		return d.detect(hookEvent{Time: at, SANs: []string{san}}, anomaly{})
+	}
+
+	// 2 in the first window, the baseline of the next one.
+	issue(start, "a.example.com")
+	issue(start.Add(time.Minute), "b.example.com")
+	var spikes []anomaly
+	for i := 0; i < 7; i++ {
+		spikes = append(spikes, issue(start.Add(time.Hour+time.Duration(i)*time.Minute), "x.example.com")...)
+	}
+	// The spike fires once, at 3 times the baseline of 2.
+	if len(spikes) != 1 || spikes[0].Type != anomalySpike || spikes[0].Domain != "example.com" ||
+		spikes[0].Count != 6 || spikes[0].Baseline != 2 {
+		t.Errorf("spikes = %+v, want one for example.com at 6 over 2", spikes)
+	}
+
+	// A window after a gap has no baseline, the minimum applies.
+	spikes = nil
+	for i := 0; i < 4; i++ {
+		spikes = append(spikes, issue(start.Add(5*time.Hour+time.Duration(i)*time.Minute), "y.example.org")...)
+	}
+	if len(spikes) != 1 || spikes[0].Domain != "example.org" || spikes[0].Baseline != 0 {
+		t.Errorf("spikes after a gap = %+v, want one for example.org at the minimum", spikes)
+	}
+}
+
+func TestDetectNewRequester(t *testing.T) {
+	d := newAnomalyDetector(AnomalyConfig{LearningPeriod: "1h"})
+	now := time.Now()
+	if found := d.detect(hookEvent{Time: now, Client: []string{"web"}}, anomaly{}); len(found) != 0 {
+		t.Errorf("learning: detect() = %+v, want none", found)
+	}
+
+	d.started = now.Add(-2 * time.Hour)
+	if found := d.detect(hookEvent{Time: now, Client: []string{"web"}}, anomaly{}); len(found) != 0 {
+		t.Errorf("learned requester: detect() = %+v, want none", found)
+	}
+	found := d.detect(hookEvent{Time: now, Client: []string{"batch"}}, anomaly{})
+	if len(found) != 1 || found[0].Type != anomalyNewRequester {
+		t.Errorf("new requester: detect() = %+v, want a new-requester anomaly", found)
+	}
+}
+
+func TestObserveLongLifetime(t *testing.T) {
+	alerts := make(chan anomaly, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a anomaly
+		json.NewDecoder(r.Body).Decode(&a)
+		alerts <- a
+	}))
+	defer srv.Close()
+
+	d := newAnomalyDetector(AnomalyConfig{Webhooks: []string{srv.URL}, MaxLifetime: "30m"})
+	cert, _ := newTestCert(t, "app.example.com")
+	d.Observe(hookEvent{Time: time.Now(), Client: []string{"web"}, Serial: "42"}, cert)
+
+	select {
+	case a := <-alerts:
+		if a.Type != anomalyLongLifetime || a.Serial != "42" || a.Lifetime != "1h1m0s" {
+			t.Errorf("alert = %+v, want a long-lifetime anomaly of 42", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not called")
+	}
+
+	var nilDetector *anomalyDetector
+	nilDetector.Observe(hookEvent{}, cert)
+}
@@ -0,0 +1,515 @@
+package signer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// Approval statuses.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalDenied   = "denied"
+	approvalIssued   = "issued"
+	approvalFailed   = "failed"
+)
+
+// approval is a sign request waiting for, or resolved by, an approver. The
+// response is kept until the approval expires so the requester can fetch it.
+type approval struct {
+	ID        string            `json:"id"`
+	Profile   string            `json:"profile"`
+	Status    string            `json:"status"`
+	Requester []string          `json:"requester"`
+	Subject   string            `json:"subject"`
+	SANs      []string          `json:"sans"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Approver  string            `json:"approver,omitempty"`
+	Reason    string            `json:"reason,omitempty"`
+	Created   time.Time         `json:"created"`
+	Expires   time.Time         `json:"expires"`
+	Response  *api.SignResponse `json:"response,omitempty"`
+	// RenewAfter is the suggested renewal time of the issued certificate.
+	RenewAfter *time.Time `json:"renewAfter,omitempty"`
+	// SCTs are the SCTs of the issued certificate in ct sync mode.
+	SCTs []signedCertificateTimestamp `json:"scts,omitempty"`
+
+	profile    *ProfileConfig
+	generation string
+	request    *SignRequest
+	event      hookEvent
+}
+
+// approvalStore keeps the approvals in memory, so the requester and the
+// approvers must reach the same replica, unless the inventory is enabled:
+// the approvals are then kept in its store, and survive restarts and are
+// shared by the replicas with Postgres.
+type approvalStore struct {
+	mu    sync.Mutex
+	items map[string]*approval
+
+	inv      *inventory
+	profiles []ProfileConfig
+}
+
+func newApprovalStore(inv *inventory, profiles []ProfileConfig) *approvalStore {
+	return &approvalStore{items: map[string]*approval{}, inv: inv, profiles: profiles}
+}
+
+// storedApproval is an approval in the store, with the request to issue
+// once approved. The profile is looked up by name when it is loaded.
+type storedApproval struct {
+	approval
+	Generation           string                 `json:"generation,omitempty"`
+	Request              *SignRequest           `json:"request"`
+	RedactCSR            bool                   `json:"redactCSR,omitempty"`
+	Extensions           []requestedExtension   `json:"extensions,omitempty"`
+	StrippedExtensions   []string               `json:"strippedExtensions,omitempty"`
+	PassthroughData      map[string]interface{} `json:"passthroughData,omitempty"`
+	PassthroughNotBefore bool                   `json:"passthroughNotBefore,omitempty"`
+	Event                hookEvent              `json:"event"`
+}
+
+func encodeApproval(a *approval) ([]byte, error) {
+	return json.Marshal(&storedApproval{
+		approval:             *a,
+		Generation:           a.generation,
+		Request:              a.request,
+		RedactCSR:            a.request.redactCSR,
+		Extensions:           a.request.extensions,
+		StrippedExtensions:   a.request.strippedExtensions,
+		PassthroughData:      a.request.templateData,
+		PassthroughNotBefore: a.request.notBefore,
+		Event:                a.event,
+	})
+}
+
+// decodeApproval returns a stored approval, or nil if its profile is no
+// longer configured.
+func (s *approvalStore) decodeApproval(data []byte) (*approval, error) {
+	var st storedApproval
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	a := &st.approval
+	for i := range s.profiles {
+		if s.profiles[i].Name == a.Profile {
+			a.profile = &s.profiles[i]
+		}
+	}
+	if a.profile == nil || st.Request == nil {
+		return nil, nil
+	}
+	st.Request.redactCSR = st.RedactCSR
+	st.Request.extensions, st.Request.strippedExtensions = st.Extensions, st.StrippedExtensions
+	st.Request.templateData, st.Request.notBefore = st.PassthroughData, st.PassthroughNotBefore
+	a.generation, a.request, a.event = st.Generation, st.Request, st.Event
+
+	return a, nil
+}
+
+// modify calls fn with the approval id if it has not expired, and saves it
+// if fn returns true. It returns false if the approval does not exist or fn
+// returned false.
+func (s *approvalStore) modify(id string, fn func(*approval) bool) (bool, error) {
+	if s.inv == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		a, ok := s.items[id]
+		return ok && !time.Now().After(a.Expires) && fn(a), nil
+	}
+
+	var ok bool
+	err := s.inv.update(func(tx store.Tx) error {
+		b := tx.Bucket(approvalsBucket)
+		ok = false
+		data := b.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		a, err := s.decodeApproval(data)
+		if err != nil || a == nil || time.Now().After(a.Expires) || !fn(a) {
+			return err
+		}
+		if data, err = encodeApproval(a); err != nil {
+			return err
+		}
+		ok = true
+		return b.Put([]byte(id), data)
+	})
+
+	return ok, err
+}
+
+func (s *approvalStore) add(a *approval) error {
+	now := time.Now()
+	if s.inv == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for id, item := range s.items {
+			if now.After(item.Expires) {
+				delete(s.items, id)
+			}
+		}
+		s.items[a.ID] = a
+		return nil
+	}
+
+	data, err := encodeApproval(a)
+	if err != nil {
+		return err
+	}
+	return s.inv.update(func(tx store.Tx) error {
+		b := tx.Bucket(approvalsBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var item approval
+			if err := json.Unmarshal(v, &item); err != nil || now.After(item.Expires) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte(a.ID), data)
+	})
+}
+
+// get returns a copy of an approval that has not expired.
+func (s *approvalStore) get(id string) (approval, bool, error) {
+	if s.inv == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		a, ok := s.items[id]
+		if !ok || time.Now().After(a.Expires) {
+			return approval{}, false, nil
+		}
+		return *a, true, nil
+	}
+
+	var a *approval
+	err := s.inv.view(func(tx store.Tx) error {
+		data := tx.Bucket(approvalsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var err error
+		a, err = s.decodeApproval(data)
+		return err
+	})
+	if err != nil || a == nil || time.Now().After(a.Expires) {
+		return approval{}, false, err
+	}
+
+	return *a, true, nil
+}
+
+// transition sets the status of a pending approval, and returns false if it
+// is no longer pending.
+func (s *approvalStore) transition(id, status, approver, reason string) (bool, error) {
+	return s.modify(id, func(a *approval) bool {
+		if a.Status != approvalPending {
+			return false
+		}
+		a.Status, a.Approver, a.Reason = status, approver, reason
+		return true
+	})
+}
+
+// resolve records the result of the issuance of an approved request.
+func (s *approvalStore) resolve(id string, resp *api.SignResponse, scts []signedCertificateTimestamp, err error) error {
+	_, serr := s.modify(id, func(a *approval) bool {
+		if err != nil {
+			a.Status, a.Reason = approvalFailed, err.Error()
+			return true
+		}
+		a.Status, a.Response, a.SCTs = approvalIssued, resp, scts
+		return true
+	})
+
+	return serr
+}
+
+// list returns the approvals matching fn, oldest first.
+func (s *approvalStore) list(fn func(*approval) bool) ([]approval, error) {
+	now := time.Now()
+	items := []approval{}
+	if s.inv == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for _, a := range s.items {
+			if now.Before(a.Expires) && fn(a) {
+				items = append(items, *a)
+			}
+		}
+	} else {
+		err := s.inv.view(func(tx store.Tx) error {
+			return tx.Bucket(approvalsBucket).ForEach(func(_, v []byte) error {
+				a, err := s.decodeApproval(v)
+				if err == nil && a != nil && now.Before(a.Expires) && fn(a) {
+					items = append(items, *a)
+				}
+				return err
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created.Before(items[j].Created)
+	})
+
+	return items, nil
+}
+
+// requestApproval checks the profile grant and limits of a request and
+// records it as pending.
+func (s *server) requestApproval(r *http.Request, generation string, request *SignRequest) (*approval, error) {
+	if s.approvals == nil {
+		return nil, errs.BadRequest("profiles are not available, the approvals feature is disabled")
+	}
+	profile, err := s.profileFor(r, request.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := limitNotAfter(request, profile.GetMaxDuration()); err != nil {
+		return nil, err
+	}
+	if err := checkRequiredMetadata(request.Metadata, profile.RequiredMetadata, profile.Name); err != nil {
+		return nil, err
+	}
+	event := newHookEvent(r, generation, request)
+	event.Severity = profile.GetSensitivity()
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errs.InternalServerErr(err)
+	}
+
+	now := time.Now().UTC()
+	a := &approval{
+		ID:         hex.EncodeToString(b),
+		Profile:    profile.Name,
+		Status:     approvalPending,
+		Requester:  clientIdentities(r),
+		Subject:    request.CsrPEM.Subject.CommonName,
+		SANs:       requestSANs(request),
+		Metadata:   request.Metadata,
+		Created:    now,
+		Expires:    now.Add(profile.GetApprovalTTL()),
+		profile:    profile,
+		generation: generation,
+		request:    request,
+		event:      event,
+	}
+	if err := s.approvals.add(a); err != nil {
+		return nil, errs.InternalServerErr(err)
+	}
+
+	logFor("approvals").WithFields(log.Fields{
+		"id":        a.ID,
+		"profile":   a.Profile,
+		"requester": a.Requester,
+		"subject":   a.Subject,
+		"metadata":  a.Metadata,
+	}).Info("Sign request waiting for approval")
+
+	return a, nil
+}
+
+// listApprovals returns the pending approvals the client can decide.
+func (s *server) listApprovals(w http.ResponseWriter, r *http.Request) {
+	items, err := s.approvals.list(func(a *approval) bool {
+		return a.Status == approvalPending && clientAllowed(r, a.profile.Approvers)
+	})
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	render.JSON(w, r, items)
+}
+
+// getApproval returns an approval to its requester or approvers. The response
+// is included once the certificate is issued.
+func (s *server) getApproval(w http.ResponseWriter, r *http.Request) {
+	a, ok, err := s.approvals.get(r.PathValue("id"))
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	if !ok || !(policy.ContainsAny(a.Requester, clientIdentities(r)) || clientAllowed(r, a.profile.Approvers)) {
+		render.Error(w, r, errs.NotFound("approval not found"))
+		return
+	}
+
+	s.renderApproval(w, r, a)
+}
+
+// renderApproval writes an approval with its response in the chain layout
+// requested in r. With format=pem only the certificate chain is written.
+func (s *server) renderApproval(w http.ResponseWriter, r *http.Request, a approval) {
+	opts, err := parseBundleOptions(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	if a.Response == nil {
+		render.JSON(w, r, a)
+		return
+	}
+	if opts.pem {
+		s.writeSignResponse(w, r, a.Response, nil, nil, opts, http.StatusOK)
+		return
+	}
+	s.setCertificateHeaders(w, a.Response)
+
+	if a.Response, err = s.bundle(a.Response, opts); err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	if cert := a.Response.ServerPEM.Certificate; cert != nil {
+		t := s.config.Renewal.renewAfter(cert)
+		a.RenewAfter = &t
+	}
+	render.JSON(w, r, a)
+}
+
+// ApprovalDecision is the optional body of POST /approvals/{id}/approve and
+// POST /approvals/{id}/deny.
+type ApprovalDecision struct {
+	Reason string `json:"reason"`
+}
+
+// decideApproval approves or denies a pending request. Approving issues the
+// certificate. Approvers cannot decide their own requests.
+func (s *server) decideApproval(w http.ResponseWriter, r *http.Request) {
+	action := r.PathValue("action")
+	if action != "approve" && action != "deny" {
+		render.Error(w, r, errs.NotFound("not found"))
+		return
+	}
+
+	if _, err := parseBundleOptions(r); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	var body ApprovalDecision
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+			return
+		}
+	}
+
+	a, ok, err := s.approvals.get(r.PathValue("id"))
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	clients := clientIdentities(r)
+	if !ok || !clientAllowed(r, a.profile.Approvers) {
+		render.Error(w, r, errs.NotFound("approval not found"))
+		return
+	}
+	if policy.ContainsAny(a.Requester, clients) {
+		render.Error(w, r, errs.Forbidden("requests cannot be approved by their requester"))
+		return
+	}
+
+	status := approvalApproved
+	if action == "deny" {
+		status = approvalDenied
+	}
+	if ok, err = s.approvals.transition(a.ID, status, clients[0], body.Reason); err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	if !ok {
+		render.Error(w, r, errs.New(http.StatusConflict, "approval is not pending"))
+		return
+	}
+
+	logger := logFor("approvals").WithFields(log.Fields{
+		"id":       a.ID,
+		"profile":  a.Profile,
+		"approver": clients[0],
+		"reason":   body.Reason,
+	})
+	if status == approvalDenied {
+		s.releaseQuota(a.event.Client)
+		logger.Info("Sign request denied by approver")
+		a.event.Decision = &policy.Decision{RuleID: "approval", Reason: body.Reason}
+		s.hooks.Fire(hookDenial, a.event)
+		a.Status, a.Approver, a.Reason = status, clients[0], body.Reason
+		s.renderApproval(w, r, a)
+		return
+	}
+
+	resp, err := s.issueApproved(r.Context(), a)
+	if serr := s.approvals.resolve(a.ID, resp, a.request.scts, err); serr != nil {
+		logger.WithField("error", serr).Error("Error recording the approval result")
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("Error issuing approved certificate")
+		s.releaseQuota(a.event.Client)
+		s.countSign(a.event.Client, a.generation, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	logger.Info("Issued approved certificate")
+	s.countSign(a.event.Client, a.generation, "issued", nil)
+	a.event.SCTs = a.request.scts
+	s.issued(a.event, resp)
+	a.Status, a.Approver, a.Reason = approvalIssued, clients[0], body.Reason
+	a.Response, a.SCTs = resp, a.request.scts
+	s.renderApproval(w, r, a)
+}
+
+// issueApproved signs an approved request with the template data of its
+// profile, and verifies the issued certificate matches the profile.
+func (s *server) issueApproved(ctx context.Context, a approval) (*api.SignResponse, error) {
+	data, err := json.Marshal(a.profile.templateData())
+	if err != nil {
+		return nil, errs.InternalServerErr(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeouts.GetSign())
+	defer cancel()
+
+	resp, err := s.issueWith(ctx, s.upstreamFor(a.generation), a.request, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.profile.Verify(resp.ServerPEM.Certificate); err != nil {
+		return nil, errs.Wrap(http.StatusBadGateway, err, "upstream CA did not apply the signing profile")
+	}
+
+	return resp, nil
+}
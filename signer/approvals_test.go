@@ -0,0 +1,183 @@
+package signer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+)
+
+var testProfiles = []ProfileConfig{
+	{Name: profileCodeSigning, Clients: []string{"ci"}, Approvers: []string{"security"}, MaxDuration: "1h"},
+}
+
+func TestApprovalStore(t *testing.T) {
+	for _, inv := range []*inventory{nil, newTestInventory(t)} {
+		name := "memory"
+		if inv != nil {
+			name = "inventory"
+		}
+		s := newApprovalStore(inv, testProfiles)
+		_, request := newPolicyTestRequest(t, "ci", "release.example.com")
+		now := time.Now().UTC()
+		add := func(id string, created time.Time, ttl time.Duration) {
+			a := &approval{
+				ID: id, Profile: profileCodeSigning, Status: approvalPending, Requester: []string{"ci"},
+				Created: created, Expires: created.Add(ttl), profile: &testProfiles[0], request: request,
+			}
+			if err := s.add(a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		add("b", now, time.Hour)
+		add("a", now.Add(-time.Minute), time.Hour)
+		add("expired", now.Add(-2*time.Hour), time.Hour)
+
+		if _, ok, err := s.get("expired"); ok || err != nil {
+			t.Errorf("%s: get(expired) = %v, %v, want not found", name, ok, err)
+		}
+		items, err := s.list(func(a *approval) bool { return a.Status == approvalPending })
+		if err != nil || len(items) != 2 || items[0].ID != "a" || items[1].ID != "b" {
+			t.Errorf("%s: list() = %v, %v, want a and b", name, items, err)
+		}
+
+		if ok, err := s.transition("a", approvalDenied, "security", "not a release"); !ok || err != nil {
+			t.Errorf("%s: transition(a) = %v, %v, want true", name, ok, err)
+		}
+		if ok, _ := s.transition("a", approvalApproved, "security", ""); ok {
+			t.Errorf("%s: transition() of a denied approval succeeded", name)
+		}
+		if a, _, _ := s.get("a"); a.Status != approvalDenied || a.Approver != "security" || a.Reason != "not a release" {
+			t.Errorf("%s: get(a) = %+v, want denied by security", name, a)
+		}
+
+		s.transition("b", approvalApproved, "security", "")
+		if err := s.resolve("b", nil, nil, errors.New("upstream down")); err != nil {
+			t.Fatal(err)
+		}
+		if b, ok, _ := s.get("b"); !ok || b.Status != approvalFailed || b.Reason != "upstream down" || b.profile == nil || b.request == nil {
+			t.Errorf("%s: get(b) = %+v, want failed with its profile and request", name, b)
+		}
+	}
+}
+
+// newApprovalTestServer returns a server with an in-memory approval store.
+func newApprovalTestServer() *server {
+	config := &Config{Profiles: append([]ProfileConfig{}, testProfiles...)}
+	return &server{config: config, hooks: newHookRunner(nil), approvals: newApprovalStore(nil, config.Profiles)}
+}
+
+func TestRequestApproval(t *testing.T) {
+	s := newApprovalTestServer()
+	r, request := newPolicyTestRequest(t, "ci", "release.example.com")
+	request.Profile = profileCodeSigning
+	a, err := s.requestApproval(r, generationStable, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != approvalPending || a.Subject != "release.example.com" || len(a.ID) != 32 {
+		t.Errorf("requestApproval() = %+v, want a pending approval", a)
+	}
+	if got, ok, _ := s.approvals.get(a.ID); !ok || got.Status != approvalPending {
+		t.Errorf("get(%s) = %+v, %v, want the pending approval", a.ID, got, ok)
+	}
+
+	r, request = newPolicyTestRequest(t, "web", "www.example.com")
+	request.Profile = profileCodeSigning
+	if _, err := s.requestApproval(r, generationStable, request); errorStatus(err) != http.StatusForbidden {
+		t.Errorf("requestApproval() of an ungranted client = %v, want 403", err)
+	}
+
+	if _, err := (&server{config: s.config}).requestApproval(r, generationStable, request); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("requestApproval() without approvals = %v, want 400", err)
+	}
+}
+
+func TestDecideApproval(t *testing.T) {
+	s := newApprovalTestServer()
+	r, request := newPolicyTestRequest(t, "ci", "release.example.com")
+	request.Profile = profileCodeSigning
+	a, err := s.requestApproval(r, generationStable, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decide := func(client, id, action, body string) *httptest.ResponseRecorder {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/approvals/"+id+"/"+action, strings.NewReader(body)), client)
+		r.SetPathValue("id", id)
+		r.SetPathValue("action", action)
+		w := httptest.NewRecorder()
+		s.decideApproval(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name, client, id, action string
+		status                   int
+	}{
+		{"not an approver", "web", a.ID, "deny", http.StatusNotFound},
+		{"unknown", "security", "missing", "deny", http.StatusNotFound},
+		{"invalid action", "security", a.ID, "maybe", http.StatusNotFound},
+		{"deny", "security", a.ID, "deny", http.StatusOK},
+		{"already decided", "security", a.ID, "approve", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		w := decide(tt.client, tt.id, tt.action, `{"reason":"no ticket"}`)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	got, _, _ := s.approvals.get(a.ID)
+	if got.Status != approvalDenied || got.Approver != "security" || got.Reason != "no ticket" {
+		t.Errorf("approval after deny = %+v, want denied by security", got)
+	}
+}
+
+func TestDecideOwnApproval(t *testing.T) {
+	s := newApprovalTestServer()
+	r, request := newPolicyTestRequest(t, "ci", "release.example.com")
+	r = withIdentities(r, "ci", "security")
+	request.Profile = profileCodeSigning
+	a, err := s.requestApproval(r, generationStable, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = withIdentities(httptest.NewRequest(http.MethodPost, "/approvals/"+a.ID+"/approve", nil), "security")
+	r.SetPathValue("id", a.ID)
+	r.SetPathValue("action", "approve")
+	w := httptest.NewRecorder()
+	s.decideApproval(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("self approval: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestEncodeApproval(t *testing.T) {
+	_, request := newPolicyTestRequest(t, "ci", "release.example.com")
+	request.redactCSR = true
+	request.templateData = map[string]interface{}{"team": "release"}
+	a := &approval{ID: "a", Profile: profileCodeSigning, profile: &testProfiles[0], generation: generationCanary, request: request, Response: &api.SignResponse{}}
+	data, err := encodeApproval(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newApprovalStore(nil, testProfiles)
+	got, err := s.decodeApproval(data)
+	if err != nil || got == nil {
+		t.Fatalf("decodeApproval() = %v, %v", got, err)
+	}
+	if got.generation != generationCanary || !got.request.redactCSR || got.request.templateData["team"] != "release" {
+		t.Errorf("decodeApproval() = %+v, want the generation and request options", got)
+	}
+
+	if got, err := newApprovalStore(nil, nil).decodeApproval(data); got != nil || err != nil {
+		t.Errorf("decodeApproval() of a removed profile = %v, %v, want nil", got, err)
+	}
+}
@@ -0,0 +1,38 @@
+package signer
+
+import (
+	"net/http"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// clientIdentities returns the names the client presented in its TLS
+// certificate: the common name followed by the DNS, email and URI SANs. Behind
+// a trusted proxy they are the names in the trusted header.
+func clientIdentities(r *http.Request) []string {
+	if ids, ok := r.Context().Value(identitiesKey{}).([]string); ok {
+		return ids
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+
+	return ids
+}
+
+// clientAllowed reports whether any of the client identities is in the
+// allowed list. An empty list allows nobody.
+func clientAllowed(r *http.Request, allowed []string) bool {
+	return policy.ContainsAny(allowed, clientIdentities(r))
+}
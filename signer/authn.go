@@ -0,0 +1,230 @@
+package signer
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// Authentication requirements of the endpoints.
+const (
+	authnMTLS  = "mtls"
+	authnToken = "token"
+	authnAny   = "any"
+	authnNone  = "none"
+)
+
+// AuthnConfig configures how each endpoint authenticates its clients: with
+// a client certificate (mtls), a bearer token (token), either (any), or not
+// at all (none). Endpoints not listed use the default, mtls.
+type AuthnConfig struct {
+	Default   string                `yaml:"default"`
+	Tokens    []TokenConfig         `yaml:"tokens"`
+	OIDC      []OIDCProviderConfig  `yaml:"oidc"`
+	Endpoints []EndpointAuthnConfig `yaml:"endpoints"`
+	Replay    ReplayConfig          `yaml:"replay"`
+}
+
+// TokenConfig is a static bearer token. Requests authenticated with it have
+// the token name as client identity.
+type TokenConfig struct {
+	Name      string `yaml:"name"`
+	TokenFile string `yaml:"tokenFile"`
+}
+
+// EndpointAuthnConfig is the requirement of the endpoints under Path, or of
+// Path only if it does not end with a slash.
+type EndpointAuthnConfig struct {
+	Path    string `yaml:"path"`
+	Require string `yaml:"require"`
+}
+
+// GetDefault returns the requirement of the endpoints not listed, defaults
+// to mtls.
+func (c AuthnConfig) GetDefault() string {
+	if c.Default == "" {
+		return authnMTLS
+	}
+	return c.Default
+}
+
+// Validate checks the requirements and tokens.
+func (c AuthnConfig) Validate() error {
+	modes := []string{c.GetDefault()}
+	for _, e := range c.Endpoints {
+		if !strings.HasPrefix(e.Path, "/") {
+			return errors.Errorf("invalid authn endpoint path %q", e.Path)
+		}
+		modes = append(modes, e.Require)
+	}
+	for _, m := range modes {
+		switch m {
+		case authnMTLS, authnAny, authnNone:
+		case authnToken:
+			if len(c.Tokens) == 0 && len(c.OIDC) == 0 {
+				return errors.New("authn requires tokens or oidc with the token requirement")
+			}
+		default:
+			return errors.Errorf("invalid authn requirement %q", m)
+		}
+	}
+	for _, t := range c.Tokens {
+		if t.Name == "" || t.TokenFile == "" {
+			return errors.New("authn tokens require a name and a tokenFile")
+		}
+	}
+	names := map[string]bool{}
+	for _, p := range c.OIDC {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return errors.Errorf("duplicated authn oidc name %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	return c.Replay.Validate()
+}
+
+// optionalClientCerts reports whether some endpoints can be called without
+// a client certificate, so the TLS handshake must not require one.
+func (c AuthnConfig) optionalClientCerts() bool {
+	if c.GetDefault() != authnMTLS {
+		return true
+	}
+	for _, e := range c.Endpoints {
+		if e.Require != authnMTLS {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requirementFor returns the requirement of the most specific endpoint
+// matching path.
+func (c AuthnConfig) requirementFor(path string) string {
+	require, longest := c.GetDefault(), -1
+	for _, e := range c.Endpoints {
+		match := path == e.Path || (strings.HasSuffix(e.Path, "/") && strings.HasPrefix(path, e.Path))
+		if match && len(e.Path) > longest {
+			require, longest = e.Require, len(e.Path)
+		}
+	}
+
+	return require
+}
+
+// authToken is a loaded bearer token.
+type authToken struct {
+	name  string
+	token []byte
+}
+
+// loadAuthTokens reads the token files.
+func loadAuthTokens(c AuthnConfig) ([]authToken, error) {
+	var tokens []authToken
+	for _, t := range c.Tokens {
+		b, err := readPasswordFromFile(t.TokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading token %s", t.Name)
+		}
+		if len(b) == 0 {
+			return nil, errors.Errorf("token file of %s is empty", t.Name)
+		}
+		tokens = append(tokens, authToken{name: t.Name, token: b})
+	}
+
+	return tokens, nil
+}
+
+// tokenIdentities returns the client identities of the bearer token of r,
+// if it is valid: the name of a static token, or the identities of an OIDC
+// token.
+func (s *server) tokenIdentities(r *http.Request) ([]string, bool) {
+	value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+	value = strings.TrimSpace(value)
+	for _, t := range s.authTokens {
+		if subtle.ConstantTimeCompare([]byte(value), t.token) == 1 {
+			return []string{t.name}, true
+		}
+	}
+
+	return s.oidcIdentities(r.Context(), value)
+}
+
+// authenticate wraps next enforcing the authentication requirement of each
+// endpoint. Failures return 401 Unauthorized.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	c := s.config.Authn
+	if !c.optionalClientCerts() && len(c.Tokens) == 0 && len(c.OIDC) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require := c.requirementFor(r.URL.Path)
+		hasCert := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+		ids, hasToken := s.tokenIdentities(r)
+
+		var ok bool
+		switch require {
+		case authnNone:
+			ok = true
+		case authnMTLS:
+			ok = hasCert
+		case authnToken:
+			ok = hasToken
+		case authnAny:
+			ok = hasCert || hasToken
+		}
+		if !ok {
+			authnFailures.WithLabelValues(require).Inc()
+			logFor("server").WithFields(log.Fields{
+				"path":    r.URL.Path,
+				"require": require,
+				"remote":  r.RemoteAddr,
+			}).Warn("Unauthorized: missing or invalid credentials")
+			if require != authnMTLS {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ca-signer"`)
+			}
+			render.Error(w, r, errs.New(http.StatusUnauthorized, "endpoint requires %s authentication", require))
+			return
+		}
+
+		if hasToken && !hasCert && require != authnNone {
+			r = r.WithContext(context.WithValue(r.Context(), identitiesKey{}, ids))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// applyOptionalClientCerts lets clients connect without a certificate, the
+// certificates presented are still verified. The authentication of each
+// endpoint is then enforced by authenticate.
+func applyOptionalClientCerts(cfg *tls.Config) {
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	next := cfg.GetConfigForClient
+	if next == nil {
+		return
+	}
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c, err := next(hello)
+		if err != nil || c == nil {
+			return c, err
+		}
+		c = c.Clone()
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		return c, nil
+	}
+}
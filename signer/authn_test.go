@@ -0,0 +1,138 @@
+package signer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthnConfigValidate(t *testing.T) {
+	tokens := []TokenConfig{{Name: "ci", TokenFile: "/run/ci-token"}}
+	tests := []struct {
+		name string
+		c    AuthnConfig
+		ok   bool
+	}{
+		{"default", AuthnConfig{}, true},
+		{"endpoints", AuthnConfig{Tokens: tokens, Endpoints: []EndpointAuthnConfig{{"/roots", authnNone}, {"/sign", authnAny}, {"/admin/", authnMTLS}}}, true},
+		{"token without tokens", AuthnConfig{Default: authnToken}, false},
+		{"requirement", AuthnConfig{Endpoints: []EndpointAuthnConfig{{"/sign", "basic"}}}, false},
+		{"relative path", AuthnConfig{Endpoints: []EndpointAuthnConfig{{"sign", authnNone}}}, false},
+		{"token file", AuthnConfig{Tokens: []TokenConfig{{Name: "ci"}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestRequirementFor(t *testing.T) {
+	c := AuthnConfig{Endpoints: []EndpointAuthnConfig{
+		{"/roots", authnNone},
+		{"/admin/", authnToken},
+		{"/admin/maintenance", authnMTLS},
+	}}
+	tests := []struct {
+		path, want string
+	}{
+		{"/roots", authnNone},
+		{"/roots/1", authnMTLS},
+		{"/admin/drain", authnToken},
+		{"/admin/maintenance", authnMTLS},
+		{"/sign", authnMTLS},
+	}
+	for _, tt := range tests {
+		if got := c.requirementFor(tt.path); got != tt.want {
+			t.Errorf("requirementFor(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+	if !c.optionalClientCerts() || (AuthnConfig{Endpoints: []EndpointAuthnConfig{{"/sign", authnMTLS}}}).optionalClientCerts() {
+		t.Error("optionalClientCerts() must be true only when some endpoint does not require mtls")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := writeFile(tokenFile, "s3cret\n"); err != nil {
+		t.Fatal(err)
+	}
+	c := AuthnConfig{
+		Tokens: []TokenConfig{{Name: "ci", TokenFile: tokenFile}},
+		Endpoints: []EndpointAuthnConfig{
+			{"/roots", authnNone},
+			{"/sign", authnAny},
+			{"/stats", authnToken},
+		},
+	}
+	tokens, err := loadAuthTokens(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: &Config{Authn: c}, authTokens: tokens}
+
+	var ids []string
+	handler := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = clientIdentities(r)
+	}))
+	cert, _ := newTestCert(t, "web")
+	tests := []struct {
+		path, token string
+		cert        bool
+		status      int
+		ids         []string
+	}{
+		{"/roots", "", false, http.StatusOK, nil},
+		{"/sign", "s3cret", false, http.StatusOK, []string{"ci"}},
+		{"/sign", "", true, http.StatusOK, []string{"web"}},
+		{"/sign", "wrong", false, http.StatusUnauthorized, nil},
+		{"/stats", "", true, http.StatusUnauthorized, nil},
+		{"/stats", "s3cret", false, http.StatusOK, []string{"ci"}},
+		{"/approvals", "s3cret", false, http.StatusUnauthorized, nil},
+		{"/approvals", "", true, http.StatusOK, []string{"web"}},
+	}
+	for _, tt := range tests {
+		ids = nil
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.cert {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status || strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+			t.Errorf("%s token %q cert %v: status = %d, identities %v, want %d, %v", tt.path, tt.token, tt.cert, w.Code, ids, tt.status, tt.ids)
+		}
+		if tt.status == http.StatusUnauthorized && tt.path == "/stats" && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: WWW-Authenticate is missing", tt.path)
+		}
+	}
+}
+
+func TestLoadAuthTokensEmpty(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := writeFile(tokenFile, "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAuthTokens(AuthnConfig{Tokens: []TokenConfig{{Name: "ci", TokenFile: tokenFile}}}); err == nil {
+		t.Error("loadAuthTokens() accepted an empty token")
+	}
+}
+
+func TestApplyOptionalClientCerts(t *testing.T) {
+	cfg := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}, nil
+	}
+	applyOptionalClientCerts(cfg)
+	c, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil || cfg.ClientAuth != tls.VerifyClientCertIfGiven || c.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("applyOptionalClientCerts() = %v and %v, want VerifyClientCertIfGiven", cfg.ClientAuth, c.ClientAuth)
+	}
+}
@@ -0,0 +1,587 @@
+package signer
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// snapshotVersion is the version of the snapshot format.
+const snapshotVersion = 1
+
+// snapshotTimeout bounds the transaction reading a snapshot of a Postgres
+// store, which holds a connection and the old row versions while it runs.
+const snapshotTimeout = time.Hour
+
+// snapshotManifest describes a snapshot of the store: a zstd compressed tar
+// archive with a buckets/<name> entry per bucket, holding its keys and
+// values as varint length-prefixed pairs, and manifest.json last. Values are
+// copied as stored, so encrypted values stay encrypted.
+type snapshotManifest struct {
+	Version int                       `json:"version"`
+	Created time.Time                 `json:"created"`
+	Signer  string                    `json:"signer"`
+	Store   string                    `json:"store"`
+	Buckets map[string]snapshotBucket `json:"buckets"`
+}
+
+type snapshotBucket struct {
+	Keys   int    `json:"keys"`
+	SHA256 string `json:"sha256"`
+}
+
+// rawStore returns the store under the encryption, if any.
+func rawStore(s store.Store) store.Store {
+	if e, ok := s.(*encryptedStore); ok {
+		return e.Store
+	}
+
+	return s
+}
+
+func storeKind(s store.Store) string {
+	if _, ok := rawStore(s).(*store.Postgres); ok {
+		return "postgres"
+	}
+
+	return "bolt"
+}
+
+// snapshot is a snapshot of the store spooled to temporary files, one per
+// bucket.
+type snapshot struct {
+	manifest *snapshotManifest
+	files    map[string]*os.File
+}
+
+// takeSnapshot reads all the buckets in a single transaction, so the
+// snapshot is consistent while the signers write to the store. The buckets
+// are spooled to temporary files so the transaction ends before the archive
+// is written. A Postgres transaction is bounded by snapshotTimeout and ctx
+// rather than by the timeout of the requests.
+func takeSnapshot(ctx context.Context, db store.Store) (*snapshot, error) {
+	snap := &snapshot{
+		manifest: &snapshotManifest{
+			Version: snapshotVersion,
+			Created: time.Now().UTC(),
+			Signer:  Version,
+			Store:   storeKind(db),
+			Buckets: map[string]snapshotBucket{},
+		},
+		files: map[string]*os.File{},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+	view := rawStore(db).View
+	if pg, ok := rawStore(db).(*store.Postgres); ok {
+		view = func(fn func(store.Tx) error) error {
+			return pg.ViewContext(ctx, fn)
+		}
+	}
+
+	err := view(func(tx store.Tx) error {
+		for _, name := range storeBuckets {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			f, err := os.CreateTemp("", "ca-signer-snapshot-")
+			if err != nil {
+				return err
+			}
+			snap.files[string(name)] = f
+			h := sha256.New()
+			bw := bufio.NewWriter(io.MultiWriter(f, h))
+			var n int
+			err = tx.Bucket(name).ForEach(func(k, v []byte) error {
+				n++
+				return writeSnapshotPair(bw, k, v)
+			})
+			if err == nil {
+				err = bw.Flush()
+			}
+			if err != nil {
+				return err
+			}
+			snap.manifest.Buckets[string(name)] = snapshotBucket{Keys: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+		}
+		return nil
+	})
+	if err != nil {
+		snap.Close()
+		return nil, errors.Wrap(err, "error reading store")
+	}
+
+	return snap, nil
+}
+
+// Close removes the temporary files.
+func (snap *snapshot) Close() {
+	for _, f := range snap.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// write writes the snapshot archive.
+func (snap *snapshot) write(w io.Writer) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	m := snap.manifest
+	for _, name := range storeBuckets {
+		f := snap.files[string(name)]
+		size, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "buckets/" + string(name), Mode: 0o600, Size: size, ModTime: m.Created}); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0o600, Size: int64(len(data)), ModTime: m.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func writeSnapshotPair(w *bufio.Writer, k, v []byte) error {
+	for _, b := range [][]byte{k, v} {
+		if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(b)))); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSnapshot calls fn with the entries of a snapshot, and returns its
+// manifest.
+func readSnapshot(name string, fn func(hdr *tar.Header, r io.Reader) error) (*snapshotManifest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var m *snapshotManifest
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading snapshot")
+		}
+		if hdr.Name == "manifest.json" {
+			m = new(snapshotManifest)
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, errors.Wrap(err, "error reading snapshot manifest")
+			}
+			continue
+		}
+		if err := fn(hdr, tr); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return nil, errors.New("snapshot has no manifest")
+	}
+	if m.Version != snapshotVersion {
+		return nil, errors.Errorf("unsupported snapshot version %d", m.Version)
+	}
+
+	return m, nil
+}
+
+// verifySnapshot checks the checksums and key counts of a snapshot against
+// its manifest.
+func verifySnapshot(name string) (*snapshotManifest, error) {
+	got := map[string]snapshotBucket{}
+	m, err := readSnapshot(name, func(hdr *tar.Header, r io.Reader) error {
+		bucket := strings.TrimPrefix(hdr.Name, "buckets/")
+		h := sha256.New()
+		var n int
+		err := readSnapshotPairs(io.TeeReader(r, h), func(_, _ []byte) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error reading bucket %s", bucket)
+		}
+		got[bucket] = snapshotBucket{Keys: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for bucket, b := range m.Buckets {
+		if got[bucket] != b {
+			return nil, errors.Errorf("snapshot bucket %s does not match the manifest", bucket)
+		}
+	}
+	for bucket := range got {
+		if _, ok := m.Buckets[bucket]; !ok {
+			return nil, errors.Errorf("snapshot bucket %s is not in the manifest", bucket)
+		}
+	}
+
+	return m, nil
+}
+
+func readSnapshotPairs(r io.Reader, fn func(k, v []byte) error) error {
+	br := bufio.NewReader(r)
+	for {
+		k, err := readSnapshotBytes(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		v, err := readSnapshotBytes(br)
+		if err != nil {
+			return errors.Wrap(err, "truncated snapshot")
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+}
+
+func readSnapshotBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 64<<20 {
+		return nil, errors.New("invalid snapshot entry size")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// restoreSnapshot verifies a snapshot and writes it to an empty store, or
+// replaces the content of the store with force.
+func restoreSnapshot(name string, db store.Store, force bool, progress func(bucket string, n int)) (*snapshotManifest, error) {
+	m, err := verifySnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	for bucket := range m.Buckets {
+		if !isStoreBucket(bucket) {
+			return nil, errors.Errorf("unknown snapshot bucket %s", bucket)
+		}
+	}
+
+	for _, name := range storeBuckets {
+		var keys [][]byte
+		err := db.View(func(tx store.Tx) error {
+			return tx.Bucket(name).ForEach(func(k, _ []byte) error {
+				keys = append(keys, append([]byte{}, k...))
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 && !force {
+			return nil, errors.Errorf("the store is not empty, bucket %s has %d keys", name, len(keys))
+		}
+		for i := 0; i < len(keys); i += store.MigrateBatch {
+			batch := keys[i:min(i+store.MigrateBatch, len(keys))]
+			err := db.Update(func(tx store.Tx) error {
+				b := tx.Bucket(name)
+				for _, k := range batch {
+					if err := b.Delete(k); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "error clearing bucket %s", name)
+			}
+		}
+	}
+
+	_, err = readSnapshot(name, func(hdr *tar.Header, r io.Reader) error {
+		bucket := []byte(strings.TrimPrefix(hdr.Name, "buckets/"))
+		var batch [][2][]byte
+		var n int
+		flush := func() error {
+			err := db.Update(func(tx store.Tx) error {
+				b := tx.Bucket(bucket)
+				for _, kv := range batch {
+					if err := b.Put(kv[0], kv[1]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			n += len(batch)
+			batch = batch[:0]
+			return err
+		}
+		err := readSnapshotPairs(r, func(k, v []byte) error {
+			batch = append(batch, [2][]byte{k, v})
+			if len(batch) < store.MigrateBatch {
+				return nil
+			}
+			return flush()
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error restoring bucket %s", bucket)
+		}
+		progress(string(bucket), n)
+		return nil
+	})
+
+	return m, err
+}
+
+func isStoreBucket(name string) bool {
+	for _, b := range storeBuckets {
+		if string(b) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backup streams a snapshot of the inventory store. It is consistent while
+// the signer runs, which a copy of the BoltDB file is not.
+func (s *server) backup(w http.ResponseWriter, r *http.Request) {
+	snap, err := takeSnapshot(r.Context(), s.inventory.store)
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	defer snap.Close()
+
+	name := "ca-signer-" + snap.manifest.Created.Format("20060102T150405Z") + ".tar.zst"
+	w.Header().Set("Content-Type", "application/zstd")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	logger := logFor("admin").WithFields(log.Fields{
+		"client":  clientIdentities(r),
+		"buckets": snap.manifest.Buckets,
+	})
+	if err := snap.write(w); err != nil {
+		logger.WithField("error", err).Error("Error writing store snapshot")
+		return
+	}
+	logger.Info("Store snapshot downloaded")
+}
+
+// runBackupCommand implements "ca-signer backup". It writes a snapshot of
+// the store configured in the config file, or downloads one from the admin
+// API of a running signer, which is required for a BoltDB file in use.
+func runBackupCommand(args []string) int {
+	var o benchOptions
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "path to the signer configuration, to read the store directly")
+	out := fs.String("out", "", "snapshot file to write, e.g. snapshot.tar.zst")
+	fs.StringVar(&o.target, "signer", "", "base URL of a running signer to download the snapshot from, e.g. https://ca-signer:4443")
+	fs.StringVar(&o.cert, "cert", "", "admin client certificate for mTLS")
+	fs.StringVar(&o.key, "key", "", "admin client key for mTLS")
+	fs.StringVar(&o.root, "root", "", "root certificate trusted for the signer, defaults to the system roots")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *out == "" || (o.target == "" && *configFile == "") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	tmp := *out + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating %s: %v\n", *out, err)
+		return exitError
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if o.target != "" {
+		err = downloadSnapshot(f, o)
+	} else {
+		err = backupFromConfig(f, *configFile)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing snapshot: %v\n", err)
+		return exitError
+	}
+
+	m, err := verifySnapshot(tmp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error verifying snapshot: %v\n", err)
+		return exitError
+	}
+	if err := os.Rename(tmp, *out); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing snapshot: %v\n", err)
+		return exitError
+	}
+	printSnapshotManifest(m)
+
+	return 0
+}
+
+func backupFromConfig(w io.Writer, configFile string) error {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if !config.Inventory.Enabled() {
+		return errors.New("the inventory is not configured")
+	}
+	db, err := openStore(config.Inventory)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	snap, err := takeSnapshot(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	return snap.write(w)
+}
+
+func downloadSnapshot(w io.Writer, o benchOptions) error {
+	o.concurrency = 1
+	client, err := benchClient(o)
+	if err != nil {
+		return err
+	}
+	client.Timeout = 0
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, strings.TrimSuffix(o.target, "/")+"/admin/backup", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func printSnapshotManifest(m *snapshotManifest) {
+	fmt.Printf("snapshot of a %s store created %s by ca-signer %s\n", m.Store, m.Created.Format(time.RFC3339), m.Signer)
+	for _, name := range storeBuckets {
+		if b, ok := m.Buckets[string(name)]; ok {
+			fmt.Printf("%s: %d keys\n", name, b.Keys)
+		}
+	}
+}
+
+// runRestoreCommand implements "ca-signer restore". It verifies a snapshot
+// and writes it to the store configured in the config file, which must be
+// empty unless --force is given. The signers must be stopped.
+func runRestoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "path to the signer configuration")
+	in := fs.String("in", "", "snapshot file to restore")
+	force := fs.Bool("force", false, "replace the content of a store that is not empty")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *in == "" || *configFile == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+		return exitUsage
+	}
+	if !config.Inventory.Enabled() {
+		fmt.Fprintln(os.Stderr, "the inventory is not configured")
+		return exitUsage
+	}
+	db, err := openStore(config.Inventory)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening inventory: %v\n", err)
+		return exitError
+	}
+	defer db.Close()
+
+	m, err := restoreSnapshot(*in, db, *force, func(bucket string, n int) {
+		fmt.Printf("%s: %d keys restored\n", bucket, n)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error restoring snapshot: %v\n", err)
+		return exitError
+	}
+	fmt.Printf("restored a snapshot of a %s store created %s\n", m.Store, m.Created.Format(time.RFC3339))
+
+	return 0
+}
@@ -0,0 +1,56 @@
+package signer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	inv := newTestInventory(t)
+	for _, serial := range []string{"1", "2"} {
+		if err := inv.Put(&certificateRecord{Serial: serial, Fingerprint: "fp" + serial}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := takeSnapshot(context.Background(), inv.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	if n := snap.manifest.Buckets[string(certificatesBucket)].Keys; n != 2 {
+		t.Errorf("snapshot has %d certificates, want 2", n)
+	}
+	name := filepath.Join(t.TempDir(), "snapshot.tar.zst")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dst := newTestInventory(t)
+	if _, err := restoreSnapshot(name, dst.store, false, func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := dst.GetByFingerprint("fp2"); err != nil || rec == nil || rec.Serial != "2" {
+		t.Fatalf("GetByFingerprint() after restore = %v, %v", rec, err)
+	}
+	if _, err := restoreSnapshot(name, dst.store, false, func(string, int) {}); err == nil {
+		t.Error("restoreSnapshot() into a store that is not empty error = nil")
+	}
+}
+
+func TestSnapshotCanceled(t *testing.T) {
+	inv := newTestInventory(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if snap, err := takeSnapshot(ctx, inv.store); err == nil {
+		snap.Close()
+		t.Fatal("takeSnapshot() with a canceled context error = nil")
+	}
+}
@@ -0,0 +1,278 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// BatchConfig configures POST /sign/batch, which issues the certificates of
+// several CSRs in one request.
+type BatchConfig struct {
+	Enabled     bool `yaml:"enabled"`
+	MaxRequests int  `yaml:"maxRequests"`
+	Concurrency int  `yaml:"concurrency"`
+}
+
+// GetMaxRequests returns the maximum number of CSRs in a batch, defaults to
+// 100.
+func (c BatchConfig) GetMaxRequests() int {
+	if c.MaxRequests > 0 {
+		return c.MaxRequests
+	}
+
+	return 100
+}
+
+// GetConcurrency returns the number of CSRs of a batch signed in parallel,
+// defaults to 4.
+func (c BatchConfig) GetConcurrency() int {
+	if c.Concurrency > 0 {
+		return c.Concurrency
+	}
+
+	return 4
+}
+
+// Validate checks the limits.
+func (c BatchConfig) Validate() error {
+	if c.MaxRequests < 0 || c.Concurrency < 0 {
+		return errors.New("batch maxRequests and concurrency must be positive")
+	}
+
+	return nil
+}
+
+// BatchSignRequest is the body of POST /sign/batch.
+type BatchSignRequest struct {
+	Requests []json.RawMessage `json:"requests"`
+}
+
+// batchResult is the result of a CSR of a batch: the response of POST /sign
+// if it was issued, or its error body.
+type batchResult struct {
+	Index       int                `json:"index"`
+	Status      int                `json:"status"`
+	Certificate *renewableResponse `json:"certificate,omitempty"`
+	Error       json.RawMessage    `json:"error,omitempty"`
+}
+
+// signBatch issues the certificates of the CSRs of a batch, each checked
+// like POST /sign. Clients accepting application/x-ndjson receive each
+// result on its own line as soon as it is ready, in completion order;
+// other clients receive all the results at the end, in request order. The
+// status is 200 in both cases, the status of each CSR is in its result.
+// Every CSR after the first counts against the rate limit of the client.
+func (s *server) signBatch(w http.ResponseWriter, r *http.Request) {
+	generation := s.generationFor(r)
+	opts, err := parseBundleOptions(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	if opts.pem {
+		render.Error(w, r, errs.BadRequest("format pem is not supported with batches"))
+		return
+	}
+
+	var body BatchSignRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, int64(s.config.Batch.GetMaxRequests())*maxSignRequestSize)).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+	switch n := len(body.Requests); {
+	case n == 0:
+		render.Error(w, r, errs.BadRequest("missing requests"))
+		return
+	case n > s.config.Batch.GetMaxRequests():
+		render.Error(w, r, errs.BadRequest("too many requests, the maximum is %d", s.config.Batch.GetMaxRequests()))
+		return
+	}
+
+	results := make(chan batchResult)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s.config.Batch.GetConcurrency())
+	for i, raw := range body.Requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results <- s.signBatchItem(r, generation, opts, i, raw)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	counts := map[int]int{}
+	if !acceptsNDJSON(r) {
+		out := make([]batchResult, len(body.Requests))
+		for res := range results {
+			out[res.Index] = res
+			counts[res.Status]++
+		}
+		logBatch(r, len(out), counts)
+		render.JSON(w, r, map[string]interface{}{"results": out})
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	var writeErr error
+	for res := range results {
+		counts[res.Status]++
+		// Keep draining the results after a write error, so the workers
+		// do not block.
+		if writeErr == nil {
+			if writeErr = enc.Encode(res); writeErr == nil {
+				writeErr = rc.Flush()
+			}
+		}
+	}
+	logBatch(r, len(body.Requests), counts)
+}
+
+// signBatchItem checks and issues a CSR of a batch.
+func (s *server) signBatchItem(r *http.Request, generation string, opts bundleOptions, index int, raw json.RawMessage) batchResult {
+	res := batchResult{Index: index}
+	fail := func(err error) batchResult {
+		rec := &bufferedResponse{header: http.Header{}}
+		render.Error(rec, r, err)
+		res.Status, res.Error = rec.status, bytes.TrimSpace(rec.body.Bytes())
+		return res
+	}
+
+	if index > 0 && s.limiter != nil {
+		window := time.Now().Truncate(time.Minute)
+		if n, err := s.limiter.Incr(r.Context(), rateLimitKey(r), window); err == nil && n > int64(s.config.RateLimit.RequestsPerMinute) {
+			rateLimited.Inc()
+			return fail(errs.New(http.StatusTooManyRequests, "rate limit exceeded"))
+		}
+	}
+
+	var request SignRequest
+	endDecode := timePhase(r.Context(), phaseDecode)
+	err := json.Unmarshal(raw, &request)
+	endDecode()
+	if err != nil {
+		s.countSign(clientIdentities(r), generation, "invalid", err)
+		return fail(errs.BadRequestErr(err, "error reading request"))
+	}
+	endValidate := timePhase(r.Context(), phaseValidate)
+	err = request.Validate()
+	endValidate()
+	if err != nil {
+		s.countSign(clientIdentities(r), generation, "invalid", err)
+		return fail(err)
+	}
+	if request.Profile != "" {
+		return fail(errs.BadRequest("profiles are not supported with batches"))
+	}
+
+	if err := s.checkPolicy(r, generation, &request); err != nil {
+		result := "error"
+		if _, ok := err.(*policyError); ok {
+			result = "denied"
+		}
+		s.countSign(clientIdentities(r), generation, result, err)
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.Timeouts.GetSign())
+	defer cancel()
+
+	resp, err := s.issueWith(ctx, s.upstreamFor(generation), &request, nil)
+	if err != nil {
+		s.releaseQuota(clientIdentities(r))
+		s.countSign(clientIdentities(r), generation, "error", err)
+		return fail(err)
+	}
+
+	logFor("server").WithFields(log.Fields{
+		"request":  requestID(r),
+		"client":   clientIdentities(r),
+		"subject":  request.CsrPEM.Subject.CommonName,
+		"serial":   resp.ServerPEM.Certificate.SerialNumber.String(),
+		"metadata": request.Metadata,
+		"index":    index,
+	}).Info("Issued certificate")
+	s.countSign(clientIdentities(r), generation, "issued", nil)
+	s.issued(newHookEvent(r, generation, &request), resp)
+
+	bundled, err := s.bundle(resp, opts)
+	if err != nil {
+		return fail(errs.InternalServerErr(err))
+	}
+	res.Status = http.StatusCreated
+	res.Certificate = &renewableResponse{
+		SignResponse: bundled,
+		RenewAfter:   s.config.Renewal.renewAfter(resp.ServerPEM.Certificate),
+		SCTs:         request.scts,
+	}
+
+	return res
+}
+
+// logBatch logs the number of results of a batch by status.
+func logBatch(r *http.Request, n int, counts map[int]int) {
+	logFor("server").WithFields(log.Fields{
+		"request":  requestID(r),
+		"client":   clientIdentities(r),
+		"requests": n,
+		"statuses": counts,
+	}).Info("Processed batch")
+}
+
+// acceptsNDJSON reports whether Accept lists application/x-ndjson.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bufferedResponse records an error response, so the errors of a batch
+// have the same body as the errors of POST /sign.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
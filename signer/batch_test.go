@@ -0,0 +1,178 @@
+package signer
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// newBatchTestServer returns a server issuing the batches with a test
+// upstream, allowing names of example.com.
+func newBatchTestServer(t *testing.T, c BatchConfig) *server {
+	t.Helper()
+	s := newPolicyTestServer(policy.Config{Rules: []policy.Rule{
+		{ID: "no-prod", Action: "deny", SANs: []string{"*.prod.example.com"}},
+		{ID: "example", Action: "allow", SANs: []string{"*.example.com"}},
+	}})
+	s.config.Batch = c
+	up := newTestUpstream(t)
+	s.provisioner, s.trustedRoots = up.provisioner, []*x509.Certificate{up.root}
+
+	return s
+}
+
+// batchBody returns a batch of requests, names being a CSR for the name and
+// other values raw requests.
+func batchBody(t *testing.T, requests ...string) string {
+	t.Helper()
+	var raw []string
+	for _, req := range requests {
+		if strings.HasPrefix(req, "{") {
+			raw = append(raw, req)
+		} else {
+			raw = append(raw, `{"csr":`+mustJSON(t, newTestCSR(t, req))+`}`)
+		}
+	}
+
+	return `{"requests":[` + strings.Join(raw, ",") + `]}`
+}
+
+func TestBatchConfig(t *testing.T) {
+	if c := (BatchConfig{}); c.GetMaxRequests() != 100 || c.GetConcurrency() != 4 || c.Validate() != nil {
+		t.Errorf("defaults = %d, %d, %v", c.GetMaxRequests(), c.GetConcurrency(), c.Validate())
+	}
+	if err := (BatchConfig{Concurrency: -1}).Validate(); err == nil {
+		t.Error("Validate() of a negative concurrency error = nil")
+	}
+}
+
+func TestAcceptsNDJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"application/x-ndjson", true},
+		{"application/json, application/x-ndjson; q=0.9", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/sign/batch", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := acceptsNDJSON(r); got != tt.want {
+			t.Errorf("acceptsNDJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestSignBatch(t *testing.T) {
+	s := newBatchTestServer(t, BatchConfig{MaxRequests: 3})
+	call := func(path, accept, body string) *httptest.ResponseRecorder {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)), "web")
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		s.signBatch(w, r)
+		return w
+	}
+	body := batchBody(t, "www.example.com", "db.prod.example.com", `{"csr":"invalid"}`)
+	want := []int{http.StatusCreated, http.StatusForbidden, http.StatusBadRequest}
+
+	w := call("/sign/batch", "", body)
+	var out struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || w.Code != http.StatusOK || len(out.Results) != len(want) {
+		t.Fatalf("signBatch() = %d %s, %v", w.Code, w.Body, err)
+	}
+	for i, res := range out.Results {
+		if res.Index != i || res.Status != want[i] {
+			t.Errorf("result %d = index %d, status %d, want status %d", i, res.Index, res.Status, want[i])
+		}
+	}
+	if cert := out.Results[0].Certificate; cert == nil || cert.ServerPEM.Certificate.DNSNames[0] != "www.example.com" || cert.RenewAfter.IsZero() {
+		t.Errorf("issued result = %+v", cert)
+	}
+	var denial struct {
+		RuleID string `json:"ruleId"`
+	}
+	if err := json.Unmarshal(out.Results[1].Error, &denial); err != nil || denial.RuleID != "no-prod" {
+		t.Errorf("denied result error = %s, want the rule of POST /sign", out.Results[1].Error)
+	}
+
+	w = call("/sign/batch", "application/x-ndjson", body)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("signBatch() with ndjson = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var statuses []int
+	scanner := bufio.NewScanner(w.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var res batchResult
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		if res.Status != want[res.Index] {
+			t.Errorf("ndjson result %d status = %d, want %d", res.Index, res.Status, want[res.Index])
+		}
+		statuses = append(statuses, res.Status)
+	}
+	if len(statuses) != len(want) {
+		t.Errorf("ndjson results = %v, want %d lines", statuses, len(want))
+	}
+
+	for _, tt := range []struct {
+		name string
+		path string
+		body string
+	}{
+		{"empty", "/sign/batch", `{"requests":[]}`},
+		{"too many", "/sign/batch", batchBody(t, "a.example.com", "b.example.com", "c.example.com", "d.example.com")},
+		{"pem", "/sign/batch?format=pem", body},
+		{"profile", "/sign/batch", batchBody(t, `{"csr":`+mustJSON(t, newTestCSR(t, "www.example.com"))+`,"profile":"server"}`)},
+	} {
+		w := call(tt.path, "", tt.body)
+		if tt.name == "profile" {
+			json.Unmarshal(w.Body.Bytes(), &out)
+			if w.Code != http.StatusOK || out.Results[0].Status != http.StatusBadRequest {
+				t.Errorf("%s: result = %d %s, want a 400 result", tt.name, w.Code, w.Body)
+			}
+			continue
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400: %s", tt.name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestSignBatchRateLimit(t *testing.T) {
+	s := newBatchTestServer(t, BatchConfig{})
+	s.config.RateLimit = RateLimitConfig{RequestsPerMinute: 1}
+	s.limiter = newRateLimiter(s.config.RateLimit)
+	r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign/batch", strings.NewReader(batchBody(t, "a.example.com", "b.example.com", "c.example.com"))), "web")
+	w := httptest.NewRecorder()
+	s.signBatch(w, r)
+
+	var out struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []int
+	for _, res := range out.Results {
+		statuses = append(statuses, res.Status)
+	}
+	sort.Ints(statuses)
+	// The first CSR is the request itself, the second one fits in the limit.
+	if want := []int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests}; out.Results[0].Status != http.StatusCreated || !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %v, want %v with the first CSR issued", statuses, want)
+	}
+}
@@ -0,0 +1,279 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchOptions are the flags of "ca-signer bench".
+type benchOptions struct {
+	target      string
+	rate        float64
+	duration    time.Duration
+	concurrency int
+	keyType     string
+	san         string
+	notAfter    string
+	cert, key   string
+	root        string
+	token       string
+	jsonOutput  bool
+}
+
+// benchResult is the summary printed by "ca-signer bench". Latencies are
+// in milliseconds and measure the HTTP round trip, not the key generation.
+type benchResult struct {
+	Target    string             `json:"target"`
+	Duration  string             `json:"duration"`
+	Sent      int                `json:"sent"`
+	Issued    int                `json:"issued"`
+	Failed    int                `json:"failed"`
+	Skipped   int                `json:"skipped"`
+	Rate      float64            `json:"rate"`
+	Statuses  map[string]int     `json:"statuses"`
+	Latencies map[string]float64 `json:"latencies"`
+}
+
+// runBenchCommand implements "ca-signer bench". It sends sign requests with
+// fresh keys and CSRs at a fixed rate, and prints the latency percentiles.
+// Requests that would exceed the concurrency are skipped, so a saturated
+// target shows up as skipped requests rather than a lower rate. It exits
+// with 0 if every request succeeded, 1 if some failed and 2 on usage
+// errors.
+func runBenchCommand(args []string) int {
+	var o benchOptions
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.StringVar(&o.target, "target", "", "base URL of the signer, e.g. https://ca-signer:4443")
+	fs.Float64Var(&o.rate, "rate", 10, "sign requests per second")
+	fs.DurationVar(&o.duration, "duration", 60*time.Second, "duration of the run")
+	fs.IntVar(&o.concurrency, "concurrency", 64, "maximum requests in flight")
+	fs.StringVar(&o.keyType, "key-type", "ec", "key type of the CSRs: ec (P-256) or rsa (2048)")
+	fs.StringVar(&o.san, "san", "bench-%d.example.com", "DNS SAN of the CSRs, %d is replaced by the request number")
+	fs.StringVar(&o.notAfter, "not-after", "", "lifetime requested, e.g. 1h")
+	fs.StringVar(&o.cert, "cert", "", "client certificate for mTLS")
+	fs.StringVar(&o.key, "key", "", "client key for mTLS")
+	fs.StringVar(&o.root, "root", "", "root certificate trusted for the signer, defaults to the system roots")
+	fs.StringVar(&o.token, "token", "", "bearer token, for endpoints requiring token authentication")
+	fs.BoolVar(&o.jsonOutput, "json", false, "print the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if o.target == "" || o.rate <= 0 || o.duration <= 0 || o.concurrency <= 0 || (o.keyType != "ec" && o.keyType != "rsa") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	client, err := benchClient(o)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error configuring TLS: %v\n", err)
+		return exitUsage
+	}
+
+	res := runBench(context.Background(), client, o)
+	if o.jsonOutput {
+		out, _ := json.MarshalIndent(res, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		printBenchResult(os.Stdout, res)
+	}
+	if res.Failed > 0 {
+		return exitError
+	}
+
+	return 0
+}
+
+func benchClient(o benchOptions) (*http.Client, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.cert != "" || o.key != "" {
+		cert, err := tls.LoadX509KeyPair(o.cert, o.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if o.root != "" {
+		pool, err := loadCertPool(o.root)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			TLSClientConfig:     cfg,
+			MaxIdleConnsPerHost: o.concurrency,
+		},
+	}, nil
+}
+
+// runBench sends the requests and collects the results.
+func runBench(ctx context.Context, client *http.Client, o benchOptions) benchResult {
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		latencies []time.Duration
+		res       = benchResult{Target: o.target, Statuses: map[string]int{}}
+	)
+	slots := make(chan struct{}, o.concurrency)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / o.rate))
+	defer ticker.Stop()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, o.duration)
+	defer cancel()
+loop:
+	for n := 0; ; n++ {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			res.Skipped++
+			continue
+		}
+
+		res.Sent++
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			status, elapsed, err := benchSign(client, o, n)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				res.Failed++
+				res.Statuses["error"]++
+			case status != http.StatusCreated:
+				res.Failed++
+				res.Statuses[fmt.Sprint(status)]++
+			default:
+				res.Issued++
+				res.Statuses[fmt.Sprint(status)]++
+				latencies = append(latencies, elapsed)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	res.Duration = elapsed.Round(time.Millisecond).String()
+	res.Rate = float64(res.Issued) / elapsed.Seconds()
+	res.Latencies = latencyPercentiles(latencies)
+
+	return res
+}
+
+// benchSign generates a key and a CSR and sends it to /v1/sign. Only the
+// HTTP round trip is timed.
+func benchSign(client *http.Client, o benchOptions, n int) (int, time.Duration, error) {
+	var key crypto.Signer
+	var err error
+	if o.keyType == "rsa" {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	name := o.san
+	if strings.Contains(name, "%d") {
+		name = fmt.Sprintf(name, n)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"csr":      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+		"notAfter": o.notAfter,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(o.target, "/")+"/v1/sign", bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, time.Since(start), nil
+}
+
+// latencyPercentiles returns the p50, p90, p95, p99 and maximum latencies
+// in milliseconds.
+func latencyPercentiles(latencies []time.Duration) map[string]float64 {
+	out := map[string]float64{}
+	if len(latencies) == 0 {
+		return out
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	ms := func(d time.Duration) float64 {
+		return float64(d.Microseconds()) / 1000
+	}
+	for _, p := range []int{50, 90, 95, 99} {
+		i := (len(latencies)*p+99)/100 - 1
+		out[fmt.Sprintf("p%d", p)] = ms(latencies[max(i, 0)])
+	}
+	out["max"] = ms(latencies[len(latencies)-1])
+
+	return out
+}
+
+func printBenchResult(w io.Writer, res benchResult) {
+	fmt.Fprintf(w, "target:    %s\n", res.Target)
+	fmt.Fprintf(w, "duration:  %s\n", res.Duration)
+	fmt.Fprintf(w, "requests:  %d sent, %d issued, %d failed, %d skipped\n", res.Sent, res.Issued, res.Failed, res.Skipped)
+	fmt.Fprintf(w, "rate:      %.1f issued/s\n", res.Rate)
+	statuses := make([]string, 0, len(res.Statuses))
+	for s, n := range res.Statuses {
+		statuses = append(statuses, fmt.Sprintf("%s=%d", s, n))
+	}
+	sort.Strings(statuses)
+	fmt.Fprintf(w, "statuses:  %s\n", strings.Join(statuses, " "))
+	if len(res.Latencies) > 0 {
+		fmt.Fprintf(w, "latency:   p50=%.1fms p90=%.1fms p95=%.1fms p99=%.1fms max=%.1fms\n",
+			res.Latencies["p50"], res.Latencies["p90"], res.Latencies["p95"], res.Latencies["p99"], res.Latencies["max"])
+	}
+}
@@ -0,0 +1,100 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	if got := latencyPercentiles(nil); len(got) != 0 {
+		t.Errorf("latencyPercentiles(nil) = %v, want none", got)
+	}
+
+	var latencies []time.Duration
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	want := map[string]float64{"p50": 50, "p90": 90, "p95": 95, "p99": 99, "max": 100}
+	got := latencyPercentiles(latencies)
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("latencyPercentiles()[%s] = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			CSR      string `json:"csr"`
+			NotAfter string `json:"notAfter"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		block, _ := pem.Decode([]byte(body.CSR))
+		if r.URL.Path != "/v1/sign" || r.Header.Get("Authorization") != "Bearer secret" || block == nil || body.NotAfter != "1h" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		names = append(names, csr.DNSNames...)
+		mu.Unlock()
+		if strings.HasPrefix(csr.Subject.CommonName, "fail") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	o := benchOptions{target: srv.URL + "/", rate: 100, duration: 200 * time.Millisecond, concurrency: 4, keyType: "ec", san: "bench-%d.example.com", notAfter: "1h", token: "secret"}
+	res := runBench(context.Background(), srv.Client(), o)
+	if res.Sent == 0 || res.Issued != res.Sent || res.Failed != 0 || res.Statuses["201"] != res.Issued || res.Latencies["max"] == 0 {
+		t.Errorf("runBench() = %+v, want every request issued", res)
+	}
+	if len(names) != res.Sent || names[0] == names[len(names)-1] || !strings.HasSuffix(names[0], ".example.com") {
+		t.Errorf("SANs requested = %v, want one per request", names)
+	}
+
+	o.san = "fail.example.com"
+	res = runBench(context.Background(), srv.Client(), o)
+	if res.Sent == 0 || res.Failed != res.Sent || res.Statuses["403"] != res.Failed || len(res.Latencies) != 0 {
+		t.Errorf("runBench() of denied requests = %+v, want every request failed", res)
+	}
+
+	var out bytes.Buffer
+	printBenchResult(&out, res)
+	if !strings.Contains(out.String(), "statuses:  403=") {
+		t.Errorf("printBenchResult() = %q, want the statuses", out.String())
+	}
+}
+
+func TestRunBenchCommandUsage(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"-target", "https://localhost", "-rate", "0"},
+		{"-target", "https://localhost", "-key-type", "ed25519"},
+		{"-unknown"},
+	} {
+		if got := runBenchCommand(args); got != exitUsage {
+			t.Errorf("runBenchCommand(%q) = %d, want %d", args, got, exitUsage)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package signer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+)
+
+// bootstrapTimeout is the timeout of the root download.
+const bootstrapTimeout = 30 * time.Second
+
+// bootstrapRoot downloads the root certificate of the upstream CA to
+// rootCAPath if rootFingerprint is set, replacing the step CLI bootstrap of
+// an init container. An existing root is kept if it matches the
+// fingerprint, and is an error otherwise unless force is set. It returns
+// true if the root was written.
+func bootstrapRoot(cfg *Config, force bool) (bool, error) {
+	if cfg.RootFingerprint == "" {
+		return false, nil
+	}
+	fingerprint := normalizeFingerprint(cfg.RootFingerprint)
+	path := cfg.GetRootCAPath()
+
+	if data, err := os.ReadFile(path); err == nil {
+		if fp, err := pemFingerprint(data); err == nil && fp == fingerprint {
+			return false, nil
+		}
+		if !force {
+			return false, errors.Errorf("root certificate %s does not match rootFingerprint", path)
+		}
+	}
+
+	client, err := ca.NewClient(cfg.CaURL, ca.WithRootSHA256(fingerprint))
+	if err != nil {
+		return false, errors.Wrap(err, "error creating CA client")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+	defer cancel()
+	// The root is fetched without verifying the TLS connection, and
+	// verified against the fingerprint.
+	resp, err := client.RootWithContext(ctx, fingerprint)
+	if err != nil {
+		return false, errors.Wrap(err, "error downloading root certificate")
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: resp.RootPEM.Raw})
+	if err := writeFileAtomic(path, data, 0o644); err != nil {
+		return false, errors.Wrap(err, "error writing root certificate")
+	}
+
+	return true, nil
+}
+
+// pemFingerprint returns the SHA-256 fingerprint of the first certificate
+// in PEM data.
+func pemFingerprint(data []byte) (string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.New("no certificate found")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(block.Bytes)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeFileAtomic writes data to a temporary file renamed to path, creating
+// the directory if needed.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// bootstrapAtStartup downloads the root at startup if it is missing, see
+// bootstrapRoot.
+func bootstrapAtStartup(cfg *Config) error {
+	written, err := bootstrapRoot(cfg, false)
+	if err != nil || !written {
+		return err
+	}
+	logFor("server").WithFields(log.Fields{
+		"caURL":       cfg.CaURL,
+		"rootCAPath":  cfg.GetRootCAPath(),
+		"fingerprint": normalizeFingerprint(cfg.RootFingerprint),
+	}).Info("Downloaded the root certificate of the upstream CA")
+
+	return nil
+}
+
+// runBootstrapCommand implements "ca-signer bootstrap". It downloads the
+// root certificate of the CA and writes it to the root path, like step ca
+// bootstrap. The flags default to the config file, if any, and the
+// CA_SIGNER_ environment variables.
+func runBootstrapCommand(args []string) int {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv(configFileEnv), "path to the signer configuration (optional)")
+	caURL := fs.String("ca-url", "", "URL of the CA")
+	fingerprint := fs.String("fingerprint", "", "SHA-256 fingerprint of the root certificate")
+	root := fs.String("root", "", "path the root certificate is written to")
+	force := fs.Bool("force", false, "replace an existing root that does not match the fingerprint")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	cfg := &Config{}
+	if *file != "" {
+		var err error
+		if cfg, err = loadConfig(*file); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+			return exitUsage
+		}
+	} else if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		fmt.Fprintf(os.Stderr, "error loading environment: %v\n", err)
+		return exitUsage
+	}
+	for _, f := range []struct {
+		value *string
+		field *string
+	}{{caURL, &cfg.CaURL}, {fingerprint, &cfg.RootFingerprint}, {root, &cfg.RootCAPath}} {
+		if *f.value != "" {
+			*f.field = *f.value
+		}
+	}
+	if cfg.CaURL == "" || cfg.RootFingerprint == "" {
+		fmt.Fprintln(os.Stderr, "usage: ca-signer bootstrap --ca-url <url> --fingerprint <sha256> [--root <file>] [--force]")
+		return exitUsage
+	}
+
+	written, err := bootstrapRoot(cfg, *force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error bootstrapping: %v\n", err)
+		return exitError
+	}
+	if written {
+		fmt.Printf("The root certificate has been saved in %s.\n", cfg.GetRootCAPath())
+	} else {
+		fmt.Printf("The root certificate in %s matches the fingerprint.\n", cfg.GetRootCAPath())
+	}
+
+	return 0
+}
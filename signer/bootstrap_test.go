@@ -0,0 +1,50 @@
+package signer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBootstrapRoot(t *testing.T) {
+	up := newTestUpstream(t)
+	sum := sha256.Sum256(up.root.Raw)
+	other, _ := newTestCert(t, "Other Root CA")
+	path := filepath.Join(t.TempDir(), "certs", "root_ca.crt")
+	cfg := &Config{CaURL: up.URL, RootCAPath: path, RootFingerprint: hex.EncodeToString(sum[:])}
+
+	if written, err := bootstrapRoot(&Config{CaURL: up.URL, RootCAPath: path}, false); written || err != nil {
+		t.Errorf("bootstrapRoot() without fingerprint = %v, %v, want nothing done", written, err)
+	}
+	if written, err := bootstrapRoot(cfg, false); !written || err != nil {
+		t.Fatalf("bootstrapRoot() = %v, %v, want the root written", written, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp, err := pemFingerprint(data); err != nil || fp != cfg.RootFingerprint {
+		t.Errorf("written root fingerprint = %s, %v, want %s", fp, err, cfg.RootFingerprint)
+	}
+	if written, err := bootstrapRoot(cfg, false); written || err != nil {
+		t.Errorf("bootstrapRoot() of a matching root = %v, %v, want it kept", written, err)
+	}
+
+	if err := writeFile(path, certPEM(other)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bootstrapRoot(cfg, false); err == nil {
+		t.Error("bootstrapRoot() of a mismatching root error = nil")
+	}
+	if written, err := bootstrapRoot(cfg, true); !written || err != nil {
+		t.Errorf("bootstrapRoot() with force = %v, %v, want the root replaced", written, err)
+	}
+
+	cfg.RootFingerprint = hex.EncodeToString(make([]byte, sha256.Size))
+	os.Remove(path)
+	if _, err := bootstrapRoot(cfg, false); err == nil {
+		t.Error("bootstrapRoot() of a wrong fingerprint error = nil")
+	}
+}
@@ -0,0 +1,138 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// bundleOptions is the chain layout requested with the includeRoot,
+// chainOrder and format query parameters.
+type bundleOptions struct {
+	includeRoot bool
+	rootFirst   bool
+	pem         bool
+}
+
+// parseBundleOptions reads the chain layout from the query of r. The chain
+// is leaf first without the root by default.
+func parseBundleOptions(r *http.Request) (bundleOptions, error) {
+	var opts bundleOptions
+	q := r.URL.Query()
+	if v := q.Get("includeRoot"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, errs.BadRequest("invalid includeRoot %q", v)
+		}
+		opts.includeRoot = b
+	}
+	switch v := q.Get("chainOrder"); v {
+	case "", "leaf-first":
+	case "root-first":
+		opts.rootFirst = true
+	default:
+		return opts, errs.BadRequest("invalid chainOrder %q, must be leaf-first or root-first", v)
+	}
+	switch v := q.Get("format"); v {
+	case "", "json":
+	case "pem":
+		opts.pem = true
+	default:
+		return opts, errs.BadRequest("invalid format %q, must be json or pem", v)
+	}
+
+	return opts, nil
+}
+
+// bundle returns a copy of resp with the certChain in the requested layout.
+func (s *server) bundle(resp *api.SignResponse, opts bundleOptions) (*api.SignResponse, error) {
+	out := *resp
+	out.CertChainPEM = append([]api.Certificate{}, responseChain(resp)...)
+
+	if opts.includeRoot {
+		root := chainRoot(out.CertChainPEM, s.trustedRoots)
+		if root == nil {
+			return nil, errors.New("chain is not signed by a trusted root")
+		}
+		if last := out.CertChainPEM[len(out.CertChainPEM)-1]; !last.Certificate.Equal(root) {
+			out.CertChainPEM = append(out.CertChainPEM, api.NewCertificate(root))
+		}
+	}
+
+	if opts.rootFirst {
+		chain := out.CertChainPEM
+		for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+			chain[i], chain[j] = chain[j], chain[i]
+		}
+	}
+
+	return &out, nil
+}
+
+// writeSignResponse writes resp in the layout and format requested in r.
+// The SCTs of the certificate, if any, and the secondary certificate of a
+// dual issuance are returned in the JSON format.
+func (s *server) writeSignResponse(w http.ResponseWriter, r *http.Request, resp *api.SignResponse, scts []signedCertificateTimestamp, secondary *api.SignResponse, opts bundleOptions, status int) {
+	endRender := timePhase(r.Context(), phaseRender)
+	s.setCertificateHeaders(w, resp)
+	if fp := s.rootFingerprint(resp); fp != "" {
+		w.Header().Set("X-Root-Fingerprint", fp)
+	}
+
+	resp, err := s.bundle(resp, opts)
+	if err != nil {
+		endRender()
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	if !opts.pem {
+		var body renewableResponse
+		body.SignResponse = resp
+		body.SCTs = scts
+		if secondary != nil {
+			if body.Secondary, err = s.bundle(secondary, opts); err != nil {
+				endRender()
+				render.Error(w, r, errs.InternalServerErr(err))
+				return
+			}
+		}
+		if cert := resp.ServerPEM.Certificate; cert != nil {
+			body.RenewAfter = s.config.Renewal.renewAfter(cert)
+		}
+		endRender()
+		render.JSONStatus(w, r, body, status)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, c := range resp.CertChainPEM {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	endRender()
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// readRootCertificate returns the first certificate in the root file.
+func readRootCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading root certificate")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.Errorf("%s is not a PEM certificate", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
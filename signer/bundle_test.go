@@ -0,0 +1,131 @@
+package signer
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/api"
+)
+
+func TestParseBundleOptions(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bundleOptions
+		ok    bool
+	}{
+		{"", bundleOptions{}, true},
+		{"includeRoot=true&chainOrder=root-first&format=pem", bundleOptions{includeRoot: true, rootFirst: true, pem: true}, true},
+		{"includeRoot=0&chainOrder=leaf-first&format=json", bundleOptions{}, true},
+		{"includeRoot=yes", bundleOptions{}, false},
+		{"chainOrder=random", bundleOptions{}, false},
+		{"format=der", bundleOptions{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseBundleOptions(httptest.NewRequest(http.MethodPost, "/sign?"+tt.query, nil))
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("parseBundleOptions(%q) = %+v, %v, want %+v, ok %v", tt.query, got, err, tt.want, tt.ok)
+		}
+		if !tt.ok && errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("parseBundleOptions(%q) status = %d, want 400", tt.query, errorStatus(err))
+		}
+	}
+}
+
+func TestBundle(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	intermediate, intermediateKey := issueTestCert(t, root, rootKey, "Intermediate CA", true)
+	leaf, _ := issueTestCert(t, intermediate, intermediateKey, "www.example.com", false)
+	other, _ := newTestCert(t, "Other Root CA")
+	resp := &api.SignResponse{ServerPEM: api.NewCertificate(leaf), CaPEM: api.NewCertificate(intermediate)}
+
+	names := func(chain []api.Certificate) []string {
+		var out []string
+		for _, c := range chain {
+			out = append(out, c.Subject.CommonName)
+		}
+		return out
+	}
+	tests := []struct {
+		opts bundleOptions
+		want []string
+	}{
+		{bundleOptions{}, []string{"www.example.com", "Intermediate CA"}},
+		{bundleOptions{includeRoot: true}, []string{"www.example.com", "Intermediate CA", "Root CA"}},
+		{bundleOptions{includeRoot: true, rootFirst: true}, []string{"Root CA", "Intermediate CA", "www.example.com"}},
+		{bundleOptions{rootFirst: true}, []string{"Intermediate CA", "www.example.com"}},
+	}
+	s := &server{trustedRoots: []*x509.Certificate{other, root}}
+	for _, tt := range tests {
+		got, err := s.bundle(resp, tt.opts)
+		if err != nil || !sameStrings(names(got.CertChainPEM), tt.want) {
+			t.Errorf("bundle(%+v) = %v, %v, want %v", tt.opts, names(got.CertChainPEM), err, tt.want)
+		}
+	}
+	if len(resp.CertChainPEM) != 0 {
+		t.Errorf("bundle() modified the response chain: %v", names(resp.CertChainPEM))
+	}
+
+	// The root is not added twice if the upstream chain has it.
+	withRoot := &api.SignResponse{CertChainPEM: []api.Certificate{api.NewCertificate(leaf), api.NewCertificate(intermediate), api.NewCertificate(root)}}
+	if got, _ := s.bundle(withRoot, bundleOptions{includeRoot: true}); len(got.CertChainPEM) != 3 {
+		t.Errorf("bundle() of a chain with its root = %v, want 3 certificates", names(got.CertChainPEM))
+	}
+
+	s.trustedRoots = []*x509.Certificate{other}
+	if _, err := s.bundle(resp, bundleOptions{includeRoot: true}); err == nil {
+		t.Error("bundle() included an untrusted root")
+	}
+}
+
+func TestWriteSignResponsePEM(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	leaf, _ := issueTestCert(t, root, rootKey, "www.example.com", false)
+	s := &server{config: &Config{}, trustedRoots: []*x509.Certificate{root}}
+	resp := &api.SignResponse{ServerPEM: api.NewCertificate(leaf), CaPEM: api.NewCertificate(root)}
+
+	r := httptest.NewRequest(http.MethodPost, "/sign?format=pem&includeRoot=true", nil)
+	w := httptest.NewRecorder()
+	s.writeSignResponse(w, r, resp, nil, nil, bundleOptions{includeRoot: true, pem: true}, http.StatusCreated)
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != "application/x-pem-file" {
+		t.Fatalf("status = %d, Content-Type = %q, want a 201 PEM response", w.Code, w.Header().Get("Content-Type"))
+	}
+	var n int
+	for rest := w.Body.Bytes(); ; n++ {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+	}
+	if n != 2 {
+		t.Errorf("PEM response has %d certificates, want 2", n)
+	}
+	if w.Header().Get("X-Root-Fingerprint") == "" {
+		t.Error("X-Root-Fingerprint is missing")
+	}
+}
+
+func TestCertificateHeaders(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	leaf, _ := issueTestCert(t, root, rootKey, "www.example.com", false)
+	s := &server{config: &Config{}, trustedRoots: []*x509.Certificate{root}}
+	resp := &api.SignResponse{ServerPEM: api.NewCertificate(leaf), CaPEM: api.NewCertificate(root)}
+
+	w := httptest.NewRecorder()
+	s.writeSignResponse(w, httptest.NewRequest(http.MethodPost, "/sign", nil), resp, nil, nil, bundleOptions{}, http.StatusCreated)
+	sum := sha256.Sum256(leaf.Raw)
+	if got := w.Header().Get("X-Certificate-Serial"); got != leaf.SerialNumber.String() {
+		t.Errorf("X-Certificate-Serial = %q, want %s", got, leaf.SerialNumber)
+	}
+	if got := w.Header().Get("X-Certificate-Fingerprint"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("X-Certificate-Fingerprint = %q, want %x", got, sum)
+	}
+	if _, err := time.Parse(time.RFC3339, w.Header().Get("X-Renew-After")); err != nil {
+		t.Errorf("X-Renew-After = %q: %v", w.Header().Get("X-Renew-After"), err)
+	}
+}
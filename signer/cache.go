@@ -0,0 +1,132 @@
+package signer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheConfig configures the caching of the upstream read-only responses.
+type CacheConfig struct {
+	TTL      string `yaml:"ttl"`
+	MaxStale string `yaml:"maxStale"`
+}
+
+// GetTTL returns how long a cached response is fresh, defaults to 5m.
+func (c CacheConfig) GetTTL() time.Duration {
+	if d, err := time.ParseDuration(c.TTL); err == nil {
+		return d
+	}
+
+	return 5 * time.Minute
+}
+
+// GetMaxStale returns how long a response can be served after it expired
+// while it is refreshed in the background or the upstream is down, defaults
+// to 1h.
+func (c CacheConfig) GetMaxStale() time.Duration {
+	if d, err := time.ParseDuration(c.MaxStale); err == nil {
+		return d
+	}
+
+	return time.Hour
+}
+
+// Cache statuses reported in the X-Cache response header.
+const (
+	cacheHit   = "HIT"
+	cacheStale = "STALE"
+	cacheMiss  = "MISS"
+)
+
+// upstreamCache caches upstream responses using stale-while-revalidate: a
+// stale entry is returned immediately while it is refreshed in the
+// background, and it keeps being served while the upstream fails until it
+// is older than ttl+maxStale.
+type upstreamCache struct {
+	ttl      time.Duration
+	maxStale time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	value      interface{}
+	fetched    time.Time
+	refreshing bool
+}
+
+type fetchFunc func(context.Context) (interface{}, error)
+
+func newUpstreamCache(c CacheConfig, timeout time.Duration) *upstreamCache {
+	return &upstreamCache{
+		ttl:      c.GetTTL(),
+		maxStale: c.GetMaxStale(),
+		timeout:  timeout,
+		entries:  map[string]*cacheEntry{},
+	}
+}
+
+// Get returns the cached value of key, calling fetch if it is missing or too
+// old. It also returns the time the value was fetched and the cache status.
+func (c *upstreamCache) Get(ctx context.Context, key string, fetch fetchFunc) (interface{}, time.Time, string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		// The entry is read under the lock, refresh updates it in place.
+		value, fetched := e.value, e.fetched
+		age := time.Since(fetched)
+		switch {
+		case age < c.ttl:
+			c.mu.Unlock()
+			return value, fetched, cacheHit, nil
+		case age < c.ttl+c.maxStale:
+			if !e.refreshing {
+				e.refreshing = true
+				go c.refresh(key, fetch)
+			}
+			c.mu.Unlock()
+			return value, fetched, cacheStale, nil
+		}
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	v, err := fetch(ctx)
+	if err != nil {
+		return nil, time.Time{}, cacheMiss, upstreamError(ctx, err)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	c.entries[key] = &cacheEntry{value: v, fetched: now}
+	c.mu.Unlock()
+
+	return v, now, cacheMiss, nil
+}
+
+func (c *upstreamCache) refresh(key string, fetch fetchFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	v, err := fetch(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	e.refreshing = false
+	if err != nil {
+		logFor("cache").WithFields(log.Fields{
+			"key":   key,
+			"error": err,
+		}).Warn("Error refreshing upstream response, serving stale")
+		return
+	}
+	e.value, e.fetched = v, time.Now()
+}
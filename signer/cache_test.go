@@ -0,0 +1,101 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ageEntry moves the fetch time of the cached key back by d.
+func ageEntry(c *upstreamCache, key string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key].fetched = c.entries[key].fetched.Add(-d)
+}
+
+func TestUpstreamCacheStaleWhileRevalidate(t *testing.T) {
+	c := newUpstreamCache(CacheConfig{TTL: "1m", MaxStale: "1h"}, time.Second)
+	ctx := context.Background()
+	var calls atomic.Int32
+	var failing atomic.Bool
+	refreshed := make(chan struct{}, 1)
+	fetch := func(context.Context) (interface{}, error) {
+		n := calls.Add(1)
+		defer func() {
+			if n > 1 {
+				refreshed <- struct{}{}
+			}
+		}()
+		if failing.Load() {
+			return nil, errors.New("upstream down")
+		}
+		return n, nil
+	}
+
+	tests := []struct {
+		name   string
+		age    time.Duration
+		value  interface{}
+		status string
+	}{
+		{"miss", 0, int32(1), cacheMiss},
+		{"hit", 0, int32(1), cacheHit},
+		{"stale", 2 * time.Minute, int32(1), cacheStale},
+	}
+	for _, tt := range tests {
+		if tt.age > 0 {
+			ageEntry(c, "roots", tt.age)
+		}
+		v, _, status, err := c.Get(ctx, "roots", fetch)
+		if err != nil || v != tt.value || status != tt.status {
+			t.Fatalf("%s: Get() = %v, %s, %v, want %v, %s", tt.name, v, status, err, tt.value, tt.status)
+		}
+	}
+	<-refreshed
+	if v, _, status, _ := c.Get(ctx, "roots", fetch); v != int32(2) || status != cacheHit {
+		t.Fatalf("Get() after the refresh = %v, %s, want 2, %s", v, status, cacheHit)
+	}
+
+	// A failing upstream keeps the stale value until maxStale.
+	failing.Store(true)
+	ageEntry(c, "roots", 30*time.Minute)
+	if v, _, status, err := c.Get(ctx, "roots", fetch); err != nil || v != int32(2) || status != cacheStale {
+		t.Fatalf("Get() with a failing upstream = %v, %s, %v", v, status, err)
+	}
+	<-refreshed
+	ageEntry(c, "roots", 2*time.Hour)
+	if _, _, _, err := c.Get(ctx, "roots", fetch); err == nil {
+		t.Error("Get() past maxStale with a failing upstream error = nil")
+	}
+}
+
+func TestServeCached(t *testing.T) {
+	s := &server{cache: newUpstreamCache(CacheConfig{}, time.Second)}
+	fetch := func(context.Context) (interface{}, error) {
+		return map[string]string{"status": "ok"}, nil
+	}
+	for _, want := range []string{cacheMiss, cacheHit} {
+		w := httptest.NewRecorder()
+		s.serveCached(w, httptest.NewRequest(http.MethodGet, "/health", nil), "health", fetch)
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != want || w.Header().Get("Age") != "0" {
+			t.Errorf("serveCached() = %d, X-Cache %s, Age %s, want %s", w.Code, w.Header().Get("X-Cache"), w.Header().Get("Age"), want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.serveCached(w, httptest.NewRequest(http.MethodPost, "/health", nil), "health", fetch)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("serveCached() of a POST = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	w = httptest.NewRecorder()
+	s.serveCached(w, httptest.NewRequest(http.MethodGet, "/roots", nil), "roots", func(context.Context) (interface{}, error) {
+		return nil, errors.New("connection refused")
+	})
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("serveCached() with a failing upstream = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,381 @@
+package signer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+var campaignsBucket = []byte("campaigns")
+
+// campaign requires the certificates it targets to be rotated by a deadline.
+// The targets are the valid certificates matching a SAN pattern or issued to
+// a requester when the campaign starts. A target is rotated once it expires
+// or is revoked, or a certificate with the same SANs is issued after the
+// start.
+type campaign struct {
+	ID         string    `json:"id"`
+	Reason     string    `json:"reason"`
+	RotateBy   time.Time `json:"rotateBy"`
+	SANs       []string  `json:"sans,omitempty"`
+	Requesters []string  `json:"requesters,omitempty"`
+	Created    time.Time `json:"created"`
+	CreatedBy  []string  `json:"createdBy"`
+	Serials    []string  `json:"serials"`
+}
+
+// matches reports whether a record is targeted by the campaign patterns.
+func (c *campaign) matches(rec *certificateRecord) bool {
+	if policy.ContainsAny(c.Requesters, rec.Metadata.Client) {
+		return true
+	}
+	for _, pattern := range c.SANs {
+		for _, san := range append([]string{rec.Subject}, rec.SANs...) {
+			if ok, _ := path.Match(pattern, san); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// PutCampaign stores a campaign.
+func (inv *inventory) PutCampaign(c *campaign) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return inv.update(func(tx store.Tx) error {
+		return tx.Bucket(campaignsBucket).Put([]byte(c.ID), data)
+	})
+}
+
+// Campaigns returns the campaigns, oldest first.
+func (inv *inventory) Campaigns() ([]*campaign, error) {
+	campaigns := []*campaign{}
+	err := inv.view(func(tx store.Tx) error {
+		return tx.Bucket(campaignsBucket).ForEach(func(_, v []byte) error {
+			c := new(campaign)
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			campaigns = append(campaigns, c)
+			return nil
+		})
+	})
+	sort.Slice(campaigns, func(i, j int) bool {
+		return campaigns[i].Created.Before(campaigns[j].Created)
+	})
+
+	return campaigns, err
+}
+
+// DeleteCampaign removes a campaign, and returns false if it did not exist.
+func (inv *inventory) DeleteCampaign(id string) (bool, error) {
+	var found bool
+	err := inv.update(func(tx store.Tx) error {
+		b := tx.Bucket(campaignsBucket)
+		found = b.Get([]byte(id)) != nil
+		return b.Delete([]byte(id))
+	})
+
+	return found, err
+}
+
+// campaignReport is the compliance of a campaign.
+type campaignReport struct {
+	*campaign
+	Total   int      `json:"total"`
+	Rotated int      `json:"rotated"`
+	Pending []string `json:"pending"`
+	Overdue bool     `json:"overdue"`
+}
+
+// campaignReports returns the compliance of the campaigns, in one pass over
+// the inventory.
+func (s *server) campaignReports(campaigns []*campaign, now time.Time) ([]campaignReport, error) {
+	type target struct {
+		rec       *certificateRecord
+		campaigns []int
+	}
+	targets := map[string]*target{}
+	for i, c := range campaigns {
+		for _, serial := range c.Serials {
+			if targets[serial] == nil {
+				targets[serial] = &target{}
+			}
+			targets[serial].campaigns = append(targets[serial].campaigns, i)
+		}
+	}
+
+	// replaced[i] holds the SAN sets issued after the start of campaign i.
+	replaced := make([]map[string]bool, len(campaigns))
+	for i := range replaced {
+		replaced[i] = map[string]bool{}
+	}
+	err := s.inventory.All(func(rec *certificateRecord) error {
+		if t, ok := targets[rec.Serial]; ok {
+			t.rec = rec
+		}
+		for i, c := range campaigns {
+			if rec.Metadata.IssuedAt.After(c.Created) {
+				replaced[i][sanSetKey(rec)] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]campaignReport, len(campaigns))
+	for i, c := range campaigns {
+		reports[i] = campaignReport{campaign: c, Total: len(c.Serials), Pending: []string{}}
+	}
+	for serial, t := range targets {
+		for _, i := range t.campaigns {
+			// Records deleted by the retention have expired long ago.
+			if t.rec == nil || t.rec.status(now) != statusValid || replaced[i][sanSetKey(t.rec)] {
+				reports[i].Rotated++
+			} else {
+				reports[i].Pending = append(reports[i].Pending, serial)
+			}
+		}
+	}
+	for i := range reports {
+		sort.Strings(reports[i].Pending)
+		reports[i].Overdue = len(reports[i].Pending) > 0 && now.After(reports[i].RotateBy)
+		campaignPending.WithLabelValues(reports[i].ID).Set(float64(len(reports[i].Pending)))
+	}
+
+	return reports, nil
+}
+
+// sanSetKey identifies the names of a certificate, regardless of their order.
+func sanSetKey(rec *certificateRecord) string {
+	names := append([]string{rec.Subject}, rec.SANs...)
+	sort.Strings(names)
+	data, _ := json.Marshal(names)
+	return string(data)
+}
+
+// pendingCampaigns returns the campaigns a certificate must still be rotated
+// for.
+func (s *server) pendingCampaigns(serial string) ([]campaignReport, error) {
+	campaigns, err := s.inventory.Campaigns()
+	if err != nil {
+		return nil, err
+	}
+	var targeting []*campaign
+	for _, c := range campaigns {
+		if policy.ContainsAny(c.Serials, []string{serial}) {
+			targeting = append(targeting, c)
+		}
+	}
+	if len(targeting) == 0 {
+		return nil, nil
+	}
+
+	reports, err := s.campaignReports(targeting, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var pending []campaignReport
+	for _, r := range reports {
+		if policy.ContainsAny(r.Pending, []string{serial}) {
+			pending = append(pending, r)
+		}
+	}
+
+	return pending, nil
+}
+
+// annotateCampaigns sets the pending rotation campaigns of a record and the
+// earliest deadline.
+func (s *server) annotateCampaigns(rec *certificateRecord) error {
+	pending, err := s.pendingCampaigns(rec.Serial)
+	if err != nil {
+		return err
+	}
+	for _, c := range pending {
+		rec.Campaigns = append(rec.Campaigns, c.ID)
+		if rec.RotateBy == nil || c.RotateBy.Before(*rec.RotateBy) {
+			rotateBy := c.RotateBy
+			rec.RotateBy = &rotateBy
+		}
+	}
+
+	return nil
+}
+
+// CampaignRequest is the body of POST /admin/campaigns.
+type CampaignRequest struct {
+	Reason     string    `json:"reason"`
+	RotateBy   time.Time `json:"rotateBy"`
+	SANs       []string  `json:"sans"`
+	Requesters []string  `json:"requesters"`
+}
+
+// createCampaign starts a rotation campaign for the valid certificates
+// matching the request, and pushes a renewal notice to their clients.
+func (s *server) createCampaign(w http.ResponseWriter, r *http.Request) {
+	var body CampaignRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+	if len(body.SANs) == 0 && len(body.Requesters) == 0 {
+		render.Error(w, r, errs.BadRequest("sans or requesters is required"))
+		return
+	}
+	for _, pattern := range body.SANs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			render.Error(w, r, errs.BadRequest("invalid SAN pattern %q", pattern))
+			return
+		}
+	}
+	if body.RotateBy.IsZero() {
+		render.Error(w, r, errs.BadRequest("rotateBy is required"))
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	now := time.Now().UTC()
+	c := &campaign{
+		ID:         hex.EncodeToString(b),
+		Reason:     body.Reason,
+		RotateBy:   body.RotateBy.UTC(),
+		SANs:       body.SANs,
+		Requesters: body.Requesters,
+		Created:    now,
+		CreatedBy:  clientIdentities(r),
+		Serials:    []string{},
+	}
+	var clients []string
+	err := s.inventory.All(func(rec *certificateRecord) error {
+		if rec.status(now) == statusValid && c.matches(rec) {
+			c.Serials = append(c.Serials, rec.Serial)
+			clients = append(clients, rec.Metadata.Client...)
+		}
+		return nil
+	})
+	if err == nil {
+		err = s.inventory.PutCampaign(c)
+	}
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	var delivered int
+	if s.renewals != nil && len(c.Serials) > 0 {
+		delivered = s.renewals.notify(func(sub *renewalSubscriber) bool {
+			return policy.ContainsAny(c.Serials, sub.serials) || policy.ContainsAny(clients, sub.clients)
+		}, c.notice())
+	}
+
+	logFor("admin").WithFields(log.Fields{
+		"client":    c.CreatedBy,
+		"campaign":  c.ID,
+		"reason":    c.Reason,
+		"rotateBy":  c.RotateBy,
+		"targets":   len(c.Serials),
+		"delivered": delivered,
+	}).Warn("Started rotation campaign")
+
+	reports, err := s.campaignReports([]*campaign{c}, now)
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	render.JSONStatus(w, r, reports[0], http.StatusCreated)
+}
+
+// notice returns the renewal notice of the campaign.
+func (c *campaign) notice() renewalNotice {
+	rotateBy := c.RotateBy
+	return renewalNotice{
+		Time:     time.Now().UTC(),
+		Reason:   c.Reason,
+		Serials:  c.Serials,
+		Campaign: c.ID,
+		RotateBy: &rotateBy,
+	}
+}
+
+// listCampaigns returns the compliance of every campaign.
+func (s *server) listCampaigns(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := s.inventory.Campaigns()
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	reports, err := s.campaignReports(campaigns, time.Now())
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	render.JSON(w, r, reports)
+}
+
+// getCampaign returns the compliance of a campaign.
+func (s *server) getCampaign(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := s.inventory.Campaigns()
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	for _, c := range campaigns {
+		if c.ID != r.PathValue("id") {
+			continue
+		}
+		reports, err := s.campaignReports([]*campaign{c}, time.Now())
+		if err != nil {
+			render.Error(w, r, errs.InternalServerErr(err))
+			return
+		}
+		render.JSON(w, r, reports[0])
+		return
+	}
+
+	render.Error(w, r, errs.NotFound("campaign not found"))
+}
+
+// deleteCampaign ends a campaign.
+func (s *server) deleteCampaign(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	found, err := s.inventory.DeleteCampaign(id)
+	switch {
+	case err != nil:
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	case !found:
+		render.Error(w, r, errs.NotFound("campaign not found"))
+		return
+	}
+
+	campaignPending.DeleteLabelValues(id)
+	logFor("admin").WithFields(log.Fields{
+		"client":   clientIdentities(r),
+		"campaign": id,
+	}).Warn("Ended rotation campaign")
+	w.WriteHeader(http.StatusNoContent)
+}
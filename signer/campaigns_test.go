@@ -0,0 +1,97 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCampaigns(t *testing.T) {
+	inv := newTestInventory(t)
+	now := time.Now()
+	for _, rec := range []*certificateRecord{
+		{Serial: "1", Subject: "www.example.com", SANs: []string{"www.example.com"}, Metadata: issuanceMetadata{Client: []string{"web"}}},
+		{Serial: "2", Subject: "api.example.com", SANs: []string{"api.example.com"}, Metadata: issuanceMetadata{Client: []string{"api"}}},
+		{Serial: "3", Subject: "db.example.com", SANs: []string{"db.example.com"}, Metadata: issuanceMetadata{Client: []string{"db"}}},
+		{Serial: "4", Subject: "www.example.com", SANs: []string{"www.example.com"}, NotAfter: now.Add(-time.Minute)},
+	} {
+		rec.Fingerprint = "fp" + rec.Serial
+		rec.Metadata.IssuedAt = now.Add(-time.Hour)
+		if rec.NotAfter.IsZero() {
+			rec.NotAfter = now.Add(time.Hour)
+		}
+		if err := inv.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{config: &Config{}, inventory: inv, renewals: newRenewalHub(RenewalStreamConfig{})}
+	sub, _ := s.renewals.subscribe([]string{"api"}, nil)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"no targets", `{"rotateBy":"2030-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{"invalid pattern", `{"sans":["["],"rotateBy":"2030-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{"no deadline", `{"sans":["www.*"]}`, http.StatusBadRequest},
+		{"created", `{"reason":"key compromise","sans":["www.*"],"requesters":["api"],"rotateBy":"2030-01-01T00:00:00Z"}`, http.StatusCreated},
+	}
+	report := campaignReport{campaign: &campaign{}}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.createCampaign(w, withIdentities(httptest.NewRequest(http.MethodPost, "/admin/campaigns", strings.NewReader(tt.body)), "admin"))
+		if w.Code != tt.status {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if w.Code == http.StatusCreated {
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if report.Total != 2 || report.Rotated != 0 || !sameStrings(report.Pending, []string{"1", "2"}) || report.Overdue {
+		t.Errorf("created campaign = %+v, want serials 1 and 2 pending", report)
+	}
+	if len(sub.ch) != 1 {
+		t.Errorf("notices queued to a targeted client = %d, want 1", len(sub.ch))
+	}
+
+	// A certificate for the same names issued after the start rotates 1.
+	if err := inv.Put(&certificateRecord{Serial: "5", Fingerprint: "fp5", Subject: "www.example.com", SANs: []string{"www.example.com"}, NotAfter: now.Add(time.Hour), Metadata: issuanceMetadata{IssuedAt: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	campaigns, err := inv.Campaigns()
+	if err != nil || len(campaigns) != 1 {
+		t.Fatalf("Campaigns() = %v, %v, want the created campaign", campaigns, err)
+	}
+	campaigns[0].RotateBy = now.Add(-time.Minute)
+	reports, err := s.campaignReports(campaigns, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := reports[0]; r.Rotated != 1 || !sameStrings(r.Pending, []string{"2"}) || !r.Overdue {
+		t.Errorf("campaignReports() after the deadline = %+v, want serial 2 overdue", r)
+	}
+
+	rec := &certificateRecord{Serial: "2"}
+	if err := s.annotateCampaigns(rec); err != nil || !sameStrings(rec.Campaigns, []string{report.ID}) || rec.RotateBy == nil || !rec.RotateBy.Equal(report.RotateBy) {
+		t.Errorf("annotateCampaigns() = %v, %v %v, want the campaign", err, rec.Campaigns, rec.RotateBy)
+	}
+	if notices := s.campaignNotices([]string{"2", "3"}); len(notices) != 1 || !sameStrings(notices[0].Serials, []string{"2"}) {
+		t.Errorf("campaignNotices() = %+v, want the notice of serial 2", notices)
+	}
+
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		r := withIdentities(httptest.NewRequest(http.MethodDelete, "/admin/campaigns/"+report.ID, nil), "admin")
+		r.SetPathValue("id", report.ID)
+		w := httptest.NewRecorder()
+		s.deleteCampaign(w, r)
+		if w.Code != status {
+			t.Errorf("deleteCampaign() = %d, want %d", w.Code, status)
+		}
+	}
+}
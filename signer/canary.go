@@ -0,0 +1,92 @@
+package signer
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+const (
+	generationStable = "stable"
+	generationCanary = "canary"
+)
+
+// CanaryConfig configures a policy and/or upstream provisioner that is only
+// applied to a percentage of the requests. Clients are assigned to the canary
+// by a hash of their identity, so a client always sees the same generation.
+// Promoting the canary is done by moving its settings to the main config.
+type CanaryConfig struct {
+	Percent                 int            `yaml:"percent"`
+	Policy                  *policy.Config `yaml:"policy"`
+	CaURL                   string         `yaml:"caURL"`
+	ProvisionerName         string         `yaml:"provisionerName"`
+	ProvisionerKid          string         `yaml:"provisionerKid"`
+	ProvisionerPasswordFile string         `yaml:"provisionerPasswordFile"`
+}
+
+// Enabled returns true if the canary receives any traffic.
+func (c CanaryConfig) Enabled() bool {
+	return c.Percent > 0
+}
+
+// Validate checks the canary percentage and policy.
+func (c CanaryConfig) Validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return errors.Errorf("invalid canary percent %d", c.Percent)
+	}
+	if c.Policy != nil {
+		return c.Policy.Validate()
+	}
+
+	return nil
+}
+
+// generationFor returns the config generation serving the request.
+func (s *server) generationFor(r *http.Request) string {
+	c := s.config.Canary
+	if !c.Enabled() {
+		return generationStable
+	}
+
+	var bucket int
+	if ids := clientIdentities(r); len(ids) > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(ids[0]))
+		bucket = int(h.Sum32() % 100)
+	} else {
+		bucket = rand.Intn(100) //nolint:gosec // not used for security
+	}
+
+	if bucket < c.Percent {
+		return generationCanary
+	}
+
+	return generationStable
+}
+
+// policyFor returns the policy of the given generation, with the runtime
+// rules.
+func (s *server) policyFor(generation string) policy.Config {
+	p := s.config.Policy
+	if generation == generationCanary && s.config.Canary.Policy != nil {
+		p = *s.config.Canary.Policy
+	}
+	if s.policyRules != nil {
+		p = s.policyRules.apply(p)
+	}
+
+	return p
+}
+
+// upstreamFor returns the upstream provisioner of the given generation.
+func (s *server) upstreamFor(generation string) string {
+	if generation == generationCanary && s.upstream(upstreamCanary) != nil {
+		return upstreamCanary
+	}
+
+	return upstreamDefault
+}
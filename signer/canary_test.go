@@ -0,0 +1,53 @@
+package signer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+func TestGenerationFor(t *testing.T) {
+	generation := func(s *server, client string) string {
+		return s.generationFor(withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), client))
+	}
+	for _, percent := range []int{0, 100} {
+		s := &server{config: &Config{Canary: CanaryConfig{Percent: percent}}}
+		want := map[int]string{0: generationStable, 100: generationCanary}[percent]
+		if got := generation(s, "web"); got != want {
+			t.Errorf("generationFor() at %d%% = %s, want %s", percent, got, want)
+		}
+	}
+
+	s := &server{config: &Config{Canary: CanaryConfig{Percent: 30}}}
+	canary := 0
+	for i := range 1000 {
+		client := "client-" + strconv.Itoa(i)
+		g := generation(s, client)
+		if g == generationCanary {
+			canary++
+		}
+		if again := generation(s, client); again != g {
+			t.Fatalf("generationFor(%s) = %s then %s, want the same generation", client, g, again)
+		}
+	}
+	if canary < 200 || canary > 400 {
+		t.Errorf("%d clients of 1000 in a 30%% canary", canary)
+	}
+}
+
+func TestPolicyForCanary(t *testing.T) {
+	canary := &policy.Config{DefaultAction: "deny"}
+	s := &server{config: &Config{Policy: policy.Config{DefaultAction: "allow"}, Canary: CanaryConfig{Percent: 10, Policy: canary}}}
+	if got := s.policyFor(generationStable).GetDefaultAction(); got != "allow" {
+		t.Errorf("policyFor(stable) defaultAction = %s, want allow", got)
+	}
+	if got := s.policyFor(generationCanary).GetDefaultAction(); got != "deny" {
+		t.Errorf("policyFor(canary) defaultAction = %s, want deny", got)
+	}
+	if err := (CanaryConfig{Percent: 101}).Validate(); err == nil {
+		t.Error("Validate() of a canary over 100% error = nil")
+	}
+}
@@ -0,0 +1,124 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net/http"
+	"slices"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/errs"
+)
+
+// Problems found in the chains returned by the upstream CAs.
+const (
+	chainDuplicate = "duplicate"
+	chainOrder     = "order"
+	chainUnrelated = "unrelated"
+)
+
+// normalizeChain returns the chain of leaf, leaf first and each certificate
+// followed by its issuer, built from the certificates returned with it, and
+// the problems of the returned chain: duplicated certificates, certificates
+// out of order, and certificates that are not in the chain of the leaf,
+// which are dropped.
+func normalizeChain(leaf *x509.Certificate, returned []api.Certificate) ([]api.Certificate, []string) {
+	var problems []string
+	addProblem := func(p string) {
+		if !slices.Contains(problems, p) {
+			problems = append(problems, p)
+		}
+	}
+
+	var pool []*x509.Certificate
+	seen := map[string]bool{}
+	for i, c := range returned {
+		if c.Certificate == nil {
+			continue
+		}
+		if seen[string(c.Certificate.Raw)] {
+			addProblem(chainDuplicate)
+			continue
+		}
+		seen[string(c.Certificate.Raw)] = true
+		if c.Certificate.Equal(leaf) {
+			if i != 0 {
+				addProblem(chainOrder)
+			}
+			continue
+		}
+		pool = append(pool, c.Certificate)
+	}
+
+	chain := []api.Certificate{api.NewCertificate(leaf)}
+	for current := leaf; !isSelfSigned(current); {
+		i := issuerIndex(current, pool)
+		if i < 0 {
+			break
+		}
+		if i != 0 {
+			addProblem(chainOrder)
+		}
+		current = pool[i]
+		chain = append(chain, api.NewCertificate(current))
+		pool = append(pool[:i], pool[i+1:]...)
+	}
+	if len(pool) > 0 {
+		addProblem(chainUnrelated)
+	}
+
+	return chain, problems
+}
+
+// issuerIndex returns the index of the certificate of pool that signed
+// cert, or -1.
+func issuerIndex(cert *x509.Certificate, pool []*x509.Certificate) int {
+	for i, c := range pool {
+		if bytes.Equal(c.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(c) == nil {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// repairChain replaces the chain of a response returned by the upstream
+// named name with its normalized chain. Repairs are logged and counted;
+// with strictChain, a chain needing one is rejected instead.
+func (s *server) repairChain(name string, resp *api.SignResponse) error {
+	leaf := resp.ServerPEM.Certificate
+	chain, problems := normalizeChain(leaf, responseChain(resp))
+	if len(problems) == 0 {
+		return nil
+	}
+
+	for _, p := range problems {
+		upstreamChainRepairs.WithLabelValues(name, p).Inc()
+	}
+	fields := log.Fields{
+		"upstream": name,
+		"serial":   leaf.SerialNumber.String(),
+		"problems": problems,
+	}
+	if s.config.ResponseValidation.StrictChain {
+		upstreamRejections.WithLabelValues(name, "malformed-chain").Inc()
+		logFor("server").WithFields(fields).Error("Rejected certificate returned by the upstream CA with a malformed chain")
+		return errs.Wrap(http.StatusBadGateway, errors.Errorf("chain has %v certificates", problems), "upstream CA returned a malformed chain")
+	}
+	logFor("server").WithFields(fields).Warn("Repaired the chain returned by the upstream CA")
+
+	if len(resp.CertChainPEM) > 0 {
+		resp.CertChainPEM = chain
+	}
+	if len(chain) > 1 {
+		resp.CaPEM = chain[1]
+	}
+
+	return nil
+}
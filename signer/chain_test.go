@@ -0,0 +1,87 @@
+package signer
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/api"
+)
+
+func TestNormalizeChain(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	intermediate, intermediateKey := issueTestCert(t, root, rootKey, "Intermediate CA", true)
+	issuing, issuingKey := issueTestCert(t, intermediate, intermediateKey, "Issuing CA", true)
+	leaf, _ := issueTestCert(t, issuing, issuingKey, "www.example.com", false)
+	other, _ := newTestCert(t, "Other Root CA")
+	c := api.NewCertificate
+
+	tests := []struct {
+		name     string
+		returned []api.Certificate
+		problems []string
+	}{
+		{"ordered", []api.Certificate{c(leaf), c(issuing), c(intermediate)}, nil},
+		{"with root", []api.Certificate{c(leaf), c(issuing), c(intermediate), c(root)}, nil},
+		{"duplicate", []api.Certificate{c(leaf), c(issuing), c(issuing), c(intermediate)}, []string{chainDuplicate}},
+		{"intermediates swapped", []api.Certificate{c(leaf), c(intermediate), c(issuing)}, []string{chainOrder}},
+		{"leaf last", []api.Certificate{c(issuing), c(intermediate), c(leaf)}, []string{chainOrder}},
+		{"unrelated", []api.Certificate{c(leaf), c(issuing), c(intermediate), c(other)}, []string{chainUnrelated}},
+		{"all", []api.Certificate{c(leaf), c(other), c(intermediate), c(leaf), c(issuing)}, []string{chainDuplicate, chainOrder, chainUnrelated}},
+		{"nil", []api.Certificate{c(leaf), {}, c(issuing), c(intermediate)}, nil},
+	}
+	for _, tt := range tests {
+		chain, problems := normalizeChain(leaf, tt.returned)
+		var got []string
+		for _, cert := range chain {
+			got = append(got, cert.Subject.CommonName)
+		}
+		want := []string{"www.example.com", "Issuing CA", "Intermediate CA"}
+		if tt.name == "with root" {
+			want = append(want, "Root CA")
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") || !sameStrings(problems, tt.problems) {
+			t.Errorf("%s: normalizeChain() = %v, %v, want %v, %v", tt.name, got, problems, want, tt.problems)
+		}
+	}
+}
+
+func TestRepairChain(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	intermediate, intermediateKey := issueTestCert(t, root, rootKey, "Intermediate CA", true)
+	leaf, _ := issueTestCert(t, intermediate, intermediateKey, "www.example.com", false)
+	c := api.NewCertificate
+	repairs := upstreamChainRepairs.WithLabelValues("primary", chainDuplicate)
+	rejections := upstreamRejections.WithLabelValues("primary", "malformed-chain")
+	before, beforeRejections := testutil.ToFloat64(repairs), testutil.ToFloat64(rejections)
+
+	s := &server{config: &Config{}}
+	resp := &api.SignResponse{ServerPEM: c(leaf), CaPEM: c(root), CertChainPEM: []api.Certificate{c(leaf), c(leaf), c(intermediate), c(root)}}
+	if err := s.repairChain("primary", resp); err != nil {
+		t.Fatalf("repairChain() = %v", err)
+	}
+	if len(resp.CertChainPEM) != 3 || !resp.CaPEM.Equal(intermediate) {
+		t.Errorf("repaired chain of %d certificates, ca %s", len(resp.CertChainPEM), resp.CaPEM.Subject.CommonName)
+	}
+	if err := s.repairChain("primary", resp); err != nil {
+		t.Errorf("repairChain() of a repaired chain = %v", err)
+	}
+
+	legacy := &api.SignResponse{ServerPEM: c(leaf), CaPEM: c(leaf)}
+	if err := s.repairChain("primary", legacy); err != nil || len(legacy.CertChainPEM) != 0 {
+		t.Errorf("repairChain() without certChain = %v, %d certificates", err, len(legacy.CertChainPEM))
+	}
+
+	s.config.ResponseValidation.StrictChain = true
+	resp = &api.SignResponse{ServerPEM: c(leaf), CaPEM: c(intermediate), CertChainPEM: []api.Certificate{c(leaf), c(intermediate), c(intermediate)}}
+	if err := s.repairChain("primary", resp); errorStatus(err) != http.StatusBadGateway || len(resp.CertChainPEM) != 3 {
+		t.Errorf("repairChain() with strictChain = %v, want a 502", err)
+	}
+	if got := testutil.ToFloat64(repairs) - before; got != 3 {
+		t.Errorf("duplicate repairs counted = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(rejections) - beforeRejections; got != 1 {
+		t.Errorf("rejections counted = %v, want 1", got)
+	}
+}
@@ -0,0 +1,129 @@
+package signer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// ClientAuthConfig configures how the clients of the signer are
+// authenticated.
+type ClientAuthConfig struct {
+	CABundles     []string             `yaml:"caBundles"`
+	IncludeRoot   *bool                `yaml:"includeRoot"`
+	TrustedHeader *TrustedHeaderConfig `yaml:"trustedHeader"`
+	Revocation    RevocationConfig     `yaml:"revocation"`
+}
+
+// GetIncludeRoot returns whether certificates issued by the CA at rootCAPath
+// are accepted in addition to caBundles, defaults to true.
+func (c ClientAuthConfig) GetIncludeRoot() bool {
+	return c.IncludeRoot == nil || *c.IncludeRoot
+}
+
+// clientCAPool is the pool of CAs trusted for client authentication, loaded
+// from PEM bundles and reloaded when they change.
+type clientCAPool struct {
+	files []string
+
+	mu      sync.RWMutex
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// newClientCAPool returns the client CA pool of the configuration, or nil if
+// no specific bundles are configured.
+func newClientCAPool(config *Config) (*clientCAPool, error) {
+	c := config.ClientAuth
+	if len(c.CABundles) == 0 {
+		return nil, nil
+	}
+
+	files := append([]string{}, c.CABundles...)
+	if c.GetIncludeRoot() {
+		files = append(files, config.GetRootCAPaths()...)
+	}
+
+	p := &clientCAPool{files: files}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Pool returns the current pool.
+func (p *clientCAPool) Pool() *x509.CertPool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pool
+}
+
+// Watch checks the bundles every interval until ctx is done.
+func (p *clientCAPool) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.reload(); err != nil {
+				logFor("tls").WithField("error", err).Error("Error reloading client CA bundles, keeping the previous ones")
+			}
+		}
+	}
+}
+
+// reload loads the bundles if any of them changed since the last load.
+func (p *clientCAPool) reload() error {
+	modTime, err := latestModTime(p.files...)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	unchanged := p.pool != nil && modTime.Equal(p.modTime)
+	p.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	pool, err := loadCertPool(p.files...)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.pool, p.modTime = pool, modTime
+	p.mu.Unlock()
+	logFor("tls").WithField("bundles", p.files).Info("Loaded client CA bundles")
+
+	return nil
+}
+
+// applyClientCAs makes cfg verify client certificates against the pool. It
+// keeps any GetConfigForClient already set, like the one used by the
+// bootstrapped server to follow root rotations.
+func applyClientCAs(cfg *tls.Config, p *clientCAPool) {
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		base := cfg
+		if next != nil {
+			c, err := next(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				base = c
+			}
+		}
+
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = p.Pool()
+		return c, nil
+	}
+}
@@ -0,0 +1,56 @@
+package signer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientCAPool(t *testing.T) {
+	dir := t.TempDir()
+	partner, _ := newTestCert(t, "Partner CA")
+	root, _ := newTestCert(t, "Root CA")
+	config := &Config{
+		RootCAPath: filepath.Join(dir, "root_ca.crt"),
+		ClientAuth: ClientAuthConfig{CABundles: []string{filepath.Join(dir, "partner.crt")}},
+	}
+	for name, cert := range map[string]*x509.Certificate{config.RootCAPath: root, config.ClientAuth.CABundles[0]: partner} {
+		if err := writeFile(name, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trusted := func(p *clientCAPool, cert *x509.Certificate) bool {
+		_, err := cert.Verify(x509.VerifyOptions{Roots: p.Pool()})
+		return err == nil
+	}
+
+	p, err := newClientCAPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !trusted(p, partner) || !trusted(p, root) {
+		t.Error("pool does not trust the bundle and the root")
+	}
+
+	cfg := &tls.Config{}
+	applyClientCAs(cfg, p)
+	c, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil || c.ClientCAs != p.Pool() || c.GetConfigForClient != nil {
+		t.Errorf("GetConfigForClient() = %v, want the client CA pool", err)
+	}
+
+	includeRoot := false
+	config.ClientAuth.IncludeRoot = &includeRoot
+	if p, err = newClientCAPool(config); err != nil {
+		t.Fatal(err)
+	}
+	if !trusted(p, partner) || trusted(p, root) {
+		t.Error("pool without includeRoot trusts the root")
+	}
+
+	if p, err := newClientCAPool(&Config{}); p != nil || err != nil {
+		t.Errorf("newClientCAPool() without bundles = %v, %v, want nil", p, err)
+	}
+}
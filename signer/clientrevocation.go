@@ -0,0 +1,358 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Revocation sources of the client certificates.
+const (
+	revocationInventory = "inventory"
+	revocationOCSP      = "ocsp"
+	revocationCRL       = "crl"
+)
+
+// Revocation statuses of the client certificates.
+const (
+	revocationGood    = "good"
+	revocationRevoked = "revoked"
+	revocationUnknown = "unknown"
+)
+
+// maxCRLSize is the maximum size of a downloaded CRL.
+const maxCRLSize = 10 << 20
+
+// RevocationConfig configures the revocation checks of the client
+// certificates. The sources are checked in order until one knows the
+// certificate: "inventory", the certificates revoked through the signer,
+// "ocsp", the OCSP responder of the certificate, and "crl", the CRLs of
+// crlURLs or of the certificate distribution points.
+type RevocationConfig struct {
+	Sources    []string `yaml:"sources"`
+	CRLURLs    []string `yaml:"crlURLs"`
+	FailClosed bool     `yaml:"failClosed"`
+	CacheTTL   string   `yaml:"cacheTTL"`
+	Timeout    string   `yaml:"timeout"`
+}
+
+// Enabled returns true if client certificates are checked.
+func (c RevocationConfig) Enabled() bool {
+	return len(c.Sources) > 0
+}
+
+// GetCacheTTL returns how long the status of a certificate, and a CRL
+// without next update, is cached, defaults to 5m.
+func (c RevocationConfig) GetCacheTTL() time.Duration {
+	if d, err := time.ParseDuration(c.CacheTTL); err == nil {
+		return d
+	}
+
+	return 5 * time.Minute
+}
+
+// GetTimeout returns the timeout of the OCSP requests and CRL downloads,
+// defaults to 5s.
+func (c RevocationConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 5 * time.Second
+}
+
+// Validate checks the sources and CRL URLs.
+func (c RevocationConfig) Validate() error {
+	for _, s := range c.Sources {
+		switch s {
+		case revocationInventory, revocationOCSP, revocationCRL:
+		default:
+			return errors.Errorf("invalid clientAuth.revocation source %q", s)
+		}
+	}
+	for _, u := range c.CRLURLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return errors.Errorf("invalid clientAuth.revocation CRL URL %q", u)
+		}
+	}
+
+	return nil
+}
+
+// revocationChecker checks the revocation status of the client
+// certificates, caching the statuses and the CRLs.
+type revocationChecker struct {
+	config    RevocationConfig
+	inventory *inventory
+	client    *http.Client
+
+	mu       sync.Mutex
+	statuses map[string]cachedRevocation
+	crls     map[string]cachedCRL
+}
+
+type cachedRevocation struct {
+	status  string
+	source  string
+	expires time.Time
+}
+
+type cachedCRL struct {
+	list    *x509.RevocationList
+	expires time.Time
+}
+
+func newRevocationChecker(c RevocationConfig, inv *inventory) *revocationChecker {
+	return &revocationChecker{
+		config:    c,
+		inventory: inv,
+		client:    &http.Client{Timeout: c.GetTimeout()},
+		statuses:  map[string]cachedRevocation{},
+		crls:      map[string]cachedCRL{},
+	}
+}
+
+// Check returns the status of leaf, issued by issuer, and the source that
+// knew it. Certificates unknown to all the sources are unknown; the error
+// is the last failure of a source if none knew the certificate.
+func (c *revocationChecker) Check(ctx context.Context, leaf, issuer *x509.Certificate) (string, string, error) {
+	key := certificateFingerprint(leaf)
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.statuses[key]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.status, cached.source, nil
+	}
+
+	var lastErr error
+	status, source := revocationUnknown, ""
+	for _, src := range c.config.Sources {
+		var err error
+		switch src {
+		case revocationInventory:
+			status, err = c.checkInventory(leaf)
+		case revocationOCSP:
+			status, err = c.checkOCSP(ctx, leaf, issuer)
+		case revocationCRL:
+			status, err = c.checkCRL(ctx, leaf, issuer)
+		}
+		result := status
+		if err != nil {
+			result = "error"
+			lastErr = errors.Wrapf(err, "%s check failed", src)
+		}
+		clientRevocationChecks.WithLabelValues(src, result).Inc()
+		if err == nil && status != revocationUnknown {
+			source = src
+			break
+		}
+		status = revocationUnknown
+	}
+	if status == revocationUnknown && lastErr != nil {
+		return status, "", lastErr
+	}
+
+	c.mu.Lock()
+	c.statuses[key] = cachedRevocation{status: status, source: source, expires: now.Add(c.config.GetCacheTTL())}
+	for k, v := range c.statuses {
+		if now.After(v.expires) {
+			delete(c.statuses, k)
+		}
+	}
+	c.mu.Unlock()
+
+	return status, source, nil
+}
+
+// checkInventory returns revoked for the certificates revoked through the
+// signer, and unknown otherwise as the inventory does not know the other
+// revocations.
+func (c *revocationChecker) checkInventory(leaf *x509.Certificate) (string, error) {
+	rec, err := c.inventory.GetByFingerprint(certificateFingerprint(leaf))
+	if err != nil || rec == nil {
+		return revocationUnknown, err
+	}
+	if rec.Status == statusRevoked {
+		return revocationRevoked, nil
+	}
+
+	return revocationUnknown, nil
+}
+
+// checkOCSP asks the first OCSP responder of the certificate.
+func (c *revocationChecker) checkOCSP(ctx context.Context, leaf, issuer *x509.Certificate) (string, error) {
+	if len(leaf.OCSPServer) == 0 || issuer == nil {
+		return revocationUnknown, nil
+	}
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	data, err := c.fetch(req)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ocsp.ParseResponseForCert(data, leaf, issuer)
+	if err != nil {
+		return "", err
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		return revocationGood, nil
+	case ocsp.Revoked:
+		return revocationRevoked, nil
+	default:
+		return revocationUnknown, nil
+	}
+}
+
+// checkCRL looks the certificate up in the CRLs, which must be signed by
+// its issuer.
+func (c *revocationChecker) checkCRL(ctx context.Context, leaf, issuer *x509.Certificate) (string, error) {
+	urls := c.config.CRLURLs
+	if len(urls) == 0 {
+		urls = leaf.CRLDistributionPoints
+	}
+	if len(urls) == 0 || issuer == nil {
+		return revocationUnknown, nil
+	}
+
+	var lastErr error
+	status := revocationUnknown
+	for _, u := range urls {
+		list, err := c.crl(ctx, u)
+		if err == nil {
+			err = list.CheckSignatureFrom(issuer)
+		}
+		if err != nil {
+			lastErr = errors.Wrapf(err, "error loading CRL %s", u)
+			continue
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return revocationRevoked, nil
+			}
+		}
+		status = revocationGood
+	}
+	if status == revocationUnknown && lastErr != nil {
+		return "", lastErr
+	}
+
+	return status, nil
+}
+
+// crl returns the CRL at u, downloaded again after its next update.
+func (c *revocationChecker) crl(ctx context.Context, u string) (*x509.RevocationList, error) {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.crls[u]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.list, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := now.Add(c.config.GetCacheTTL())
+	if !list.NextUpdate.IsZero() && list.NextUpdate.Before(expires) {
+		expires = list.NextUpdate
+	}
+	c.mu.Lock()
+	c.crls[u] = cachedCRL{list: list, expires: expires}
+	c.mu.Unlock()
+
+	return list, nil
+}
+
+func (c *revocationChecker) fetch(req *http.Request) ([]byte, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+}
+
+// clientRevocation rejects the requests whose client certificate is
+// revoked with 403. If the status cannot be checked, the request is
+// rejected with 503 when failClosed is set, and accepted otherwise.
+func (s *server) clientRevocation(next http.Handler) http.Handler {
+	if s.revocation == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		chain := r.TLS.VerifiedChains[0]
+		var issuer *x509.Certificate
+		if len(chain) > 1 {
+			issuer = chain[1]
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), s.config.ClientAuth.Revocation.GetTimeout())
+		defer cancel()
+		status, source, err := s.revocation.Check(ctx, chain[0], issuer)
+		fields := log.Fields{
+			"client": clientIdentities(r),
+			"serial": chain[0].SerialNumber.String(),
+			"path":   r.URL.Path,
+		}
+		switch {
+		case status == revocationRevoked:
+			clientRevocationDenials.WithLabelValues(revocationRevoked).Inc()
+			logFor("tls").WithFields(fields).WithField("source", source).Warn("Forbidden: client certificate is revoked")
+			render.Error(w, r, errs.Forbidden("client certificate has been revoked"))
+			return
+		case err != nil && s.config.ClientAuth.Revocation.FailClosed:
+			clientRevocationDenials.WithLabelValues("error").Inc()
+			logFor("tls").WithFields(fields).WithField("error", err).Error("Client certificate revocation check failed, rejecting the request")
+			render.Error(w, r, errs.New(http.StatusServiceUnavailable, "client certificate revocation status is unavailable"))
+			return
+		case err != nil:
+			logFor("tls").WithFields(fields).WithField("error", err).Warn("Client certificate revocation check failed, accepting the request")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,227 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testRevocationSource is an OCSP responder at /ocsp and a CRL at /crl for
+// the certificates of a test CA, which can sign CRLs; /fail always fails.
+type testRevocationSource struct {
+	*httptest.Server
+	ca       *x509.Certificate
+	key      *ecdsa.PrivateKey
+	revoked  map[int64]bool
+	requests atomic.Int32
+}
+
+func newTestRevocationSource(t *testing.T) *testRevocationSource {
+	t.Helper()
+	src := &testRevocationSource{revoked: map[int64]bool{}}
+	var err error
+	if src.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, src.key.Public(), src.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	src.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		src.requests.Add(1)
+		switch r.URL.Path {
+		case "/ocsp":
+			body, _ := io.ReadAll(r.Body)
+			req, err := ocsp.ParseRequest(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			tmpl := ocsp.Response{Status: ocsp.Good, SerialNumber: req.SerialNumber, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+			if src.revoked[req.SerialNumber.Int64()] {
+				tmpl.Status, tmpl.RevokedAt = ocsp.Revoked, time.Now()
+			}
+			resp, err := ocsp.CreateResponse(src.ca, src.ca, tmpl, src.key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write(resp)
+		case "/crl":
+			list := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+			for serial := range src.revoked {
+				list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+			}
+			der, err := x509.CreateRevocationList(rand.Reader, list, src.ca, src.key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write(der)
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(src.Close)
+
+	return src
+}
+
+// issue returns a client certificate with serial, pointing to the OCSP
+// responder and CRL of the source.
+func (src *testRevocationSource) issue(t *testing.T, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		OCSPServer:            []string{src.URL + "/ocsp"},
+		CRLDistributionPoints: []string{src.URL + "/crl"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, src.ca, key.Public(), src.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestRevocationConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    RevocationConfig
+		ok   bool
+	}{
+		{"disabled", RevocationConfig{}, true},
+		{"sources", RevocationConfig{Sources: []string{"inventory", "ocsp", "crl"}, CRLURLs: []string{"https://pki.example.com/ca.crl"}}, true},
+		{"source", RevocationConfig{Sources: []string{"ldap"}}, false},
+		{"crl url", RevocationConfig{Sources: []string{"crl"}, CRLURLs: []string{"ldap://pki.example.com/ca.crl"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	if c := (RevocationConfig{}); c.Enabled() || c.GetCacheTTL() != 5*time.Minute || c.GetTimeout() != 5*time.Second {
+		t.Errorf("defaults = %v, %v, %v", c.Enabled(), c.GetCacheTTL(), c.GetTimeout())
+	}
+}
+
+func TestRevocationCheck(t *testing.T) {
+	src := newTestRevocationSource(t)
+	inv := newTestInventory(t)
+	good, revoked, revokedBySigner := src.issue(t, 10), src.issue(t, 11), src.issue(t, 12)
+	src.revoked[11] = true
+	if err := inv.Put(&certificateRecord{Serial: "12", Fingerprint: certificateFingerprint(revokedBySigner), NotAfter: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.Revoke("12", time.Now(), "keyCompromise"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  RevocationConfig
+		leaf    *x509.Certificate
+		issuer  *x509.Certificate
+		status  string
+		source  string
+		wantErr bool
+	}{
+		{"inventory revoked", RevocationConfig{Sources: []string{"inventory", "ocsp"}}, revokedBySigner, src.ca, revocationRevoked, revocationInventory, false},
+		{"inventory unknown", RevocationConfig{Sources: []string{"inventory"}}, good, src.ca, revocationUnknown, "", false},
+		{"ocsp good", RevocationConfig{Sources: []string{"inventory", "ocsp"}}, good, src.ca, revocationGood, revocationOCSP, false},
+		{"ocsp revoked", RevocationConfig{Sources: []string{"ocsp"}}, revoked, src.ca, revocationRevoked, revocationOCSP, false},
+		{"crl good", RevocationConfig{Sources: []string{"crl"}}, good, src.ca, revocationGood, revocationCRL, false},
+		{"crl revoked", RevocationConfig{Sources: []string{"crl"}}, revoked, src.ca, revocationRevoked, revocationCRL, false},
+		{"crl urls", RevocationConfig{Sources: []string{"crl"}, CRLURLs: []string{src.URL + "/fail", src.URL + "/crl"}}, revoked, src.ca, revocationRevoked, revocationCRL, false},
+		{"crl other issuer", RevocationConfig{Sources: []string{"crl"}}, revoked, newTestRevocationSource(t).ca, revocationUnknown, "", true},
+		{"no issuer", RevocationConfig{Sources: []string{"ocsp", "crl"}}, revoked, nil, revocationUnknown, "", false},
+		{"failed", RevocationConfig{Sources: []string{"crl"}, CRLURLs: []string{src.URL + "/fail"}}, good, src.ca, revocationUnknown, "", true},
+		{"fallback", RevocationConfig{Sources: []string{"crl", "ocsp"}, CRLURLs: []string{src.URL + "/fail"}}, revoked, src.ca, revocationRevoked, revocationOCSP, false},
+	}
+	for _, tt := range tests {
+		c := newRevocationChecker(tt.config, inv)
+		status, source, err := c.Check(context.Background(), tt.leaf, tt.issuer)
+		if status != tt.status || source != tt.source || (err != nil) != tt.wantErr {
+			t.Errorf("%s: Check() = %s, %s, %v, want %s, %s, error %v", tt.name, status, source, err, tt.status, tt.source, tt.wantErr)
+		}
+	}
+
+	c := newRevocationChecker(RevocationConfig{Sources: []string{"ocsp"}}, inv)
+	if status, _, _ := c.Check(context.Background(), good, src.ca); status != revocationGood {
+		t.Fatalf("Check() = %s, want good", status)
+	}
+	src.revoked[10] = true
+	requests := src.requests.Load()
+	if status, _, _ := c.Check(context.Background(), good, src.ca); status != revocationGood || src.requests.Load() != requests {
+		t.Errorf("Check() of a cached status = %s, requests %d, want good without a request", status, src.requests.Load()-requests)
+	}
+}
+
+func TestClientRevocation(t *testing.T) {
+	src := newTestRevocationSource(t)
+	src.revoked[11] = true
+	good, revoked := src.issue(t, 10), src.issue(t, 11)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		config RevocationConfig
+		chain  []*x509.Certificate
+		status int
+	}{
+		{"no certificate", RevocationConfig{Sources: []string{"ocsp"}}, nil, http.StatusOK},
+		{"good", RevocationConfig{Sources: []string{"ocsp"}}, []*x509.Certificate{good, src.ca}, http.StatusOK},
+		{"revoked", RevocationConfig{Sources: []string{"ocsp"}}, []*x509.Certificate{revoked, src.ca}, http.StatusForbidden},
+		{"fail open", RevocationConfig{Sources: []string{"crl"}, CRLURLs: []string{src.URL + "/fail"}}, []*x509.Certificate{good, src.ca}, http.StatusOK},
+		{"fail closed", RevocationConfig{Sources: []string{"crl"}, CRLURLs: []string{src.URL + "/fail"}, FailClosed: true}, []*x509.Certificate{good, src.ca}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		s := &server{config: &Config{ClientAuth: ClientAuthConfig{Revocation: tt.config}}, revocation: newRevocationChecker(tt.config, nil)}
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), "client")
+		if tt.chain != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{tt.chain}}
+		}
+		w := httptest.NewRecorder()
+		s.clientRevocation(handler).ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
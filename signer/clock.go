@@ -0,0 +1,309 @@
+package signer
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/cli-utils/token"
+)
+
+// ClockConfig configures the time used for the provisioner tokens and the
+// validity checks, for signers running on hosts with unreliable clocks.
+type ClockConfig struct {
+	SkewTolerance string     `yaml:"skewTolerance"`
+	TokenLifetime string     `yaml:"tokenLifetime"`
+	NTP           *NTPConfig `yaml:"ntp"`
+}
+
+// NTPConfig configures the measure of the clock drift against NTP servers.
+type NTPConfig struct {
+	Servers  []string `yaml:"servers"`
+	Interval string   `yaml:"interval"`
+	MaxDrift string   `yaml:"maxDrift"`
+	Quorum   int      `yaml:"quorum"`
+	Correct  bool     `yaml:"correct"`
+}
+
+// GetSkewTolerance returns how far the clocks of the signer, the upstream CAs
+// and the token issuers may disagree, defaults to 0.
+func (c ClockConfig) GetSkewTolerance() time.Duration {
+	d, _ := time.ParseDuration(c.SkewTolerance)
+	return d
+}
+
+// GetTokenLifetime returns the lifetime of the provisioner tokens, defaults to
+// 5m like the step CLI.
+func (c ClockConfig) GetTokenLifetime() time.Duration {
+	if d, err := time.ParseDuration(c.TokenLifetime); err == nil {
+		return d
+	}
+
+	return token.DefaultValidity
+}
+
+// customTokens returns whether the validity of the provisioner tokens differs
+// from the one of the step client.
+func (c ClockConfig) customTokens() bool {
+	return c.SkewTolerance != "" || c.TokenLifetime != "" || (c.NTP != nil && c.NTP.Correct)
+}
+
+// Validate checks the durations and the NTP servers.
+func (c ClockConfig) Validate() error {
+	if c.SkewTolerance != "" {
+		if d, err := time.ParseDuration(c.SkewTolerance); err != nil || d < 0 || d > 10*time.Minute {
+			return errors.Errorf("invalid clock skewTolerance %q, must be a duration up to 10m", c.SkewTolerance)
+		}
+	}
+	if c.TokenLifetime != "" {
+		if d, err := time.ParseDuration(c.TokenLifetime); err != nil || d < token.MinValidity {
+			return errors.Errorf("invalid clock tokenLifetime %q, must be a duration of at least %s", c.TokenLifetime, token.MinValidity)
+		}
+	}
+	// Tokens are backdated by the skew tolerance, and the CA refuses tokens
+	// valid for longer than an hour.
+	if c.GetSkewTolerance()+c.GetTokenLifetime() > token.MaxValidity {
+		return errors.Errorf("clock skewTolerance and tokenLifetime must add up to at most %s", token.MaxValidity)
+	}
+	if n := c.NTP; n != nil {
+		if len(n.Servers) == 0 {
+			return errors.New("clock ntp requires servers")
+		}
+		for _, s := range n.Servers {
+			if _, _, err := net.SplitHostPort(ntpAddress(s)); err != nil || s == "" {
+				return errors.Errorf("invalid clock ntp server %q", s)
+			}
+		}
+		if n.Interval != "" {
+			if d, err := time.ParseDuration(n.Interval); err != nil || d < time.Minute {
+				return errors.Errorf("invalid clock ntp interval %q, must be a duration of at least 1m", n.Interval)
+			}
+		}
+		if n.MaxDrift != "" {
+			if d, err := time.ParseDuration(n.MaxDrift); err != nil || d <= 0 {
+				return errors.Errorf("invalid clock ntp maxDrift %q", n.MaxDrift)
+			}
+		}
+		if n.Quorum < 0 || n.Quorum > len(n.Servers) {
+			return errors.Errorf("invalid clock ntp quorum %d, must be at most the number of servers", n.Quorum)
+		}
+	}
+
+	return nil
+}
+
+// GetInterval returns how often the drift is measured, defaults to 5m.
+func (c NTPConfig) GetInterval() time.Duration {
+	if d, err := time.ParseDuration(c.Interval); err == nil {
+		return d
+	}
+
+	return 5 * time.Minute
+}
+
+// GetMaxDrift returns the drift above which a warning is logged and the
+// clock is not corrected, defaults to 1s.
+func (c NTPConfig) GetMaxDrift() time.Duration {
+	if d, err := time.ParseDuration(c.MaxDrift); err == nil {
+		return d
+	}
+
+	return time.Second
+}
+
+// GetQuorum returns how many servers must agree on the offset, defaults to
+// a majority of the servers.
+func (c NTPConfig) GetQuorum() int {
+	if c.Quorum > 0 {
+		return c.Quorum
+	}
+
+	return len(c.Servers)/2 + 1
+}
+
+// clock is the source of the current time.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the host, corrected by the offset measured
+// against NTP when clock.ntp.correct is set.
+type systemClock struct {
+	offset atomic.Int64
+}
+
+func (c *systemClock) Now() time.Time {
+	return time.Now().Add(time.Duration(c.offset.Load()))
+}
+
+var (
+	signerClock   clock = &systemClock{}
+	clockConfig   ClockConfig
+	clockSkewNano atomic.Int64
+)
+
+// configureClock sets the skew tolerance and the token lifetime. It must run
+// before the provisioners are loaded.
+func configureClock(c ClockConfig) {
+	clockConfig = c
+	clockSkewNano.Store(int64(c.GetSkewTolerance()))
+}
+
+// clockLeeway returns the leeway of the checks of the tokens received by the
+// signer: the skew tolerance, and at least a minute.
+func clockLeeway() time.Duration {
+	return max(time.Minute, time.Duration(clockSkewNano.Load()))
+}
+
+// ntpEpoch is the offset of the Unix epoch in the NTP era 0.
+const ntpEpoch = 2208988800
+
+// ntpAgreement is how far from the median the offset of a server may be to
+// agree with it, above the jitter of a single SNTP request.
+const ntpAgreement = 250 * time.Millisecond
+
+// ntpAddress adds the NTP port to a server without one.
+func ntpAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+
+	return net.JoinHostPort(server, "123")
+}
+
+// ntpOffset measures the offset of the host clock to an NTP server with a
+// single SNTP request: the server time minus the host time.
+func ntpOffset(ctx context.Context, server string) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", ntpAddress(server))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	// Version 4, client mode; the transmit timestamp is echoed in the
+	// originate timestamp of the response.
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3
+	t1 := time.Now()
+	binary.BigEndian.PutUint64(req[40:], ntpTimestamp(t1))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case n < 48 || resp[0]&7 != 4:
+		return 0, errors.New("invalid NTP response")
+	case resp[1] == 0:
+		return 0, errors.Errorf("NTP server refused the request: %q", resp[12:16])
+	case resp[0]>>6 == 3:
+		return 0, errors.New("NTP server is not synchronized")
+	case binary.BigEndian.Uint64(resp[24:]) != binary.BigEndian.Uint64(req[40:]):
+		return 0, errors.New("NTP response does not match the request")
+	}
+	t2 := ntpTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := ntpTime(binary.BigEndian.Uint64(resp[40:]))
+
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func ntpTimestamp(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpoch)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+func ntpTime(ts uint64) time.Time {
+	sec := int64(ts>>32) - ntpEpoch
+	nsec := int64((ts & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(sec, nsec)
+}
+
+// driftMonitor measures the drift of the host clock against the NTP servers.
+type driftMonitor struct {
+	config NTPConfig
+	clock  *systemClock
+}
+
+func newDriftMonitor(c NTPConfig) *driftMonitor {
+	m := &driftMonitor{config: c}
+	if sc, ok := signerClock.(*systemClock); ok && c.Correct {
+		m.clock = sc
+	}
+
+	return m
+}
+
+// check is the clock-drift job. It measures the offset of every server and
+// records the drift.
+func (m *driftMonitor) check(ctx context.Context) error {
+	var offsets []time.Duration
+	for _, s := range m.config.Servers {
+		offset, err := ntpOffset(ctx, s)
+		if err != nil {
+			clockSyncErrors.WithLabelValues(s).Inc()
+			logFor("clock").WithFields(log.Fields{"server": s, "error": err}).Debug("Error querying NTP server")
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+
+	return m.record(offsets)
+}
+
+// record takes the median of the offsets as the drift when a quorum of the
+// servers agree on it, so a single server cannot move the clock. It logs a
+// warning when the drift exceeds maxDrift, and corrects the signer clock
+// with correct unless it does.
+func (m *driftMonitor) record(offsets []time.Duration) error {
+	quorum := m.config.GetQuorum()
+	if len(offsets) < quorum {
+		return errors.Errorf("%d NTP servers answered, %d required", len(offsets), quorum)
+	}
+	slices.Sort(offsets)
+	drift := offsets[len(offsets)/2]
+	agreeing := 0
+	for _, o := range offsets {
+		if (o - drift).Abs() <= ntpAgreement {
+			agreeing++
+		}
+	}
+	if agreeing < quorum {
+		return errors.Errorf("NTP servers disagree: %d offsets within %s of the median, %d required", agreeing, ntpAgreement, quorum)
+	}
+	clockDrift.Set(drift.Seconds())
+
+	logger := logFor("clock")
+	fields := log.Fields{"drift": drift.String(), "servers": len(offsets)}
+	exceeded := drift.Abs() > m.config.GetMaxDrift()
+	if exceeded {
+		fields["maxDrift"] = m.config.GetMaxDrift().String()
+		fields["skewTolerance"] = time.Duration(clockSkewNano.Load()).String()
+		fields["corrected"] = false
+		logger.WithFields(fields).Warn("Clock drift")
+	} else {
+		logger.WithFields(fields).Debug("Measured clock drift")
+	}
+	if m.clock != nil && !exceeded {
+		m.clock.offset.Store(int64(drift))
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package signer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDriftMonitorRecord(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	tests := []struct {
+		name    string
+		config  NTPConfig
+		offsets []time.Duration
+		want    time.Duration
+		wantErr bool
+	}{
+		{"agreeing", NTPConfig{Servers: servers}, []time.Duration{400 * time.Millisecond, 500 * time.Millisecond, 600 * time.Millisecond}, 500 * time.Millisecond, false},
+		{"one false server", NTPConfig{Servers: servers}, []time.Duration{500 * time.Millisecond, time.Hour, 550 * time.Millisecond}, 550 * time.Millisecond, false},
+		{"no quorum", NTPConfig{Servers: servers}, []time.Duration{500 * time.Millisecond}, 0, true},
+		{"quorum of one", NTPConfig{Servers: servers, Quorum: 1}, []time.Duration{500 * time.Millisecond}, 500 * time.Millisecond, false},
+		{"disagreeing", NTPConfig{Servers: servers}, []time.Duration{0, time.Second, 2 * time.Second}, 0, true},
+		{"above maxDrift", NTPConfig{Servers: servers}, []time.Duration{time.Hour, time.Hour, time.Hour}, 0, false},
+		{"raised maxDrift", NTPConfig{Servers: servers, MaxDrift: "2h"}, []time.Duration{time.Hour, time.Hour, time.Hour}, time.Hour, false},
+	}
+	for _, tt := range tests {
+		m := &driftMonitor{config: tt.config, clock: &systemClock{}}
+		err := m.record(tt.offsets)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: record() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if got := time.Duration(m.clock.offset.Load()); got != tt.want {
+			t.Errorf("%s: offset = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNTPConfigValidateQuorum(t *testing.T) {
+	c := ClockConfig{NTP: &NTPConfig{Servers: []string{"a", "b"}, Quorum: 3}}
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with a quorum above the number of servers error = nil")
+	}
+	c.NTP.Quorum = 2
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
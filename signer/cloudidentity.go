@@ -0,0 +1,550 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// Cloud identity providers.
+const (
+	cloudAWS   = "aws"
+	cloudGCP   = "gcp"
+	cloudAzure = "azure"
+)
+
+// awsAudienceHeader is the header of the signed GetCallerIdentity requests
+// that binds them to the signer, so a request signed for another service
+// cannot be replayed here.
+const awsAudienceHeader = "X-Ca-Signer-Audience"
+
+// cloudVariables are the variables of the SAN patterns of each provider, in
+// addition to account, name and principal.
+var cloudVariables = map[string][]string{
+	cloudAWS:   {"arn", "session", "userID"},
+	cloudGCP:   {"serviceAccount", "projectNumber", "zone", "instanceID", "instanceName"},
+	cloudAzure: {"subscription", "resourceGroup", "resourceID", "appID"},
+}
+
+// CloudIdentityConfig configures POST /sign/cloud, which exchanges a proof
+// of a cloud identity for a certificate whose SANs are derived from it, so
+// VMs can get their first certificate without a pre-provisioned one.
+type CloudIdentityConfig struct {
+	Providers   []CloudProviderConfig `yaml:"providers"`
+	MaxLifetime string                `yaml:"maxLifetime"`
+	Timeout     string                `yaml:"timeout"`
+}
+
+// CloudProviderConfig configures the identities accepted from a cloud
+// provider. Accounts are the AWS account ids, GCP project ids or Azure
+// tenant ids accepted. SANs are the patterns of the names the identities
+// can get, with ${variable} replaced by the attributes of the identity.
+type CloudProviderConfig struct {
+	Type        string   `yaml:"type"`
+	Audience    string   `yaml:"audience"`
+	Accounts    []string `yaml:"accounts"`
+	SANs        []string `yaml:"sans"`
+	STSEndpoint string   `yaml:"stsEndpoint"`
+	JWKSURL     string   `yaml:"jwksURL"`
+}
+
+// Enabled returns true if at least one provider is configured.
+func (c CloudIdentityConfig) Enabled() bool {
+	return len(c.Providers) > 0
+}
+
+// GetMaxLifetime returns the maximum lifetime of the certificates, defaults
+// to 1h.
+func (c CloudIdentityConfig) GetMaxLifetime() time.Duration {
+	if d, err := time.ParseDuration(c.MaxLifetime); err == nil {
+		return d
+	}
+
+	return time.Hour
+}
+
+// GetTimeout returns the timeout of the calls to the cloud providers,
+// defaults to 10s.
+func (c CloudIdentityConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 10 * time.Second
+}
+
+// provider returns the configuration of the provider typ.
+func (c CloudIdentityConfig) provider(typ string) (CloudProviderConfig, bool) {
+	for _, p := range c.Providers {
+		if p.Type == typ {
+			return p, true
+		}
+	}
+
+	return CloudProviderConfig{}, false
+}
+
+// Validate checks the providers and their SAN patterns.
+func (c CloudIdentityConfig) Validate() error {
+	seen := map[string]bool{}
+	for _, p := range c.Providers {
+		if _, ok := cloudVariables[p.Type]; !ok {
+			return errors.Errorf("invalid cloudIdentity provider type %q, must be aws, gcp or azure", p.Type)
+		}
+		if seen[p.Type] {
+			return errors.Errorf("duplicated cloudIdentity provider %q", p.Type)
+		}
+		seen[p.Type] = true
+		if p.Audience == "" {
+			return errors.Errorf("cloudIdentity provider %s requires an audience", p.Type)
+		}
+		if len(p.Accounts) == 0 {
+			return errors.Errorf("cloudIdentity provider %s requires accounts", p.Type)
+		}
+		if len(p.SANs) == 0 {
+			return errors.Errorf("cloudIdentity provider %s requires sans", p.Type)
+		}
+		known := append([]string{"account", "name", "principal"}, cloudVariables[p.Type]...)
+		for _, san := range p.SANs {
+			var unknown string
+			os.Expand(san, func(v string) string {
+				if !slices.Contains(known, v) && unknown == "" {
+					unknown = v
+				}
+				return ""
+			})
+			if unknown != "" {
+				return errors.Errorf("unknown variable %q in cloudIdentity provider %s san %q", unknown, p.Type, san)
+			}
+		}
+		for _, u := range []string{p.STSEndpoint, p.JWKSURL} {
+			if parsed, err := url.Parse(u); u != "" && (err != nil || parsed.Scheme != "https") {
+				return errors.Errorf("invalid cloudIdentity provider %s URL %q, must be https", p.Type, u)
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetSTSEndpoint returns the AWS STS endpoint the signed requests are sent
+// to, defaults to https://sts.amazonaws.com.
+func (c CloudProviderConfig) GetSTSEndpoint() string {
+	if c.STSEndpoint != "" {
+		return c.STSEndpoint
+	}
+
+	return "https://sts.amazonaws.com"
+}
+
+// GetJWKSURL returns the keys verifying the GCP identity tokens or the Azure
+// managed identity tokens.
+func (c CloudProviderConfig) GetJWKSURL() string {
+	switch {
+	case c.JWKSURL != "":
+		return c.JWKSURL
+	case c.Type == cloudAzure:
+		return "https://login.microsoftonline.com/common/discovery/v2.0/keys"
+	default:
+		return "https://www.googleapis.com/oauth2/v3/certs"
+	}
+}
+
+// expandPatterns expands ${attribute} in the patterns with the attributes of
+// an identity. Patterns using an empty attribute are skipped.
+func expandPatterns(patterns []string, attributes map[string]string) []string {
+	var sans []string
+	for _, p := range patterns {
+		missing := false
+		san := os.Expand(p, func(v string) string {
+			if attributes[v] == "" {
+				missing = true
+			}
+			return attributes[v]
+		})
+		if !missing && san != "" {
+			sans = append(sans, san)
+		}
+	}
+
+	return sans
+}
+
+// cloudIdentity is a verified cloud identity. Its principal is the client
+// identity of the request; its attributes, including account, name and
+// principal, expand the SAN patterns.
+type cloudIdentity struct {
+	Provider   string
+	Principal  string
+	Attributes map[string]string
+}
+
+// AWSIdentityRequest is a GetCallerIdentity request signed with AWS SigV4,
+// with the X-Ca-Signer-Audience header among the signed headers. The signer
+// sends it to STS, which returns the identity that signed it.
+type AWSIdentityRequest struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+// CloudSignRequest is the body of POST /sign/cloud: the CSR and a proof of
+// the identity, a signed AWS request or a GCP or Azure token.
+type CloudSignRequest struct {
+	SignRequest
+	Provider string              `json:"provider"`
+	Token    string              `json:"token,omitempty"`
+	Request  *AWSIdentityRequest `json:"request,omitempty"`
+}
+
+// cloudVerifier verifies the cloud identity proofs.
+type cloudVerifier struct {
+	config CloudIdentityConfig
+	client *http.Client
+	keys   *jwksCache
+}
+
+func newCloudVerifier(c CloudIdentityConfig) *cloudVerifier {
+	return &cloudVerifier{
+		config: c,
+		client: &http.Client{Timeout: c.GetTimeout()},
+		keys:   newJWKSCache(c.GetTimeout()),
+	}
+}
+
+// verify returns the identity proven by the request. Invalid proofs return
+// 401 Unauthorized, and identities of other accounts 403 Forbidden.
+func (v *cloudVerifier) verify(ctx context.Context, body *CloudSignRequest) (*cloudIdentity, error) {
+	p, ok := v.config.provider(body.Provider)
+	if !ok {
+		return nil, errs.BadRequest("unknown cloud provider %q", body.Provider)
+	}
+
+	var id *cloudIdentity
+	var err error
+	switch p.Type {
+	case cloudAWS:
+		if body.Request == nil {
+			return nil, errs.BadRequest("missing request")
+		}
+		id, err = v.verifyAWS(ctx, p, body.Request)
+	case cloudGCP:
+		id, err = v.verifyGCP(ctx, p, body.Token)
+	case cloudAzure:
+		id, err = v.verifyAzure(ctx, p, body.Token)
+	}
+	if err != nil {
+		if _, ok := err.(*errs.Error); ok {
+			return nil, err
+		}
+		return nil, errs.New(http.StatusUnauthorized, "invalid %s identity: %v", p.Type, err)
+	}
+	if !slices.Contains(p.Accounts, id.Attributes["account"]) {
+		return nil, errs.Forbidden("%s account %q is not allowed", p.Type, id.Attributes["account"])
+	}
+	id.Provider = p.Type
+	id.Attributes["principal"] = id.Principal
+
+	return id, nil
+}
+
+// verifyAWS checks that the request is a GetCallerIdentity request for the
+// STS endpoint bound to the audience, sends it and returns the caller.
+// Assumed roles are identified by the role ARN, the session name is an
+// attribute.
+func (v *cloudVerifier) verifyAWS(ctx context.Context, p CloudProviderConfig, in *AWSIdentityRequest) (*cloudIdentity, error) {
+	endpoint, _ := url.Parse(p.GetSTSEndpoint())
+	u, err := url.Parse(in.URL)
+	if err != nil || u.Scheme != endpoint.Scheme || u.Host != endpoint.Host || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return nil, errors.Errorf("request url must be %s", endpoint)
+	}
+	if in.Method != http.MethodPost {
+		return nil, errors.New("request method must be POST")
+	}
+	body, err := base64.StdEncoding.DecodeString(in.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid request body")
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil || len(form) != 2 || form.Get("Action") != "GetCallerIdentity" || form.Get("Version") != "2011-06-15" {
+		return nil, errors.New("request must be a GetCallerIdentity request")
+	}
+	headers := http.Header(in.Headers).Clone()
+	if headers.Get(awsAudienceHeader) != p.Audience {
+		return nil, errors.Errorf("request header %s must be %q", awsAudienceHeader, p.Audience)
+	}
+	_, signed, _ := strings.Cut(headers.Get("Authorization"), "SignedHeaders=")
+	signed, _, _ = strings.Cut(signed, ",")
+	if !slices.Contains(strings.Split(signed, ";"), strings.ToLower(awsAudienceHeader)) {
+		return nil, errors.Errorf("request header %s must be signed", awsAudienceHeader)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	headers.Del("Accept")
+	headers.Del("Content-Length")
+	req.Header = headers
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, errs.New(http.StatusBadGateway, "error calling AWS STS: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("AWS STS returned status %d", resp.StatusCode)
+	}
+	var out struct {
+		Result struct {
+			Arn     string `xml:"Arn"`
+			UserID  string `xml:"UserId"`
+			Account string `xml:"Account"`
+		} `xml:"GetCallerIdentityResult"`
+	}
+	if err := xml.Unmarshal(data, &out); err != nil || out.Result.Arn == "" {
+		return nil, errs.New(http.StatusBadGateway, "invalid response from AWS STS")
+	}
+
+	arn := out.Result.Arn
+	id := &cloudIdentity{Principal: arn, Attributes: map[string]string{
+		"account": out.Result.Account,
+		"arn":     arn,
+		"userID":  out.Result.UserID,
+	}}
+	// arn:partition:service::account:resource
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 {
+		return nil, errs.New(http.StatusBadGateway, "invalid ARN %q from AWS STS", arn)
+	}
+	resource := parts[5]
+	if role, ok := strings.CutPrefix(resource, "assumed-role/"); ok {
+		role, session, _ := strings.Cut(role, "/")
+		id.Principal = "arn:" + parts[1] + ":iam::" + parts[4] + ":role/" + role
+		id.Attributes["name"], id.Attributes["session"] = role, session
+	} else {
+		id.Attributes["name"] = resource[strings.LastIndex(resource, "/")+1:]
+	}
+
+	return id, nil
+}
+
+// verifyGCP verifies a GCP identity token, from the metadata server of a VM
+// with format=full, or of a service account. The account is the project of
+// the VM, or of the service account.
+func (v *cloudVerifier) verifyGCP(ctx context.Context, p CloudProviderConfig, token string) (*cloudIdentity, error) {
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Google        struct {
+			ComputeEngine struct {
+				ProjectID     string `json:"project_id"`
+				ProjectNumber int64  `json:"project_number"`
+				Zone          string `json:"zone"`
+				InstanceID    string `json:"instance_id"`
+				InstanceName  string `json:"instance_name"`
+			} `json:"compute_engine"`
+		} `json:"google"`
+	}
+	issuers := []string{"https://accounts.google.com", "accounts.google.com"}
+	if err := v.keys.verify(ctx, p.GetJWKSURL(), token, issuers, p.Audience, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errors.New("token has no verified service account email")
+	}
+
+	gce := claims.Google.ComputeEngine
+	projectNumber := ""
+	if gce.ProjectNumber != 0 {
+		projectNumber = strconv.FormatInt(gce.ProjectNumber, 10)
+	}
+	local, domain, _ := strings.Cut(claims.Email, "@")
+	project := gce.ProjectID
+	if project == "" {
+		project, _ = strings.CutSuffix(domain, ".iam.gserviceaccount.com")
+	}
+	name := gce.InstanceName
+	if name == "" {
+		name = local
+	}
+
+	return &cloudIdentity{Principal: claims.Email, Attributes: map[string]string{
+		"account":        project,
+		"name":           name,
+		"serviceAccount": claims.Email,
+		"projectNumber":  projectNumber,
+		"zone":           gce.Zone,
+		"instanceID":     gce.InstanceID,
+		"instanceName":   gce.InstanceName,
+	}}, nil
+}
+
+// verifyAzure verifies an Azure managed identity token for the audience.
+// The account is the tenant, the principal the object id of the identity
+// and the name the last segment of its resource id, e.g. the VM name.
+func (v *cloudVerifier) verifyAzure(ctx context.Context, p CloudProviderConfig, token string) (*cloudIdentity, error) {
+	var claims struct {
+		TenantID   string `json:"tid"`
+		ObjectID   string `json:"oid"`
+		AppID      string `json:"appid"`
+		ResourceID string `json:"xms_mirid"`
+	}
+	var issuers []string
+	for _, tenant := range p.Accounts {
+		issuers = append(issuers, "https://sts.windows.net/"+tenant+"/", "https://login.microsoftonline.com/"+tenant+"/v2.0")
+	}
+	if err := v.keys.verify(ctx, p.GetJWKSURL(), token, issuers, p.Audience, &claims); err != nil {
+		return nil, err
+	}
+	if claims.ObjectID == "" || claims.ResourceID == "" {
+		return nil, errors.New("token is not a managed identity token")
+	}
+
+	// /subscriptions/{id}/resourcegroups/{group}/providers/{type}/{name}
+	attributes := map[string]string{
+		"account":    claims.TenantID,
+		"name":       claims.ResourceID[strings.LastIndex(claims.ResourceID, "/")+1:],
+		"resourceID": claims.ResourceID,
+		"appID":      claims.AppID,
+	}
+	segments := strings.Split(strings.Trim(claims.ResourceID, "/"), "/")
+	for i := 0; i+1 < len(segments); i += 2 {
+		switch strings.ToLower(segments[i]) {
+		case "subscriptions":
+			attributes["subscription"] = segments[i+1]
+		case "resourcegroups":
+			attributes["resourceGroup"] = segments[i+1]
+		}
+	}
+
+	return &cloudIdentity{Principal: claims.ObjectID, Attributes: attributes}, nil
+}
+
+// signCloud issues a certificate for a cloud identity. The names of the
+// CSR must be among the SANs derived from the identity. The request then
+// goes through the policy like the other requests, with the principal as
+// the client identity.
+func (s *server) signCloud(w http.ResponseWriter, r *http.Request) {
+	generation := s.generationFor(r)
+	opts, err := parseBundleOptions(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	var body CloudSignRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSignRequestSize)).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+	if err := body.SignRequest.Validate(); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	if body.Profile != "" {
+		render.Error(w, r, errs.BadRequest("profiles are not supported with cloud identities"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.CloudIdentity.GetTimeout())
+	id, err := s.cloud.verify(ctx, &body)
+	cancel()
+	if err != nil {
+		provider, result := body.Provider, "invalid"
+		if _, ok := s.config.CloudIdentity.provider(provider); !ok {
+			provider = "unknown"
+		}
+		if e, ok := err.(*errs.Error); ok && e.StatusCode() >= http.StatusInternalServerError {
+			result = "error"
+		}
+		cloudIdentityExchanges.WithLabelValues(provider, result).Inc()
+		logFor("server").WithFields(log.Fields{
+			"provider": body.Provider,
+			"remote":   r.RemoteAddr,
+			"error":    err,
+		}).Warn("Unauthorized: invalid cloud identity")
+		render.Error(w, r, err)
+		return
+	}
+
+	p, _ := s.config.CloudIdentity.provider(id.Provider)
+	sans := expandPatterns(p.SANs, id.Attributes)
+	request := &body.SignRequest
+	names := requestNames(request)
+	for _, name := range names {
+		if !slices.Contains(sans, name) {
+			cloudIdentityExchanges.WithLabelValues(id.Provider, "denied").Inc()
+			logFor("policy").WithFields(log.Fields{
+				"provider":  id.Provider,
+				"principal": id.Principal,
+				"san":       name,
+				"allowed":   sans,
+			}).Warn("Forbidden: name not derived from the cloud identity")
+			render.Error(w, r, errs.Forbidden("%s is not allowed for %s, allowed names are %s", name, id.Principal, strings.Join(sans, ", ")))
+			return
+		}
+	}
+	if len(names) == 0 {
+		render.Error(w, r, errs.BadRequest("csr has no names, allowed names are %s", strings.Join(sans, ", ")))
+		return
+	}
+	if err := limitNotAfter(request, s.config.CloudIdentity.GetMaxLifetime()); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), identitiesKey{}, []string{id.Principal}))
+	if err := s.checkPolicy(r, generation, request); err != nil {
+		result := "error"
+		if _, ok := err.(*policyError); ok {
+			result = "denied"
+		}
+		cloudIdentityExchanges.WithLabelValues(id.Provider, result).Inc()
+		s.countSign(clientIdentities(r), generation, result, err)
+		render.Error(w, r, err)
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(r.Context(), s.config.Timeouts.GetSign())
+	defer cancel()
+
+	resp, err := s.issueWith(ctx, s.upstreamFor(generation), request, nil)
+	if err != nil {
+		cloudIdentityExchanges.WithLabelValues(id.Provider, "error").Inc()
+		s.releaseQuota(clientIdentities(r))
+		s.countSign(clientIdentities(r), generation, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	logFor("server").WithFields(log.Fields{
+		"request":   requestID(r),
+		"provider":  id.Provider,
+		"principal": id.Principal,
+		"account":   id.Attributes["account"],
+		"subject":   request.CsrPEM.Subject.CommonName,
+		"serial":    resp.ServerPEM.Certificate.SerialNumber.String(),
+		"metadata":  request.Metadata,
+	}).Info("Issued certificate for a cloud identity")
+	cloudIdentityExchanges.WithLabelValues(id.Provider, "issued").Inc()
+	s.countSign(clientIdentities(r), generation, "issued", nil)
+	s.issued(newHookEvent(r, generation, request), resp)
+	s.writeSignResponse(w, r, resp, request.scts, nil, opts, http.StatusCreated)
+}
@@ -0,0 +1,357 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.step.sm/crypto/jose"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// testTokenIssuer signs identity tokens with a P-256 key published in a key
+// set, at any path but the OpenID Connect discovery document.
+type testTokenIssuer struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+	kid string
+}
+
+func newTestTokenIssuer(t *testing.T) *testTokenIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testTokenIssuer{key: key, kid: "test-key"}
+	iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			json.NewEncoder(w).Encode(map[string]string{"issuer": iss.URL, "jwks_uri": iss.URL + "/keys"})
+			return
+		}
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: iss.kid, Algorithm: "ES256", Use: "sig"},
+		}})
+	}))
+	t.Cleanup(iss.Close)
+
+	return iss
+}
+
+// token returns a token with the claims, valid for an hour unless they set
+// exp. Claims set to nil are omitted.
+func (iss *testTokenIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: iss.key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", iss.kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := map[string]interface{}{"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range claims {
+		all[k] = v
+		if v == nil {
+			delete(all, k)
+		}
+	}
+	tok, err := jose.Signed(signer).Claims(all).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tok
+}
+
+// newTestSTS returns an AWS STS answering GetCallerIdentity with arn.
+func newTestSTS(t *testing.T, arn string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(awsAudienceHeader) == "" || !strings.Contains(string(body), "GetCallerIdentity") {
+			http.Error(w, "<Error/>", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `<GetCallerIdentityResponse><GetCallerIdentityResult><Arn>%s</Arn><UserId>AROAEXAMPLE:web-1</UserId><Account>123456789012</Account></GetCallerIdentityResult></GetCallerIdentityResponse>`, arn)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// awsIdentityRequest returns a GetCallerIdentity request for endpoint with
+// the audience header, signed unless signed is false.
+func awsIdentityRequest(endpoint, audience string, signed bool) *AWSIdentityRequest {
+	headers := "content-type;host;x-amz-date"
+	if signed {
+		headers += ";x-ca-signer-audience"
+	}
+	return &AWSIdentityRequest{
+		Method: http.MethodPost,
+		URL:    endpoint + "/",
+		Headers: map[string][]string{
+			"Authorization":   {"AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/20260101/us-east-1/sts/aws4_request, SignedHeaders=" + headers + ", Signature=abcd"},
+			"Content-Type":    {"application/x-www-form-urlencoded; charset=utf-8"},
+			awsAudienceHeader: {audience},
+		},
+		Body: base64.StdEncoding.EncodeToString([]byte("Action=GetCallerIdentity&Version=2011-06-15")),
+	}
+}
+
+func TestCloudIdentityConfigValidate(t *testing.T) {
+	valid := CloudProviderConfig{Type: "gcp", Audience: "https://signer.example.com", Accounts: []string{"my-project"}, SANs: []string{"${instanceName}.${zone}.gcp.example.com"}}
+	tests := []struct {
+		name    string
+		mutate  func(*CloudProviderConfig)
+		another bool
+		ok      bool
+	}{
+		{"valid", func(*CloudProviderConfig) {}, false, true},
+		{"type", func(p *CloudProviderConfig) { p.Type = "oracle" }, false, false},
+		{"duplicated", func(*CloudProviderConfig) {}, true, false},
+		{"audience", func(p *CloudProviderConfig) { p.Audience = "" }, false, false},
+		{"accounts", func(p *CloudProviderConfig) { p.Accounts = nil }, false, false},
+		{"sans", func(p *CloudProviderConfig) { p.SANs = nil }, false, false},
+		{"variable of another provider", func(p *CloudProviderConfig) { p.SANs = []string{"${session}.example.com"} }, false, false},
+		{"common variable", func(p *CloudProviderConfig) { p.SANs = []string{"${name}.${account}.example.com"} }, false, true},
+		{"jwks url", func(p *CloudProviderConfig) { p.JWKSURL = "http://keys.example.com" }, false, false},
+	}
+	for _, tt := range tests {
+		p := valid
+		tt.mutate(&p)
+		c := CloudIdentityConfig{Providers: []CloudProviderConfig{p}}
+		if tt.another {
+			c.Providers = append(c.Providers, p)
+		}
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	if got := (CloudProviderConfig{Type: cloudAzure}).GetJWKSURL(); !strings.HasPrefix(got, "https://login.microsoftonline.com/") {
+		t.Errorf("GetJWKSURL() of azure = %s", got)
+	}
+	if got := (CloudProviderConfig{Type: cloudAWS}).GetSTSEndpoint(); got != "https://sts.amazonaws.com" {
+		t.Errorf("GetSTSEndpoint() = %s", got)
+	}
+}
+
+func TestExpandPatterns(t *testing.T) {
+	attributes := map[string]string{"name": "web-1", "zone": "europe-west1-b", "session": ""}
+	got := expandPatterns([]string{"${name}.${zone}.example.com", "${name}.${session}.example.com", "static.example.com", "${missing}"}, attributes)
+	if !sameStrings(got, []string{"web-1.europe-west1-b.example.com", "static.example.com"}) {
+		t.Errorf("expandPatterns() = %v", got)
+	}
+}
+
+func TestCloudVerifierGCP(t *testing.T) {
+	iss := newTestTokenIssuer(t)
+	v := newCloudVerifier(CloudIdentityConfig{Providers: []CloudProviderConfig{
+		{Type: cloudGCP, Audience: "signer", Accounts: []string{"my-project"}, SANs: []string{"${name}.example.com"}, JWKSURL: iss.URL},
+	}})
+	vm := map[string]interface{}{
+		"iss": "https://accounts.google.com", "aud": "signer",
+		"email": "123-compute@developer.gserviceaccount.com", "email_verified": true,
+		"google": map[string]interface{}{"compute_engine": map[string]interface{}{
+			"project_id": "my-project", "project_number": 123, "zone": "europe-west1-b", "instance_id": "42", "instance_name": "web-1",
+		}},
+	}
+	with := func(claim string, value interface{}) map[string]interface{} {
+		c := map[string]interface{}{claim: value}
+		for k, v := range vm {
+			if k != claim {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	id, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudGCP, Token: iss.token(t, vm)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"account": "my-project", "name": "web-1", "projectNumber": "123", "zone": "europe-west1-b", "instanceID": "42", "principal": "123-compute@developer.gserviceaccount.com"}
+	for k, v := range want {
+		if id.Attributes[k] != v {
+			t.Errorf("attribute %s = %q, want %q", k, id.Attributes[k], v)
+		}
+	}
+
+	// Outside a VM, the project comes from the service account email.
+	saEmail := with("email", "deploy@my-project.iam.gserviceaccount.com")
+	saEmail["google"] = nil
+	if sa, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudGCP, Token: iss.token(t, saEmail)}); err != nil || sa.Attributes["account"] != "my-project" || sa.Attributes["name"] != "deploy" {
+		t.Errorf("verify() of a service account = %+v, %v", sa, err)
+	}
+
+	tests := []struct {
+		name   string
+		body   *CloudSignRequest
+		status int
+	}{
+		{"provider", &CloudSignRequest{Provider: cloudAzure, Token: iss.token(t, vm)}, http.StatusBadRequest},
+		{"audience", &CloudSignRequest{Provider: cloudGCP, Token: iss.token(t, with("aud", "other"))}, http.StatusUnauthorized},
+		{"issuer", &CloudSignRequest{Provider: cloudGCP, Token: iss.token(t, with("iss", "https://evil.example.com"))}, http.StatusUnauthorized},
+		{"expired", &CloudSignRequest{Provider: cloudGCP, Token: iss.token(t, with("exp", time.Now().Add(-time.Hour).Unix()))}, http.StatusUnauthorized},
+		{"no exp", &CloudSignRequest{Provider: cloudGCP, Token: iss.token(t, with("exp", nil))}, http.StatusUnauthorized},
+		{"unverified email", &CloudSignRequest{Provider: cloudGCP, Token: iss.token(t, with("email_verified", false))}, http.StatusUnauthorized},
+		{"account", &CloudSignRequest{Provider: cloudGCP, Token: iss.token(t, with("google", map[string]interface{}{"compute_engine": map[string]interface{}{"project_id": "other"}}))}, http.StatusForbidden},
+		{"malformed", &CloudSignRequest{Provider: cloudGCP, Token: "not.a.token"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if _, err := v.verify(context.Background(), tt.body); errorStatus(err) != tt.status {
+			t.Errorf("%s: verify() = %v, want status %d", tt.name, err, tt.status)
+		}
+	}
+
+	other := newTestTokenIssuer(t)
+	other.kid = iss.kid
+	if _, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudGCP, Token: other.token(t, vm)}); errorStatus(err) != http.StatusUnauthorized {
+		t.Errorf("verify() of a token signed by another key = %v, want 401", err)
+	}
+}
+
+func TestCloudVerifierAzure(t *testing.T) {
+	iss := newTestTokenIssuer(t)
+	v := newCloudVerifier(CloudIdentityConfig{Providers: []CloudProviderConfig{
+		{Type: cloudAzure, Audience: "api://signer", Accounts: []string{"tenant-1"}, SANs: []string{"${name}.example.com"}, JWKSURL: iss.URL},
+	}})
+	claims := map[string]interface{}{
+		"iss": "https://sts.windows.net/tenant-1/", "aud": "api://signer", "tid": "tenant-1", "oid": "object-1", "appid": "app-1",
+		"xms_mirid": "/subscriptions/sub-1/resourcegroups/rg-1/providers/Microsoft.Compute/virtualMachines/vm-1",
+	}
+	id, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudAzure, Token: iss.token(t, claims)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"account": "tenant-1", "name": "vm-1", "subscription": "sub-1", "resourceGroup": "rg-1", "appID": "app-1", "principal": "object-1"}
+	for k, v := range want {
+		if id.Attributes[k] != v {
+			t.Errorf("attribute %s = %q, want %q", k, id.Attributes[k], v)
+		}
+	}
+
+	claims["iss"] = "https://sts.windows.net/tenant-2/"
+	if _, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudAzure, Token: iss.token(t, claims)}); errorStatus(err) != http.StatusUnauthorized {
+		t.Errorf("verify() of another tenant = %v, want 401", err)
+	}
+	claims["iss"] = "https://login.microsoftonline.com/tenant-1/v2.0"
+	delete(claims, "xms_mirid")
+	if _, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudAzure, Token: iss.token(t, claims)}); errorStatus(err) != http.StatusUnauthorized {
+		t.Errorf("verify() of a token that is not a managed identity token = %v, want 401", err)
+	}
+}
+
+func TestCloudVerifierAWS(t *testing.T) {
+	sts := newTestSTS(t, "arn:aws:sts::123456789012:assumed-role/web/i-0abc")
+	config := CloudProviderConfig{Type: cloudAWS, Audience: "signer", Accounts: []string{"123456789012"}, SANs: []string{"${session}.example.com"}, STSEndpoint: sts.URL}
+	v := newCloudVerifier(CloudIdentityConfig{Providers: []CloudProviderConfig{config}})
+
+	id, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudAWS, Request: awsIdentityRequest(sts.URL, "signer", true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Principal != "arn:aws:iam::123456789012:role/web" || id.Attributes["session"] != "i-0abc" || id.Attributes["name"] != "web" || id.Attributes["userID"] != "AROAEXAMPLE:web-1" {
+		t.Errorf("verify() = %+v", id)
+	}
+
+	mutate := func(fn func(*AWSIdentityRequest)) *AWSIdentityRequest {
+		req := awsIdentityRequest(sts.URL, "signer", true)
+		fn(req)
+		return req
+	}
+	tests := []struct {
+		name    string
+		request *AWSIdentityRequest
+		status  int
+	}{
+		{"missing", nil, http.StatusBadRequest},
+		{"endpoint", awsIdentityRequest("https://evil.example.com", "signer", true), http.StatusUnauthorized},
+		{"query", mutate(func(r *AWSIdentityRequest) { r.URL += "?Action=GetCallerIdentity" }), http.StatusUnauthorized},
+		{"method", mutate(func(r *AWSIdentityRequest) { r.Method = http.MethodGet }), http.StatusUnauthorized},
+		{"action", mutate(func(r *AWSIdentityRequest) {
+			r.Body = base64.StdEncoding.EncodeToString([]byte(url.Values{"Action": {"GetSessionToken"}, "Version": {"2011-06-15"}}.Encode()))
+		}), http.StatusUnauthorized},
+		{"audience", awsIdentityRequest(sts.URL, "other", true), http.StatusUnauthorized},
+		{"unsigned audience", awsIdentityRequest(sts.URL, "signer", false), http.StatusUnauthorized},
+		{"rejected", mutate(func(r *AWSIdentityRequest) { r.Headers[awsAudienceHeader] = nil }), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if _, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudAWS, Request: tt.request}); errorStatus(err) != tt.status {
+			t.Errorf("%s: verify() = %v, want status %d", tt.name, err, tt.status)
+		}
+	}
+
+	user := newTestSTS(t, "arn:aws:iam::123456789012:user/ops/alice")
+	config.STSEndpoint = user.URL
+	v = newCloudVerifier(CloudIdentityConfig{Providers: []CloudProviderConfig{config}})
+	if id, err := v.verify(context.Background(), &CloudSignRequest{Provider: cloudAWS, Request: awsIdentityRequest(user.URL, "signer", true)}); err != nil || id.Principal != "arn:aws:iam::123456789012:user/ops/alice" || id.Attributes["name"] != "alice" {
+		t.Errorf("verify() of a user = %+v, %v", id, err)
+	}
+}
+
+func TestSignCloudRejected(t *testing.T) {
+	iss := newTestTokenIssuer(t)
+	c := CloudIdentityConfig{Providers: []CloudProviderConfig{
+		{Type: cloudGCP, Audience: "signer", Accounts: []string{"my-project"}, SANs: []string{"${name}.gcp.example.com"}, JWKSURL: iss.URL},
+	}}
+	s := newPolicyTestServer(policy.Config{Rules: []policy.Rule{
+		{ID: "no-db", Action: "deny", SANs: []string{"db-*.gcp.example.com"}},
+	}})
+	s.config.CloudIdentity, s.cloud = c, newCloudVerifier(c)
+	token := func(name string) string {
+		return iss.token(t, map[string]interface{}{
+			"iss": "https://accounts.google.com", "aud": "signer", "email": "vm@my-project.iam.gserviceaccount.com", "email_verified": true,
+			"google": map[string]interface{}{"compute_engine": map[string]interface{}{"project_id": "my-project", "instance_name": name}},
+		})
+	}
+	body := func(provider, token string, extra string, names ...string) string {
+		return `{"csr":` + mustJSON(t, newTestCSR(t, names...)) + `,"provider":"` + provider + `","token":"` + token + `"` + extra + `}`
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		result string
+	}{
+		{"malformed", `{"csr":`, http.StatusBadRequest, ""},
+		{"profile", body(cloudGCP, token("web-1"), `,"profile":"server"`, "web-1.gcp.example.com"), http.StatusBadRequest, ""},
+		{"unknown provider", body(cloudAWS, token("web-1"), "", "web-1.gcp.example.com"), http.StatusBadRequest, "invalid"},
+		{"invalid token", body(cloudGCP, "invalid", "", "web-1.gcp.example.com"), http.StatusUnauthorized, "invalid"},
+		{"other name", body(cloudGCP, token("web-1"), "", "web-2.gcp.example.com"), http.StatusForbidden, "denied"},
+		{"policy", body(cloudGCP, token("db-1"), "", "db-1.gcp.example.com"), http.StatusForbidden, "denied"},
+	}
+	for _, tt := range tests {
+		provider := cloudGCP
+		if tt.name == "unknown provider" {
+			provider = "unknown"
+		}
+		var before float64
+		if tt.result != "" {
+			before = testutil.ToFloat64(cloudIdentityExchanges.WithLabelValues(provider, tt.result))
+		}
+		r := httptest.NewRequest(http.MethodPost, "/sign/cloud", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		s.signCloud(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if tt.result != "" {
+			if got := testutil.ToFloat64(cloudIdentityExchanges.WithLabelValues(provider, tt.result)) - before; got != 1 {
+				t.Errorf("%s: %s exchanges counted = %v, want 1", tt.name, tt.result, got)
+			}
+		}
+	}
+}
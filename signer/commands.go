@@ -0,0 +1,158 @@
+package signer
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+)
+
+// Version and Commit identify the build, set by the release builds with
+// -ldflags "-X github.com/Fyve-Labs/ca-signer/signer.Version=...".
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+// runCommand runs the subcommand in args if there is one, and returns false
+// if args is not a known subcommand.
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	switch args[0] {
+	case "policy":
+		return runPolicyCommand(args[1:]), true
+	case "bench":
+		return runBenchCommand(args[1:]), true
+	case "config":
+		return runConfigCommand(args[1:]), true
+	case "bootstrap":
+		return runBootstrapCommand(args[1:]), true
+	case "agent":
+		return runAgentCommand(args[1:]), true
+	case "store":
+		return runStoreCommand(args[1:]), true
+	case "backup":
+		return runBackupCommand(args[1:]), true
+	case "restore":
+		return runRestoreCommand(args[1:]), true
+	case "usage":
+		return runUsageCommand(args[1:]), true
+	case "support-bundle":
+		return runSupportBundleCommand(args[1:]), true
+	case "version":
+		fmt.Printf("ca-signer %s (commit %s, %s %s/%s)\n", Version, Commit, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// runPolicyCommand implements "ca-signer policy test". It evaluates the
+// policy in the config against a CSR like POST /policy/evaluate does, and
+// prints the decision. It exits with 0 if the request is allowed, 1 if it is
+// denied and 2 on usage errors or an invalid CSR.
+func runPolicyCommand(args []string) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintln(os.Stderr, "usage: ca-signer policy test --config <file> --csr <file> [--identity <name>]... [--group <name>]... [--generation stable|canary] [--runtime-rules]")
+		return exitUsage
+	}
+
+	var identities, groups stringList
+	fs := flag.NewFlagSet("policy test", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "path to the signer configuration")
+	csrFile := fs.String("csr", "", "path to the PEM or DER encoded CSR")
+	fs.Var(&identities, "identity", "client identity to evaluate the policy for, can be repeated")
+	fs.Var(&groups, "group", "directory group of the client to evaluate the policy for, can be repeated; the directory is not queried")
+	generation := fs.String("generation", generationStable, "config generation to evaluate: stable, or canary for the canary policy")
+	runtimeRules := fs.Bool("runtime-rules", false, "also evaluate the runtime rules of the inventory, which must not be locked by a running signer if it is a BoltDB file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if *csrFile == "" || (*generation != generationStable && *generation != generationCanary) {
+		fs.Usage()
+		return exitUsage
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+		return exitUsage
+	}
+
+	csr, err := readCSRFile(*csrFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading csr: %v\n", err)
+		return exitUsage
+	}
+	request := &SignRequest{CsrPEM: api.CertificateRequest{CertificateRequest: csr}}
+	if err := request.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid csr: %v\n", err)
+		return exitUsage
+	}
+
+	s := &server{config: config}
+	if *runtimeRules {
+		if !config.Inventory.Enabled() {
+			fmt.Fprintln(os.Stderr, "the inventory is not configured")
+			return exitUsage
+		}
+		inv, err := openInventory(config.Inventory)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error opening inventory: %v\n", err)
+			return exitUsage
+		}
+		defer inv.Close()
+		if s.policyRules, err = loadRuntimePolicy(inv); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return exitUsage
+		}
+	}
+
+	d := s.policyFor(*generation).Evaluate(identities, groups, requestNames(request))
+	out, _ := json.MarshalIndent(d, "", "  ")
+	fmt.Println(string(out))
+	if !d.Allowed {
+		return 1
+	}
+
+	return 0
+}
+
+// readCSRFile reads a PEM or DER encoded certificate request.
+func readCSRFile(filename string) (*x509.CertificateRequest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		if !strings.HasSuffix(block.Type, "CERTIFICATE REQUEST") {
+			return nil, errors.Errorf("unexpected PEM block %q", block.Type)
+		}
+		data = block.Bytes
+	}
+
+	return x509.ParseCertificateRequest(data)
+}
+
+// stringList is a flag.Value accumulating repeated flags.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
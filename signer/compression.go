@@ -0,0 +1,285 @@
+package signer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// CompressionConfig configures the compression of the HTTP bodies. Request
+// bodies in gzip or deflate are always accepted, responses are compressed
+// when enabled and the client accepts it.
+type CompressionConfig struct {
+	Responses      bool `yaml:"responses"`
+	Level          int  `yaml:"level"`
+	MinSize        int  `yaml:"minSize"`
+	MaxRequestSize int  `yaml:"maxRequestSize"`
+}
+
+// GetLevel returns the gzip and deflate compression level, 1 to 9,
+// defaults to 6.
+func (c CompressionConfig) GetLevel() int {
+	if c.Level > 0 {
+		return c.Level
+	}
+
+	return gzip.DefaultCompression
+}
+
+// GetMinSize returns the size in bytes under which responses are sent
+// uncompressed, defaults to 1024.
+func (c CompressionConfig) GetMinSize() int {
+	if c.MinSize > 0 {
+		return c.MinSize
+	}
+
+	return 1024
+}
+
+// GetMaxRequestSize returns the maximum size in bytes of a decompressed
+// request body, defaults to 1MiB.
+func (c CompressionConfig) GetMaxRequestSize() int64 {
+	if c.MaxRequestSize > 0 {
+		return int64(c.MaxRequestSize)
+	}
+
+	return 1 << 20
+}
+
+// Validate checks the compression level and sizes.
+func (c CompressionConfig) Validate() error {
+	if c.Level < 0 || c.Level > gzip.BestCompression {
+		return errors.Errorf("invalid compression level %d, must be between 1 and 9", c.Level)
+	}
+	if c.MinSize < 0 || c.MaxRequestSize < 0 {
+		return errors.New("compression sizes must be positive")
+	}
+
+	return nil
+}
+
+// compression decompresses the request bodies sent with a gzip or deflate
+// Content-Encoding and, if enabled, compresses the responses of next for
+// the clients that accept it.
+func (s *server) compression(next http.Handler) http.Handler {
+	cfg := s.config.Compression
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enc := r.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+			body, err := decompressedBody(enc, r.Body)
+			if err != nil {
+				w.Header().Set("Accept-Encoding", "gzip, deflate")
+				render.Error(w, r, err)
+				return
+			}
+			defer body.Close()
+			r.Body = http.MaxBytesReader(w, body, cfg.GetMaxRequestSize())
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+
+		if !cfg.Responses {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := acceptedEncoding(r)
+		if enc == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: enc, level: cfg.GetLevel(), minSize: cfg.GetMinSize()}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// decompressedBody returns a reader decompressing body, deflate being the
+// zlib format as in HTTP.
+func decompressedBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	var err error
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		rc, err = gzip.NewReader(body)
+	case "deflate":
+		rc, err = zlib.NewReader(body)
+	default:
+		return nil, errs.New(http.StatusUnsupportedMediaType, "unsupported content encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, errs.BadRequestErr(err, "invalid %s request body", encoding)
+	}
+
+	return rc, nil
+}
+
+// acceptedEncoding returns the response encoding for the Accept-Encoding of
+// the request, gzip if accepted, else deflate, else none.
+func acceptedEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		accepted[coding] = true
+	}
+
+	for _, enc := range []string{"gzip", "deflate"} {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// incompressibleTypes are the content types sent as is: event streams
+// must reach the client as they are written, the others are compressed
+// already.
+var incompressibleTypes = []string{
+	"text/event-stream",
+	"application/x-pkcs12",
+	"application/zip",
+	"application/gzip",
+}
+
+// compressWriter buffers the first minSize bytes of a response to decide
+// whether it is worth compressing, and compresses the rest as it is
+// written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	level    int
+	minSize  int
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	w       io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.status != 0 {
+		return
+	}
+	c.status = code
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.decided {
+		return c.writer().Write(b)
+	}
+
+	c.buf.Write(b)
+	if c.buf.Len() >= c.minSize {
+		if err := c.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush implements http.Flusher, a flushed response is compressed only if
+// it has reached minSize.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.start(c.buf.Len() >= c.minSize)
+	}
+	if gw, ok := c.w.(interface{ Flush() error }); ok {
+		gw.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// start writes the headers and the buffered body, compressed if compress
+// is set and the response can be compressed.
+func (c *compressWriter) start(compress bool) error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+
+	h := c.ResponseWriter.Header()
+	if compress && c.compressible() {
+		var err error
+		switch c.encoding {
+		case "gzip":
+			c.w, err = gzip.NewWriterLevel(c.ResponseWriter, c.level)
+		default:
+			c.w, err = zlib.NewWriterLevel(c.ResponseWriter, c.level)
+		}
+		if err != nil {
+			return err
+		}
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+	if c.buf.Len() > 0 {
+		if _, err := c.writer().Write(c.buf.Bytes()); err != nil {
+			return err
+		}
+		c.buf.Reset()
+	}
+	return nil
+}
+
+// compressible reports whether the response can be compressed given its
+// status and headers.
+func (c *compressWriter) compressible() bool {
+	if c.status < http.StatusOK || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		return false
+	}
+	h := c.ResponseWriter.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	for _, t := range incompressibleTypes {
+		if mediaType == t {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *compressWriter) writer() io.Writer {
+	if c.w != nil {
+		return c.w
+	}
+	return c.ResponseWriter
+}
+
+// close sends a response that never reached minSize as is and terminates
+// the compressed stream.
+func (c *compressWriter) close() {
+	if !c.decided {
+		if c.status == 0 {
+			return
+		}
+		c.start(false)
+	}
+	if c.w != nil {
+		c.w.Close()
+	}
+}
@@ -0,0 +1,147 @@
+package signer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressionConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    CompressionConfig
+		ok   bool
+	}{
+		{"default", CompressionConfig{}, true},
+		{"level", CompressionConfig{Level: 9}, true},
+		{"invalid level", CompressionConfig{Level: 10}, false},
+		{"negative size", CompressionConfig{MinSize: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip, deflate", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0.5", "deflate"},
+		{"br", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptedEncoding(r); got != tt.want {
+			t.Errorf("%q: acceptedEncoding() = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionRequests(t *testing.T) {
+	s := &server{config: &Config{Compression: CompressionConfig{MaxRequestSize: 64}}}
+	var received string
+	handler := s.compression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		received = string(b)
+	}))
+
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(`{"csr":"gzip"}`))
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(`{"csr":"deflate"}`))
+	zw.Close()
+	var large bytes.Buffer
+	gw = gzip.NewWriter(&large)
+	gw.Write(bytes.Repeat([]byte("a"), 65))
+	gw.Close()
+
+	tests := []struct {
+		encoding string
+		body     []byte
+		status   int
+		want     string
+	}{
+		{"gzip", gz.Bytes(), http.StatusOK, `{"csr":"gzip"}`},
+		{"deflate", zl.Bytes(), http.StatusOK, `{"csr":"deflate"}`},
+		{"identity", []byte("plain"), http.StatusOK, "plain"},
+		{"br", []byte("brotli"), http.StatusUnsupportedMediaType, ""},
+		{"gzip", []byte("not gzip"), http.StatusBadRequest, ""},
+		{"gzip", large.Bytes(), http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		received = ""
+		r := httptest.NewRequest(http.MethodPost, "/sign", bytes.NewReader(tt.body))
+		r.Header.Set("Content-Encoding", tt.encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status || received != tt.want {
+			t.Errorf("%s: status = %d, body %q, want %d, %q", tt.encoding, w.Code, received, tt.status, tt.want)
+		}
+	}
+}
+
+func TestCompressionResponses(t *testing.T) {
+	s := &server{config: &Config{Compression: CompressionConfig{Responses: true, MinSize: 16}}}
+	handler := s.compression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, r.URL.Query().Get("body"))
+	}))
+
+	long := strings.Repeat("certificate ", 10)
+	tests := []struct {
+		name     string
+		accept   string
+		typ      string
+		body     string
+		encoding string
+	}{
+		{"gzip", "gzip", "application/json", long, "gzip"},
+		{"deflate", "deflate", "application/json", long, "deflate"},
+		{"not accepted", "", "application/json", long, ""},
+		{"small", "gzip", "application/json", "small", ""},
+		{"incompressible", "gzip", "application/x-pkcs12", long, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/?type="+tt.typ+"&body="+strings.ReplaceAll(tt.body, " ", "+"), nil)
+		r.Header.Set("Accept-Encoding", tt.accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Encoding"); got != tt.encoding || w.Code != http.StatusCreated {
+			t.Errorf("%s: %d, Content-Encoding = %q, want 201, %q", tt.name, w.Code, got, tt.encoding)
+			continue
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary = %q, want Accept-Encoding", tt.name, w.Header().Get("Vary"))
+		}
+
+		var body io.Reader = w.Body
+		switch tt.encoding {
+		case "gzip":
+			body, _ = gzip.NewReader(w.Body)
+		case "deflate":
+			body, _ = zlib.NewReader(w.Body)
+		}
+		if b, err := io.ReadAll(body); err != nil || string(b) != tt.body {
+			t.Errorf("%s: body = %q, %v, want %q", tt.name, b, err, tt.body)
+		}
+	}
+}
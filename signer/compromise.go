@@ -0,0 +1,352 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/certificates/errs"
+	"go.step.sm/crypto/pemutil"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// CRL reason codes of RFC 5280.
+const (
+	reasonUnspecified   = 0
+	reasonKeyCompromise = 1
+)
+
+// compromiseStatementMaxAge is how old a signed compromise statement may be.
+const compromiseStatementMaxAge = 5 * time.Minute
+
+// CompromiseReport is the body of POST /report-compromise. The reporter
+// proves possession of the key either by sending the private key itself, or
+// by signing the statement
+//
+//	ca-signer key compromise <hex SHA-256 of the SPKI> <RFC 3339 time>
+//
+// with it; publicKey is then the public key or a certificate in PEM.
+type CompromiseReport struct {
+	PrivateKey string `json:"privateKey"`
+	PublicKey  string `json:"publicKey"`
+	Statement  string `json:"statement"`
+	Signature  string `json:"signature"`
+	Reason     string `json:"reason"`
+}
+
+// compromisedKey returns the public key the report proves possession of.
+func (c CompromiseReport) compromisedKey(now time.Time) (crypto.PublicKey, error) {
+	if c.PrivateKey != "" {
+		key, err := pemutil.ParseKey([]byte(c.PrivateKey))
+		if err != nil {
+			return nil, errs.BadRequestErr(err, "invalid privateKey")
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errs.BadRequest("privateKey is not a private key")
+		}
+		return signer.Public(), nil
+	}
+
+	if c.PublicKey == "" || c.Statement == "" || c.Signature == "" {
+		return nil, errs.BadRequest("privateKey, or publicKey, statement and signature are required")
+	}
+	pub, err := pemutil.ParseKey([]byte(c.PublicKey))
+	if err != nil {
+		return nil, errs.BadRequestErr(err, "invalid publicKey")
+	}
+	if cert, ok := pub.(*x509.Certificate); ok {
+		pub = cert.PublicKey
+	}
+	spki, err := spkiFingerprint(pub)
+	if err != nil {
+		return nil, errs.BadRequestErr(err, "invalid publicKey")
+	}
+
+	fields := strings.Fields(c.Statement)
+	if len(fields) != 5 || strings.Join(fields[:3], " ") != "ca-signer key compromise" || fields[3] != spki {
+		return nil, errs.BadRequest("statement must be \"ca-signer key compromise %s <RFC 3339 time>\"", spki)
+	}
+	t, err := time.Parse(time.RFC3339, fields[4])
+	if err != nil || now.Sub(t).Abs() > compromiseStatementMaxAge {
+		return nil, errs.BadRequest("statement time must be within %s of now", compromiseStatementMaxAge)
+	}
+	sig, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil {
+		return nil, errs.BadRequestErr(err, "invalid signature encoding")
+	}
+	if err := verifyStatement(pub, []byte(c.Statement), sig); err != nil {
+		return nil, errs.Wrap(http.StatusForbidden, err, "invalid statement signature")
+	}
+
+	return pub, nil
+}
+
+// verifyStatement verifies an Ed25519 signature of the statement, or an
+// ECDSA or RSA PKCS #1 v1.5 signature of its SHA-256.
+func verifyStatement(pub crypto.PublicKey, statement, sig []byte) error {
+	digest := sha256.Sum256(statement)
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, statement, sig) {
+			return errors.New("signature does not match")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return errors.New("signature does not match")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	default:
+		return errors.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// spkiFingerprint returns the hex SHA-256 of the DER SubjectPublicKeyInfo.
+func spkiFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CertificatesForKey returns the valid certificates issued for a public key,
+// given by the hex SHA-256 of its SPKI.
+func (inv *inventory) CertificatesForKey(spki string, now time.Time) ([]*certificateRecord, error) {
+	var recs []*certificateRecord
+	err := inv.All(func(rec *certificateRecord) error {
+		if rec.status(now) != statusValid {
+			return nil
+		}
+		block, _ := pem.Decode([]byte(rec.Certificate))
+		if block == nil {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+		if fp, err := spkiFingerprint(cert.PublicKey); err == nil && fp == spki {
+			recs = append(recs, rec)
+		}
+		return nil
+	})
+
+	return recs, err
+}
+
+// errCertificateNotFound is returned when a serial number is not in the
+// inventory.
+var errCertificateNotFound = errors.New("certificate not found")
+
+// Revoke marks a certificate as revoked, or returns errCertificateNotFound.
+func (inv *inventory) Revoke(serial string, t time.Time, reason string) error {
+	return inv.update(func(tx store.Tx) error {
+		b := tx.Bucket(certificatesBucket)
+		data := b.Get([]byte(serial))
+		if data == nil {
+			return errCertificateNotFound
+		}
+		var rec certificateRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		t = t.UTC()
+		rec.RevokedAt, rec.RevocationReason = &t, reason
+		data, err := json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(serial), data)
+	})
+}
+
+// revocationFailure is a certificate the upstream CA failed to revoke.
+type revocationFailure struct {
+	Serial string `json:"serial"`
+	Error  string `json:"error"`
+}
+
+// compromiseResult is the response of POST /report-compromise.
+type compromiseResult struct {
+	Key     string              `json:"key"`
+	Revoked []string            `json:"revoked"`
+	Failed  []revocationFailure `json:"failed,omitempty"`
+}
+
+// reportCompromise revokes all the valid certificates in the inventory
+// issued for a key the reporter proves possession of. Revocations are
+// audited in the logs and fire the revocation hooks.
+func (s *server) reportCompromise(w http.ResponseWriter, r *http.Request) {
+	var body CompromiseReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSignRequestSize)).Decode(&body); err != nil {
+		compromiseReports.WithLabelValues("invalid").Inc()
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+
+	now := time.Now()
+	pub, err := body.compromisedKey(now)
+	if err != nil {
+		compromiseReports.WithLabelValues("invalid").Inc()
+		render.Error(w, r, err)
+		return
+	}
+	spki, err := spkiFingerprint(pub)
+	if err != nil {
+		compromiseReports.WithLabelValues("invalid").Inc()
+		render.Error(w, r, errs.BadRequestErr(err, "unsupported key"))
+		return
+	}
+
+	recs, err := s.inventory.CertificatesForKey(spki, now)
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	if len(recs) == 0 {
+		compromiseReports.WithLabelValues("unknown").Inc()
+		render.Error(w, r, errs.NotFound("no valid certificate was issued for this key"))
+		return
+	}
+
+	reason := "key compromise reported"
+	if body.Reason != "" {
+		reason += ": " + body.Reason
+	}
+	result := compromiseResult{Key: spki, Revoked: []string{}}
+	for _, rec := range recs {
+		if err := s.revoke(r, rec, reasonKeyCompromise, reason); err != nil {
+			result.Failed = append(result.Failed, revocationFailure{Serial: rec.Serial, Error: err.Error()})
+			continue
+		}
+		result.Revoked = append(result.Revoked, rec.Serial)
+	}
+
+	if s.renewals != nil && len(result.Revoked) > 0 {
+		s.renewals.notify(func(sub *renewalSubscriber) bool {
+			return policy.ContainsAny(result.Revoked, sub.serials)
+		}, renewalNotice{Time: now.UTC(), Reason: reason, Serials: result.Revoked})
+	}
+
+	status := http.StatusOK
+	if len(result.Failed) > 0 {
+		compromiseReports.WithLabelValues("partial").Inc()
+		status = http.StatusBadGateway
+	} else {
+		compromiseReports.WithLabelValues("revoked").Inc()
+	}
+	render.JSONStatus(w, r, result, status)
+}
+
+// revoke revokes a certificate with the provisioner that issued it, records
+// the revocation in the inventory and fires the revocation hooks.
+func (s *server) revoke(r *http.Request, rec *certificateRecord, reasonCode int, reason string) error {
+	logger := logFor("server").WithFields(log.Fields{
+		"request":  requestID(r),
+		"client":   clientIdentities(r),
+		"serial":   rec.Serial,
+		"subject":  rec.Subject,
+		"sans":     rec.SANs,
+		"reason":   reason,
+		"endpoint": r.URL.Path,
+	})
+
+	name := s.upstreamFor(rec.Metadata.Generation)
+	if rec.Metadata.Endpoint == "/sign/intermediate" && s.upstream(upstreamIntermediate) != nil {
+		name = upstreamIntermediate
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.Timeouts.GetSign())
+	defer cancel()
+	if err := revokeUpstream(ctx, s.upstream(name), rec.Serial, reasonCode, reason); err != nil {
+		revocations.WithLabelValues("error").Inc()
+		logger.WithField("error", err).Error("Error revoking certificate")
+		return err
+	}
+
+	now := time.Now()
+	if err := s.inventory.Revoke(rec.Serial, now, reason); err != nil {
+		inventoryErrors.Inc()
+		logger.WithField("error", err).Error("Error recording revocation in the inventory")
+	}
+	revocations.WithLabelValues("revoked").Inc()
+	logger.Warn("Revoked certificate")
+
+	s.hooks.Fire(hookRevocation, hookEvent{
+		Time:             now.UTC(),
+		RequestID:        requestID(r),
+		Client:           clientIdentities(r),
+		Endpoint:         r.URL.Path,
+		Generation:       rec.Metadata.Generation,
+		Subject:          rec.Subject,
+		SANs:             rec.SANs,
+		Certificate:      rec.Certificate,
+		Serial:           rec.Serial,
+		Metadata:         rec.Metadata.Labels,
+		RevocationReason: reason,
+	})
+
+	return nil
+}
+
+// revokeRejected revokes a certificate issued by the upstream named name
+// that the signer rejected, so that it cannot be used even if it leaked.
+// Errors are logged, the request fails either way.
+func (s *server) revokeRejected(ctx context.Context, name string, cert *x509.Certificate, reason string) {
+	serial := cert.SerialNumber.String()
+	logger := logFor("server").WithFields(log.Fields{
+		"upstream": name,
+		"serial":   serial,
+		"subject":  cert.Subject.String(),
+		"reason":   reason,
+	})
+	if err := revokeUpstream(ctx, s.upstream(name), serial, reasonUnspecified, reason); err != nil {
+		revocations.WithLabelValues("error").Inc()
+		logger.WithField("error", err).Error("Error revoking rejected certificate")
+		return
+	}
+	revocations.WithLabelValues("revoked").Inc()
+	logger.Warn("Revoked rejected certificate")
+}
+
+// revokeUpstream revokes a serial number passively, i.e. it is added to the
+// CRL and OCSP responses of the CA, with a revoke token of the provisioner.
+func revokeUpstream(ctx context.Context, p *ca.Provisioner, serial string, reasonCode int, reason string) error {
+	token, err := revokeToken(p, serial)
+	if err != nil {
+		return errors.Wrap(err, "error generating revoke token")
+	}
+
+	_, err = p.RevokeWithContext(ctx, &api.RevokeRequest{
+		Serial:     serial,
+		OTT:        token,
+		ReasonCode: reasonCode,
+		Reason:     reason,
+		Passive:    true,
+	}, nil)
+	return upstreamError(ctx, err)
+}
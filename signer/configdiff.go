@@ -0,0 +1,206 @@
+package signer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+var (
+	configBucket     = []byte("config")
+	configCurrentKey = []byte("current")
+)
+
+// configRecord is the last configuration the signer started with, stored
+// in the inventory. Config is rendered like GET /config, with secrets
+// redacted; Hash covers the secrets too.
+type configRecord struct {
+	Generation int                    `json:"generation"`
+	Hash       string                 `json:"hash"`
+	Changed    time.Time              `json:"changed"`
+	Config     map[string]interface{} `json:"config"`
+}
+
+// configChange is a field changed between two configurations, named by
+// its path in the config file, e.g. policy.rules[0].sans. Added and
+// removed fields have no old or new value.
+type configChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// configHash returns the SHA-256 of the effective configuration.
+func configHash(c *Config) string {
+	data, _ := json.Marshal(configValue(reflect.ValueOf(*c), true))
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// renderedConfig returns the effective configuration with secrets redacted
+// as a JSON object, as it is stored and compared.
+func renderedConfig(c *Config) (map[string]interface{}, error) {
+	data, err := json.Marshal(renderConfig(c, true))
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(data, &m)
+
+	return m, err
+}
+
+// diffConfig returns the fields changed from old to new, sorted by path.
+// Lists of the same length are compared item by item, other lists as a
+// whole.
+func diffConfig(old, new map[string]interface{}) []configChange {
+	changes := []configChange{}
+	diffValue("", old, new, &changes)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes
+}
+
+func diffValue(path string, old, new interface{}, changes *[]configChange) {
+	switch o := old.(type) {
+	case map[string]interface{}:
+		if n, ok := new.(map[string]interface{}); ok {
+			for k, v := range o {
+				diffValue(joinConfigPath(path, k), v, n[k], changes)
+			}
+			for k, v := range n {
+				if _, ok := o[k]; !ok {
+					diffValue(joinConfigPath(path, k), nil, v, changes)
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if n, ok := new.([]interface{}); ok && len(n) == len(o) {
+			for i := range o {
+				diffValue(fmt.Sprintf("%s[%d]", path, i), o[i], n[i], changes)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, configChange{Path: path, Old: old, New: new})
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// LastConfig returns the configuration the signer last started with, or
+// nil if none was recorded.
+func (inv *inventory) LastConfig() (*configRecord, error) {
+	var rec *configRecord
+	err := inv.view(func(tx store.Tx) error {
+		data := tx.Bucket(configBucket).Get(configCurrentKey)
+		if data == nil {
+			return nil
+		}
+		rec = new(configRecord)
+		return json.Unmarshal(data, rec)
+	})
+
+	return rec, err
+}
+
+// PutConfig records the configuration the signer started with.
+func (inv *inventory) PutConfig(rec *configRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return inv.update(func(tx store.Tx) error {
+		return tx.Bucket(configBucket).Put(configCurrentKey, data)
+	})
+}
+
+// recordConfig compares the configuration with the one the signer last
+// started with, as a config push restarts the signer. If it changed, the
+// generation is incremented and the changed fields are logged. The
+// generation and hash are exported as metrics, so behavior changes can be
+// correlated with config pushes. Without an inventory, the generation is
+// always 1.
+func recordConfig(c *Config, inv *inventory) error {
+	hash := configHash(c)
+	configInfo.WithLabelValues(hash).Set(1)
+	if inv == nil {
+		configGeneration.Set(1)
+		return nil
+	}
+
+	current, err := renderedConfig(c)
+	if err != nil {
+		return err
+	}
+	last, err := inv.LastConfig()
+	if err != nil {
+		return err
+	}
+	logger := logFor("config")
+	rec := &configRecord{Generation: 1, Hash: hash, Changed: time.Now().UTC(), Config: current}
+	switch {
+	case last == nil:
+		logger.WithFields(log.Fields{
+			"generation": rec.Generation,
+			"hash":       hash,
+		}).Info("Recorded the configuration")
+	case last.Hash == hash:
+		rec = last
+	default:
+		rec.Generation = last.Generation + 1
+		changes := diffConfig(last.Config, current)
+		fields := log.Fields{
+			"generation":         rec.Generation,
+			"previousGeneration": last.Generation,
+			"hash":               hash,
+			"previousHash":       last.Hash,
+			"changes":            changes,
+		}
+		if len(changes) == 0 {
+			// Only redacted values changed.
+			fields["changes"] = "secrets"
+		}
+		logger.WithFields(fields).Warn("Configuration changed")
+		for _, ch := range changes {
+			configChanges.WithLabelValues(topLevelConfigField(ch.Path)).Inc()
+		}
+	}
+	configGeneration.Set(float64(rec.Generation))
+	configChangedTime.Set(float64(rec.Changed.Unix()))
+	if rec == last {
+		return nil
+	}
+
+	return inv.PutConfig(rec)
+}
+
+// topLevelConfigField returns the section of a config path, e.g. policy for
+// policy.rules[0].sans.
+func topLevelConfigField(path string) string {
+	for i, c := range path {
+		if c == '.' || c == '[' {
+			return path[:i]
+		}
+	}
+	return path
+}
@@ -0,0 +1,101 @@
+package signer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old := map[string]interface{}{
+		"caURL":   "https://ca:9000",
+		"cache":   map[string]interface{}{"ttl": "5m0s"},
+		"clients": []interface{}{"web", "db"},
+		"admin":   []interface{}{"ops"},
+		"removed": true,
+	}
+	new := map[string]interface{}{
+		"caURL":   "https://ca:9000",
+		"cache":   map[string]interface{}{"ttl": "10m0s"},
+		"clients": []interface{}{"web", "api"},
+		"admin":   []interface{}{"ops", "security"},
+		"added":   "value",
+	}
+	want := []configChange{
+		{Path: "added", New: "value"},
+		{Path: "admin", Old: []interface{}{"ops"}, New: []interface{}{"ops", "security"}},
+		{Path: "cache.ttl", Old: "5m0s", New: "10m0s"},
+		{Path: "clients[1]", Old: "db", New: "api"},
+		{Path: "removed", Old: true},
+	}
+	if got := diffConfig(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffConfig() = %+v, want %+v", got, want)
+	}
+	if got := diffConfig(old, old); len(got) != 0 {
+		t.Errorf("diffConfig() of the same config = %+v, want none", got)
+	}
+}
+
+func TestTopLevelConfigField(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"caURL", "caURL"},
+		{"cache.ttl", "cache"},
+		{"profiles[0].name", "profiles"},
+		{"policy.rules[0].sans", "policy"},
+	}
+	for _, tt := range tests {
+		if got := topLevelConfigField(tt.path); got != tt.want {
+			t.Errorf("topLevelConfigField(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRecordConfig(t *testing.T) {
+	inv := newTestInventory(t)
+	c := &Config{CaURL: "https://ca:9000"}
+	caChanges := configChanges.WithLabelValues("caURL")
+
+	steps := []struct {
+		name       string
+		change     func()
+		generation int
+		changes    float64
+	}{
+		{"first", func() {}, 1, 0},
+		{"unchanged", func() {}, 1, 0},
+		{"changed", func() { c.CaURL = "https://ca:9443" }, 2, 1},
+		{"secret", func() { c.RateLimit.Redis.Password = "hunter2" }, 3, 0},
+		{"same secret", func() {}, 3, 0},
+	}
+	for _, step := range steps {
+		step.change()
+		before := testutil.ToFloat64(caChanges)
+		if err := recordConfig(c, inv); err != nil {
+			t.Fatalf("%s: recordConfig() = %v", step.name, err)
+		}
+		rec, err := inv.LastConfig()
+		if err != nil || rec == nil {
+			t.Fatalf("%s: LastConfig() = %v, %v", step.name, rec, err)
+		}
+		if rec.Generation != step.generation || rec.Hash != configHash(c) || rec.Config["caURL"] != c.CaURL {
+			t.Errorf("%s: recorded generation %d %s %v, want %d", step.name, rec.Generation, rec.Hash, rec.Config["caURL"], step.generation)
+		}
+		if got := testutil.ToFloat64(configGeneration); got != float64(step.generation) {
+			t.Errorf("%s: generation metric = %v, want %d", step.name, got, step.generation)
+		}
+		if got := testutil.ToFloat64(caChanges) - before; got != step.changes {
+			t.Errorf("%s: caURL changes counted = %v, want %v", step.name, got, step.changes)
+		}
+	}
+
+	if err := recordConfig(c, nil); err != nil || testutil.ToFloat64(configGeneration) != 1 {
+		t.Errorf("recordConfig() without inventory = %v, generation %v, want 1", err, testutil.ToFloat64(configGeneration))
+	}
+	if got := testutil.ToFloat64(configInfo.WithLabelValues(configHash(c))); got != 1 {
+		t.Errorf("config info = %v, want 1", got)
+	}
+}
@@ -0,0 +1,170 @@
+package signer
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/smallstep/certificates/api/render"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultGetters are the getters of the defaults of the fields whose getter
+// is not named after them.
+var defaultGetters = map[string]string{
+	"Service":                 "GetServiceName",
+	"ProvisionerPasswordFile": "GetProvisionerPasswordPath",
+}
+
+// renderConfig returns the config as a generic value keyed by the YAML
+// names of the fields, with secrets redacted. With effective, the zero
+// fields are set to the defaults returned by their getters, e.g. Timeout to
+// GetTimeout(). Maps are rendered with sorted keys, so the output is
+// deterministic.
+func renderConfig(c *Config, effective bool) interface{} {
+	return redactConfig(configValue(reflect.ValueOf(*c), effective), false)
+}
+
+// redactConfig redacts the strings of the fields with sensitive names and
+// the secrets in the other strings. Unlike the logs, the sections with
+// sensitive names, e.g. challengePassword, are walked so only their secret
+// fields are redacted.
+func redactConfig(v interface{}, sensitive bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = redactConfig(val, sensitiveKey.MatchString(k))
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactConfig(v[i], sensitive)
+		}
+		return v
+	case string:
+		if sensitive && v != "" {
+			return redacted
+		}
+		return redactString(v)
+	default:
+		return v
+	}
+}
+
+func configValue(v reflect.Value, effective bool) interface{} {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return configValue(v.Elem(), effective)
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fv := v.Field(i)
+			if effective && fv.IsZero() {
+				if d, ok := configDefault(v, f.Name); ok {
+					fv = d
+				}
+			}
+			if fv.Kind() == reflect.Pointer && fv.IsNil() {
+				continue
+			}
+			m[name] = configValue(fv, effective)
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return []interface{}{}
+		}
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = configValue(v.Index(i), effective)
+		}
+		return s
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key().Interface())] = configValue(iter.Value(), effective)
+		}
+		return m
+	default:
+		if d, ok := v.Interface().(time.Duration); ok {
+			return d.String()
+		}
+		return v.Interface()
+	}
+}
+
+// configDefault returns the value of the getter of the field name of the
+// struct v, if it has one taking no arguments.
+func configDefault(v reflect.Value, name string) (reflect.Value, bool) {
+	getter, ok := defaultGetters[name]
+	if !ok {
+		getter = "Get" + name
+	}
+	m := v.MethodByName(getter)
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return reflect.Value{}, false
+	}
+
+	return m.Call(nil)[0], true
+}
+
+// getConfig returns the effective configuration, with secrets redacted.
+func (s *server) getConfig(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, renderConfig(s.config, true))
+}
+
+// runConfigCommand implements "ca-signer config print". It prints the
+// configuration as loaded, or with --effective with the defaults applied,
+// in YAML with secrets redacted. "ca-signer config sign" signs a config
+// file.
+func runConfigCommand(args []string) int {
+	if len(args) > 0 && args[0] == "sign" {
+		return runConfigSignCommand(args[1:])
+	}
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: ca-signer config print [--config <file>] [--effective]")
+		fmt.Fprintln(os.Stderr, "       ca-signer config sign --config <file> --key <private key> [--out <file>]")
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "path to the signer configuration")
+	effective := fs.Bool("effective", false, "apply the defaults")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+		return exitUsage
+	}
+
+	out, err := yaml.Marshal(renderConfig(config, *effective))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error rendering config: %v\n", err)
+		return 1
+	}
+	fmt.Print(string(out))
+
+	return 0
+}
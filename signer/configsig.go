@@ -0,0 +1,189 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Environment variables of the config signature verification. They are
+// not config fields, so a writable config file cannot disable the
+// verification.
+const (
+	configKeyEnv       = envPrefix + "CONFIG_KEY"
+	configSignatureEnv = envPrefix + "CONFIG_SIGNATURE"
+)
+
+// configSignatureFile returns the signature of a config file, from
+// CA_SIGNER_CONFIG_SIGNATURE or next to it with a .sig extension.
+func configSignatureFile(file string) string {
+	if sig := os.Getenv(configSignatureEnv); sig != "" {
+		return sig
+	}
+
+	return file + ".sig"
+}
+
+// verifyConfig checks the signature of the config file data if
+// CA_SIGNER_CONFIG_KEY is set. The signature is a detached signature in
+// base64, such as written by "ca-signer config sign" with an Ed25519 key or
+// "cosign sign-blob" with an ECDSA key.
+func verifyConfig(file string, data []byte) error {
+	keyFile := os.Getenv(configKeyEnv)
+	if keyFile == "" {
+		return nil
+	}
+	if file == "" {
+		return errors.Errorf("%s is set, a signed config file is required", configKeyEnv)
+	}
+	pub, err := readVerificationKey(keyFile)
+	if err != nil {
+		return err
+	}
+	sigFile := configSignatureFile(file)
+	b64, err := os.ReadFile(sigFile)
+	if err != nil {
+		return errors.Wrap(err, "error reading config signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b64)))
+	if err != nil {
+		return errors.Wrapf(err, "invalid config signature %s", sigFile)
+	}
+	if !verifySignature(pub, data, sig) {
+		return errors.Errorf("config signature %s does not match %s", sigFile, file)
+	}
+
+	return nil
+}
+
+// readVerificationKey reads an Ed25519 or ECDSA public key in PEM.
+func readVerificationKey(file string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading config key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.Errorf("no public key found in %s", file)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid config key %s", file)
+	}
+	switch pub.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return pub, nil
+	default:
+		return nil, errors.Errorf("unsupported config key %s, must be Ed25519 or ECDSA", file)
+	}
+}
+
+// verifySignature checks an Ed25519 signature of data, or an ECDSA
+// signature of its SHA-256 digest.
+func verifySignature(pub crypto.PublicKey, data, sig []byte) bool {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, digest[:], sig)
+	default:
+		return false
+	}
+}
+
+// signData signs data like verifySignature verifies it.
+func signData(key crypto.Signer, data []byte) ([]byte, error) {
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, errors.New("unsupported key, must be Ed25519 or ECDSA")
+	}
+}
+
+// readSigningKey reads an unencrypted Ed25519 or ECDSA private key in PEM.
+func readSigningKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("no private key found in %s", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, errors.Errorf("unsupported private key %s of type %s", file, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key %s", file)
+	}
+
+	return signer, nil
+}
+
+// runConfigSignCommand implements "ca-signer config sign". It writes the
+// signature of a config file verified with CA_SIGNER_CONFIG_KEY.
+func runConfigSignCommand(args []string) int {
+	fs := flag.NewFlagSet("config sign", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "path to the signer configuration")
+	keyFile := fs.String("key", "", "Ed25519 or ECDSA private key in PEM")
+	out := fs.String("out", "", "signature file, defaults to the config file with a .sig extension")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *configFile == "" || *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "usage: ca-signer config sign --config <file> --key <private key> [--out <file>]")
+		return exitUsage
+	}
+	if *out == "" {
+		*out = *configFile + ".sig"
+	}
+
+	key, err := readSigningKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading key: %v\n", err)
+		return exitUsage
+	}
+	data, err := os.ReadFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading config: %v\n", err)
+		return exitUsage
+	}
+	sig, err := signData(key, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error signing config: %v\n", err)
+		return exitError
+	}
+	if err := os.WriteFile(*out, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing signature: %v\n", err)
+		return exitError
+	}
+	fmt.Printf("The signature has been saved in %s.\n", *out)
+
+	return 0
+}
@@ -0,0 +1,133 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestKeys writes the private and public keys of key in PEM to dir,
+// and returns their paths.
+func writeTestKeys(t *testing.T, dir, name string, key crypto.Signer) (string, string) {
+	t.Helper()
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privFile, pubFile := filepath.Join(dir, name+".key"), filepath.Join(dir, name+".pub")
+	if err := writeFile(privFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(pubFile, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))); err != nil {
+		t.Fatal(err)
+	}
+
+	return privFile, pubFile
+}
+
+func TestConfigSignature(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.yaml")
+	data := "caURL: https://ca:9000\n"
+	if err := writeFile(config, data); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"ed25519": edKey, "ecdsa": ecKey} {
+		privFile, pubFile := writeTestKeys(t, dir, name, key)
+		t.Setenv(configKeyEnv, pubFile)
+		t.Setenv(configSignatureEnv, "")
+		if code := runConfigSignCommand([]string{"--config", config, "--key", privFile}); code != 0 {
+			t.Fatalf("%s: config sign = %d", name, code)
+		}
+		if err := verifyConfig(config, []byte(data)); err != nil {
+			t.Errorf("%s: verifyConfig() = %v", name, err)
+		}
+		if err := verifyConfig(config, []byte(data+"admin: {}\n")); err == nil {
+			t.Errorf("%s: verifyConfig() of a modified config error = nil", name)
+		}
+
+		sig := filepath.Join(dir, name+".sig")
+		if code := runConfigSignCommand([]string{"--config", config, "--key", privFile, "--out", sig}); code != 0 {
+			t.Fatalf("%s: config sign --out = %d", name, code)
+		}
+		t.Setenv(configSignatureEnv, sig)
+		if got := configSignatureFile(config); got != sig {
+			t.Errorf("%s: configSignatureFile() = %s, want %s", name, got, sig)
+		}
+		if err := verifyConfig(config, []byte(data)); err != nil {
+			t.Errorf("%s: verifyConfig() with %s = %v", name, configSignatureEnv, err)
+		}
+	}
+
+	t.Setenv(configSignatureEnv, filepath.Join(dir, "missing.sig"))
+	if err := verifyConfig(config, []byte(data)); err == nil {
+		t.Error("verifyConfig() without a signature error = nil")
+	}
+	if err := verifyConfig("", nil); err == nil {
+		t.Error("verifyConfig() without a config file error = nil")
+	}
+	t.Setenv(configKeyEnv, "")
+	if err := verifyConfig("", nil); err != nil {
+		t.Errorf("verifyConfig() without %s = %v", configKeyEnv, err)
+	}
+}
+
+func TestReadConfigKeys(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privFile, pubFile := writeTestKeys(t, dir, "rsa", rsaKey)
+	if _, err := readVerificationKey(pubFile); err == nil {
+		t.Error("readVerificationKey() of an RSA key error = nil")
+	}
+	if _, err := readVerificationKey(privFile); err == nil {
+		t.Error("readVerificationKey() of a private key error = nil")
+	}
+	if _, err := signData(rsaKey, []byte("data")); err == nil {
+		t.Error("signData() with an RSA key error = nil")
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecFile := filepath.Join(dir, "ec.key")
+	if err := writeFile(ecFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := readSigningKey(ecFile); err != nil || !ecKey.Equal(key) {
+		t.Errorf("readSigningKey() of an EC private key = %v, %v", key, err)
+	}
+	if _, err := readSigningKey(pubFile); err == nil {
+		t.Error("readSigningKey() of a public key error = nil")
+	}
+	if code := runConfigSignCommand([]string{"--key", ecFile}); code != exitUsage {
+		t.Errorf("config sign without a config = %d, want %d", code, exitUsage)
+	}
+}
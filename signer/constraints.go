@@ -0,0 +1,162 @@
+package signer
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// NameConstraints mirrors the nameConstraints object of the step X.509
+// templates. The constraints are always marked as critical.
+type NameConstraints struct {
+	PermittedDNSDomains     []string `yaml:"permittedDNSDomains" json:"permittedDNSDomains,omitempty"`
+	ExcludedDNSDomains      []string `yaml:"excludedDNSDomains" json:"excludedDNSDomains,omitempty"`
+	PermittedIPRanges       []string `yaml:"permittedIPRanges" json:"permittedIPRanges,omitempty"`
+	ExcludedIPRanges        []string `yaml:"excludedIPRanges" json:"excludedIPRanges,omitempty"`
+	PermittedEmailAddresses []string `yaml:"permittedEmailAddresses" json:"permittedEmailAddresses,omitempty"`
+	ExcludedEmailAddresses  []string `yaml:"excludedEmailAddresses" json:"excludedEmailAddresses,omitempty"`
+	PermittedURIDomains     []string `yaml:"permittedURIDomains" json:"permittedURIDomains,omitempty"`
+	ExcludedURIDomains      []string `yaml:"excludedURIDomains" json:"excludedURIDomains,omitempty"`
+}
+
+// Delegation grants a set of clients the right to request intermediates
+// restricted to their own namespace.
+type Delegation struct {
+	Clients         []string        `yaml:"clients"`
+	MaxPathLen      int             `yaml:"maxPathLen"`
+	NameConstraints NameConstraints `yaml:"nameConstraints"`
+}
+
+// IsEmpty returns true if no constraint is set.
+func (n NameConstraints) IsEmpty() bool {
+	return len(n.PermittedDNSDomains) == 0 && len(n.ExcludedDNSDomains) == 0 &&
+		len(n.PermittedIPRanges) == 0 && len(n.ExcludedIPRanges) == 0 &&
+		len(n.PermittedEmailAddresses) == 0 && len(n.ExcludedEmailAddresses) == 0 &&
+		len(n.PermittedURIDomains) == 0 && len(n.ExcludedURIDomains) == 0
+}
+
+// Validate checks that the IP ranges are valid CIDRs.
+func (n NameConstraints) Validate() error {
+	for _, r := range append(append([]string{}, n.PermittedIPRanges...), n.ExcludedIPRanges...) {
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			return errors.Wrapf(err, "invalid name constraint IP range %q", r)
+		}
+	}
+
+	return nil
+}
+
+// templateData returns the nameConstraints value passed to the upstream
+// provisioner template.
+func (n NameConstraints) templateData() map[string]interface{} {
+	return map[string]interface{}{
+		"critical":                true,
+		"permittedDNSDomains":     n.PermittedDNSDomains,
+		"excludedDNSDomains":      n.ExcludedDNSDomains,
+		"permittedIPRanges":       n.PermittedIPRanges,
+		"excludedIPRanges":        n.ExcludedIPRanges,
+		"permittedEmailAddresses": n.PermittedEmailAddresses,
+		"excludedEmailAddresses":  n.ExcludedEmailAddresses,
+		"permittedURIDomains":     n.PermittedURIDomains,
+		"excludedURIDomains":      n.ExcludedURIDomains,
+	}
+}
+
+// Verify checks that cert carries exactly the constraints in n. It is used
+// to make sure the upstream template honored the requested constraints.
+func (n NameConstraints) Verify(cert *x509.Certificate) error {
+	if n.IsEmpty() {
+		return nil
+	}
+	if !cert.PermittedDNSDomainsCritical {
+		return errors.New("name constraints are not marked as critical")
+	}
+
+	checks := []struct {
+		name      string
+		want, got []string
+	}{
+		{"permittedDNSDomains", n.PermittedDNSDomains, cert.PermittedDNSDomains},
+		{"excludedDNSDomains", n.ExcludedDNSDomains, cert.ExcludedDNSDomains},
+		{"permittedIPRanges", normalizeCIDRs(n.PermittedIPRanges), ipNetStrings(cert.PermittedIPRanges)},
+		{"excludedIPRanges", normalizeCIDRs(n.ExcludedIPRanges), ipNetStrings(cert.ExcludedIPRanges)},
+		{"permittedEmailAddresses", n.PermittedEmailAddresses, cert.PermittedEmailAddresses},
+		{"excludedEmailAddresses", n.ExcludedEmailAddresses, cert.ExcludedEmailAddresses},
+		{"permittedURIDomains", n.PermittedURIDomains, cert.PermittedURIDomains},
+		{"excludedURIDomains", n.ExcludedURIDomains, cert.ExcludedURIDomains},
+	}
+	for _, c := range checks {
+		if !sameStrings(c.want, c.got) {
+			return errors.Errorf("issued certificate %s %v do not match the requested %v", c.name, c.got, c.want)
+		}
+	}
+
+	return nil
+}
+
+// verifyCAGrant checks that cert is a CA certificate with the path length
+// and, if any, the name constraints of the grant, so an upstream template
+// ignoring the template data cannot hand out an unconstrained CA.
+func verifyCAGrant(cert *x509.Certificate, maxPathLen int, nc NameConstraints) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return errors.New("issued certificate is not a CA certificate")
+	}
+	if cert.MaxPathLen != maxPathLen || (maxPathLen == 0 && !cert.MaxPathLenZero) {
+		return errors.Errorf("issued certificate path length %d does not match the granted %d", cert.MaxPathLen, maxPathLen)
+	}
+
+	return nc.Verify(cert)
+}
+
+// delegationFor returns the delegation matching the client in r, or nil if
+// the client has no specific delegation.
+func (c IntermediateConfig) delegationFor(r *http.Request) *Delegation {
+	for i := range c.Delegations {
+		if clientAllowed(r, c.Delegations[i].Clients) {
+			return &c.Delegations[i]
+		}
+	}
+
+	return nil
+}
+
+func ipNetStrings(nets []*net.IPNet) []string {
+	s := make([]string, len(nets))
+	for i, n := range nets {
+		s[i] = n.String()
+	}
+	return s
+}
+
+// normalizeCIDRs returns the canonical form of the given ranges, ignoring the
+// invalid ones.
+func normalizeCIDRs(ranges []string) []string {
+	var s []string
+	for _, r := range ranges {
+		if _, n, err := net.ParseCIDR(r); err == nil {
+			s = append(s, n.String())
+		}
+	}
+	return s
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,127 @@
+package signer
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newConstrainedCA returns a CA certificate with the name constraints set
+// by tmpl, signed by a test CA.
+func newConstrainedCA(t *testing.T, tmpl *x509.Certificate) *x509.Certificate {
+	t.Helper()
+	ca, key := newTestCert(t, "Test CA")
+	tmpl.SerialNumber = big.NewInt(2)
+	tmpl.NotBefore, tmpl.NotAfter = time.Now(), time.Now().Add(time.Hour)
+	tmpl.BasicConstraintsValid, tmpl.IsCA = true, true
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestNameConstraintsVerify(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.1.0.0/16")
+	cert := newConstrainedCA(t, &x509.Certificate{
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{".team.example.com", "team.example.com"},
+		PermittedIPRanges:           []*net.IPNet{ipNet},
+	})
+
+	tests := []struct {
+		name string
+		nc   NameConstraints
+		ok   bool
+	}{
+		{"empty", NameConstraints{}, true},
+		{"same", NameConstraints{PermittedDNSDomains: []string{"team.example.com", ".team.example.com"}, PermittedIPRanges: []string{"10.1.2.3/16"}}, true},
+		{"missing domain", NameConstraints{PermittedDNSDomains: []string{".team.example.com"}, PermittedIPRanges: []string{"10.1.0.0/16"}}, false},
+		{"missing range", NameConstraints{PermittedDNSDomains: []string{"team.example.com", ".team.example.com"}}, false},
+		{"excluded", NameConstraints{PermittedDNSDomains: []string{"team.example.com", ".team.example.com"}, PermittedIPRanges: []string{"10.1.0.0/16"}, ExcludedDNSDomains: []string{"prod.team.example.com"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.nc.Verify(cert); (err == nil) != tt.ok {
+			t.Errorf("%s: Verify() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	notCritical := newConstrainedCA(t, &x509.Certificate{PermittedDNSDomains: []string{".team.example.com"}})
+	if err := (NameConstraints{PermittedDNSDomains: []string{".team.example.com"}}).Verify(notCritical); err == nil {
+		t.Error("Verify() of constraints that are not critical error = nil")
+	}
+}
+
+func TestNameConstraintsValidate(t *testing.T) {
+	if err := (NameConstraints{PermittedIPRanges: []string{"10.0.0.0/8"}, ExcludedIPRanges: []string{"fd00::/8"}}).Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	if err := (NameConstraints{ExcludedIPRanges: []string{"10.0.0.1"}}).Validate(); err == nil {
+		t.Error("Validate() of an IP without a prefix length error = nil")
+	}
+	c := IntermediateConfig{Delegations: []Delegation{{Clients: []string{"team-ca"}, NameConstraints: NameConstraints{PermittedIPRanges: []string{"invalid"}}}}}
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() of an invalid delegation error = nil")
+	}
+	for _, d := range []string{"0s", "-1h", "1 day"} {
+		if err := (IntermediateConfig{MaxDuration: d}).Validate(); err == nil {
+			t.Errorf("Validate() of maxDuration %q error = nil", d)
+		}
+	}
+}
+
+func TestIntermediateMaxDuration(t *testing.T) {
+	tests := []struct {
+		maxDuration string
+		want        time.Duration
+	}{
+		{"", 24 * time.Hour},
+		{"72h", 72 * time.Hour},
+		{"0s", 24 * time.Hour},
+		{"-1h", 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := (IntermediateConfig{MaxDuration: tt.maxDuration}).GetMaxDuration(); got != tt.want {
+			t.Errorf("%q: GetMaxDuration() = %s, want %s", tt.maxDuration, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyCAGrant(t *testing.T) {
+	team := NameConstraints{PermittedDNSDomains: []string{".team.example.com"}}
+	tests := []struct {
+		name       string
+		tmpl       *x509.Certificate
+		maxPathLen int
+		nc         NameConstraints
+		ok         bool
+	}{
+		{"path length 0", &x509.Certificate{MaxPathLenZero: true}, 0, NameConstraints{}, true},
+		{"path length 1", &x509.Certificate{MaxPathLen: 1}, 1, NameConstraints{}, true},
+		{"constraints", &x509.Certificate{MaxPathLenZero: true, PermittedDNSDomainsCritical: true, PermittedDNSDomains: []string{".team.example.com"}}, 0, team, true},
+		{"no path length", &x509.Certificate{MaxPathLen: -1}, 0, NameConstraints{}, false},
+		{"longer path", &x509.Certificate{MaxPathLen: 2}, 1, NameConstraints{}, false},
+		{"no constraints", &x509.Certificate{MaxPathLenZero: true}, 0, team, false},
+	}
+	for _, tt := range tests {
+		cert := newConstrainedCA(t, tt.tmpl)
+		if err := verifyCAGrant(cert, tt.maxPathLen, tt.nc); (err == nil) != tt.ok {
+			t.Errorf("%s: verifyCAGrant() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	ca, key := newTestCert(t, "Test CA")
+	leaf, _ := issueTestCert(t, ca, key, "www.example.com", false)
+	if err := verifyCAGrant(leaf, 0, NameConstraints{}); err == nil {
+		t.Error("verifyCAGrant() of a leaf certificate error = nil")
+	}
+}
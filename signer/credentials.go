@@ -0,0 +1,173 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/certificates/errs"
+)
+
+// Upstream provisioners, also the names used by the monitor.
+const (
+	upstreamDefault      = "default"
+	upstreamIntermediate = "intermediate"
+	upstreamCanary       = "canary"
+	upstreamSecondary    = "secondary"
+)
+
+// minRefreshInterval limits how often the credentials of a provisioner are
+// refreshed, so a CA rejecting every token is not flooded.
+const minRefreshInterval = 30 * time.Second
+
+// upstream returns the current provisioner of an upstream, nil if it is not
+// configured.
+func (s *server) upstream(name string) *ca.Provisioner {
+	s.upstreamMu.RLock()
+	defer s.upstreamMu.RUnlock()
+
+	switch name {
+	case upstreamIntermediate:
+		return s.intermediate
+	case upstreamCanary:
+		return s.canary
+	case upstreamSecondary:
+		return s.secondary
+	default:
+		return s.provisioner
+	}
+}
+
+// upstreamSource returns the CA URL and password file of an upstream.
+func (s *server) upstreamSource(name string) (caURL, passwordFile string) {
+	caURL, passwordFile = s.config.CaURL, s.config.GetProvisionerPasswordPath()
+	switch name {
+	case upstreamIntermediate:
+		if f := s.config.Intermediate.ProvisionerPasswordFile; f != "" {
+			passwordFile = f
+		}
+	case upstreamCanary:
+		if u := s.config.Canary.CaURL; u != "" {
+			caURL = u
+		}
+		if f := s.config.Canary.ProvisionerPasswordFile; f != "" {
+			passwordFile = f
+		}
+	case upstreamSecondary:
+		caURL = s.config.DualIssuance.CaURL
+		if f := s.config.DualIssuance.ProvisionerPasswordFile; f != "" {
+			passwordFile = f
+		}
+	}
+
+	return caURL, passwordFile
+}
+
+// issueWith signs the request with the provisioner of an upstream. If the CA
+// rejects the token with 401 Unauthorized, e.g. after a provisioner key
+// rotation, the credentials are refreshed and the request retried once. The
+// allowed extensions and passed through template data of the request are
+// added to the template data, and the certificate must not carry the
+// stripped extensions.
+func (s *server) issueWith(ctx context.Context, name string, request *SignRequest, templateData json.RawMessage) (*api.SignResponse, error) {
+	templateData, err := withExtensions(templateData, request)
+	if err == nil {
+		templateData, err = withPassthrough(templateData, request)
+	}
+	if err != nil {
+		return nil, errs.InternalServerErr(err)
+	}
+
+	p := s.upstream(name)
+	start := time.Now()
+	resp, err := issue(ctx, p, request, templateData)
+	if isUnauthorized(err) {
+		if np, rerr := s.refreshProvisioner(name, p); rerr == nil && np != p {
+			start = time.Now()
+			resp, err = issue(ctx, np, request, templateData)
+		}
+	}
+	s.observeUpstream(start, err)
+	if err != nil {
+		return resp, err
+	}
+
+	if err := verifyExtensions(request, resp.ServerPEM.Certificate); err != nil {
+		return nil, errs.Wrap(http.StatusBadGateway, err, "upstream CA did not strip the requested extensions")
+	}
+	if err := s.validateResponse(name, resp); err != nil {
+		return nil, err
+	}
+	if s.ct != nil && s.ct.mode == "sync" && !resp.ServerPEM.Certificate.IsCA {
+		request.scts = s.ct.submit(ctx, resp.ServerPEM.Certificate.SerialNumber.String(), responseChain(resp))
+	}
+	return resp, nil
+}
+
+func isUnauthorized(err error) bool {
+	var sc render.StatusCodedError
+	return errors.As(err, &sc) && sc.StatusCode() == http.StatusUnauthorized
+}
+
+// refreshProvisioner reloads the password file of an upstream and resolves
+// its provisioner again by name, using the first key that decrypts with the
+// password. It returns the current provisioner if stale was already
+// replaced or was refreshed less than minRefreshInterval ago.
+func (s *server) refreshProvisioner(name string, stale *ca.Provisioner) (*ca.Provisioner, error) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	if p := s.upstream(name); p != stale {
+		return p, nil
+	}
+	if time.Since(s.refreshed[name]) < minRefreshInterval {
+		return stale, nil
+	}
+	if s.refreshed == nil {
+		s.refreshed = map[string]time.Time{}
+	}
+	s.refreshed[name] = time.Now()
+
+	logger := logFor("credentials").WithFields(log.Fields{
+		"upstream":    name,
+		"provisioner": stale.Name(),
+		"kid":         stale.Kid(),
+	})
+	caURL, passwordFile := s.upstreamSource(name)
+	p, err := func() (*ca.Provisioner, error) {
+		password, err := readPasswordFromFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		rootOption, err := upstreamRootOption(s.config)
+		if err != nil {
+			return nil, err
+		}
+		return newProvisioner(stale.Name(), "", caURL, password, rootOption)
+	}()
+	if err != nil {
+		provisionerRefreshes.WithLabelValues(name, "error").Inc()
+		logger.WithField("error", err).Error("Error refreshing provisioner credentials")
+		return nil, err
+	}
+
+	// Upstreams sharing the stale provisioner, e.g. an intermediate
+	// provisioner defaulting to the main one, are refreshed together.
+	s.upstreamMu.Lock()
+	for _, field := range []**ca.Provisioner{&s.provisioner, &s.intermediate, &s.canary, &s.secondary} {
+		if *field == stale {
+			*field = p
+		}
+	}
+	s.upstreamMu.Unlock()
+
+	provisionerRefreshes.WithLabelValues(name, "ok").Inc()
+	logger.WithField("newKid", p.Kid()).Warn("Refreshed provisioner credentials")
+	return p, nil
+}
@@ -0,0 +1,80 @@
+package signer
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpstreamSource(t *testing.T) {
+	s := &server{config: &Config{
+		CaURL:                   "https://ca",
+		ProvisionerPasswordFile: "/run/password",
+		Intermediate:            IntermediateConfig{ProvisionerPasswordFile: "/run/intermediate"},
+		Canary:                  CanaryConfig{CaURL: "https://canary"},
+		DualIssuance:            DualIssuanceConfig{CaURL: "https://secondary", ProvisionerPasswordFile: "/run/secondary"},
+	}}
+	tests := []struct {
+		name, caURL, passwordFile string
+	}{
+		{upstreamDefault, "https://ca", "/run/password"},
+		{upstreamIntermediate, "https://ca", "/run/intermediate"},
+		{upstreamCanary, "https://canary", "/run/password"},
+		{upstreamSecondary, "https://secondary", "/run/secondary"},
+	}
+	for _, tt := range tests {
+		caURL, passwordFile := s.upstreamSource(tt.name)
+		if caURL != tt.caURL || passwordFile != tt.passwordFile {
+			t.Errorf("upstreamSource(%s) = %s, %s, want %s, %s", tt.name, caURL, passwordFile, tt.caURL, tt.passwordFile)
+		}
+	}
+}
+
+func TestRefreshProvisioner(t *testing.T) {
+	up := newTestUpstream(t)
+	dir := t.TempDir()
+	config := &Config{
+		CaURL:                   up.URL,
+		RootCAPath:              filepath.Join(dir, "root.crt"),
+		ProvisionerPasswordFile: filepath.Join(dir, "password"),
+	}
+	if err := writeFile(config.RootCAPath, certPEM(up.root)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(config.ProvisionerPasswordFile, "wrong\n"); err != nil {
+		t.Fatal(err)
+	}
+	stale := up.provisioner
+	s := &server{config: config, provisioner: stale, intermediate: stale}
+
+	failed := testutil.ToFloat64(provisionerRefreshes.WithLabelValues(upstreamDefault, "error"))
+	if _, err := s.refreshProvisioner(upstreamDefault, stale); err == nil {
+		t.Fatal("refreshProvisioner() with the wrong password succeeded")
+	}
+	if got := testutil.ToFloat64(provisionerRefreshes.WithLabelValues(upstreamDefault, "error")) - failed; got != 1 {
+		t.Errorf("failed refreshes = %v, want 1", got)
+	}
+	if p, err := s.refreshProvisioner(upstreamDefault, stale); p != stale || err != nil {
+		t.Errorf("refreshProvisioner() right after a refresh = %v, %v, want the stale provisioner", p, err)
+	}
+
+	// The password file was updated, as by a secret rotation.
+	if err := writeFile(config.ProvisionerPasswordFile, testProvisionerPassword+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	s.refreshed = nil
+	p, err := s.refreshProvisioner(upstreamDefault, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == stale || p.Kid() != stale.Kid() {
+		t.Errorf("refreshProvisioner() = %v, want a new provisioner with kid %s", p, stale.Kid())
+	}
+	if s.upstream(upstreamDefault) != p || s.upstream(upstreamIntermediate) != p {
+		t.Error("the upstreams sharing the stale provisioner were not refreshed")
+	}
+	if got, _ := s.refreshProvisioner(upstreamIntermediate, stale); got != p {
+		t.Error("refreshProvisioner() of an already refreshed upstream did not return the current provisioner")
+	}
+}
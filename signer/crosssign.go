@@ -0,0 +1,209 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// CrossSignConfig allows the admin clients to cross-sign the intermediates
+// of other hierarchies with the intermediate provisioner, e.g. to bridge the
+// trust of an old and a new root during a migration. Only the subjects
+// matching the Subjects patterns are cross-signed. The path length of the
+// cross-signed certificate is capped by MaxPathLen.
+type CrossSignConfig struct {
+	Subjects    []string `yaml:"subjects"`
+	MaxPathLen  int      `yaml:"maxPathLen"`
+	MaxDuration string   `yaml:"maxDuration"`
+}
+
+// Enabled returns true if subjects can be cross-signed.
+func (c CrossSignConfig) Enabled() bool {
+	return len(c.Subjects) > 0
+}
+
+// GetMaxDuration returns the maximum lifetime of a cross-signed certificate,
+// defaults to 720h.
+func (c CrossSignConfig) GetMaxDuration() time.Duration {
+	if d, err := time.ParseDuration(c.MaxDuration); err == nil {
+		return d
+	}
+
+	return 720 * time.Hour
+}
+
+// Validate checks the subject patterns and the path length.
+func (c CrossSignConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, p := range c.Subjects {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Wrapf(err, "invalid crossSign subjects pattern %q", p)
+		}
+	}
+	if c.MaxPathLen < 0 {
+		return errors.New("crossSign maxPathLen must not be negative")
+	}
+
+	return nil
+}
+
+// permits returns true if the subject can be cross-signed.
+func (c CrossSignConfig) permits(subject string) bool {
+	return slices.ContainsFunc(c.Subjects, func(p string) bool {
+		ok, _ := path.Match(p, subject)
+		return ok
+	})
+}
+
+// CrossSignRequest is the body of POST /admin/cross-sign. The CSR is signed
+// by the key of the intermediate to cross-sign; the optional certificate is
+// the intermediate in its own hierarchy, whose path length and name
+// constraints are kept in the cross-signed certificate.
+type CrossSignRequest struct {
+	CsrPEM      api.CertificateRequest `json:"csr"`
+	Certificate string                 `json:"certificate,omitempty"`
+	NotAfter    api.TimeDuration       `json:"notAfter"`
+	Metadata    map[string]string      `json:"metadata,omitempty"`
+}
+
+// crossSignGrant returns the path length and name constraints of the
+// cross-signed certificate: the ones of the existing certificate, if any,
+// with the path length capped by the configuration.
+func crossSignGrant(csr *x509.CertificateRequest, certPEM string, maxPathLen int) (int, NameConstraints, error) {
+	if certPEM == "" {
+		return maxPathLen, NameConstraints{}, nil
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return 0, NameConstraints{}, errs.BadRequest("invalid certificate: no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return 0, NameConstraints{}, errs.BadRequestErr(err, "invalid certificate: %s", err)
+	}
+	if !cert.IsCA {
+		return 0, NameConstraints{}, errs.BadRequest("certificate is not a CA certificate")
+	}
+	if !bytes.Equal(cert.RawSubject, csr.RawSubject) || !bytes.Equal(cert.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+		return 0, NameConstraints{}, errs.BadRequest("certificate subject and key do not match the csr")
+	}
+
+	pathLen := maxPathLen
+	if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+		pathLen = min(cert.MaxPathLen, maxPathLen)
+	}
+	nc := NameConstraints{
+		PermittedDNSDomains:     cert.PermittedDNSDomains,
+		ExcludedDNSDomains:      cert.ExcludedDNSDomains,
+		PermittedIPRanges:       ipNetStrings(cert.PermittedIPRanges),
+		ExcludedIPRanges:        ipNetStrings(cert.ExcludedIPRanges),
+		PermittedEmailAddresses: cert.PermittedEmailAddresses,
+		ExcludedEmailAddresses:  cert.ExcludedEmailAddresses,
+		PermittedURIDomains:     cert.PermittedURIDomains,
+		ExcludedURIDomains:      cert.ExcludedURIDomains,
+	}
+
+	return pathLen, nc, nil
+}
+
+// crossSign signs the intermediate of another hierarchy with the
+// intermediate provisioner. The cross-signed certificate must carry the
+// capped path length and the name constraints of the existing one, it is
+// revoked otherwise, and is audited as a high-sensitivity issuance.
+func (s *server) crossSign(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config.CrossSign
+	opts, err := parseBundleOptions(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	var body CrossSignRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSignRequestSize)).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+	request := &SignRequest{CsrPEM: body.CsrPEM, NotAfter: body.NotAfter, Metadata: body.Metadata}
+	if err := request.Validate(); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	csr := request.CsrPEM.CertificateRequest
+	subject := csr.Subject.CommonName
+	if subject == "" {
+		render.Error(w, r, errs.BadRequest("csr requires a subject common name"))
+		return
+	}
+
+	fields := log.Fields{
+		"requestId": requestID(r),
+		"client":    clientIdentities(r),
+		"subject":   subject,
+	}
+	if !cfg.permits(subject) {
+		crossSignatures.WithLabelValues("forbidden").Inc()
+		logFor("audit").WithFields(fields).Warn("Forbidden: subject not allowed to be cross-signed")
+		render.Error(w, r, errs.Forbidden("subject %q is not allowed to be cross-signed", subject))
+		return
+	}
+
+	maxPathLen, constraints, err := crossSignGrant(csr, body.Certificate, cfg.MaxPathLen)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	if err := limitNotAfter(request, cfg.GetMaxDuration()); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	data, err := json.Marshal(intermediateTemplateData(maxPathLen, constraints))
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.Timeouts.GetSign())
+	defer cancel()
+
+	resp, err := s.issueWith(ctx, upstreamIntermediate, request, data)
+	if err == nil {
+		if verr := verifyCAGrant(resp.ServerPEM.Certificate, maxPathLen, constraints); verr != nil {
+			s.revokeRejected(ctx, upstreamIntermediate, resp.ServerPEM.Certificate, "cross-signed certificate does not match the grant")
+			err = errs.Wrap(http.StatusBadGateway, verr, "upstream CA did not apply the path length and name constraints of the certificate")
+		}
+	}
+	fields["maxPathLen"] = maxPathLen
+	fields["nameConstraints"] = constraints
+	if err != nil {
+		crossSignatures.WithLabelValues("error").Inc()
+		fields["error"] = err
+		logFor("audit").WithFields(fields).Error("Error cross-signing certificate")
+		render.Error(w, r, err)
+		return
+	}
+
+	crossSignatures.WithLabelValues("issued").Inc()
+	fields["serial"] = resp.ServerPEM.Certificate.SerialNumber.String()
+	logFor("audit").WithFields(fields).Warn("Cross-signed certificate")
+	event := newHookEvent(r, s.generationFor(r), request)
+	event.Severity = sensitivityHigh
+	s.countQuota(event.Client, event.Time)
+	s.issued(event, resp)
+
+	s.writeSignResponse(w, r, resp, request.scts, nil, opts, http.StatusCreated)
+}
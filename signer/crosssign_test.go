@@ -0,0 +1,162 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+func TestCrossSignConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		c    CrossSignConfig
+		ok   bool
+	}{
+		{"disabled", CrossSignConfig{}, true},
+		{"valid", CrossSignConfig{Subjects: []string{"Legacy * CA"}, MaxPathLen: 1}, true},
+		{"pattern", CrossSignConfig{Subjects: []string{"Legacy [CA"}}, false},
+		{"path length", CrossSignConfig{Subjects: []string{"Legacy CA"}, MaxPathLen: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	c := CrossSignConfig{Subjects: []string{"Legacy * CA", "Partner CA"}}
+	if !c.permits("Legacy Issuing CA") || !c.permits("Partner CA") || c.permits("Legacy CA") || c.permits("Partner CA 2") {
+		t.Error("permits() does not match the subject patterns")
+	}
+	if d := c.GetMaxDuration(); d != 720*time.Hour {
+		t.Errorf("GetMaxDuration() = %v, want 720h", d)
+	}
+}
+
+// newCrossSignCSR returns a CSR for the intermediate cn, and its certificate
+// in another hierarchy, permitted to issue for domain.
+func newCrossSignCSR(t *testing.T, cn, domain string, maxPathLen int) (*x509.CertificateRequest, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, rootKey := newTestCert(t, "Legacy Root CA")
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
+	}
+	if domain != "" {
+		tmpl.PermittedDNSDomains = []string{domain}
+	}
+	der, err = x509.CreateCertificate(rand.Reader, tmpl, root, key.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return csr, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestCrossSignGrant(t *testing.T) {
+	csr, cert := newCrossSignCSR(t, "Legacy Issuing CA", ".legacy.example.com", 3)
+	pathLen, nc, err := crossSignGrant(csr, cert, 1)
+	if err != nil || pathLen != 1 || !sameStrings(nc.PermittedDNSDomains, []string{".legacy.example.com"}) {
+		t.Errorf("crossSignGrant() = %d, %+v, %v, want the constraints of the certificate and path length 1", pathLen, nc, err)
+	}
+	zero, zeroCert := newCrossSignCSR(t, "Legacy Issuing CA", "", 0)
+	if pathLen, _, err := crossSignGrant(zero, zeroCert, 1); err != nil || pathLen != 0 {
+		t.Errorf("crossSignGrant() of a path length 0 = %d, %v, want 0", pathLen, err)
+	}
+	if pathLen, nc, err := crossSignGrant(csr, "", 2); err != nil || pathLen != 2 || len(nc.PermittedDNSDomains) != 0 {
+		t.Errorf("crossSignGrant() without certificate = %d, %+v, %v", pathLen, nc, err)
+	}
+
+	leaf, leafKey := newTestCert(t, "Legacy Issuing CA")
+	server, _ := issueTestCert(t, leaf, leafKey, "www.example.com", false)
+	for name, certPEM := range map[string]string{
+		"not PEM":     "certificate",
+		"not a CA":    certPEM(server),
+		"other key":   certPEM(leaf),
+		"other CSR":   zeroCert,
+		"not a chain": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")})),
+	} {
+		if _, _, err := crossSignGrant(csr, certPEM, 1); errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("%s: crossSignGrant() = %v, want a bad request", name, err)
+		}
+	}
+}
+
+func TestCrossSign(t *testing.T) {
+	honoring := newTestUpstreamWithOptions(t, &provisioner.Options{X509: &provisioner.X509Options{Template: testCATemplate}})
+	ignoring := newTestUpstream(t)
+	csr := func(cn string) string { return mustJSON(t, newTestCSR(t, cn)) }
+	_, constrained := newCrossSignCSR(t, "Legacy Issuing CA", ".legacy.example.com", 0)
+	issued := crossSignatures.WithLabelValues("issued")
+	forbidden := crossSignatures.WithLabelValues("forbidden")
+	before, beforeForbidden := testutil.ToFloat64(issued), testutil.ToFloat64(forbidden)
+
+	tests := []struct {
+		name     string
+		upstream *testUpstream
+		body     string
+		status   int
+	}{
+		{"issued", honoring, `{"csr":` + csr("Legacy Issuing CA") + `,"notAfter":"1h"}`, http.StatusCreated},
+		{"path length ignored", ignoring, `{"csr":` + csr("Legacy Issuing CA") + `,"notAfter":"1h"}`, http.StatusBadGateway},
+		{"subject", honoring, `{"csr":` + csr("Other CA") + `}`, http.StatusForbidden},
+		{"no subject", honoring, `{"csr":` + mustJSON(t, newTestCSR(t)) + `}`, http.StatusBadRequest},
+		{"certificate mismatch", honoring, `{"csr":` + csr("Legacy Issuing CA") + `,"certificate":` + mustJSON(t, constrained) + `}`, http.StatusBadRequest},
+		{"too long", honoring, `{"csr":` + csr("Legacy Issuing CA") + `,"notAfter":"2000h"}`, http.StatusBadRequest},
+		{"malformed", honoring, `{"csr":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		s := &server{
+			config:       &Config{CrossSign: CrossSignConfig{Subjects: []string{"Legacy * CA"}, MaxPathLen: 1}},
+			hooks:        newHookRunner(nil),
+			intermediate: tt.upstream.provisioner,
+			trustedRoots: []*x509.Certificate{tt.upstream.root},
+		}
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/admin/cross-sign", strings.NewReader(tt.body)), "admin")
+		w := httptest.NewRecorder()
+		s.crossSign(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+	if got := testutil.ToFloat64(issued) - before; got != 1 {
+		t.Errorf("cross-signatures counted = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(forbidden) - beforeForbidden; got != 1 {
+		t.Errorf("forbidden cross-signatures counted = %v, want 1", got)
+	}
+	if got := len(ignoring.revocations()); got != 1 {
+		t.Errorf("rejected cross-signatures revoked = %d, want 1", got)
+	}
+}
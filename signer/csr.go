@@ -0,0 +1,175 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/errs"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// Limits of the CSRs accepted by the signer. They are checked before and
+// after parsing so crafted CSRs are rejected without allocating much.
+const (
+	maxCSRSize          = 16 << 10
+	maxSignRequestSize  = 64 << 10
+	maxCSRAttributes    = 8
+	maxCSRExtensions    = 32
+	maxCSRNames         = 100
+	maxCSRSubjectLength = 64
+)
+
+var oidExtensionRequest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 14}
+
+// parseCSR parses a CSR in DER or PEM. The DER structure is walked first to
+// reject oversized inputs, trailing data and too many attributes or
+// extensions, then the parsed request is checked against the limits.
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	if len(data) > maxCSRSize {
+		return nil, errs.BadRequest("csr exceeds %d bytes", maxCSRSize)
+	}
+
+	der := data
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		block, rest := pem.Decode(data)
+		if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+			return nil, errs.BadRequest("invalid csr: expected a CERTIFICATE REQUEST PEM block")
+		}
+		if len(bytes.TrimSpace(rest)) != 0 {
+			return nil, errs.BadRequest("invalid csr: unexpected data after the PEM block")
+		}
+		der = block.Bytes
+	}
+
+	if err := precheckCSR(der); err != nil {
+		return nil, errs.BadRequestErr(err, "invalid csr: %s", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, errs.BadRequestErr(err, "invalid csr")
+	}
+	if err := checkCSRLimits(csr); err != nil {
+		return nil, errs.BadRequestErr(err, "invalid csr: %s", err)
+	}
+
+	return csr, nil
+}
+
+// precheckCSR walks the outer structure of a DER CSR, counting attributes
+// and requested extensions, without parsing their contents.
+func precheckCSR(der []byte) error {
+	input := cryptobyte.String(der)
+	var csr, info cryptobyte.String
+	if !input.ReadASN1(&csr, cbasn1.SEQUENCE) || !input.Empty() {
+		return errors.New("malformed or trailing data")
+	}
+	if !csr.ReadASN1(&info, cbasn1.SEQUENCE) {
+		return errors.New("malformed certification request info")
+	}
+
+	var version int64
+	var subject, spki cryptobyte.String
+	if !info.ReadASN1Integer(&version) ||
+		!info.ReadASN1(&subject, cbasn1.SEQUENCE) ||
+		!info.ReadASN1(&spki, cbasn1.SEQUENCE) {
+		return errors.New("malformed certification request info")
+	}
+
+	var attributes cryptobyte.String
+	if !info.ReadOptionalASN1(&attributes, nil, cbasn1.Tag(0).Constructed().ContextSpecific()) {
+		return errors.New("malformed attributes")
+	}
+	for n := 0; !attributes.Empty(); n++ {
+		if n == maxCSRAttributes {
+			return errors.Errorf("more than %d attributes", maxCSRAttributes)
+		}
+		var attr, values cryptobyte.String
+		var oid asn1.ObjectIdentifier
+		if !attributes.ReadASN1(&attr, cbasn1.SEQUENCE) ||
+			!attr.ReadASN1ObjectIdentifier(&oid) ||
+			!attr.ReadASN1(&values, cbasn1.SET) {
+			return errors.New("malformed attribute")
+		}
+		if !oid.Equal(oidExtensionRequest) {
+			continue
+		}
+		var exts cryptobyte.String
+		if !values.ReadASN1(&exts, cbasn1.SEQUENCE) {
+			return errors.New("malformed extension request")
+		}
+		for m := 0; !exts.Empty(); m++ {
+			if m == maxCSRExtensions {
+				return errors.Errorf("more than %d extensions", maxCSRExtensions)
+			}
+			if !exts.SkipASN1(cbasn1.SEQUENCE) {
+				return errors.New("malformed extension")
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkCSRLimits checks the number of names and the subject of a parsed CSR.
+func checkCSRLimits(csr *x509.CertificateRequest) error {
+	if len(csr.Extensions) > maxCSRExtensions {
+		return errors.Errorf("csr has more than %d extensions", maxCSRExtensions)
+	}
+	names := len(csr.DNSNames) + len(csr.EmailAddresses) + len(csr.IPAddresses) + len(csr.URIs)
+	if names > maxCSRNames {
+		return errors.Errorf("csr has more than %d subject alternative names", maxCSRNames)
+	}
+	if len(csr.Subject.CommonName) > maxCSRSubjectLength {
+		return errors.Errorf("csr common name exceeds %d characters", maxCSRSubjectLength)
+	}
+
+	return nil
+}
+
+// decodeRawSignRequest reads a CSR in DER (application/pkcs10) or PEM from
+// the body of r. The optional notAfter query parameter sets the lifetime.
+func decodeRawSignRequest(r *http.Request) (*SignRequest, error) {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		switch {
+		case err != nil:
+			return nil, errs.BadRequestErr(err, "invalid Content-Type")
+		case mt != "application/pkcs10" && mt != "application/x-pem-file" && mt != "application/pem-certificate-chain" &&
+			mt != "text/plain" && mt != "application/octet-stream":
+			return nil, errs.New(http.StatusUnsupportedMediaType, "unsupported Content-Type %s", mt)
+		}
+	}
+
+	endDecode := timePhase(r.Context(), phaseDecode)
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxCSRSize+1))
+	if err != nil {
+		endDecode()
+		return nil, errs.BadRequestErr(err, "error reading request body")
+	}
+	csr, err := parseCSR(data)
+	endDecode()
+	if err != nil {
+		return nil, err
+	}
+
+	request := &SignRequest{CsrPEM: api.CertificateRequest{CertificateRequest: csr}}
+	if v := r.URL.Query().Get("notAfter"); v != "" {
+		if err := request.NotAfter.UnmarshalJSON([]byte(`"` + v + `"`)); err != nil {
+			return nil, errs.BadRequestErr(err, "invalid notAfter")
+		}
+	}
+	defer timePhase(r.Context(), phaseValidate)()
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
@@ -0,0 +1,97 @@
+package signer
+
+import (
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func csrDER(t testing.TB, names ...string) []byte {
+	t.Helper()
+	block, _ := pem.Decode([]byte(newTestCSR(t, names...)))
+	return block.Bytes
+}
+
+func testCSRNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("host%d.example.com", i)
+	}
+	return names
+}
+
+func TestParseCSR(t *testing.T) {
+	valid := newTestCSR(t, "example.com", "www.example.com")
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"pem", []byte(valid), ""},
+		{"der", csrDER(t, "example.com"), ""},
+		{"trailing pem", []byte(valid + "junk"), "unexpected data after the PEM block"},
+		{"trailing der", append(csrDER(t, "example.com"), 0), "malformed or trailing data"},
+		{"certificate pem", []byte(strings.ReplaceAll(valid, "CERTIFICATE REQUEST", "CERTIFICATE")), "expected a CERTIFICATE REQUEST"},
+		{"too large", make([]byte, maxCSRSize+1), "csr exceeds"},
+		{"too many names", csrDER(t, testCSRNames(maxCSRNames+1)...), "subject alternative names"},
+		{"long common name", csrDER(t, strings.Repeat("a", maxCSRSubjectLength+1)+".example.com"), "common name exceeds"},
+		{"garbage", []byte("not a csr"), "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csr, err := parseCSR(tt.data)
+			if tt.wantErr == "" {
+				if err != nil || csr == nil {
+					t.Fatalf("parseCSR() = %v, %v", csr, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseCSR() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func FuzzParseCSR(f *testing.F) {
+	valid := newTestCSR(f, "example.com", "www.example.com")
+	der := csrDER(f, "example.com")
+	f.Add([]byte(valid))
+	f.Add(der)
+	f.Add(der[:len(der)/2])
+	f.Add(append(append([]byte{}, der...), 0))
+	f.Add([]byte(valid + "junk"))
+	f.Add(csrDER(f, testCSRNames(maxCSRNames+1)...))
+	f.Add(csrDER(f, strings.Repeat("a", maxCSRSubjectLength+1)))
+	f.Add([]byte{0x30, 0x84, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte("-----BEGIN CERTIFICATE REQUEST-----\n-----END CERTIFICATE REQUEST-----\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) <= maxCSRSize {
+			if pemBlock, _ := pem.Decode(data); pemBlock == nil {
+				_ = precheckCSR(data)
+			}
+		}
+
+		csr, err := parseCSR(data)
+		if err != nil {
+			return
+		}
+		if len(data) > maxCSRSize {
+			t.Fatalf("accepted a csr of %d bytes", len(data))
+		}
+		if len(csr.Extensions) > maxCSRExtensions {
+			t.Fatalf("accepted a csr with %d extensions", len(csr.Extensions))
+		}
+		if n := len(csr.DNSNames) + len(csr.EmailAddresses) + len(csr.IPAddresses) + len(csr.URIs); n > maxCSRNames {
+			t.Fatalf("accepted a csr with %d names", n)
+		}
+		if len(csr.Subject.CommonName) > maxCSRSubjectLength {
+			t.Fatalf("accepted a csr with a common name of %d characters", len(csr.Subject.CommonName))
+		}
+		if err := precheckCSR(csr.Raw); err != nil {
+			t.Fatalf("accepted a csr failing precheckCSR: %v", err)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package signer
+
+import (
+	"crypto/subtle"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+var oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+// CSRAttributesConfig configures the policy of the CSR attributes.
+// ChallengePassword is "require", "verify" or "strip", and ExtensionRequest
+// is "require" or "forbid". Attributes are ignored by default.
+type CSRAttributesConfig struct {
+	ChallengePassword ChallengePasswordConfig `yaml:"challengePassword"`
+	ExtensionRequest  string                  `yaml:"extensionRequest"`
+}
+
+// ChallengePasswordConfig configures the challengePassword attribute. With
+// verify the password must match the content of one of PasswordFiles, read
+// on each request so secrets can be rotated.
+type ChallengePasswordConfig struct {
+	Mode          string   `yaml:"mode"`
+	PasswordFiles []string `yaml:"passwordFiles"`
+}
+
+// Validate checks the modes and the password files.
+func (c CSRAttributesConfig) Validate() error {
+	switch c.ChallengePassword.Mode {
+	case "", "require", "strip":
+	case "verify":
+		if len(c.ChallengePassword.PasswordFiles) == 0 {
+			return errors.New("csrAttributes.challengePassword verify requires passwordFiles")
+		}
+		for _, f := range c.ChallengePassword.PasswordFiles {
+			if _, err := readPasswordFromFile(f); err != nil {
+				return errors.Wrapf(err, "error reading challenge password file %s", f)
+			}
+		}
+	default:
+		return errors.Errorf("invalid csrAttributes.challengePassword mode %q", c.ChallengePassword.Mode)
+	}
+	switch c.ExtensionRequest {
+	case "", "require", "forbid":
+	default:
+		return errors.Errorf("invalid csrAttributes.extensionRequest %q", c.ExtensionRequest)
+	}
+
+	return nil
+}
+
+// checkCSRAttributes applies the attribute policy to the request, and
+// returns a denial with rule "challenge-password" or "extension-request".
+// Unless challenge passwords are ignored, the CSR of a request carrying one
+// is left out of the hook events so the secret is not passed on.
+func (c CSRAttributesConfig) checkCSRAttributes(request *SignRequest) policy.Decision {
+	password, hasPassword, hasExtensions, err := parseCSRAttributes(request.CsrPEM.Raw)
+	if err != nil {
+		return policy.Decision{RuleID: "challenge-password", Reason: "invalid csr attributes: " + err.Error()}
+	}
+	if hasPassword && c.ChallengePassword.Mode != "" {
+		request.redactCSR = true
+	}
+
+	switch c.ExtensionRequest {
+	case "require":
+		if !hasExtensions {
+			return policy.Decision{RuleID: "extension-request", Reason: "csr must request its extensions"}
+		}
+	case "forbid":
+		if hasExtensions {
+			return policy.Decision{RuleID: "extension-request", Reason: "csr must not request extensions"}
+		}
+	}
+
+	switch c.ChallengePassword.Mode {
+	case "require":
+		if password == "" {
+			return policy.Decision{RuleID: "challenge-password", Reason: "csr must have a challengePassword"}
+		}
+	case "verify":
+		if password == "" {
+			return policy.Decision{RuleID: "challenge-password", Reason: "csr must have a challengePassword"}
+		}
+		if !c.ChallengePassword.matches(password) {
+			return policy.Decision{RuleID: "challenge-password", Reason: "invalid challengePassword"}
+		}
+	}
+
+	return policy.Decision{Allowed: true}
+}
+
+// matches returns true if password is the content of a password file.
+func (c ChallengePasswordConfig) matches(password string) bool {
+	var ok bool
+	for _, f := range c.PasswordFiles {
+		b, err := readPasswordFromFile(f)
+		if err != nil {
+			logFor("policy").WithField("error", err).Errorf("Error reading challenge password file %s", f)
+			continue
+		}
+		if len(b) > 0 && subtle.ConstantTimeCompare(b, []byte(password)) == 1 {
+			ok = true
+		}
+	}
+
+	return ok
+}
+
+// parseCSRAttributes returns the challengePassword of a DER CSR and whether
+// it has the challengePassword and extensionRequest attributes.
+func parseCSRAttributes(der []byte) (password string, hasPassword, hasExtensions bool, err error) {
+	input := cryptobyte.String(der)
+	var csr, info, attributes cryptobyte.String
+	if !input.ReadASN1(&csr, cbasn1.SEQUENCE) ||
+		!csr.ReadASN1(&info, cbasn1.SEQUENCE) ||
+		!info.SkipASN1(cbasn1.INTEGER) ||
+		!info.SkipASN1(cbasn1.SEQUENCE) ||
+		!info.SkipASN1(cbasn1.SEQUENCE) ||
+		!info.ReadOptionalASN1(&attributes, nil, cbasn1.Tag(0).Constructed().ContextSpecific()) {
+		return "", false, false, errors.New("malformed certification request info")
+	}
+
+	for !attributes.Empty() {
+		var attr, values cryptobyte.String
+		var oid asn1.ObjectIdentifier
+		if !attributes.ReadASN1(&attr, cbasn1.SEQUENCE) ||
+			!attr.ReadASN1ObjectIdentifier(&oid) ||
+			!attr.ReadASN1(&values, cbasn1.SET) {
+			return "", false, false, errors.New("malformed attribute")
+		}
+		switch {
+		case oid.Equal(oidExtensionRequest):
+			hasExtensions = true
+		case oid.Equal(oidChallengePassword):
+			var value cryptobyte.String
+			var tag cbasn1.Tag
+			if !values.ReadAnyASN1(&value, &tag) {
+				return "", false, false, errors.New("malformed challengePassword")
+			}
+			switch tag {
+			case cbasn1.PrintableString, cbasn1.UTF8String, cbasn1.IA5String, cbasn1.T61String:
+			default:
+				return "", false, false, errors.New("challengePassword is not a string")
+			}
+			password, hasPassword = string(value), true
+		}
+	}
+
+	return password, hasPassword, hasExtensions, nil
+}
@@ -0,0 +1,172 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallstep/certificates/api"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+var oidSubjectAltNameExt = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// newAttributesRequest returns a sign request of a CSR for device.example.com
+// with a challengePassword attribute if password is not empty, and an
+// extensionRequest attribute with the SAN if withExtensions is set. The
+// standard library cannot create challengePassword attributes, so the CSR is
+// built by hand.
+func newAttributesRequest(t *testing.T, password string, withExtensions bool) *SignRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := asn1.Marshal(pkix.Name{CommonName: "device.example.com"}.ToRDNSequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	san, err := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("device.example.com")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1Int64(0)
+		b.AddBytes(subject)
+		b.AddBytes(spki)
+		b.AddASN1(cbasn1.Tag(0).Constructed().ContextSpecific(), func(b *cryptobyte.Builder) {
+			if password != "" {
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oidChallengePassword)
+					b.AddASN1(cbasn1.SET, func(b *cryptobyte.Builder) {
+						b.AddASN1(cbasn1.UTF8String, func(b *cryptobyte.Builder) { b.AddBytes([]byte(password)) })
+					})
+				})
+			}
+			if withExtensions {
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oidExtensionRequest)
+					b.AddASN1(cbasn1.SET, func(b *cryptobyte.Builder) {
+						b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+								b.AddASN1ObjectIdentifier(oidSubjectAltNameExt)
+								b.AddASN1OctetString(san)
+							})
+						})
+					})
+				})
+			}
+		})
+	})
+	info := b.BytesOrPanic()
+	digest := sha256.Sum256(info)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b = cryptobyte.Builder{}
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddBytes(info)
+		b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+			b.AddASN1ObjectIdentifier(oidECDSAWithSHA256)
+		})
+		b.AddASN1BitString(sig)
+	})
+	csr, err := x509.ParseCertificateRequest(b.BytesOrPanic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &SignRequest{CsrPEM: api.CertificateRequest{CertificateRequest: csr}}
+}
+
+func TestParseCSRAttributes(t *testing.T) {
+	request := newAttributesRequest(t, "enroll-123", true)
+	password, hasPassword, hasExtensions, err := parseCSRAttributes(request.CsrPEM.Raw)
+	if err != nil || password != "enroll-123" || !hasPassword || !hasExtensions {
+		t.Errorf("parseCSRAttributes() = %q, %v, %v, %v, want the password and extensions", password, hasPassword, hasExtensions, err)
+	}
+	if dns := request.CsrPEM.DNSNames; len(dns) != 1 || dns[0] != "device.example.com" {
+		t.Errorf("CSR DNS names = %v, want the requested SAN", dns)
+	}
+
+	_, hasPassword, hasExtensions, err = parseCSRAttributes(csrDER(t, "www.example.com"))
+	if err != nil || hasPassword || !hasExtensions {
+		t.Errorf("parseCSRAttributes() of a standard CSR = %v, %v, %v, want extensions only", hasPassword, hasExtensions, err)
+	}
+	if _, _, _, err := parseCSRAttributes([]byte{0x30, 0x03, 0x02, 0x01, 0x00}); err == nil {
+		t.Error("parseCSRAttributes() accepted a malformed CSR")
+	}
+}
+
+func TestCheckCSRAttributes(t *testing.T) {
+	dir := t.TempDir()
+	current, previous := filepath.Join(dir, "current"), filepath.Join(dir, "previous")
+	writeFile(current, "enroll-123\n")
+	writeFile(previous, "enroll-old\n")
+	verify := ChallengePasswordConfig{Mode: "verify", PasswordFiles: []string{current, previous}}
+
+	tests := []struct {
+		name       string
+		c          CSRAttributesConfig
+		password   string
+		extensions bool
+		rule       string
+		redacted   bool
+	}{
+		{"ignored", CSRAttributesConfig{}, "enroll-123", true, "", false},
+		{"require", CSRAttributesConfig{ChallengePassword: ChallengePasswordConfig{Mode: "require"}}, "anything", true, "", true},
+		{"require missing", CSRAttributesConfig{ChallengePassword: ChallengePasswordConfig{Mode: "require"}}, "", true, "challenge-password", false},
+		{"verify", CSRAttributesConfig{ChallengePassword: verify}, "enroll-123", true, "", true},
+		{"verify previous", CSRAttributesConfig{ChallengePassword: verify}, "enroll-old", true, "", true},
+		{"verify wrong", CSRAttributesConfig{ChallengePassword: verify}, "guess", true, "challenge-password", true},
+		{"strip", CSRAttributesConfig{ChallengePassword: ChallengePasswordConfig{Mode: "strip"}}, "enroll-123", true, "", true},
+		{"require extensions", CSRAttributesConfig{ExtensionRequest: "require"}, "", false, "extension-request", false},
+		{"forbid extensions", CSRAttributesConfig{ExtensionRequest: "forbid"}, "", true, "extension-request", false},
+	}
+	for _, tt := range tests {
+		request := newAttributesRequest(t, tt.password, tt.extensions)
+		d := tt.c.checkCSRAttributes(request)
+		if d.Allowed != (tt.rule == "") || d.RuleID != tt.rule || request.redactCSR != tt.redacted {
+			t.Errorf("%s: checkCSRAttributes() = %+v, redacted %v, want rule %q, redacted %v", tt.name, d, request.redactCSR, tt.rule, tt.redacted)
+		}
+	}
+}
+
+func TestCSRAttributesConfigValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	writeFile(file, "enroll-123")
+	tests := []struct {
+		c  CSRAttributesConfig
+		ok bool
+	}{
+		{CSRAttributesConfig{}, true},
+		{CSRAttributesConfig{ChallengePassword: ChallengePasswordConfig{Mode: "verify", PasswordFiles: []string{file}}, ExtensionRequest: "forbid"}, true},
+		{CSRAttributesConfig{ChallengePassword: ChallengePasswordConfig{Mode: "verify"}}, false},
+		{CSRAttributesConfig{ChallengePassword: ChallengePasswordConfig{Mode: "verify", PasswordFiles: []string{file + ".missing"}}}, false},
+		{CSRAttributesConfig{ChallengePassword: ChallengePasswordConfig{Mode: "check"}}, false},
+		{CSRAttributesConfig{ExtensionRequest: "allow"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v, want ok %v", tt.c, err, tt.ok)
+		}
+	}
+}
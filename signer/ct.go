@@ -0,0 +1,289 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// CTConfig configures the submission of the issued leaf certificates to
+// Certificate Transparency logs, e.g. private logs for internal
+// transparency.
+type CTConfig struct {
+	Logs    []CTLogConfig `yaml:"logs"`
+	Mode    string        `yaml:"mode"`
+	Timeout string        `yaml:"timeout"`
+}
+
+// CTLogConfig is a Certificate Transparency log. If its public key is
+// configured, the signatures of its SCTs are verified.
+type CTLogConfig struct {
+	URL       string `yaml:"url"`
+	PublicKey string `yaml:"publicKey"`
+}
+
+// Enabled returns true if logs are configured.
+func (c CTConfig) Enabled() bool {
+	return len(c.Logs) > 0
+}
+
+// GetMode returns "async" (default), submitting in the background and
+// storing the SCTs in the inventory, or "sync", submitting before
+// responding and returning the SCTs to the client.
+func (c CTConfig) GetMode() string {
+	if c.Mode != "" {
+		return c.Mode
+	}
+
+	return "async"
+}
+
+// GetTimeout returns the timeout of a submission to a log, defaults to
+// 10s.
+func (c CTConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 10 * time.Second
+}
+
+// Validate checks the mode, the timeout and the log URLs.
+func (c CTConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if m := c.GetMode(); m != "async" && m != "sync" {
+		return errors.Errorf("invalid ct mode %q, must be async or sync", m)
+	}
+	if c.Timeout != "" {
+		if _, err := time.ParseDuration(c.Timeout); err != nil {
+			return errors.Wrap(err, "invalid ct timeout")
+		}
+	}
+	for _, l := range c.Logs {
+		u, err := url.Parse(l.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.Errorf("invalid ct log url %q", l.URL)
+		}
+	}
+
+	return nil
+}
+
+// signedCertificateTimestamp is an SCT returned by a log, as stored in the
+// inventory and returned to the clients. SCT is the TLS encoding of the
+// SCT, as in the SCT list extension, in base64.
+type signedCertificateTimestamp struct {
+	Log       string    `json:"log"`
+	LogID     string    `json:"logId"`
+	Timestamp time.Time `json:"timestamp"`
+	SCT       string    `json:"sct"`
+}
+
+// ctLog is a log with its SCT verifier, if its public key is configured.
+type ctLog struct {
+	url      string
+	verifier *ct.SignatureVerifier
+	logID    ct.SHA256Hash
+}
+
+// ctSubmitter submits certificates to the configured logs.
+type ctSubmitter struct {
+	mode    string
+	timeout time.Duration
+	logs    []ctLog
+	client  *http.Client
+}
+
+func newCTSubmitter(c CTConfig) (*ctSubmitter, error) {
+	s := &ctSubmitter{
+		mode:    c.GetMode(),
+		timeout: c.GetTimeout(),
+		client:  &http.Client{},
+	}
+	for _, l := range c.Logs {
+		cl := ctLog{url: strings.TrimSuffix(l.URL, "/")}
+		if l.PublicKey != "" {
+			data, err := os.ReadFile(l.PublicKey)
+			if err != nil {
+				return nil, errors.Wrap(err, "error reading ct log public key")
+			}
+			pub, id, _, err := ct.PublicKeyFromPEM(data)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error parsing ct log public key %s", l.PublicKey)
+			}
+			if cl.verifier, err = ct.NewSignatureVerifier(pub); err != nil {
+				return nil, errors.Wrapf(err, "unsupported ct log public key %s", l.PublicKey)
+			}
+			cl.logID = id
+		}
+		s.logs = append(s.logs, cl)
+	}
+
+	return s, nil
+}
+
+// submit sends the chain to every log in parallel and returns the SCTs
+// received. Failures are logged and counted, but do not fail the issuance.
+func (c *ctSubmitter) submit(ctx context.Context, serial string, chain []api.Certificate) []signedCertificateTimestamp {
+	var der [][]byte
+	for _, cert := range chain {
+		if cert.Certificate != nil {
+			der = append(der, cert.Raw)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var scts []signedCertificateTimestamp
+	for _, l := range c.logs {
+		wg.Add(1)
+		go func(l ctLog) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			sct, err := c.addChain(ctx, l, der)
+			if err != nil {
+				ctSubmissions.WithLabelValues(l.url, "error").Inc()
+				logFor("ct").WithFields(log.Fields{
+					"log":    l.url,
+					"serial": serial,
+					"error":  err,
+				}).Error("Error submitting certificate to CT log")
+				return
+			}
+			ctSubmissions.WithLabelValues(l.url, "submitted").Inc()
+			mu.Lock()
+			scts = append(scts, *sct)
+			mu.Unlock()
+		}(l)
+	}
+	wg.Wait()
+
+	return scts
+}
+
+// addChain posts the chain to the add-chain endpoint of a log and verifies
+// the SCT returned.
+func (c *ctSubmitter) addChain(ctx context.Context, l ctLog, chain [][]byte) (*signedCertificateTimestamp, error) {
+	body, err := json.Marshal(ct.AddChainRequest{Chain: chain})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url+ct.AddChainPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("log answered %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var rsp ct.AddChainResponse
+	if err := json.Unmarshal(data, &rsp); err != nil {
+		return nil, errors.Wrap(err, "error decoding add-chain response")
+	}
+	sct, err := rsp.ToSignedCertificateTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.verifier != nil {
+		if sct.LogID.KeyID != l.logID {
+			return nil, errors.New("SCT log ID does not match the log public key")
+		}
+		entry := ct.LogEntry{Leaf: ct.MerkleTreeLeaf{
+			Version:  ct.V1,
+			LeafType: ct.TimestampedEntryLeafType,
+			TimestampedEntry: &ct.TimestampedEntry{
+				Timestamp:  sct.Timestamp,
+				EntryType:  ct.X509LogEntryType,
+				X509Entry:  &ct.ASN1Cert{Data: chain[0]},
+				Extensions: sct.Extensions,
+			},
+		}}
+		if err := l.verifier.VerifySCTSignature(*sct, entry); err != nil {
+			return nil, errors.Wrap(err, "invalid SCT signature")
+		}
+	}
+
+	encoded, err := cttls.Marshal(*sct)
+	if err != nil {
+		return nil, err
+	}
+	return &signedCertificateTimestamp{
+		Log:       l.url,
+		LogID:     base64.StdEncoding.EncodeToString(sct.LogID.KeyID[:]),
+		Timestamp: time.UnixMilli(int64(sct.Timestamp)).UTC(),
+		SCT:       base64.StdEncoding.EncodeToString(encoded),
+	}, nil
+}
+
+// submitCT submits a leaf certificate in the background in async mode and
+// adds the SCTs to its inventory record.
+func (s *server) submitCT(resp *api.SignResponse) {
+	cert := resp.ServerPEM.Certificate
+	if s.ct == nil || s.ct.mode != "async" || cert == nil || cert.IsCA {
+		return
+	}
+
+	serial := cert.SerialNumber.String()
+	chain := responseChain(resp)
+	go func() {
+		scts := s.ct.submit(context.Background(), serial, chain)
+		if s.inventory == nil || len(scts) == 0 {
+			return
+		}
+		if err := s.inventory.AddSCTs(serial, scts); err != nil {
+			inventoryErrors.Inc()
+			logFor("inventory").WithFields(log.Fields{
+				"serial": serial,
+				"error":  err,
+			}).Error("Error storing SCTs in the inventory")
+		}
+	}()
+}
+
+// AddSCTs adds SCTs to the record of a certificate.
+func (inv *inventory) AddSCTs(serial string, scts []signedCertificateTimestamp) error {
+	return inv.update(func(tx store.Tx) error {
+		b := tx.Bucket(certificatesBucket)
+		var rec certificateRecord
+		if err := json.Unmarshal(b.Get([]byte(serial)), &rec); err != nil {
+			return err
+		}
+		rec.SCTs = append(rec.SCTs, scts...)
+		data, err := json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(serial), data)
+	})
+}
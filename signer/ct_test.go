@@ -0,0 +1,147 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	"github.com/smallstep/certificates/api"
+)
+
+// newTestCTLog starts a CT log signing the SCTs of the submitted chains with
+// key, and returns its URL.
+func newTestCTLog(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logID := sha256.Sum256(der)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ct.AddChainRequest
+		if r.URL.Path != ct.AddChainPath || json.NewDecoder(r.Body).Decode(&req) != nil || len(req.Chain) == 0 {
+			http.Error(w, "bad chain", http.StatusBadRequest)
+			return
+		}
+		sct := ct.SignedCertificateTimestamp{SCTVersion: ct.V1, LogID: ct.LogID{KeyID: logID}, Timestamp: uint64(time.Now().UnixMilli())}
+		input, err := ct.SerializeSCTSignatureInput(sct, ct.LogEntry{Leaf: ct.MerkleTreeLeaf{
+			Version:  ct.V1,
+			LeafType: ct.TimestampedEntryLeafType,
+			TimestampedEntry: &ct.TimestampedEntry{
+				Timestamp: sct.Timestamp,
+				EntryType: ct.X509LogEntryType,
+				X509Entry: &ct.ASN1Cert{Data: req.Chain[0]},
+			},
+		}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		digest := sha256.Sum256(input)
+		sig, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		signature, _ := cttls.Marshal(cttls.DigitallySigned{
+			Algorithm: cttls.SignatureAndHashAlgorithm{Hash: cttls.SHA256, Signature: cttls.ECDSA},
+			Signature: sig,
+		})
+		json.NewEncoder(w).Encode(ct.AddChainResponse{SCTVersion: ct.V1, ID: logID[:], Timestamp: sct.Timestamp, Signature: signature})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+// writePublicKey writes the PEM public key of key in a temporary file and
+// returns its path.
+func writePublicKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "log.pem")
+	if err := writeFile(name, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func TestCTConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    CTConfig
+		ok   bool
+	}{
+		{"disabled", CTConfig{Mode: "invalid"}, true},
+		{"sync", CTConfig{Mode: "sync", Logs: []CTLogConfig{{URL: "https://ct.example.com/log"}}}, true},
+		{"mode", CTConfig{Mode: "batch", Logs: []CTLogConfig{{URL: "https://ct.example.com/log"}}}, false},
+		{"timeout", CTConfig{Timeout: "soon", Logs: []CTLogConfig{{URL: "https://ct.example.com/log"}}}, false},
+		{"url", CTConfig{Logs: []CTLogConfig{{URL: "ct.example.com/log"}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestCTSubmit(t *testing.T) {
+	logKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	verified := newTestCTLog(t, logKey)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	c, err := newCTSubmitter(CTConfig{Logs: []CTLogConfig{
+		{URL: verified + "/", PublicKey: writePublicKey(t, logKey)},
+		{URL: newTestCTLog(t, logKey)},
+		{URL: newTestCTLog(t, otherKey), PublicKey: writePublicKey(t, logKey)},
+		{URL: failing.URL},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, rootKey := newTestCert(t, "Root CA")
+	leaf, _ := issueTestCert(t, root, rootKey, "www.example.com", false)
+	scts := c.submit(context.Background(), leaf.SerialNumber.String(), []api.Certificate{api.NewCertificate(leaf), api.NewCertificate(root)})
+	if len(scts) != 2 {
+		t.Fatalf("submit() = %+v, want the SCTs of the 2 valid logs", scts)
+	}
+	for _, sct := range scts {
+		if sct.SCT == "" || sct.LogID == "" || time.Since(sct.Timestamp) > time.Minute {
+			t.Errorf("SCT = %+v, want an encoded SCT", sct)
+		}
+	}
+
+	inv := newTestInventory(t)
+	serial := leaf.SerialNumber.String()
+	if err := inv.Put(&certificateRecord{Serial: serial, Fingerprint: certificateFingerprint(leaf)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.AddSCTs(serial, scts); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := inv.Get(serial); err != nil || len(rec.SCTs) != 2 {
+		t.Errorf("record after AddSCTs() = %+v, %v, want 2 SCTs", rec, err)
+	}
+
+	if _, err := newCTSubmitter(CTConfig{Logs: []CTLogConfig{{URL: verified, PublicKey: filepath.Join(t.TempDir(), "missing.pem")}}}); err == nil {
+		t.Error("newCTSubmitter() with a missing public key error = nil")
+	}
+}
@@ -0,0 +1,224 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeprecationConfig marks an endpoint, its unversioned alias or fields of
+// its JSON requests as deprecated. Their requests get the Deprecation
+// (RFC 9745), Sunset (RFC 8594) and Link headers, and are counted and
+// logged with their clients, so the remaining users can be found before the
+// sunset. Requests are still served after the sunset.
+type DeprecationConfig struct {
+	Path        string   `yaml:"path"`
+	Unversioned bool     `yaml:"unversioned"`
+	Fields      []string `yaml:"fields"`
+	Since       string   `yaml:"since"`
+	Sunset      string   `yaml:"sunset"`
+	Link        string   `yaml:"link"`
+}
+
+// parseDeprecationDate parses a date, "2006-01-02" or RFC 3339.
+func parseDeprecationDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// GetSince returns the deprecation date.
+func (c DeprecationConfig) GetSince() time.Time {
+	t, _ := parseDeprecationDate(c.Since)
+	return t
+}
+
+// GetSunset returns the sunset date, zero if not set.
+func (c DeprecationConfig) GetSunset() time.Time {
+	t, _ := parseDeprecationDate(c.Sunset)
+	return t
+}
+
+// Validate checks the path, the dates and the link.
+func (c DeprecationConfig) Validate() error {
+	if !strings.HasPrefix(c.Path, "/") {
+		return errors.Errorf("invalid deprecation path %q", c.Path)
+	}
+	for _, f := range c.Fields {
+		if f == "" || strings.HasPrefix(f, ".") || strings.HasSuffix(f, ".") {
+			return errors.Errorf("invalid deprecated field %q of %s", f, c.Path)
+		}
+	}
+	since, err := parseDeprecationDate(c.Since)
+	if err != nil {
+		return errors.Errorf("invalid deprecation since %q of %s, must be a date or an RFC 3339 time", c.Since, c.Path)
+	}
+	if c.Sunset != "" {
+		sunset, err := parseDeprecationDate(c.Sunset)
+		if err != nil {
+			return errors.Errorf("invalid deprecation sunset %q of %s, must be a date or an RFC 3339 time", c.Sunset, c.Path)
+		}
+		if !sunset.After(since) {
+			return errors.Errorf("deprecation sunset of %s must be after since", c.Path)
+		}
+	}
+	if c.Link != "" {
+		if u, err := url.Parse(c.Link); err != nil || !u.IsAbs() {
+			return errors.Errorf("invalid deprecation link %q of %s", c.Link, c.Path)
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if the deprecation applies to the endpoint at path,
+// requested on a versioned path or not.
+func (c DeprecationConfig) matches(path string, versioned bool) bool {
+	if c.Unversioned && versioned {
+		return false
+	}
+	return path == c.Path || (strings.HasSuffix(c.Path, "/") && strings.HasPrefix(path, c.Path))
+}
+
+// deprecated wraps next adding the deprecation headers to the requests of
+// deprecated endpoints, and to the requests setting deprecated fields in
+// their JSON body. Fields are dotted paths in the body, e.g.
+// "options.legacy".
+func (s *server) deprecated(next http.Handler) http.Handler {
+	if len(s.config.Deprecations) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var matched []DeprecationConfig
+		for _, d := range s.config.Deprecations {
+			if d.matches(r.URL.Path, versionedPath(r)) {
+				matched = append(matched, d)
+			}
+		}
+		if len(matched) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body map[string]interface{}
+		for _, d := range matched {
+			if len(d.Fields) > 0 {
+				body = peekJSONBody(r)
+				break
+			}
+		}
+
+		clients := clientIdentities(r)
+		tenant := s.tenantFor(clients)
+		var since, sunset time.Time
+		var endpoints, fields, links []string
+		for _, d := range matched {
+			used := len(d.Fields) == 0
+			if used {
+				deprecatedRequests.WithLabelValues(d.Path, "", tenant).Inc()
+			}
+			for _, f := range d.Fields {
+				if hasJSONField(body, f) {
+					deprecatedRequests.WithLabelValues(d.Path, f, tenant).Inc()
+					fields = append(fields, f)
+					used = true
+				}
+			}
+			if !used {
+				continue
+			}
+			if !slices.Contains(endpoints, d.Path) {
+				endpoints = append(endpoints, d.Path)
+			}
+			if since.IsZero() || d.GetSince().Before(since) {
+				since = d.GetSince()
+			}
+			if t := d.GetSunset(); !t.IsZero() && (sunset.IsZero() || t.Before(sunset)) {
+				sunset = t
+			}
+			if d.Link != "" {
+				links = append(links, "<"+d.Link+`>; rel="deprecation"; type="text/html"`)
+			}
+			if d.Unversioned {
+				links = append(links, "</v"+strconv.Itoa(apiVersionLatest)+r.URL.Path+`>; rel="successor-version"`)
+			}
+		}
+		if len(endpoints) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+		if !sunset.IsZero() {
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		for _, l := range links {
+			w.Header().Add("Link", l)
+		}
+
+		logFor("deprecation").WithFields(log.Fields{
+			"path":       r.URL.Path,
+			"versioned":  versionedPath(r),
+			"fields":     fields,
+			"client":     clients,
+			"tenant":     tenant,
+			"userAgent":  r.UserAgent(),
+			"deprecated": endpoints,
+		}).Info("Deprecated API used")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// peekJSONBody decodes the JSON object in the body of r, and restores the
+// body for the next handlers. It returns nil for other bodies.
+func peekJSONBody(r *http.Request) map[string]interface{} {
+	if r.Body == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return nil
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mediaType, _, _ := mime.ParseMediaType(ct); mediaType != "application/json" {
+			return nil
+		}
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxSignRequestSize+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+	if err != nil || len(b) > maxSignRequestSize {
+		return nil
+	}
+	var body map[string]interface{}
+	if json.Unmarshal(b, &body) != nil {
+		return nil
+	}
+
+	return body
+}
+
+// hasJSONField returns true if the dotted path is set in body.
+func hasJSONField(body map[string]interface{}, path string) bool {
+	var v interface{} = body
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if v, ok = m[name]; !ok {
+			return false
+		}
+	}
+
+	return v != nil
+}
@@ -0,0 +1,125 @@
+package signer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeprecationConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    DeprecationConfig
+		ok   bool
+	}{
+		{"endpoint", DeprecationConfig{Path: "/sign/raw", Since: "2024-01-01"}, true},
+		{"full", DeprecationConfig{Path: "/sign", Fields: []string{"options.legacy"}, Since: "2024-01-01T00:00:00Z", Sunset: "2024-07-01", Link: "https://docs.example.com/migration"}, true},
+		{"path", DeprecationConfig{Path: "sign", Since: "2024-01-01"}, false},
+		{"field", DeprecationConfig{Path: "/sign", Fields: []string{"options."}, Since: "2024-01-01"}, false},
+		{"no since", DeprecationConfig{Path: "/sign"}, false},
+		{"sunset", DeprecationConfig{Path: "/sign", Since: "2024-01-01", Sunset: "July"}, false},
+		{"sunset before since", DeprecationConfig{Path: "/sign", Since: "2024-07-01", Sunset: "2024-01-01"}, false},
+		{"link", DeprecationConfig{Path: "/sign", Since: "2024-01-01", Link: "/docs"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestDeprecationMatches(t *testing.T) {
+	tests := []struct {
+		c         DeprecationConfig
+		path      string
+		versioned bool
+		want      bool
+	}{
+		{DeprecationConfig{Path: "/sign/raw"}, "/sign/raw", true, true},
+		{DeprecationConfig{Path: "/sign/raw"}, "/sign", false, false},
+		{DeprecationConfig{Path: "/approvals/"}, "/approvals/123", true, true},
+		{DeprecationConfig{Path: "/sign", Unversioned: true}, "/sign", false, true},
+		{DeprecationConfig{Path: "/sign", Unversioned: true}, "/sign", true, false},
+	}
+	for _, tt := range tests {
+		if got := tt.c.matches(tt.path, tt.versioned); got != tt.want {
+			t.Errorf("%+v: matches(%s, %v) = %v, want %v", tt.c, tt.path, tt.versioned, got, tt.want)
+		}
+	}
+}
+
+func TestHasJSONField(t *testing.T) {
+	body := map[string]interface{}{
+		"csr":     "pem",
+		"options": map[string]interface{}{"legacy": true, "none": nil},
+	}
+	for path, want := range map[string]bool{
+		"csr":            true,
+		"options.legacy": true,
+		"options.none":   false,
+		"options.other":  false,
+		"csr.legacy":     false,
+		"profile":        false,
+	} {
+		if got := hasJSONField(body, path); got != want {
+			t.Errorf("hasJSONField(%s) = %v, want %v", path, got, want)
+		}
+	}
+	if hasJSONField(nil, "csr") {
+		t.Error("hasJSONField() of no body = true")
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	s := &server{config: &Config{Deprecations: []DeprecationConfig{
+		{Path: "/sign/raw", Since: "2024-01-01", Sunset: "2024-12-31", Link: "https://docs.example.com/raw"},
+		{Path: "/sign", Fields: []string{"options.legacy"}, Since: "2024-03-01", Sunset: "2024-09-01"},
+		{Path: "/roots", Unversioned: true, Since: "2024-02-01"},
+	}}}
+	var body string
+	handler := versioned(s.deprecated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	})))
+	date := func(s string) string {
+		t, _ := time.Parse(time.DateOnly, s)
+		return t.UTC().Format(http.TimeFormat)
+	}
+	field := deprecatedRequests.WithLabelValues("/sign", "options.legacy", tenantOther)
+	before := testutil.ToFloat64(field)
+
+	tests := []struct {
+		name, method, path, body string
+		deprecation, sunset      string
+		links                    []string
+	}{
+		{"endpoint", http.MethodPost, "/v1/sign/raw", `{}`, "@1704067200", date("2024-12-31"), []string{`<https://docs.example.com/raw>; rel="deprecation"; type="text/html"`}},
+		{"field", http.MethodPost, "/sign", `{"csr":"pem","options":{"legacy":true}}`, "@1709251200", date("2024-09-01"), nil},
+		{"field not set", http.MethodPost, "/sign", `{"csr":"pem"}`, "", "", nil},
+		{"not JSON", http.MethodPost, "/sign", `csr=pem`, "", "", nil},
+		{"unversioned", http.MethodGet, "/roots", ``, "@1706745600", "", []string{`</v1/roots>; rel="successor-version"`}},
+		{"versioned", http.MethodGet, "/v1/roots", ``, "", "", nil},
+		{"other", http.MethodGet, "/health", ``, "", "", nil},
+	}
+	for _, tt := range tests {
+		body = ""
+		r := withIdentities(httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)), "web")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		h := w.Header()
+		if h.Get("Deprecation") != tt.deprecation || h.Get("Sunset") != tt.sunset || strings.Join(h.Values("Link"), ",") != strings.Join(tt.links, ",") {
+			t.Errorf("%s: Deprecation %q, Sunset %q, Link %q, want %q, %q, %q", tt.name, h.Get("Deprecation"), h.Get("Sunset"), h.Values("Link"), tt.deprecation, tt.sunset, tt.links)
+		}
+		if body != tt.body {
+			t.Errorf("%s: body of the next handler = %q, want %q", tt.name, body, tt.body)
+		}
+	}
+	if got := testutil.ToFloat64(field) - before; got != 1 {
+		t.Errorf("deprecated field requests counted = %v, want 1", got)
+	}
+}
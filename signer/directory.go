@@ -0,0 +1,429 @@
+package signer
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// maxSCIMResponse is the maximum size of a SCIM users response.
+const maxSCIMResponse = 4 << 20
+
+// Directory types.
+const (
+	directoryLDAP = "ldap"
+	directorySCIM = "scim"
+)
+
+// DirectoryConfig resolves the groups of the client identities in an LDAP
+// or SCIM directory, so policy rules can grant names to the members of
+// groups, e.g. to the users authenticated with an OIDC token. With ldap, the
+// groups are the values of GroupAttribute in the entries under BaseDN
+// matching Filter, where ${identity} is replaced by the escaped identity.
+// With scim, they are the groups of the user whose UserAttribute is the
+// identity. Only the identities matching the Identities patterns are
+// looked up. The groups are cached for CacheTTL, and the groups of at most
+// CacheSize identities are kept, the least recently used being evicted.
+type DirectoryConfig struct {
+	Type             string   `yaml:"type"`
+	URL              string   `yaml:"url"`
+	CAFile           string   `yaml:"caFile"`
+	BindDN           string   `yaml:"bindDN"`
+	BindPasswordFile string   `yaml:"bindPasswordFile"`
+	BaseDN           string   `yaml:"baseDN"`
+	Filter           string   `yaml:"filter"`
+	GroupAttribute   string   `yaml:"groupAttribute"`
+	TokenFile        string   `yaml:"tokenFile"`
+	UserAttribute    string   `yaml:"userAttribute"`
+	Identities       []string `yaml:"identities"`
+	CacheTTL         string   `yaml:"cacheTTL"`
+	CacheSize        int      `yaml:"cacheSize"`
+	MaxStale         string   `yaml:"maxStale"`
+	Timeout          string   `yaml:"timeout"`
+	FailClosed       bool     `yaml:"failClosed"`
+}
+
+// Enabled returns true if a directory is configured.
+func (c DirectoryConfig) Enabled() bool {
+	return c.Type != ""
+}
+
+// GetGroupAttribute returns the LDAP attribute holding the group names,
+// defaults to cn.
+func (c DirectoryConfig) GetGroupAttribute() string {
+	if c.GroupAttribute != "" {
+		return c.GroupAttribute
+	}
+
+	return "cn"
+}
+
+// GetUserAttribute returns the SCIM attribute matched against the
+// identities, defaults to userName.
+func (c DirectoryConfig) GetUserAttribute() string {
+	if c.UserAttribute != "" {
+		return c.UserAttribute
+	}
+
+	return "userName"
+}
+
+// GetCacheTTL returns how long the groups of an identity are cached,
+// defaults to 5m.
+func (c DirectoryConfig) GetCacheTTL() time.Duration {
+	if d, err := time.ParseDuration(c.CacheTTL); err == nil {
+		return d
+	}
+
+	return 5 * time.Minute
+}
+
+// GetCacheSize returns how many identities have their groups cached,
+// defaults to 10000.
+func (c DirectoryConfig) GetCacheSize() int {
+	if c.CacheSize > 0 {
+		return c.CacheSize
+	}
+
+	return 10000
+}
+
+// GetMaxStale returns how long after they expire the groups of an identity
+// are used while the directory fails, defaults to 1h.
+func (c DirectoryConfig) GetMaxStale() time.Duration {
+	if d, err := time.ParseDuration(c.MaxStale); err == nil {
+		return d
+	}
+
+	return time.Hour
+}
+
+// GetTimeout returns the timeout of a lookup, defaults to 5s.
+func (c DirectoryConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 5 * time.Second
+}
+
+// Validate checks the URL and the settings of the directory type.
+func (c DirectoryConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" {
+		return errors.Errorf("invalid directory url %q", c.URL)
+	}
+	switch c.Type {
+	case directoryLDAP:
+		if u.Scheme != "ldaps" {
+			return errors.Errorf("invalid directory url %q, must be an ldaps URL", c.URL)
+		}
+		if c.BaseDN == "" || !strings.Contains(c.Filter, "${identity}") {
+			return errors.New("ldap directory requires a baseDN and a filter with ${identity}")
+		}
+		if _, err := ldap.CompileFilter(strings.ReplaceAll(c.Filter, "${identity}", "x")); err != nil {
+			return errors.Wrap(err, "invalid directory filter")
+		}
+		if c.BindDN != "" && c.BindPasswordFile == "" {
+			return errors.New("directory bindDN requires a bindPasswordFile")
+		}
+	case directorySCIM:
+		if u.Scheme != "https" {
+			return errors.Errorf("invalid directory url %q, must be an https URL", c.URL)
+		}
+		if c.TokenFile == "" {
+			return errors.New("scim directory requires a tokenFile")
+		}
+	default:
+		return errors.Errorf("invalid directory type %q, must be ldap or scim", c.Type)
+	}
+	if c.CacheSize < 0 {
+		return errors.Errorf("invalid directory cacheSize %d", c.CacheSize)
+	}
+	if c.MaxStale != "" {
+		if d, err := time.ParseDuration(c.MaxStale); err != nil || d < 0 {
+			return errors.Errorf("invalid directory maxStale %q", c.MaxStale)
+		}
+	}
+	for _, p := range c.Identities {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Wrapf(err, "invalid directory identities pattern %q", p)
+		}
+	}
+
+	return nil
+}
+
+// resolves returns true if the groups of the identity are looked up.
+func (c DirectoryConfig) resolves(identity string) bool {
+	if len(c.Identities) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(c.Identities, func(p string) bool {
+		ok, _ := path.Match(p, identity)
+		return ok
+	})
+}
+
+// directory resolves and caches the groups of the client identities. The
+// groups of an identity are kept after they expire, and used for maxStale
+// while the directory fails. The cache is a list of the identities, most
+// recently used first, bounded by cacheSize.
+type directory struct {
+	config    DirectoryConfig
+	tlsConfig *tls.Config
+	client    *http.Client
+
+	mu     sync.Mutex
+	groups map[string]*list.Element
+	lru    *list.List
+}
+
+type cachedGroups struct {
+	identity string
+	groups   []string
+	expires  time.Time
+}
+
+func newDirectory(c DirectoryConfig) (*directory, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading directory caFile")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &directory{
+		config:    c,
+		tlsConfig: tlsConfig,
+		client: &http.Client{
+			Timeout:   c.GetTimeout(),
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		groups: map[string]*list.Element{},
+		lru:    list.New(),
+	}, nil
+}
+
+// Groups returns the groups of the client identities. Identities the
+// directory fails to resolve have their expired groups for maxStale, or
+// none; with failClosed, the error is returned instead.
+func (d *directory) Groups(ctx context.Context, clients []string) ([]string, error) {
+	var groups []string
+	for _, id := range clients {
+		if !d.config.resolves(id) {
+			continue
+		}
+		g, err := d.groupsOf(ctx, id)
+		if err != nil {
+			if d.config.FailClosed {
+				return nil, err
+			}
+			logFor("directory").WithFields(log.Fields{
+				"identity": id,
+				"error":    err,
+			}).Warn("Error resolving the directory groups")
+		}
+		groups = append(groups, g...)
+	}
+	slices.Sort(groups)
+
+	return slices.Compact(groups), nil
+}
+
+// groupsOf returns the cached groups of an identity, looking them up if
+// they expired. On errors, the expired groups are returned with the error
+// until they are older than maxStale.
+func (d *directory) groupsOf(ctx context.Context, identity string) ([]string, error) {
+	now := time.Now()
+	cached, ok := d.cached(identity)
+	if ok && now.Before(cached.expires) {
+		return cached.groups, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.GetTimeout())
+	defer cancel()
+	var groups []string
+	var err error
+	switch d.config.Type {
+	case directoryLDAP:
+		groups, err = d.ldapGroups(ctx, identity)
+	case directorySCIM:
+		groups, err = d.scimGroups(ctx, identity)
+	}
+	if err != nil {
+		directoryLookups.WithLabelValues(d.config.Type, "error").Inc()
+		err = errors.Wrapf(err, "error looking up the groups of %s", identity)
+		if ok && now.Before(cached.expires.Add(d.config.GetMaxStale())) {
+			return cached.groups, err
+		}
+		return nil, err
+	}
+	directoryLookups.WithLabelValues(d.config.Type, "success").Inc()
+	d.cache(&cachedGroups{identity: identity, groups: groups, expires: now.Add(d.config.GetCacheTTL())})
+
+	return groups, nil
+}
+
+// cached returns the cached groups of an identity, expired or not, and
+// marks them as recently used.
+func (d *directory) cached(identity string) (cachedGroups, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.groups[identity]
+	if !ok {
+		return cachedGroups{}, false
+	}
+	d.lru.MoveToFront(e)
+
+	return *e.Value.(*cachedGroups), true
+}
+
+// cache stores the groups of an identity, evicting the least recently used
+// identities above cacheSize.
+func (d *directory) cache(c *cachedGroups) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.groups[c.identity]; ok {
+		e.Value = c
+		d.lru.MoveToFront(e)
+		return
+	}
+	d.groups[c.identity] = d.lru.PushFront(c)
+	for d.lru.Len() > d.config.GetCacheSize() {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.groups, oldest.Value.(*cachedGroups).identity)
+	}
+}
+
+// ldapGroups searches the values of the group attribute in the entries
+// matching the filter for the identity. The port of the ldaps URL defaults
+// to 636.
+func (d *directory) ldapGroups(ctx context.Context, identity string) ([]string, error) {
+	dialer := &net.Dialer{}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	conn, err := ldap.DialURL(d.config.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(d.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(d.config.GetTimeout())
+
+	if d.config.BindDN != "" {
+		password, err := readPasswordFromFile(d.config.BindPasswordFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading directory bindPasswordFile")
+		}
+		if err := conn.Bind(d.config.BindDN, string(password)); err != nil {
+			return nil, errors.Wrap(err, "error binding to LDAP")
+		}
+	}
+
+	attribute := d.config.GetGroupAttribute()
+	res, err := conn.Search(ldap.NewSearchRequest(
+		d.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(d.config.GetTimeout().Seconds()), false,
+		strings.ReplaceAll(d.config.Filter, "${identity}", ldap.EscapeFilter(identity)),
+		[]string{attribute}, nil,
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "error searching LDAP")
+	}
+
+	var groups []string
+	for _, e := range res.Entries {
+		groups = append(groups, e.GetEqualFoldAttributeValues(attribute)...)
+	}
+
+	return groups, nil
+}
+
+// scimUsers is the response of a SCIM users query, RFC 7644.
+type scimUsers struct {
+	Resources []struct {
+		Groups []struct {
+			Value   string `json:"value"`
+			Display string `json:"display"`
+		} `json:"groups"`
+	} `json:"Resources"`
+}
+
+// scimGroups queries the users with the identity and returns the display
+// names of their groups, or their ids without display names.
+func (d *directory) scimGroups(ctx context.Context, identity string) ([]string, error) {
+	token, err := readPasswordFromFile(d.config.TokenFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading directory tokenFile")
+	}
+	value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(identity)
+	query := url.Values{
+		"filter":     {d.config.GetUserAttribute() + ` eq "` + value + `"`},
+		"attributes": {"groups"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(d.config.URL, "/")+"/Users?"+query.Encode(), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	req.Header.Set("Accept", "application/scim+json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("SCIM users query returned %s", resp.Status)
+	}
+	var users scimUsers
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSCIMResponse)).Decode(&users); err != nil {
+		return nil, errors.Wrap(err, "error decoding SCIM users")
+	}
+
+	var groups []string
+	for _, u := range users.Resources {
+		for _, g := range u.Groups {
+			if g.Display != "" {
+				groups = append(groups, g.Display)
+			} else if g.Value != "" {
+				groups = append(groups, g.Value)
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// groupsFor returns the directory groups of the clients if the policy has
+// rules with groups.
+func (s *server) groupsFor(ctx context.Context, p policy.Config, clients []string) ([]string, error) {
+	if s.directory == nil || !p.UsesGroups() {
+		return nil, nil
+	}
+
+	return s.directory.Groups(ctx, clients)
+}
@@ -0,0 +1,126 @@
+package signer
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestSCIM starts a SCIM API returning the group "ops" for every user,
+// or failing while down is set, and returns a directory using it.
+func newTestSCIM(t *testing.T, c DirectoryConfig) (*directory, *atomic.Bool) {
+	t.Helper()
+	var down atomic.Bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"Resources":[{"groups":[{"value":"1","display":"ops"}]}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	c.Type, c.URL = directorySCIM, srv.URL
+	c.CAFile, c.TokenFile = filepath.Join(dir, "ca.crt"), filepath.Join(dir, "token")
+	if err := writeFile(c.CAFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(c.TokenFile, "token"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDirectory(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, &down
+}
+
+// expire moves the expiry of the cached groups of identity by d.
+func expire(d *directory, identity string, by time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.groups[identity].Value.(*cachedGroups).expires = time.Now().Add(-by)
+}
+
+func TestDirectoryMaxStale(t *testing.T) {
+	d, down := newTestSCIM(t, DirectoryConfig{MaxStale: "1h"})
+	ctx := context.Background()
+	if groups, err := d.Groups(ctx, []string{"alice"}); err != nil || !reflect.DeepEqual(groups, []string{"ops"}) {
+		t.Fatalf("Groups() = %v, %v, want ops", groups, err)
+	}
+
+	// Expired groups are used while the directory fails, up to maxStale.
+	down.Store(true)
+	expire(d, "alice", time.Minute)
+	if groups, err := d.Groups(ctx, []string{"alice"}); err != nil || !reflect.DeepEqual(groups, []string{"ops"}) {
+		t.Fatalf("Groups() of stale groups = %v, %v, want ops", groups, err)
+	}
+	expire(d, "alice", 2*time.Hour)
+	if groups, err := d.Groups(ctx, []string{"alice"}); err != nil || len(groups) != 0 {
+		t.Fatalf("Groups() past maxStale = %v, %v, want none", groups, err)
+	}
+
+	d.config.FailClosed = true
+	if _, err := d.Groups(ctx, []string{"alice"}); err == nil {
+		t.Fatal("Groups() with failClosed error = nil")
+	}
+}
+
+func TestDirectoryCacheSize(t *testing.T) {
+	d, down := newTestSCIM(t, DirectoryConfig{CacheSize: 2})
+	ctx := context.Background()
+	for i := range 3 {
+		if _, err := d.Groups(ctx, []string{"user" + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+		// user0 stays the most recently used.
+		if _, err := d.Groups(ctx, []string{"user0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.lru.Len() != 2 || len(d.groups) != 2 {
+		t.Fatalf("cache holds %d identities, want 2", d.lru.Len())
+	}
+	if _, ok := d.groups["user1"]; ok {
+		t.Error("least recently used identity is still cached")
+	}
+
+	down.Store(true)
+	if groups, err := d.Groups(ctx, []string{"user0", "user2"}); err != nil || !reflect.DeepEqual(groups, []string{"ops"}) {
+		t.Errorf("Groups() of cached identities = %v, %v, want ops", groups, err)
+	}
+}
+
+func TestDirectoryConfigValidate(t *testing.T) {
+	base := DirectoryConfig{Type: directoryLDAP, URL: "ldaps://ldap.example.com", BaseDN: "dc=example,dc=com", Filter: "(member=uid=${identity},ou=people,dc=example,dc=com)"}
+	if err := base.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(c *DirectoryConfig)
+	}{
+		{"filter", func(c *DirectoryConfig) { c.Filter = "(member=${identity}" }},
+		{"identity", func(c *DirectoryConfig) { c.Filter = "(objectClass=*)" }},
+		{"scheme", func(c *DirectoryConfig) { c.URL = "ldap://ldap.example.com" }},
+		{"cacheSize", func(c *DirectoryConfig) { c.CacheSize = -1 }},
+		{"maxStale", func(c *DirectoryConfig) { c.MaxStale = "-1h" }},
+	}
+	for _, tt := range tests {
+		c := base
+		tt.edit(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: Validate() error = nil", tt.name)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// DNSCheckConfig configures the DNS ownership check of the requested DNS
+// SANs. A name passes if all its addresses are in CIDRs, if it is a CNAME to
+// a name in Zones, or if the TXT record TXTPrefix.<name> contains one of the
+// client identities. Wildcards are denied unless their parent domain is in
+// WildcardZones.
+type DNSCheckConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	CIDRs         []string `yaml:"cidrs"`
+	Zones         []string `yaml:"zones"`
+	TXTPrefix     string   `yaml:"txtPrefix"`
+	WildcardZones []string `yaml:"wildcardZones"`
+	Resolver      string   `yaml:"resolver"`
+	Timeout       string   `yaml:"timeout"`
+	Exempt        []string `yaml:"exempt"`
+}
+
+// dnsResolver is the part of net.Resolver used by the check.
+type dnsResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// GetTimeout returns the timeout of the lookups of a request, defaults to 5s.
+func (c DNSCheckConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 5 * time.Second
+}
+
+// Validate checks the CIDRs and exempt patterns.
+func (c DNSCheckConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.CIDRs) == 0 && len(c.Zones) == 0 && c.TXTPrefix == "" {
+		return errors.New("dnsCheck requires cidrs, zones or txtPrefix")
+	}
+	if _, err := parseCIDRs(c.CIDRs); err != nil {
+		return errors.Wrap(err, "invalid dnsCheck cidrs")
+	}
+	for _, pattern := range c.Exempt {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid dnsCheck exempt pattern %q", pattern)
+		}
+	}
+
+	return nil
+}
+
+// resolver returns the resolver used by the check, the system one unless a
+// resolver address is configured.
+func (c DNSCheckConfig) resolver() dnsResolver {
+	if c.Resolver == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, c.Resolver)
+		},
+	}
+}
+
+// checkDNS verifies the ownership of every DNS SAN in the request, and returns
+// a denial with rule "dns" for the first one failing.
+func (c DNSCheckConfig) checkDNS(ctx context.Context, clients []string, request *SignRequest) policy.Decision {
+	ctx, cancel := context.WithTimeout(ctx, c.GetTimeout())
+	defer cancel()
+
+	return c.checkDNSWith(ctx, c.resolver(), clients, request)
+}
+
+func (c DNSCheckConfig) checkDNSWith(ctx context.Context, resolver dnsResolver, clients []string, request *SignRequest) policy.Decision {
+	cidrs, _ := parseCIDRs(c.CIDRs)
+	for _, name := range request.CsrPEM.DNSNames {
+		if c.exempt(name) {
+			continue
+		}
+		if err := c.verifyName(ctx, resolver, cidrs, clients, name); err != nil {
+			logFor("policy").WithFields(log.Fields{
+				"san":   name,
+				"error": err,
+			}).Debug("DNS ownership check failed")
+			return policy.Decision{
+				RuleID: "dns",
+				SAN:    name,
+				Reason: fmt.Sprintf("%s failed the DNS ownership check: %v", name, err),
+			}
+		}
+	}
+
+	return policy.Decision{Allowed: true}
+}
+
+// exempt returns true if the name matches one of the exempt patterns.
+func (c DNSCheckConfig) exempt(name string) bool {
+	for _, pattern := range c.Exempt {
+		if policy.MatchName(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c DNSCheckConfig) verifyName(ctx context.Context, resolver dnsResolver, cidrs []*net.IPNet, clients []string, name string) error {
+	// Wildcards are checked on their parent domain, in the zones allowing
+	// them only.
+	if parent, ok := strings.CutPrefix(name, "*."); ok {
+		if !inZones(parent, c.WildcardZones) {
+			return errors.New("wildcard names are not allowed in this zone")
+		}
+		name = parent
+	}
+
+	if c.TXTPrefix != "" {
+		records, _ := resolver.LookupTXT(ctx, c.TXTPrefix+"."+name)
+		for _, txt := range records {
+			if policy.ContainsAny(clients, strings.Fields(txt)) {
+				return nil
+			}
+		}
+	}
+
+	if len(c.Zones) > 0 {
+		// LookupCNAME returns the name itself when it has no CNAME record,
+		// which does not prove anything.
+		if cname, err := resolver.LookupCNAME(ctx, name); err == nil && !sameName(cname, name) && inZones(cname, c.Zones) {
+			return nil
+		}
+	}
+
+	if len(cidrs) > 0 {
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if !inCIDRs(addr.IP, cidrs) {
+				return errors.Errorf("%s is outside the allowed networks", addr.IP)
+			}
+		}
+		if len(addrs) > 0 {
+			return nil
+		}
+	}
+
+	return errors.New("no matching address, CNAME or TXT record")
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+func inCIDRs(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameName returns true if the DNS names are equal, ignoring the case and
+// the final dot.
+func sameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// inZones returns true if name is one of the zones or a subdomain of one.
+func inZones(name string, zones []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, z := range zones {
+		z = strings.ToLower(strings.TrimSuffix(z, "."))
+		if name == z || strings.HasSuffix(name, "."+z) {
+			return true
+		}
+	}
+
+	return false
+}
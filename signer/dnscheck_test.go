@@ -0,0 +1,107 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/smallstep/certificates/api"
+)
+
+// fakeResolver answers from maps, like a resolver without recursion.
+type fakeResolver struct {
+	txt   map[string][]string
+	cname map[string]string
+	addrs map[string][]string
+}
+
+func (f fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if r, ok := f.txt[name]; ok {
+		return r, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// LookupCNAME returns the name itself when it has no CNAME, like
+// net.Resolver.
+func (f fakeResolver) LookupCNAME(_ context.Context, host string) (string, error) {
+	if c, ok := f.cname[host]; ok {
+		return c + ".", nil
+	}
+	return host + ".", nil
+}
+
+func (f fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, a := range f.addrs[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func dnsRequest(names ...string) *SignRequest {
+	return &SignRequest{CsrPEM: api.CertificateRequest{CertificateRequest: &x509.CertificateRequest{DNSNames: names}}}
+}
+
+func TestCheckDNS(t *testing.T) {
+	resolver := fakeResolver{
+		txt:   map[string][]string{"_ca-signer.txt.example.com": {"web other"}},
+		cname: map[string]string{"alias.example.com": "lb.svc.internal", "outside.example.com": "lb.elsewhere.com"},
+		addrs: map[string][]string{
+			"inside.example.com":  {"10.0.0.1"},
+			"mixed.example.com":   {"10.0.0.1", "192.0.2.1"},
+			"wild.example.com":    {"10.0.0.2"},
+			"svc.internal":        {"192.0.2.9"},
+			"plain.svc.internal":  {"192.0.2.9"},
+			"nocheck.example.com": {"192.0.2.1"},
+		},
+	}
+	c := DNSCheckConfig{
+		Enabled:       true,
+		CIDRs:         []string{"10.0.0.0/8"},
+		Zones:         []string{"svc.internal"},
+		TXTPrefix:     "_ca-signer",
+		WildcardZones: []string{"wild.example.com"},
+		Exempt:        []string{"nocheck.*"},
+	}
+
+	tests := []struct {
+		name    string
+		allowed bool
+	}{
+		{"inside.example.com", true},
+		{"mixed.example.com", false},
+		{"txt.example.com", true},
+		{"alias.example.com", true},
+		{"outside.example.com", false},
+		// A name of the zone without a CNAME is not proven by the zone.
+		{"plain.svc.internal", false},
+		{"unknown.example.com", false},
+		{"*.wild.example.com", true},
+		{"*.inside.example.com", false},
+		{"nocheck.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := c.checkDNSWith(context.Background(), resolver, []string{"web"}, dnsRequest(tt.name))
+			if d.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v: %s", d.Allowed, tt.allowed, d.Reason)
+			}
+			if !d.Allowed && (d.RuleID != "dns" || d.SAN != tt.name) {
+				t.Errorf("denial = %+v, want rule dns for %s", d, tt.name)
+			}
+		})
+	}
+}
+
+func TestCheckDNSTXTOtherClient(t *testing.T) {
+	resolver := fakeResolver{txt: map[string][]string{"_ca-signer.txt.example.com": {"web"}}}
+	c := DNSCheckConfig{Enabled: true, TXTPrefix: "_ca-signer"}
+	if d := c.checkDNSWith(context.Background(), resolver, []string{"intruder"}, dnsRequest("txt.example.com")); d.Allowed {
+		t.Fatal("TXT record of another client allowed the name")
+	}
+}
@@ -0,0 +1,154 @@
+package signer
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// Modes of the dual issuance.
+const (
+	dualIssuanceReturn = "return"
+	dualIssuanceStore  = "store"
+)
+
+// DualIssuanceConfig issues the CSRs of /sign and /sign/raw with a second
+// upstream CA too, e.g. the CA of a new hierarchy during a migration, without
+// client changes. The secondary certificate is returned with the primary one
+// in the secondary field of the JSON responses ("return"), or only stored in
+// the inventory ("store"). Failures of the secondary CA are logged and
+// counted, the request still gets the primary certificate.
+type DualIssuanceConfig struct {
+	CaURL                   string   `yaml:"caURL"`
+	ProvisionerName         string   `yaml:"provisionerName"`
+	ProvisionerKid          string   `yaml:"provisionerKid"`
+	ProvisionerPasswordFile string   `yaml:"provisionerPasswordFile"`
+	Mode                    string   `yaml:"mode"`
+	Clients                 []string `yaml:"clients"`
+}
+
+// Enabled returns true if a secondary CA is configured.
+func (c DualIssuanceConfig) Enabled() bool {
+	return c.CaURL != ""
+}
+
+// GetMode returns what is done with the secondary certificates, defaults to
+// return.
+func (c DualIssuanceConfig) GetMode() string {
+	if c.Mode != "" {
+		return c.Mode
+	}
+
+	return dualIssuanceReturn
+}
+
+// Validate checks the CA URL and the mode.
+func (c DualIssuanceConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if u, err := url.Parse(c.CaURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.Errorf("invalid dualIssuance caURL %q, must be an https URL", c.CaURL)
+	}
+	switch c.GetMode() {
+	case dualIssuanceReturn, dualIssuanceStore:
+	default:
+		return errors.Errorf("invalid dualIssuance mode %q, must be return or store", c.Mode)
+	}
+
+	return nil
+}
+
+// appliesTo returns true if the requests of the clients are dual issued.
+func (c DualIssuanceConfig) appliesTo(clients []string) bool {
+	return len(c.Clients) == 0 || policy.ContainsAny(c.Clients, clients)
+}
+
+// dualIssuance is the issuance of a request with the secondary CA, running
+// while the primary CA signs it.
+type dualIssuance struct {
+	done chan struct{}
+	resp *api.SignResponse
+	err  error
+}
+
+// startDualIssuance signs a copy of the request with the secondary CA, if
+// dual issuance applies to the clients, and returns nil otherwise.
+func (s *server) startDualIssuance(ctx context.Context, clients []string, request *SignRequest) *dualIssuance {
+	if s.upstream(upstreamSecondary) == nil || !s.config.DualIssuance.appliesTo(clients) {
+		return nil
+	}
+
+	d := &dualIssuance{done: make(chan struct{})}
+	secondary := *request
+	go func() {
+		defer close(d.done)
+		d.resp, d.err = s.issueWith(ctx, upstreamSecondary, &secondary, nil)
+	}()
+
+	return d
+}
+
+// wait returns the secondary certificate, or nil if the secondary CA failed.
+// The primary certificate is nil if the primary CA failed.
+func (d *dualIssuance) wait(primary *api.SignResponse, requestID string) *api.SignResponse {
+	if d == nil {
+		return nil
+	}
+	<-d.done
+
+	fields := log.Fields{"request": requestID}
+	if primary != nil {
+		fields["serial"] = primary.ServerPEM.Certificate.SerialNumber.String()
+	}
+	switch {
+	case d.err != nil:
+		dualIssuances.WithLabelValues("error").Inc()
+		fields["error"] = d.err
+		logFor("server").WithFields(fields).Warn("Error issuing the secondary certificate")
+		return nil
+	case primary == nil:
+		// The secondary certificate is not used without a primary one.
+		dualIssuances.WithLabelValues("orphaned").Inc()
+		fields["secondarySerial"] = d.resp.ServerPEM.Certificate.SerialNumber.String()
+		logFor("server").WithFields(fields).Warn("Issued a secondary certificate without primary certificate")
+		return nil
+	}
+	dualIssuances.WithLabelValues("issued").Inc()
+	fields["secondarySerial"] = d.resp.ServerPEM.Certificate.SerialNumber.String()
+	logFor("server").WithFields(fields).Info("Issued secondary certificate")
+
+	return d.resp
+}
+
+// storeSecondary stores the secondary certificate of an issuance in the
+// inventory, with the serial number of the primary one.
+func (s *server) storeSecondary(event hookEvent, primary, secondary *api.SignResponse) {
+	if s.inventory == nil || secondary == nil {
+		return
+	}
+
+	rec := newCertificateRecord(secondary, issuanceMetadata{
+		IssuedAt:      event.Time,
+		RequestID:     event.RequestID,
+		Client:        event.Client,
+		Endpoint:      event.Endpoint,
+		Generation:    event.Generation,
+		Profile:       event.Profile,
+		Labels:        event.Metadata,
+		PrimarySerial: primary.ServerPEM.Certificate.SerialNumber.String(),
+	})
+	rec.RootFingerprint = s.rootFingerprint(secondary)
+	if err := s.inventory.Put(rec); err != nil {
+		inventoryErrors.Inc()
+		logFor("inventory").WithFields(log.Fields{
+			"serial": rec.Serial,
+			"error":  err,
+		}).Error("Error storing certificate in the inventory")
+	}
+}
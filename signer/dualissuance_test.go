@@ -0,0 +1,139 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/api"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+func TestDualIssuanceConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		c    DualIssuanceConfig
+		ok   bool
+	}{
+		{"disabled", DualIssuanceConfig{}, true},
+		{"return", DualIssuanceConfig{CaURL: "https://ca-next:9000"}, true},
+		{"store", DualIssuanceConfig{CaURL: "https://ca-next:9000", Mode: dualIssuanceStore}, true},
+		{"http", DualIssuanceConfig{CaURL: "http://ca-next:9000"}, false},
+		{"no host", DualIssuanceConfig{CaURL: "https:///"}, false},
+		{"mode", DualIssuanceConfig{CaURL: "https://ca-next:9000", Mode: "both"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	if mode := (DualIssuanceConfig{}).GetMode(); mode != dualIssuanceReturn {
+		t.Errorf("GetMode() = %s, want %s", mode, dualIssuanceReturn)
+	}
+
+	c := DualIssuanceConfig{Clients: []string{"web"}}
+	if !c.appliesTo([]string{"web"}) || c.appliesTo([]string{"ci"}) || !(DualIssuanceConfig{}).appliesTo([]string{"ci"}) {
+		t.Error("appliesTo() does not match the clients")
+	}
+}
+
+// newDualIssuanceTestServer returns a server issuing with a primary and a
+// secondary upstream CA, storing the certificates in an inventory.
+func newDualIssuanceTestServer(t *testing.T, c DualIssuanceConfig) (*server, *testUpstream) {
+	t.Helper()
+	s := newPolicyTestServer(policy.Config{})
+	s.config.DualIssuance = c
+	s.inventory = newTestInventory(t)
+	primary, secondary := newTestUpstream(t), newTestUpstream(t)
+	s.provisioner, s.secondary = primary.provisioner, secondary.provisioner
+	s.trustedRoots = []*x509.Certificate{primary.root, secondary.root}
+
+	return s, secondary
+}
+
+func TestSignDualIssuance(t *testing.T) {
+	issued := dualIssuances.WithLabelValues("issued")
+	before := testutil.ToFloat64(issued)
+
+	for _, mode := range []string{dualIssuanceReturn, dualIssuanceStore} {
+		s, secondary := newDualIssuanceTestServer(t, DualIssuanceConfig{CaURL: "https://ca-next:9000", Mode: mode})
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", strings.NewReader(`{"csr":`+mustJSON(t, newTestCSR(t, "www.example.com"))+`}`)), "web")
+		w := httptest.NewRecorder()
+		s.sign(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: status = %d: %s", mode, w.Code, w.Body)
+		}
+		var body struct {
+			api.SignResponse
+			Secondary *api.SignResponse `json:"secondary"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := body.Secondary != nil; got != (mode == dualIssuanceReturn) {
+			t.Fatalf("%s: secondary certificate returned = %v", mode, got)
+		}
+		if body.Secondary != nil && body.Secondary.ServerPEM.CheckSignatureFrom(secondary.intermediate) != nil {
+			t.Errorf("%s: secondary certificate issued by %s", mode, body.Secondary.ServerPEM.Issuer.CommonName)
+		}
+
+		primarySerial := body.ServerPEM.Certificate.SerialNumber.String()
+		rec, err := s.inventory.Get(primarySerial)
+		if err != nil || rec.Metadata.SecondarySerial == "" {
+			t.Fatalf("%s: primary record = %+v, %v", mode, rec, err)
+		}
+		stored, err := s.inventory.Get(rec.Metadata.SecondarySerial)
+		if err != nil || stored.Metadata.PrimarySerial != primarySerial || stored.Metadata.Endpoint != rec.Metadata.Endpoint {
+			t.Errorf("%s: secondary record = %+v, %v", mode, stored, err)
+		}
+	}
+	if got := testutil.ToFloat64(issued) - before; got != 2 {
+		t.Errorf("secondary certificates counted = %v, want 2", got)
+	}
+}
+
+func TestSignDualIssuanceFailure(t *testing.T) {
+	s, secondary := newDualIssuanceTestServer(t, DualIssuanceConfig{CaURL: "https://ca-next:9000", Clients: []string{"web"}})
+	secondary.Close()
+	failed := dualIssuances.WithLabelValues("error")
+	before := testutil.ToFloat64(failed)
+
+	for _, client := range []string{"web", "ci"} {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", strings.NewReader(`{"csr":`+mustJSON(t, newTestCSR(t, "www.example.com"))+`}`)), client)
+		w := httptest.NewRecorder()
+		s.sign(w, r)
+		if w.Code != http.StatusCreated || strings.Contains(w.Body.String(), `"secondary"`) {
+			t.Errorf("%s: status = %d: %s", client, w.Code, w.Body)
+		}
+	}
+	if got := testutil.ToFloat64(failed) - before; got != 1 {
+		t.Errorf("secondary failures counted = %v, want 1, for the web client only", got)
+	}
+}
+
+func TestDualIssuanceOrphaned(t *testing.T) {
+	s, _ := newDualIssuanceTestServer(t, DualIssuanceConfig{CaURL: "https://ca-next:9000"})
+	var request SignRequest
+	if err := json.Unmarshal([]byte(`{"csr":`+mustJSON(t, newTestCSR(t, "www.example.com"))+`}`), &request); err != nil {
+		t.Fatal(err)
+	}
+	orphaned := dualIssuances.WithLabelValues("orphaned")
+	before := testutil.ToFloat64(orphaned)
+
+	d := s.startDualIssuance(context.Background(), []string{"web"}, &request)
+	if got := d.wait(nil, "req-1"); got != nil {
+		t.Errorf("wait() without primary certificate = %v, want nil", got)
+	}
+	if got := testutil.ToFloat64(orphaned) - before; got != 1 {
+		t.Errorf("orphaned certificates counted = %v, want 1", got)
+	}
+	if got := (*dualIssuance)(nil).wait(nil, "req-2"); got != nil {
+		t.Errorf("wait() without dual issuance = %v, want nil", got)
+	}
+}
@@ -0,0 +1,287 @@
+package signer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// EmailVerificationConfig requires the email SANs of a CSR to be verified by
+// the client with a code sent by email before they are signed. Challenges and
+// verifications are kept in memory, so all the requests of a client must reach
+// the same replica.
+type EmailVerificationConfig struct {
+	Enabled     bool       `yaml:"enabled"`
+	Domains     []string   `yaml:"domains"`
+	CodeTTL     string     `yaml:"codeTTL"`
+	VerifiedTTL string     `yaml:"verifiedTTL"`
+	MaxAttempts int        `yaml:"maxAttempts"`
+	SMTP        SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig configures the server used to send the verification codes.
+type SMTPConfig struct {
+	Address      string `yaml:"address"`
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"passwordFile"`
+	From         string `yaml:"from"`
+}
+
+// GetCodeTTL returns how long a code is valid, defaults to 10m.
+func (c EmailVerificationConfig) GetCodeTTL() time.Duration {
+	if d, err := time.ParseDuration(c.CodeTTL); err == nil {
+		return d
+	}
+
+	return 10 * time.Minute
+}
+
+// GetVerifiedTTL returns how long a verified address can be signed, defaults
+// to 24h.
+func (c EmailVerificationConfig) GetVerifiedTTL() time.Duration {
+	if d, err := time.ParseDuration(c.VerifiedTTL); err == nil {
+		return d
+	}
+
+	return 24 * time.Hour
+}
+
+// GetMaxAttempts returns the number of wrong codes accepted before a
+// challenge is discarded, defaults to 5.
+func (c EmailVerificationConfig) GetMaxAttempts() int {
+	if c.MaxAttempts > 0 {
+		return c.MaxAttempts
+	}
+
+	return 5
+}
+
+// Validate checks the SMTP configuration.
+func (c EmailVerificationConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.SMTP.Address == "" || c.SMTP.From == "" {
+		return errors.New("emailVerification.smtp requires an address and a from address")
+	}
+	if _, _, err := net.SplitHostPort(c.SMTP.Address); err != nil {
+		return errors.Wrap(err, "invalid emailVerification.smtp address")
+	}
+
+	return nil
+}
+
+// allowedDomain returns true if codes can be sent to the address.
+func (c EmailVerificationConfig) allowedDomain(email string) bool {
+	if len(c.Domains) == 0 {
+		return true
+	}
+	i := strings.LastIndex(email, "@")
+	return i > 0 && inZones(email[i+1:], c.Domains)
+}
+
+// emailSender sends the verification codes.
+type emailSender interface {
+	Send(to, subject, body string) error
+}
+
+type smtpSender struct {
+	config SMTPConfig
+}
+
+func (s smtpSender) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.config.Username != "" {
+		password, err := readPasswordFromFile(s.config.PasswordFile)
+		if err != nil {
+			return errors.Wrap(err, "error reading smtp password")
+		}
+		host, _, _ := net.SplitHostPort(s.config.Address)
+		auth = smtp.PlainAuth("", s.config.Username, string(password), host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		s.config.From, to, subject, body)
+	return smtp.SendMail(s.config.Address, auth, s.config.From, []string{to}, []byte(msg))
+}
+
+// emailVerifier keeps the pending challenges and the verified addresses.
+// Both are bound to the identities of the client that requested them.
+type emailVerifier struct {
+	config EmailVerificationConfig
+	sender emailSender
+
+	mu         sync.Mutex
+	challenges map[string]*emailChallenge
+	verified   map[string]emailVerification
+}
+
+type emailChallenge struct {
+	clients  []string
+	code     [sha256.Size]byte
+	expires  time.Time
+	attempts int
+}
+
+type emailVerification struct {
+	clients []string
+	expires time.Time
+}
+
+func newEmailVerifier(config EmailVerificationConfig) *emailVerifier {
+	return &emailVerifier{
+		config:     config,
+		sender:     smtpSender{config: config.SMTP},
+		challenges: map[string]*emailChallenge{},
+		verified:   map[string]emailVerification{},
+	}
+}
+
+// EmailChallengeRequest is the body of POST /email/challenge and POST
+// /email/verify.
+type EmailChallengeRequest struct {
+	Email string `json:"email"`
+	Code  string `json:"code,omitempty"`
+}
+
+// challenge sends a verification code to the address in the request body.
+func (v *emailVerifier) challenge(w http.ResponseWriter, r *http.Request) {
+	var body EmailChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	if !strings.Contains(email, "@") {
+		render.Error(w, r, errs.BadRequest("invalid email address"))
+		return
+	}
+	if !v.config.allowedDomain(email) {
+		render.Error(w, r, errs.Forbidden("email domain is not allowed"))
+		return
+	}
+	clients := clientIdentities(r)
+	if len(clients) == 0 {
+		render.Error(w, r, errs.Forbidden("a client certificate is required"))
+		return
+	}
+
+	code, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	c := fmt.Sprintf("%06d", code)
+
+	ttl := v.config.GetCodeTTL()
+	text := fmt.Sprintf("Your verification code is %s.\r\n\r\nIt expires in %s. If you did not request a certificate for this address, ignore this message.", c, ttl)
+	if err := v.sender.Send(email, "Certificate request verification code", text); err != nil {
+		logFor("email").WithFields(log.Fields{"email": email, "error": err}).Error("Error sending verification code")
+		render.Error(w, r, errs.Wrap(http.StatusBadGateway, err, "error sending verification code"))
+		return
+	}
+
+	v.mu.Lock()
+	v.sweep(time.Now())
+	v.challenges[email] = &emailChallenge{
+		clients: clients,
+		code:    sha256.Sum256([]byte(c)),
+		expires: time.Now().Add(ttl),
+	}
+	v.mu.Unlock()
+
+	logFor("email").WithFields(log.Fields{"client": clients, "email": email}).Info("Sent email verification code")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verify confirms an address with the code sent by challenge.
+func (v *emailVerifier) verify(w http.ResponseWriter, r *http.Request) {
+	var body EmailChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	clients := clientIdentities(r)
+	sum := sha256.Sum256([]byte(strings.TrimSpace(body.Code)))
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	v.sweep(now)
+	c, ok := v.challenges[email]
+	if !ok || !policy.ContainsAny(c.clients, clients) {
+		render.Error(w, r, errs.Forbidden("no pending verification for this address"))
+		return
+	}
+	if subtle.ConstantTimeCompare(c.code[:], sum[:]) != 1 {
+		if c.attempts++; c.attempts >= v.config.GetMaxAttempts() {
+			delete(v.challenges, email)
+		}
+		render.Error(w, r, errs.Forbidden("invalid verification code"))
+		return
+	}
+
+	delete(v.challenges, email)
+	v.verified[email] = emailVerification{
+		clients: c.clients,
+		expires: now.Add(v.config.GetVerifiedTTL()),
+	}
+
+	logFor("email").WithFields(log.Fields{"client": clients, "email": email}).Info("Verified email address")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkEmails returns a denial with rule "email" for the first email SAN of
+// the request that the client has not verified.
+func (v *emailVerifier) checkEmails(clients []string, request *SignRequest) policy.Decision {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	for _, email := range request.CsrPEM.EmailAddresses {
+		ver, ok := v.verified[strings.ToLower(email)]
+		if !ok || now.After(ver.expires) || !policy.ContainsAny(ver.clients, clients) {
+			return policy.Decision{
+				RuleID: "email",
+				SAN:    email,
+				Reason: fmt.Sprintf("%s has not been verified, use /email/challenge and /email/verify first", email),
+			}
+		}
+	}
+
+	return policy.Decision{Allowed: true}
+}
+
+// sweep removes the expired challenges and verifications, v.mu must be held.
+func (v *emailVerifier) sweep(now time.Time) {
+	for k, c := range v.challenges {
+		if now.After(c.expires) {
+			delete(v.challenges, k)
+		}
+	}
+	for k, ver := range v.verified {
+		if now.After(ver.expires) {
+			delete(v.verified, k)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+func TestEmailVerificationConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    EmailVerificationConfig
+		ok   bool
+	}{
+		{"disabled", EmailVerificationConfig{}, true},
+		{"valid", EmailVerificationConfig{Enabled: true, SMTP: SMTPConfig{Address: "smtp:587", From: "pki@example.com"}}, true},
+		{"no from", EmailVerificationConfig{Enabled: true, SMTP: SMTPConfig{Address: "smtp:587"}}, false},
+		{"no port", EmailVerificationConfig{Enabled: true, SMTP: SMTPConfig{Address: "smtp", From: "pki@example.com"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	c := EmailVerificationConfig{Domains: []string{"example.com"}}
+	if !c.allowedDomain("alice@example.com") || !c.allowedDomain("bob@eu.example.com") || c.allowedDomain("eve@example.org") || c.allowedDomain("@example.com") {
+		t.Error("allowedDomain() does not match the domains")
+	}
+}
+
+// fakeEmailSender records the messages, or fails with err.
+type fakeEmailSender struct {
+	to, body string
+	err      error
+}
+
+func (f *fakeEmailSender) Send(to, subject, body string) error {
+	f.to, f.body = to, body
+	return f.err
+}
+
+// code returns the verification code of the last message.
+func (f *fakeEmailSender) code() string {
+	return regexp.MustCompile(`\d{6}`).FindString(f.body)
+}
+
+// newEmailTestRequest returns a sign request of client for the email
+// addresses.
+func newEmailTestRequest(t *testing.T, emails ...string) *SignRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{EmailAddresses: emails}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request SignRequest
+	csr := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	if err := json.Unmarshal([]byte(`{"csr":`+mustJSON(t, csr)+`}`), &request); err != nil {
+		t.Fatal(err)
+	}
+
+	return &request
+}
+
+func TestEmailVerification(t *testing.T) {
+	v := newEmailVerifier(EmailVerificationConfig{Enabled: true, Domains: []string{"example.com"}, MaxAttempts: 2})
+	sender := &fakeEmailSender{}
+	v.sender = sender
+	post := func(handler http.HandlerFunc, client, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/email", strings.NewReader(body))
+		if client != "" {
+			r = withIdentities(r, client)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	request := newEmailTestRequest(t, "Alice@example.com")
+	if d := v.checkEmails([]string{"web"}, request); d.Allowed || d.RuleID != "email" || d.SAN != "Alice@example.com" {
+		t.Errorf("checkEmails() before verification = %+v", d)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		client  string
+		body    string
+		status  int
+	}{
+		{"invalid", v.challenge, "web", `{"email":"alice"}`, http.StatusBadRequest},
+		{"domain", v.challenge, "web", `{"email":"eve@example.org"}`, http.StatusForbidden},
+		{"no client", v.challenge, "", `{"email":"alice@example.com"}`, http.StatusForbidden},
+		{"challenge", v.challenge, "web", `{"email":" Alice@Example.com "}`, http.StatusAccepted},
+		{"other client", v.verify, "other", `{"email":"alice@example.com","code":"CODE"}`, http.StatusForbidden},
+		{"wrong code", v.verify, "web", `{"email":"alice@example.com","code":"abcdef"}`, http.StatusForbidden},
+		{"verify", v.verify, "web", `{"email":"alice@example.com","code":"CODE"}`, http.StatusNoContent},
+		{"verified twice", v.verify, "web", `{"email":"alice@example.com","code":"CODE"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := post(tt.handler, tt.client, strings.ReplaceAll(tt.body, "CODE", sender.code())); got != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.status)
+		}
+	}
+	if sender.to != "alice@example.com" {
+		t.Errorf("code sent to %q", sender.to)
+	}
+
+	if d := v.checkEmails([]string{"web"}, request); !d.Allowed {
+		t.Errorf("checkEmails() after verification = %+v", d)
+	}
+	if d := v.checkEmails([]string{"other"}, request); d.Allowed {
+		t.Error("checkEmails() of another client allowed the address")
+	}
+	if d := v.checkEmails([]string{"web"}, newEmailTestRequest(t, "alice@example.com", "bob@example.com")); d.Allowed || d.SAN != "bob@example.com" {
+		t.Errorf("checkEmails() with an unverified address = %+v", d)
+	}
+
+	// The challenge is discarded after maxAttempts wrong codes.
+	post(v.challenge, "web", `{"email":"bob@example.com"}`)
+	code := sender.code()
+	for range 2 {
+		post(v.verify, "web", `{"email":"bob@example.com","code":"wrong"}`)
+	}
+	if got := post(v.verify, "web", `{"email":"bob@example.com","code":"`+code+`"}`); got != http.StatusForbidden {
+		t.Errorf("verify after too many attempts: status = %d, want 403", got)
+	}
+
+	sender.err = errors.New("connection refused")
+	if got := post(v.challenge, "web", `{"email":"carol@example.com"}`); got != http.StatusBadGateway {
+		t.Errorf("challenge with a failing SMTP server: status = %d, want 502", got)
+	}
+}
+
+func TestCheckPolicyEmails(t *testing.T) {
+	s := newPolicyTestServer(policy.Config{})
+	s.emails = newEmailVerifier(EmailVerificationConfig{Enabled: true})
+	r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), "web")
+	if pe, ok := s.checkPolicy(r, generationStable, newEmailTestRequest(t, "alice@example.com")).(*policyError); !ok || pe.RuleID != "email" {
+		t.Errorf("checkPolicy() of an unverified email = %v, want a denial by email", pe)
+	}
+}
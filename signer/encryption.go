@@ -0,0 +1,480 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// keysBucket holds the wrapped data keys of an encrypted store. It is not
+// encrypted itself.
+var keysBucket = []byte("keys")
+
+// encryptedMagic prefixes the encrypted values. Plaintext values, written
+// before the encryption was enabled, are JSON, decimal serial numbers or
+// small big-endian counters, which never start with 0xff.
+var encryptedMagic = []byte("\xffcse1")
+
+// EncryptionConfig encrypts the values of the inventory with AES-256-GCM
+// data keys, wrapped by AWS KMS or for age recipients.
+type EncryptionConfig struct {
+	KMS *KMSConfig `yaml:"kms"`
+	Age *AgeConfig `yaml:"age"`
+}
+
+// KMSConfig wraps the data keys with an AWS KMS key.
+type KMSConfig struct {
+	KeyID    string `yaml:"keyId"`
+	Region   string `yaml:"region"`
+	Endpoint string `yaml:"endpoint"`
+}
+
+// AgeConfig wraps the data keys for age X25519 recipients, and unwraps them
+// with the identities. Identities of former recipients can be kept to read
+// the keys wrapped before a rotation.
+type AgeConfig struct {
+	Recipients    []string `yaml:"recipients"`
+	IdentityFiles []string `yaml:"identityFiles"`
+}
+
+// Enabled returns true if an encryption is configured.
+func (c EncryptionConfig) Enabled() bool {
+	return c.KMS != nil || c.Age != nil
+}
+
+// Validate checks that one key provider is configured.
+func (c EncryptionConfig) Validate() error {
+	switch {
+	case c.KMS != nil && c.Age != nil:
+		return errors.New("inventory encryption kms and age cannot both be set")
+	case c.KMS != nil:
+		if c.KMS.KeyID == "" || c.KMS.Region == "" {
+			return errors.New("inventory encryption kms requires keyId and region")
+		}
+	case c.Age != nil:
+		if len(c.Age.Recipients) == 0 || len(c.Age.IdentityFiles) == 0 {
+			return errors.New("inventory encryption age requires recipients and identityFiles")
+		}
+		for _, r := range c.Age.Recipients {
+			if _, err := parseAgeRecipient(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// keyWrapper encrypts and decrypts the data keys.
+type keyWrapper interface {
+	Name() string
+	Wrap(plaintext []byte) ([]byte, error)
+	Unwrap(ciphertext []byte) ([]byte, error)
+}
+
+func newKeyWrapper(c EncryptionConfig) (keyWrapper, error) {
+	if c.KMS != nil {
+		return newKMSWrapper(*c.KMS)
+	}
+
+	return newAgeWrapper(*c.Age)
+}
+
+// dataKey is a wrapped data key in the keys bucket.
+type dataKey struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Wrapper string    `json:"wrapper"`
+	Wrapped []byte    `json:"wrapped"`
+}
+
+// keyring holds the unwrapped data keys. Values are encrypted with the
+// current key, the newest one; the others are unwrapped when a value
+// encrypted with them is read.
+type keyring struct {
+	wrapper keyWrapper
+
+	mu      sync.RWMutex
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// encryptedStore encrypts the values of a store, bound to their bucket and
+// key. The keys are not encrypted.
+type encryptedStore struct {
+	store.Store
+	keys *keyring
+}
+
+// newEncryptedStore loads the current data key of the store, and creates
+// one if there is none.
+func newEncryptedStore(db store.Store, c EncryptionConfig) (*encryptedStore, error) {
+	wrapper, err := newKeyWrapper(c)
+	if err != nil {
+		return nil, err
+	}
+	kr := &keyring{wrapper: wrapper, keys: map[string]cipher.AEAD{}}
+
+	var current *dataKey
+	err = db.View(func(tx store.Tx) error {
+		var err error
+		current, err = newestDataKey(tx.Bucket(keysBucket))
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading data keys")
+	}
+	if current == nil {
+		if current, err = kr.rotate(db); err != nil {
+			return nil, err
+		}
+	} else if err := kr.add(current); err != nil {
+		return nil, err
+	}
+	kr.current = current.ID
+
+	logFor("inventory").WithFields(log.Fields{
+		"key":     current.ID,
+		"wrapper": wrapper.Name(),
+	}).Info("Loaded inventory data key")
+
+	return &encryptedStore{Store: db, keys: kr}, nil
+}
+
+func newestDataKey(b store.Bucket) (*dataKey, error) {
+	var newest *dataKey
+	err := b.ForEach(func(_, v []byte) error {
+		k := new(dataKey)
+		if err := json.Unmarshal(v, k); err != nil {
+			return err
+		}
+		if newest == nil || k.Created.After(newest.Created) {
+			newest = k
+		}
+		return nil
+	})
+
+	return newest, err
+}
+
+// rotate creates a new data key, stores it wrapped and makes it current.
+func (kr *keyring) rotate(db store.Store) (*dataKey, error) {
+	key := make([]byte, 32)
+	id := make([]byte, 8)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	wrapped, err := kr.wrapper.Wrap(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error wrapping data key")
+	}
+
+	dk := &dataKey{ID: hex.EncodeToString(id), Created: time.Now().UTC(), Wrapper: kr.wrapper.Name(), Wrapped: wrapped}
+	data, err := json.Marshal(dk)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx store.Tx) error {
+		return tx.Bucket(keysBucket).Put([]byte(dk.ID), data)
+	}); err != nil {
+		return nil, errors.Wrap(err, "error storing data key")
+	}
+
+	aead, err := newDataKeyAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	kr.mu.Lock()
+	kr.keys[dk.ID], kr.current = aead, dk.ID
+	kr.mu.Unlock()
+
+	return dk, nil
+}
+
+// add unwraps a data key.
+func (kr *keyring) add(dk *dataKey) error {
+	if dk.Wrapper != kr.wrapper.Name() {
+		return errors.Errorf("data key %s is wrapped with %s", dk.ID, dk.Wrapper)
+	}
+	key, err := kr.wrapper.Unwrap(dk.Wrapped)
+	if err != nil {
+		return errors.Wrapf(err, "error unwrapping data key %s", dk.ID)
+	}
+	aead, err := newDataKeyAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	kr.mu.Lock()
+	kr.keys[dk.ID] = aead
+	kr.mu.Unlock()
+	return nil
+}
+
+// get returns a data key, unwrapping it from the keys bucket if needed,
+// e.g. when another replica rotated the keys.
+func (kr *keyring) get(tx store.Tx, id string) (cipher.AEAD, error) {
+	kr.mu.RLock()
+	aead, ok := kr.keys[id]
+	kr.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	data := tx.Bucket(keysBucket).Get([]byte(id))
+	if data == nil {
+		return nil, errors.Errorf("unknown data key %s", id)
+	}
+	dk := new(dataKey)
+	if err := json.Unmarshal(data, dk); err != nil {
+		return nil, err
+	}
+	if err := kr.add(dk); err != nil {
+		return nil, err
+	}
+
+	return kr.get(tx, id)
+}
+
+func newDataKeyAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptedAAD binds a value to its bucket and key, so values cannot be
+// swapped.
+func encryptedAAD(bucket, key []byte) []byte {
+	return append(append(append([]byte{}, bucket...), 0), key...)
+}
+
+// seal encrypts a value with the current key: the magic, the length and id
+// of the key, the nonce and the ciphertext.
+func (kr *keyring) seal(bucket, key, value []byte) ([]byte, error) {
+	kr.mu.RLock()
+	id, aead := kr.current, kr.keys[kr.current]
+	kr.mu.RUnlock()
+
+	out := append(append([]byte{}, encryptedMagic...), byte(len(id)))
+	out = append(out, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+
+	return aead.Seal(out, nonce, value, encryptedAAD(bucket, key)), nil
+}
+
+// open decrypts a value, and returns plaintext values as is.
+func (kr *keyring) open(tx store.Tx, bucket, key, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, encryptedMagic) {
+		return value, nil
+	}
+	rest := value[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, errors.New("invalid encrypted value")
+	}
+	id, rest := string(rest[1:1+int(rest[0])]), rest[1+int(rest[0]):]
+	aead, err := kr.get(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("invalid encrypted value")
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], encryptedAAD(bucket, key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decrypting %s/%s", bucket, key)
+	}
+
+	return plaintext, nil
+}
+
+func (s *encryptedStore) View(fn func(store.Tx) error) error {
+	return s.Store.View(func(tx store.Tx) error {
+		return s.run(tx, fn)
+	})
+}
+
+func (s *encryptedStore) Update(fn func(store.Tx) error) error {
+	return s.Store.Update(func(tx store.Tx) error {
+		return s.run(tx, fn)
+	})
+}
+
+func (s *encryptedStore) run(tx store.Tx, fn func(store.Tx) error) error {
+	etx := &encryptedTx{tx: tx, keys: s.keys}
+	if err := fn(etx); err != nil {
+		return err
+	}
+
+	return etx.err
+}
+
+// Compact compacts the underlying BoltDB file.
+func (s *encryptedStore) Compact() error {
+	if c, ok := s.Store.(interface{ Compact() error }); ok {
+		return c.Compact()
+	}
+
+	return nil
+}
+
+// encryptedTx is a transaction of an encrypted store. err records the first
+// error of a Get, which cannot return it.
+type encryptedTx struct {
+	tx   store.Tx
+	keys *keyring
+	err  error
+}
+
+func (t *encryptedTx) Bucket(name []byte) store.Bucket {
+	if bytes.Equal(name, keysBucket) {
+		return t.tx.Bucket(name)
+	}
+	return &encryptedBucket{tx: t, name: name, b: t.tx.Bucket(name)}
+}
+
+type encryptedBucket struct {
+	tx   *encryptedTx
+	name []byte
+	b    store.Bucket
+}
+
+func (b *encryptedBucket) Get(key []byte) []byte {
+	v := b.b.Get(key)
+	if v == nil {
+		return nil
+	}
+	v, err := b.tx.keys.open(b.tx.tx, b.name, key, v)
+	if err != nil {
+		if b.tx.err == nil {
+			b.tx.err = err
+		}
+		return nil
+	}
+
+	return v
+}
+
+func (b *encryptedBucket) Put(key, value []byte) error {
+	v, err := b.tx.keys.seal(b.name, key, value)
+	if err != nil {
+		return err
+	}
+
+	return b.b.Put(key, v)
+}
+
+func (b *encryptedBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b *encryptedBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(b.decrypt(fn))
+}
+
+func (b *encryptedBucket) ForEachAfter(after []byte, fn func(k, v []byte) error) error {
+	return b.b.ForEachAfter(after, b.decrypt(fn))
+}
+
+func (b *encryptedBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	return b.b.ForEachPrefix(prefix, b.decrypt(fn))
+}
+
+func (b *encryptedBucket) decrypt(fn func(k, v []byte) error) func(k, v []byte) error {
+	return func(k, v []byte) error {
+		v, err := b.tx.keys.open(b.tx.tx, b.name, k, v)
+		if err != nil {
+			return err
+		}
+		return fn(k, v)
+	}
+}
+
+// reencrypt encrypts all the values with a new data key, in batches. With
+// prune, it encrypts them with the current key instead and deletes the
+// others: the values written with a former key by replicas that did not
+// restart since the rotation would be lost.
+func (s *encryptedStore) reencrypt(prune bool, progress func(bucket string, n int)) error {
+	if !prune {
+		if _, err := s.keys.rotate(s.Store); err != nil {
+			return err
+		}
+	}
+	current := s.keys.current
+
+	for _, name := range storeBuckets {
+		if bytes.Equal(name, keysBucket) {
+			continue
+		}
+		var keys [][]byte
+		err := s.Store.View(func(tx store.Tx) error {
+			return tx.Bucket(name).ForEach(func(k, _ []byte) error {
+				keys = append(keys, append([]byte{}, k...))
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(keys); i += store.MigrateBatch {
+			batch := keys[i:min(i+store.MigrateBatch, len(keys))]
+			err := s.Update(func(tx store.Tx) error {
+				b := tx.Bucket(name)
+				for _, k := range batch {
+					if v := b.Get(k); v != nil {
+						if err := b.Put(k, v); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "error re-encrypting bucket %s", name)
+			}
+		}
+		progress(string(name), len(keys))
+	}
+
+	if !prune {
+		return nil
+	}
+	return s.Store.Update(func(tx store.Tx) error {
+		b := tx.Bucket(keysBucket)
+		var old [][]byte
+		err := b.ForEach(func(k, _ []byte) error {
+			if string(k) != current {
+				old = append(old, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,233 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// A data key wrapped by the age command line tool:
+//
+//	age -r age1w7ypchsgrk0e8sgps5qefcuuxyr8ve2gcdyqk87xsmeed8pfpg2szkwtgx -o dk.age dk.bin
+const (
+	testAgeIdentity = "AGE-SECRET-KEY-1UZR69FDCWH4MJDUFGXWK56S8PUCEMW4X0WELUZ22MXX4ZYMTGP8Q4A496Z"
+	testAgeWrapped  = "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBld0R5dDdtT0hvQmFaclFZYVhDbkNDWUIxVUJsWGdPSmVBb1FCdEVpK0IwCm4vWEdVcGQ4YXN4OTZiYkpvT1dwOTlXakc5Y2FBSUgxTWs0cHVobU5TbTAKLS0tIHdJdE1WTTEyTk5iWk9OeitCNWVuLzI2bzVDSjhiUDd3M1FIU1pZa1I4WXMKZfNwCuCxywOzWDcS/jHI4UfSiKrJkaUIg+CojODeqYXhSV8BMathCKYQPaqE6Fr0ylWDFPilOwuaOx9a+b5kQw=="
+	testDataKey     = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+)
+
+// newTestAgeConfig returns an age config for a new identity, written to a
+// temporary file.
+func newTestAgeConfig(t *testing.T) *AgeConfig {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "key.txt")
+	if err := writeFile(name, "# test identity\n"+id.String()+"\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	return &AgeConfig{Recipients: []string{id.Recipient().String()}, IdentityFiles: []string{name}}
+}
+
+func TestAgeWrapperVector(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "key.txt")
+	if err := writeFile(name, testAgeIdentity+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newAgeWrapper(AgeConfig{
+		Recipients:    []string{"age1w7ypchsgrk0e8sgps5qefcuuxyr8ve2gcdyqk87xsmeed8pfpg2szkwtgx"},
+		IdentityFiles: []string{name},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, _ := base64.StdEncoding.DecodeString(testAgeWrapped)
+	key, err := w.Unwrap(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(key) != testDataKey {
+		t.Errorf("Unwrap() = %x, want %s", key, testDataKey)
+	}
+}
+
+func TestAgeWrapperRoundTrip(t *testing.T) {
+	c := newTestAgeConfig(t)
+	w, err := newAgeWrapper(*c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{7}, 32)
+	wrapped, err := w.Wrap(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(wrapped, []byte("age-encryption.org/v1\n-> X25519 ")) {
+		t.Errorf("Wrap() = %q, want an age file", wrapped)
+	}
+	if got, err := w.Unwrap(wrapped); err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("Unwrap() = %x, %v, want %x", got, err, key)
+	}
+
+	other, err := newAgeWrapper(*newTestAgeConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Unwrap(wrapped); err == nil {
+		t.Error("Unwrap() with another identity error = nil")
+	}
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err := w.Unwrap(wrapped); err == nil {
+		t.Error("Unwrap() of a modified payload error = nil")
+	}
+}
+
+func TestAgeRecipientValidate(t *testing.T) {
+	c := EncryptionConfig{Age: &AgeConfig{Recipients: []string{"age1invalid"}, IdentityFiles: []string{"key.txt"}}}
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with an invalid recipient error = nil")
+	}
+}
+
+// fakeKMS implements Encrypt and Decrypt of the KMS JSON API, wrapping
+// with a fixed prefix, and records the requests.
+type fakeKMS struct {
+	targets []string
+	auth    []string
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.targets = append(f.targets, r.Header.Get("X-Amz-Target"))
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	var in struct {
+		KeyId             string
+		Plaintext         []byte
+		CiphertextBlob    []byte
+		EncryptionContext map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || !reflect.DeepEqual(in.EncryptionContext, kmsEncryptionContext) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"InvalidCiphertextException","message":"invalid request"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.Encrypt":
+		json.NewEncoder(w).Encode(map[string]any{"KeyId": in.KeyId, "CiphertextBlob": append([]byte(in.KeyId+":"), in.Plaintext...)})
+	case "TrentService.Decrypt":
+		keyID, plaintext, _ := bytes.Cut(in.CiphertextBlob, []byte(":"))
+		json.NewEncoder(w).Encode(map[string]any{"KeyId": string(keyID), "Plaintext": plaintext})
+	}
+}
+
+func TestKMSWrapperRoundTrip(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	fake := &fakeKMS{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	w, err := newKMSWrapper(KMSConfig{KeyID: "alias/ca-signer", Region: "eu-west-1", Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{7}, 32)
+	wrapped, err := w.Wrap(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := w.Unwrap(wrapped); err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("Unwrap() = %x, %v, want %x", got, err, key)
+	}
+
+	if want := []string{"TrentService.Encrypt", "TrentService.Decrypt"}; !reflect.DeepEqual(fake.targets, want) {
+		t.Errorf("targets = %v, want %v", fake.targets, want)
+	}
+	for _, auth := range fake.auth {
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDTEST/") || !strings.Contains(auth, "/eu-west-1/kms/aws4_request") {
+			t.Errorf("Authorization = %q, want a SigV4 signature for kms in eu-west-1", auth)
+		}
+	}
+}
+
+func TestKeyringOpenVector(t *testing.T) {
+	key, _ := hex.DecodeString(testDataKey)
+	aead, err := newDataKeyAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := &keyring{keys: map[string]cipher.AEAD{"0123abcd": aead}, current: "0123abcd"}
+
+	// The magic, the length and id of the key, a zero nonce and the
+	// AES-256-GCM ciphertext bound to certificates/1.
+	value, _ := hex.DecodeString("ff63736531083031323361626364000000000000000000000000759ec6bbc745e2d12a928b043a51a4eea67146eae3c5513c022e2717146c")
+	got, err := kr.open(nil, certificatesBucket, []byte("1"), value)
+	if err != nil || string(got) != `{"serial":"1"}` {
+		t.Fatalf("open() = %q, %v", got, err)
+	}
+	if _, err := kr.open(nil, certificatesBucket, []byte("2"), value); err == nil {
+		t.Error("open() of a value moved to another key error = nil")
+	}
+	if got, err := kr.open(nil, certificatesBucket, []byte("1"), []byte(`{"serial":"1"}`)); err != nil || string(got) != `{"serial":"1"}` {
+		t.Errorf("open() of a plaintext value = %q, %v", got, err)
+	}
+
+	sealed, err := kr.seal(certificatesBucket, []byte("1"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := kr.open(nil, certificatesBucket, []byte("1"), sealed); err != nil || string(got) != "value" {
+		t.Errorf("open() of a sealed value = %q, %v", got, err)
+	}
+}
+
+func TestEncryptedInventory(t *testing.T) {
+	c := InventoryConfig{
+		Path:       filepath.Join(t.TempDir(), "inventory.db"),
+		Encryption: EncryptionConfig{Age: newTestAgeConfig(t)},
+	}
+	inv, err := openInventory(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.Put(&certificateRecord{Serial: "1", Fingerprint: "fp1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var raw []byte
+	rawStore(inv.store).View(func(tx store.Tx) error {
+		raw = append(raw, tx.Bucket(certificatesBucket).Get([]byte("1"))...)
+		return nil
+	})
+	if !bytes.HasPrefix(raw, encryptedMagic) || bytes.Contains(raw, []byte("fp1")) {
+		t.Errorf("stored value = %q, want it encrypted", raw)
+	}
+	inv.Close()
+
+	// The data key is unwrapped again when the inventory is reopened.
+	if inv, err = openInventory(c); err != nil {
+		t.Fatal(err)
+	}
+	defer inv.Close()
+	if rec, err := inv.Get("1"); err != nil || rec == nil || rec.Fingerprint != "fp1" {
+		t.Fatalf("Get() = %v, %v, want the record", rec, err)
+	}
+}
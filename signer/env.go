@@ -0,0 +1,189 @@
+package signer
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// envPrefix is the prefix of the environment variables setting config
+// fields, e.g. CA_SIGNER_CA_URL sets caURL and CA_SIGNER_TIMEOUTS_SIGN sets
+// timeouts.sign.
+const envPrefix = "CA_SIGNER_"
+
+// configFileEnv is the environment variable with the path of the config
+// file when it is not given as an argument.
+const configFileEnv = envPrefix + "CONFIG"
+
+// applyEnv sets the config fields from the environment variables named
+// after their YAML path. Lists of strings are comma separated, maps of
+// strings are comma separated key=value pairs, and the other lists and maps,
+// e.g. policy.rules, are YAML or JSON.
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	_, err := applyEnvStruct(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(envPrefix, "_"), lookup)
+	return err
+}
+
+// applyEnvStruct sets the fields of the struct v, and returns true if any
+// was set.
+func applyEnvStruct(v reflect.Value, prefix string, lookup func(string) (string, bool)) (bool, error) {
+	var set bool
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		env := prefix + "_" + envName(name)
+		fv := v.Field(i)
+
+		switch {
+		case fv.Kind() == reflect.Struct:
+			ok, err := applyEnvStruct(fv, env, lookup)
+			if err != nil {
+				return false, err
+			}
+			set = set || ok
+			continue
+		case fv.Kind() == reflect.Pointer && fv.Type().Elem().Kind() == reflect.Struct:
+			p := reflect.New(fv.Type().Elem())
+			if !fv.IsNil() {
+				p.Elem().Set(fv.Elem())
+			}
+			ok, err := applyEnvStruct(p.Elem(), env, lookup)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				fv.Set(p)
+				set = true
+			}
+			continue
+		}
+
+		value, ok := lookup(env)
+		if !ok {
+			continue
+		}
+		if err := setEnvField(fv, value); err != nil {
+			return false, errors.Wrapf(err, "invalid %s", env)
+		}
+		set = true
+	}
+
+	return set, nil
+}
+
+// setEnvField parses value into the field v.
+func setEnvField(v reflect.Value, value string) error {
+	if v.Kind() == reflect.Pointer {
+		p := reflect.New(v.Type().Elem())
+		if err := setEnvField(p.Elem(), value); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var items []string
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					items = append(items, s)
+				}
+			}
+			v.Set(reflect.ValueOf(items).Convert(v.Type()))
+			return nil
+		}
+		return yaml.Unmarshal([]byte(value), v.Addr().Interface())
+	case reflect.Map:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "{") {
+			m := reflect.MakeMap(v.Type())
+			for _, pair := range strings.Split(value, ",") {
+				if pair = strings.TrimSpace(pair); pair == "" {
+					continue
+				}
+				k, val, ok := strings.Cut(pair, "=")
+				if !ok {
+					return errors.Errorf("invalid pair %q, must be key=value", pair)
+				}
+				m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), reflect.ValueOf(strings.TrimSpace(val)))
+			}
+			v.Set(m)
+			return nil
+		}
+		return yaml.Unmarshal([]byte(value), v.Addr().Interface())
+	default:
+		return yaml.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+
+	return nil
+}
+
+// envName converts a YAML field name to an environment variable name, e.g.
+// rootCAPath to ROOT_CA_PATH and serverSANs to SERVER_SANS.
+func envName(name string) string {
+	r := []rune(name)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := r[i-1]
+			// Split before a word, or before the last capital of an
+			// acronym followed by a word: caURL, rootCAPath. A plural s
+			// does not start a word: serverSANs.
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1]) &&
+				!(r[i+1] == 's' && (i+2 == len(r) || unicode.IsUpper(r[i+2])))
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+
+	return b.String()
+}
+
+// configFile returns the config file given as argument or in
+// CA_SIGNER_CONFIG, empty to configure the signer with the environment
+// only.
+func configFile(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+
+	return os.Getenv(configFileEnv)
+}
@@ -0,0 +1,60 @@
+package signer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"caURL", "CA_URL"},
+		{"rootCAPath", "ROOT_CA_PATH"},
+		{"serverSANs", "SERVER_SANS"},
+		{"maxIdleConnsPerHost", "MAX_IDLE_CONNS_PER_HOST"},
+		{"ipFamily", "IP_FAMILY"},
+		{"smime", "SMIME"},
+	}
+	for _, tt := range tests {
+		if got := envName(tt.name); got != tt.want {
+			t.Errorf("envName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"CA_SIGNER_CA_URL":                           "https://ca:9000",
+		"CA_SIGNER_SERVER_SANS":                      "signer.example.com, 10.0.0.1",
+		"CA_SIGNER_TIMEOUTS_SIGN":                    "20s",
+		"CA_SIGNER_RENEWAL_FRACTION":                 "0.5",
+		"CA_SIGNER_RENEWAL_STREAM_ENABLED":           "true",
+		"CA_SIGNER_UPSTREAM_HOSTS":                   `{"ca": ["10.0.0.1"]}`,
+		"CA_SIGNER_POLICY_RULES":                     `[{"id": "web", "action": "allow", "sans": ["*.example.com"]}]`,
+		"CA_SIGNER_RESPONSE_VALIDATION_VERIFY_CHAIN": "false",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	var c Config
+	if err := applyEnv(&c, lookup); err != nil {
+		t.Fatal(err)
+	}
+	if c.CaURL != "https://ca:9000" || !reflect.DeepEqual(c.ServerSANs, []string{"signer.example.com", "10.0.0.1"}) || c.Timeouts.Sign != "20s" {
+		t.Errorf("applyEnv() strings = %q, %q, %q", c.CaURL, c.ServerSANs, c.Timeouts.Sign)
+	}
+	if c.Renewal.Fraction != 0.5 || !c.Renewal.Stream.Enabled || c.ResponseValidation.GetVerifyChain() {
+		t.Errorf("applyEnv() scalars = %+v, %v", c.Renewal, c.ResponseValidation.GetVerifyChain())
+	}
+	if !reflect.DeepEqual(c.Upstream.Hosts, map[string][]string{"ca": {"10.0.0.1"}}) || len(c.Policy.Rules) != 1 || c.Policy.Rules[0].ID != "web" {
+		t.Errorf("applyEnv() structured values = %v, %+v", c.Upstream.Hosts, c.Policy.Rules)
+	}
+
+	env = map[string]string{"CA_SIGNER_RENEWAL_FRACTION": "half"}
+	if err := applyEnv(&Config{}, lookup); err == nil {
+		t.Error("applyEnv() of an invalid number error = nil")
+	}
+}
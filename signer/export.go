@@ -0,0 +1,255 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// ExportConfig configures the periodic export of the inventory records to
+// an object store, in CSV or Parquet.
+type ExportConfig struct {
+	Format   string            `yaml:"format"`
+	Interval string            `yaml:"interval"`
+	Store    ObjectStoreConfig `yaml:"store"`
+}
+
+// GetFormat returns the export format, defaults to csv.
+func (c ExportConfig) GetFormat() string {
+	if c.Format == "" {
+		return "csv"
+	}
+	return c.Format
+}
+
+// GetInterval returns how often the records are exported, defaults to 24h if
+// not specified or invalid.
+func (c ExportConfig) GetInterval() time.Duration {
+	if d, err := time.ParseDuration(c.Interval); err == nil && d > 0 {
+		return d
+	}
+
+	return 24 * time.Hour
+}
+
+// Validate checks the format, the interval and the object store.
+func (c ExportConfig) Validate() error {
+	switch c.GetFormat() {
+	case "csv", "parquet":
+	default:
+		return errors.Errorf("invalid inventory export format %q", c.Format)
+	}
+	if c.Interval != "" {
+		if d, err := time.ParseDuration(c.Interval); err != nil || d <= 0 {
+			return errors.Errorf("invalid inventory export interval %q", c.Interval)
+		}
+	}
+
+	return c.Store.Validate()
+}
+
+// exportColumns are the columns of the exported records.
+var exportColumns = []string{
+	"serial", "fingerprint", "subject", "sans", "not_before", "not_after",
+	"status", "revoked_at", "revocation_reason", "issued_at", "client",
+	"endpoint", "generation", "profile", "labels",
+}
+
+// exportRecord is the exported row of a record, with the exportColumns.
+// Timestamps are in milliseconds in Parquet, and revoked_at is null if the
+// certificate is not revoked.
+type exportRecord struct {
+	Serial           string     `parquet:"serial"`
+	Fingerprint      string     `parquet:"fingerprint"`
+	Subject          string     `parquet:"subject"`
+	SANs             string     `parquet:"sans"`
+	NotBefore        time.Time  `parquet:"not_before,timestamp(millisecond)"`
+	NotAfter         time.Time  `parquet:"not_after,timestamp(millisecond)"`
+	Status           string     `parquet:"status"`
+	RevokedAt        *time.Time `parquet:"revoked_at,optional,timestamp(millisecond)"`
+	RevocationReason string     `parquet:"revocation_reason"`
+	IssuedAt         time.Time  `parquet:"issued_at,timestamp(millisecond)"`
+	Client           string     `parquet:"client"`
+	Endpoint         string     `parquet:"endpoint"`
+	Generation       string     `parquet:"generation"`
+	Profile          string     `parquet:"profile"`
+	Labels           string     `parquet:"labels"`
+}
+
+// newExportRecord returns the exported row of a record.
+func newExportRecord(rec *certificateRecord, now time.Time) exportRecord {
+	return exportRecord{
+		Serial:           rec.Serial,
+		Fingerprint:      rec.Fingerprint,
+		Subject:          rec.Subject,
+		SANs:             strings.Join(rec.SANs, " "),
+		NotBefore:        rec.NotBefore,
+		NotAfter:         rec.NotAfter,
+		Status:           rec.status(now),
+		RevokedAt:        rec.RevokedAt,
+		RevocationReason: rec.RevocationReason,
+		IssuedAt:         rec.Metadata.IssuedAt,
+		Client:           strings.Join(rec.Metadata.Client, " "),
+		Endpoint:         rec.Metadata.Endpoint,
+		Generation:       rec.Metadata.Generation,
+		Profile:          rec.Metadata.Profile,
+		Labels:           formatMetadata(rec.Metadata.Labels),
+	}
+}
+
+// csvValues returns the values of the CSV columns, timestamps in RFC 3339
+// and empty if the certificate is not revoked.
+func (r exportRecord) csvValues() []string {
+	ts := func(t time.Time) string { return t.UTC().Format(time.RFC3339) }
+	var revokedAt string
+	if r.RevokedAt != nil {
+		revokedAt = ts(*r.RevokedAt)
+	}
+
+	return []string{
+		r.Serial, r.Fingerprint, r.Subject, r.SANs, ts(r.NotBefore), ts(r.NotAfter),
+		r.Status, revokedAt, r.RevocationReason, ts(r.IssuedAt), r.Client,
+		r.Endpoint, r.Generation, r.Profile, r.Labels,
+	}
+}
+
+// allPageSize is the number of records read per transaction by All.
+const allPageSize = 1000
+
+// All calls fn with every record of the inventory, in order of serial
+// number. Records are read in pages, each in its own transaction, and fn
+// runs outside of them.
+func (inv *inventory) All(fn func(*certificateRecord) error) error {
+	var cursor []byte
+	for {
+		var page []*certificateRecord
+		var next []byte
+		err := inv.view(func(tx store.Tx) error {
+			err := tx.Bucket(certificatesBucket).ForEachAfter(cursor, func(k, v []byte) error {
+				rec := new(certificateRecord)
+				if err := json.Unmarshal(v, rec); err != nil {
+					return err
+				}
+				page = append(page, rec)
+				if len(page) == allPageSize {
+					next = append([]byte{}, k...)
+					return errScanDone
+				}
+				return nil
+			})
+			if err == errScanDone {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, rec := range page {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// exportWriter encodes the exported rows.
+type exportWriter interface {
+	Write(exportRecord) error
+	Close() error
+}
+
+// newExportWriter returns the writer of a format to w, and its content type.
+func newExportWriter(format string, w io.Writer) (exportWriter, string) {
+	if format == "parquet" {
+		return &parquetExportWriter{w: parquet.NewGenericWriter[exportRecord](w)}, "application/vnd.apache.parquet"
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+	return &csvExportWriter{w: cw}, "text/csv"
+}
+
+// csvExportWriter writes CSV with a header.
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvExportWriter) Write(r exportRecord) error {
+	return c.w.Write(r.csvValues())
+}
+
+func (c *csvExportWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// parquetExportWriter writes a Parquet file.
+type parquetExportWriter struct {
+	w *parquet.GenericWriter[exportRecord]
+}
+
+func (p *parquetExportWriter) Write(r exportRecord) error {
+	_, err := p.w.Write([]exportRecord{r})
+	return err
+}
+
+func (p *parquetExportWriter) Close() error {
+	return p.w.Close()
+}
+
+// runExport writes a snapshot of all the inventory records to the object
+// store. A BoltDB inventory is local to each replica, so the key includes
+// the hostname of the replica. Records are read and encoded a page at a
+// time.
+func (s *server) runExport(ctx context.Context) error {
+	cfg := s.config.Inventory.Export
+	store, err := newObjectStore(cfg.Store)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var buf bytes.Buffer
+	w, contentType := newExportWriter(cfg.GetFormat(), &buf)
+	var n int
+	if err := s.inventory.All(func(rec *certificateRecord) error {
+		n++
+		return w.Write(newExportRecord(rec, now))
+	}); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "error encoding inventory export")
+	}
+	if n == 0 {
+		return nil
+	}
+
+	host, _ := os.Hostname()
+	key := "exports/" + host + "/" + now.UTC().Format("20060102T150405Z") + "." + cfg.GetFormat()
+	if err := store.Put(ctx, key, contentType, buf.Bytes()); err != nil {
+		return errors.Wrap(err, "error exporting inventory records")
+	}
+
+	logFor("inventory").WithFields(log.Fields{
+		"key":     key,
+		"records": n,
+	}).Info("Exported inventory records")
+	return nil
+}
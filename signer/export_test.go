@@ -0,0 +1,150 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func putTestRecords(t *testing.T, inv *inventory, n int, now time.Time) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		rec := &certificateRecord{
+			Serial:      strconv.Itoa(100000 + i),
+			Fingerprint: "fp" + strconv.Itoa(i),
+			Subject:     "host" + strconv.Itoa(i) + ".example.com",
+			SANs:        []string{"host" + strconv.Itoa(i) + ".example.com"},
+			NotBefore:   now.Add(-time.Hour),
+			NotAfter:    now.Add(time.Hour),
+			Metadata:    issuanceMetadata{IssuedAt: now.Add(-time.Hour), Client: []string{"client"}, Endpoint: "/sign"},
+		}
+		if i == 0 {
+			revoked := now.Add(-time.Minute)
+			rec.RevokedAt, rec.RevocationReason = &revoked, "keyCompromise"
+		}
+		if err := inv.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInventoryAllPages(t *testing.T) {
+	inv := newTestInventory(t)
+	putTestRecords(t, inv, allPageSize*2+3, time.Now())
+
+	var n int
+	var last string
+	err := inv.All(func(rec *certificateRecord) error {
+		if rec.Serial <= last {
+			t.Fatalf("All() returned %s after %s", rec.Serial, last)
+		}
+		last = rec.Serial
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != allPageSize*2+3 {
+		t.Fatalf("All() = %d records, want %d", n, allPageSize*2+3)
+	}
+}
+
+func exportRecords(t *testing.T, inv *inventory, format string, now time.Time) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, _ := newExportWriter(format, &buf)
+	err := inv.All(func(rec *certificateRecord) error {
+		return w.Write(newExportRecord(rec, now))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestExportParquetRoundTrip(t *testing.T) {
+	inv := newTestInventory(t)
+	now := time.Now().Truncate(time.Millisecond)
+	putTestRecords(t, inv, 3, now)
+
+	data := exportRecords(t, inv, "parquet", now)
+	rows, err := parquet.Read[exportRecord](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("read %d rows, want 3", len(rows))
+	}
+	first := rows[0]
+	if first.Serial != "100000" || first.Status != statusRevoked || first.RevocationReason != "keyCompromise" {
+		t.Fatalf("first row = %+v", first)
+	}
+	if first.RevokedAt == nil || !first.RevokedAt.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("revoked_at = %v, want %v", first.RevokedAt, now.Add(-time.Minute))
+	}
+	if !first.NotAfter.Equal(now.Add(time.Hour)) {
+		t.Fatalf("not_after = %v, want %v", first.NotAfter, now.Add(time.Hour))
+	}
+	if rows[1].RevokedAt != nil || rows[1].Status != statusValid {
+		t.Fatalf("second row = %+v, want a valid certificate", rows[1])
+	}
+
+	f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range f.Schema().Fields() {
+		if c.Name() != exportColumns[i] {
+			t.Fatalf("column %d = %s, want %s", i, c.Name(), exportColumns[i])
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	inv := newTestInventory(t)
+	now := time.Now()
+	putTestRecords(t, inv, 2, now)
+
+	records, err := csv.NewReader(bytes.NewReader(exportRecords(t, inv, "csv", now))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || len(records[0]) != len(exportColumns) || records[0][0] != "serial" {
+		t.Fatalf("csv = %v, want a header and 2 rows", records)
+	}
+	if records[1][7] != now.Add(-time.Minute).UTC().Format(time.RFC3339) || records[2][7] != "" {
+		t.Fatalf("revoked_at = %q, %q", records[1][7], records[2][7])
+	}
+}
+
+func TestExportInterval(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     time.Duration
+		valid    bool
+	}{
+		{"", 24 * time.Hour, true},
+		{"6h", 6 * time.Hour, true},
+		{"0s", 24 * time.Hour, false},
+		{"-6h", 24 * time.Hour, false},
+		{"hourly", 24 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		c := ExportConfig{Interval: tt.interval, Store: ObjectStoreConfig{Type: "file", Path: t.TempDir()}}
+		if got := c.GetInterval(); got != tt.want {
+			t.Errorf("%q: GetInterval() = %s, want %s", tt.interval, got, tt.want)
+		}
+		if err := c.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%q: Validate() = %v, want valid %v", tt.interval, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package signer
+
+import (
+	"crypto/x509"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// Extensions the signer does not pass on: they are set by the signer or the
+// upstream template from the request or the configuration.
+var standardExtensions = map[string]bool{
+	"2.5.29.14": true, // subjectKeyIdentifier
+	"2.5.29.15": true, // keyUsage
+	"2.5.29.17": true, // subjectAltName
+	"2.5.29.19": true, // basicConstraints
+	"2.5.29.30": true, // nameConstraints
+	"2.5.29.35": true, // authorityKeyIdentifier
+	"2.5.29.37": true, // extKeyUsage
+}
+
+// oidSCTPoison is the precertificate poison of Certificate Transparency, it
+// must never end up in an issued certificate.
+const oidSCTPoison = "1.3.6.1.4.1.11129.2.4.3"
+
+// ExtensionsConfig configures which other extensions requested in CSRs are
+// forwarded to the upstream templates. Unknown is what happens to the
+// extensions not allowed: "strip" (default), "deny" or "allow". The SCT
+// poison and the OIDs in Strip are always stripped.
+type ExtensionsConfig struct {
+	Unknown string           `yaml:"unknown"`
+	Allow   []ExtensionGrant `yaml:"allow"`
+	Strip   []string         `yaml:"strip"`
+}
+
+// ExtensionGrant allows the clients to request extensions with the given
+// OIDs. A grant without clients applies to every client.
+type ExtensionGrant struct {
+	OIDs    []string `yaml:"oids"`
+	Clients []string `yaml:"clients"`
+}
+
+// GetUnknown returns the action on extensions not allowed, defaults to
+// "strip".
+func (c ExtensionsConfig) GetUnknown() string {
+	if c.Unknown == "" {
+		return "strip"
+	}
+	return c.Unknown
+}
+
+// Validate checks the action and the OIDs.
+func (c ExtensionsConfig) Validate() error {
+	switch c.GetUnknown() {
+	case "strip", "deny", "allow":
+	default:
+		return errors.Errorf("invalid extensions.unknown %q", c.Unknown)
+	}
+	oids := append([]string{}, c.Strip...)
+	for _, g := range c.Allow {
+		oids = append(oids, g.OIDs...)
+	}
+	for _, oid := range oids {
+		if _, err := x509.ParseOID(oid); err != nil {
+			return errors.Wrapf(err, "invalid extension OID %q", oid)
+		}
+	}
+
+	return nil
+}
+
+// requestedExtension is an extension forwarded to the upstream template as
+// .Insecure.User.extensions, in the format of step-ca templates.
+type requestedExtension struct {
+	ID       string `json:"id"`
+	Critical bool   `json:"critical"`
+	Value    []byte `json:"value"`
+}
+
+// checkExtensions sorts the extensions requested in the CSR in forwarded and
+// stripped ones, and returns a denial with rule "extension" if an extension
+// is not allowed and unknown is "deny".
+func (c ExtensionsConfig) checkExtensions(clients []string, request *SignRequest) policy.Decision {
+	request.extensions, request.strippedExtensions = nil, nil
+	for _, ext := range request.CsrPEM.Extensions {
+		oid := ext.Id.String()
+		if standardExtensions[oid] {
+			continue
+		}
+
+		action := c.GetUnknown()
+		switch {
+		case oid == oidSCTPoison || policy.ContainsAny(c.Strip, []string{oid}):
+			action = "strip"
+		case c.allowed(clients, oid):
+			action = "allow"
+		}
+
+		switch action {
+		case "allow":
+			request.extensions = append(request.extensions, requestedExtension{ID: oid, Critical: ext.Critical, Value: ext.Value})
+		case "deny":
+			return policy.Decision{RuleID: "extension", Reason: "extension " + oid + " is not allowed"}
+		default:
+			request.strippedExtensions = append(request.strippedExtensions, oid)
+		}
+	}
+	if len(request.strippedExtensions) > 0 {
+		logFor("policy").WithFields(log.Fields{
+			"client":     clients,
+			"extensions": request.strippedExtensions,
+		}).Info("Stripped requested extensions")
+	}
+
+	return policy.Decision{Allowed: true}
+}
+
+func (c ExtensionsConfig) allowed(clients []string, oid string) bool {
+	for _, g := range c.Allow {
+		if policy.ContainsAny(g.OIDs, []string{oid}) && (len(g.Clients) == 0 || policy.ContainsAny(g.Clients, clients)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyExtensions fails if the issued certificate carries an extension that
+// was stripped from the request, or the SCT poison.
+func verifyExtensions(request *SignRequest, cert *x509.Certificate) error {
+	for _, ext := range cert.Extensions {
+		oid := ext.Id.String()
+		if oid == oidSCTPoison || policy.ContainsAny(request.strippedExtensions, []string{oid}) {
+			return errors.Errorf("certificate carries the stripped extension %s", oid)
+		}
+	}
+
+	return nil
+}
+
+// withExtensions adds the forwarded extensions of the request to the
+// template data.
+func withExtensions(templateData json.RawMessage, request *SignRequest) (json.RawMessage, error) {
+	if len(request.extensions) == 0 {
+		return templateData, nil
+	}
+
+	data := map[string]interface{}{}
+	if len(templateData) > 0 {
+		if err := json.Unmarshal(templateData, &data); err != nil {
+			return nil, err
+		}
+	}
+	data["extensions"] = request.extensions
+
+	return json.Marshal(data)
+}
@@ -0,0 +1,144 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/smallstep/certificates/api"
+)
+
+var (
+	oidTestAllowed = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	oidTestOther   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+	oidTestPoison  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+)
+
+// newExtensionsRequest returns a sign request of a CSR for app.example.com
+// requesting the extensions.
+func newExtensionsRequest(t *testing.T, oids ...asn1.ObjectIdentifier) *SignRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "app.example.com"}, DNSNames: []string{"app.example.com"}}
+	for _, oid := range oids {
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, pkix.Extension{Id: oid, Critical: oid.Equal(oidTestAllowed), Value: []byte{0x05, 0x00}})
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &SignRequest{CsrPEM: api.CertificateRequest{CertificateRequest: csr}}
+}
+
+func TestCheckExtensions(t *testing.T) {
+	grant := []ExtensionGrant{{OIDs: []string{oidTestAllowed.String()}, Clients: []string{"hsm"}}}
+	tests := []struct {
+		name      string
+		c         ExtensionsConfig
+		client    string
+		forwarded []string
+		stripped  []string
+		denied    bool
+	}{
+		{"default", ExtensionsConfig{}, "hsm", nil, []string{"1.3.6.1.4.1.99999.1", "1.3.6.1.4.1.99999.2", oidSCTPoison}, false},
+		{"granted", ExtensionsConfig{Allow: grant}, "hsm", []string{"1.3.6.1.4.1.99999.1"}, []string{"1.3.6.1.4.1.99999.2", oidSCTPoison}, false},
+		{"not granted", ExtensionsConfig{Allow: grant}, "web", nil, []string{"1.3.6.1.4.1.99999.1", "1.3.6.1.4.1.99999.2", oidSCTPoison}, false},
+		{"allow", ExtensionsConfig{Unknown: "allow", Strip: []string{"1.3.6.1.4.1.99999.2"}}, "web", []string{"1.3.6.1.4.1.99999.1"}, []string{"1.3.6.1.4.1.99999.2", oidSCTPoison}, false},
+		{"deny", ExtensionsConfig{Unknown: "deny", Allow: grant}, "web", nil, nil, true},
+	}
+	for _, tt := range tests {
+		request := newExtensionsRequest(t, oidTestAllowed, oidTestOther, oidTestPoison)
+		d := tt.c.checkExtensions([]string{tt.client}, request)
+		if d.Allowed == tt.denied || (tt.denied && d.RuleID != "extension") {
+			t.Errorf("%s: checkExtensions() = %+v, want denied %v", tt.name, d, tt.denied)
+			continue
+		}
+		if tt.denied {
+			continue
+		}
+		var forwarded []string
+		for _, ext := range request.extensions {
+			forwarded = append(forwarded, ext.ID)
+		}
+		if strings.Join(forwarded, ",") != strings.Join(tt.forwarded, ",") || strings.Join(request.strippedExtensions, ",") != strings.Join(tt.stripped, ",") {
+			t.Errorf("%s: forwarded %v, stripped %v, want %v, %v", tt.name, forwarded, request.strippedExtensions, tt.forwarded, tt.stripped)
+		}
+	}
+}
+
+func TestWithExtensions(t *testing.T) {
+	request := newExtensionsRequest(t, oidTestAllowed)
+	if got, err := withExtensions(json.RawMessage(`{"team":"hsm"}`), request); err != nil || string(got) != `{"team":"hsm"}` {
+		t.Errorf("withExtensions() without forwarded extensions = %s, %v, want the data unchanged", got, err)
+	}
+
+	ExtensionsConfig{Unknown: "allow"}.checkExtensions(nil, request)
+	got, err := withExtensions(json.RawMessage(`{"team":"hsm"}`), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		Team       string               `json:"team"`
+		Extensions []requestedExtension `json:"extensions"`
+	}
+	if err := json.Unmarshal(got, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Team != "hsm" || len(data.Extensions) != 1 || data.Extensions[0].ID != oidTestAllowed.String() ||
+		!data.Extensions[0].Critical || string(data.Extensions[0].Value) != "\x05\x00" {
+		t.Errorf("withExtensions() = %s, want the team and the critical extension", got)
+	}
+}
+
+func TestVerifyExtensions(t *testing.T) {
+	request := newExtensionsRequest(t, oidTestOther)
+	ExtensionsConfig{}.checkExtensions(nil, request)
+	leaf := func(oids ...asn1.ObjectIdentifier) *x509.Certificate {
+		c := &x509.Certificate{}
+		for _, oid := range oids {
+			c.Extensions = append(c.Extensions, pkix.Extension{Id: oid})
+		}
+		return c
+	}
+
+	if err := verifyExtensions(request, leaf(oidTestAllowed)); err != nil {
+		t.Errorf("verifyExtensions() = %v, want nil", err)
+	}
+	if err := verifyExtensions(request, leaf(oidTestOther)); err == nil {
+		t.Error("verifyExtensions() accepted a stripped extension")
+	}
+	if err := verifyExtensions(&SignRequest{}, leaf(oidTestPoison)); err == nil {
+		t.Error("verifyExtensions() accepted the SCT poison")
+	}
+}
+
+func TestExtensionsConfigValidate(t *testing.T) {
+	tests := []struct {
+		c  ExtensionsConfig
+		ok bool
+	}{
+		{ExtensionsConfig{}, true},
+		{ExtensionsConfig{Unknown: "deny", Allow: []ExtensionGrant{{OIDs: []string{"1.3.6.1.4.1.99999.1"}}}}, true},
+		{ExtensionsConfig{Unknown: "drop"}, false},
+		{ExtensionsConfig{Strip: []string{"not-an-oid"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v, want ok %v", tt.c, err, tt.ok)
+		}
+	}
+}
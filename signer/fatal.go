@@ -0,0 +1,89 @@
+package signer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes of the signer, so orchestrators can tell apart the failures that
+// need a config change from the ones that can be retried.
+const (
+	exitError         = 1
+	exitUsage         = 2
+	exitConfig        = 3
+	exitUpstream      = 4
+	exitListen        = 5
+	terminationLogEnv = "TERMINATION_LOG"
+	terminationLog    = "/dev/termination-log"
+)
+
+// exitCodeError is an error carrying the exit code the signer should use if
+// it is fatal.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode annotates err with an exit code.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &exitCodeError{code: code, err: err}
+}
+
+// exitCodeName returns a short name for the exit code, used in logs.
+func exitCodeName(code int) string {
+	switch code {
+	case exitUsage:
+		return "usage"
+	case exitConfig:
+		return "config"
+	case exitUpstream:
+		return "upstream"
+	case exitListen:
+		return "listen"
+	default:
+		return "error"
+	}
+}
+
+// fatal logs err and exits. The exit code is taken from err if it has one,
+// otherwise code is used. The message is also written to the Kubernetes
+// termination log so it shows in the pod status.
+func fatal(code int, err error, msg string) {
+	var ec *exitCodeError
+	if errors.As(err, &ec) {
+		code = ec.code
+	}
+
+	log.WithFields(log.Fields{
+		"event":    "fatal",
+		"exitCode": code,
+		"reason":   exitCodeName(code),
+		"error":    err,
+	}).Error(msg)
+
+	path := os.Getenv(terminationLogEnv)
+	if path == "" {
+		path = terminationLog
+	}
+	if f, err2 := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0); err2 == nil {
+		fmt.Fprintf(f, "%s (%s): %v\n", msg, exitCodeName(code), err)
+		f.Close()
+	}
+
+	os.Exit(code)
+}
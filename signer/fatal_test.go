@@ -0,0 +1,66 @@
+package signer
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFatal(t *testing.T) {
+	if os.Getenv("TEST_FATAL") != "" {
+		err := withExitCode(exitListen, errors.New("address already in use"))
+		fatal(exitError, errors.Wrap(err, "error binding listener"), "Error binding listener")
+		return
+	}
+
+	termLog := filepath.Join(t.TempDir(), "termination-log")
+	writeFile(termLog, "")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFatal$")
+	cmd.Env = append(os.Environ(), "TEST_FATAL=1", terminationLogEnv+"="+termLog)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitListen {
+		t.Fatalf("fatal() exited with %v, want exit status %d", err, exitListen)
+	}
+
+	data, err := os.ReadFile(termLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Error binding listener (listen): error binding listener: address already in use"; strings.TrimSpace(string(data)) != want {
+		t.Errorf("termination log = %q, want %q", data, want)
+	}
+}
+
+func TestWithExitCode(t *testing.T) {
+	if err := withExitCode(exitConfig, nil); err != nil {
+		t.Errorf("withExitCode(nil) = %v, want nil", err)
+	}
+
+	cause := errors.New("no such file")
+	err := withExitCode(exitConfig, cause)
+	if err.Error() != cause.Error() || !errors.Is(err, cause) {
+		t.Errorf("withExitCode() = %v, want it to wrap %v", err, cause)
+	}
+
+	tests := []struct {
+		code int
+		want string
+	}{
+		{exitError, "error"},
+		{exitUsage, "usage"},
+		{exitConfig, "config"},
+		{exitUpstream, "upstream"},
+		{exitListen, "listen"},
+		{42, "error"},
+	}
+	for _, tt := range tests {
+		if got := exitCodeName(tt.code); got != tt.want {
+			t.Errorf("exitCodeName(%d) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package signer
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Features gate the subsystems of the signer on top of their own
+// configuration, so that operators can roll them out one at a time. A
+// subsystem only runs if it is configured and its feature is enabled.
+const (
+	featureBatch         = "batch"
+	featureApprovals     = "approvals"
+	featureKeygen        = "keygen"
+	featureCloudIdentity = "cloudIdentity"
+	featureRenewalStream = "renewalStream"
+	featurePassthrough   = "passthrough"
+)
+
+// feature is a known feature and whether it is enabled when the features
+// map does not set it. Experimental features are disabled by default.
+type feature struct {
+	name    string
+	enabled bool
+}
+
+var knownFeatures = []feature{
+	{name: featureBatch, enabled: true},
+	{name: featureApprovals, enabled: true},
+	{name: featureKeygen, enabled: true},
+	{name: featureCloudIdentity, enabled: true},
+	{name: featureRenewalStream, enabled: true},
+	{name: featurePassthrough, enabled: false},
+}
+
+// validateFeatures checks that the features map only sets known features.
+func validateFeatures(features map[string]bool) error {
+	for name := range features {
+		if !slices.ContainsFunc(knownFeatures, func(f feature) bool { return f.name == name }) {
+			names := make([]string, len(knownFeatures))
+			for i, f := range knownFeatures {
+				names[i] = f.name
+			}
+			return errors.Errorf("unknown feature %q, must be one of %s", name, strings.Join(names, ", "))
+		}
+	}
+
+	return nil
+}
+
+// featureEnabled returns whether a feature is enabled, by the features map
+// or by default.
+func (c *Config) featureEnabled(name string) bool {
+	if enabled, ok := c.Features[name]; ok {
+		return enabled
+	}
+	for _, f := range knownFeatures {
+		if f.name == name {
+			return f.enabled
+		}
+	}
+
+	return false
+}
+
+// logFeatures logs the features and sets ca_signer_feature_enabled.
+func logFeatures(config *Config) {
+	fields := log.Fields{}
+	for _, f := range knownFeatures {
+		enabled := config.featureEnabled(f.name)
+		fields[f.name] = enabled
+		v := 0.0
+		if enabled {
+			v = 1
+		}
+		featureEnabled.WithLabelValues(f.name).Set(v)
+	}
+	logFor("server").WithFields(fields).Info("Features")
+}
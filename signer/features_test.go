@@ -0,0 +1,74 @@
+package signer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValidateFeatures(t *testing.T) {
+	if err := validateFeatures(map[string]bool{featureBatch: false, featurePassthrough: true}); err != nil {
+		t.Errorf("validateFeatures() = %v", err)
+	}
+	if err := validateFeatures(map[string]bool{"acme": true}); err == nil || !strings.Contains(err.Error(), `"acme"`) {
+		t.Errorf("validateFeatures() of an unknown feature = %v", err)
+	}
+}
+
+func TestFeatureEnabled(t *testing.T) {
+	tests := []struct {
+		features map[string]bool
+		name     string
+		want     bool
+	}{
+		{nil, featureBatch, true},
+		{nil, featurePassthrough, false},
+		{map[string]bool{featureBatch: false}, featureBatch, false},
+		{map[string]bool{featurePassthrough: true}, featurePassthrough, true},
+		{nil, "acme", false},
+	}
+	for _, tt := range tests {
+		c := &Config{Features: tt.features}
+		if got := c.featureEnabled(tt.name); got != tt.want {
+			t.Errorf("%v: featureEnabled(%s) = %v, want %v", tt.features, tt.name, got, tt.want)
+		}
+	}
+
+	logFeatures(&Config{Features: map[string]bool{featureKeygen: false}})
+	if testutil.ToFloat64(featureEnabled.WithLabelValues(featureKeygen)) != 0 || testutil.ToFloat64(featureEnabled.WithLabelValues(featureBatch)) != 1 {
+		t.Error("ca_signer_feature_enabled does not match the features")
+	}
+}
+
+func TestFeatureRoutes(t *testing.T) {
+	passthrough := PassthroughConfig{Allow: []PassthroughGrant{{Fields: []string{"notBefore"}}}}
+	tests := []struct {
+		features map[string]bool
+		batch    int
+	}{
+		{nil, http.StatusBadRequest},
+		{map[string]bool{featureBatch: false, featurePassthrough: true}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		s := &server{config: &Config{Batch: BatchConfig{Enabled: true}, Passthrough: passthrough, Features: tt.features}}
+		handler := s.routes()
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign/batch", strings.NewReader(`{`)), "web")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.batch {
+			t.Errorf("%v: /sign/batch status = %d, want %d", tt.features, w.Code, tt.batch)
+		}
+		if got := len(s.passthrough.Allow) > 0; got != tt.features[featurePassthrough] {
+			t.Errorf("%v: passthrough grants in effect = %v", tt.features, got)
+		}
+	}
+
+	s := &server{config: &Config{}}
+	r, request := newPolicyTestRequest(t, "web", "www.example.com")
+	if _, err := s.requestApproval(r, generationStable, request); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("requestApproval() with the approvals disabled = %v, want 400", err)
+	}
+}
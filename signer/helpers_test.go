@@ -0,0 +1,304 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/config"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/certificates/db"
+	"go.step.sm/crypto/jose"
+)
+
+// newTestCSR returns a PEM encoded CSR with a P-256 key for the DNS names,
+// the first one also being the common name.
+func newTestCSR(t testing.TB, names ...string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.CertificateRequest{DNSNames: names}
+	if len(names) > 0 {
+		tmpl.Subject = pkix.Name{CommonName: names[0]}
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+// newTestCert returns a self-signed CA certificate with a P-256 key, valid
+// for an hour.
+func newTestCert(t testing.TB, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// withIdentities returns r authenticated as the client identities, as the
+// trusted header and token authentication do.
+func withIdentities(r *http.Request, ids ...string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identitiesKey{}, ids))
+}
+
+// writeFile writes a test file readable by the owner only.
+func writeFile(name, content string) error {
+	return os.WriteFile(name, []byte(content), 0o600)
+}
+
+// newTestInventory returns an inventory in a BoltDB file of a temporary
+// directory, closed at the end of the test.
+func newTestInventory(t testing.TB) *inventory {
+	t.Helper()
+
+	inv, err := openInventory(InventoryConfig{Path: filepath.Join(t.TempDir(), "inventory.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inv.Close() })
+
+	return inv
+}
+
+// errorStatus returns the HTTP status of an error rendered by the handlers,
+// or 0 if it has none.
+func errorStatus(err error) int {
+	var sc render.StatusCodedError
+	if errors.As(err, &sc) {
+		return sc.StatusCode()
+	}
+
+	return 0
+}
+
+// issueTestCert returns a certificate with a P-256 key for cn signed by
+// parent, valid for an hour. It is a CA certificate if isCA is set, and a
+// server certificate for the DNS name or IP address cn otherwise.
+func issueTestCert(t testing.TB, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, cn string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{cn}
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.ExtKeyUsage, tmpl.DNSNames, tmpl.IPAddresses = nil, nil, nil
+		tmpl.BasicConstraintsValid, tmpl.IsCA = true, true
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+const testProvisionerPassword = "password"
+
+// testUpstream is an in-memory step-ca with a JWK provisioner, issuing with
+// an intermediate of a test root.
+type testUpstream struct {
+	*httptest.Server
+	root         *x509.Certificate
+	intermediate *x509.Certificate
+	provisioner  *ca.Provisioner
+
+	mu      sync.Mutex
+	revoked []string
+}
+
+// revocations returns the serial numbers of the revocation requests received.
+func (u *testUpstream) revocations() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.revoked...)
+}
+
+// testCATemplate is an X.509 template issuing CA certificates with the
+// template data of the intermediates, as the intermediate provisioner of a
+// step-ca set up for the signer does.
+const testCATemplate = `{
+	"subject": {{ toJson .Subject }},
+	"keyUsage": ["certSign", "crlSign"],
+	"basicConstraints": {"isCA": {{ .Insecure.User.isCA }}, "maxPathLen": {{ .Insecure.User.maxPathLen }}}
+	{{- with .Insecure.User.nameConstraints }},
+	"nameConstraints": {{ toJson . }}
+	{{- end }}
+}`
+
+// newTestUpstream starts an upstream CA, stopped at the end of the test.
+func newTestUpstream(t testing.TB) *testUpstream {
+	t.Helper()
+	return newTestUpstreamWithOptions(t, nil)
+}
+
+// newTestUpstreamWithOptions starts an upstream CA whose provisioner has the
+// options, e.g. a template, stopped at the end of the test.
+func newTestUpstreamWithOptions(t testing.TB, options *provisioner.Options) *testUpstream {
+	t.Helper()
+
+	root, rootKey := newTestCert(t, "Test Root CA")
+	intermediate, intermediateKey := issueTestCert(t, root, rootKey, "Test Intermediate CA", true)
+	serverCert, serverKey := issueTestCert(t, intermediate, intermediateKey, "127.0.0.1", false)
+
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := jose.EncryptJWK(jwk, []byte(testProvisionerPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := enc.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := jwk.Public()
+	authDB, err := db.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := authority.NewEmbedded(
+		authority.WithConfig(&config.Config{
+			AuthorityConfig: &config.AuthConfig{
+				Provisioners: provisioner.List{&provisioner.JWK{
+					Type:         "JWK",
+					Name:         "signer",
+					Key:          &pub,
+					EncryptedKey: encrypted,
+					Options:      options,
+				}},
+			},
+		}),
+		authority.WithX509RootCerts(root),
+		authority.WithX509Signer(intermediate, intermediateKey),
+		authority.WithDatabase(authDB),
+		authority.WithQuietInit(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := chi.NewRouter()
+	api.Route(mux)
+	mux.Route("/1.0", func(r chi.Router) {
+		api.Route(r)
+	})
+	up := &testUpstream{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/revoke") {
+			var req api.RevokeRequest
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if json.Unmarshal(body, &req) == nil {
+				up.mu.Lock()
+				up.revoked = append(up.revoked, req.Serial)
+				up.mu.Unlock()
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	srv.Config.BaseContext = func(net.Listener) context.Context {
+		return authority.NewContext(context.Background(), auth)
+	}
+	srv.TLS = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{serverCert.Raw, intermediate.Raw},
+			PrivateKey:  serverKey,
+		}},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	p, err := ca.NewProvisioner("signer", pub.KeyID, srv.URL, []byte(testProvisionerPassword),
+		ca.WithTransport(&http.Transport{TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up.Server, up.root, up.intermediate, up.provisioner = srv, root, intermediate, p
+
+	return up
+}
@@ -0,0 +1,274 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// Hook events.
+const (
+	hookPreSign    = "pre-sign"
+	hookPostSign   = "post-sign"
+	hookDenial     = "denial"
+	hookRevocation = "revocation"
+	hookAlert      = "alert"
+)
+
+// HookConfig configures a hook run on signer events. A hook either executes
+// Command with the event JSON on stdin, or posts the event JSON to URL.
+type HookConfig struct {
+	Name    string   `yaml:"name"`
+	Events  []string `yaml:"events"`
+	Command []string `yaml:"command"`
+	URL     string   `yaml:"url"`
+	Timeout string   `yaml:"timeout"`
+}
+
+// GetTimeout returns how long the hook may run, defaults to 10s.
+func (c HookConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 10 * time.Second
+}
+
+// Validate checks the hook events and action.
+func (c HookConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("hook is missing a name")
+	}
+	if (len(c.Command) == 0) == (c.URL == "") {
+		return errors.Errorf("hook %q must have exactly one of command or url", c.Name)
+	}
+	if len(c.Events) == 0 {
+		return errors.Errorf("hook %q has no events", c.Name)
+	}
+	for _, e := range c.Events {
+		switch e {
+		case hookPreSign, hookPostSign, hookDenial, hookRevocation, hookAlert:
+		default:
+			return errors.Errorf("invalid event %q in hook %q", e, c.Name)
+		}
+	}
+
+	return nil
+}
+
+// hookEvent is the JSON document passed to the hooks.
+type hookEvent struct {
+	Event            string            `json:"event"`
+	Time             time.Time         `json:"time"`
+	RequestID        string            `json:"requestId,omitempty"`
+	Client           []string          `json:"client"`
+	Endpoint         string            `json:"endpoint"`
+	Generation       string            `json:"generation,omitempty"`
+	Profile          string            `json:"profile,omitempty"`
+	Severity         string            `json:"severity,omitempty"`
+	Subject          string            `json:"subject,omitempty"`
+	SANs             []string          `json:"sans,omitempty"`
+	CSR              string            `json:"csr,omitempty"`
+	Certificate      string            `json:"certificate,omitempty"`
+	Serial           string            `json:"serial,omitempty"`
+	SecondarySerial  string            `json:"secondarySerial,omitempty"`
+	Decision         *policy.Decision  `json:"decision,omitempty"`
+	RevocationReason string            `json:"revocationReason,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+
+	SCTs []signedCertificateTimestamp `json:"scts,omitempty"`
+}
+
+// newHookEvent returns the event for a sign request from the client in r.
+func newHookEvent(r *http.Request, generation string, request *SignRequest) hookEvent {
+	csr := request.CsrPEM.CertificateRequest
+	event := hookEvent{
+		Time:       time.Now().UTC(),
+		RequestID:  requestID(r),
+		Client:     clientIdentities(r),
+		Endpoint:   r.URL.Path,
+		Generation: generation,
+		Profile:    request.Profile,
+		Severity:   sensitivityRoutine,
+		Subject:    csr.Subject.CommonName,
+		SANs:       requestSANs(request),
+		Metadata:   request.Metadata,
+		SCTs:       request.scts,
+	}
+	if !request.redactCSR {
+		event.CSR = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	}
+
+	return event
+}
+
+// withResponse adds the issued certificate to the event.
+func (e hookEvent) withResponse(resp *api.SignResponse) hookEvent {
+	if cert := resp.ServerPEM.Certificate; cert != nil {
+		e.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		e.Serial = cert.SerialNumber.String()
+	}
+
+	return e
+}
+
+// hookRunner runs the configured hooks. Pre-sign hooks run synchronously and
+// can deny a request, the other events are delivered in the background.
+type hookRunner struct {
+	hooks  []HookConfig
+	client *http.Client
+}
+
+func newHookRunner(hooks []HookConfig) *hookRunner {
+	return &hookRunner{hooks: hooks, client: &http.Client{}}
+}
+
+// PreSign runs the pre-sign hooks in order. A hook exiting with a non-zero
+// status or answering with a 4xx status denies the request with a policyError
+// whose rule is "hook:<name>", other failures are returned as upstream errors.
+func (h *hookRunner) PreSign(ctx context.Context, e hookEvent) error {
+	e.Event = hookPreSign
+	for _, hook := range h.hooks {
+		if !policy.ContainsAny(hook.Events, []string{hookPreSign}) {
+			continue
+		}
+		if err := h.run(ctx, hook, e); err != nil {
+			var he *hookError
+			if errors.As(err, &he) && he.denied {
+				return &policyError{Decision: policy.Decision{RuleID: "hook:" + hook.Name, Reason: he.msg}}
+			}
+			return errs.Wrapf(http.StatusBadGateway, err, "error running hook %s", hook.Name)
+		}
+	}
+
+	return nil
+}
+
+// Fire delivers an event to its hooks in the background.
+func (h *hookRunner) Fire(event string, e hookEvent) {
+	e.Event = event
+	for _, hook := range h.hooks {
+		if !policy.ContainsAny(hook.Events, []string{event}) {
+			continue
+		}
+		go func(hook HookConfig) {
+			if err := h.run(context.Background(), hook, e); err != nil {
+				logFor("hooks").WithFields(log.Fields{
+					"hook":  hook.Name,
+					"event": event,
+					"error": err,
+				}).Warn("Error running hook")
+			}
+		}(hook)
+	}
+}
+
+// hookError is the failure reported by a hook, denied is set if the hook ran
+// and rejected the event.
+type hookError struct {
+	denied bool
+	msg    string
+}
+
+func (e *hookError) Error() string {
+	return e.msg
+}
+
+func (h *hookRunner) run(ctx context.Context, hook HookConfig, e hookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hook.GetTimeout())
+	defer cancel()
+
+	if hook.URL != "" {
+		err = h.post(ctx, hook.URL, body)
+	} else {
+		err = execHook(ctx, hook.Command, body)
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+		var he *hookError
+		if errors.As(err, &he) && he.denied {
+			result = "denied"
+		}
+	}
+	hookRuns.WithLabelValues(hook.Name, e.Event, result).Inc()
+
+	return err
+}
+
+// execHook runs command with body on stdin. The output of a failed command is
+// used as the reason.
+func execHook(ctx context.Context, command []string, body []byte) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if ctx.Err() == nil && errors.As(err, &exitErr) {
+		return &hookError{denied: true, msg: hookReason(out.Bytes(), exitErr.Error())}
+	}
+
+	return errors.Wrap(err, "error running hook command")
+}
+
+// post sends body to url. The response body of a failed request is used as
+// the reason.
+func (h *hookRunner) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error calling hook")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &hookError{
+		denied: resp.StatusCode < 500,
+		msg:    hookReason(b, resp.Status),
+	}
+}
+
+func hookReason(out []byte, def string) string {
+	if s := strings.TrimSpace(string(out)); s != "" {
+		if len(s) > 512 {
+			s = s[:512]
+		}
+		return s
+	}
+
+	return def
+}
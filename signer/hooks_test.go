@@ -0,0 +1,112 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api/render"
+)
+
+func TestHookConfigValidate(t *testing.T) {
+	tests := []struct {
+		c  HookConfig
+		ok bool
+	}{
+		{HookConfig{Name: "ticket", Events: []string{hookPostSign}, URL: "https://tickets"}, true},
+		{HookConfig{Name: "dns", Events: []string{hookPreSign, hookDenial}, Command: []string{"/bin/check"}}, true},
+		{HookConfig{Events: []string{hookPostSign}, URL: "https://tickets"}, false},
+		{HookConfig{Name: "both", Events: []string{hookPostSign}, URL: "https://tickets", Command: []string{"/bin/check"}}, false},
+		{HookConfig{Name: "none", Events: []string{hookPostSign}}, false},
+		{HookConfig{Name: "idle", URL: "https://tickets"}, false},
+		{HookConfig{Name: "typo", Events: []string{"post-sing"}, URL: "https://tickets"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.c.Name, err, tt.ok)
+		}
+	}
+}
+
+func TestPreSignExecHook(t *testing.T) {
+	tests := []struct {
+		script string
+		denied string
+	}{
+		{`grep -q '"event":"pre-sign"'`, ""},
+		{`echo "foo.example.com is not in DNS"; exit 1`, "foo.example.com is not in DNS"},
+	}
+	for _, tt := range tests {
+		h := newHookRunner([]HookConfig{{Name: "dns", Events: []string{hookPreSign}, Command: []string{"sh", "-c", tt.script}}})
+		err := h.PreSign(context.Background(), hookEvent{SANs: []string{"foo.example.com"}})
+		var pe *policyError
+		switch {
+		case tt.denied == "" && err != nil:
+			t.Errorf("%s: PreSign() = %v, want nil", tt.script, err)
+		case tt.denied != "" && (!errors.As(err, &pe) || pe.Decision.RuleID != "hook:dns" || pe.Decision.Reason != tt.denied):
+			t.Errorf("%s: PreSign() = %v, want a denial by hook:dns with %q", tt.script, err, tt.denied)
+		}
+	}
+}
+
+func TestPreSignHTTPHook(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e hookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || e.Event != hookPreSign {
+			t.Errorf("hook received %+v, %v, want a pre-sign event", e, err)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("change freeze"))
+	}))
+	defer srv.Close()
+	h := newHookRunner([]HookConfig{{Name: "freeze", Events: []string{hookPreSign}, URL: srv.URL}})
+
+	status = http.StatusNoContent
+	if err := h.PreSign(context.Background(), hookEvent{}); err != nil {
+		t.Errorf("204: PreSign() = %v, want nil", err)
+	}
+
+	status = http.StatusForbidden
+	var pe *policyError
+	if err := h.PreSign(context.Background(), hookEvent{}); !errors.As(err, &pe) || pe.Decision.Reason != "change freeze" {
+		t.Errorf("403: PreSign() = %v, want a denial with the response body", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	var sc render.StatusCodedError
+	if err := h.PreSign(context.Background(), hookEvent{}); !errors.As(err, &sc) || sc.StatusCode() != http.StatusBadGateway {
+		t.Errorf("503: PreSign() = %v, want a 502 error", err)
+	}
+}
+
+func TestFireHook(t *testing.T) {
+	events := make(chan hookEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e hookEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer srv.Close()
+	h := newHookRunner([]HookConfig{{Name: "ticket", Events: []string{hookRevocation}, URL: srv.URL}})
+
+	h.Fire(hookPostSign, hookEvent{Serial: "1"})
+	h.Fire(hookRevocation, hookEvent{Serial: "2"})
+	select {
+	case e := <-events:
+		if e.Event != hookRevocation || e.Serial != "2" {
+			t.Errorf("hook received %s of %s, want the revocation of 2", e.Event, e.Serial)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("revocation hook was not called")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("hook received an unexpected %s event", e.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
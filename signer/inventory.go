@@ -0,0 +1,356 @@
+package signer
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+var (
+	certificatesBucket = []byte("certificates")
+	fingerprintsBucket = []byte("fingerprints")
+	failuresBucket     = []byte("failures")
+)
+
+// Certificate statuses.
+const (
+	statusValid   = "valid"
+	statusRevoked = "revoked"
+	statusExpired = "expired"
+)
+
+// InventoryConfig configures the inventory of the issued certificates, a
+// BoltDB file or a Postgres database shared by the replicas. The inventory
+// is disabled if neither is set.
+type InventoryConfig struct {
+	Path       string           `yaml:"path"`
+	Postgres   PostgresConfig   `yaml:"postgres"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Retention  RetentionConfig  `yaml:"retention"`
+	Export     *ExportConfig    `yaml:"export"`
+}
+
+// Enabled returns true if the inventory is configured.
+func (c InventoryConfig) Enabled() bool {
+	return c.Path != "" || c.Postgres.Enabled()
+}
+
+// certificateRecord is a certificate issued by the signer and its issuance
+// metadata.
+type certificateRecord struct {
+	Serial           string           `json:"serial"`
+	Fingerprint      string           `json:"fingerprint"`
+	Subject          string           `json:"subject"`
+	SANs             []string         `json:"sans"`
+	NotBefore        time.Time        `json:"notBefore"`
+	NotAfter         time.Time        `json:"notAfter"`
+	Status           string           `json:"status"`
+	RevokedAt        *time.Time       `json:"revokedAt,omitempty"`
+	RevocationReason string           `json:"revocationReason,omitempty"`
+	Certificate      string           `json:"certificate"`
+	Chain            []string         `json:"chain"`
+	RootFingerprint  string           `json:"rootFingerprint,omitempty"`
+	Metadata         issuanceMetadata `json:"metadata"`
+
+	// RotateBy and Campaigns are set when the certificate must be rotated
+	// for rotation campaigns, they are not stored.
+	RotateBy  *time.Time `json:"rotateBy,omitempty"`
+	Campaigns []string   `json:"campaigns,omitempty"`
+
+	SCTs []signedCertificateTimestamp `json:"scts,omitempty"`
+}
+
+// issuanceMetadata describes the request of a certificate.
+type issuanceMetadata struct {
+	IssuedAt   time.Time         `json:"issuedAt"`
+	RequestID  string            `json:"requestId,omitempty"`
+	Client     []string          `json:"client"`
+	Endpoint   string            `json:"endpoint"`
+	Generation string            `json:"generation,omitempty"`
+	Profile    string            `json:"profile,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+
+	// SecondarySerial is the serial number of the certificate issued with
+	// the secondary CA of a dual issuance, and PrimarySerial the one of the
+	// primary certificate of a secondary certificate.
+	SecondarySerial string `json:"secondarySerial,omitempty"`
+	PrimarySerial   string `json:"primarySerial,omitempty"`
+}
+
+// status returns the status of the certificate at the given time.
+func (c *certificateRecord) status(now time.Time) string {
+	switch {
+	case c.RevokedAt != nil:
+		return statusRevoked
+	case now.After(c.NotAfter):
+		return statusExpired
+	default:
+		return statusValid
+	}
+}
+
+// inventory stores the issued certificates by serial number, with an index
+// by SHA-256 fingerprint, in the store.
+type inventory struct {
+	store    store.Store
+	shared   bool
+	failures failureCounts
+}
+
+// openInventory opens or creates the inventory store.
+func openInventory(c InventoryConfig) (*inventory, error) {
+	db, err := openStore(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Encryption.Enabled() {
+		encrypted, err := newEncryptedStore(db, c.Encryption)
+		if err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "error loading inventory encryption")
+		}
+		db = encrypted
+	}
+
+	return &inventory{store: db, shared: c.Postgres.Enabled()}, nil
+}
+
+// Close closes the inventory store.
+func (inv *inventory) Close() error {
+	return inv.store.Close()
+}
+
+// view runs fn in a read-only transaction.
+func (inv *inventory) view(fn func(store.Tx) error) error {
+	return inv.store.View(fn)
+}
+
+// update runs fn in a read-write transaction.
+func (inv *inventory) update(fn func(store.Tx) error) error {
+	return inv.store.Update(fn)
+}
+
+// newCertificateRecord returns the record of an issued certificate.
+func newCertificateRecord(resp *api.SignResponse, md issuanceMetadata) *certificateRecord {
+	cert := resp.ServerPEM.Certificate
+	rec := &certificateRecord{
+		Serial:      cert.SerialNumber.String(),
+		Fingerprint: certificateFingerprint(cert),
+		Subject:     cert.Subject.CommonName,
+		SANs:        certificateSANs(cert),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Certificate: encodeCertificatePEM(cert),
+		Metadata:    md,
+	}
+	for _, c := range resp.CertChainPEM {
+		if c.Certificate != nil && !c.Certificate.Equal(cert) {
+			rec.Chain = append(rec.Chain, encodeCertificatePEM(c.Certificate))
+		}
+	}
+
+	return rec
+}
+
+// Put stores a certificate record.
+func (inv *inventory) Put(rec *certificateRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return inv.update(func(tx store.Tx) error {
+		if err := tx.Bucket(certificatesBucket).Put([]byte(rec.Serial), data); err != nil {
+			return err
+		}
+		return tx.Bucket(fingerprintsBucket).Put([]byte(rec.Fingerprint), []byte(rec.Serial))
+	})
+}
+
+// Get returns the record of a serial number, or nil if it does not exist.
+func (inv *inventory) Get(serial string) (*certificateRecord, error) {
+	var rec *certificateRecord
+	err := inv.view(func(tx store.Tx) (err error) {
+		rec, err = getRecord(tx, []byte(serial))
+		return err
+	})
+	if err != nil || rec == nil {
+		return nil, err
+	}
+
+	rec.Status = rec.status(time.Now())
+	return rec, nil
+}
+
+// GetByFingerprint returns the record of a SHA-256 fingerprint, or nil if it
+// does not exist. The index and the record are read in the same transaction.
+func (inv *inventory) GetByFingerprint(fingerprint string) (*certificateRecord, error) {
+	var rec *certificateRecord
+	err := inv.view(func(tx store.Tx) (err error) {
+		serial := tx.Bucket(fingerprintsBucket).Get([]byte(fingerprint))
+		if serial == nil {
+			return nil
+		}
+		rec, err = getRecord(tx, serial)
+		return err
+	})
+	if err != nil || rec == nil {
+		return nil, err
+	}
+
+	rec.Status = rec.status(time.Now())
+	return rec, nil
+}
+
+// getRecord decodes the record of a serial number in tx, or returns nil if
+// it does not exist.
+func getRecord(tx store.Tx, serial []byte) (*certificateRecord, error) {
+	data := tx.Bucket(certificatesBucket).Get(serial)
+	if data == nil {
+		return nil, nil
+	}
+	rec := new(certificateRecord)
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// issued records a certificate in the inventory, if enabled, and fires the
+// post-sign hooks. Inventory errors are logged, as the certificate has
+// already been issued.
+func (s *server) issued(event hookEvent, resp *api.SignResponse) {
+	event = event.withResponse(resp)
+	root := s.rootFingerprint(resp)
+	if root == "" {
+		root = "unknown"
+	}
+	issuedByRoot.WithLabelValues(root).Inc()
+
+	if s.inventory != nil {
+		rec := newCertificateRecord(resp, issuanceMetadata{
+			IssuedAt:   event.Time,
+			RequestID:  event.RequestID,
+			Client:     event.Client,
+			Endpoint:   event.Endpoint,
+			Generation: event.Generation,
+			Profile:    event.Profile,
+			Labels:     event.Metadata,
+
+			SecondarySerial: event.SecondarySerial,
+		})
+		if root != "unknown" {
+			rec.RootFingerprint = root
+		}
+		rec.SCTs = event.SCTs
+		if err := s.inventory.Put(rec); err != nil {
+			inventoryErrors.Inc()
+			logFor("inventory").WithFields(log.Fields{
+				"serial": rec.Serial,
+				"error":  err,
+			}).Error("Error storing certificate in the inventory")
+		}
+	}
+
+	s.submitCT(resp)
+	s.anomalies.Observe(event, resp.ServerPEM.Certificate)
+	s.hooks.Fire(hookPostSign, event)
+	if event.Severity == sensitivityHigh {
+		s.alert(event)
+	}
+}
+
+// getCertificate returns the inventory record of a serial number, in decimal
+// or hexadecimal.
+func (s *server) getCertificate(w http.ResponseWriter, r *http.Request) {
+	serial, ok := normalizeSerial(r.PathValue("serial"))
+	if !ok {
+		render.Error(w, r, errs.BadRequest("invalid serial number"))
+		return
+	}
+
+	rec, err := s.inventory.Get(serial)
+	if err == nil && rec != nil {
+		err = s.annotateCampaigns(rec)
+	}
+	s.renderRecord(w, r, rec, err)
+}
+
+// getCertificateByFingerprint returns the inventory record of a SHA-256
+// fingerprint in hexadecimal.
+func (s *server) getCertificateByFingerprint(w http.ResponseWriter, r *http.Request) {
+	fp := strings.ToLower(strings.ReplaceAll(r.PathValue("sha256"), ":", ""))
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+		render.Error(w, r, errs.BadRequest("invalid SHA-256 fingerprint"))
+		return
+	}
+
+	rec, err := s.inventory.GetByFingerprint(fp)
+	if err == nil && rec != nil {
+		err = s.annotateCampaigns(rec)
+	}
+	s.renderRecord(w, r, rec, err)
+}
+
+func (s *server) renderRecord(w http.ResponseWriter, r *http.Request, rec *certificateRecord, err error) {
+	switch {
+	case err != nil:
+		render.Error(w, r, errs.InternalServerErr(err))
+	case rec == nil:
+		render.Error(w, r, errs.NotFound("certificate not found"))
+	default:
+		render.JSON(w, r, rec)
+	}
+}
+
+// normalizeSerial returns the decimal form of a serial number given in
+// decimal, or in hexadecimal with an optional 0x prefix and colons.
+func normalizeSerial(s string) (string, bool) {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		h := strings.TrimPrefix(strings.ToLower(strings.ReplaceAll(s, ":", "")), "0x")
+		if n, ok = new(big.Int).SetString(h, 16); !ok {
+			return "", false
+		}
+	}
+
+	return n.String(), true
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func encodeCertificatePEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+// certificateSANs returns the DNS, email, IP and URI SANs of a certificate.
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+
+	return sans
+}
@@ -0,0 +1,72 @@
+package signer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+func TestInventoryGetByFingerprint(t *testing.T) {
+	inv := newTestInventory(t)
+	rec := &certificateRecord{
+		Serial:      "1234",
+		Fingerprint: "abcd",
+		Subject:     "example.com",
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+	}
+	if err := inv.Put(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inv.GetByFingerprint("abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Serial != "1234" || got.Status != statusValid {
+		t.Fatalf("GetByFingerprint() = %+v, want the valid record 1234", got)
+	}
+
+	if got, err := inv.GetByFingerprint("ef01"); err != nil || got != nil {
+		t.Fatalf("GetByFingerprint() = %+v, %v, want nil", got, err)
+	}
+}
+
+// failingStore is a Store whose transactions fail.
+type failingStore struct{}
+
+func (failingStore) View(func(store.Tx) error) error   { return errors.New("store unavailable") }
+func (failingStore) Update(func(store.Tx) error) error { return errors.New("store unavailable") }
+func (failingStore) Close() error                      { return nil }
+
+func TestInventoryGetByFingerprintError(t *testing.T) {
+	inv := &inventory{store: failingStore{}}
+	if _, err := inv.GetByFingerprint("abcd"); err == nil {
+		t.Fatal("GetByFingerprint() error = nil, want the store error")
+	}
+}
+
+func TestInventoryRevoke(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.Put(&certificateRecord{Serial: "1234", Fingerprint: "abcd", NotAfter: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := inv.Revoke("1234", time.Now(), "keyCompromise"); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := inv.Get("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != statusRevoked || rec.RevocationReason != "keyCompromise" {
+		t.Fatalf("Get() = %+v, want a revoked record", rec)
+	}
+
+	if err := inv.Revoke("5678", time.Now(), "keyCompromise"); err != errCertificateNotFound {
+		t.Fatalf("Revoke() of an unknown serial = %v, want errCertificateNotFound", err)
+	}
+}
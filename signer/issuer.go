@@ -0,0 +1,137 @@
+package signer
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// anomalyWrongIssuer is the anomaly reported when an upstream CA returns a
+// certificate from an unexpected hierarchy.
+const anomalyWrongIssuer = "unexpected-issuer"
+
+// ResponseValidationConfig configures the checks of the certificates
+// returned by the upstream CAs before they are returned to the clients.
+type ResponseValidationConfig struct {
+	VerifyChain     *bool    `yaml:"verifyChain"`
+	Issuers         []string `yaml:"issuers"`
+	AuthorityKeyIDs []string `yaml:"authorityKeyIds"`
+	StrictChain     bool     `yaml:"strictChain"`
+}
+
+// GetVerifyChain returns whether the returned chain must verify up to one
+// of the trusted roots, defaults to true.
+func (c ResponseValidationConfig) GetVerifyChain() bool {
+	return c.VerifyChain == nil || *c.VerifyChain
+}
+
+// Validate checks the authority key IDs.
+func (c ResponseValidationConfig) Validate() error {
+	for _, id := range c.AuthorityKeyIDs {
+		if _, err := hex.DecodeString(normalizeFingerprint(id)); err != nil || id == "" {
+			return errors.Errorf("invalid responseValidation authorityKeyId %q, must be hexadecimal", id)
+		}
+	}
+
+	return nil
+}
+
+// validateResponse repairs the chain returned by the upstream named name
+// and checks that the certificate chains to a trusted root and was issued by
+// one of the expected issuers. Rejections are logged, counted and reported
+// as anomalies.
+func (s *server) validateResponse(name string, resp *api.SignResponse) error {
+	cfg := s.config.ResponseValidation
+	leaf := resp.ServerPEM.Certificate
+	if leaf == nil {
+		return errs.New(http.StatusBadGateway, "upstream CA returned no certificate")
+	}
+	if err := s.repairChain(name, resp); err != nil {
+		return err
+	}
+
+	reason, err := checkResponse(cfg, leaf, responseChain(resp), s.trustedRoots)
+	if err == nil {
+		return nil
+	}
+
+	upstreamRejections.WithLabelValues(name, reason).Inc()
+	logFor("server").WithFields(log.Fields{
+		"upstream": name,
+		"reason":   reason,
+		"serial":   leaf.SerialNumber.String(),
+		"subject":  leaf.Subject.String(),
+		"issuer":   leaf.Issuer.String(),
+		"aki":      hex.EncodeToString(leaf.AuthorityKeyId),
+		"error":    err,
+	}).Error("Rejected certificate returned by the upstream CA")
+	s.anomalies.Report(anomaly{
+		Type:    anomalyWrongIssuer,
+		Time:    time.Now().UTC(),
+		Message: "upstream " + name + " returned a certificate issued by " + leaf.Issuer.String() + ": " + err.Error(),
+		Subject: leaf.Subject.String(),
+		Serial:  leaf.SerialNumber.String(),
+	})
+
+	return errs.Wrap(http.StatusBadGateway, err, "upstream CA returned a certificate from an unexpected issuer")
+}
+
+// checkResponse returns the reason, "chain", "issuer" or
+// "authority-key-id", and the error if leaf is not valid.
+func checkResponse(cfg ResponseValidationConfig, leaf *x509.Certificate, chain []api.Certificate, roots []*x509.Certificate) (string, error) {
+	if len(cfg.Issuers) > 0 {
+		issuer := leaf.Issuer.String()
+		if !policy.ContainsAny(cfg.Issuers, []string{issuer}) {
+			return "issuer", errors.Errorf("issuer %q is not expected", issuer)
+		}
+	}
+
+	if len(cfg.AuthorityKeyIDs) > 0 {
+		aki := hex.EncodeToString(leaf.AuthorityKeyId)
+		var ok bool
+		for _, id := range cfg.AuthorityKeyIDs {
+			if normalizeFingerprint(id) == aki {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return "authority-key-id", errors.Errorf("authority key id %q is not expected", aki)
+		}
+	}
+
+	if cfg.GetVerifyChain() {
+		opts := x509.VerifyOptions{
+			Roots:         x509.NewCertPool(),
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			CurrentTime:   signerClock.Now(),
+		}
+		// The CA may backdate or postdate the certificate a little, verify
+		// it while it is valid.
+		if opts.CurrentTime.Before(leaf.NotBefore) {
+			opts.CurrentTime = leaf.NotBefore
+		}
+		for _, root := range roots {
+			opts.Roots.AddCert(root)
+		}
+		for _, c := range chain {
+			if c.Certificate != nil && !c.Certificate.Equal(leaf) {
+				opts.Intermediates.AddCert(c.Certificate)
+			}
+		}
+		if _, err := leaf.Verify(opts); err != nil {
+			return "chain", errors.Wrap(err, "chain does not verify to a trusted root")
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,80 @@
+package signer
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/api"
+)
+
+func TestCheckResponse(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	intermediate, intermediateKey := issueTestCert(t, root, rootKey, "Intermediate CA", true)
+	leaf, _ := issueTestCert(t, intermediate, intermediateKey, "www.example.com", false)
+	other, _ := newTestCert(t, "Other Root CA")
+	chain := []api.Certificate{api.NewCertificate(leaf), api.NewCertificate(intermediate)}
+	aki := strings.ToUpper(hex.EncodeToString(intermediate.SubjectKeyId))
+	noVerify := false
+
+	tests := []struct {
+		name   string
+		cfg    ResponseValidationConfig
+		chain  []api.Certificate
+		roots  []*x509.Certificate
+		reason string
+	}{
+		{"default", ResponseValidationConfig{}, chain, []*x509.Certificate{root}, ""},
+		{"expected", ResponseValidationConfig{Issuers: []string{"CN=Intermediate CA"}, AuthorityKeyIDs: []string{aki}}, chain, []*x509.Certificate{other, root}, ""},
+		{"missing intermediate", ResponseValidationConfig{}, chain[:1], []*x509.Certificate{root}, "chain"},
+		{"untrusted", ResponseValidationConfig{}, chain, []*x509.Certificate{other}, "chain"},
+		{"not verified", ResponseValidationConfig{VerifyChain: &noVerify}, chain, []*x509.Certificate{other}, ""},
+		{"issuer", ResponseValidationConfig{Issuers: []string{"CN=Other CA"}}, chain, []*x509.Certificate{root}, "issuer"},
+		{"authority key id", ResponseValidationConfig{AuthorityKeyIDs: []string{"abcd"}}, chain, []*x509.Certificate{root}, "authority-key-id"},
+	}
+	for _, tt := range tests {
+		reason, err := checkResponse(tt.cfg, leaf, tt.chain, tt.roots)
+		if reason != tt.reason || (err == nil) != (tt.reason == "") {
+			t.Errorf("%s: checkResponse() = %q, %v, want %q", tt.name, reason, err, tt.reason)
+		}
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	leaf, _ := issueTestCert(t, root, rootKey, "www.example.com", false)
+	other, _ := newTestCert(t, "Other Root CA")
+	s := &server{config: &Config{}, trustedRoots: []*x509.Certificate{other}, anomalies: newAnomalyDetector(AnomalyConfig{})}
+	rejections := upstreamRejections.WithLabelValues("primary", "chain")
+	before := testutil.ToFloat64(rejections)
+
+	resp := &api.SignResponse{ServerPEM: api.NewCertificate(leaf), CaPEM: api.NewCertificate(root)}
+	if err := s.validateResponse("primary", resp); errorStatus(err) != http.StatusBadGateway {
+		t.Errorf("validateResponse() of an untrusted certificate = %v, want a 502", err)
+	}
+	if got := testutil.ToFloat64(rejections) - before; got != 1 {
+		t.Errorf("rejections counted = %v, want 1", got)
+	}
+
+	s.trustedRoots = []*x509.Certificate{root}
+	if err := s.validateResponse("primary", resp); err != nil {
+		t.Errorf("validateResponse() = %v", err)
+	}
+	if err := s.validateResponse("primary", &api.SignResponse{}); errorStatus(err) != http.StatusBadGateway {
+		t.Errorf("validateResponse() without a certificate = %v, want a 502", err)
+	}
+}
+
+func TestResponseValidationConfigValidate(t *testing.T) {
+	if err := (ResponseValidationConfig{AuthorityKeyIDs: []string{"AB:CD:EF"}}).Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	for _, id := range []string{"", "xyz"} {
+		if err := (ResponseValidationConfig{AuthorityKeyIDs: []string{id}}).Validate(); err == nil {
+			t.Errorf("Validate() of authority key id %q error = nil", id)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// oidJKSKeyProtector is the proprietary algorithm used by the Sun provider to
+// protect the keys in a JKS keystore.
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// encodeJKS returns a Java KeyStore with a single private key entry. The key
+// and the keystore use the same password, as keytool does by default.
+func encodeJKS(alias string, key interface{}, chain []*x509.Certificate, password string) ([]byte, error) {
+	plain, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding private key")
+	}
+	pass := jksPassword(password)
+	protected, err := protectJKSKey(plain, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := func(v interface{}) { binary.Write(&buf, binary.BigEndian, v) }
+	w(uint32(0xFEEDFEED))
+	w(uint32(2))
+	w(uint32(1))
+
+	w(uint32(1)) // private key entry
+	writeJKSUTF(&buf, alias)
+	w(uint64(time.Now().UnixMilli()))
+	w(uint32(len(protected)))
+	buf.Write(protected)
+	w(uint32(len(chain)))
+	for _, c := range chain {
+		writeJKSUTF(&buf, "X.509")
+		w(uint32(len(c.Raw)))
+		buf.Write(c.Raw)
+	}
+
+	h := sha1.New()
+	h.Write(pass)
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+
+	return buf.Bytes(), nil
+}
+
+// protectJKSKey encrypts a PKCS#8 key with the JKS key protector and returns
+// it as an EncryptedPrivateKeyInfo.
+func protectJKSKey(plain, pass []byte) ([]byte, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	encrypted := append([]byte{}, salt...)
+	digest := salt
+	for i := 0; i < len(plain); i += sha1.Size {
+		h := sha1.New()
+		h.Write(pass)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(plain); j++ {
+			encrypted = append(encrypted, plain[i+j]^digest[j])
+		}
+	}
+	check := sha1.Sum(append(append([]byte{}, pass...), plain...))
+	encrypted = append(encrypted, check[:]...)
+
+	return asn1.Marshal(struct {
+		Algorithm     pkix.AlgorithmIdentifier
+		EncryptedData []byte
+	}{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: encrypted,
+	})
+}
+
+// jksPassword returns the password as the big-endian UTF-16 bytes used by
+// the keystore digests.
+func jksPassword(password string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(password)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+
+	return b
+}
+
+// writeJKSUTF writes a string as Java's DataOutput.writeUTF does.
+func writeJKSUTF(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
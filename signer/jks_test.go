@@ -0,0 +1,134 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// readJKS parses a keystore with a single private key entry, checking its
+// integrity digest and recovering the key as the JDK does.
+func readJKS(t *testing.T, data []byte, password string) (string, interface{}, []*x509.Certificate) {
+	t.Helper()
+	pass := jksPassword(password)
+	body, mac := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	h := sha1.New()
+	h.Write(pass)
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), mac) {
+		t.Fatal("keystore integrity check failed")
+	}
+
+	r := bytes.NewReader(body)
+	var u32 uint32
+	read := func(v interface{}) {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readUTF := func() string {
+		var n uint16
+		read(&n)
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return string(b)
+	}
+	readBytes := func() []byte {
+		read(&u32)
+		b := make([]byte, u32)
+		io.ReadFull(r, b)
+		return b
+	}
+
+	var magic, version, count, tag uint32
+	read(&magic)
+	read(&version)
+	read(&count)
+	read(&tag)
+	if magic != 0xFEEDFEED || version != 2 || count != 1 || tag != 1 {
+		t.Fatalf("keystore header = %x %d %d %d, want a JKS v2 with one key entry", magic, version, count, tag)
+	}
+	alias := readUTF()
+	var date uint64
+	read(&date)
+
+	var info struct {
+		Algorithm     pkix.AlgorithmIdentifier
+		EncryptedData []byte
+	}
+	if _, err := asn1.Unmarshal(readBytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		t.Fatalf("key protector = %v, want %v", info.Algorithm.Algorithm, oidJKSKeyProtector)
+	}
+	enc := info.EncryptedData
+	salt, check := enc[:sha1.Size], enc[len(enc)-sha1.Size:]
+	enc = enc[sha1.Size : len(enc)-sha1.Size]
+	plain := make([]byte, len(enc))
+	digest := salt
+	for i := 0; i < len(enc); i += sha1.Size {
+		d := sha1.Sum(append(append([]byte{}, pass...), digest...))
+		digest = d[:]
+		for j := 0; j < sha1.Size && i+j < len(enc); j++ {
+			plain[i+j] = enc[i+j] ^ digest[j]
+		}
+	}
+	if sum := sha1.Sum(append(append([]byte{}, pass...), plain...)); !bytes.Equal(sum[:], check) {
+		t.Fatal("key protector check failed")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chain []*x509.Certificate
+	read(&count)
+	for i := uint32(0); i < count; i++ {
+		if typ := readUTF(); typ != "X.509" {
+			t.Fatalf("certificate type = %q, want X.509", typ)
+		}
+		cert, err := x509.ParseCertificate(readBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, cert)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("keystore has %d trailing bytes", r.Len())
+	}
+
+	return alias, key, chain
+}
+
+func TestEncodeJKS(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	leaf, key := issueTestCert(t, root, rootKey, "app.example.com", false)
+
+	data, err := encodeJKS("app", key, []*x509.Certificate{leaf, root}, "changeit-ü")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alias, got, chain := readJKS(t, data, "changeit-ü")
+	if alias != "app" {
+		t.Errorf("alias = %q, want app", alias)
+	}
+	if !key.Equal(got) {
+		t.Error("keystore key does not match the generated key")
+	}
+	if len(chain) != 2 || !chain[0].Equal(leaf) || !chain[1].Equal(root) {
+		t.Errorf("keystore chain has %d certificates, want the leaf and root", len(chain))
+	}
+}
+
+func TestJKSPassword(t *testing.T) {
+	if got, want := jksPassword("aé"), []byte{0, 'a', 0, 0xe9}; !bytes.Equal(got, want) {
+		t.Errorf("jksPassword() = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+package signer
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// job is a periodic background task that must only run on one replica,
+// unless it is local to each replica.
+type job struct {
+	name     string
+	interval time.Duration
+	local    bool
+	run      func(context.Context) error
+}
+
+// jobRunner runs the background jobs on the elected leader. Without leader
+// election the replica is always the leader.
+type jobRunner struct {
+	jobs []job
+}
+
+// Add registers a job running every interval.
+func (j *jobRunner) Add(name string, interval time.Duration, fn func(context.Context) error) {
+	j.jobs = append(j.jobs, job{name: name, interval: interval, run: fn})
+}
+
+// AddLocal registers a job running every interval on every replica, such as
+// the maintenance of local files.
+func (j *jobRunner) AddLocal(name string, interval time.Duration, fn func(context.Context) error) {
+	j.jobs = append(j.jobs, job{name: name, interval: interval, local: true, run: fn})
+}
+
+// Run starts the local jobs, and the other jobs when this replica becomes the
+// leader. They stop when it loses the leadership or ctx is done.
+func (j *jobRunner) Run(ctx context.Context, config LeaderElectionConfig) error {
+	j.start(ctx, true)
+	if !config.Enabled {
+		leaderGauge.Set(1)
+		j.start(ctx, false)
+		return nil
+	}
+
+	elector, err := newLeaderElector(config)
+	if err != nil {
+		return err
+	}
+
+	logFor("jobs").WithFields(log.Fields{
+		"lease":     config.GetLeaseName(),
+		"namespace": config.GetNamespace(),
+		"identity":  elector.identity,
+	}).Info("Starting leader election")
+	go elector.Run(ctx, func(ctx context.Context) {
+		j.start(ctx, false)
+	})
+	return nil
+}
+
+// start runs the local or leader jobs, each in its own goroutine, until ctx
+// is done.
+func (j *jobRunner) start(ctx context.Context, local bool) {
+	for _, jb := range j.jobs {
+		if jb.local != local {
+			continue
+		}
+		go func(jb job) {
+			ticker := time.NewTicker(jb.interval)
+			defer ticker.Stop()
+			for {
+				if err := jb.run(ctx); err != nil && ctx.Err() == nil {
+					logFor("jobs").WithFields(log.Fields{
+						"job":   jb.name,
+						"error": err,
+					}).Error("Background job failed")
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(jb)
+	}
+}
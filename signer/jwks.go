@@ -0,0 +1,179 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.step.sm/crypto/jose"
+)
+
+const (
+	// jwksTTL is how long a key set is used before it is downloaded again.
+	jwksTTL = time.Hour
+	// jwksMinRefresh is the minimum interval between two downloads of a key
+	// set, as tokens with unknown key ids trigger a download.
+	jwksMinRefresh = time.Minute
+	// maxJWKSSize is the maximum size of a downloaded key set.
+	maxJWKSSize = 1 << 20
+)
+
+// jwksCache downloads and caches the JSON web key sets that verify identity
+// tokens.
+type jwksCache struct {
+	client *http.Client
+
+	mu        sync.Mutex
+	sets      map[string]cachedKeySet
+	discovery map[string]string
+}
+
+type cachedKeySet struct {
+	keys    jose.JSONWebKeySet
+	fetched time.Time
+}
+
+func newJWKSCache(timeout time.Duration) *jwksCache {
+	return &jwksCache{
+		client:    &http.Client{Timeout: timeout},
+		sets:      map[string]cachedKeySet{},
+		discovery: map[string]string{},
+	}
+}
+
+// key returns the key kid of the set at url. The set is downloaded again
+// when it is older than jwksTTL, or when it does not have kid, e.g. after a
+// key rotation.
+func (c *jwksCache) key(ctx context.Context, url, kid string) (*jose.JSONWebKey, error) {
+	c.mu.Lock()
+	set, ok := c.sets[url]
+	c.mu.Unlock()
+
+	now := time.Now()
+	fresh := ok && now.Sub(set.fetched) < jwksTTL
+	if fresh {
+		if keys := set.keys.Key(kid); len(keys) > 0 {
+			return &keys[0], nil
+		}
+	}
+	if !fresh || now.Sub(set.fetched) >= jwksMinRefresh {
+		keys, err := c.fetch(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		set = cachedKeySet{keys: keys, fetched: now}
+		c.mu.Lock()
+		c.sets[url] = set
+		c.mu.Unlock()
+	}
+	if keys := set.keys.Key(kid); len(keys) > 0 {
+		return &keys[0], nil
+	}
+
+	return nil, errors.Errorf("key %q not found in %s", kid, url)
+}
+
+func (c *jwksCache) fetch(ctx context.Context, url string) (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return keys, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return keys, errors.Wrapf(err, "error downloading %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keys, errors.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&keys); err != nil {
+		return keys, errors.Wrapf(err, "invalid key set %s", url)
+	}
+
+	return keys, nil
+}
+
+// discover returns the key set URL of an OpenID Connect issuer, from its
+// discovery document.
+func (c *jwksCache) discover(ctx context.Context, issuer string) (string, error) {
+	c.mu.Lock()
+	url, ok := c.discovery[issuer]
+	c.mu.Unlock()
+	if ok {
+		return url, nil
+	}
+
+	doc := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, doc, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "error downloading %s", doc)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status %d from %s", resp.StatusCode, doc)
+	}
+	var config struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&config); err != nil {
+		return "", errors.Wrapf(err, "invalid discovery document %s", doc)
+	}
+	if config.Issuer != issuer || config.JWKSURI == "" {
+		return "", errors.Errorf("invalid discovery document %s: issuer %q, jwks_uri %q", doc, config.Issuer, config.JWKSURI)
+	}
+
+	c.mu.Lock()
+	c.discovery[issuer] = config.JWKSURI
+	c.mu.Unlock()
+
+	return config.JWKSURI, nil
+}
+
+// verify checks the signature of the JWT raw with the key set at url, then
+// its issuer, audience and validity, and decodes its claims into dest.
+// Tokens must expire.
+func (c *jwksCache) verify(ctx context.Context, url, raw string, issuers []string, audience string, dest interface{}) error {
+	tok, err := jose.ParseSigned(raw)
+	if err != nil {
+		return errors.Wrap(jose.TrimPrefix(err), "invalid token")
+	}
+	if len(tok.Headers) != 1 {
+		return errors.New("invalid token: expected one signature")
+	}
+	header := tok.Headers[0]
+	key, err := c.key(ctx, url, header.KeyID)
+	if err != nil {
+		return err
+	}
+	if !jose.IsAsymmetric(key) || (key.Algorithm != "" && key.Algorithm != header.Algorithm) {
+		return errors.Errorf("invalid token: unexpected algorithm %q", header.Algorithm)
+	}
+
+	var claims jose.Claims
+	if err := jose.Verify(tok, key.Key, &claims, dest); err != nil {
+		return errors.Wrap(jose.TrimPrefix(err), "invalid token")
+	}
+	if claims.Expiry == nil {
+		return errors.New("invalid token: missing exp")
+	}
+	if err := claims.ValidateWithLeeway(jose.Expected{Audience: jose.Audience{audience}, Time: signerClock.Now()}, clockLeeway()); err != nil {
+		return errors.Wrap(jose.TrimPrefix(err), "invalid token")
+	}
+	if !slices.Contains(issuers, claims.Issuer) {
+		return errors.Errorf("invalid token: unexpected issuer %q", claims.Issuer)
+	}
+
+	return nil
+}
@@ -0,0 +1,314 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// KeygenConfig configures POST /sign/keygen, which generates the key of the
+// certificate on the signer and returns it with the certificate as PEM,
+// PKCS#12 or JKS.
+type KeygenConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	KeyType        string `yaml:"keyType"`
+	Alias          string `yaml:"alias"`
+	PasswordSource string `yaml:"passwordSource"`
+	PasswordFile   string `yaml:"passwordFile"`
+}
+
+// GetKeyType returns the type of the generated keys, "EC" (default, P-256) or
+// "RSA" (2048 bits).
+func (c KeygenConfig) GetKeyType() string {
+	if c.KeyType != "" {
+		return c.KeyType
+	}
+
+	return "EC"
+}
+
+// GetAlias returns the default alias of the keystore entries, defaults to
+// "ca-signer".
+func (c KeygenConfig) GetAlias() string {
+	if c.Alias != "" {
+		return c.Alias
+	}
+
+	return "ca-signer"
+}
+
+// GetPasswordSource returns where keystore passwords come from: "request"
+// (default), "generate" or "file".
+func (c KeygenConfig) GetPasswordSource() string {
+	if c.PasswordSource != "" {
+		return c.PasswordSource
+	}
+
+	return "request"
+}
+
+// Validate checks the key type and password source.
+func (c KeygenConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if t := c.GetKeyType(); t != "EC" && t != "RSA" {
+		return errors.Errorf("invalid keygen keyType %q", t)
+	}
+	switch c.GetPasswordSource() {
+	case "request", "generate":
+	case "file":
+		if c.PasswordFile == "" {
+			return errors.New("keygen passwordSource file requires a passwordFile")
+		}
+	default:
+		return errors.Errorf("invalid keygen passwordSource %q", c.PasswordSource)
+	}
+
+	return nil
+}
+
+// KeygenRequest is the body of POST /sign/keygen.
+type KeygenRequest struct {
+	Subject  string            `json:"subject"`
+	SANs     []string          `json:"sans"`
+	NotAfter api.TimeDuration  `json:"notAfter"`
+	KeyType  string            `json:"keyType"`
+	Format   string            `json:"format"`
+	Alias    string            `json:"alias"`
+	Password string            `json:"password"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// signKeygen generates a key and issues a certificate for it. The key is
+// returned in the requested format, with the chain in the layout requested
+// with includeRoot.
+func (s *server) signKeygen(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config.Keygen
+	opts, err := parseBundleOptions(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	var body KeygenRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+	if body.Subject == "" && len(body.SANs) == 0 {
+		render.Error(w, r, errs.BadRequest("missing subject or sans"))
+		return
+	}
+	if body.Format == "" {
+		body.Format = "pem"
+	}
+	if body.Format != "pem" && body.Format != "pkcs12" && body.Format != "jks" {
+		render.Error(w, r, errs.BadRequest("invalid format %q, must be pem, pkcs12 or jks", body.Format))
+		return
+	}
+	if body.KeyType == "" {
+		body.KeyType = cfg.GetKeyType()
+	}
+	if body.Alias == "" {
+		body.Alias = cfg.GetAlias()
+	}
+
+	if err := validateMetadata(body.Metadata); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	password, generated, err := cfg.storePassword(body)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	key, csr, err := newKeyAndRequest(body.KeyType, body.Subject, body.SANs)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	request := &SignRequest{CsrPEM: api.CertificateRequest{CertificateRequest: csr}, NotAfter: body.NotAfter, Metadata: body.Metadata}
+
+	generation := s.generationFor(r)
+	if err := s.checkPolicy(r, generation, request); err != nil {
+		result := "error"
+		if _, ok := err.(*policyError); ok {
+			result = "denied"
+		}
+		s.countSign(clientIdentities(r), generation, result, err)
+		render.Error(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.Timeouts.GetSign())
+	defer cancel()
+
+	resp, err := s.issueWith(ctx, s.upstreamFor(generation), request, nil)
+	if err != nil {
+		s.releaseQuota(clientIdentities(r))
+		s.countSign(clientIdentities(r), generation, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+	s.countSign(clientIdentities(r), generation, "issued", nil)
+	s.issued(newHookEvent(r, generation, request), resp)
+
+	opts.rootFirst = false
+	if resp, err = s.bundle(resp, opts); err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+	var chain []*x509.Certificate
+	for _, c := range resp.CertChainPEM {
+		chain = append(chain, c.Certificate)
+	}
+
+	var out []byte
+	var contentType, ext string
+	switch body.Format {
+	case "pkcs12":
+		out, err = pkcs12.Modern.Encode(key, chain[0], chain[1:], password)
+		contentType, ext = "application/x-pkcs12", "p12"
+	case "jks":
+		out, err = encodeJKS(strings.ToLower(body.Alias), key, chain, password)
+		contentType, ext = "application/x-java-keystore", "jks"
+	default:
+		out, err = encodePEMBundle(key, chain)
+		contentType, ext = "application/x-pem-file", "pem"
+	}
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	logFor("server").WithFields(log.Fields{
+		"client":   clientIdentities(r),
+		"subject":  csr.Subject.CommonName,
+		"format":   body.Format,
+		"serial":   chain[0].SerialNumber.String(),
+		"metadata": body.Metadata,
+	}).Info("Issued certificate with a generated key")
+
+	s.setCertificateHeaders(w, resp)
+	if generated {
+		w.Header().Set("X-Keystore-Password", password)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+body.Alias+`.`+ext+`"`)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(out)
+}
+
+// storePassword returns the password of a keystore and whether it was
+// generated. PEM bundles are not encrypted.
+func (c KeygenConfig) storePassword(body KeygenRequest) (string, bool, error) {
+	if body.Format == "pem" {
+		return "", false, nil
+	}
+
+	switch c.GetPasswordSource() {
+	case "generate":
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			return "", false, errs.InternalServerErr(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b), true, nil
+	case "file":
+		password, err := readPasswordFromFile(c.PasswordFile)
+		if err != nil {
+			return "", false, errs.InternalServerErr(err)
+		}
+		return string(password), false, nil
+	default:
+		if len(body.Password) < 8 {
+			return "", false, errs.BadRequest("password must have at least 8 characters")
+		}
+		return body.Password, false, nil
+	}
+}
+
+// newKeyAndRequest generates a key of the given type, "EC" (P-256) or "RSA"
+// (2048 bits), and a CSR for the subject and SANs. The subject defaults to
+// the first SAN.
+func newKeyAndRequest(keyType, subject string, sans []string) (crypto.Signer, *x509.CertificateRequest, error) {
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case "EC":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "RSA":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, nil, errs.BadRequest("invalid keyType %q, must be EC or RSA", keyType)
+	}
+	if err != nil {
+		return nil, nil, errs.InternalServerErr(err)
+	}
+
+	if subject == "" && len(sans) > 0 {
+		subject = sans[0]
+	}
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: subject}}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if u, err := url.Parse(san); err == nil && u.Scheme != "" {
+			tmpl.URIs = append(tmpl.URIs, u)
+		} else if a, err := mail.ParseAddress(san); err == nil && a.Address == san {
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, san)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return nil, nil, errs.BadRequestErr(err, "error creating certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, errs.InternalServerErr(err)
+	}
+
+	return key, csr, nil
+}
+
+// encodePEMBundle returns the PKCS#8 key followed by the chain.
+func encodePEMBundle(key crypto.Signer, chain []*x509.Certificate) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,136 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeygenConfigValidate(t *testing.T) {
+	tests := []struct {
+		c  KeygenConfig
+		ok bool
+	}{
+		{KeygenConfig{}, true},
+		{KeygenConfig{Enabled: true}, true},
+		{KeygenConfig{Enabled: true, KeyType: "RSA", PasswordSource: "generate"}, true},
+		{KeygenConfig{Enabled: true, KeyType: "DSA"}, false},
+		{KeygenConfig{Enabled: true, PasswordSource: "file"}, false},
+		{KeygenConfig{Enabled: true, PasswordSource: "vault"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v, want ok %v", tt.c, err, tt.ok)
+		}
+	}
+}
+
+func TestStorePassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if err := writeFile(file, "from-file\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		c         KeygenConfig
+		body      KeygenRequest
+		want      string
+		generated bool
+		status    int
+	}{
+		{"pem", KeygenConfig{}, KeygenRequest{Format: "pem", Password: "ignored"}, "", false, 0},
+		{"request", KeygenConfig{}, KeygenRequest{Format: "jks", Password: "changeit!"}, "changeit!", false, 0},
+		{"short", KeygenConfig{}, KeygenRequest{Format: "jks", Password: "short"}, "", false, http.StatusBadRequest},
+		{"file", KeygenConfig{PasswordSource: "file", PasswordFile: file}, KeygenRequest{Format: "pkcs12"}, "from-file", false, 0},
+		{"generate", KeygenConfig{PasswordSource: "generate"}, KeygenRequest{Format: "pkcs12"}, "", true, 0},
+	}
+	for _, tt := range tests {
+		got, generated, err := tt.c.storePassword(tt.body)
+		if errorStatus(err) != tt.status || generated != tt.generated {
+			t.Errorf("%s: storePassword() = %q, %v, %v, want status %d, generated %v", tt.name, got, generated, err, tt.status, tt.generated)
+			continue
+		}
+		if tt.generated && len(got) != 24 {
+			t.Errorf("%s: storePassword() = %q, want 24 random characters", tt.name, got)
+		}
+		if !tt.generated && got != tt.want {
+			t.Errorf("%s: storePassword() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewKeyAndRequest(t *testing.T) {
+	key, csr, err := newKeyAndRequest("EC", "", []string{"app.example.com", "10.0.0.1", "spiffe://example.com/app", "ops@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("EC key is a %T", key)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Error(err)
+	}
+	if csr.Subject.CommonName != "app.example.com" || len(csr.DNSNames) != 1 || len(csr.IPAddresses) != 1 ||
+		len(csr.URIs) != 1 || len(csr.EmailAddresses) != 1 {
+		t.Errorf("CSR = %s %v %v %v %v, want one SAN of each type", csr.Subject.CommonName, csr.DNSNames, csr.IPAddresses, csr.URIs, csr.EmailAddresses)
+	}
+
+	if key, _, err := newKeyAndRequest("RSA", "app", nil); err != nil {
+		t.Error(err)
+	} else if _, ok := key.(*rsa.PrivateKey); !ok {
+		t.Errorf("RSA key is a %T", key)
+	}
+	if _, _, err := newKeyAndRequest("DSA", "app", nil); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("newKeyAndRequest(DSA) = %v, want 400", err)
+	}
+}
+
+func TestEncodePEMBundle(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	leaf, key := issueTestCert(t, root, rootKey, "app.example.com", false)
+	out, err := encodePEMBundle(key, []*x509.Certificate{leaf, root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for rest := out; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		types = append(types, block.Type)
+	}
+	if want := []string{"PRIVATE KEY", "CERTIFICATE", "CERTIFICATE"}; !sameStrings(types, want) {
+		t.Errorf("encodePEMBundle() = %v, want %v", types, want)
+	}
+}
+
+func TestSignKeygenRejected(t *testing.T) {
+	s := &server{config: &Config{Keygen: KeygenConfig{Enabled: true}}}
+	tests := []struct {
+		name, query, body string
+	}{
+		{"no names", "", `{"format":"pem"}`},
+		{"format", "", `{"sans":["app.example.com"],"format":"der"}`},
+		{"password", "", `{"sans":["app.example.com"],"format":"jks","password":"short"}`},
+		{"key type", "", `{"sans":["app.example.com"],"keyType":"DSA"}`},
+		{"chain order", "?chainOrder=random", `{"sans":["app.example.com"]}`},
+		{"malformed", "", `{"sans":`},
+	}
+	for _, tt := range tests {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign/keygen"+tt.query, strings.NewReader(tt.body)), "app")
+		w := httptest.NewRecorder()
+		s.signKeygen(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+}
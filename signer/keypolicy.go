@@ -0,0 +1,242 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// defaultMinRSABits is the minimum size of the RSA keys allowed by the key
+// type "RSA".
+const defaultMinRSABits = 2048
+
+// KeysConfig restricts the key types and the signature algorithms of the
+// CSRs, e.g. to move names or clients away from RSA. Every rule applying to
+// a request must allow it.
+type KeysConfig struct {
+	Rules []KeyRule `yaml:"rules"`
+}
+
+// KeyRule allows the key types and CSR signature algorithms listed. It
+// applies to the requests from its clients, for its profiles, requesting
+// any name matching its SANs patterns; empty selectors match every request.
+// Key types are "RSA", "RSA-<bits>" for a minimum size, "ECDSA",
+// "ECDSA-P256", "ECDSA-P384", "ECDSA-P521", "Ed25519", "ML-DSA" and the
+// names of the post-quantum algorithms. Signature algorithms use the Go
+// names, e.g. "SHA256-RSA", "ECDSA-SHA384" or "Ed25519", and the names of
+// the post-quantum algorithms.
+type KeyRule struct {
+	ID                  string   `yaml:"id"`
+	Clients             []string `yaml:"clients"`
+	Profiles            []string `yaml:"profiles"`
+	SANs                []string `yaml:"sans"`
+	KeyTypes            []string `yaml:"keyTypes"`
+	SignatureAlgorithms []string `yaml:"signatureAlgorithms"`
+}
+
+// signatureAlgorithms are the CSR signature algorithms by name.
+var signatureAlgorithms = map[string]x509.SignatureAlgorithm{}
+
+func init() {
+	for a := x509.MD2WithRSA; a <= x509.PureEd25519; a++ {
+		signatureAlgorithms[a.String()] = a
+	}
+}
+
+// Validate checks the rule ids, key types, signature algorithms and
+// patterns. The post-quantum algorithm names come from pq.
+func (c KeysConfig) Validate(pq PostQuantumConfig) error {
+	pqNames := map[string]bool{}
+	for _, name := range pq.algorithms() {
+		pqNames[name] = true
+	}
+	seen := map[string]bool{}
+	for i, rule := range c.Rules {
+		if rule.ID == "" {
+			return errors.Errorf("keys rule %d is missing an id", i)
+		}
+		if seen[rule.ID] {
+			return errors.Errorf("duplicated keys rule id %q", rule.ID)
+		}
+		seen[rule.ID] = true
+		if len(rule.KeyTypes) == 0 && len(rule.SignatureAlgorithms) == 0 {
+			return errors.Errorf("keys rule %q must have keyTypes or signatureAlgorithms", rule.ID)
+		}
+		for _, t := range rule.KeyTypes {
+			if !validKeyType(t) && !pqNames[t] {
+				return errors.Errorf("invalid key type %q in keys rule %q", t, rule.ID)
+			}
+		}
+		for _, a := range rule.SignatureAlgorithms {
+			if _, ok := signatureAlgorithms[a]; !ok && !pqNames[a] {
+				return errors.Errorf("invalid signature algorithm %q in keys rule %q", a, rule.ID)
+			}
+		}
+		for _, pattern := range rule.SANs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid pattern %q in keys rule %q", pattern, rule.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validKeyType(t string) bool {
+	switch t {
+	case "RSA", "ECDSA", "ECDSA-P256", "ECDSA-P384", "ECDSA-P521", "Ed25519", "ML-DSA":
+		return true
+	}
+	bits, ok := strings.CutPrefix(t, "RSA-")
+	if !ok {
+		return false
+	}
+	n, err := strconv.Atoi(bits)
+	return err == nil && n >= 1024
+}
+
+// checkKeys returns a denial with the id of the first rule applying to the
+// request that does not allow its key type or signature algorithm. The
+// reason lists what the rule allows.
+func (c KeysConfig) checkKeys(clients []string, request *SignRequest) policy.Decision {
+	csr := request.CsrPEM.CertificateRequest
+	keyType, bits := csrKeyType(csr.PublicKey)
+	alg := csr.SignatureAlgorithm.String()
+	pqKey, pqSig := csrPostQuantum(csr.Raw)
+	if pqKey != "" {
+		keyType, bits = pqKey, 0
+	}
+	if pqSig != "" {
+		alg = pqSig
+	}
+	names := requestNames(request)
+	for _, rule := range c.Rules {
+		san, ok := rule.applies(clients, request.Profile, names)
+		if !ok {
+			continue
+		}
+		if len(rule.KeyTypes) > 0 && !keyTypeAllowed(rule.KeyTypes, keyType, bits) {
+			return policy.Decision{
+				RuleID: rule.ID,
+				SAN:    san,
+				Reason: fmt.Sprintf("key type %s is not allowed%s, use one of %s", describeKey(keyType, bits), forName(san), strings.Join(rule.KeyTypes, ", ")),
+			}
+		}
+		if len(rule.SignatureAlgorithms) > 0 && !policy.ContainsAny(rule.SignatureAlgorithms, []string{alg}) {
+			return policy.Decision{
+				RuleID: rule.ID,
+				SAN:    san,
+				Reason: fmt.Sprintf("csr signature algorithm %s is not allowed%s, sign the csr with one of %s", alg, forName(san), strings.Join(rule.SignatureAlgorithms, ", ")),
+			}
+		}
+	}
+
+	return policy.Decision{Allowed: true}
+}
+
+// rulesFor returns the rules applying to the requests of clients for
+// profile, whatever their names.
+func (c KeysConfig) rulesFor(clients []string, profile string) []keyRuleInfo {
+	rules := []keyRuleInfo{}
+	for _, rule := range c.Rules {
+		if len(rule.Clients) > 0 && !policy.ContainsAny(rule.Clients, clients) {
+			continue
+		}
+		if len(rule.Profiles) > 0 && !policy.ContainsAny(rule.Profiles, []string{profile}) {
+			continue
+		}
+		rules = append(rules, keyRuleInfo{
+			ID:                  rule.ID,
+			SANs:                rule.SANs,
+			KeyTypes:            rule.KeyTypes,
+			SignatureAlgorithms: rule.SignatureAlgorithms,
+		})
+	}
+
+	return rules
+}
+
+// applies returns true if the rule applies to the request, and the first
+// name matching its SANs patterns.
+func (r KeyRule) applies(clients []string, profile string, names []string) (string, bool) {
+	if len(r.Clients) > 0 && !policy.ContainsAny(r.Clients, clients) {
+		return "", false
+	}
+	if len(r.Profiles) > 0 && !policy.ContainsAny(r.Profiles, []string{profile}) {
+		return "", false
+	}
+	if len(r.SANs) == 0 {
+		return "", true
+	}
+	for _, name := range names {
+		for _, pattern := range r.SANs {
+			if policy.MatchName(pattern, name) {
+				return name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// csrKeyType returns the key type of a public key, "RSA", "ECDSA-<curve>"
+// or "Ed25519", and the size of RSA keys.
+func csrKeyType(pub any) (string, int) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + strings.ReplaceAll(k.Curve.Params().Name, "-", ""), 0
+	case ed25519.PublicKey:
+		return "Ed25519", 0
+	default:
+		return fmt.Sprintf("%T", pub), 0
+	}
+}
+
+// keyTypeAllowed returns true if the key matches one of the allowed types.
+func keyTypeAllowed(allowed []string, keyType string, bits int) bool {
+	for _, t := range allowed {
+		switch {
+		case t == keyType && keyType != "RSA":
+			return true
+		case t == "ECDSA" && strings.HasPrefix(keyType, "ECDSA-"):
+			return true
+		case t == "ML-DSA" && strings.HasPrefix(keyType, "ML-DSA-"):
+			return true
+		case keyType == "RSA" && (t == "RSA" || strings.HasPrefix(t, "RSA-")):
+			min := defaultMinRSABits
+			if s, ok := strings.CutPrefix(t, "RSA-"); ok {
+				min, _ = strconv.Atoi(s)
+			}
+			if bits >= min {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func describeKey(keyType string, bits int) string {
+	if keyType == "RSA" {
+		return fmt.Sprintf("RSA-%d", bits)
+	}
+	return keyType
+}
+
+func forName(san string) string {
+	if san == "" {
+		return ""
+	}
+	return " for " + san
+}
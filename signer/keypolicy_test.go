@@ -0,0 +1,87 @@
+package signer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeysConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    KeysConfig
+		ok   bool
+	}{
+		{"empty", KeysConfig{}, true},
+		{"valid", KeysConfig{Rules: []KeyRule{{ID: "no-rsa", SANs: []string{"*.example.com"}, KeyTypes: []string{"ECDSA", "RSA-3072", "Ed25519"}, SignatureAlgorithms: []string{"ECDSA-SHA256"}}}}, true},
+		{"no id", KeysConfig{Rules: []KeyRule{{KeyTypes: []string{"ECDSA"}}}}, false},
+		{"duplicated", KeysConfig{Rules: []KeyRule{{ID: "a", KeyTypes: []string{"ECDSA"}}, {ID: "a", KeyTypes: []string{"RSA"}}}}, false},
+		{"nothing allowed", KeysConfig{Rules: []KeyRule{{ID: "a"}}}, false},
+		{"key type", KeysConfig{Rules: []KeyRule{{ID: "a", KeyTypes: []string{"DSA"}}}}, false},
+		{"small RSA", KeysConfig{Rules: []KeyRule{{ID: "a", KeyTypes: []string{"RSA-512"}}}}, false},
+		{"algorithm", KeysConfig{Rules: []KeyRule{{ID: "a", SignatureAlgorithms: []string{"SHA256"}}}}, false},
+		{"pattern", KeysConfig{Rules: []KeyRule{{ID: "a", KeyTypes: []string{"ECDSA"}, SANs: []string{"["}}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(PostQuantumConfig{}); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestKeyTypeAllowed(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		keyType string
+		bits    int
+		want    bool
+	}{
+		{[]string{"ECDSA"}, "ECDSA-P384", 0, true},
+		{[]string{"ECDSA-P256"}, "ECDSA-P384", 0, false},
+		{[]string{"RSA"}, "RSA", 2048, true},
+		{[]string{"RSA"}, "RSA", 1024, false},
+		{[]string{"RSA-3072"}, "RSA", 2048, false},
+		{[]string{"ECDSA", "RSA-3072"}, "RSA", 4096, true},
+		{[]string{"ML-DSA"}, "ML-DSA-65", 0, true},
+		{[]string{"Ed25519"}, "ECDSA-P256", 0, false},
+	}
+	for _, tt := range tests {
+		if got := keyTypeAllowed(tt.allowed, tt.keyType, tt.bits); got != tt.want {
+			t.Errorf("keyTypeAllowed(%v, %s, %d) = %v, want %v", tt.allowed, tt.keyType, tt.bits, got, tt.want)
+		}
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	c := KeysConfig{Rules: []KeyRule{
+		{ID: "prod-rsa", SANs: []string{"*.prod.example.com"}, KeyTypes: []string{"RSA-3072"}},
+		{ID: "legacy", Clients: []string{"legacy"}, KeyTypes: []string{"ECDSA-P384"}},
+		{ID: "sha512", Profiles: []string{"strict"}, SignatureAlgorithms: []string{"ECDSA-SHA512"}},
+	}}
+
+	tests := []struct {
+		name    string
+		client  string
+		profile string
+		names   []string
+		rule    string
+	}{
+		{"no rule", "web", "", []string{"www.example.com"}, ""},
+		{"san", "web", "", []string{"www.example.com", "db.prod.example.com"}, "prod-rsa"},
+		{"client", "legacy", "", []string{"www.example.com"}, "legacy"},
+		{"profile", "web", "strict", []string{"www.example.com"}, "sha512"},
+	}
+	for _, tt := range tests {
+		_, request := newPolicyTestRequest(t, tt.client, tt.names...)
+		request.Profile = tt.profile
+		d := c.checkKeys([]string{tt.client}, request)
+		if d.Allowed != (tt.rule == "") || d.RuleID != tt.rule {
+			t.Errorf("%s: checkKeys() = %+v, want rule %q", tt.name, d, tt.rule)
+		}
+	}
+
+	_, request := newPolicyTestRequest(t, "web", "db.prod.example.com")
+	d := c.checkKeys([]string{"web"}, request)
+	if d.SAN != "db.prod.example.com" || !strings.Contains(d.Reason, "ECDSA-P256 is not allowed for db.prod.example.com, use one of RSA-3072") {
+		t.Errorf("checkKeys() = %+v, want the reason naming the key and the SAN", d)
+	}
+}
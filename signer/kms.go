@@ -0,0 +1,79 @@
+package signer
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/pkg/errors"
+)
+
+// kmsTimeout bounds a call to AWS KMS.
+const kmsTimeout = 30 * time.Second
+
+// kmsEncryptionContext binds the data keys wrapped by AWS KMS to the signer,
+// and is logged by CloudTrail with each use.
+var kmsEncryptionContext = map[string]string{"service": "ca-signer", "purpose": "inventory"}
+
+// kmsWrapper wraps data keys with the Encrypt and Decrypt calls of AWS KMS.
+// Credentials come from the default chain of the AWS SDK: the environment,
+// the shared config files, web identity tokens and the instance or task
+// role.
+type kmsWrapper struct {
+	keyID  string
+	client *kms.Client
+}
+
+func newKMSWrapper(c KMSConfig) (*kmsWrapper, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(c.Region))
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading AWS config")
+	}
+	client := kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if c.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+		}
+	})
+
+	return &kmsWrapper{keyID: c.KeyID, client: client}, nil
+}
+
+func (w *kmsWrapper) Name() string {
+	return "kms"
+}
+
+// Wrap encrypts a data key with the KMS key.
+func (w *kmsWrapper) Wrap(plaintext []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	out, err := w.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:             aws.String(w.keyID),
+		Plaintext:         plaintext,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling KMS Encrypt")
+	}
+
+	return out.CiphertextBlob, nil
+}
+
+// Unwrap decrypts a data key. The ciphertext identifies the KMS key, so keys
+// wrapped before a change of keyId can still be unwrapped.
+func (w *kmsWrapper) Unwrap(ciphertext []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	out, err := w.client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    ciphertext,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling KMS Decrypt")
+	}
+
+	return out.Plaintext, nil
+}
@@ -0,0 +1,75 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal client of the Kubernetes API of the cluster the
+// signer runs in, authenticated with the service account of the pod.
+type kubeClient struct {
+	url    string
+	client *http.Client
+}
+
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod")
+	}
+
+	caPEM, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading service account CA")
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	return &kubeClient{
+		url: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			},
+		},
+	}, nil
+}
+
+// do sends a request to the API path with the service account token, read
+// on each request as it is rotated.
+func (k *kubeClient) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading service account token")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+
+	return k.client.Do(req)
+}
+
+// podNamespace returns the namespace of the pod, "default" if unknown.
+func podNamespace() string {
+	ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "default"
+	}
+	return strings.TrimSpace(string(ns))
+}
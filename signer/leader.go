@@ -0,0 +1,324 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// LeaderElectionConfig configures the election of the replica running the
+// background jobs. It uses a Kubernetes Lease object, so the signer must run
+// in a pod whose service account can get, create and update leases; there is
+// no lock in the inventory store for replicas running outside Kubernetes.
+type LeaderElectionConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	LeaseName     string `yaml:"leaseName"`
+	Namespace     string `yaml:"namespace"`
+	Identity      string `yaml:"identity"`
+	LeaseDuration string `yaml:"leaseDuration"`
+	RenewDeadline string `yaml:"renewDeadline"`
+	RetryPeriod   string `yaml:"retryPeriod"`
+}
+
+// GetLeaseName returns the name of the lease, defaults to "ca-signer".
+func (c LeaderElectionConfig) GetLeaseName() string {
+	if c.LeaseName != "" {
+		return c.LeaseName
+	}
+
+	return "ca-signer"
+}
+
+// GetNamespace returns the namespace of the lease, defaults to the namespace
+// of the pod.
+func (c LeaderElectionConfig) GetNamespace() string {
+	if c.Namespace != "" {
+		return c.Namespace
+	}
+
+	return podNamespace()
+}
+
+// GetIdentity returns the identity of this replica, defaults to the hostname.
+func (c LeaderElectionConfig) GetIdentity() string {
+	if c.Identity != "" {
+		return c.Identity
+	}
+
+	host, _ := os.Hostname()
+	return host
+}
+
+// GetLeaseDuration returns how long a lease is valid without renewal,
+// defaults to 15s.
+func (c LeaderElectionConfig) GetLeaseDuration() time.Duration {
+	if d, err := time.ParseDuration(c.LeaseDuration); err == nil && d > 0 {
+		return d
+	}
+
+	return 15 * time.Second
+}
+
+// GetRenewDeadline returns how long the leader keeps leading without
+// renewing the lease, defaults to two thirds of the lease duration. It is
+// shorter than the lease duration so the leader steps down before another
+// replica can acquire the lease.
+func (c LeaderElectionConfig) GetRenewDeadline() time.Duration {
+	if d, err := time.ParseDuration(c.RenewDeadline); err == nil && d > 0 {
+		return d
+	}
+
+	return c.GetLeaseDuration() * 2 / 3
+}
+
+// GetRetryPeriod returns how often the lease is acquired or renewed, defaults
+// to 5s.
+func (c LeaderElectionConfig) GetRetryPeriod() time.Duration {
+	if d, err := time.ParseDuration(c.RetryPeriod); err == nil && d > 0 {
+		return d
+	}
+
+	return 5 * time.Second
+}
+
+// Validate checks the durations: the retry period must be shorter than the
+// renew deadline, itself shorter than the lease duration.
+func (c LeaderElectionConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	durations := []struct{ name, value string }{
+		{"leaseDuration", c.LeaseDuration},
+		{"renewDeadline", c.RenewDeadline},
+		{"retryPeriod", c.RetryPeriod},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v <= 0 {
+			return errors.Errorf("invalid leaderElection %s %q", d.name, d.value)
+		}
+	}
+	if c.GetRenewDeadline() >= c.GetLeaseDuration() {
+		return errors.New("leaderElection renewDeadline must be shorter than leaseDuration")
+	}
+	if c.GetRetryPeriod() >= c.GetRenewDeadline() {
+		return errors.New("leaderElection retryPeriod must be shorter than renewDeadline")
+	}
+
+	return nil
+}
+
+// leaderElector elects a leader among the signer replicas.
+type leaderElector struct {
+	config   LeaderElectionConfig
+	identity string
+	kube     *kubeClient
+	path     string
+	leading  atomic.Bool
+	cancel   context.CancelFunc
+}
+
+// newLeaderElector returns an elector using the in-cluster Kubernetes API.
+func newLeaderElector(config LeaderElectionConfig) (*leaderElector, error) {
+	kube, err := newKubeClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "leader election requires running in a Kubernetes pod")
+	}
+
+	return &leaderElector{
+		config:   config,
+		identity: config.GetIdentity(),
+		kube:     kube,
+		path:     fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", config.GetNamespace()),
+	}, nil
+}
+
+// IsLeader returns true if this replica currently holds the lease.
+func (e *leaderElector) IsLeader() bool {
+	return e.leading.Load()
+}
+
+// Run tries to acquire and renew the lease until ctx is done. onStartedLeading
+// is called with a context that is canceled when the leadership is lost, at
+// the latest when the lease has not been renewed for the renew deadline.
+func (e *leaderElector) Run(ctx context.Context, onStartedLeading func(context.Context)) {
+	stop := func() {
+		if e.cancel != nil {
+			e.cancel()
+			e.cancel = nil
+		}
+		if e.leading.Swap(false) {
+			leaderGauge.Set(0)
+			logFor("leader").WithField("identity", e.identity).Info("Lost leadership")
+		}
+	}
+	defer stop()
+
+	var lastRenew time.Time
+	ticker := time.NewTicker(e.config.GetRetryPeriod())
+	defer ticker.Stop()
+	for {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if e.IsLeader() {
+			attemptCtx, cancel = context.WithDeadline(ctx, lastRenew.Add(e.config.GetRenewDeadline()))
+		}
+		ok, err := e.tryAcquireOrRenew(attemptCtx)
+		cancel()
+		switch {
+		case err != nil:
+			logFor("leader").WithField("error", err).Warn("Error renewing leader election lease")
+			if e.IsLeader() && time.Since(lastRenew) >= e.config.GetRenewDeadline() {
+				stop()
+			}
+		case ok:
+			lastRenew = time.Now()
+			if !e.leading.Swap(true) {
+				leaderGauge.Set(1)
+				logFor("leader").WithField("identity", e.identity).Info("Acquired leadership")
+				var leaderCtx context.Context
+				leaderCtx, e.cancel = context.WithCancel(ctx)
+				go onStartedLeading(leaderCtx)
+			}
+		default:
+			stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				e.release()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lease is the subset of the coordination.k8s.io/v1 Lease used for leader
+// election.
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// tryAcquireOrRenew returns true if this replica holds the lease after the
+// call.
+func (e *leaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now()
+	l, err := e.get(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if l == nil {
+		l = &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		l.Metadata.Name = e.config.GetLeaseName()
+		e.hold(l, now)
+		return e.write(ctx, http.MethodPost, e.path, l)
+	}
+
+	if l.Spec.HolderIdentity != e.identity && l.Spec.HolderIdentity != "" {
+		renew, err := time.Parse(microTimeFormat, l.Spec.RenewTime)
+		expiry := renew.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second)
+		if err == nil && now.Before(expiry) {
+			return false, nil
+		}
+	}
+
+	e.hold(l, now)
+	return e.write(ctx, http.MethodPut, e.path+"/"+l.Metadata.Name, l)
+}
+
+// hold sets this replica as the holder of the lease.
+func (e *leaderElector) hold(l *lease, now time.Time) {
+	if l.Spec.HolderIdentity != e.identity {
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.AcquireTime = now.UTC().Format(microTimeFormat)
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = int(e.config.GetLeaseDuration().Seconds())
+	l.Spec.RenewTime = now.UTC().Format(microTimeFormat)
+}
+
+// release gives up the lease so another replica can take over immediately.
+func (e *leaderElector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := e.get(ctx)
+	if err != nil || l == nil || l.Spec.HolderIdentity != e.identity {
+		return
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.LeaseDurationSeconds = 1
+	if _, err := e.write(ctx, http.MethodPut, e.path+"/"+l.Metadata.Name, l); err != nil {
+		logFor("leader").WithField("error", err).Warn("Error releasing leader election lease")
+	}
+}
+
+// get returns the lease, or nil if it does not exist.
+func (e *leaderElector) get(ctx context.Context) (*lease, error) {
+	resp, err := e.kube.do(ctx, http.MethodGet, e.path+"/"+e.config.GetLeaseName(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var l lease
+		if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+			return nil, errors.Wrap(err, "error decoding lease")
+		}
+		return &l, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unexpected status %d getting lease", resp.StatusCode)
+	}
+}
+
+// write creates or updates the lease. It returns false without an error if
+// another replica updated it first.
+func (e *leaderElector) write(ctx context.Context, method, path string, l *lease) (bool, error) {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := e.kube.do(ctx, method, path, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, errors.Errorf("unexpected status %d writing lease", resp.StatusCode)
+	}
+}
@@ -0,0 +1,81 @@
+package signer
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaseHold(t *testing.T) {
+	a := &leaderElector{config: LeaderElectionConfig{LeaseDuration: "20s"}, identity: "a"}
+	b := &leaderElector{config: LeaderElectionConfig{}, identity: "b"}
+	l := &lease{}
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	a.hold(l, start)
+	a.hold(l, start.Add(5*time.Second))
+	if l.Spec.HolderIdentity != "a" || l.Spec.LeaseTransitions != 1 || l.Spec.LeaseDurationSeconds != 20 {
+		t.Errorf("lease after renewal = %+v", l.Spec)
+	}
+	if l.Spec.AcquireTime != "2026-10-16T12:00:00.000000Z" || l.Spec.RenewTime != "2026-10-16T12:00:05.000000Z" {
+		t.Errorf("lease times = %s, %s", l.Spec.AcquireTime, l.Spec.RenewTime)
+	}
+
+	b.hold(l, start.Add(time.Minute))
+	if l.Spec.HolderIdentity != "b" || l.Spec.LeaseTransitions != 2 || l.Spec.LeaseDurationSeconds != 15 || l.Spec.AcquireTime != l.Spec.RenewTime {
+		t.Errorf("lease after a takeover = %+v", l.Spec)
+	}
+}
+
+func TestLeaderElectionConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     LeaderElectionConfig
+		renew time.Duration
+		valid bool
+	}{
+		{"defaults", LeaderElectionConfig{Enabled: true}, 10 * time.Second, true},
+		{"lease duration", LeaderElectionConfig{Enabled: true, LeaseDuration: "30s"}, 20 * time.Second, true},
+		{"renew deadline", LeaderElectionConfig{Enabled: true, RenewDeadline: "12s"}, 12 * time.Second, true},
+		{"renew deadline after expiry", LeaderElectionConfig{Enabled: true, RenewDeadline: "15s"}, 15 * time.Second, false},
+		{"retry after deadline", LeaderElectionConfig{Enabled: true, LeaseDuration: "6s"}, 4 * time.Second, false},
+		{"zero lease duration", LeaderElectionConfig{Enabled: true, LeaseDuration: "0s"}, 10 * time.Second, false},
+		{"negative renew deadline", LeaderElectionConfig{Enabled: true, RenewDeadline: "-1s"}, 10 * time.Second, false},
+		{"disabled", LeaderElectionConfig{RenewDeadline: "1m"}, time.Minute, true},
+	}
+	for _, tt := range tests {
+		if got := tt.c.GetRenewDeadline(); got != tt.renew {
+			t.Errorf("%s: GetRenewDeadline() = %s, want %s", tt.name, got, tt.renew)
+		}
+		if err := tt.c.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestJobRunnerWithoutElection(t *testing.T) {
+	var local, leader atomic.Int32
+	var j jobRunner
+	j.AddLocal("local", time.Hour, func(context.Context) error {
+		local.Add(1)
+		return nil
+	})
+	j.Add("leader", time.Hour, func(context.Context) error {
+		leader.Add(1)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := j.Run(ctx, LeaderElectionConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for (local.Load() == 0 || leader.Load() == 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if local.Load() != 1 || leader.Load() != 1 {
+		t.Errorf("jobs ran %d local and %d leader times, want 1 each", local.Load(), leader.Load())
+	}
+}
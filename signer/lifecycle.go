@@ -0,0 +1,96 @@
+package signer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// lifecycleShutdownTimeout is how long the shutdown hooks have once the HTTP
+// server has stopped, within the 10s margin an upgrade leaves on top of
+// shutdown.timeout.
+const lifecycleShutdownTimeout = 10 * time.Second
+
+// lifecycleHook is the start or shutdown function of a subsystem.
+type lifecycleHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// lifecycle runs the start and shutdown hooks of the subsystems of the
+// signer, such as the inventory and the background jobs. Start hooks run in
+// the order they were registered, once the configuration is loaded and before
+// the listeners serve; shutdown hooks run in the reverse order, after the
+// HTTP server has stopped, so a subsystem is stopped before the ones it was
+// registered after.
+type lifecycle struct {
+	mu       sync.Mutex
+	starts   []lifecycleHook
+	stops    []lifecycleHook
+	shutdown bool
+}
+
+// OnStart registers a function run by Start.
+func (l *lifecycle) OnStart(name string, fn func(context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.starts = append(l.starts, lifecycleHook{name: name, fn: fn})
+}
+
+// OnShutdown registers a function run by Shutdown.
+func (l *lifecycle) OnShutdown(name string, fn func(context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stops = append(l.stops, lifecycleHook{name: name, fn: fn})
+}
+
+// Start runs the start hooks and stops at the first error. ctx lives until
+// the signer exits, e.g. for the goroutines started by the hooks.
+func (l *lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	starts := append([]lifecycleHook{}, l.starts...)
+	l.mu.Unlock()
+
+	for _, h := range starts {
+		if err := h.fn(ctx); err != nil {
+			return errors.Wrapf(err, "error starting %s", h.name)
+		}
+		logFor("lifecycle").WithField("subsystem", h.name).Debug("Started")
+	}
+
+	return nil
+}
+
+// Shutdown runs the shutdown hooks, in the reverse order of registration,
+// with ctx bounding them all. Errors are logged and the next hooks still
+// run. It only runs once.
+func (l *lifecycle) Shutdown(ctx context.Context) {
+	l.mu.Lock()
+	if l.shutdown {
+		l.mu.Unlock()
+		return
+	}
+	l.shutdown = true
+	stops := append([]lifecycleHook{}, l.stops...)
+	l.mu.Unlock()
+
+	logger := logFor("lifecycle")
+	for i := len(stops) - 1; i >= 0; i-- {
+		h := stops[i]
+		start := time.Now()
+		if err := h.fn(ctx); err != nil {
+			logger.WithFields(log.Fields{
+				"subsystem": h.name,
+				"error":     err,
+			}).Error("Error shutting down")
+			continue
+		}
+		logger.WithFields(log.Fields{
+			"subsystem": h.name,
+			"duration":  time.Since(start).String(),
+		}).Debug("Shut down")
+	}
+}
@@ -0,0 +1,52 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLifecycle(t *testing.T) {
+	var l lifecycle
+	var calls []string
+	hook := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+	l.OnStart("inventory", hook("start inventory", nil))
+	l.OnStart("jobs", hook("start jobs", nil))
+	l.OnShutdown("inventory", hook("stop inventory", nil))
+	l.OnShutdown("cache", hook("stop cache", errors.New("flush failed")))
+	l.OnShutdown("jobs", hook("stop jobs", nil))
+
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	l.Shutdown(context.Background())
+	l.Shutdown(context.Background())
+	want := "start inventory,start jobs,stop jobs,stop cache,stop inventory"
+	if got := strings.Join(calls, ","); got != want {
+		t.Errorf("hooks run = %s, want %s", got, want)
+	}
+}
+
+func TestLifecycleStartError(t *testing.T) {
+	var l lifecycle
+	started := false
+	l.OnStart("jobs", func(context.Context) error { return errors.New("no leader election lease") })
+	l.OnStart("renewals", func(context.Context) error {
+		started = true
+		return nil
+	})
+
+	err := l.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "error starting jobs") {
+		t.Errorf("Start() = %v, want the error of the jobs", err)
+	}
+	if started {
+		t.Error("Start() ran the hooks after the error")
+	}
+}
@@ -0,0 +1,127 @@
+package signer
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// GetAddresses returns the addresses the server listens on: address
+// followed by addresses, or ":4443" if neither is set.
+func (c Config) GetAddresses() []string {
+	var addrs []string
+	if c.Address != "" {
+		addrs = append(addrs, c.Address)
+	}
+	for _, a := range c.Addresses {
+		if !policy.ContainsAny(addrs, []string{a}) {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs
+	}
+
+	return []string{c.GetAddress()}
+}
+
+// GetListenNetwork returns the network of the listeners for ipFamily:
+// "tcp" for "dual" (default), "tcp4" for "ipv4" and "tcp6" for "ipv6". An
+// unspecified address, e.g. ":4443" or "[::]:4443", accepts IPv4 and IPv6
+// connections with "dual" and IPv6 only with "ipv6".
+func (c Config) GetListenNetwork() string {
+	switch c.IPFamily {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// validateListen checks the listen addresses and the IP family.
+func (c Config) validateListen() error {
+	switch c.IPFamily {
+	case "", "dual", "ipv4", "ipv6":
+	default:
+		return errors.Errorf("invalid ipFamily %q, must be dual, ipv4 or ipv6", c.IPFamily)
+	}
+
+	for _, addr := range c.GetAddresses() {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid listen address %q, IPv6 addresses must be in brackets", addr)
+		}
+		if host == "" {
+			continue
+		}
+		ip := net.ParseIP(stripZone(host))
+		switch {
+		case ip == nil:
+			// A host name, resolved by the listener.
+		case c.IPFamily == "ipv4" && ip.To4() == nil:
+			return errors.Errorf("listen address %q is not an IPv4 address", addr)
+		case c.IPFamily == "ipv6" && ip.To4() != nil:
+			return errors.Errorf("listen address %q is not an IPv6 address", addr)
+		}
+	}
+
+	return nil
+}
+
+// listen binds the listeners of all the configured addresses, closing the
+// ones already bound if one fails. After an upgrade, the listeners of the
+// previous process are reused.
+func listen(config *Config) ([]net.Listener, error) {
+	defer closeInheritedListeners()
+
+	network := config.GetListenNetwork()
+	var listeners []net.Listener
+	for _, addr := range config.GetAddresses() {
+		if ln, ok := takeListener(addr); ok {
+			listeners = append(listeners, ln)
+			continue
+		}
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "error listening on %s", addr)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// serveTLS serves srv on all the listeners and returns the first error.
+func serveTLS(srv *http.Server, listeners []net.Listener) error {
+	errc := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		logFor("server").WithFields(log.Fields{
+			"address": ln.Addr().String(),
+			"network": ln.Addr().Network(),
+		}).Info("Listening")
+		go func(ln net.Listener) {
+			errc <- srv.ServeTLS(ln, "", "")
+		}(ln)
+	}
+
+	return <-errc
+}
+
+// stripZone removes the zone of an IPv6 address, e.g. "fe80::1%eth0".
+func stripZone(host string) string {
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		return host[:i]
+	}
+
+	return host
+}
@@ -0,0 +1,86 @@
+package signer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestGetAddresses(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"default", Config{}, []string{":4443"}},
+		{"address", Config{Address: "127.0.0.1:8443"}, []string{"127.0.0.1:8443"}},
+		{"both", Config{Address: ":8443", Addresses: []string{"[::1]:8443", ":8443"}}, []string{":8443", "[::1]:8443"}},
+	}
+	for _, tt := range tests {
+		if got := tt.config.GetAddresses(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: GetAddresses() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateListen(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		ok     bool
+		net    string
+	}{
+		{"default", Config{}, true, "tcp"},
+		{"dual", Config{IPFamily: "dual", Addresses: []string{"0.0.0.0:4443", "[::]:4443"}}, true, "tcp"},
+		{"ipv4", Config{IPFamily: "ipv4", Address: "10.0.0.1:4443"}, true, "tcp4"},
+		{"ipv6", Config{IPFamily: "ipv6", Addresses: []string{"[fe80::1%eth0]:4443", "localhost:4443"}}, true, "tcp6"},
+		{"invalid family", Config{IPFamily: "ipv5"}, false, ""},
+		{"no brackets", Config{Address: "2001:db8::1:4443"}, false, ""},
+		{"ipv4 on ipv6", Config{IPFamily: "ipv6", Address: "10.0.0.1:4443"}, false, ""},
+		{"ipv6 on ipv4", Config{IPFamily: "ipv4", Address: "[::1]:4443"}, false, ""},
+	}
+	for _, tt := range tests {
+		if err := tt.config.validateListen(); (err == nil) != tt.ok {
+			t.Errorf("%s: validateListen() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if got := tt.config.GetListenNetwork(); tt.ok && got != tt.net {
+			t.Errorf("%s: GetListenNetwork() = %q, want %q", tt.name, got, tt.net)
+		}
+	}
+}
+
+// freeAddress returns a loopback address with a port free to bind.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func TestListen(t *testing.T) {
+	first, second := freeAddress(t), freeAddress(t)
+	listeners, err := listen(&Config{Addresses: []string{first, second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 || listeners[0].Addr().String() != first || listeners[1].Addr().String() != second {
+		t.Fatalf("listen() = %v, want listeners on %s and %s", listeners, first, second)
+	}
+	defer listeners[1].Close()
+
+	// A failure closes the listeners already bound.
+	listeners[0].Close()
+	if _, err := listen(&Config{Addresses: []string{first, second}}); err == nil {
+		t.Fatal("listen() of a bound address error = nil")
+	}
+	ln, err := net.Listen("tcp", first)
+	if err != nil {
+		t.Errorf("address bound before the failure is still in use: %v", err)
+	} else {
+		ln.Close()
+	}
+}
@@ -0,0 +1,170 @@
+package signer
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// LoggingConfig configures the log levels, the sampling of debug logs and the
+// outputs. Logs are written to stdout if no output is configured.
+type LoggingConfig struct {
+	Level      string            `yaml:"level"`
+	Components map[string]string `yaml:"components"`
+	Sampling   SamplingConfig    `yaml:"sampling"`
+	Outputs    []LogOutputConfig `yaml:"outputs"`
+}
+
+// SamplingConfig limits the debug logs: every second, the first Initial
+// entries with a given message are logged, then one every Thereafter.
+type SamplingConfig struct {
+	Initial    int `yaml:"initial"`
+	Thereafter int `yaml:"thereafter"`
+}
+
+// Validate checks the log levels.
+func (c LoggingConfig) Validate() error {
+	if c.Level != "" {
+		if _, err := log.ParseLevel(c.Level); err != nil {
+			return errors.Wrap(err, "invalid logging level")
+		}
+	}
+	for name, level := range c.Components {
+		if _, err := log.ParseLevel(level); err != nil {
+			return errors.Wrapf(err, "invalid logging level for component %q", name)
+		}
+	}
+	for _, o := range c.Outputs {
+		if err := o.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// levelFor returns the level of a component, defaults to the global level.
+func (c LoggingConfig) levelFor(component string) log.Level {
+	if l, ok := c.Components[component]; ok {
+		if level, err := log.ParseLevel(l); err == nil {
+			return level
+		}
+	}
+	if level, err := log.ParseLevel(c.Level); err == nil {
+		return level
+	}
+
+	return log.InfoLevel
+}
+
+var (
+	loggingMu     sync.Mutex
+	loggingConfig LoggingConfig
+	loggers       = map[string]*log.Logger{}
+)
+
+// configureLogging sets up the standard logger, the component loggers and the
+// log outputs.
+func configureLogging(config *Config) error {
+	loggingMu.Lock()
+	defer loggingMu.Unlock()
+
+	loggingConfig = config.Logging
+	std := log.StandardLogger()
+	std.SetOutput(os.Stdout)
+	switch config.LogFormat {
+	case "json":
+		std.SetFormatter(&log.JSONFormatter{})
+	case "text":
+		std.SetFormatter(&log.TextFormatter{})
+	}
+	std.SetFormatter(&redactingFormatter{next: std.Formatter})
+	if s := loggingConfig.Sampling; s.Initial > 0 {
+		std.SetFormatter(newSamplingFormatter(std.Formatter, s))
+	}
+	std.SetFormatter(&recordingFormatter{next: std.Formatter})
+	if len(loggingConfig.Outputs) > 0 {
+		var sinks []logSink
+		for _, o := range loggingConfig.Outputs {
+			sink, err := newLogSink(o)
+			if err != nil {
+				return err
+			}
+			sinks = append(sinks, sink)
+		}
+		std.SetFormatter(&dispatchFormatter{next: std.Formatter, sinks: sinks})
+	}
+	std.SetLevel(loggingConfig.levelFor(""))
+
+	for name, l := range loggers {
+		setupLogger(l, name)
+	}
+
+	return nil
+}
+
+// logFor returns the logger of a component. Its level can be set with
+// logging.components, and its entries have a component field.
+func logFor(component string) *log.Entry {
+	loggingMu.Lock()
+	l, ok := loggers[component]
+	if !ok {
+		l = log.New()
+		setupLogger(l, component)
+		loggers[component] = l
+	}
+	loggingMu.Unlock()
+
+	return l.WithField("component", component)
+}
+
+func setupLogger(l *log.Logger, component string) {
+	std := log.StandardLogger()
+	l.SetOutput(std.Out)
+	l.SetFormatter(std.Formatter)
+	l.ReplaceHooks(std.Hooks)
+	l.SetLevel(loggingConfig.levelFor(component))
+}
+
+// samplingFormatter drops the debug and trace entries over the sampling
+// rate. Formatting an entry to no bytes makes logrus skip it.
+type samplingFormatter struct {
+	next     log.Formatter
+	sampling SamplingConfig
+
+	mu     sync.Mutex
+	second int64
+	counts map[string]int
+}
+
+func newSamplingFormatter(next log.Formatter, s SamplingConfig) *samplingFormatter {
+	return &samplingFormatter{next: next, sampling: s, counts: map[string]int{}}
+}
+
+func (f *samplingFormatter) Format(e *log.Entry) ([]byte, error) {
+	if e.Level < log.DebugLevel || f.keep(e.Message, e.Time) {
+		return f.next.Format(e)
+	}
+
+	return nil, nil
+}
+
+func (f *samplingFormatter) keep(msg string, t time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if sec := t.Unix(); sec != f.second {
+		f.second = sec
+		f.counts = map[string]int{}
+	}
+	f.counts[msg]++
+	n := f.counts[msg]
+	if n <= f.sampling.Initial {
+		return true
+	}
+
+	return f.sampling.Thereafter > 0 && (n-f.sampling.Initial)%f.sampling.Thereafter == 0
+}
@@ -0,0 +1,58 @@
+package signer
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLevelFor(t *testing.T) {
+	c := LoggingConfig{Level: "warn", Components: map[string]string{"policy": "debug"}}
+	if got := c.levelFor("policy"); got != log.DebugLevel {
+		t.Errorf("levelFor(policy) = %v, want debug", got)
+	}
+	if got := c.levelFor("server"); got != log.WarnLevel {
+		t.Errorf("levelFor(server) = %v, want warn", got)
+	}
+	if got := (LoggingConfig{}).levelFor("server"); got != log.InfoLevel {
+		t.Errorf("default level = %v, want info", got)
+	}
+}
+
+func TestLoggingConfigValidate(t *testing.T) {
+	if err := (LoggingConfig{Level: "loud"}).Validate(); err == nil {
+		t.Error("Validate() accepted an invalid level")
+	}
+	if err := (LoggingConfig{Components: map[string]string{"policy": "chatty"}}).Validate(); err == nil {
+		t.Error("Validate() accepted an invalid component level")
+	}
+}
+
+func TestSamplingFormatter(t *testing.T) {
+	f := newSamplingFormatter(&log.TextFormatter{DisableTimestamp: true}, SamplingConfig{Initial: 2, Thereafter: 3})
+	now := time.Unix(1700000000, 0)
+	var kept int
+	for i := 0; i < 10; i++ {
+		b, err := f.Format(&log.Entry{Logger: log.New(), Level: log.DebugLevel, Message: "m", Time: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > 0 {
+			kept++
+		}
+	}
+	// The first 2, then the 5th and 8th.
+	if kept != 4 {
+		t.Errorf("kept %d debug entries, want 4", kept)
+	}
+
+	b, _ := f.Format(&log.Entry{Logger: log.New(), Level: log.InfoLevel, Message: "m", Time: now})
+	if len(b) == 0 {
+		t.Error("info entry was sampled")
+	}
+	b, _ = f.Format(&log.Entry{Logger: log.New(), Level: log.DebugLevel, Message: "m", Time: now.Add(time.Second)})
+	if len(b) == 0 {
+		t.Error("debug entry of the next second was dropped")
+	}
+}
@@ -0,0 +1,855 @@
+// Package signer implements ca-signer, the signing service in front of
+// step-ca, and its subcommands. The command is in cmd/ca-signer.
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/certificates/errs"
+	"sigs.k8s.io/yaml"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+type Config struct {
+	CaURL                   string   `yaml:"caURL"`
+	RootCAPath              string   `yaml:"rootCAPath"`
+	RootFingerprint         string   `yaml:"rootFingerprint"`
+	AdditionalRootCAPaths   []string `yaml:"additionalRootCAPaths"`
+	ProvisionerPasswordFile string   `yaml:"provisionerPasswordFile"`
+	Address                 string   `yaml:"address"`
+	Addresses               []string `yaml:"addresses"`
+	IPFamily                string   `yaml:"ipFamily"`
+	Service                 string   `yaml:"service"`
+	ServerSANs              []string `yaml:"serverSANs"`
+	ServerCert              string   `yaml:"serverCert"`
+	ServerKey               string   `yaml:"serverKey"`
+	LogFormat               string   `yaml:"logFormat"`
+
+	Intermediate IntermediateConfig `yaml:"intermediate"`
+	Policy       policy.Config      `yaml:"policy"`
+	Canary       CanaryConfig       `yaml:"canary"`
+
+	DNSCheck          DNSCheckConfig          `yaml:"dnsCheck"`
+	CSRAttributes     CSRAttributesConfig     `yaml:"csrAttributes"`
+	Extensions        ExtensionsConfig        `yaml:"extensions"`
+	Passthrough       PassthroughConfig       `yaml:"passthrough"`
+	Keys              KeysConfig              `yaml:"keys"`
+	PostQuantum       PostQuantumConfig       `yaml:"postQuantum"`
+	EmailVerification EmailVerificationConfig `yaml:"emailVerification"`
+	SMIME             SMIMEConfig             `yaml:"smime"`
+	Profiles          []ProfileConfig         `yaml:"profiles"`
+	Keygen            KeygenConfig            `yaml:"keygen"`
+	CloudIdentity     CloudIdentityConfig     `yaml:"cloudIdentity"`
+	Batch             BatchConfig             `yaml:"batch"`
+
+	LeaderElection LeaderElectionConfig `yaml:"leaderElection"`
+	RateLimit      RateLimitConfig      `yaml:"rateLimit"`
+	Priority       PriorityConfig       `yaml:"priority"`
+	Timings        TimingsConfig        `yaml:"timings"`
+	Shutdown       ShutdownConfig       `yaml:"shutdown"`
+	Cache          CacheConfig          `yaml:"cache"`
+	Preflight      PreflightConfig      `yaml:"preflight"`
+	ClientAuth     ClientAuthConfig     `yaml:"clientAuth"`
+	TLS            TLSConfig            `yaml:"tls"`
+	Timeouts       TimeoutsConfig       `yaml:"timeouts"`
+	Compression    CompressionConfig    `yaml:"compression"`
+	Proxy          ProxyConfig          `yaml:"proxy"`
+	Upstream       UpstreamConfig       `yaml:"upstream"`
+	Renewal        RenewalConfig        `yaml:"renewal"`
+	Logging        LoggingConfig        `yaml:"logging"`
+	Hooks          []HookConfig         `yaml:"hooks"`
+	Inventory      InventoryConfig      `yaml:"inventory"`
+	Quotas         []QuotaConfig        `yaml:"quotas"`
+	Tenants        []TenantConfig       `yaml:"tenants"`
+	Admin          AdminConfig          `yaml:"admin"`
+	Authn          AuthnConfig          `yaml:"authn"`
+	Directory      DirectoryConfig      `yaml:"directory"`
+	StepAdmin      StepAdminConfig      `yaml:"stepAdmin"`
+	DualIssuance   DualIssuanceConfig   `yaml:"dualIssuance"`
+	CrossSign      CrossSignConfig      `yaml:"crossSign"`
+	TSA            TSAConfig            `yaml:"tsa"`
+	Mirror         MirrorConfig         `yaml:"mirror"`
+	Deprecations   []DeprecationConfig  `yaml:"deprecations"`
+	Monitor        MonitorConfig        `yaml:"monitor"`
+	Anomalies      AnomalyConfig        `yaml:"anomalies"`
+	Clock          ClockConfig          `yaml:"clock"`
+	OTT            OTTConfig            `yaml:"ott"`
+
+	ResponseValidation ResponseValidationConfig `yaml:"responseValidation"`
+	CT                 CTConfig                 `yaml:"ct"`
+
+	Features map[string]bool `yaml:"features"`
+}
+
+// IntermediateConfig configures the /sign/intermediate endpoint used to
+// delegate short-lived issuing CAs.
+type IntermediateConfig struct {
+	Enabled                 bool     `yaml:"enabled"`
+	ProvisionerName         string   `yaml:"provisionerName"`
+	ProvisionerKid          string   `yaml:"provisionerKid"`
+	ProvisionerPasswordFile string   `yaml:"provisionerPasswordFile"`
+	AllowedClients          []string `yaml:"allowedClients"`
+	MaxPathLen              int      `yaml:"maxPathLen"`
+	MaxDuration             string   `yaml:"maxDuration"`
+	RequireConstraints      bool     `yaml:"requireConstraints"`
+	Sensitivity             string   `yaml:"sensitivity"`
+	RequiredMetadata        []string `yaml:"requiredMetadata"`
+
+	NameConstraints NameConstraints `yaml:"nameConstraints"`
+	Delegations     []Delegation    `yaml:"delegations"`
+}
+
+type SignRequest struct {
+	CsrPEM   api.CertificateRequest `json:"csr"`
+	NotAfter api.TimeDuration       `json:"notAfter"`
+	Profile  string                 `json:"profile,omitempty"`
+	Metadata map[string]string      `json:"metadata,omitempty"`
+
+	// NotBefore and TemplateData are passed through to the upstream CA
+	// when passthrough allows the client to set them.
+	NotBefore    api.TimeDuration `json:"notBefore"`
+	TemplateData json.RawMessage  `json:"templateData,omitempty"`
+
+	// redactCSR leaves the CSR out of the hook events, e.g. when it carries
+	// a challenge password.
+	redactCSR bool
+	// extensions are the requested extensions forwarded to the upstream
+	// templates, strippedExtensions the OIDs of the others.
+	extensions         []requestedExtension
+	strippedExtensions []string
+	// scts are the SCTs of the issued certificate in ct sync mode.
+	scts []signedCertificateTimestamp
+	// templateData is the template data passed through, notBefore whether
+	// NotBefore is.
+	templateData map[string]interface{}
+	notBefore    bool
+}
+
+func (s *SignRequest) Validate() error {
+	if s.CsrPEM.CertificateRequest == nil {
+		return errs.BadRequest("missing csr")
+	}
+
+	if pq, err := checkPostQuantum(s.CsrPEM.CertificateRequest); pq {
+		if err != nil {
+			return err
+		}
+	} else if err := s.CsrPEM.CertificateRequest.CheckSignature(); err != nil {
+		return errs.BadRequestErr(err, "invalid csr")
+	}
+	if err := checkCSRLimits(s.CsrPEM.CertificateRequest); err != nil {
+		return errs.BadRequestErr(err, "invalid csr: %s", err)
+	}
+
+	return validateMetadata(s.Metadata)
+}
+
+// GetAddress returns the address set in the configuration, defaults to ":4443"
+// if it's not specified.
+func (c Config) GetAddress() string {
+	if c.Address != "" {
+		return c.Address
+	}
+
+	return ":4443"
+}
+
+func (c Config) GetServiceName() string {
+	if c.Service != "" {
+		return c.Service
+	}
+
+	return "ca-signer.step.svc.cluster.local"
+}
+
+// GetServerSANs returns the SANs of the signer's own certificate. Environment
+// variables are expanded, so "${POD_IP}" can be used with the downward API,
+// and empty values are dropped. IP addresses are written in their canonical
+// form, IPv6 ones with or without brackets. Defaults to the service name and
+// 127.0.0.1, or ::1 if ipFamily is ipv6.
+func (c Config) GetServerSANs() []string {
+	var sans []string
+	for _, s := range c.ServerSANs {
+		s, _ = policy.CanonicalIP(strings.TrimSpace(os.ExpandEnv(s)))
+		if s != "" && !policy.ContainsAny(sans, []string{s}) {
+			sans = append(sans, s)
+		}
+	}
+	if len(sans) > 0 {
+		return sans
+	}
+
+	if c.IPFamily == "ipv6" {
+		return []string{c.GetServiceName(), "::1"}
+	}
+	return []string{c.GetServiceName(), "127.0.0.1"}
+}
+
+func (c Config) GetRootCAPath() string {
+	if c.RootCAPath != "" {
+		return c.RootCAPath
+	}
+
+	return "/home/step/certs/root_ca.crt"
+}
+
+// GetProvisionerPasswordPath returns the path to the provisioner password,
+// defaults to "/home/step/password" if not specified in the
+// configuration.
+func (c Config) GetProvisionerPasswordPath() string {
+	if c.ProvisionerPasswordFile != "" {
+		return c.ProvisionerPasswordFile
+	}
+
+	return "/home/step/password/password"
+}
+
+// GetMaxDuration returns the maximum lifetime of an intermediate, defaults to
+// 24h if not specified or invalid.
+func (c IntermediateConfig) GetMaxDuration() time.Duration {
+	if d, err := time.ParseDuration(c.MaxDuration); err == nil && d > 0 {
+		return d
+	}
+
+	return 24 * time.Hour
+}
+
+// grantFor returns the path length and name constraints that apply to the
+// client in r, and false if the client is not allowed to request
+// intermediates. Delegations take precedence over allowedClients.
+func (c IntermediateConfig) grantFor(r *http.Request) (int, NameConstraints, bool) {
+	if d := c.delegationFor(r); d != nil {
+		return d.MaxPathLen, d.NameConstraints, true
+	}
+	if clientAllowed(r, c.AllowedClients) {
+		return c.MaxPathLen, c.NameConstraints, true
+	}
+
+	return 0, NameConstraints{}, false
+}
+
+// Validate checks the maximum lifetime, name constraints and sensitivity of
+// the intermediate configuration.
+func (c IntermediateConfig) Validate() error {
+	if c.MaxDuration != "" {
+		if d, err := time.ParseDuration(c.MaxDuration); err != nil || d <= 0 {
+			return errors.Errorf("invalid intermediate maxDuration %q", c.MaxDuration)
+		}
+	}
+	if err := validateSensitivity("intermediates", c.Sensitivity, c.RequiredMetadata); err != nil {
+		return err
+	}
+	if err := c.NameConstraints.Validate(); err != nil {
+		return err
+	}
+	for _, d := range c.Delegations {
+		if err := d.NameConstraints.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// intermediateTemplateData returns the data passed to the upstream provisioner
+// template as .Insecure.User when signing an intermediate.
+func intermediateTemplateData(maxPathLen int, nc NameConstraints) map[string]interface{} {
+	data := map[string]interface{}{
+		"isCA":       true,
+		"maxPathLen": maxPathLen,
+	}
+	if !nc.IsEmpty() {
+		data["nameConstraints"] = nc.templateData()
+	}
+
+	return data
+}
+
+// Main runs the signer, or the subcommand in the arguments, and exits on
+// errors.
+func Main() {
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
+	config, err := loadConfig(configFile(os.Args[1:]))
+	if err != nil {
+		fatal(exitConfig, err, "Error loading config")
+	}
+
+	if err := configureLogging(config); err != nil {
+		fatal(exitConfig, err, "Error configuring logging")
+	}
+	log.WithFields(log.Fields{
+		"config": config,
+	}).Info("Loaded config")
+	logFeatures(config)
+	applyProxy(config.Proxy)
+	configureClock(config.Clock)
+	configureOTT(config.OTT)
+	applyPostQuantum(config.PostQuantum)
+	logUpstreamProxy(config.CaURL)
+	if err := bootstrapAtStartup(config); err != nil {
+		fatal(exitUpstream, err, "Error bootstrapping the root certificate")
+	}
+
+	provisionerName := os.Getenv("PROVISIONER_NAME")
+	provisionerKid := os.Getenv("PROVISIONER_KID")
+	log.WithFields(log.Fields{
+		"provisionerName": provisionerName,
+		"provisionerKid":  provisionerKid,
+	}).Info("Loaded provisioner configuration")
+
+	if err := runPreflight(config); err != nil {
+		fatal(exitConfig, err, "Error running preflight checks")
+	}
+
+	password, err := readPasswordFromFile(config.GetProvisionerPasswordPath())
+	if err != nil {
+		fatal(exitConfig, err, "Error reading provisioner password")
+	}
+
+	roots, err := readTrustedRoots(config)
+	if err != nil {
+		fatal(exitConfig, err, "Error reading root certificates")
+	}
+	rootOption, err := upstreamRootOption(config)
+	if err != nil {
+		fatal(exitConfig, err, "Error reading root certificates")
+	}
+
+	provisioner, err := newProvisioner(
+		provisionerName, provisionerKid, config.CaURL, password, rootOption)
+	if err != nil {
+		fatal(exitUpstream, err, "Error loading provisioner")
+	}
+	log.WithFields(log.Fields{
+		"name": provisioner.Name(),
+		"kid":  provisioner.Kid(),
+	}).Info("Loaded provisioner")
+
+	if err := preflightProvisioner(config, provisioner); err != nil {
+		fatal(exitConfig, err, "Error running preflight checks")
+	}
+
+	s, err := newServer(config, provisioner, roots)
+	if err != nil {
+		fatal(exitConfig, err, "Error loading authentication tokens")
+	}
+	if config.Intermediate.Enabled {
+		s.intermediate, err = loadIntermediateProvisioner(config, provisioner, password)
+		if err != nil {
+			fatal(exitUpstream, err, "Error loading intermediate provisioner")
+		}
+		log.WithFields(log.Fields{
+			"name": s.intermediate.Name(),
+			"kid":  s.intermediate.Kid(),
+		}).Info("Loaded intermediate provisioner")
+	}
+
+	if config.Canary.Enabled() {
+		c := config.Canary
+		caURL := c.CaURL
+		if caURL == "" {
+			caURL = config.CaURL
+		}
+		s.canary, err = loadProvisioner(config, caURL, c.ProvisionerName, c.ProvisionerKid, c.ProvisionerPasswordFile, provisioner, password)
+		if err != nil {
+			fatal(exitUpstream, err, "Error loading canary provisioner")
+		}
+		log.WithFields(log.Fields{
+			"percent": c.Percent,
+			"caURL":   caURL,
+			"name":    s.canary.Name(),
+			"kid":     s.canary.Kid(),
+		}).Info("Loaded canary configuration")
+	}
+
+	if config.DualIssuance.Enabled() {
+		c := config.DualIssuance
+		s.secondary, err = loadProvisioner(config, c.CaURL, c.ProvisionerName, c.ProvisionerKid, c.ProvisionerPasswordFile, provisioner, password)
+		if err != nil {
+			fatal(exitUpstream, err, "Error loading secondary provisioner")
+		}
+		log.WithFields(log.Fields{
+			"caURL": c.CaURL,
+			"mode":  c.GetMode(),
+			"name":  s.secondary.Name(),
+			"kid":   s.secondary.Kid(),
+		}).Info("Loaded dual issuance configuration")
+	}
+
+	var targets []upstreamTarget
+	for _, name := range []string{upstreamDefault, upstreamIntermediate, upstreamCanary, upstreamSecondary} {
+		if p := s.upstream(name); p != nil && (name == upstreamDefault || p != provisioner) {
+			caURL, _ := s.upstreamSource(name)
+			targets = append(targets, upstreamTarget{name: name, caURL: caURL})
+		}
+	}
+	s.monitor = newUpstreamMonitor(s, roots, targets...)
+	s.jobs.AddLocal("upstream-monitor", config.Monitor.GetInterval(), s.monitor.check)
+	if n := config.Clock.NTP; n != nil {
+		s.jobs.AddLocal("clock-drift", n.GetInterval(), newDriftMonitor(*n).check)
+	}
+
+	if err := takeOver(config.Shutdown.GetTimeout() + 10*time.Second); err != nil {
+		fatal(exitError, err, "Error taking over from the previous process")
+	}
+
+	if config.Inventory.Enabled() {
+		s.inventory, err = openInventory(config.Inventory)
+		if err != nil {
+			fatal(exitConfig, err, "Error opening inventory")
+		}
+		s.lifecycle.OnShutdown("inventory", func(context.Context) error {
+			return s.inventory.Close()
+		})
+		// Every replica counts its own failures, flushed before the
+		// inventory is closed.
+		s.jobs.AddLocal("failure-counters", failureFlushInterval, s.inventory.FlushFailures)
+		s.lifecycle.OnShutdown("failure-counters", s.inventory.FlushFailures)
+		if s.policyRules, err = loadRuntimePolicy(s.inventory); err != nil {
+			fatal(exitConfig, err, "Error loading policy rules")
+		}
+		// A shared store is maintained by the leader, a BoltDB file by
+		// each replica.
+		addJob := s.jobs.AddLocal
+		if s.inventory.shared {
+			addJob = s.jobs.Add
+			s.jobs.AddLocal("policy-reload", 30*time.Second, s.policyRules.reload)
+		}
+		if r := config.Inventory.Retention; r.Enabled() {
+			addJob("inventory-retention", r.GetInterval(), s.runRetention)
+		}
+		if e := config.Inventory.Export; e != nil {
+			addJob("inventory-export", e.GetInterval(), s.runExport)
+		}
+	}
+
+	if err := recordConfig(config, s.inventory); err != nil {
+		logFor("config").WithField("error", err).Error("Error recording the configuration")
+	}
+
+	if config.Directory.Enabled() {
+		s.directory, err = newDirectory(config.Directory)
+		if err != nil {
+			fatal(exitConfig, err, "Error loading directory")
+		}
+	}
+
+	if config.CT.Enabled() {
+		s.ct, err = newCTSubmitter(config.CT)
+		if err != nil {
+			fatal(exitConfig, err, "Error loading CT logs")
+		}
+	}
+
+	if config.TSA.Enabled {
+		s.tsa = newTimestamper(config.TSA)
+		s.jobs.AddLocal("tsa-certificate", time.Minute, s.renewTSA)
+	}
+
+	if config.Mirror.Enabled() {
+		s.mirror, err = newMirror(config.Mirror)
+		if err != nil {
+			fatal(exitConfig, err, "Error loading mirror")
+		}
+	}
+
+	// make sure to cancel the renew goroutine
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The jobs stop before the inventory they use is closed.
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	s.lifecycle.OnStart("jobs", func(context.Context) error {
+		return s.jobs.Run(jobsCtx, config.LeaderElection)
+	})
+	s.lifecycle.OnShutdown("jobs", func(context.Context) error {
+		stopJobs()
+		return nil
+	})
+	if err := s.lifecycle.Start(ctx); err != nil {
+		fatal(exitConfig, err, "Error starting the signer")
+	}
+
+	srv, err := newHTTPServer(ctx, config, provisioner, s.routes())
+	if err != nil {
+		fatal(exitUpstream, err, "Error creating server")
+	}
+
+	listeners, err := listen(config)
+	if err != nil {
+		fatal(exitListen, err, "Error binding listener")
+	}
+
+	var onShutdown []func()
+	if s.renewals != nil {
+		onShutdown = append(onShutdown, s.renewals.closeStreams)
+	}
+	err = serve(srv, config, listeners, onShutdown...)
+	stopCtx, stop := context.WithTimeout(context.Background(), lifecycleShutdownTimeout)
+	defer stop()
+	s.lifecycle.Shutdown(stopCtx)
+	if err != nil {
+		fatal(exitError, err, "Error serving")
+	}
+}
+
+// loadIntermediateProvisioner returns the provisioner used to sign
+// intermediates. It falls back to the default provisioner if no specific one
+// is configured.
+func loadIntermediateProvisioner(config *Config, def *ca.Provisioner, password []byte) (*ca.Provisioner, error) {
+	cfg := config.Intermediate
+	return loadProvisioner(config, config.CaURL, cfg.ProvisionerName, cfg.ProvisionerKid, cfg.ProvisionerPasswordFile, def, password)
+}
+
+// loadProvisioner loads the named provisioner from the CA at caURL. It
+// returns def if no name is given and the CA is the default one, and the
+// password is only read from passwordFile if it is set.
+func loadProvisioner(config *Config, caURL, name, kid, passwordFile string, def *ca.Provisioner, password []byte) (*ca.Provisioner, error) {
+	if name == "" {
+		if caURL == config.CaURL {
+			return def, nil
+		}
+		name = def.Name()
+	}
+
+	if passwordFile != "" {
+		var err error
+		if password, err = readPasswordFromFile(passwordFile); err != nil {
+			return nil, err
+		}
+	}
+
+	rootOption, err := upstreamRootOption(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProvisioner(name, kid, caURL, password, rootOption)
+}
+
+// loadConfig reads the config file, if any, then sets the fields from the
+// CA_SIGNER_ environment variables and validates the result.
+func loadConfig(file string) (*Config, error) {
+	var cfg Config
+	var data []byte
+	if file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := verifyConfig(file, data); err != nil {
+		return nil, err
+	}
+	if file != "" {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(&cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Validate checks the configuration and the consistency of its sections.
+func (cfg *Config) Validate() error {
+	if cfg.CaURL == "" {
+		return errors.New("caURL is required, set it in the config file or in CA_SIGNER_CA_URL")
+	}
+
+	if fp := cfg.RootFingerprint; fp != "" {
+		if b, err := hex.DecodeString(normalizeFingerprint(fp)); err != nil || len(b) != sha256.Size {
+			return errors.Errorf("invalid rootFingerprint %q, must be a SHA-256 fingerprint in hexadecimal", fp)
+		}
+	}
+
+	if (cfg.ServerCert == "") != (cfg.ServerKey == "") {
+		return errors.New("serverCert and serverKey must be set together")
+	}
+
+	if err := cfg.Logging.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.TLS.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Timeouts.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Intermediate.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Policy.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.DNSCheck.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.CSRAttributes.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Extensions.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Passthrough.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateFeatures(cfg.Features); err != nil {
+		return err
+	}
+
+	if err := cfg.PostQuantum.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Keys.Validate(cfg.PostQuantum); err != nil {
+		return err
+	}
+
+	if err := cfg.EmailVerification.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.SMIME.Validate(cfg.EmailVerification); err != nil {
+		return err
+	}
+
+	profiles := map[string]bool{}
+	for _, p := range cfg.Profiles {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if profiles[p.Name] {
+			return errors.Errorf("duplicated profile %q", p.Name)
+		}
+		profiles[p.Name] = true
+	}
+
+	if err := cfg.Authn.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Renewal.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.validateListen(); err != nil {
+		return err
+	}
+
+	if err := cfg.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Proxy.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Upstream.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.ResponseValidation.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.CT.Validate(); err != nil {
+		return err
+	}
+
+	if th := cfg.ClientAuth.TrustedHeader; th != nil {
+		if err := th.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.ClientAuth.Revocation.Validate(); err != nil {
+		return err
+	}
+	if slices.Contains(cfg.ClientAuth.Revocation.Sources, revocationInventory) && !cfg.Inventory.Enabled() {
+		return errors.New("clientAuth.revocation source inventory requires the inventory")
+	}
+
+	if err := cfg.Inventory.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Anomalies.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Keygen.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.CloudIdentity.Validate(); err != nil {
+		return err
+	}
+	if cfg.CloudIdentity.Enabled() && cfg.Authn.requirementFor("/sign/cloud") == authnMTLS {
+		return errors.New("cloudIdentity requires an authn endpoint for /sign/cloud that does not require mtls")
+	}
+
+	if err := cfg.Batch.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Canary.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.DualIssuance.Validate(); err != nil {
+		return err
+	}
+	if cfg.DualIssuance.Enabled() && cfg.DualIssuance.GetMode() == dualIssuanceStore && !cfg.Inventory.Enabled() {
+		return errors.New("dualIssuance mode store requires the inventory")
+	}
+
+	if err := cfg.RateLimit.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Priority.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Shutdown.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.LeaderElection.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Clock.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.OTT.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.StepAdmin.Validate(); err != nil {
+		return err
+	}
+	if cfg.StepAdmin.Enabled() && !cfg.Admin.Enabled() {
+		return errors.New("stepAdmin requires the admin API")
+	}
+
+	if err := cfg.CrossSign.Validate(); err != nil {
+		return err
+	}
+	if cfg.CrossSign.Enabled() && (!cfg.Admin.Enabled() || !cfg.Intermediate.Enabled) {
+		return errors.New("crossSign requires the admin API and intermediates")
+	}
+
+	if err := cfg.TSA.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Mirror.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Directory.Validate(); err != nil {
+		return err
+	}
+	if !cfg.Directory.Enabled() && (cfg.Policy.UsesGroups() || (cfg.Canary.Policy != nil && cfg.Canary.Policy.UsesGroups())) {
+		return errors.New("policy rules with groups require a directory")
+	}
+
+	for _, h := range cfg.Hooks {
+		if err := h.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range cfg.Deprecations {
+		if err := d.Validate(); err != nil {
+			return err
+		}
+	}
+
+	tenants := map[string]bool{}
+	for _, t := range cfg.Tenants {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+		if tenants[t.Name] {
+			return errors.Errorf("duplicated tenant %q", t.Name)
+		}
+		tenants[t.Name] = true
+	}
+
+	if len(cfg.Quotas) > 0 && !cfg.Inventory.Enabled() {
+		return errors.New("quotas require the inventory")
+	}
+	teams := map[string]bool{}
+	for _, q := range cfg.Quotas {
+		if err := q.Validate(); err != nil {
+			return err
+		}
+		if teams[q.Team] {
+			return errors.Errorf("duplicated quota team %q", q.Team)
+		}
+		teams[q.Team] = true
+	}
+
+	return nil
+}
+
+// readPasswordFromFile reads and returns the password from the given filename.
+// The contents of the file will be trimmed at the right.
+func readPasswordFromFile(filename string) ([]byte, error) {
+	password, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	password = bytes.TrimRightFunc(password, unicode.IsSpace)
+	return password, nil
+}
+
+func generateSubject(sans []string) string {
+	if len(sans) == 0 {
+		return "127.0.0.1"
+	}
+
+	for _, s := range sans {
+		if s != "127.0.0.1" && s != "localhost" {
+			return s
+		}
+	}
+
+	return sans[0]
+}
@@ -0,0 +1,27 @@
+package signer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetServerSANs(t *testing.T) {
+	t.Setenv("POD_IP", "10.0.0.7")
+	t.Setenv("POD_IPV6", "")
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"default", Config{}, []string{"ca-signer.step.svc.cluster.local", "127.0.0.1"}},
+		{"service", Config{Service: "signer.pki.svc", IPFamily: "ipv6"}, []string{"signer.pki.svc", "::1"}},
+		{"expanded", Config{ServerSANs: []string{"signer.example.com", "${POD_IP}", "${POD_IPV6}", " signer.example.com "}}, []string{"signer.example.com", "10.0.0.7"}},
+		{"IPv6", Config{ServerSANs: []string{"[2001:DB8::1]", "2001:db8:0::1"}}, []string{"2001:db8::1"}},
+		{"all empty", Config{ServerSANs: []string{"${POD_IPV6}"}}, []string{"ca-signer.step.svc.cluster.local", "127.0.0.1"}},
+	}
+	for _, tt := range tests {
+		if got := tt.config.GetServerSANs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: GetServerSANs() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// AdminConfig configures the admin API. It is only served to the listed
+// client certificate names.
+type AdminConfig struct {
+	Clients []string `yaml:"clients"`
+}
+
+// Enabled returns true if admin clients are configured.
+func (c AdminConfig) Enabled() bool {
+	return len(c.Clients) > 0
+}
+
+// maintenanceMode rejects the sign requests while enabled and counts the
+// sign requests in flight, so the signer can be drained before upstream CA
+// maintenance.
+type maintenanceMode struct {
+	inFlight atomic.Int64
+
+	mu         sync.Mutex
+	enabled    bool
+	reason     string
+	since      time.Time
+	retryAfter time.Duration
+}
+
+// maintenanceStatus is the JSON returned by the maintenance endpoints.
+type maintenanceStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Reason     string     `json:"reason,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+	RetryAfter string     `json:"retryAfter,omitempty"`
+	InFlight   int64      `json:"inFlight"`
+	Drained    *bool      `json:"drained,omitempty"`
+}
+
+func (m *maintenanceMode) status() maintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := maintenanceStatus{Enabled: m.enabled, InFlight: m.inFlight.Load()}
+	if m.enabled {
+		since := m.since
+		st.Reason, st.Since, st.RetryAfter = m.reason, &since, m.retryAfter.String()
+	}
+	return st
+}
+
+func (m *maintenanceMode) set(enabled bool, reason string, retryAfter time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if enabled && !m.enabled {
+		m.since = time.Now().UTC()
+	}
+	m.enabled, m.reason, m.retryAfter = enabled, reason, retryAfter
+	if enabled {
+		maintenanceGauge.Set(1)
+	} else {
+		maintenanceGauge.Set(0)
+	}
+}
+
+// wait returns true once no sign request is in flight, or false if the
+// timeout expires first.
+func (m *maintenanceMode) wait(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for m.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+
+	return true
+}
+
+// maintenance wraps a sign endpoint, rejecting requests with 503 Service
+// Unavailable while the signer is in maintenance, and counting the requests
+// in flight.
+func (s *server) maintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := &s.maintenanceMode
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+
+		m.mu.Lock()
+		enabled, reason, retryAfter := m.enabled, m.reason, m.retryAfter
+		m.mu.Unlock()
+		if enabled {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			render.Error(w, r, errs.New(http.StatusServiceUnavailable, "signer is in maintenance: %s", reason))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// admin wraps next allowing only the admin clients.
+func (s *server) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !clientAllowed(r, s.config.Admin.Clients) {
+			logFor("admin").WithFields(log.Fields{
+				"client": clientIdentities(r),
+				"path":   r.URL.Path,
+			}).Warn("Forbidden: client is not an admin")
+			render.Error(w, r, errs.Forbidden("client is not allowed to use the admin API"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// MaintenanceRequest is the body of PUT /admin/maintenance and POST
+// /admin/drain.
+type MaintenanceRequest struct {
+	Enabled    bool   `json:"enabled"`
+	Reason     string `json:"reason"`
+	RetryAfter string `json:"retryAfter"`
+	Timeout    string `json:"timeout"`
+}
+
+// parse returns the Retry-After duration, defaults to 5m, and the drain
+// timeout, defaults to 30s.
+func (b MaintenanceRequest) parse() (retryAfter, timeout time.Duration, err error) {
+	retryAfter, timeout = 5*time.Minute, 30*time.Second
+	if b.RetryAfter != "" {
+		if retryAfter, err = time.ParseDuration(b.RetryAfter); err != nil || retryAfter < 0 {
+			return 0, 0, errs.BadRequest("invalid retryAfter %q", b.RetryAfter)
+		}
+	}
+	if b.Timeout != "" {
+		if timeout, err = time.ParseDuration(b.Timeout); err != nil || timeout < 0 {
+			return 0, 0, errs.BadRequest("invalid timeout %q", b.Timeout)
+		}
+	}
+
+	return retryAfter, timeout, nil
+}
+
+func decodeMaintenanceRequest(r *http.Request) (MaintenanceRequest, error) {
+	var body MaintenanceRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return body, errs.BadRequestErr(err, "error reading request body")
+		}
+	}
+	if body.Reason == "" {
+		body.Reason = "maintenance"
+	}
+
+	return body, nil
+}
+
+// getMaintenance returns the maintenance status.
+func (s *server) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, s.maintenanceMode.status())
+}
+
+// putMaintenance enables or disables the maintenance mode.
+func (s *server) putMaintenance(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeMaintenanceRequest(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	retryAfter, _, err := body.parse()
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	s.maintenanceMode.set(body.Enabled, body.Reason, retryAfter)
+	logFor("admin").WithFields(log.Fields{
+		"client":  clientIdentities(r),
+		"enabled": body.Enabled,
+		"reason":  body.Reason,
+	}).Warn("Changed maintenance mode")
+
+	render.JSON(w, r, s.maintenanceMode.status())
+}
+
+// drain enables the maintenance mode and waits until the sign requests in
+// flight have completed or the timeout expires.
+func (s *server) drain(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeMaintenanceRequest(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	retryAfter, timeout, err := body.parse()
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	s.maintenanceMode.set(true, body.Reason, retryAfter)
+	logger := logFor("admin").WithFields(log.Fields{
+		"client": clientIdentities(r),
+		"reason": body.Reason,
+	})
+	logger.Warn("Draining sign requests")
+
+	drained := s.maintenanceMode.wait(r.Context(), timeout)
+	st := s.maintenanceMode.status()
+	st.Drained = &drained
+	logger.WithField("inFlight", st.InFlight).Info("Drain finished")
+	render.JSON(w, r, st)
+}
@@ -0,0 +1,93 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaintenance(t *testing.T) {
+	s := &server{config: &Config{Admin: AdminConfig{Clients: []string{"ops"}}}}
+	sign := s.maintenance(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	put := s.admin(s.putMaintenance)
+	call := func(h http.HandlerFunc, client, method, path, body string) *httptest.ResponseRecorder {
+		r := withIdentities(httptest.NewRequest(method, path, strings.NewReader(body)), client)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	if w := call(put, "web", http.MethodPut, "/admin/maintenance", `{"enabled":true}`); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := call(put, "ops", http.MethodPut, "/admin/maintenance", `{"enabled":true,"retryAfter":"soon"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid retryAfter: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := call(put, "ops", http.MethodPut, "/admin/maintenance", `{"enabled":true,"reason":"CA upgrade","retryAfter":"2m"}`)
+	var st maintenanceStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil || !st.Enabled || st.Reason != "CA upgrade" || st.Since == nil {
+		t.Errorf("enable: status = %s, want enabled for the CA upgrade", w.Body)
+	}
+	if got := testutil.ToFloat64(maintenanceGauge); got != 1 {
+		t.Errorf("maintenance gauge = %v, want 1", got)
+	}
+
+	w = call(sign, "web", http.MethodPost, "/sign", "")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "120" {
+		t.Errorf("sign in maintenance: status = %d, Retry-After = %q, want 503 and 120", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	call(put, "ops", http.MethodPut, "/admin/maintenance", `{"enabled":false}`)
+	if w := call(sign, "web", http.MethodPost, "/sign", ""); w.Code != http.StatusCreated {
+		t.Errorf("sign after maintenance: status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got := testutil.ToFloat64(maintenanceGauge); got != 0 {
+		t.Errorf("maintenance gauge = %v, want 0", got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := &server{config: &Config{}}
+	started, release := make(chan struct{}), make(chan struct{})
+	sign := s.maintenance(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	done := make(chan struct{})
+	go func() {
+		sign(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/sign", nil))
+		close(done)
+	}()
+	<-started
+
+	drain := func(timeout string) maintenanceStatus {
+		w := httptest.NewRecorder()
+		s.drain(w, httptest.NewRequest(http.MethodPost, "/admin/drain", strings.NewReader(`{"timeout":"`+timeout+`"}`)))
+		var st maintenanceStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil || st.Drained == nil {
+			t.Fatalf("drain: %d %s", w.Code, w.Body)
+		}
+		return st
+	}
+
+	if st := drain("150ms"); *st.Drained || st.InFlight != 1 || !st.Enabled || st.Reason != "maintenance" {
+		t.Errorf("drain with a request in flight = %+v, want not drained", st)
+	}
+	close(release)
+	<-done
+	if st := drain("5s"); !*st.Drained || st.InFlight != 0 {
+		t.Errorf("drain after the request = %+v, want drained", st)
+	}
+	s.maintenanceMode.set(false, "", 0)
+
+	if _, _, err := (MaintenanceRequest{Timeout: "-1s"}).parse(); err == nil {
+		t.Error("parse() accepted a negative timeout")
+	}
+}
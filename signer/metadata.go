@@ -0,0 +1,48 @@
+package signer
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/smallstep/certificates/errs"
+)
+
+// Limits of the metadata of a sign request.
+const (
+	maxMetadataEntries     = 16
+	maxMetadataValueLength = 256
+)
+
+var metadataKeyRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// validateMetadata checks the number of entries, the keys and the length of
+// the values of the metadata sent with a sign request, such as the team,
+// ticket or workload ID.
+func validateMetadata(md map[string]string) error {
+	if len(md) > maxMetadataEntries {
+		return errs.BadRequest("metadata has more than %d entries", maxMetadataEntries)
+	}
+	for k, v := range md {
+		if !metadataKeyRegexp.MatchString(k) {
+			return errs.BadRequest("invalid metadata key %q", k)
+		}
+		if len(v) > maxMetadataValueLength {
+			return errs.BadRequest("metadata %q is longer than %d characters", k, maxMetadataValueLength)
+		}
+	}
+
+	return nil
+}
+
+// formatMetadata returns the metadata as sorted key=value pairs separated by
+// spaces.
+func formatMetadata(md map[string]string) string {
+	pairs := make([]string, 0, len(md))
+	for k, v := range md {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+
+	return strings.Join(pairs, " ")
+}
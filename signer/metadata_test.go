@@ -0,0 +1,68 @@
+package signer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/api"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	many := map[string]string{}
+	for i := 0; i <= maxMetadataEntries; i++ {
+		many["k"+strconv.Itoa(i)] = "v"
+	}
+	tests := []struct {
+		name string
+		md   map[string]string
+		ok   bool
+	}{
+		{"none", nil, true},
+		{"valid", map[string]string{"team": "payments", "ticket": "OPS-123", "workload.id": "api_v2"}, true},
+		{"too many", many, false},
+		{"key", map[string]string{"team name": "payments"}, false},
+		{"key start", map[string]string{"-team": "payments"}, false},
+		{"value", map[string]string{"team": strings.Repeat("x", maxMetadataValueLength+1)}, false},
+	}
+	for _, tt := range tests {
+		err := validateMetadata(tt.md)
+		if (err == nil) != tt.ok || (!tt.ok && errorStatus(err) != http.StatusBadRequest) {
+			t.Errorf("%s: validateMetadata() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestFormatMetadata(t *testing.T) {
+	if got := formatMetadata(map[string]string{"ticket": "OPS-123", "team": "payments"}); got != "team=payments ticket=OPS-123" {
+		t.Errorf("formatMetadata() = %q, want %q", got, "team=payments ticket=OPS-123")
+	}
+	if got := formatMetadata(nil); got != "" {
+		t.Errorf("formatMetadata(nil) = %q, want empty", got)
+	}
+}
+
+func TestIssuedRecordsMetadata(t *testing.T) {
+	root, rootKey := newTestCert(t, "Root CA")
+	leaf, _ := issueTestCert(t, root, rootKey, "app.example.com", false)
+	s := &server{config: &Config{}, inventory: newTestInventory(t), hooks: newHookRunner(nil)}
+
+	r, request := newPolicyTestRequest(t, "web", "app.example.com")
+	request.Metadata = map[string]string{"team": "payments"}
+	s.issued(newHookEvent(r, generationStable, request), &api.SignResponse{
+		ServerPEM: api.NewCertificate(leaf), CaPEM: api.NewCertificate(root),
+	})
+
+	rec, err := s.inventory.Get(leaf.SerialNumber.String())
+	if err != nil || rec == nil {
+		t.Fatalf("Get() = %v, %v, want the issued certificate", rec, err)
+	}
+	if rec.Metadata.Labels["team"] != "payments" {
+		t.Errorf("labels = %v, want team=payments", rec.Metadata.Labels)
+	}
+	if got := newExportRecord(rec, time.Now()).Labels; got != "team=payments" {
+		t.Errorf("exported labels = %q, want team=payments", got)
+	}
+}
@@ -0,0 +1,358 @@
+package signer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	signRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "sign_requests_total",
+		Help:      "Number of sign requests, by config generation, result and tenant.",
+	}, []string{"generation", "result", "tenant"})
+
+	policyDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "policy_denials_total",
+		Help:      "Number of sign requests denied by the policy, by rule, config generation and tenant.",
+	}, []string{"rule", "generation", "tenant"})
+
+	policyReportedDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "policy_reported_denials_total",
+		Help:      "Number of sign requests that report-only rules would have denied, by rule, config generation and tenant.",
+	}, []string{"rule", "generation", "tenant"})
+
+	highSensitivityIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "high_sensitivity_issued_total",
+		Help:      "Number of certificates issued for high-sensitivity profiles and intermediates, by profile or endpoint and tenant.",
+	}, []string{"profile", "tenant"})
+
+	configGeneration = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "config_generation",
+		Help:      "Generation of the configuration, incremented each time the signer starts with a changed configuration.",
+	})
+
+	configChangedTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "config_last_change_timestamp_seconds",
+		Help:      "Time the configuration generation was first started.",
+	})
+
+	configInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "config_info",
+		Help:      "Always 1, with the SHA-256 of the effective configuration.",
+	}, []string{"hash"})
+
+	configChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "config_changes_total",
+		Help:      "Number of fields changed by the last configuration change, by top-level section.",
+	}, []string{"section"})
+
+	tlsHandshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "tls_handshakes_total",
+		Help:      "Number of TLS handshakes, by version, cipher suite and whether the session was resumed.",
+	}, []string{"version", "cipher_suite", "resumed"})
+
+	tlsHandshakeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "tls_handshake_failures_total",
+		Help:      "Number of failed TLS handshakes, by reason.",
+	}, []string{"reason"})
+
+	dualIssuances = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "dual_issuances_total",
+		Help:      "Number of certificates issued with the secondary CA of the dual issuance, by result.",
+	}, []string{"result"})
+
+	timestamps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "timestamps_total",
+		Help:      "Number of timestamp queries answered by the TSA, by result.",
+	}, []string{"result"})
+
+	deprecatedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "deprecated_requests_total",
+		Help:      "Number of requests to deprecated endpoints or setting deprecated fields, by configured path, field and tenant.",
+	}, []string{"endpoint", "field", "tenant"})
+
+	mirroredRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "mirrored_requests_total",
+		Help:      "Number of sign requests mirrored to the staging signer, by result.",
+	}, []string{"result"})
+
+	crossSignatures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "cross_signatures_total",
+		Help:      "Number of intermediates of other hierarchies cross-signed for the admin clients, by result.",
+	}, []string{"result"})
+
+	stepAdminOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "step_admin_operations_total",
+		Help:      "Number of step-ca admin operations proxied for the admin clients, by operation and result.",
+	}, []string{"operation", "result"})
+
+	directoryLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "directory_lookups_total",
+		Help:      "Number of lookups of the groups of a client identity in the directory, by type and result.",
+	}, []string{"type", "result"})
+
+	clientRevocationChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "client_revocation_checks_total",
+		Help:      "Number of revocation checks of client certificates, by source and result.",
+	}, []string{"source", "result"})
+
+	clientRevocationDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "client_revocation_denials_total",
+		Help:      "Number of requests rejected by the revocation checks of client certificates, by reason.",
+	}, []string{"reason"})
+
+	cloudIdentityExchanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "cloud_identity_exchanges_total",
+		Help:      "Number of cloud identity exchanges on /sign/cloud, by provider and result.",
+	}, []string{"provider", "result"})
+
+	oidcAuthentications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "oidc_authentications_total",
+		Help:      "Number of OIDC bearer tokens verified, by provider and result.",
+	}, []string{"provider", "result"})
+
+	signQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "sign_queue_depth",
+		Help:      "Number of sign requests waiting for a slot, by priority class.",
+	}, []string{"class"})
+
+	signQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ca_signer",
+		Name:      "sign_queue_wait_seconds",
+		Help:      "Time sign requests waited for a slot, by priority class.",
+		Buckets:   []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"class"})
+
+	signQueueRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "sign_queue_rejections_total",
+		Help:      "Number of sign requests rejected without a slot, by priority class and reason (full or timeout).",
+	}, []string{"class", "reason"})
+
+	signConcurrencyLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "sign_concurrency_limit",
+		Help:      "Current limit of sign requests processed at once.",
+	})
+
+	signPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ca_signer",
+		Name:      "sign_phase_duration_seconds",
+		Help:      "Time spent in each phase of the sign requests.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"phase"})
+
+	upstreamDials = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "upstream_connections_total",
+		Help:      "Number of connections opened to the upstream CAs.",
+	})
+
+	upstreamHandshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "upstream_tls_handshakes_total",
+		Help:      "Number of TLS handshakes with the upstream CAs, by resumed.",
+	}, []string{"resumed"})
+
+	leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "leader",
+		Help:      "Whether this replica is the leader running the background jobs.",
+	})
+
+	rateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "rate_limited_total",
+		Help:      "Number of sign requests rejected by the rate limiter.",
+	})
+
+	rateLimiterErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "rate_limiter_errors_total",
+		Help:      "Number of errors checking the rate limit.",
+	})
+
+	hookRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "hook_runs_total",
+		Help:      "Number of hook runs, by hook, event and result.",
+	}, []string{"hook", "event", "result"})
+
+	inventoryErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "inventory_errors_total",
+		Help:      "Number of errors storing issued certificates in the inventory.",
+	})
+
+	anomaliesDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "anomalies_detected_total",
+		Help:      "Number of issuance anomalies detected, by type.",
+	}, []string{"type"})
+
+	quotaUsed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "quota_used",
+		Help:      "Number of certificates issued to a team this month.",
+	}, []string{"team"})
+
+	quotaExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "quota_exhausted_total",
+		Help:      "Number of sign requests rejected because the team quota was exhausted.",
+	}, []string{"team"})
+
+	maintenanceGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "maintenance",
+		Help:      "Whether the signer is in maintenance and rejects sign requests (1) or not (0).",
+	})
+
+	upstreamUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "upstream_up",
+		Help:      "Whether the last health check of the upstream CA succeeded (1) or not (0), by upstream.",
+	}, []string{"upstream"})
+
+	upstreamProvisionerAvailable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "upstream_provisioner_available",
+		Help:      "Whether the provisioner was listed by the upstream CA at the last check (1) or not (0), by upstream.",
+	}, []string{"upstream"})
+
+	upstreamLastCheck = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "upstream_last_check_timestamp_seconds",
+		Help:      "Unix time of the last check of the upstream CA, by upstream.",
+	}, []string{"upstream"})
+
+	issuedByRoot = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "issued_by_root_total",
+		Help:      "Number of certificates issued, by SHA-256 fingerprint of the root that signed the chain.",
+	}, []string{"root"})
+
+	provisionerRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "provisioner_refreshes_total",
+		Help:      "Number of provisioner credential refreshes, by upstream and result.",
+	}, []string{"upstream", "result"})
+
+	trustedHeaderRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "trusted_header_rejected_total",
+		Help:      "Number of requests rejected for sending the trusted identity header from an untrusted source.",
+	})
+
+	replayRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "replay_rejections_total",
+		Help:      "Number of requests with a bearer token rejected for a missing or invalid signature or nonce, by reason.",
+	}, []string{"reason"})
+
+	authnFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "authn_failures_total",
+		Help:      "Number of requests rejected for missing or invalid credentials, by endpoint requirement.",
+	}, []string{"require"})
+
+	renewalStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "renewal_streams",
+		Help:      "Number of open renewal streams.",
+	})
+
+	renewalNotices = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "renewal_notices_total",
+		Help:      "Renewal notices sent to the streams, by result.",
+	}, []string{"result"})
+
+	campaignPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "rotation_campaign_pending",
+		Help:      "Certificates not rotated yet, by rotation campaign, as of the last report.",
+	}, []string{"campaign"})
+
+	compromiseReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "compromise_reports_total",
+		Help:      "Key compromise reports, by result.",
+	}, []string{"result"})
+
+	revocations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "revocations_total",
+		Help:      "Certificates revoked through the signer, by result.",
+	}, []string{"result"})
+
+	upstreamPinFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "upstream_pin_failures_total",
+		Help:      "Connections to an upstream CA rejected because its certificates do not match the pins.",
+	})
+
+	upstreamChainRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "upstream_chain_repairs_total",
+		Help:      "Chains returned by the upstream CAs with duplicate, out of order or unrelated certificates, by upstream and problem.",
+	}, []string{"upstream", "problem"})
+
+	upstreamRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "upstream_rejected_certificates_total",
+		Help:      "Certificates returned by the upstream CAs and rejected by the response validation, by upstream and reason.",
+	}, []string{"upstream", "reason"})
+
+	ctSubmissions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "ct_submissions_total",
+		Help:      "Certificates submitted to Certificate Transparency logs, by log and result.",
+	}, []string{"log", "result"})
+
+	panics = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "panics_total",
+		Help:      "Number of panics recovered in the HTTP handlers.",
+	})
+
+	featureEnabled = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "feature_enabled",
+		Help:      "1 if the feature is enabled, by feature.",
+	}, []string{"feature"})
+
+	clockDrift = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ca_signer",
+		Name:      "clock_drift_seconds",
+		Help:      "Offset of the NTP servers to the host clock at the last measure; positive when the host clock is behind.",
+	})
+
+	clockSyncErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ca_signer",
+		Name:      "clock_sync_errors_total",
+		Help:      "Failed queries of the NTP servers, by server.",
+	}, []string{"server"})
+)
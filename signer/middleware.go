@@ -0,0 +1,67 @@
+package signer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// recoverer converts panics in next into 500 Internal Server Error responses
+// and logs them with their stack trace.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler { //nolint:errorlint // sentinel passed to panic
+				panic(rec)
+			}
+
+			panics.Inc()
+			logFor("server").WithFields(log.Fields{
+				"request": requestID(r),
+				"path":    r.URL.Path,
+				"panic":   rec,
+				"stack":   string(debug.Stack()),
+			}).Error("Recovered from panic in handler")
+			render.Error(w, r, errs.InternalServer("internal server error"))
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type requestIDKey struct{}
+
+// validRequestID matches the request IDs accepted from clients or proxies.
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+// requestIDs assigns an ID to every request, the X-Request-Id sent by the
+// client if valid or a random one, and returns it in X-Request-Id.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of the request.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,86 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoverer(t *testing.T) {
+	handler := recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	before := testutil.ToFloat64(panics)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("panic: status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	var body struct {
+		Status int `json:"status"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Status != http.StatusInternalServerError {
+		t.Errorf("panic: body = %s, want the internal server error JSON", w.Body)
+	}
+	if got := testutil.ToFloat64(panics) - before; got != 1 {
+		t.Errorf("panic: panics_total increased by %v, want 1", got)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ok", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("no panic: status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	// http.ErrAbortHandler aborts the response and must reach net/http.
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler { //nolint:errorlint // sentinel passed to panic
+			t.Errorf("ErrAbortHandler: recovered %v, want it re-panicked", rec)
+		}
+	}()
+	recoverer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestRequestIDs(t *testing.T) {
+	var id string
+	handler := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = requestID(r)
+	}))
+
+	tests := []struct {
+		header string
+		kept   bool
+	}{
+		{"deploy-42:step.1", true},
+		{"", false},
+		{"bad id with spaces", false},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Request-Id", tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("X-Request-Id"); got != id {
+			t.Errorf("%q: X-Request-Id = %q, want the request ID %q", tt.header, got, id)
+		}
+		if tt.kept && id != tt.header {
+			t.Errorf("%q: request ID = %q, want it kept", tt.header, id)
+		}
+		if !tt.kept && (id == tt.header || len(id) != 32) {
+			t.Errorf("%q: request ID = %q, want a random one", tt.header, id)
+		}
+	}
+}
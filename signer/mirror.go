@@ -0,0 +1,193 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// MirrorConfig duplicates a fraction of the sign requests to a staging
+// signer, e.g. in front of a new CA version, to soak test it with the real
+// traffic. The copies are sent in the background and their responses are
+// discarded; the clients only get the responses of this signer.
+type MirrorConfig struct {
+	URL            string  `yaml:"url"`
+	Percent        float64 `yaml:"percent"`
+	CAFile         string  `yaml:"caFile"`
+	CertFile       string  `yaml:"certFile"`
+	KeyFile        string  `yaml:"keyFile"`
+	IdentityHeader string  `yaml:"identityHeader"`
+	Timeout        string  `yaml:"timeout"`
+	MaxConcurrent  int     `yaml:"maxConcurrent"`
+}
+
+// Enabled returns true if requests are mirrored.
+func (c MirrorConfig) Enabled() bool {
+	return c.URL != "" && c.Percent > 0
+}
+
+// GetTimeout returns the timeout of a mirrored request, defaults to 10s.
+func (c MirrorConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 10 * time.Second
+}
+
+// GetMaxConcurrent returns the maximum number of mirrored requests in
+// flight, defaults to 10. Requests are not mirrored while it is reached.
+func (c MirrorConfig) GetMaxConcurrent() int {
+	if c.MaxConcurrent > 0 {
+		return c.MaxConcurrent
+	}
+
+	return 10
+}
+
+// Validate checks the URL, the percentage and the client certificate.
+func (c MirrorConfig) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.Errorf("invalid mirror url %q, must be an https URL", c.URL)
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return errors.Errorf("invalid mirror percent %v, must be between 0 and 100", c.Percent)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("mirror requires both certFile and keyFile, or none")
+	}
+	if c.Timeout != "" {
+		if _, err := time.ParseDuration(c.Timeout); err != nil {
+			return errors.Wrap(err, "invalid mirror timeout")
+		}
+	}
+
+	return nil
+}
+
+// mirror sends the copies of the requests to the staging signer.
+type mirror struct {
+	config MirrorConfig
+	client *http.Client
+	slots  chan struct{}
+}
+
+func newMirror(c MirrorConfig) (*mirror, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading mirror caFile")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading mirror certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &mirror{
+		config: c,
+		client: &http.Client{
+			Timeout: c.GetTimeout(),
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		slots: make(chan struct{}, c.GetMaxConcurrent()),
+	}, nil
+}
+
+// mirrored wraps next sending a copy of the sampled requests to the
+// staging signer, with their path, query, body and request ID, and the
+// client identities in identityHeader if set.
+func (s *server) mirrored(next http.HandlerFunc) http.HandlerFunc {
+	if s.mirror == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64()*100 >= s.mirror.config.Percent { //nolint:gosec // not used for security
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignRequestSize+1))
+		rest := r.Body
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), rest))
+		if err != nil || len(body) > maxSignRequestSize {
+			next(w, r)
+			return
+		}
+
+		header := http.Header{}
+		header.Set("X-Request-Id", requestID(r))
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			header.Set("Content-Type", ct)
+		}
+		if ids := clientIdentities(r); s.mirror.config.IdentityHeader != "" && len(ids) > 0 {
+			header.Set(s.mirror.config.IdentityHeader, strings.Join(ids, ","))
+		}
+		s.mirror.send(r.URL.RequestURI(), header, body)
+
+		next(w, r)
+	}
+}
+
+// send posts the copy in the background, or drops it if too many copies
+// are in flight.
+func (m *mirror) send(path string, header http.Header, body []byte) {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirroredRequests.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-m.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.GetTimeout())
+		defer cancel()
+
+		fields := log.Fields{"requestId": header.Get("X-Request-Id"), "path": path}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(m.config.URL, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			mirroredRequests.WithLabelValues("error").Inc()
+			logFor("mirror").WithFields(fields).WithField("error", err).Debug("Error mirroring request")
+			return
+		}
+		req.Header = header
+		resp, err := m.client.Do(req)
+		if err != nil {
+			mirroredRequests.WithLabelValues("error").Inc()
+			logFor("mirror").WithFields(fields).WithField("error", err).Debug("Error mirroring request")
+			return
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxSignRequestSize))
+		resp.Body.Close()
+
+		result := "sent"
+		if resp.StatusCode >= 300 {
+			result = "failed"
+		}
+		mirroredRequests.WithLabelValues(result).Inc()
+		fields["status"] = resp.StatusCode
+		logFor("mirror").WithFields(fields).Debug("Mirrored request")
+	}()
+}
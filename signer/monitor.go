@@ -0,0 +1,230 @@
+package signer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/ca"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// MonitorConfig configures the monitor polling the upstream CAs
+// independently of the traffic.
+type MonitorConfig struct {
+	Interval string `yaml:"interval"`
+}
+
+// GetInterval returns how often the upstream CAs are checked, defaults to
+// 30s.
+func (c MonitorConfig) GetInterval() time.Duration {
+	if d, err := time.ParseDuration(c.Interval); err == nil && d > 0 {
+		return d
+	}
+
+	return 30 * time.Second
+}
+
+// upstreamTarget is an upstream checked by the monitor.
+type upstreamTarget struct {
+	name  string
+	caURL string
+}
+
+// upstreamStatus is the last known state of an upstream CA and provisioner.
+type upstreamStatus struct {
+	Name                 string     `json:"name"`
+	CaURL                string     `json:"caURL"`
+	Provisioner          string     `json:"provisioner"`
+	Kid                  string     `json:"kid"`
+	Healthy              bool       `json:"healthy"`
+	ProvisionerAvailable bool       `json:"provisionerAvailable"`
+	RootFingerprints     []string   `json:"rootFingerprints"`
+	RootTrusted          bool       `json:"rootTrusted"`
+	CheckedAt            time.Time  `json:"checkedAt"`
+	LastHealthy          *time.Time `json:"lastHealthy,omitempty"`
+	Error                string     `json:"error,omitempty"`
+
+	// missing is set when the CA answered but no longer lists the
+	// provisioner key, e.g. after a rotation.
+	missing bool
+}
+
+// upstreamMonitor polls the health, roots and provisioners of the upstream
+// CAs of each distinct provisioner. The credentials of a provisioner no
+// longer listed by its CA are refreshed.
+type upstreamMonitor struct {
+	targets []upstreamTarget
+	timeout time.Duration
+	trusted []string
+	resolve func(name string) *ca.Provisioner
+	refresh func(name string, stale *ca.Provisioner) (*ca.Provisioner, error)
+
+	mu       sync.RWMutex
+	statuses map[string]upstreamStatus
+}
+
+func newUpstreamMonitor(s *server, roots []*x509.Certificate, targets ...upstreamTarget) *upstreamMonitor {
+	m := &upstreamMonitor{
+		targets:  targets,
+		timeout:  s.config.Timeouts.GetRead(),
+		trusted:  []string{},
+		resolve:  s.upstream,
+		refresh:  s.refreshProvisioner,
+		statuses: map[string]upstreamStatus{},
+	}
+	for _, root := range roots {
+		sum := sha256.Sum256(root.Raw)
+		m.trusted = append(m.trusted, hex.EncodeToString(sum[:]))
+	}
+
+	return m
+}
+
+// check updates the status of every target.
+func (m *upstreamMonitor) check(ctx context.Context) error {
+	for _, t := range m.targets {
+		p := m.resolve(t.name)
+		st := m.checkTarget(ctx, t, p)
+		if st.missing {
+			if np, err := m.refresh(t.name, p); err == nil && np != p {
+				st = m.checkTarget(ctx, t, np)
+			}
+		}
+
+		up := st.Healthy && st.ProvisionerAvailable
+		m.mu.Lock()
+		prev, known := m.statuses[t.name]
+		if up {
+			checked := st.CheckedAt
+			st.LastHealthy = &checked
+		} else {
+			st.LastHealthy = prev.LastHealthy
+		}
+		m.statuses[t.name] = st
+		m.mu.Unlock()
+
+		upstreamUp.WithLabelValues(t.name).Set(boolGauge(st.Healthy))
+		upstreamProvisionerAvailable.WithLabelValues(t.name).Set(boolGauge(st.ProvisionerAvailable))
+		upstreamLastCheck.WithLabelValues(t.name).Set(float64(st.CheckedAt.Unix()))
+
+		if !known || up != (prev.Healthy && prev.ProvisionerAvailable) {
+			logger := logFor("monitor").WithFields(log.Fields{
+				"upstream":    t.name,
+				"caURL":       t.caURL,
+				"provisioner": st.Provisioner,
+				"kid":         st.Kid,
+			})
+			if up {
+				logger.Info("Upstream CA is available")
+			} else {
+				logger.WithField("error", st.Error).Warn("Upstream CA is unavailable")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *upstreamMonitor) checkTarget(ctx context.Context, t upstreamTarget, p *ca.Provisioner) upstreamStatus {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	st := upstreamStatus{
+		Name:             t.name,
+		CaURL:            t.caURL,
+		Provisioner:      p.Name(),
+		Kid:              p.Kid(),
+		RootFingerprints: []string{},
+		CheckedAt:        time.Now().UTC(),
+	}
+
+	health, err := p.HealthWithContext(ctx)
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	st.Healthy = health.Status == "ok"
+
+	roots, err := p.RootsWithContext(ctx)
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	for _, c := range roots.Certificates {
+		sum := sha256.Sum256(c.Raw)
+		fp := hex.EncodeToString(sum[:])
+		st.RootFingerprints = append(st.RootFingerprints, fp)
+		st.RootTrusted = st.RootTrusted || policy.ContainsAny(m.trusted, []string{fp})
+	}
+
+	id := p.Name() + ":" + p.Kid()
+	var cursor string
+	for {
+		resp, err := p.ProvisionersWithContext(ctx, ca.WithProvisionerCursor(cursor), ca.WithProvisionerLimit(100))
+		if err != nil {
+			st.Error = err.Error()
+			return st
+		}
+		for _, prov := range resp.Provisioners {
+			if prov.GetIDForToken() == id {
+				st.ProvisionerAvailable = true
+			}
+		}
+		if st.ProvisionerAvailable || resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+	if !st.ProvisionerAvailable {
+		st.missing = true
+		st.Error = "provisioner " + id + " not found on the CA"
+	}
+
+	return st
+}
+
+// upstreamStatusResponse is the JSON returned by GET /status.
+type upstreamStatusResponse struct {
+	Healthy      bool             `json:"healthy"`
+	TrustedRoots []string         `json:"trustedRoots"`
+	Upstreams    []upstreamStatus `json:"upstreams"`
+}
+
+// status returns the last status of the upstream CAs.
+func (m *upstreamMonitor) status(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, m.lastStatus())
+}
+
+// lastStatus returns the last status of the upstream CAs. Targets not
+// checked yet are reported as unhealthy.
+func (m *upstreamMonitor) lastStatus() upstreamStatusResponse {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	resp := upstreamStatusResponse{Healthy: true, TrustedRoots: m.trusted}
+	for _, t := range m.targets {
+		st, ok := m.statuses[t.name]
+		if !ok {
+			st = upstreamStatus{Name: t.name, CaURL: t.caURL, Provisioner: m.resolve(t.name).Name(), Kid: m.resolve(t.name).Kid(), RootFingerprints: []string{}, Error: "not checked yet"}
+		}
+		resp.Healthy = resp.Healthy && st.Healthy && st.ProvisionerAvailable
+		resp.Upstreams = append(resp.Upstreams, st)
+	}
+
+	return resp
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package signer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/ca"
+)
+
+func TestUpstreamMonitor(t *testing.T) {
+	up := newTestUpstream(t)
+	other, _ := newTestCert(t, "Other Root CA")
+	s := &server{config: &Config{}}
+	m := newUpstreamMonitor(s, []*x509.Certificate{other, up.root}, upstreamTarget{name: "primary", caURL: up.URL})
+	m.resolve = func(string) *ca.Provisioner { return up.provisioner }
+
+	if st := m.lastStatus(); st.Healthy || st.Upstreams[0].Error != "not checked yet" {
+		t.Errorf("before the first check: lastStatus() = %+v, want unhealthy", st)
+	}
+
+	if err := m.check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(up.root.Raw)
+	st := m.lastStatus()
+	if got := st.Upstreams[0]; !st.Healthy || !got.Healthy || !got.ProvisionerAvailable || !got.RootTrusted ||
+		len(got.RootFingerprints) != 1 || got.RootFingerprints[0] != hex.EncodeToString(sum[:]) ||
+		got.Kid != up.provisioner.Kid() || got.LastHealthy == nil {
+		t.Errorf("healthy upstream: lastStatus() = %+v", st)
+	}
+	if got := testutil.ToFloat64(upstreamProvisionerAvailable.WithLabelValues("primary")); got != 1 {
+		t.Errorf("provisioner available gauge = %v, want 1", got)
+	}
+	lastHealthy := *st.Upstreams[0].LastHealthy
+
+	up.Close()
+	m.check(context.Background())
+	st = m.lastStatus()
+	if got := st.Upstreams[0]; st.Healthy || got.Healthy || got.Error == "" || got.LastHealthy == nil || !got.LastHealthy.Equal(lastHealthy) {
+		t.Errorf("stopped upstream: lastStatus() = %+v, want unhealthy since %v", st, lastHealthy)
+	}
+	if got := testutil.ToFloat64(upstreamUp.WithLabelValues("primary")); got != 0 {
+		t.Errorf("up gauge = %v, want 0", got)
+	}
+
+	w := httptest.NewRecorder()
+	m.status(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestUpstreamMonitorUntrustedRoot(t *testing.T) {
+	up := newTestUpstream(t)
+	other, _ := newTestCert(t, "Other Root CA")
+	m := newUpstreamMonitor(&server{config: &Config{}}, []*x509.Certificate{other}, upstreamTarget{name: "primary", caURL: up.URL})
+	m.resolve = func(string) *ca.Provisioner { return up.provisioner }
+
+	m.check(context.Background())
+	if got := m.lastStatus().Upstreams[0]; !got.Healthy || got.RootTrusted {
+		t.Errorf("lastStatus() = %+v, want a healthy upstream with an untrusted root", got)
+	}
+}
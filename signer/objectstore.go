@@ -0,0 +1,228 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// ObjectStoreConfig configures where exported files are written. Type is
+// "file" (a local directory), "s3" or "gcs".
+type ObjectStoreConfig struct {
+	Type     string `yaml:"type"`
+	Path     string `yaml:"path"`
+	Bucket   string `yaml:"bucket"`
+	Prefix   string `yaml:"prefix"`
+	Region   string `yaml:"region"`
+	Endpoint string `yaml:"endpoint"`
+}
+
+// Validate checks the object store type and location.
+func (c ObjectStoreConfig) Validate() error {
+	switch c.Type {
+	case "file":
+		if c.Path == "" {
+			return errors.New("file object store requires a path")
+		}
+	case "s3":
+		if c.Bucket == "" || c.Region == "" {
+			return errors.New("s3 object store requires a bucket and a region")
+		}
+	case "gcs":
+		if c.Bucket == "" {
+			return errors.New("gcs object store requires a bucket")
+		}
+	default:
+		return errors.Errorf("invalid object store type %q", c.Type)
+	}
+
+	return nil
+}
+
+// objectStore writes objects to a bucket or directory.
+type objectStore interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+}
+
+// newObjectStore returns the object store of the configuration. Keys are
+// prefixed with the configured prefix.
+func newObjectStore(c ObjectStoreConfig) (objectStore, error) {
+	switch c.Type {
+	case "file":
+		return &fileObjectStore{dir: filepath.Join(c.Path, c.Prefix)}, nil
+	case "s3":
+		return newS3ObjectStore(c), nil
+	case "gcs":
+		ts, err := google.DefaultTokenSource(context.Background(), "https://www.googleapis.com/auth/devstorage.read_write")
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading google credentials")
+		}
+		return &gcsObjectStore{config: c, client: oauth2.NewClient(context.Background(), ts)}, nil
+	default:
+		return nil, errors.Errorf("invalid object store type %q", c.Type)
+	}
+}
+
+type fileObjectStore struct {
+	dir string
+}
+
+func (s *fileObjectStore) Put(_ context.Context, key, _ string, data []byte) error {
+	name := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// gcsObjectStore uploads objects with the JSON API, using the application
+// default credentials.
+type gcsObjectStore struct {
+	config ObjectStoreConfig
+	client *http.Client
+}
+
+func (s *gcsObjectStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(s.config.Bucket), url.QueryEscape(path.Join(s.config.Prefix, key)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return doObjectRequest(s.client, req)
+}
+
+// s3ObjectStore uploads objects with a SigV4 signed PUT. Credentials are read
+// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. A
+// custom endpoint, such as MinIO, uses path-style URLs.
+type s3ObjectStore struct {
+	config ObjectStoreConfig
+	client *http.Client
+}
+
+func newS3ObjectStore(c ObjectStoreConfig) *s3ObjectStore {
+	return &s3ObjectStore{config: c, client: &http.Client{Timeout: 5 * time.Minute}}
+}
+
+func (s *s3ObjectStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	key = path.Join(s.config.Prefix, key)
+	var u string
+	if s.config.Endpoint != "" {
+		u = strings.TrimSuffix(s.config.Endpoint, "/") + "/" + s.config.Bucket + "/" + key
+	} else {
+		u = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.config.Bucket, s.config.Region, key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if err := signSigV4(req, data, s.config.Region, "s3", time.Now()); err != nil {
+		return err
+	}
+
+	return doObjectRequest(s.client, req)
+}
+
+func doObjectRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error uploading object")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("unexpected status %d uploading object: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+
+	return nil
+}
+
+// signSigV4 signs the request with AWS Signature Version 4.
+func signSigV4(req *http.Request, body []byte, region, service string, now time.Time) error {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	for _, h := range []string{"x-amz-security-token", "x-amz-target"} {
+		if req.Header.Get(h) != "" {
+			headers = append(headers, h)
+		}
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,210 @@
+package signer
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.step.sm/crypto/jose"
+)
+
+// OIDC providers with a default issuer and required claims.
+const (
+	oidcGitHub = "github"
+	oidcGitLab = "gitlab"
+)
+
+// oidcTimeout is the timeout of the discovery and key downloads.
+const oidcTimeout = 10 * time.Second
+
+// oidcIssuers are the default issuers of the CI providers.
+var oidcIssuers = map[string]string{
+	oidcGitHub: "https://token.actions.githubusercontent.com",
+	oidcGitLab: "https://gitlab.com",
+}
+
+// oidcScopeClaims are the claims restricting the tokens of the CI providers
+// to some repositories or projects. Anyone can get a token with any audience
+// from these issuers, so at least one of them must be constrained.
+var oidcScopeClaims = map[string][]string{
+	oidcGitHub: {"sub", "repository", "repository_id", "repository_owner", "repository_owner_id"},
+	oidcGitLab: {"sub", "project_path", "project_id", "namespace_path", "namespace_id"},
+}
+
+// OIDCProviderConfig accepts the bearer tokens of an OpenID Connect issuer,
+// such as the tokens of GitHub Actions and GitLab CI jobs. Tokens must have
+// the audience and claims matching the patterns; their client identities
+// are the identities patterns, with ${claim} replaced by the claims of the
+// token, so policy rules and profiles grant them names.
+type OIDCProviderConfig struct {
+	Name       string              `yaml:"name"`
+	Type       string              `yaml:"type"`
+	Issuer     string              `yaml:"issuer"`
+	Audience   string              `yaml:"audience"`
+	JWKSURL    string              `yaml:"jwksURL"`
+	Claims     map[string][]string `yaml:"claims"`
+	Identities []string            `yaml:"identities"`
+}
+
+// GetIssuer returns the issuer of the tokens, defaults to the issuer of the
+// provider type.
+func (c OIDCProviderConfig) GetIssuer() string {
+	if c.Issuer != "" {
+		return c.Issuer
+	}
+
+	return oidcIssuers[c.Type]
+}
+
+// GetIdentities returns the patterns of the client identities, defaults to
+// the sub claim, e.g. repo:fyve-labs/ca-signer:ref:refs/heads/main on
+// GitHub.
+func (c OIDCProviderConfig) GetIdentities() []string {
+	if len(c.Identities) > 0 {
+		return c.Identities
+	}
+
+	return []string{"${sub}"}
+}
+
+// Validate checks the issuer and the claim patterns.
+func (c OIDCProviderConfig) Validate() error {
+	switch c.Type {
+	case "", oidcGitHub, oidcGitLab:
+	default:
+		return errors.Errorf("invalid authn oidc type %q, must be github, gitlab or empty", c.Type)
+	}
+	if c.Name == "" {
+		return errors.New("authn oidc providers require a name")
+	}
+	if !httpsURL(c.GetIssuer()) {
+		return errors.Errorf("invalid authn oidc %s issuer %q, must be an https URL", c.Name, c.GetIssuer())
+	}
+	if c.JWKSURL != "" && !httpsURL(c.JWKSURL) {
+		return errors.Errorf("invalid authn oidc %s jwksURL %q, must be an https URL", c.Name, c.JWKSURL)
+	}
+	if c.Audience == "" {
+		return errors.Errorf("authn oidc %s requires an audience", c.Name)
+	}
+	if len(c.Claims) == 0 {
+		return errors.Errorf("authn oidc %s requires claims", c.Name)
+	}
+	if scope := oidcScopeClaims[c.Type]; len(scope) > 0 && !slices.ContainsFunc(scope, func(claim string) bool { return len(c.Claims[claim]) > 0 }) {
+		return errors.Errorf("authn oidc %s requires one of the claims %s", c.Name, strings.Join(scope, ", "))
+	}
+	for claim, patterns := range c.Claims {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return errors.Wrapf(err, "invalid pattern %q of claim %s in authn oidc %s", p, claim, c.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// oidcVerifier authenticates the bearer tokens of the OIDC providers.
+type oidcVerifier struct {
+	providers []OIDCProviderConfig
+	keys      *jwksCache
+}
+
+func newOIDCVerifier(providers []OIDCProviderConfig) *oidcVerifier {
+	return &oidcVerifier{providers: providers, keys: newJWKSCache(oidcTimeout)}
+}
+
+// httpsURL returns true if u is an absolute https URL.
+func httpsURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && parsed.Scheme == "https" && parsed.Host != ""
+}
+
+// identities returns the client identities of a token, from the first
+// provider of its issuer accepting it, and false if none does.
+func (v *oidcVerifier) identities(ctx context.Context, raw string) ([]string, bool) {
+	tok, err := jose.ParseSigned(raw)
+	if err != nil {
+		return nil, false
+	}
+	var unverified jose.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, false
+	}
+
+	for _, p := range v.providers {
+		if p.GetIssuer() != unverified.Issuer {
+			continue
+		}
+		ids, err := v.verify(ctx, p, raw)
+		if err != nil {
+			oidcAuthentications.WithLabelValues(p.Name, "rejected").Inc()
+			logFor("server").WithFields(log.Fields{
+				"provider": p.Name,
+				"subject":  unverified.Subject,
+				"error":    err,
+			}).Warn("Rejected OIDC token")
+			continue
+		}
+		oidcAuthentications.WithLabelValues(p.Name, "accepted").Inc()
+		return ids, true
+	}
+
+	return nil, false
+}
+
+// verify verifies a token of the provider and returns its identities.
+func (v *oidcVerifier) verify(ctx context.Context, p OIDCProviderConfig, raw string) ([]string, error) {
+	jwksURL := p.JWKSURL
+	if jwksURL == "" {
+		var err error
+		if jwksURL, err = v.keys.discover(ctx, p.GetIssuer()); err != nil {
+			return nil, err
+		}
+	}
+	var claims map[string]interface{}
+	if err := v.keys.verify(ctx, jwksURL, raw, []string{p.GetIssuer()}, p.Audience, &claims); err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{}
+	for k, v := range claims {
+		switch v := v.(type) {
+		case string:
+			attributes[k] = v
+		case bool:
+			attributes[k] = strconv.FormatBool(v)
+		case float64:
+			attributes[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	for claim, patterns := range p.Claims {
+		if !slices.ContainsFunc(patterns, func(pattern string) bool {
+			ok, _ := path.Match(pattern, attributes[claim])
+			return ok
+		}) {
+			return nil, errors.Errorf("claim %s %q is not allowed", claim, attributes[claim])
+		}
+	}
+	ids := expandPatterns(p.GetIdentities(), attributes)
+	if len(ids) == 0 {
+		return nil, errors.New("token has no identity")
+	}
+
+	return ids, nil
+}
+
+// oidcIdentities returns the identities of the OIDC bearer token of the
+// request, if it is valid.
+func (s *server) oidcIdentities(ctx context.Context, token string) ([]string, bool) {
+	if s.oidc == nil || strings.Count(token, ".") != 2 {
+		return nil, false
+	}
+
+	return s.oidc.identities(ctx, token)
+}
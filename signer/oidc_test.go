@@ -0,0 +1,125 @@
+package signer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOIDCProviderConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    OIDCProviderConfig
+		ok   bool
+	}{
+		{"github", OIDCProviderConfig{Name: "actions", Type: oidcGitHub, Audience: "ca-signer", Claims: map[string][]string{"repository": {"fyve-labs/*"}}}, true},
+		{"generic", OIDCProviderConfig{Name: "idp", Issuer: "https://idp.example.com", Audience: "ca-signer", Claims: map[string][]string{"groups": {"ops"}}}, true},
+		{"type", OIDCProviderConfig{Name: "ci", Type: "jenkins", Audience: "ca-signer", Claims: map[string][]string{"sub": {"*"}}}, false},
+		{"name", OIDCProviderConfig{Type: oidcGitHub, Audience: "ca-signer", Claims: map[string][]string{"repository": {"fyve-labs/*"}}}, false},
+		{"no issuer", OIDCProviderConfig{Name: "idp", Audience: "ca-signer", Claims: map[string][]string{"sub": {"*"}}}, false},
+		{"http issuer", OIDCProviderConfig{Name: "idp", Issuer: "http://idp.example.com", Audience: "ca-signer", Claims: map[string][]string{"sub": {"*"}}}, false},
+		{"jwks url", OIDCProviderConfig{Name: "actions", Type: oidcGitHub, JWKSURL: "http://keys", Audience: "ca-signer", Claims: map[string][]string{"repository": {"fyve-labs/*"}}}, false},
+		{"audience", OIDCProviderConfig{Name: "actions", Type: oidcGitHub, Claims: map[string][]string{"repository": {"fyve-labs/*"}}}, false},
+		{"claims", OIDCProviderConfig{Name: "actions", Type: oidcGitHub, Audience: "ca-signer"}, false},
+		{"unscoped", OIDCProviderConfig{Name: "jobs", Type: oidcGitLab, Audience: "ca-signer", Claims: map[string][]string{"ref": {"main"}}}, false},
+		{"pattern", OIDCProviderConfig{Name: "jobs", Type: oidcGitLab, Audience: "ca-signer", Claims: map[string][]string{"project_path": {"fyve-labs/["}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	token := AuthnConfig{Endpoints: []EndpointAuthnConfig{{"/sign", authnToken}}}
+	if err := token.Validate(); err == nil {
+		t.Error("Validate() of the token requirement without tokens or oidc error = nil")
+	}
+	token.OIDC = []OIDCProviderConfig{tests[0].c, tests[0].c}
+	if err := token.Validate(); err == nil {
+		t.Error("Validate() of duplicated oidc names error = nil")
+	}
+	token.OIDC = token.OIDC[:1]
+	if err := token.Validate(); err != nil {
+		t.Errorf("Validate() of the token requirement with oidc = %v", err)
+	}
+}
+
+func TestOIDCIdentities(t *testing.T) {
+	iss := newTestTokenIssuer(t)
+	providers := []OIDCProviderConfig{
+		{Name: "main", Type: oidcGitHub, Issuer: iss.URL, Audience: "ca-signer", Claims: map[string][]string{"repository": {"fyve-labs/*"}, "ref": {"refs/heads/main"}}, Identities: []string{"github:${repository}", "${environment}"}},
+		{Name: "tags", Type: oidcGitHub, Issuer: iss.URL, Audience: "ca-signer", JWKSURL: iss.URL + "/keys", Claims: map[string][]string{"repository": {"fyve-labs/*"}, "ref_type": {"tag"}}},
+	}
+	v := newOIDCVerifier(providers)
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": iss.URL, "aud": "ca-signer", "sub": "repo:fyve-labs/ca-signer:ref:refs/heads/main", "repository": "fyve-labs/ca-signer", "ref": "refs/heads/main", "ref_type": "branch"}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		ok     bool
+		ids    []string
+	}{
+		{"main", claims(nil), true, []string{"github:fyve-labs/ca-signer"}},
+		{"environment", claims(map[string]interface{}{"environment": "production"}), true, []string{"github:fyve-labs/ca-signer", "production"}},
+		{"tag", claims(map[string]interface{}{"ref": "refs/tags/v1.0.0", "ref_type": "tag", "sub": "repo:fyve-labs/ca-signer:ref:refs/tags/v1.0.0"}), true, []string{"repo:fyve-labs/ca-signer:ref:refs/tags/v1.0.0"}},
+		{"other repository", claims(map[string]interface{}{"repository": "evil/ca-signer"}), false, nil},
+		{"other branch", claims(map[string]interface{}{"ref": "refs/heads/dev"}), false, nil},
+		{"audience", claims(map[string]interface{}{"aud": "other"}), false, nil},
+		{"issuer", claims(map[string]interface{}{"iss": "https://token.actions.githubusercontent.com"}), false, nil},
+	}
+	for _, tt := range tests {
+		ids, ok := v.identities(context.Background(), iss.token(t, tt.claims))
+		if ok != tt.ok || !sameStrings(ids, tt.ids) {
+			t.Errorf("%s: identities() = %v, %v, want %v, %v", tt.name, ids, ok, tt.ids, tt.ok)
+		}
+	}
+
+	rejected := oidcAuthentications.WithLabelValues("main", "rejected")
+	before := testutil.ToFloat64(rejected)
+	v.identities(context.Background(), iss.token(t, claims(map[string]interface{}{"repository": "evil/ca-signer"})))
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("rejected tokens counted = %v, want 1", got)
+	}
+}
+
+func TestAuthenticateOIDC(t *testing.T) {
+	iss := newTestTokenIssuer(t)
+	c := AuthnConfig{
+		OIDC:      []OIDCProviderConfig{{Name: "actions", Type: oidcGitHub, Issuer: iss.URL, Audience: "ca-signer", Claims: map[string][]string{"repository": {"fyve-labs/*"}}}},
+		Endpoints: []EndpointAuthnConfig{{"/sign", authnToken}},
+	}
+	s := &server{config: &Config{Authn: c}, oidc: newOIDCVerifier(c.OIDC)}
+	var ids []string
+	handler := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = clientIdentities(r)
+	}))
+
+	for _, tt := range []struct {
+		token  string
+		status int
+		ids    []string
+	}{
+		{iss.token(t, map[string]interface{}{"iss": iss.URL, "aud": "ca-signer", "sub": "repo:fyve-labs/web:ref:refs/heads/main", "repository": "fyve-labs/web"}), http.StatusOK, []string{"repo:fyve-labs/web:ref:refs/heads/main"}},
+		{iss.token(t, map[string]interface{}{"iss": iss.URL, "aud": "ca-signer", "sub": "repo:evil/web:ref:refs/heads/main", "repository": "evil/web"}), http.StatusUnauthorized, nil},
+		{"static", http.StatusUnauthorized, nil},
+	} {
+		ids = nil
+		r := httptest.NewRequest(http.MethodPost, "/sign", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status || strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+			t.Errorf("status = %d, identities %v, want %d, %v", w.Code, ids, tt.status, tt.ids)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/cli-utils/token"
+	"github.com/smallstep/cli-utils/token/provision"
+	"go.step.sm/crypto/jose"
+	"go.step.sm/crypto/randutil"
+)
+
+// OTTConfig customizes the one-time tokens (OTTs) minted with the
+// provisioners, for upstream CAs with stricter provisioner policies. Their
+// validity is configured in ClockConfig.
+type OTTConfig struct {
+	Audience       string         `yaml:"audience"`
+	RevokeAudience string         `yaml:"revokeAudience"`
+	Claims         map[string]any `yaml:"claims"`
+}
+
+// tokenReservedClaims are set by the signer and cannot be configured.
+var tokenReservedClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "sans", "sha", "step"}
+
+// custom returns whether the tokens differ from the ones of the step client.
+func (c OTTConfig) custom() bool {
+	return c.Audience != "" || c.RevokeAudience != "" || len(c.Claims) > 0
+}
+
+// Validate checks the audiences and the claim names.
+func (c OTTConfig) Validate() error {
+	for field, aud := range map[string]string{"audience": c.Audience, "revokeAudience": c.RevokeAudience} {
+		if aud == "" {
+			continue
+		}
+		if u, err := url.Parse(aud); err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.Errorf("invalid ott %s %q, must be an https URL", field, aud)
+		}
+	}
+	for name := range c.Claims {
+		if name == "" || slices.Contains(tokenReservedClaims, name) {
+			return errors.Errorf("invalid ott claim %q, the signer sets %s", name, strings.Join(tokenReservedClaims, ", "))
+		}
+	}
+
+	return nil
+}
+
+// signAudience returns the audience of the sign tokens, defaults to the sign
+// endpoint of the provisioner CA.
+func (c OTTConfig) signAudience(p *ca.Provisioner) string {
+	if c.Audience != "" {
+		return c.Audience
+	}
+
+	return p.Audience()
+}
+
+// revokeAudience returns the audience of the revoke tokens, defaults to the
+// revoke endpoint next to the sign audience.
+func (c OTTConfig) revokeAudience(p *ca.Provisioner) string {
+	if c.RevokeAudience != "" {
+		return c.RevokeAudience
+	}
+
+	return strings.TrimSuffix(c.signAudience(p), "/sign") + "/revoke"
+}
+
+var ottConfig OTTConfig
+
+// configureOTT sets the audiences and claims of the tokens. Like
+// configureClock, it must run before the provisioners are loaded.
+func configureOTT(c OTTConfig) {
+	ottConfig = c
+}
+
+// customTokens returns whether the signer mints the tokens itself, with the
+// provisioner keys, instead of the step client.
+func customTokens() bool {
+	return clockConfig.customTokens() || ottConfig.custom()
+}
+
+// tokenKey is the decrypted key of a provisioner, kept to mint the tokens on
+// the signer clock.
+type tokenKey struct {
+	jwk         *jose.JSONWebKey
+	fingerprint string
+}
+
+var (
+	tokenKeysMu sync.Mutex
+	tokenKeys   = map[string]*tokenKey{}
+)
+
+// newProvisioner loads a provisioner like ca.NewProvisioner. With custom
+// tokens, it also keeps the provisioner key for mintToken.
+func newProvisioner(name, kid, caURL string, password []byte, opts ...ca.ClientOption) (*ca.Provisioner, error) {
+	p, err := ca.NewProvisioner(name, kid, caURL, password, opts...)
+	if err != nil || !customTokens() {
+		return p, err
+	}
+
+	encrypted, err := p.ProvisionerKey(p.Kid())
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting provisioner key")
+	}
+	enc, err := jose.ParseEncrypted(encrypted.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing provisioner encrypted key")
+	}
+	data, err := enc.Decrypt(password)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decrypting provisioner key with provided password")
+	}
+	jwk := new(jose.JSONWebKey)
+	if err := json.Unmarshal(data, jwk); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling provisioner key")
+	}
+	fp, err := p.RootFingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenKeysMu.Lock()
+	tokenKeys[p.Kid()] = &tokenKey{jwk: jwk, fingerprint: fp}
+	tokenKeysMu.Unlock()
+
+	return p, nil
+}
+
+// signToken returns a sign token of the provisioner for the SANs.
+func signToken(p *ca.Provisioner, subject string, sans ...string) (string, error) {
+	return mintToken(p, ottConfig.signAudience(p), subject, sans...)
+}
+
+// revokeToken returns a revoke token of the provisioner for a serial number.
+func revokeToken(p *ca.Provisioner, serial string) (string, error) {
+	return mintToken(p, ottConfig.revokeAudience(p), serial)
+}
+
+// mintToken returns a one-time token of the provisioner for the audience.
+// Tokens are valid from the signer time minus the skew tolerance, so that an
+// upstream CA whose clock is behind accepts them, for the token lifetime, and
+// carry the configured claims. Without custom tokens, the provisioner mints
+// the token.
+func mintToken(p *ca.Provisioner, audience, subject string, sans ...string) (string, error) {
+	tokenKeysMu.Lock()
+	key := tokenKeys[p.Kid()]
+	tokenKeysMu.Unlock()
+	if key == nil {
+		if audience != p.Audience() {
+			rp := *p
+			rp.SetAudience(audience)
+			p = &rp
+		}
+		return p.Token(subject, sans...)
+	}
+
+	if len(sans) == 0 {
+		sans = []string{subject}
+	}
+	jwtID, err := randutil.Hex(64)
+	if err != nil {
+		return "", err
+	}
+	now := signerClock.Now()
+	notBefore := now.Add(-time.Duration(clockSkewNano.Load()))
+	notAfter := now.Add(clockConfig.GetTokenLifetime())
+	opts := []token.Options{
+		token.WithJWTID(jwtID),
+		token.WithKid(p.Kid()),
+		token.WithIssuer(p.Name()),
+		token.WithAudience(audience),
+		token.WithValidity(notBefore, notAfter),
+		token.WithIssuedAt(notBefore),
+		token.WithSANS(sans),
+		token.WithSHA(key.fingerprint),
+	}
+	for name, value := range ottConfig.Claims {
+		opts = append(opts, token.WithClaim(name, value))
+	}
+	tok, err := provision.New(subject, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	return tok.SignedString(key.jwk.Algorithm, key.jwk.Key)
+}
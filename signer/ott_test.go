@@ -0,0 +1,134 @@
+package signer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/jose"
+)
+
+// tokenClaims returns the claims of a token, without verifying it.
+func tokenClaims(t *testing.T, raw string) map[string]interface{} {
+	t.Helper()
+	tok, err := jose.ParseSigned(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		t.Fatal(err)
+	}
+
+	return claims
+}
+
+func TestOTTConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    OTTConfig
+		ok   bool
+	}{
+		{"default", OTTConfig{}, true},
+		{"custom", OTTConfig{Audience: "https://ca.example.com/1.0/sign", RevokeAudience: "https://ca.example.com/1.0/revoke", Claims: map[string]any{"team": "pki"}}, true},
+		{"http audience", OTTConfig{Audience: "http://ca.example.com/sign"}, false},
+		{"relative audience", OTTConfig{RevokeAudience: "/1.0/revoke"}, false},
+		{"reserved claim", OTTConfig{Claims: map[string]any{"sans": []string{"*"}}}, false},
+		{"empty claim", OTTConfig{Claims: map[string]any{"": "value"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestOTTAudiences(t *testing.T) {
+	p := newTestUpstream(t).provisioner
+	tests := []struct {
+		name         string
+		c            OTTConfig
+		sign, revoke string
+	}{
+		{"default", OTTConfig{}, p.Audience(), strings.TrimSuffix(p.Audience(), "/sign") + "/revoke"},
+		{"sign", OTTConfig{Audience: "https://ca.example.com/1.0/sign"}, "https://ca.example.com/1.0/sign", "https://ca.example.com/1.0/revoke"},
+		{"both", OTTConfig{Audience: "https://ca.example.com/sign", RevokeAudience: "https://ca.example.com/admin/revoke"}, "https://ca.example.com/sign", "https://ca.example.com/admin/revoke"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.signAudience(p); got != tt.sign {
+			t.Errorf("%s: signAudience() = %s, want %s", tt.name, got, tt.sign)
+		}
+		if got := tt.c.revokeAudience(p); got != tt.revoke {
+			t.Errorf("%s: revokeAudience() = %s, want %s", tt.name, got, tt.revoke)
+		}
+	}
+}
+
+func TestMintToken(t *testing.T) {
+	t.Cleanup(func() {
+		configureOTT(OTTConfig{})
+		configureClock(ClockConfig{})
+	})
+	up := newTestUpstream(t)
+
+	// Without custom tokens, the provisioner mints them for the audience.
+	configureOTT(OTTConfig{RevokeAudience: "https://ca.example.com/1.0/revoke"})
+	tok, err := revokeToken(up.provisioner, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims := tokenClaims(t, tok); claims["aud"] != "https://ca.example.com/1.0/revoke" || claims["sub"] != "1234" {
+		t.Errorf("revoke token claims = %v", claims)
+	}
+
+	configureOTT(OTTConfig{Claims: map[string]any{"team": "pki"}})
+	configureClock(ClockConfig{TokenLifetime: "10m"})
+	pool := x509.NewCertPool()
+	pool.AddCert(up.root)
+	p, err := newProvisioner("signer", up.provisioner.Kid(), up.URL, []byte(testProvisionerPassword),
+		ca.WithTransport(&http.Transport{TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tokenKeysMu.Lock()
+		delete(tokenKeys, p.Kid())
+		tokenKeysMu.Unlock()
+	})
+
+	tok, err = signToken(p, "www.example.com", "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := tokenClaims(t, tok)
+	if claims["team"] != "pki" || claims["aud"] != p.Audience() || claims["iss"] != "signer" || claims["exp"].(float64)-claims["nbf"].(float64) != 600 {
+		t.Errorf("sign token claims = %v", claims)
+	}
+	_, request := newPolicyTestRequest(t, "web", "www.example.com")
+	resp, err := issue(context.Background(), p, request, nil)
+	if err != nil {
+		t.Fatalf("issue() with a custom token = %v", err)
+	}
+	if names := resp.ServerPEM.Certificate.DNSNames; len(names) != 1 || names[0] != "www.example.com" {
+		t.Errorf("issued names = %v", names)
+	}
+
+	// The test CA rejects tokens issued before it started, so the backdated
+	// tokens are only checked.
+	configureClock(ClockConfig{SkewTolerance: "30s"})
+	if tok, err = signToken(p, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	claims = tokenClaims(t, tok)
+	if skew := time.Since(time.Unix(int64(claims["nbf"].(float64)), 0)); skew < 29*time.Second || skew > time.Minute {
+		t.Errorf("sign token nbf is %v ago, want the skew tolerance", skew)
+	}
+	if sans, _ := claims["sans"].([]interface{}); len(sans) != 1 || sans[0] != "www.example.com" {
+		t.Errorf("sign token sans = %v, want the subject", claims["sans"])
+	}
+}
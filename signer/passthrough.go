@@ -0,0 +1,133 @@
+package signer
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+const (
+	passthroughTemplateData = "templateData"
+	passthroughNotBefore    = "notBefore"
+)
+
+// signerTemplateKeys are the keys of .Insecure.User set by the signer, which
+// clients can never pass through.
+var signerTemplateKeys = []string{"profile", "keyUsage", "extKeyUsage", "isCA", "maxPathLen", "nameConstraints", "extensions"}
+
+// PassthroughConfig configures which fields of the step-ca sign request the
+// clients may set in their sign requests, to use the templating of the
+// upstream CA through the signer. Requests setting a field not allowed are
+// denied with rule "passthrough".
+type PassthroughConfig struct {
+	Allow []PassthroughGrant `yaml:"allow"`
+}
+
+// PassthroughGrant allows the clients to set the fields. TemplateDataKeys
+// restricts the top-level keys of templateData, any key not set by the
+// signer is allowed if empty. A grant without clients applies to every
+// client.
+type PassthroughGrant struct {
+	Fields           []string `yaml:"fields"`
+	TemplateDataKeys []string `yaml:"templateDataKeys"`
+	Clients          []string `yaml:"clients"`
+}
+
+// Validate checks the fields and the template data keys.
+func (c PassthroughConfig) Validate() error {
+	for _, g := range c.Allow {
+		if len(g.Fields) == 0 {
+			return errors.New("passthrough grants require fields")
+		}
+		for _, f := range g.Fields {
+			if f != passthroughTemplateData && f != passthroughNotBefore {
+				return errors.Errorf("invalid passthrough field %q, must be templateData or notBefore", f)
+			}
+		}
+		for _, k := range g.TemplateDataKeys {
+			if slices.Contains(signerTemplateKeys, k) {
+				return errors.Errorf("invalid passthrough templateDataKeys %q, the key is set by the signer", k)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkPassthrough returns a denial with rule "passthrough" if the request
+// sets a field the clients are not allowed to. The allowed template data is
+// kept in the request, to be merged with the one of the signer.
+func (c PassthroughConfig) checkPassthrough(clients []string, request *SignRequest) policy.Decision {
+	request.templateData, request.notBefore = nil, false
+	if !request.NotBefore.IsZero() {
+		if !c.allowed(clients, passthroughNotBefore, "") {
+			return passthroughDenial("notBefore is not allowed")
+		}
+		request.notBefore = true
+	}
+	if len(request.TemplateData) == 0 || string(request.TemplateData) == "null" {
+		return policy.Decision{Allowed: true}
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(request.TemplateData, &data); err != nil {
+		return passthroughDenial("templateData must be a JSON object")
+	}
+	for key := range data {
+		if slices.Contains(signerTemplateKeys, key) {
+			return passthroughDenial("templateData key " + key + " is set by the signer")
+		}
+		if !c.allowed(clients, passthroughTemplateData, key) {
+			return passthroughDenial("templateData key " + key + " is not allowed")
+		}
+	}
+	request.templateData = data
+	logFor("policy").WithFields(log.Fields{
+		"client": clients,
+		"keys":   slices.Sorted(maps.Keys(data)),
+	}).Debug("Passing through client template data")
+
+	return policy.Decision{Allowed: true}
+}
+
+func (c PassthroughConfig) allowed(clients []string, field, key string) bool {
+	for _, g := range c.Allow {
+		if !slices.Contains(g.Fields, field) || (len(g.Clients) > 0 && !policy.ContainsAny(g.Clients, clients)) {
+			continue
+		}
+		if key == "" || len(g.TemplateDataKeys) == 0 || slices.Contains(g.TemplateDataKeys, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func passthroughDenial(reason string) policy.Decision {
+	return policy.Decision{RuleID: "passthrough", Reason: reason}
+}
+
+// withPassthrough adds the template data passed through by the client to the
+// one of the signer; the keys of the signer take precedence.
+func withPassthrough(templateData json.RawMessage, request *SignRequest) (json.RawMessage, error) {
+	if len(request.templateData) == 0 {
+		return templateData, nil
+	}
+
+	data := map[string]interface{}{}
+	for k, v := range request.templateData {
+		data[k] = v
+	}
+	if len(templateData) > 0 {
+		if err := json.Unmarshal(templateData, &data); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(data)
+}
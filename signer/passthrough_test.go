@@ -0,0 +1,114 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+func TestPassthroughConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    PassthroughConfig
+		ok   bool
+	}{
+		{"empty", PassthroughConfig{}, true},
+		{"grants", PassthroughConfig{Allow: []PassthroughGrant{{Fields: []string{"templateData", "notBefore"}, TemplateDataKeys: []string{"team"}, Clients: []string{"ci"}}}}, true},
+		{"no fields", PassthroughConfig{Allow: []PassthroughGrant{{Clients: []string{"ci"}}}}, false},
+		{"field", PassthroughConfig{Allow: []PassthroughGrant{{Fields: []string{"notAfter"}}}}, false},
+		{"signer key", PassthroughConfig{Allow: []PassthroughGrant{{Fields: []string{"templateData"}, TemplateDataKeys: []string{"extensions"}}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckPassthrough(t *testing.T) {
+	c := PassthroughConfig{Allow: []PassthroughGrant{
+		{Fields: []string{"templateData"}, TemplateDataKeys: []string{"team", "owner"}},
+		{Fields: []string{"templateData", "notBefore"}, Clients: []string{"ci"}},
+	}}
+	tests := []struct {
+		name    string
+		client  string
+		fields  string
+		allowed bool
+		data    []string
+	}{
+		{"none", "web", ``, true, nil},
+		{"null", "web", `,"templateData":null`, true, nil},
+		{"allowed keys", "web", `,"templateData":{"team":"pki","owner":"ops"}`, true, []string{"team", "owner"}},
+		{"other key", "web", `,"templateData":{"sans":["*"]}`, false, nil},
+		{"any key", "ci", `,"templateData":{"sans":["*"]}`, true, []string{"sans"}},
+		{"signer key", "ci", `,"templateData":{"isCA":true}`, false, nil},
+		{"not an object", "ci", `,"templateData":["team"]`, false, nil},
+		{"notBefore", "web", `,"notBefore":"1h"`, false, nil},
+		{"client notBefore", "ci", `,"notBefore":"1h"`, true, nil},
+	}
+	for _, tt := range tests {
+		var request SignRequest
+		if err := json.Unmarshal([]byte(`{"csr":`+mustJSON(t, newTestCSR(t, "www.example.com"))+tt.fields+`}`), &request); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		d := c.checkPassthrough([]string{tt.client}, &request)
+		if d.Allowed != tt.allowed || (!d.Allowed && d.RuleID != "passthrough") {
+			t.Errorf("%s: checkPassthrough() = %+v, want allowed %v", tt.name, d, tt.allowed)
+			continue
+		}
+		var keys []string
+		for k := range request.templateData {
+			keys = append(keys, k)
+		}
+		if tt.allowed && (!sameStrings(keys, tt.data) || request.notBefore != (tt.name == "client notBefore")) {
+			t.Errorf("%s: kept template data %v, notBefore %v", tt.name, keys, request.notBefore)
+		}
+	}
+}
+
+func TestWithPassthrough(t *testing.T) {
+	request := &SignRequest{}
+	if got, err := withPassthrough(json.RawMessage(`{"profile":"server"}`), request); err != nil || string(got) != `{"profile":"server"}` {
+		t.Errorf("withPassthrough() without client data = %s, %v", got, err)
+	}
+
+	request.templateData = map[string]interface{}{"team": "pki", "profile": "client"}
+	got, err := withPassthrough(json.RawMessage(`{"profile":"server"}`), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(got, &data); err != nil || data["team"] != "pki" || data["profile"] != "server" {
+		t.Errorf("withPassthrough() = %s, want the client data under the signer data", got)
+	}
+	if got, err := withPassthrough(nil, request); err != nil || len(got) == 0 {
+		t.Errorf("withPassthrough() without signer data = %s, %v", got, err)
+	}
+}
+
+func TestCheckPolicyPassthrough(t *testing.T) {
+	s := newPolicyTestServer(policy.Config{})
+	s.passthrough = PassthroughConfig{Allow: []PassthroughGrant{{Fields: []string{"templateData"}, TemplateDataKeys: []string{"team"}}}}
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{`{"team":"pki"}`, true},
+		{`{"owner":"ops"}`, false},
+	}
+	for _, tt := range tests {
+		var request SignRequest
+		if err := json.Unmarshal([]byte(`{"csr":`+mustJSON(t, newTestCSR(t, "www.example.com"))+`,"templateData":`+tt.data+`}`), &request); err != nil {
+			t.Fatal(err)
+		}
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), "web")
+		err := s.checkPolicy(r, generationStable, &request)
+		if pe, ok := err.(*policyError); (err == nil) != tt.ok || (err != nil && (!ok || pe.RuleID != "passthrough")) {
+			t.Errorf("%s: checkPolicy() = %v, want ok %v", tt.data, err, tt.ok)
+		}
+	}
+}
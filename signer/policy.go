@@ -0,0 +1,35 @@
+package signer
+
+import (
+	"net/http"
+
+	"github.com/smallstep/certificates/api/render"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// policyError is the error returned to clients when a request is denied by
+// the policy. It renders the matching rule and name with the error.
+type policyError struct {
+	policy.Decision
+}
+
+// Error implements the error interface.
+func (e *policyError) Error() string {
+	return e.Reason
+}
+
+// StatusCode implements the render.StatusCodedError interface.
+func (e *policyError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+// Render implements the render.RenderableError interface.
+func (e *policyError) Render(w http.ResponseWriter, r *http.Request) {
+	render.JSONStatus(w, r, struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		RuleID  string `json:"ruleId"`
+		SAN     string `json:"san"`
+	}{http.StatusForbidden, e.Reason, e.RuleID, e.SAN}, http.StatusForbidden)
+}
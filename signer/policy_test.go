@@ -0,0 +1,162 @@
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/api/render"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// newPolicyTestServer returns a server evaluating the policy, without
+// hooks or inventory.
+func newPolicyTestServer(p policy.Config) *server {
+	return &server{config: &Config{Policy: p}, hooks: newHookRunner(nil)}
+}
+
+// newPolicyTestRequest returns a sign request of client for the names.
+func newPolicyTestRequest(t *testing.T, client string, names ...string) (*http.Request, *SignRequest) {
+	t.Helper()
+	var request SignRequest
+	if err := json.Unmarshal([]byte(`{"csr":`+mustJSON(t, newTestCSR(t, names...))+`}`), &request); err != nil {
+		t.Fatal(err)
+	}
+
+	return withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), client), &request
+}
+
+func TestCheckPolicyDenial(t *testing.T) {
+	s := newPolicyTestServer(policy.Config{Rules: []policy.Rule{
+		{ID: "no-prod", Action: "deny", SANs: []string{"*.prod.example.com"}},
+	}})
+	r, request := newPolicyTestRequest(t, "web", "www.example.com", "db.prod.example.com")
+	denials := policyDenials.WithLabelValues("no-prod", generationStable, s.tenantFor([]string{"web"}))
+	before := testutil.ToFloat64(denials)
+
+	err := s.checkPolicy(r, generationStable, request)
+	pe, ok := err.(*policyError)
+	if !ok || pe.RuleID != "no-prod" || pe.SAN != "db.prod.example.com" {
+		t.Fatalf("checkPolicy() = %#v, want a denial by no-prod", err)
+	}
+	if got := testutil.ToFloat64(denials) - before; got != 1 {
+		t.Errorf("denials counted = %v, want 1", got)
+	}
+
+	w := httptest.NewRecorder()
+	render.Error(w, r, err)
+	var body struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		RuleID  string `json:"ruleId"`
+		SAN     string `json:"san"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusForbidden || body.Status != http.StatusForbidden || body.RuleID != "no-prod" || body.SAN != "db.prod.example.com" || body.Message == "" {
+		t.Errorf("rendered denial = %d %+v", w.Code, body)
+	}
+
+	if _, request := newPolicyTestRequest(t, "web", "www.example.com"); s.checkPolicy(r, generationStable, request) != nil {
+		t.Error("checkPolicy() of allowed names denied the request")
+	}
+}
+
+func TestCheckPolicyReportOnly(t *testing.T) {
+	s := newPolicyTestServer(policy.Config{Rules: []policy.Rule{
+		{ID: "no-prod", Action: "deny", Mode: "report", SANs: []string{"*.prod.example.com"}},
+		{ID: "no-admin", Action: "deny", SANs: []string{"admin.example.com"}},
+	}})
+	reported := policyReportedDenials.WithLabelValues("no-prod", generationStable, s.tenantFor([]string{"web"}))
+	before := testutil.ToFloat64(reported)
+
+	r, request := newPolicyTestRequest(t, "web", "db.prod.example.com")
+	if err := s.checkPolicy(r, generationStable, request); err != nil {
+		t.Fatalf("checkPolicy() with a report-only denial = %v", err)
+	}
+	if got := testutil.ToFloat64(reported) - before; got != 1 {
+		t.Errorf("reported denials counted = %v, want 1", got)
+	}
+
+	r, request = newPolicyTestRequest(t, "web", "db.prod.example.com", "admin.example.com")
+	if pe, ok := s.checkPolicy(r, generationStable, request).(*policyError); !ok || pe.RuleID != "no-admin" {
+		t.Errorf("checkPolicy() = %v, want a denial by the enforced rule", pe)
+	}
+}
+
+func TestRunPolicyCommand(t *testing.T) {
+	dir := t.TempDir()
+	inventoryPath := filepath.Join(dir, "inventory.db")
+	configFile, csrFile, invalidFile := filepath.Join(dir, "signer.yaml"), filepath.Join(dir, "request.csr"), filepath.Join(dir, "invalid.csr")
+	config := `caURL: https://ca.example.com
+inventory:
+  path: ` + inventoryPath + `
+policy:
+  rules:
+    - id: internal
+      action: allow
+      sans: ["*.internal.example.com"]
+  defaultAction: deny
+canary:
+  percent: 10
+  policy:
+    defaultAction: allow
+`
+	if err := writeFile(configFile, config); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(csrFile, newTestCSR(t, "web.internal.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, maxCSRNames+1)
+	for i := range names {
+		names[i] = fmt.Sprintf("web%d.internal.example.com", i)
+	}
+	if err := writeFile(invalidFile, newTestCSR(t, names...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A runtime rule denying the name, stored as the admin API does.
+	inv, err := openInventory(InventoryConfig{Path: inventoryPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadRuntimePolicy(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: &Config{}, inventory: inv, policyRules: rules}
+	r := withIdentities(httptest.NewRequest(http.MethodPost, "/admin/policy/rules", strings.NewReader(`{"id":"web","action":"deny","position":"before","sans":["web.*"]}`)), "admin")
+	w := httptest.NewRecorder()
+	s.createPolicyRule(w, r)
+	inv.Close()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create rule status = %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"allowed", []string{"test", "-config", configFile, "-csr", csrFile}, 0},
+		{"runtime rules", []string{"test", "-config", configFile, "-csr", csrFile, "-runtime-rules"}, 1},
+		{"canary", []string{"test", "-config", configFile, "-csr", csrFile, "-generation", "canary"}, 0},
+		{"invalid csr", []string{"test", "-config", configFile, "-csr", invalidFile}, exitUsage},
+		{"generation", []string{"test", "-config", configFile, "-csr", csrFile, "-generation", "beta"}, exitUsage},
+		{"no csr", []string{"test", "-config", configFile}, exitUsage},
+		{"subcommand", []string{"run"}, exitUsage},
+	}
+	for _, tt := range tests {
+		if got := runPolicyCommand(tt.args); got != tt.want {
+			t.Errorf("%s: runPolicyCommand() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
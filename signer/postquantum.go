@@ -0,0 +1,149 @@
+package signer
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/errs"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// mldsaAlgorithms are the ML-DSA (FIPS 204) algorithms, identified by the
+// same OID in the subject public key info and the signature.
+var mldsaAlgorithms = map[string]string{
+	"2.16.840.1.101.3.4.3.17": "ML-DSA-44",
+	"2.16.840.1.101.3.4.3.18": "ML-DSA-65",
+	"2.16.840.1.101.3.4.3.19": "ML-DSA-87",
+}
+
+// PostQuantumConfig gates the CSRs using post-quantum algorithms: ML-DSA
+// and the hybrid (composite) algorithms listed, whose OIDs are still
+// drafts. They are rejected unless enabled.
+type PostQuantumConfig struct {
+	Enabled          bool                    `yaml:"enabled"`
+	HybridAlgorithms []HybridAlgorithmConfig `yaml:"hybridAlgorithms"`
+}
+
+// HybridAlgorithmConfig names the OID of a composite signature algorithm,
+// e.g. "MLDSA65-ECDSA-P256-SHA512", so keys rules can refer to it.
+type HybridAlgorithmConfig struct {
+	Name string `yaml:"name"`
+	OID  string `yaml:"oid"`
+}
+
+// Validate checks the names and OIDs of the hybrid algorithms.
+func (c PostQuantumConfig) Validate() error {
+	names := map[string]bool{}
+	for _, name := range mldsaAlgorithms {
+		names[name] = true
+	}
+	for _, h := range c.HybridAlgorithms {
+		if h.Name == "" {
+			return errors.Errorf("postQuantum hybrid algorithm %q is missing a name", h.OID)
+		}
+		if names[h.Name] {
+			return errors.Errorf("duplicated postQuantum algorithm name %q", h.Name)
+		}
+		names[h.Name] = true
+		if _, err := x509.ParseOID(h.OID); err != nil {
+			return errors.Wrapf(err, "invalid oid %q of postQuantum hybrid algorithm %q", h.OID, h.Name)
+		}
+		if _, ok := mldsaAlgorithms[h.OID]; ok {
+			return errors.Errorf("postQuantum hybrid algorithm %q uses the ML-DSA oid %s", h.Name, h.OID)
+		}
+	}
+
+	return nil
+}
+
+// algorithms returns the post-quantum algorithm names by OID.
+func (c PostQuantumConfig) algorithms() map[string]string {
+	m := make(map[string]string, len(mldsaAlgorithms)+len(c.HybridAlgorithms))
+	for oid, name := range mldsaAlgorithms {
+		m[oid] = name
+	}
+	for _, h := range c.HybridAlgorithms {
+		m[h.OID] = h.Name
+	}
+
+	return m
+}
+
+// postQuantumState is the post-quantum configuration in use. It is global
+// as CSRs are validated while decoding the requests.
+type postQuantumState struct {
+	enabled    bool
+	algorithms map[string]string
+}
+
+var postQuantum atomic.Pointer[postQuantumState]
+
+// applyPostQuantum sets the post-quantum configuration used to validate
+// the CSRs.
+func applyPostQuantum(c PostQuantumConfig) {
+	postQuantum.Store(&postQuantumState{enabled: c.Enabled, algorithms: c.algorithms()})
+}
+
+func currentPostQuantum() *postQuantumState {
+	if s := postQuantum.Load(); s != nil {
+		return s
+	}
+	return &postQuantumState{algorithms: mldsaAlgorithms}
+}
+
+// csrPostQuantum returns the names of the post-quantum algorithms of the
+// public key and the signature of a DER CSR, empty if not post-quantum.
+func csrPostQuantum(der []byte) (keyAlg, sigAlg string) {
+	keyOID, sigOID, err := csrAlgorithmOIDs(der)
+	if err != nil {
+		return "", ""
+	}
+	algs := currentPostQuantum().algorithms
+	return algs[keyOID.String()], algs[sigOID.String()]
+}
+
+// checkPostQuantum rejects the CSRs using post-quantum algorithms unless
+// enabled. If the Go toolchain cannot verify their signature, they are
+// forwarded unverified and the upstream CA verifies the proof of
+// possession. It returns false if the CSR is not post-quantum.
+func checkPostQuantum(csr *x509.CertificateRequest) (bool, error) {
+	keyAlg, sigAlg := csrPostQuantum(csr.Raw)
+	if keyAlg == "" && sigAlg == "" {
+		return false, nil
+	}
+	name := sigAlg
+	if name == "" {
+		name = keyAlg
+	}
+	if !currentPostQuantum().enabled {
+		return true, errs.BadRequest("csr uses the post-quantum algorithm %s, which is not enabled", name)
+	}
+	if err := csr.CheckSignature(); err != nil && !errors.Is(err, x509.ErrUnsupportedAlgorithm) {
+		return true, errs.BadRequestErr(err, "invalid csr")
+	}
+
+	return true, nil
+}
+
+// csrAlgorithmOIDs returns the OIDs of the public key and signature
+// algorithms of a DER CSR.
+func csrAlgorithmOIDs(der []byte) (keyOID, sigOID asn1.ObjectIdentifier, err error) {
+	input := cryptobyte.String(der)
+	var csr, info, spki, keyAlg, sigAlg cryptobyte.String
+	if !input.ReadASN1(&csr, cbasn1.SEQUENCE) ||
+		!csr.ReadASN1(&info, cbasn1.SEQUENCE) ||
+		!info.SkipASN1(cbasn1.INTEGER) ||
+		!info.SkipASN1(cbasn1.SEQUENCE) ||
+		!info.ReadASN1(&spki, cbasn1.SEQUENCE) ||
+		!spki.ReadASN1(&keyAlg, cbasn1.SEQUENCE) ||
+		!keyAlg.ReadASN1ObjectIdentifier(&keyOID) ||
+		!csr.ReadASN1(&sigAlg, cbasn1.SEQUENCE) ||
+		!sigAlg.ReadASN1ObjectIdentifier(&sigOID) {
+		return nil, nil, errors.New("malformed certification request")
+	}
+
+	return keyOID, sigOID, nil
+}
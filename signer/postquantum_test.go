@@ -0,0 +1,121 @@
+package signer
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+var (
+	oidMLDSA65       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 18}
+	oidTestComposite = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 6, 45}
+)
+
+// newPostQuantumCSR returns a PEM CSR with the public key and signature
+// algorithms, and random key and signature bytes. The standard library
+// cannot create them, so the CSR is built by hand.
+func newPostQuantumCSR(t *testing.T, keyAlg, sigAlg asn1.ObjectIdentifier) string {
+	t.Helper()
+	subject, err := asn1.Marshal(pkix.Name{CommonName: "pq.example.com"}.ToRDNSequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+			b.AddASN1Int64(0)
+			b.AddBytes(subject)
+			b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) { b.AddASN1ObjectIdentifier(keyAlg) })
+				b.AddASN1BitString(random(1952))
+			})
+			b.AddASN1(cbasn1.Tag(0).Constructed().ContextSpecific(), func(*cryptobyte.Builder) {})
+		})
+		b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) { b.AddASN1ObjectIdentifier(sigAlg) })
+		b.AddASN1BitString(random(3309))
+	})
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: b.BytesOrPanic()}))
+}
+
+func TestPostQuantumConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    PostQuantumConfig
+		ok   bool
+	}{
+		{"empty", PostQuantumConfig{}, true},
+		{"hybrid", PostQuantumConfig{HybridAlgorithms: []HybridAlgorithmConfig{{Name: "MLDSA65-ECDSA-P256-SHA512", OID: oidTestComposite.String()}}}, true},
+		{"no name", PostQuantumConfig{HybridAlgorithms: []HybridAlgorithmConfig{{OID: oidTestComposite.String()}}}, false},
+		{"ML-DSA name", PostQuantumConfig{HybridAlgorithms: []HybridAlgorithmConfig{{Name: "ML-DSA-65", OID: oidTestComposite.String()}}}, false},
+		{"ML-DSA oid", PostQuantumConfig{HybridAlgorithms: []HybridAlgorithmConfig{{Name: "hybrid", OID: oidMLDSA65.String()}}}, false},
+		{"invalid oid", PostQuantumConfig{HybridAlgorithms: []HybridAlgorithmConfig{{Name: "hybrid", OID: "1.x"}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestPostQuantumCSR(t *testing.T) {
+	t.Cleanup(func() { postQuantum.Store(nil) })
+	hybrid := PostQuantumConfig{HybridAlgorithms: []HybridAlgorithmConfig{{Name: "MLDSA65-ECDSA-P256-SHA512", OID: oidTestComposite.String()}}}
+	decode := func(csr string) *SignRequest {
+		var request SignRequest
+		if err := json.Unmarshal([]byte(`{"csr":`+mustJSON(t, csr)+`}`), &request); err != nil {
+			t.Fatal(err)
+		}
+		return &request
+	}
+
+	mldsa := decode(newPostQuantumCSR(t, oidMLDSA65, oidMLDSA65))
+	composite := decode(newPostQuantumCSR(t, oidTestComposite, oidTestComposite))
+	if key, sig := csrPostQuantum(mldsa.CsrPEM.Raw); key != "ML-DSA-65" || sig != "ML-DSA-65" {
+		t.Errorf("csrPostQuantum() = %q, %q, want ML-DSA-65", key, sig)
+	}
+
+	applyPostQuantum(hybrid)
+	if err := mldsa.Validate(); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("Validate() of an ML-DSA CSR when disabled = %v, want a 400", err)
+	}
+
+	hybrid.Enabled = true
+	applyPostQuantum(hybrid)
+	if err := composite.Validate(); err != nil {
+		t.Errorf("Validate() of a composite CSR when enabled = %v", err)
+	}
+	// Toolchains verifying ML-DSA reject the random signature, the others
+	// forward the CSR unverified.
+	if err := mldsa.Validate(); err != nil && strings.Contains(err.Error(), "not enabled") {
+		t.Errorf("Validate() of an ML-DSA CSR when enabled = %v", err)
+	}
+	if key, sig := csrPostQuantum(composite.CsrPEM.Raw); key != "MLDSA65-ECDSA-P256-SHA512" || sig != key {
+		t.Errorf("csrPostQuantum() of a composite CSR = %q, %q", key, sig)
+	}
+
+	c := KeysConfig{Rules: []KeyRule{{ID: "pq", KeyTypes: []string{"ML-DSA"}}}}
+	if d := c.checkKeys([]string{"web"}, mldsa); !d.Allowed {
+		t.Errorf("checkKeys() of an ML-DSA CSR = %+v, want allowed", d)
+	}
+	if d := c.checkKeys([]string{"web"}, decode(newTestCSR(t, "www.example.com"))); d.Allowed {
+		t.Error("checkKeys() of an ECDSA CSR allowed, want denied")
+	}
+	if err := c.Validate(hybrid); err != nil {
+		t.Errorf("Validate() of a post-quantum keys rule = %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package signer
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+)
+
+// PreflightConfig configures the checks run at startup, before the listener
+// is bound.
+type PreflightConfig struct {
+	Skip              bool   `yaml:"skip"`
+	StrictPermissions bool   `yaml:"strictPermissions"`
+	Timeout           string `yaml:"timeout"`
+}
+
+// GetTimeout returns the timeout of the upstream checks, defaults to 10s.
+func (c PreflightConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 10 * time.Second
+}
+
+// preflightCheck is a startup check with a hint on how to fix it.
+type preflightCheck struct {
+	name     string
+	hint     string
+	exitCode int
+	check    func() error
+}
+
+// runPreflight checks the files used by the signer and the connectivity to
+// the upstream CA.
+func runPreflight(config *Config) error {
+	if config.Preflight.Skip {
+		return nil
+	}
+
+	checks := []preflightCheck{
+		{
+			name: "root CA file",
+			hint: "check rootCAPath and additionalRootCAPaths point to PEM encoded root certificates of the CA",
+			check: func() error {
+				for _, path := range config.GetRootCAPaths() {
+					if err := checkRootFile(path); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "provisioner password file",
+			hint: "check provisionerPasswordFile exists, is readable and only readable by the signer",
+			check: func() error {
+				return checkSecretFile(config.GetProvisionerPasswordPath(), config.Preflight.StrictPermissions)
+			},
+		},
+		{
+			name:     "CA connectivity",
+			hint:     "check caURL is correct and the CA is reachable from the signer, and that rootCAPath is the root of that CA",
+			exitCode: exitUpstream,
+			check: func() error {
+				rootOption, err := upstreamRootOption(config)
+				if err != nil {
+					return err
+				}
+				client, err := ca.NewClient(config.CaURL, rootOption)
+				if err != nil {
+					return err
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), config.Preflight.GetTimeout())
+				defer cancel()
+				_, err = client.HealthWithContext(ctx)
+				return err
+			},
+		},
+	}
+
+	for _, f := range []string{config.Intermediate.ProvisionerPasswordFile, config.Canary.ProvisionerPasswordFile} {
+		if f == "" {
+			continue
+		}
+		filename := f
+		checks = append(checks, preflightCheck{
+			name:  "password file " + filename,
+			hint:  "check the provisioner password file exists, is readable and only readable by the signer",
+			check: func() error { return checkSecretFile(filename, config.Preflight.StrictPermissions) },
+		})
+	}
+
+	return runChecks(checks)
+}
+
+// preflightProvisioner checks that the provisioner can mint tokens, which
+// validates the decrypted key.
+func preflightProvisioner(config *Config, p *ca.Provisioner) error {
+	if config.Preflight.Skip {
+		return nil
+	}
+
+	return runChecks([]preflightCheck{{
+		name: "provisioner " + p.Name(),
+		hint: "check PROVISIONER_NAME, PROVISIONER_KID and the provisioner password",
+		check: func() error {
+			_, err := signToken(p, "preflight.ca-signer.invalid")
+			return err
+		},
+	}})
+}
+
+func runChecks(checks []preflightCheck) error {
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			logFor("preflight").WithFields(log.Fields{
+				"check": c.name,
+				"hint":  c.hint,
+				"error": err,
+			}).Error("Preflight check failed")
+			code := c.exitCode
+			if code == 0 {
+				code = exitConfig
+			}
+			return withExitCode(code, errors.Wrapf(err, "preflight check %q failed: %s", c.name, c.hint))
+		}
+		logFor("preflight").WithField("check", c.name).Debug("Preflight check passed")
+	}
+
+	return nil
+}
+
+// checkRootFile checks the file contains at least one PEM certificate.
+func checkRootFile(filename string) error {
+	_, err := readRootCertificate(filename)
+	return err
+}
+
+// checkSecretFile checks the file is readable and not writable by others.
+// Files readable by others are rejected in strict mode and logged otherwise.
+func checkSecretFile(filename string, strict bool) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Kubernetes secret volumes are symlinks to files with the configured
+	// defaultMode, os.Open follows them.
+	mode := info.Mode().Perm()
+	switch {
+	case mode&0o002 != 0:
+		return errors.Errorf("%s is writable by others (mode %o)", filename, mode)
+	case mode&0o044 != 0 && strict:
+		return errors.Errorf("%s is readable by group or others (mode %o)", filename, mode)
+	case mode&0o044 != 0:
+		logFor("preflight").WithFields(log.Fields{
+			"file": filename,
+			"mode": mode.String(),
+		}).Warn("Secret file is readable by group or others")
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package signer
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		mode   os.FileMode
+		strict bool
+		ok     bool
+	}{
+		{0o600, true, true},
+		{0o640, false, true},
+		{0o640, true, false},
+		{0o602, false, false},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, "password")
+		if err := os.WriteFile(name, []byte("secret"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(name, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkSecretFile(name, tt.strict); (err == nil) != tt.ok {
+			t.Errorf("checkSecretFile(%o, strict %v) = %v, want ok %v", tt.mode, tt.strict, err, tt.ok)
+		}
+	}
+	if err := checkSecretFile(filepath.Join(dir, "missing"), false); err == nil {
+		t.Error("checkSecretFile() of a missing file error = nil")
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	dir := t.TempDir()
+	root, _ := newTestCert(t, "Test Root")
+	rootFile, password := filepath.Join(dir, "root_ca.crt"), filepath.Join(dir, "password")
+	if err := writeFile(rootFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(password, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		code   int
+	}{
+		{"missing root", Config{RootCAPath: filepath.Join(dir, "missing.crt"), ProvisionerPasswordFile: password}, exitConfig},
+		{"missing password", Config{RootCAPath: rootFile, ProvisionerPasswordFile: filepath.Join(dir, "missing")}, exitConfig},
+		{"unreachable CA", Config{RootCAPath: rootFile, ProvisionerPasswordFile: password, CaURL: "https://127.0.0.1:1", Preflight: PreflightConfig{Timeout: "1s"}}, exitUpstream},
+		{"skipped", Config{RootCAPath: filepath.Join(dir, "missing.crt"), Preflight: PreflightConfig{Skip: true}}, 0},
+	}
+	for _, tt := range tests {
+		err := runPreflight(&tt.config)
+		var ec *exitCodeError
+		switch {
+		case tt.code == 0 && err != nil:
+			t.Errorf("%s: runPreflight() = %v", tt.name, err)
+		case tt.code != 0 && (!errors.As(err, &ec) || ec.code != tt.code):
+			t.Errorf("%s: runPreflight() = %v, want exit code %d", tt.name, err, tt.code)
+		}
+	}
+}
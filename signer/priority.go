@@ -0,0 +1,340 @@
+package signer
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// priorityDefault is the class of all the requests when no classes are
+// configured.
+const priorityDefault = "default"
+
+// PriorityConfig limits the sign requests processed at once. When all the
+// slots are busy, requests wait in a queue per priority class, and freed
+// slots go to the classes in proportion to their weights, so critical
+// renewals are not starved by bulk enrollments.
+type PriorityConfig struct {
+	MaxConcurrent int             `yaml:"maxConcurrent"`
+	MaxQueue      int             `yaml:"maxQueue"`
+	QueueTimeout  string          `yaml:"queueTimeout"`
+	Header        string          `yaml:"header"`
+	Default       string          `yaml:"default"`
+	Classes       []PriorityClass `yaml:"classes"`
+	Adaptive      AdaptiveConfig  `yaml:"adaptive"`
+}
+
+// PriorityClass is a priority class. Requests from its clients get it;
+// if clients is empty, any client can request it with the header.
+type PriorityClass struct {
+	Name    string   `yaml:"name"`
+	Weight  int      `yaml:"weight"`
+	Clients []string `yaml:"clients"`
+}
+
+// Enabled returns true if the sign requests are limited.
+func (c PriorityConfig) Enabled() bool {
+	return c.MaxConcurrent > 0
+}
+
+// GetMaxQueue returns the maximum number of waiting requests, defaults to
+// 1000.
+func (c PriorityConfig) GetMaxQueue() int {
+	if c.MaxQueue > 0 {
+		return c.MaxQueue
+	}
+
+	return 1000
+}
+
+// GetQueueTimeout returns how long a request waits for a slot, defaults to
+// 30s.
+func (c PriorityConfig) GetQueueTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.QueueTimeout); err == nil {
+		return d
+	}
+
+	return 30 * time.Second
+}
+
+// GetHeader returns the header requesting a class, defaults to
+// X-Priority-Class.
+func (c PriorityConfig) GetHeader() string {
+	if c.Header != "" {
+		return c.Header
+	}
+
+	return "X-Priority-Class"
+}
+
+// GetClasses returns the classes, a single default class if none is
+// configured.
+func (c PriorityConfig) GetClasses() []PriorityClass {
+	if len(c.Classes) > 0 {
+		return c.Classes
+	}
+
+	return []PriorityClass{{Name: priorityDefault, Weight: 1}}
+}
+
+// GetDefault returns the class of the requests of other clients, defaults
+// to the last class.
+func (c PriorityConfig) GetDefault() string {
+	if c.Default != "" {
+		return c.Default
+	}
+	classes := c.GetClasses()
+
+	return classes[len(classes)-1].Name
+}
+
+// Validate checks the classes.
+func (c PriorityConfig) Validate() error {
+	if c.MaxConcurrent < 0 || c.MaxQueue < 0 {
+		return errors.New("priority maxConcurrent and maxQueue must be positive")
+	}
+	if (len(c.Classes) > 0 || c.Adaptive.Enabled) && !c.Enabled() {
+		return errors.New("priority classes and adaptive require maxConcurrent")
+	}
+	if err := c.Adaptive.Validate(c.MaxConcurrent); err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, class := range c.Classes {
+		if class.Name == "" {
+			return errors.New("priority classes require a name")
+		}
+		if names[class.Name] {
+			return errors.Errorf("duplicated priority class %q", class.Name)
+		}
+		names[class.Name] = true
+		if class.Weight <= 0 {
+			return errors.Errorf("priority class %s requires a positive weight", class.Name)
+		}
+	}
+	if len(c.Classes) > 0 && !names[c.GetDefault()] {
+		return errors.Errorf("priority default %q is not a class", c.Default)
+	}
+
+	return nil
+}
+
+// classFor returns the class of a request: the class requested with the
+// header if the client may use it, else the first class listing the
+// client, else the default class.
+func (c PriorityConfig) classFor(r *http.Request) string {
+	clients := clientIdentities(r)
+	classes := c.GetClasses()
+	if requested := r.Header.Get(c.GetHeader()); requested != "" {
+		for _, class := range classes {
+			if class.Name == requested && (len(class.Clients) == 0 || policy.ContainsAny(class.Clients, clients)) {
+				return class.Name
+			}
+		}
+	}
+	for _, class := range classes {
+		if policy.ContainsAny(class.Clients, clients) {
+			return class.Name
+		}
+	}
+
+	return c.GetDefault()
+}
+
+var (
+	errQueueFull = errors.New("sign queue is full")
+	errShed      = errors.New("sign request shed")
+)
+
+// priorityQueue holds the requests of a class waiting for a slot. pass is
+// the virtual time of the class, advanced by 1/weight for each request it
+// is granted.
+type priorityQueue struct {
+	name    string
+	weight  float64
+	pass    float64
+	shed    bool
+	waiters *list.List
+}
+
+// priorityWaiter receives nil when it is granted a slot, or the error
+// rejecting it.
+type priorityWaiter chan error
+
+// priorityScheduler grants the slots with start-time fair queuing: a freed
+// slot goes to the waiting class with the lowest virtual time. A class that
+// was idle starts at the current virtual time, so it cannot claim the slots
+// it did not use.
+type priorityScheduler struct {
+	maxQueue int
+	adaptive *adaptiveLimit
+
+	mu     sync.Mutex
+	limit  int
+	inUse  int
+	queued int
+	vtime  float64
+	queues map[string]*priorityQueue
+	order  []*priorityQueue
+	// byWeight lists the classes from the lowest weight, the first shed.
+	byWeight []*priorityQueue
+}
+
+func newPriorityScheduler(c PriorityConfig) *priorityScheduler {
+	s := &priorityScheduler{maxQueue: c.GetMaxQueue(), limit: c.MaxConcurrent, queues: map[string]*priorityQueue{}}
+	for _, class := range c.GetClasses() {
+		q := &priorityQueue{name: class.Name, weight: float64(class.Weight), waiters: list.New()}
+		s.queues[class.Name] = q
+		s.order = append(s.order, q)
+	}
+	s.byWeight = slices.Clone(s.order)
+	slices.SortStableFunc(s.byWeight, func(a, b *priorityQueue) int {
+		return cmp.Compare(a.weight, b.weight)
+	})
+	if c.Adaptive.Enabled {
+		s.adaptive = newAdaptiveLimit(c.Adaptive, c.MaxConcurrent)
+	}
+	signConcurrencyLimit.Set(float64(s.limit))
+
+	return s
+}
+
+// acquire waits for a slot for a request of the class until ctx is done.
+func (s *priorityScheduler) acquire(ctx context.Context, class string) error {
+	s.mu.Lock()
+	if s.inUse < s.limit && s.queued == 0 {
+		s.inUse++
+		s.mu.Unlock()
+		return nil
+	}
+	q := s.queues[class]
+	if q.shed {
+		s.mu.Unlock()
+		return errShed
+	}
+	if s.queued >= s.maxQueue {
+		s.mu.Unlock()
+		return errQueueFull
+	}
+	if q.waiters.Len() == 0 && q.pass < s.vtime {
+		q.pass = s.vtime
+	}
+	ready := make(priorityWaiter, 1)
+	e := q.waiters.PushBack(ready)
+	s.queued++
+	signQueueDepth.WithLabelValues(class).Inc()
+	s.mu.Unlock()
+
+	select {
+	case err := <-ready:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	select {
+	case err := <-ready:
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		// Granted while giving up, pass the slot on.
+		s.release()
+	default:
+		q.waiters.Remove(e)
+		s.queued--
+		signQueueDepth.WithLabelValues(class).Dec()
+		s.mu.Unlock()
+	}
+
+	return ctx.Err()
+}
+
+// release frees a slot, or hands it to the next waiting request.
+func (s *priorityScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inUse--
+	s.dispatch()
+}
+
+// dispatch grants the free slots to the waiting requests. It must be
+// called with s.mu held.
+func (s *priorityScheduler) dispatch() {
+	for s.inUse < s.limit {
+		var next *priorityQueue
+		for _, q := range s.order {
+			if q.waiters.Len() > 0 && (next == nil || q.pass < next.pass) {
+				next = q
+			}
+		}
+		if next == nil {
+			return
+		}
+		ready := next.waiters.Remove(next.waiters.Front()).(priorityWaiter)
+		s.vtime = next.pass
+		next.pass += 1 / next.weight
+		s.queued--
+		s.inUse++
+		signQueueDepth.WithLabelValues(next.name).Dec()
+		ready <- nil
+	}
+}
+
+// prioritize wraps a sign endpoint so it runs in a slot of the scheduler.
+// Requests waiting longer than the queue timeout, finding the queue full or
+// shed, are rejected with 503 Service Unavailable.
+func (s *server) prioritize(next http.HandlerFunc) http.HandlerFunc {
+	if s.priority == nil {
+		return next
+	}
+	c := s.config.Priority
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		class := c.classFor(r)
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(r.Context(), c.GetQueueTimeout())
+		endQueue := timePhase(r.Context(), phaseQueue)
+		err := s.priority.acquire(ctx, class)
+		endQueue()
+		cancel()
+		waited := time.Since(start)
+		signQueueWait.WithLabelValues(class).Observe(waited.Seconds())
+		if err != nil {
+			reason := "timeout"
+			switch err {
+			case errQueueFull:
+				reason = "full"
+			case errShed:
+				reason = "shed"
+			}
+			signQueueRejections.WithLabelValues(class, reason).Inc()
+			logFor("server").WithFields(log.Fields{
+				"client": clientIdentities(r),
+				"class":  class,
+				"reason": reason,
+				"waited": waited.Round(time.Millisecond).String(),
+			}).Warn("Service Unavailable: no sign slot available")
+			w.Header().Set("Retry-After", strconv.Itoa(1+int(c.GetQueueTimeout().Seconds())/10))
+			render.Error(w, r, errs.New(http.StatusServiceUnavailable, "the signer is busy, retry later"))
+			return
+		}
+		defer s.priority.release()
+
+		w.Header().Set("X-Priority-Class", class)
+		next(w, r)
+	}
+}
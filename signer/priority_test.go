@@ -0,0 +1,177 @@
+package signer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitQueued waits until n requests are queued in the scheduler.
+func waitQueued(t *testing.T, s *priorityScheduler, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		queued := s.queued
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("requests never queued, want %d", n)
+}
+
+func TestPriorityConfigValidate(t *testing.T) {
+	classes := []PriorityClass{{Name: "critical", Weight: 3}, {Name: "bulk", Weight: 1}}
+	tests := []struct {
+		name string
+		c    PriorityConfig
+		ok   bool
+	}{
+		{"disabled", PriorityConfig{}, true},
+		{"classes", PriorityConfig{MaxConcurrent: 4, Classes: classes}, true},
+		{"default", PriorityConfig{MaxConcurrent: 4, Classes: classes, Default: "critical"}, true},
+		{"negative", PriorityConfig{MaxConcurrent: -1}, false},
+		{"classes without limit", PriorityConfig{Classes: classes}, false},
+		{"unknown default", PriorityConfig{MaxConcurrent: 4, Classes: classes, Default: "normal"}, false},
+		{"weight", PriorityConfig{MaxConcurrent: 4, Classes: []PriorityClass{{Name: "bulk"}}}, false},
+		{"duplicated", PriorityConfig{MaxConcurrent: 4, Classes: []PriorityClass{{Name: "bulk", Weight: 1}, {Name: "bulk", Weight: 2}}}, false},
+		{"name", PriorityConfig{MaxConcurrent: 4, Classes: []PriorityClass{{Weight: 1}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	if c := (PriorityConfig{}); c.GetDefault() != priorityDefault || c.GetMaxQueue() != 1000 || c.GetQueueTimeout() != 30*time.Second || c.GetHeader() != "X-Priority-Class" {
+		t.Errorf("defaults = %s, %d, %v, %s", c.GetDefault(), c.GetMaxQueue(), c.GetQueueTimeout(), c.GetHeader())
+	}
+}
+
+func TestPriorityClassFor(t *testing.T) {
+	c := PriorityConfig{MaxConcurrent: 4, Classes: []PriorityClass{
+		{Name: "critical", Weight: 4, Clients: []string{"ingress"}},
+		{Name: "renewal", Weight: 2},
+		{Name: "bulk", Weight: 1, Clients: []string{"enroll"}},
+	}, Default: "renewal"}
+	tests := []struct {
+		client, header, want string
+	}{
+		{"ingress", "", "critical"},
+		{"enroll", "", "bulk"},
+		{"web", "", "renewal"},
+		{"web", "bulk", "renewal"},
+		{"web", "critical", "renewal"},
+		{"ingress", "renewal", "renewal"},
+		{"enroll", "unknown", "bulk"},
+	}
+	for _, tt := range tests {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), tt.client)
+		r.Header.Set("X-Priority-Class", tt.header)
+		if got := c.classFor(r); got != tt.want {
+			t.Errorf("%s with %q: classFor() = %s, want %s", tt.client, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestPrioritySchedulerFairness(t *testing.T) {
+	s := newPriorityScheduler(PriorityConfig{MaxConcurrent: 1, Classes: []PriorityClass{{Name: "critical", Weight: 3}, {Name: "bulk", Weight: 1}}})
+	if err := s.acquire(context.Background(), "critical"); err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan string)
+	for i, class := range []string{"bulk", "critical", "bulk", "critical", "bulk", "critical", "bulk", "critical"} {
+		go func() {
+			if err := s.acquire(context.Background(), class); err != nil {
+				t.Error(err)
+			}
+			granted <- class
+		}()
+		waitQueued(t, s, i+1)
+	}
+
+	var order []string
+	for range 8 {
+		s.release()
+		order = append(order, <-granted)
+	}
+	s.release()
+	if got, want := strings.Join(order, ","), "critical,bulk,critical,critical,critical,bulk,bulk,bulk"; got != want {
+		t.Errorf("grant order = %s, want %s", got, want)
+	}
+	if s.inUse != 0 || s.queued != 0 {
+		t.Errorf("in use %d, queued %d after the releases, want 0", s.inUse, s.queued)
+	}
+}
+
+func TestPrioritySchedulerRejections(t *testing.T) {
+	s := newPriorityScheduler(PriorityConfig{MaxConcurrent: 1, MaxQueue: 1})
+	if err := s.acquire(context.Background(), priorityDefault); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx, priorityDefault); err != context.DeadlineExceeded {
+		t.Errorf("acquire() past the timeout = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.acquire(context.Background(), priorityDefault) }()
+	waitQueued(t, s, 1)
+	if err := s.acquire(context.Background(), priorityDefault); err != errQueueFull {
+		t.Errorf("acquire() with a full queue = %v, want %v", err, errQueueFull)
+	}
+	s.release()
+	if err := <-done; err != nil {
+		t.Errorf("acquire() of the queued request = %v", err)
+	}
+	s.release()
+	if s.inUse != 0 || s.queued != 0 {
+		t.Errorf("in use %d, queued %d after the releases, want 0", s.inUse, s.queued)
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	s := &server{config: &Config{Priority: PriorityConfig{MaxConcurrent: 1, QueueTimeout: "20ms"}}}
+	s.priority = newPriorityScheduler(s.config.Priority)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := s.prioritize(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	call := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, withIdentities(httptest.NewRequest(http.MethodPost, path, nil), "web"))
+		return w
+	}
+
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- call("/slow") }()
+	<-started
+	timeouts := signQueueRejections.WithLabelValues(priorityDefault, "timeout")
+	before := testutil.ToFloat64(timeouts)
+	if w := call("/sign"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("busy status = %d, Retry-After %q, want 503 and 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(timeouts) - before; got != 1 {
+		t.Errorf("timeouts counted = %v, want 1", got)
+	}
+
+	close(release)
+	if w := <-slow; w.Code != http.StatusCreated || w.Header().Get("X-Priority-Class") != priorityDefault {
+		t.Errorf("slow request = %d, class %q", w.Code, w.Header().Get("X-Priority-Class"))
+	}
+	if w := call("/sign"); w.Code != http.StatusCreated {
+		t.Errorf("status after the release = %d, want %d", w.Code, http.StatusCreated)
+	}
+}
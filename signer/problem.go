@@ -0,0 +1,110 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const problemContentType = "application/problem+json"
+
+// problemJSON rewrites the error responses of next as RFC 7807 problem
+// details when the client accepts application/problem+json. The status and
+// message of the smallstep error body become the status and detail of the
+// problem, and the other fields, e.g. ruleId, are kept as extensions.
+func problemJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsProblem(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		pw := &problemWriter{ResponseWriter: w}
+		next.ServeHTTP(pw, r)
+		pw.finish(r)
+	})
+}
+
+// acceptsProblem reports whether Accept lists application/problem+json.
+func acceptsProblem(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != problemContentType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+
+	return false
+}
+
+// problemWriter buffers the body of error responses so they can be
+// rewritten, other responses are written through.
+type problemWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (p *problemWriter) WriteHeader(code int) {
+	if p.status != 0 {
+		return
+	}
+	p.status = code
+	if code < http.StatusBadRequest {
+		p.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (p *problemWriter) Write(b []byte) (int, error) {
+	if p.status == 0 {
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.status < http.StatusBadRequest {
+		return p.ResponseWriter.Write(b)
+	}
+	return p.buf.Write(b)
+}
+
+// Flush implements http.Flusher for the responses written through.
+func (p *problemWriter) Flush() {
+	if f, ok := p.ResponseWriter.(http.Flusher); ok && p.status < http.StatusBadRequest {
+		f.Flush()
+	}
+}
+
+// finish writes the buffered error as a problem.
+func (p *problemWriter) finish(r *http.Request) {
+	if p.status < http.StatusBadRequest {
+		return
+	}
+
+	problem := map[string]any{}
+	if err := json.Unmarshal(p.buf.Bytes(), &problem); err != nil {
+		problem = map[string]any{"message": strings.TrimSpace(p.buf.String())}
+	}
+	if msg, ok := problem["message"]; ok {
+		problem["detail"] = msg
+		delete(problem, "message")
+	}
+	problem["type"] = "about:blank"
+	problem["title"] = http.StatusText(p.status)
+	problem["status"] = p.status
+	problem["instance"] = r.URL.Path
+
+	body, err := json.Marshal(problem)
+	if err != nil {
+		body = p.buf.Bytes()
+	}
+	h := p.ResponseWriter.Header()
+	h.Set("Content-Type", problemContentType)
+	h.Del("Content-Length")
+	p.ResponseWriter.WriteHeader(p.status)
+	p.ResponseWriter.Write(body)
+}
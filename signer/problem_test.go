@@ -0,0 +1,59 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smallstep/certificates/api/render"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+func TestProblemJSON(t *testing.T) {
+	handler := problemJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sign":
+			render.Error(w, r, &policyError{Decision: policy.Decision{RuleID: "no-prod", Reason: "production names are denied"}})
+		case "/text":
+			http.Error(w, "upstream down", http.StatusBadGateway)
+		default:
+			render.JSON(w, r, map[string]string{"status": "ok"})
+		}
+	}))
+	serve := func(path, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("/sign", "application/json, application/problem+json")
+	var problem map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusForbidden || w.Header().Get("Content-Type") != problemContentType ||
+		problem["type"] != "about:blank" || problem["title"] != "Forbidden" || problem["status"] != float64(403) ||
+		problem["instance"] != "/sign" || problem["ruleId"] != "no-prod" || problem["detail"] == nil || problem["message"] != nil {
+		t.Errorf("policy denial: %d %s %v, want a 403 problem", w.Code, w.Header().Get("Content-Type"), problem)
+	}
+
+	w = serve("/text", problemContentType)
+	problem = nil
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	if w.Code != http.StatusBadGateway || problem["detail"] != "upstream down" {
+		t.Errorf("text error: %d %s, want a 502 problem with the text as detail", w.Code, w.Body)
+	}
+
+	if w := serve("/ok", problemContentType); w.Code != http.StatusOK || w.Header().Get("Content-Type") == problemContentType {
+		t.Errorf("success: %d %s, want it written through", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, accept := range []string{"application/json", "application/problem+json;q=0"} {
+		if w := serve("/sign", accept); w.Header().Get("Content-Type") == problemContentType {
+			t.Errorf("Accept %q: got a problem, want the smallstep error", accept)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package signer
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// Signing profiles.
+const (
+	profileCodeSigning     = "codeSigning"
+	profileDocumentSigning = "documentSigning"
+)
+
+// oidExtKeyUsageDocumentSigning is id-kp-documentSigning from RFC 9336.
+var oidExtKeyUsageDocumentSigning = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 36}
+
+// ProfileConfig grants a signing profile to some clients. Certificates of a
+// profile are only issued once one of the approvers approved the request.
+type ProfileConfig struct {
+	Name        string   `yaml:"name"`
+	Clients     []string `yaml:"clients"`
+	Approvers   []string `yaml:"approvers"`
+	MaxDuration string   `yaml:"maxDuration"`
+	ApprovalTTL string   `yaml:"approvalTTL"`
+
+	Sensitivity      string   `yaml:"sensitivity"`
+	RequiredMetadata []string `yaml:"requiredMetadata"`
+}
+
+// GetMaxDuration returns the maximum lifetime of the certificates, defaults to
+// 1h.
+func (c ProfileConfig) GetMaxDuration() time.Duration {
+	if d, err := time.ParseDuration(c.MaxDuration); err == nil {
+		return d
+	}
+
+	return time.Hour
+}
+
+// GetApprovalTTL returns how long a request can wait for an approval, and an
+// issued certificate can be fetched, defaults to 1h.
+func (c ProfileConfig) GetApprovalTTL() time.Duration {
+	if d, err := time.ParseDuration(c.ApprovalTTL); err == nil {
+		return d
+	}
+
+	return time.Hour
+}
+
+// Validate checks the profile name, grants and approvers.
+func (c ProfileConfig) Validate() error {
+	if c.Name != profileCodeSigning && c.Name != profileDocumentSigning {
+		return errors.Errorf("invalid profile %q", c.Name)
+	}
+	if len(c.Clients) == 0 {
+		return errors.Errorf("profile %q has no clients", c.Name)
+	}
+	if len(c.Approvers) == 0 {
+		return errors.Errorf("profile %q has no approvers", c.Name)
+	}
+
+	return validateSensitivity("profile "+c.Name, c.Sensitivity, c.RequiredMetadata)
+}
+
+// templateData returns the data passed to the upstream provisioner template as
+// .Insecure.User when signing a certificate of the profile.
+func (c ProfileConfig) templateData() map[string]interface{} {
+	eku := []string{"codeSigning"}
+	if c.Name == profileDocumentSigning {
+		eku = []string{oidExtKeyUsageDocumentSigning.String()}
+	}
+
+	return map[string]interface{}{
+		"profile":     c.Name,
+		"keyUsage":    []string{"digitalSignature"},
+		"extKeyUsage": eku,
+	}
+}
+
+// Verify checks that the certificate has the extended key usage of the
+// profile.
+func (c ProfileConfig) Verify(cert *x509.Certificate) error {
+	if c.Name == profileCodeSigning && hasExtKeyUsage(cert, x509.ExtKeyUsageCodeSigning) {
+		return nil
+	}
+	if c.Name == profileDocumentSigning {
+		for _, oid := range cert.UnknownExtKeyUsage {
+			if oid.Equal(oidExtKeyUsageDocumentSigning) {
+				return nil
+			}
+		}
+	}
+
+	return errors.Errorf("certificate does not have the %s extended key usage", c.Name)
+}
+
+// profileFor returns the profile of a request. It fails if the profile does
+// not exist or is not granted to the client in r.
+func (s *server) profileFor(r *http.Request, name string) (*ProfileConfig, error) {
+	for i, p := range s.config.Profiles {
+		if p.Name != name {
+			continue
+		}
+		if !clientAllowed(r, p.Clients) {
+			return nil, errs.Forbidden("client is not allowed to request %s certificates", name)
+		}
+		return &s.config.Profiles[i], nil
+	}
+
+	return nil, errs.BadRequest("unknown profile %q", name)
+}
+
+// profileDefault is the name listed by GET /profiles for requests without a
+// profile.
+const profileDefault = "default"
+
+// profileInfo describes a profile in GET /profiles.
+type profileInfo struct {
+	Name             string        `json:"name"`
+	Granted          bool          `json:"granted"`
+	Clients          []string      `json:"clients,omitempty"`
+	RequiresApproval bool          `json:"requiresApproval"`
+	Sensitivity      string        `json:"sensitivity"`
+	RequiredMetadata []string      `json:"requiredMetadata,omitempty"`
+	MaxLifetime      string        `json:"maxLifetime,omitempty"`
+	ApprovalTTL      string        `json:"approvalTTL,omitempty"`
+	KeyRules         []keyRuleInfo `json:"keyRules"`
+}
+
+// keyRuleInfo is a key rule applying to a profile and the client.
+type keyRuleInfo struct {
+	ID                  string   `json:"id"`
+	SANs                []string `json:"sans,omitempty"`
+	KeyTypes            []string `json:"keyTypes,omitempty"`
+	SignatureAlgorithms []string `json:"signatureAlgorithms,omitempty"`
+}
+
+// listProfiles returns the profiles a client can request with POST /sign:
+// the default one, without profile, and the configured profiles, with their
+// grants, lifetimes and the key rules applying to the client, so clients
+// can build valid requests without trial and error.
+func (s *server) listProfiles(w http.ResponseWriter, r *http.Request) {
+	clients := clientIdentities(r)
+	profiles := []profileInfo{{
+		Name:        profileDefault,
+		Granted:     true,
+		Sensitivity: sensitivityRoutine,
+		KeyRules:    s.config.Keys.rulesFor(clients, ""),
+	}}
+	for _, p := range s.config.Profiles {
+		profiles = append(profiles, profileInfo{
+			Name:             p.Name,
+			Granted:          policy.ContainsAny(p.Clients, clients),
+			Clients:          p.Clients,
+			RequiresApproval: true,
+			Sensitivity:      p.GetSensitivity(),
+			RequiredMetadata: p.RequiredMetadata,
+			MaxLifetime:      p.GetMaxDuration().String(),
+			ApprovalTTL:      p.GetApprovalTTL().String(),
+			KeyRules:         s.config.Keys.rulesFor(clients, p.Name),
+		})
+	}
+
+	render.JSON(w, r, map[string]interface{}{"profiles": profiles})
+}
@@ -0,0 +1,165 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProfileConfigValidate(t *testing.T) {
+	tests := []struct {
+		c  ProfileConfig
+		ok bool
+	}{
+		{ProfileConfig{Name: profileCodeSigning, Clients: []string{"ci"}, Approvers: []string{"security"}}, true},
+		{ProfileConfig{Name: profileDocumentSigning, Clients: []string{"ci"}, Approvers: []string{"legal"}}, true},
+		{ProfileConfig{Name: "emailProtection", Clients: []string{"ci"}, Approvers: []string{"security"}}, false},
+		{ProfileConfig{Name: profileCodeSigning, Approvers: []string{"security"}}, false},
+		{ProfileConfig{Name: profileCodeSigning, Clients: []string{"ci"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v, want ok %v", tt.c, err, tt.ok)
+		}
+	}
+}
+
+// newTestSigningCert returns a self-signed leaf certificate with the
+// extended key usages.
+func newTestSigningCert(t *testing.T, eku []x509.ExtKeyUsage, unknown ...asn1.ObjectIdentifier) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(time.Hour),
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:        eku,
+		UnknownExtKeyUsage: unknown,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestProfileConfigVerify(t *testing.T) {
+	code := newTestSigningCert(t, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning})
+	document := newTestSigningCert(t, nil, oidExtKeyUsageDocumentSigning)
+	server := newTestSigningCert(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth})
+
+	tests := []struct {
+		profile string
+		cert    *x509.Certificate
+		ok      bool
+	}{
+		{profileCodeSigning, code, true},
+		{profileCodeSigning, document, false},
+		{profileCodeSigning, server, false},
+		{profileDocumentSigning, document, true},
+		{profileDocumentSigning, code, false},
+	}
+	for i, tt := range tests {
+		if err := (ProfileConfig{Name: tt.profile}).Verify(tt.cert); (err == nil) != tt.ok {
+			t.Errorf("%d: %s Verify() = %v, want ok %v", i, tt.profile, err, tt.ok)
+		}
+	}
+}
+
+func TestProfileTemplateData(t *testing.T) {
+	data := ProfileConfig{Name: profileDocumentSigning}.templateData()
+	if eku := data["extKeyUsage"].([]string); len(eku) != 1 || eku[0] != "1.3.6.1.5.5.7.3.36" {
+		t.Errorf("documentSigning extKeyUsage = %v, want [1.3.6.1.5.5.7.3.36]", eku)
+	}
+	data = ProfileConfig{Name: profileCodeSigning}.templateData()
+	if eku := data["extKeyUsage"].([]string); len(eku) != 1 || eku[0] != "codeSigning" {
+		t.Errorf("codeSigning extKeyUsage = %v, want [codeSigning]", eku)
+	}
+}
+
+func TestProfileFor(t *testing.T) {
+	s := &server{config: &Config{Profiles: []ProfileConfig{
+		{Name: profileCodeSigning, Clients: []string{"ci"}, Approvers: []string{"security"}},
+	}}}
+	tests := []struct {
+		client, profile string
+		status          int
+	}{
+		{"ci", profileCodeSigning, 0},
+		{"web", profileCodeSigning, http.StatusForbidden},
+		{"ci", profileDocumentSigning, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), tt.client)
+		p, err := s.profileFor(r, tt.profile)
+		switch {
+		case tt.status == 0 && (err != nil || p.Name != tt.profile):
+			t.Errorf("%s %s: profileFor() = %v, %v, want the profile", tt.client, tt.profile, p, err)
+		case tt.status != 0 && errorStatus(err) != tt.status:
+			t.Errorf("%s %s: profileFor() = %v, want status %d", tt.client, tt.profile, err, tt.status)
+		}
+	}
+}
+
+func TestListProfiles(t *testing.T) {
+	s := &server{config: &Config{
+		Profiles: testProfiles,
+		Keys: KeysConfig{Rules: []KeyRule{
+			{ID: "ec", KeyTypes: []string{"ECDSA"}},
+			{ID: "ci-signing", Clients: []string{"ci"}, Profiles: []string{profileCodeSigning}, KeyTypes: []string{"ECDSA-P384"}},
+			{ID: "legacy", Clients: []string{"legacy"}, KeyTypes: []string{"RSA"}},
+		}},
+	}}
+
+	w := httptest.NewRecorder()
+	s.listProfiles(w, withIdentities(httptest.NewRequest(http.MethodGet, "/profiles", nil), "ci"))
+	var body struct {
+		Profiles []profileInfo `json:"profiles"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Profiles) != 2 {
+		t.Fatalf("listProfiles() = %s, want the default and code signing profiles", w.Body)
+	}
+	ruleIDs := func(p profileInfo) []string {
+		var ids []string
+		for _, r := range p.KeyRules {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	def, signing := body.Profiles[0], body.Profiles[1]
+	if def.Name != profileDefault || !def.Granted || def.RequiresApproval || !sameStrings(ruleIDs(def), []string{"ec"}) {
+		t.Errorf("default profile = %+v", def)
+	}
+	if signing.Name != profileCodeSigning || !signing.Granted || !signing.RequiresApproval || signing.MaxLifetime != "1h0m0s" || !sameStrings(ruleIDs(signing), []string{"ec", "ci-signing"}) {
+		t.Errorf("code signing profile = %+v", signing)
+	}
+
+	w = httptest.NewRecorder()
+	s.listProfiles(w, withIdentities(httptest.NewRequest(http.MethodGet, "/profiles", nil), "web"))
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Profiles[1].Granted {
+		t.Error("code signing profile granted to another client")
+	}
+}
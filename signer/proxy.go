@@ -0,0 +1,84 @@
+package signer
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProxyConfig configures the proxy of the outgoing HTTP connections, to
+// the upstream CAs, HTTP hooks, webhooks and object stores. Without it the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables apply.
+type ProxyConfig struct {
+	URL     string   `yaml:"url"`
+	NoProxy []string `yaml:"noProxy"`
+}
+
+// Validate checks the proxy URL, which must be an http, https, socks5 or
+// socks5h URL.
+func (c ProxyConfig) Validate() error {
+	if c.URL == "" {
+		if len(c.NoProxy) > 0 {
+			return errors.New("proxy noProxy requires a proxy url")
+		}
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid proxy url")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return errors.Errorf("invalid proxy url scheme %q, must be http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("invalid proxy url, missing host")
+	}
+
+	return nil
+}
+
+// applyProxy replaces the proxy environment of the process with the
+// configured proxy. It must run before the first outgoing request, as the
+// environment is read once by net/http.
+func applyProxy(c ProxyConfig) {
+	if c.URL == "" {
+		return
+	}
+
+	for _, v := range []string{"HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY", "https_proxy", "http_proxy", "no_proxy"} {
+		os.Unsetenv(v)
+	}
+	os.Setenv("HTTPS_PROXY", c.URL)
+	os.Setenv("HTTP_PROXY", c.URL)
+	if len(c.NoProxy) > 0 {
+		os.Setenv("NO_PROXY", strings.Join(c.NoProxy, ","))
+	}
+}
+
+// logUpstreamProxy logs the proxy used to reach the upstream CA, if any.
+func logUpstreamProxy(caURL string) {
+	u, err := url.Parse(caURL)
+	if err != nil {
+		return
+	}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: u})
+	if err != nil {
+		logFor("server").WithField("error", err).Warn("Invalid proxy environment")
+		return
+	}
+	if proxy == nil {
+		return
+	}
+
+	logFor("server").WithFields(log.Fields{
+		"caURL": caURL,
+		"proxy": proxy.Redacted(),
+	}).Info("Connecting to the upstream CA through a proxy")
+}
@@ -0,0 +1,266 @@
+package signer
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+var usageBucket = []byte("usage")
+
+// QuotaConfig limits the certificates issued each month to the clients of a
+// team. The usage counters are kept in the inventory, so a quota applies per
+// replica with a BoltDB inventory, and to all the replicas only with a shared
+// Postgres store.
+type QuotaConfig struct {
+	Team         string   `yaml:"team"`
+	Clients      []string `yaml:"clients"`
+	MonthlyLimit int      `yaml:"monthlyLimit"`
+}
+
+// Validate checks the team, clients and limit.
+func (c QuotaConfig) Validate() error {
+	if c.Team == "" {
+		return errors.New("quota is missing a team")
+	}
+	if len(c.Clients) == 0 {
+		return errors.Errorf("quota of team %q has no clients", c.Team)
+	}
+	if c.MonthlyLimit <= 0 {
+		return errors.Errorf("quota of team %q must have a positive monthlyLimit", c.Team)
+	}
+
+	return nil
+}
+
+// quotaFor returns the quota of the first team listing one of the client
+// identities, or nil if the client is not in a team.
+func (s *server) quotaFor(clients []string) *QuotaConfig {
+	for i, q := range s.config.Quotas {
+		if policy.ContainsAny(q.Clients, clients) {
+			return &s.config.Quotas[i]
+		}
+	}
+
+	return nil
+}
+
+// quotaError is returned when the team of the client has used its monthly
+// quota.
+type quotaError struct {
+	Team   string
+	Limit  int
+	Used   int
+	Resets time.Time
+}
+
+// Error implements the error interface.
+func (e *quotaError) Error() string {
+	return "monthly certificate quota of team " + e.Team + " exhausted"
+}
+
+// StatusCode implements the render.StatusCodedError interface.
+func (e *quotaError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// Render implements the render.RenderableError interface.
+func (e *quotaError) Render(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(e.Resets).Seconds())+1))
+	render.JSONStatus(w, r, struct {
+		Status  int       `json:"status"`
+		Message string    `json:"message"`
+		Code    string    `json:"code"`
+		Team    string    `json:"team"`
+		Limit   int       `json:"limit"`
+		Used    int       `json:"used"`
+		Resets  time.Time `json:"resets"`
+	}{http.StatusTooManyRequests, e.Error(), "quotaExhausted", e.Team, e.Limit, e.Used, e.Resets}, http.StatusTooManyRequests)
+}
+
+// quotaMonth returns the month of t, the key of the usage counters, and the
+// start of the next month.
+func quotaMonth(t time.Time) (string, time.Time) {
+	t = t.UTC()
+	return t.Format("2006-01"), time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// checkQuota reserves a certificate of the monthly quota of the team of the
+// client, checking the limit and counting the certificate in the same
+// transaction, or returns a quotaError if the team has used its quota. The
+// reservation is released with releaseQuota if no certificate is issued.
+func (s *server) checkQuota(clients []string) error {
+	q := s.quotaFor(clients)
+	if q == nil || s.inventory == nil {
+		return nil
+	}
+
+	month, resets := quotaMonth(time.Now())
+	used, ok, err := s.inventory.ReserveUsage(month, q.Team, q.MonthlyLimit)
+	if err != nil {
+		return errs.InternalServerErr(err)
+	}
+	if ok {
+		quotaUsed.WithLabelValues(q.Team).Set(float64(used))
+		return nil
+	}
+
+	quotaExhausted.WithLabelValues(q.Team).Inc()
+	logFor("quotas").WithFields(log.Fields{
+		"client": clients,
+		"team":   q.Team,
+		"limit":  q.MonthlyLimit,
+	}).Warn("Too Many Requests: monthly quota exhausted")
+	return &quotaError{Team: q.Team, Limit: q.MonthlyLimit, Used: used, Resets: resets}
+}
+
+// releaseQuota releases the reservation of checkQuota of a request that did
+// not issue a certificate.
+func (s *server) releaseQuota(clients []string) {
+	s.addQuotaUsage(clients, time.Now(), -1)
+}
+
+// countQuota adds a certificate issued without a quota check, such as a
+// cross-signature, to the usage of the team of the client.
+func (s *server) countQuota(clients []string, t time.Time) {
+	s.addQuotaUsage(clients, t, 1)
+}
+
+func (s *server) addQuotaUsage(clients []string, t time.Time, delta int) {
+	q := s.quotaFor(clients)
+	if q == nil || s.inventory == nil {
+		return
+	}
+
+	month, _ := quotaMonth(t)
+	used, err := s.inventory.AddUsage(month, q.Team, delta)
+	if err != nil {
+		inventoryErrors.Inc()
+		logFor("quotas").WithFields(log.Fields{
+			"team":  q.Team,
+			"error": err,
+		}).Error("Error counting quota usage")
+		return
+	}
+	quotaUsed.WithLabelValues(q.Team).Set(float64(used))
+}
+
+// Usage returns the certificates issued to a team in a month.
+func (inv *inventory) Usage(month, team string) (int, error) {
+	var n uint64
+	err := inv.view(func(tx store.Tx) error {
+		if v := tx.Bucket(usageBucket).Get(usageKey(month, team)); len(v) == 8 {
+			n = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+
+	return int(n), err
+}
+
+// ReserveUsage increments the certificates issued to a team in a month if
+// it is below limit, and returns the new value and true. It returns the
+// current value and false if the limit is reached.
+func (inv *inventory) ReserveUsage(month, team string, limit int) (int, bool, error) {
+	var n uint64
+	var ok bool
+	err := inv.update(func(tx store.Tx) error {
+		b := tx.Bucket(usageBucket)
+		key := usageKey(month, team)
+		n, ok = 0, false
+		if v := b.Get(key); len(v) == 8 {
+			n = binary.BigEndian.Uint64(v)
+		}
+		if n >= uint64(limit) {
+			return nil
+		}
+		n, ok = n+1, true
+		return b.Put(key, binary.BigEndian.AppendUint64(nil, n))
+	})
+
+	return int(n), ok, err
+}
+
+// AddUsage adds delta to the certificates issued to a team in a month, not
+// going below zero, and returns the new value.
+func (inv *inventory) AddUsage(month, team string, delta int) (int, error) {
+	var n int
+	err := inv.update(func(tx store.Tx) error {
+		b := tx.Bucket(usageBucket)
+		key := usageKey(month, team)
+		n = 0
+		if v := b.Get(key); len(v) == 8 {
+			n = int(binary.BigEndian.Uint64(v))
+		}
+		n = max(n+delta, 0)
+		return b.Put(key, binary.BigEndian.AppendUint64(nil, uint64(n)))
+	})
+
+	return n, err
+}
+
+func usageKey(month, team string) []byte {
+	return []byte(month + "\x00" + team)
+}
+
+// quotaUsage is the usage of a team returned by GET /quotas.
+type quotaUsage struct {
+	Team   string    `json:"team"`
+	Month  string    `json:"month"`
+	Limit  int       `json:"limit"`
+	Used   int       `json:"used"`
+	Resets time.Time `json:"resets"`
+}
+
+// listQuotas returns the usage of every team this month.
+func (s *server) listQuotas(w http.ResponseWriter, r *http.Request) {
+	usages := []quotaUsage{}
+	for _, q := range s.config.Quotas {
+		u, err := s.quotaUsage(q)
+		if err != nil {
+			render.Error(w, r, errs.InternalServerErr(err))
+			return
+		}
+		usages = append(usages, u)
+	}
+
+	render.JSON(w, r, usages)
+}
+
+// getQuota returns the usage of a team this month.
+func (s *server) getQuota(w http.ResponseWriter, r *http.Request) {
+	team := r.PathValue("team")
+	for _, q := range s.config.Quotas {
+		if q.Team != team {
+			continue
+		}
+		u, err := s.quotaUsage(q)
+		if err != nil {
+			render.Error(w, r, errs.InternalServerErr(err))
+			return
+		}
+		render.JSON(w, r, u)
+		return
+	}
+
+	render.Error(w, r, errs.NotFound("team %q has no quota", team))
+}
+
+func (s *server) quotaUsage(q QuotaConfig) (quotaUsage, error) {
+	month, resets := quotaMonth(time.Now())
+	used, err := s.inventory.Usage(month, q.Team)
+	if err == nil {
+		quotaUsed.WithLabelValues(q.Team).Set(float64(used))
+	}
+
+	return quotaUsage{Team: q.Team, Month: month, Limit: q.MonthlyLimit, Used: used, Resets: resets}, err
+}
@@ -0,0 +1,67 @@
+package signer
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestReserveUsage(t *testing.T) {
+	inv := newTestInventory(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reserved int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := inv.ReserveUsage("2026-10", "payments", 5)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 5 {
+		t.Fatalf("reserved %d certificates, want the limit of 5", reserved)
+	}
+
+	if n, err := inv.AddUsage("2026-10", "payments", -1); err != nil || n != 4 {
+		t.Fatalf("AddUsage(-1) = %d, %v, want 4", n, err)
+	}
+	if n, ok, err := inv.ReserveUsage("2026-10", "payments", 5); err != nil || !ok || n != 5 {
+		t.Fatalf("ReserveUsage() after a release = %d, %v, %v, want 5, true", n, ok, err)
+	}
+	if n, err := inv.AddUsage("2026-11", "payments", -1); err != nil || n != 0 {
+		t.Fatalf("AddUsage(-1) of an empty month = %d, %v, want 0", n, err)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	s := &server{
+		config:    &Config{Quotas: []QuotaConfig{{Team: "payments", Clients: []string{"pay"}, MonthlyLimit: 1}}},
+		inventory: newTestInventory(t),
+	}
+
+	if err := s.checkQuota([]string{"pay"}); err != nil {
+		t.Fatal(err)
+	}
+	err := s.checkQuota([]string{"pay"})
+	if qe, ok := err.(*quotaError); !ok || qe.Used != 1 {
+		t.Fatalf("checkQuota() = %v, want a quotaError", err)
+	}
+
+	s.releaseQuota([]string{"pay"})
+	if err := s.checkQuota([]string{"pay"}); err != nil {
+		t.Fatalf("checkQuota() after releaseQuota() = %v", err)
+	}
+	if err := s.checkQuota([]string{"other"}); err != nil {
+		t.Fatalf("checkQuota() of a client without quota = %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package signer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// RateLimitConfig limits the number of sign requests per client. The memory
+// backend enforces the limit per replica, the redis backend shares the
+// counters between all the replicas.
+type RateLimitConfig struct {
+	RequestsPerMinute int         `yaml:"requestsPerMinute"`
+	Backend           string      `yaml:"backend"`
+	FailOpen          *bool       `yaml:"failOpen"`
+	Redis             RedisConfig `yaml:"redis"`
+}
+
+// Enabled returns true if a limit is configured.
+func (c RateLimitConfig) Enabled() bool {
+	return c.RequestsPerMinute > 0
+}
+
+// GetFailOpen returns whether requests are allowed when the backend fails,
+// defaults to true.
+func (c RateLimitConfig) GetFailOpen() bool {
+	return c.FailOpen == nil || *c.FailOpen
+}
+
+// Validate checks the backend configuration.
+func (c RateLimitConfig) Validate() error {
+	switch c.Backend {
+	case "", "memory":
+		return nil
+	case "redis":
+		return c.Redis.Validate("rateLimit.redis")
+	default:
+		return errors.Errorf("invalid rateLimit backend %q", c.Backend)
+	}
+}
+
+// rateLimiter counts the requests of a key in fixed one minute windows.
+type rateLimiter interface {
+	// Incr increments the counter of key in the current window and returns
+	// the new value.
+	Incr(ctx context.Context, key string, window time.Time) (int64, error)
+}
+
+// newRateLimiter returns the limiter for the configured backend.
+func newRateLimiter(c RateLimitConfig) rateLimiter {
+	if c.Backend == "redis" {
+		return &redisRateLimiter{client: newRedisClient(c.Redis)}
+	}
+
+	return &memoryRateLimiter{counts: map[string]int64{}}
+}
+
+type memoryRateLimiter struct {
+	mu     sync.Mutex
+	window time.Time
+	counts map[string]int64
+}
+
+func (m *memoryRateLimiter) Incr(_ context.Context, key string, window time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.window.Equal(window) {
+		m.window = window
+		m.counts = map[string]int64{}
+	}
+	m.counts[key]++
+
+	return m.counts[key], nil
+}
+
+type redisRateLimiter struct {
+	client *redis.Client
+}
+
+// Incr increments the counter and sets its expiry in one MULTI/EXEC
+// transaction, so a counter never outlives its window.
+func (r *redisRateLimiter) Incr(ctx context.Context, key string, window time.Time) (int64, error) {
+	k := "ca-signer:ratelimit:" + key + ":" + strconv.FormatInt(window.Unix(), 10)
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, k)
+		pipe.Expire(ctx, k, 2*time.Minute)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "error incrementing redis counter")
+	}
+
+	return incr.Val(), nil
+}
+
+// rateLimit wraps next rejecting the requests of clients over the limit with
+// 429 Too Many Requests.
+func (s *server) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	c := s.config.RateLimit
+	if s.limiter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := rateLimitKey(r)
+		now := time.Now()
+		window := now.Truncate(time.Minute)
+		n, err := s.limiter.Incr(r.Context(), key, window)
+		if err != nil {
+			rateLimiterErrors.Inc()
+			logFor("ratelimit").WithField("error", err).Error("Error checking rate limit")
+			if !c.GetFailOpen() {
+				render.Error(w, r, errs.Wrap(http.StatusServiceUnavailable, err, "error checking rate limit"))
+				return
+			}
+		}
+
+		if n > int64(c.RequestsPerMinute) {
+			rateLimited.Inc()
+			retryAfter := window.Add(time.Minute).Sub(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			logFor("ratelimit").WithField("client", key).Warn("Too Many Requests: client over the rate limit")
+			render.Error(w, r, errs.New(http.StatusTooManyRequests, "rate limit exceeded, retry in %s", retryAfter.Round(time.Second)))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// rateLimitKey returns the first name in the client certificate, or the
+// remote IP if the client did not present one. IPv6 clients are keyed by
+// their /64 network, as a host usually has a whole /64 to pick addresses
+// from.
+func rateLimitKey(r *http.Request) string {
+	if ids := clientIdentities(r); len(ids) > 0 {
+		return ids[0]
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	ip := net.ParseIP(stripZone(host))
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
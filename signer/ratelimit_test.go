@@ -0,0 +1,104 @@
+package signer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{})
+	ctx := context.Background()
+	window := time.Now().Truncate(time.Minute)
+	for want := int64(1); want <= 3; want++ {
+		n, err := l.Incr(ctx, "a", window)
+		if err != nil || n != want {
+			t.Fatalf("Incr() = %d, %v, want %d", n, err, want)
+		}
+	}
+	if n, _ := l.Incr(ctx, "b", window); n != 1 {
+		t.Errorf("Incr(b) = %d, want 1", n)
+	}
+	if n, _ := l.Incr(ctx, "a", window.Add(time.Minute)); n != 1 {
+		t.Errorf("Incr(a) in the next window = %d, want 1", n)
+	}
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newRateLimiter(RateLimitConfig{Backend: "redis", Redis: RedisConfig{Address: mr.Addr()}})
+	ctx := context.Background()
+	window := time.Unix(1700000040, 0)
+	for want := int64(1); want <= 3; want++ {
+		n, err := l.Incr(ctx, "client", window)
+		if err != nil || n != want {
+			t.Fatalf("Incr() = %d, %v, want %d", n, err, want)
+		}
+	}
+
+	key := "ca-signer:ratelimit:client:1700000040"
+	if ttl := mr.TTL(key); ttl <= 0 || ttl > 2*time.Minute {
+		t.Fatalf("TTL(%s) = %v, want the counter to expire", key, ttl)
+	}
+	mr.FastForward(3 * time.Minute)
+	if mr.Exists(key) {
+		t.Fatal("counter did not expire")
+	}
+}
+
+func TestRedisPasswordFile(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("s3cret")
+	file := t.TempDir() + "/password"
+	if err := writeFile(file, "s3cret\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newRedisClient(RedisConfig{Address: mr.Addr(), PasswordFile: file})
+	if err := c.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("Ping() with passwordFile = %v", err)
+	}
+	c = newRedisClient(RedisConfig{Address: mr.Addr(), Password: "wrong"})
+	if err := c.Ping(context.Background()).Err(); err == nil {
+		t.Fatal("Ping() with a wrong password succeeded")
+	}
+}
+
+func TestRedisConfigValidate(t *testing.T) {
+	if err := (RedisConfig{}).Validate("r"); err == nil {
+		t.Error("Validate() without address succeeded")
+	}
+	if err := (RedisConfig{Address: "x:6379", Password: "a", PasswordFile: "b"}).Validate("r"); err == nil {
+		t.Error("Validate() with password and passwordFile succeeded")
+	}
+	if err := (RedisConfig{Address: "x:6379", PasswordFile: "b"}).Validate("r"); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		remote string
+		client string
+		want   string
+	}{
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"[2001:db8:1:2:3:4:5:6]:1234", "", "2001:db8:1:2::/64"},
+		{"[fe80::1%eth0]:1234", "", "fe80::/64"},
+		{"10.0.0.1:1234", "web", "web"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/sign", nil)
+		r.RemoteAddr = tt.remote
+		if tt.client != "" {
+			r = withIdentities(r, tt.client)
+		}
+		if got := rateLimitKey(r); got != tt.want {
+			t.Errorf("%s: rateLimitKey() = %q, want %q", tt.remote, got, tt.want)
+		}
+	}
+}
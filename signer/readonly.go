@@ -0,0 +1,63 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// healthz reports that the signer is up. It does not depend on the upstream
+// so the signer is not restarted during CA outages.
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+// health returns the cached health of the upstream CA.
+func (s *server) health(w http.ResponseWriter, r *http.Request) {
+	s.serveCached(w, r, "health", func(ctx context.Context) (interface{}, error) {
+		return s.upstream(upstreamDefault).HealthWithContext(ctx)
+	})
+}
+
+// roots returns the cached roots of the upstream CA.
+func (s *server) roots(w http.ResponseWriter, r *http.Request) {
+	s.serveCached(w, r, "roots", func(ctx context.Context) (interface{}, error) {
+		return s.upstream(upstreamDefault).RootsWithContext(ctx)
+	})
+}
+
+// provisioners returns the cached list of the upstream provisioners.
+func (s *server) provisioners(w http.ResponseWriter, r *http.Request) {
+	s.serveCached(w, r, "provisioners", func(ctx context.Context) (interface{}, error) {
+		return s.upstream(upstreamDefault).ProvisionersWithContext(ctx)
+	})
+}
+
+// serveCached renders the cached value of key, with its age and cache status
+// in the Age and X-Cache headers.
+func (s *server) serveCached(w http.ResponseWriter, r *http.Request, key string, fetch fetchFunc) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		render.Error(w, r, errs.New(http.StatusMethodNotAllowed, "method not allowed"))
+		return
+	}
+
+	v, fetched, status, err := s.cache.Get(r.Context(), key, fetch)
+	if err != nil {
+		var sc render.StatusCodedError
+		if !errors.As(err, &sc) {
+			err = errs.Wrap(http.StatusBadGateway, err, "error contacting the upstream CA")
+		}
+		render.Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(fetched).Seconds())))
+	w.Header().Set("X-Cache", status)
+	render.JSON(w, r, v)
+}
@@ -0,0 +1,112 @@
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	// sensitiveKey matches the names of fields holding secrets or paths to
+	// secrets.
+	sensitiveKey = regexp.MustCompile(`(?i)(password|secret|token|ott|privatekey|serverkey)`)
+
+	// sensitiveValue matches JWTs, like one-time tokens, and PEM encoded
+	// private keys.
+	sensitiveValue = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*` +
+		`|-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)
+
+	// urlPassword matches the password in the user info of URLs, e.g. of a
+	// proxy.
+	urlPassword = regexp.MustCompile(`(://[^:/@\s]+:)[^@/\s]+@`)
+)
+
+// redactingFormatter removes secrets from the entries before formatting
+// them: fields with sensitive names are replaced, tokens and private keys are
+// removed from messages and values, including errors, and structured values
+// like the config are walked to redact their sensitive fields.
+type redactingFormatter struct {
+	next log.Formatter
+}
+
+func (f *redactingFormatter) Format(e *log.Entry) ([]byte, error) {
+	data := make(log.Fields, len(e.Data))
+	for k, v := range e.Data {
+		if sensitiveKey.MatchString(k) {
+			data[k] = redacted
+			continue
+		}
+		data[k] = redactValue(v)
+	}
+
+	c := *e
+	c.Data = data
+	c.Message = redactString(e.Message)
+	return f.next.Format(&c)
+}
+
+func redactString(s string) string {
+	s = urlPassword.ReplaceAllString(s, "${1}"+redacted+"@")
+	return sensitiveValue.ReplaceAllString(s, redacted)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case string:
+		return redactString(v)
+	case []string:
+		s := make([]string, len(v))
+		for i := range v {
+			s[i] = redactString(v[i])
+		}
+		return s
+	case error:
+		return redactString(v.Error())
+	case fmt.Stringer:
+		return redactString(v.String())
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return redactString(fmt.Sprint(v))
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return redacted
+	}
+
+	return redactGeneric(generic)
+}
+
+// redactGeneric walks a decoded JSON value.
+func redactGeneric(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if sensitiveKey.MatchString(k) {
+				if s, ok := val.(string); ok && s == "" {
+					continue
+				}
+				v[k] = redacted
+				continue
+			}
+			v[k] = redactGeneric(val)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactGeneric(v[i])
+		}
+		return v
+	case string:
+		return redactString(v)
+	default:
+		return v
+	}
+}
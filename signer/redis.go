@@ -0,0 +1,74 @@
+package signer
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisConfig configures the connection to a Redis server. The password can
+// also be read from PasswordFile, re-read on every new connection so it can
+// be rotated, or set with the environment, e.g.
+// CA_SIGNER_RATE_LIMIT_REDIS_PASSWORD.
+type RedisConfig struct {
+	Address      string `yaml:"address"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+	DB           int    `yaml:"db"`
+	TLS          bool   `yaml:"tls"`
+	PoolSize     int    `yaml:"poolSize"`
+}
+
+// GetPoolSize returns the maximum number of idle connections, defaults to 10.
+func (c RedisConfig) GetPoolSize() int {
+	if c.PoolSize > 0 {
+		return c.PoolSize
+	}
+
+	return 10
+}
+
+// Validate checks the address and the password source. prefix is the path
+// of the section in the errors, e.g. "rateLimit.redis".
+func (c RedisConfig) Validate(prefix string) error {
+	if c.Address == "" {
+		return errors.Errorf("%s.address is required with the redis backend", prefix)
+	}
+	if c.Password != "" && c.PasswordFile != "" {
+		return errors.Errorf("%s.password and %s.passwordFile are exclusive", prefix, prefix)
+	}
+
+	return nil
+}
+
+// newRedisClient returns a client of the Redis server. Connections are
+// opened on demand.
+func newRedisClient(c RedisConfig) *redis.Client {
+	opts := &redis.Options{
+		Addr:         c.Address,
+		DB:           c.DB,
+		PoolSize:     c.GetPoolSize(),
+		MaxIdleConns: c.GetPoolSize(),
+	}
+	if c.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	switch {
+	case c.PasswordFile != "":
+		opts.CredentialsProviderContext = func(context.Context) (string, string, error) {
+			b, err := os.ReadFile(c.PasswordFile)
+			if err != nil {
+				return "", "", errors.Wrap(err, "error reading redis passwordFile")
+			}
+			return "", strings.TrimSpace(string(b)), nil
+		}
+	case c.Password != "":
+		opts.Password = c.Password
+	}
+
+	return redis.NewClient(opts)
+}
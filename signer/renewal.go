@@ -0,0 +1,88 @@
+package signer
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+)
+
+// RenewalConfig configures the renewal time suggested to the clients: after
+// Fraction of the lifetime of a certificate, moved earlier by up to Jitter
+// so clients issued together do not renew together.
+type RenewalConfig struct {
+	Fraction float64             `yaml:"fraction"`
+	Jitter   string              `yaml:"jitter"`
+	Stream   RenewalStreamConfig `yaml:"stream"`
+}
+
+// GetFraction returns the fraction of the lifetime after which clients
+// should renew, defaults to 2/3.
+func (c RenewalConfig) GetFraction() float64 {
+	if c.Fraction > 0 {
+		return c.Fraction
+	}
+
+	return 2.0 / 3
+}
+
+// GetJitter returns the maximum jitter of the renewal time, defaults to none.
+func (c RenewalConfig) GetJitter() time.Duration {
+	if d, err := time.ParseDuration(c.Jitter); err == nil {
+		return d
+	}
+
+	return 0
+}
+
+// Validate checks the fraction.
+func (c RenewalConfig) Validate() error {
+	if c.Fraction < 0 || c.Fraction >= 1 {
+		return errors.Errorf("invalid renewal fraction %v: must be between 0 and 1", c.Fraction)
+	}
+
+	return nil
+}
+
+// renewAfter returns the time after which the certificate should be renewed.
+// The jitter is derived from the fingerprint, so the time is the same every
+// time the certificate is returned, and capped to a quarter of the time left
+// after the renewal time.
+func (c RenewalConfig) renewAfter(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	t := cert.NotBefore.Add(time.Duration(float64(lifetime) * c.GetFraction()))
+
+	jitter := min(c.GetJitter(), cert.NotAfter.Sub(t)/4)
+	if jitter > 0 {
+		sum := sha256.Sum256(cert.Raw)
+		n := binary.BigEndian.Uint64(sum[:8])
+		t = t.Add(-time.Duration(n % uint64(jitter)))
+	}
+
+	return t.UTC().Truncate(time.Second)
+}
+
+// renewableResponse is a sign response with the suggested renewal time and
+// the SCTs of the certificate in ct sync mode.
+type renewableResponse struct {
+	*api.SignResponse
+	RenewAfter time.Time                    `json:"renewAfter"`
+	SCTs       []signedCertificateTimestamp `json:"scts,omitempty"`
+	Secondary  *api.SignResponse            `json:"secondary,omitempty"`
+}
+
+// setCertificateHeaders sets the decimal serial number and the SHA-256
+// fingerprint of the issued certificate in X-Certificate-Serial and
+// X-Certificate-Fingerprint, and the suggested renewal time in
+// X-Renew-After.
+func (s *server) setCertificateHeaders(w http.ResponseWriter, resp *api.SignResponse) {
+	if cert := resp.ServerPEM.Certificate; cert != nil {
+		w.Header().Set("X-Certificate-Serial", cert.SerialNumber.String())
+		w.Header().Set("X-Certificate-Fingerprint", certificateFingerprint(cert))
+		w.Header().Set("X-Renew-After", s.config.Renewal.renewAfter(cert).Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,54 @@
+package signer
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestRenewalConfigValidate(t *testing.T) {
+	tests := []struct {
+		fraction float64
+		ok       bool
+	}{
+		{0, true},
+		{0.5, true},
+		{-0.1, false},
+		{1, false},
+	}
+	for _, tt := range tests {
+		if err := (RenewalConfig{Fraction: tt.fraction}).Validate(); (err == nil) != tt.ok {
+			t.Errorf("%v: Validate() = %v, want ok %v", tt.fraction, err, tt.ok)
+		}
+	}
+}
+
+func TestRenewAfter(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{Raw: []byte("certificate"), NotBefore: notBefore, NotAfter: notBefore.Add(90 * time.Hour)}
+
+	if got, want := (RenewalConfig{}).renewAfter(cert), notBefore.Add(60*time.Hour); !got.Equal(want) {
+		t.Errorf("renewAfter() = %v, want %v", got, want)
+	}
+	if got, want := (RenewalConfig{Fraction: 0.5}).renewAfter(cert), notBefore.Add(45*time.Hour); !got.Equal(want) {
+		t.Errorf("renewAfter() with fraction 0.5 = %v, want %v", got, want)
+	}
+
+	c := RenewalConfig{Jitter: "4h"}
+	got := c.renewAfter(cert)
+	if start, end := notBefore.Add(56*time.Hour), notBefore.Add(60*time.Hour); got.Before(start) || got.After(end) {
+		t.Errorf("renewAfter() with jitter = %v, want between %v and %v", got, start, end)
+	}
+	if again := c.renewAfter(cert); !again.Equal(got) {
+		t.Errorf("renewAfter() = %v, then %v, want the same time", got, again)
+	}
+	if got.Truncate(time.Second) != got || got.Location() != time.UTC {
+		t.Errorf("renewAfter() = %v, want whole seconds in UTC", got)
+	}
+
+	// The jitter is capped to a quarter of the 30h left after 60h.
+	got = RenewalConfig{Jitter: "100h"}.renewAfter(cert)
+	if start := notBefore.Add(60*time.Hour - 30*time.Hour/4); got.Before(start) {
+		t.Errorf("renewAfter() with a large jitter = %v, want after %v", got, start)
+	}
+}
@@ -0,0 +1,264 @@
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// RenewalStreamConfig configures GET /renewals/stream, where clients hold a
+// Server-Sent Events connection to receive renewal notices.
+type RenewalStreamConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Heartbeat  string `yaml:"heartbeat"`
+	MaxClients int    `yaml:"maxClients"`
+}
+
+// GetHeartbeat returns the interval of the keep-alive comments, defaults to
+// 30s.
+func (c RenewalStreamConfig) GetHeartbeat() time.Duration {
+	if d, err := time.ParseDuration(c.Heartbeat); err == nil && d > 0 {
+		return d
+	}
+
+	return 30 * time.Second
+}
+
+// GetMaxClients returns the maximum number of open streams, defaults to
+// 10000.
+func (c RenewalStreamConfig) GetMaxClients() int {
+	if c.MaxClients > 0 {
+		return c.MaxClients
+	}
+
+	return 10000
+}
+
+// renewalNotice asks the clients receiving it to renew their certificates.
+type renewalNotice struct {
+	Time     time.Time  `json:"time"`
+	Reason   string     `json:"reason"`
+	Serials  []string   `json:"serials,omitempty"`
+	Campaign string     `json:"campaign,omitempty"`
+	RotateBy *time.Time `json:"rotateBy,omitempty"`
+}
+
+// renewalBuffer is the number of notices queued per stream.
+const renewalBuffer = 8
+
+// renewalSubscriber is an open stream, with the identities of its client and
+// the serial numbers it declared holding.
+type renewalSubscriber struct {
+	clients []string
+	serials []string
+	ch      chan renewalNotice
+}
+
+// renewalHub delivers the renewal notices to the open streams. Streams are
+// kept in memory, so a notice only reaches the clients connected to the
+// replica sending it.
+type renewalHub struct {
+	mu   sync.Mutex
+	max  int
+	subs map[*renewalSubscriber]struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newRenewalHub(c RenewalStreamConfig) *renewalHub {
+	return &renewalHub{max: c.GetMaxClients(), subs: map[*renewalSubscriber]struct{}{}, done: make(chan struct{})}
+}
+
+// closeStreams ends the open streams on shutdown, so the clients reconnect
+// to another replica, or to the new process of an upgrade, instead of
+// holding the shutdown.
+func (h *renewalHub) closeStreams() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+func (h *renewalHub) subscribe(clients, serials []string) (*renewalSubscriber, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subs) >= h.max {
+		return nil, false
+	}
+	sub := &renewalSubscriber{clients: clients, serials: serials, ch: make(chan renewalNotice, renewalBuffer)}
+	h.subs[sub] = struct{}{}
+	renewalStreams.Set(float64(len(h.subs)))
+
+	return sub, true
+}
+
+func (h *renewalHub) unsubscribe(sub *renewalSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subs, sub)
+	renewalStreams.Set(float64(len(h.subs)))
+}
+
+// notify sends the notice to the streams matching fn and returns how many
+// received it. Streams too slow to take it are skipped.
+func (h *renewalHub) notify(fn func(*renewalSubscriber) bool, n renewalNotice) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var delivered int
+	for sub := range h.subs {
+		if !fn(sub) {
+			continue
+		}
+		select {
+		case sub.ch <- n:
+			delivered++
+			renewalNotices.WithLabelValues("delivered").Inc()
+		default:
+			renewalNotices.WithLabelValues("dropped").Inc()
+		}
+	}
+
+	return delivered
+}
+
+// renewalStream holds a Server-Sent Events stream for the client. Notices
+// are sent as "renew" events with the renewalNotice JSON as data. The
+// optional serial query parameters declare the certificates the client
+// holds, so notices targeting them reach it.
+func (s *server) renewalStream(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	clients := clientIdentities(r)
+	sub, ok := s.renewals.subscribe(clients, normalizeSerials(r.URL.Query()["serial"]))
+	if !ok {
+		w.Header().Set("Retry-After", "60")
+		render.Error(w, r, errs.New(http.StatusServiceUnavailable, "too many renewal streams"))
+		return
+	}
+	defer s.renewals.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	logFor("server").WithField("client", clients).Debug("Opened renewal stream")
+
+	for _, n := range s.campaignNotices(sub.serials) {
+		sub.ch <- n
+	}
+
+	heartbeat := time.NewTicker(s.config.Renewal.Stream.GetHeartbeat())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.renewals.done:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case n := <-sub.ch:
+			data, _ := json.Marshal(n)
+			fmt.Fprintf(w, "event: renew\ndata: %s\n\n", data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// campaignNotices returns the notices of the rotation campaigns targeting
+// the declared serials, so clients connecting after a campaign started also
+// learn about it. A client still declaring a serial has not rotated it.
+func (s *server) campaignNotices(serials []string) []renewalNotice {
+	if s.inventory == nil || len(serials) == 0 {
+		return nil
+	}
+	campaigns, err := s.inventory.Campaigns()
+	if err != nil {
+		logFor("server").WithField("error", err).Error("Error reading rotation campaigns")
+		return nil
+	}
+
+	var notices []renewalNotice
+	for _, c := range campaigns {
+		var targeted []string
+		for _, serial := range serials {
+			if policy.ContainsAny(c.Serials, []string{serial}) {
+				targeted = append(targeted, serial)
+			}
+		}
+		if len(targeted) > 0 && len(notices) < renewalBuffer {
+			n := c.notice()
+			n.Serials = targeted
+			notices = append(notices, n)
+		}
+	}
+
+	return notices
+}
+
+// normalizeSerials returns the decimal form of the valid serial numbers.
+func normalizeSerials(serials []string) []string {
+	var out []string
+	for _, serial := range serials {
+		if n, ok := normalizeSerial(serial); ok {
+			out = append(out, n)
+		}
+	}
+
+	return out
+}
+
+// RenewalPushRequest is the body of POST /admin/renewals. Notices go to the
+// streams of the listed clients or declaring the listed serials, or to all
+// streams with all.
+type RenewalPushRequest struct {
+	Clients []string `json:"clients"`
+	Serials []string `json:"serials"`
+	All     bool     `json:"all"`
+	Reason  string   `json:"reason"`
+}
+
+// pushRenewal sends a renewal notice to the matching streams of this
+// replica.
+func (s *server) pushRenewal(w http.ResponseWriter, r *http.Request) {
+	var body RenewalPushRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+	if !body.All && len(body.Clients) == 0 && len(body.Serials) == 0 {
+		render.Error(w, r, errs.BadRequest("clients, serials or all is required"))
+		return
+	}
+	if body.Reason == "" {
+		body.Reason = "requested by an administrator"
+	}
+
+	serials := normalizeSerials(body.Serials)
+	delivered := s.renewals.notify(func(sub *renewalSubscriber) bool {
+		return body.All || policy.ContainsAny(body.Clients, sub.clients) || policy.ContainsAny(serials, sub.serials)
+	}, renewalNotice{Time: time.Now().UTC(), Reason: body.Reason, Serials: serials})
+
+	logFor("admin").WithFields(log.Fields{
+		"client":    clientIdentities(r),
+		"clients":   body.Clients,
+		"serials":   serials,
+		"all":       body.All,
+		"reason":    body.Reason,
+		"delivered": delivered,
+	}).Warn("Pushed renewal notice")
+	render.JSON(w, r, map[string]int{"delivered": delivered})
+}
@@ -0,0 +1,107 @@
+package signer
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+func TestRenewalHub(t *testing.T) {
+	h := newRenewalHub(RenewalStreamConfig{MaxClients: 2})
+	web, ok := h.subscribe([]string{"web"}, []string{"10"})
+	if !ok {
+		t.Fatal("subscribe() = false, want a stream")
+	}
+	api, _ := h.subscribe([]string{"api"}, nil)
+	if _, ok := h.subscribe([]string{"db"}, nil); ok {
+		t.Error("subscribe() over the maximum = true, want false")
+	}
+
+	n := renewalNotice{Reason: "test"}
+	if got := h.notify(func(sub *renewalSubscriber) bool { return policy.ContainsAny(sub.serials, []string{"10"}) }, n); got != 1 || len(web.ch) != 1 || len(api.ch) != 0 {
+		t.Errorf("notify() of a serial = %d, queued %d and %d, want only the web stream", got, len(web.ch), len(api.ch))
+	}
+	for range renewalBuffer {
+		h.notify(func(*renewalSubscriber) bool { return true }, n)
+	}
+	if got := h.notify(func(*renewalSubscriber) bool { return true }, n); got != 0 {
+		t.Errorf("notify() of full streams = %d, want 0", got)
+	}
+
+	h.unsubscribe(web)
+	if _, ok := h.subscribe([]string{"db"}, nil); !ok {
+		t.Error("subscribe() after unsubscribe() = false, want a stream")
+	}
+}
+
+func TestRenewalStream(t *testing.T) {
+	s := &server{config: &Config{}, renewals: newRenewalHub(RenewalStreamConfig{})}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.renewalStream(w, withIdentities(r, "web"))
+	}))
+	defer srv.Close()
+	defer s.renewals.closeStreams()
+
+	resp, err := http.Get(srv.URL + "?serial=0x1f&serial=invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("renewalStream() = %d %s, want an event stream", resp.StatusCode, ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	if line, _ := events.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("first line = %q, want the connected comment", line)
+	}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"reason":"nothing"}`, http.StatusBadRequest},
+		{`{`, http.StatusBadRequest},
+		{`{"clients":["api"]}`, http.StatusOK},
+		{`{"serials":["31"],"reason":"key compromise"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.pushRenewal(w, withIdentities(httptest.NewRequest(http.MethodPost, "/admin/renewals", strings.NewReader(tt.body)), "admin"))
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.body, w.Code, tt.status, w.Body)
+		}
+	}
+
+	done := make(chan string)
+	go func() {
+		var data string
+		for data == "" {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				break
+			}
+			if d, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+				data = d
+			}
+		}
+		done <- data
+	}()
+	select {
+	case data := <-done:
+		var n renewalNotice
+		if err := json.Unmarshal([]byte(data), &n); err != nil {
+			t.Fatalf("event data %q: %v", data, err)
+		}
+		if n.Reason != "key compromise" || !sameStrings(n.Serials, []string{"31"}) {
+			t.Errorf("notice = %+v, want the one of serial 31", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no renewal notice received")
+	}
+}
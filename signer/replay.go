@@ -0,0 +1,412 @@
+package signer
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+	"go.step.sm/crypto/jose"
+)
+
+// replayNonceHeader is the header of the nonces issued by the signer.
+const replayNonceHeader = "Replay-Nonce"
+
+// errTooManyNonces is returned when a client is over noncesPerMinute.
+var errTooManyNonces = errors.New("too many nonces requested, retry in a minute")
+
+// ReplayConfig protects the endpoints called with bearer tokens from
+// replayed requests. Like ACME, the body of these requests must be a JWS
+// signed with a key registered for the client (ES256 or EdDSA), identified
+// by its JWK thumbprint in the kid, whose protected header has a nonce
+// issued by the signer, used once, and the URL of the request. Requests
+// with a client certificate are not affected. The memory backend keeps the
+// nonces per replica, the redis backend shares them between all the
+// replicas.
+type ReplayConfig struct {
+	Endpoints       []string          `yaml:"endpoints"`
+	Keys            []ReplayKeyConfig `yaml:"keys"`
+	NonceTTL        string            `yaml:"nonceTTL"`
+	MaxNonces       int               `yaml:"maxNonces"`
+	NoncesPerMinute int               `yaml:"noncesPerMinute"`
+	Backend         string            `yaml:"backend"`
+	Redis           RedisConfig       `yaml:"redis"`
+}
+
+// ReplayKeyConfig is the public key, in a PEM or JWK file, signing the
+// requests of a client identity.
+type ReplayKeyConfig struct {
+	Client  string `yaml:"client"`
+	KeyFile string `yaml:"keyFile"`
+}
+
+// Enabled returns true if some endpoints are protected.
+func (c ReplayConfig) Enabled() bool {
+	return len(c.Endpoints) > 0
+}
+
+// GetNonceTTL returns how long a nonce can be used, defaults to 5m.
+func (c ReplayConfig) GetNonceTTL() time.Duration {
+	if d, err := time.ParseDuration(c.NonceTTL); err == nil {
+		return d
+	}
+
+	return 5 * time.Minute
+}
+
+// GetMaxNonces returns the number of unused nonces kept by the memory
+// backend, defaults to 100000.
+func (c ReplayConfig) GetMaxNonces() int {
+	if c.MaxNonces > 0 {
+		return c.MaxNonces
+	}
+
+	return 100000
+}
+
+// GetNoncesPerMinute returns the number of nonces issued to a client per
+// minute, defaults to 60.
+func (c ReplayConfig) GetNoncesPerMinute() int {
+	if c.NoncesPerMinute > 0 {
+		return c.NoncesPerMinute
+	}
+
+	return 60
+}
+
+// Validate checks the endpoints, the keys and the backend.
+func (c ReplayConfig) Validate() error {
+	for _, p := range c.Endpoints {
+		if !strings.HasPrefix(p, "/") {
+			return errors.Errorf("invalid authn.replay endpoint %q", p)
+		}
+	}
+	if c.Enabled() && len(c.Keys) == 0 {
+		return errors.New("authn.replay requires the keys of the clients")
+	}
+	for _, k := range c.Keys {
+		if k.Client == "" || k.KeyFile == "" {
+			return errors.New("authn.replay keys require a client and a keyFile")
+		}
+	}
+	if c.NonceTTL != "" {
+		if d, err := time.ParseDuration(c.NonceTTL); err != nil || d <= 0 {
+			return errors.Errorf("invalid authn.replay nonceTTL %q", c.NonceTTL)
+		}
+	}
+	if c.MaxNonces < 0 {
+		return errors.Errorf("invalid authn.replay maxNonces %d", c.MaxNonces)
+	}
+	if c.NoncesPerMinute < 0 {
+		return errors.Errorf("invalid authn.replay noncesPerMinute %d", c.NoncesPerMinute)
+	}
+	switch c.Backend {
+	case "", "memory":
+	case "redis":
+		if err := c.Redis.Validate("authn.replay.redis"); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("invalid authn.replay backend %q", c.Backend)
+	}
+
+	return nil
+}
+
+// protects returns true if the endpoint at path is protected.
+func (c ReplayConfig) protects(path string) bool {
+	for _, p := range c.Endpoints {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replayKey is the public key of a client signing its requests.
+type replayKey struct {
+	client    string
+	algorithm string
+	key       crypto.PublicKey
+}
+
+// loadReplayKeys reads the keys of the clients, by JWK thumbprint.
+func loadReplayKeys(c ReplayConfig) (map[string]replayKey, error) {
+	keys := map[string]replayKey{}
+	for _, k := range c.Keys {
+		jwk, err := jose.ReadKey(k.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading the replay key of %s", k.Client)
+		}
+		if !jwk.IsPublic() {
+			return nil, errors.Errorf("replay key of %s must be a public key", k.Client)
+		}
+		var alg string
+		switch pub := jwk.Key.(type) {
+		case *ecdsa.PublicKey:
+			if pub.Curve == elliptic.P256() {
+				alg = jose.ES256
+			}
+		case ed25519.PublicKey:
+			alg = jose.EdDSA
+		}
+		if alg == "" {
+			return nil, errors.Errorf("replay key of %s must be a P-256 or Ed25519 key", k.Client)
+		}
+		kid, err := jose.Thumbprint(jwk)
+		if err != nil {
+			return nil, err
+		}
+		keys[kid] = replayKey{client: k.Client, algorithm: alg, key: jwk.Key}
+	}
+
+	return keys, nil
+}
+
+// nonceStore keeps the issued nonces until they are used or expire.
+type nonceStore interface {
+	// Add stores a nonce for ttl.
+	Add(ctx context.Context, nonce string, ttl time.Duration) error
+	// Consume removes a nonce and returns true if it was stored.
+	Consume(ctx context.Context, nonce string) (bool, error)
+}
+
+// newNonceStore returns the store for the configured backend.
+func newNonceStore(c ReplayConfig) nonceStore {
+	if c.Backend == "redis" {
+		return &redisNonceStore{client: newRedisClient(c.Redis)}
+	}
+
+	return newMemoryNonceStore(c.GetMaxNonces())
+}
+
+// memoryNonceStore keeps up to max nonces in the order they were issued,
+// evicting the oldest ones first: expired nonces, then the oldest unused
+// nonces when it is full.
+type memoryNonceStore struct {
+	mu     sync.Mutex
+	max    int
+	order  *list.List
+	nonces map[string]*list.Element
+}
+
+type issuedNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+func newMemoryNonceStore(max int) *memoryNonceStore {
+	return &memoryNonceStore{max: max, order: list.New(), nonces: map[string]*list.Element{}}
+}
+
+func (m *memoryNonceStore) Add(_ context.Context, nonce string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for e := m.order.Front(); e != nil; e = m.order.Front() {
+		if m.order.Len() < m.max && now.Before(e.Value.(*issuedNonce).expires) {
+			break
+		}
+		m.remove(e)
+	}
+	m.nonces[nonce] = m.order.PushBack(&issuedNonce{nonce: nonce, expires: now.Add(ttl)})
+
+	return nil
+}
+
+func (m *memoryNonceStore) Consume(_ context.Context, nonce string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.nonces[nonce]
+	if !ok {
+		return false, nil
+	}
+	m.remove(e)
+
+	return time.Now().Before(e.Value.(*issuedNonce).expires), nil
+}
+
+func (m *memoryNonceStore) remove(e *list.Element) {
+	m.order.Remove(e)
+	delete(m.nonces, e.Value.(*issuedNonce).nonce)
+}
+
+type redisNonceStore struct {
+	client *redis.Client
+}
+
+func (r *redisNonceStore) Add(ctx context.Context, nonce string, ttl time.Duration) error {
+	return r.client.Set(ctx, "ca-signer:nonce:"+nonce, "1", ttl).Err()
+}
+
+func (r *redisNonceStore) Consume(ctx context.Context, nonce string) (bool, error) {
+	n, err := r.client.Del(ctx, "ca-signer:nonce:"+nonce).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// newNonce issues a nonce to the client of r, up to noncesPerMinute.
+func (s *server) newNonce(r *http.Request) (string, error) {
+	c := s.config.Authn.Replay
+	n, err := s.nonceLimiter.Incr(r.Context(), "nonce:"+rateLimitKey(r), time.Now().Truncate(time.Minute))
+	if err != nil {
+		return "", errors.Wrap(err, "error checking nonce rate limit")
+	}
+	if n > int64(c.GetNoncesPerMinute()) {
+		return "", errTooManyNonces
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	if err := s.nonces.Add(r.Context(), nonce, c.GetNonceTTL()); err != nil {
+		return "", errors.Wrap(err, "error storing nonce")
+	}
+
+	return nonce, nil
+}
+
+// getNonce returns a new nonce in the Replay-Nonce header.
+func (s *server) getNonce(w http.ResponseWriter, r *http.Request) {
+	nonce, err := s.newNonce(r)
+	if errors.Is(err, errTooManyNonces) {
+		render.Error(w, r, errs.New(http.StatusTooManyRequests, "%s", err))
+		return
+	}
+	if err != nil {
+		render.Error(w, r, errs.Wrap(http.StatusServiceUnavailable, err, "error issuing nonce"))
+		return
+	}
+	w.Header().Set(replayNonceHeader, nonce)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replayProtect wraps next requiring a signed body with a fresh nonce on
+// the protected endpoints called with a bearer token. The payload of the
+// JWS replaces the body. Every response of these endpoints has a new nonce,
+// so clients do not need to fetch one for their next request.
+func (s *server) replayProtect(next http.Handler) http.Handler {
+	c := s.config.Authn.Replay
+	if s.nonces == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hasToken := strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+		hasCert := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+		if !hasToken || hasCert || r.Method != http.MethodPost || !c.protects(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if nonce, err := s.newNonce(r); err == nil {
+			w.Header().Set(replayNonceHeader, nonce)
+		}
+		signed, reason, err := s.verifySignedRequest(r)
+		if err != nil {
+			replayRejections.WithLabelValues(reason).Inc()
+			logFor("server").WithFields(log.Fields{
+				"path":   r.URL.Path,
+				"reason": reason,
+				"remote": r.RemoteAddr,
+				"error":  err,
+			}).Warn("Rejected unsigned or replayed request")
+			if _, ok := err.(*errs.Error); !ok {
+				err = errs.BadRequestErr(err, "%s", err)
+			}
+			render.Error(w, r, err)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		r.Body = io.NopCloser(bytes.NewReader(signed.payload))
+		r.ContentLength = int64(len(signed.payload))
+		r.Header.Del("Content-Type")
+		if signed.contentType != "" {
+			r.Header.Set("Content-Type", signed.contentType)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signedBody is the payload of a signed request, with the content type in
+// the cty header of the JWS.
+type signedBody struct {
+	payload     []byte
+	contentType string
+}
+
+// verifySignedRequest returns the payload of the JWS in the body of r,
+// signed by a key of the client of r, or the reason of the rejection,
+// "malformed", "signature", "url" or "nonce", and the error.
+func (s *server) verifySignedRequest(r *http.Request) (*signedBody, string, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 2*maxSignRequestSize))
+	if err != nil {
+		return nil, "malformed", errs.BadRequestErr(err, "error reading request body")
+	}
+	jws, err := jose.ParseJWS(string(body))
+	if err != nil || len(jws.Signatures) != 1 {
+		return nil, "malformed", errors.New("body must be a JWS with a single signature")
+	}
+	header := jws.Signatures[0].Protected
+	if header.KeyID == "" || header.JSONWebKey != nil {
+		return nil, "malformed", errors.New("JWS must identify its key by kid")
+	}
+	key, ok := s.replayKeys[header.KeyID]
+	if !ok || !slices.Contains(clientIdentities(r), key.client) {
+		return nil, "signature", errors.Errorf("JWS kid %q is not a key of the client", header.KeyID)
+	}
+	if header.Algorithm != key.algorithm {
+		return nil, "malformed", errors.Errorf("unsupported JWS algorithm %q, the key requires %s", header.Algorithm, key.algorithm)
+	}
+	payload, err := jws.Verify(key.key)
+	if err != nil {
+		return nil, "signature", errors.New("invalid JWS signature")
+	}
+
+	u, _ := header.ExtraHeaders["url"].(string)
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Path != r.URL.Path && parsed.Path != "/v"+strconv.Itoa(apiVersion(r))+r.URL.Path) {
+		return nil, "url", errors.Errorf("JWS url %q does not match the request", u)
+	}
+	if header.Nonce == "" {
+		return nil, "nonce", errors.New("missing JWS nonce")
+	}
+	ok, err = s.nonces.Consume(r.Context(), header.Nonce)
+	if err != nil {
+		return nil, "nonce", errs.Wrap(http.StatusServiceUnavailable, err, "error checking nonce")
+	}
+	if !ok {
+		return nil, "nonce", errors.New("invalid, expired or used nonce")
+	}
+	cty, _ := header.ExtraHeaders["cty"].(string)
+
+	return &signedBody{payload: payload, contentType: cty}, "", nil
+}
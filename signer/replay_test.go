@@ -0,0 +1,210 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.step.sm/crypto/jose"
+)
+
+// writeTestPublicKey writes the public key of key to a PEM file.
+func writeTestPublicKey(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "key.pub")
+	if err := writeFile(name, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+// signTestRequest returns a JWS of payload signed by key, with the kid of
+// key, the nonce and the url.
+func signTestRequest(t *testing.T, alg string, key crypto.Signer, nonce, url, payload string) string {
+	t.Helper()
+	kid, err := jose.Thumbprint(&jose.JSONWebKey{Key: key.Public()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := (&jose.SignerOptions{}).WithHeader("kid", kid).WithHeader("nonce", nonce).WithHeader("url", url)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(alg), Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jws.FullSerialize()
+}
+
+func TestReplayProtect(t *testing.T) {
+	ciKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, opsKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Authn: AuthnConfig{Replay: ReplayConfig{
+		Endpoints: []string{"/sign"},
+		Keys: []ReplayKeyConfig{
+			{Client: "ci", KeyFile: writeTestPublicKey(t, ciKey)},
+			{Client: "ops", KeyFile: writeTestPublicKey(t, opsKey)},
+		},
+	}}}
+	s, err := newServer(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.nonces = newNonceStore(config.Authn.Replay)
+	s.nonceLimiter = newRateLimiter(RateLimitConfig{})
+	handler := s.replayProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	nonce := func() string {
+		n, err := s.newNonce(httptest.NewRequest(http.MethodGet, "/nonce", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	post := func(client, body string) *httptest.ResponseRecorder {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", strings.NewReader(body)), client)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	used := nonce()
+	if w := post("ci", signTestRequest(t, "ES256", ciKey, used, "https://signer.example.com/sign", "payload")); w.Code != http.StatusOK || w.Body.String() != "payload" || w.Header().Get(replayNonceHeader) == "" {
+		t.Fatalf("signed request = %d %q", w.Code, w.Body)
+	}
+	if w := post("ops", signTestRequest(t, "EdDSA", opsKey, nonce(), "https://signer.example.com/v1/sign", "payload")); w.Code != http.StatusOK {
+		t.Fatalf("EdDSA signed request = %d %q", w.Code, w.Body)
+	}
+
+	hmac := func() string {
+		opts := (&jose.SignerOptions{}).WithHeader("kid", "ci").WithHeader("nonce", nonce()).WithHeader("url", "/sign")
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("token")}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign([]byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jws.FullSerialize()
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		client string
+		body   string
+	}{
+		{"unsigned", "ci", "payload"},
+		{"replayed", "ci", signTestRequest(t, "ES256", ciKey, used, "/sign", "payload")},
+		{"HS256 with the token", "ci", hmac()},
+		{"key of another client", "ops", signTestRequest(t, "ES256", ciKey, nonce(), "/sign", "payload")},
+		{"unknown key", "ci", signTestRequest(t, "ES256", other, nonce(), "/sign", "payload")},
+		{"other url", "ci", signTestRequest(t, "ES256", ciKey, nonce(), "/sign/raw", "payload")},
+	}
+	for _, tt := range tests {
+		if w := post(tt.client, tt.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMemoryNonceStoreMaxNonces(t *testing.T) {
+	ctx := context.Background()
+	m := newMemoryNonceStore(3)
+	for i := range 5 {
+		if err := m.Add(ctx, strconv.Itoa(i), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.nonces) != 3 || m.order.Len() != 3 {
+		t.Fatalf("store holds %d nonces, want 3", len(m.nonces))
+	}
+	for i, want := range []bool{false, false, true, true, true} {
+		if ok, _ := m.Consume(ctx, strconv.Itoa(i)); ok != want {
+			t.Errorf("Consume(%d) = %v, want %v", i, ok, want)
+		}
+	}
+
+	// Expired nonces are dropped when the next one is added.
+	m.Add(ctx, "expired", -time.Second)
+	if ok, _ := m.Consume(ctx, "expired"); ok {
+		t.Error("Consume() of an expired nonce = true")
+	}
+	m.Add(ctx, "expired", -time.Second)
+	m.Add(ctx, "fresh", time.Minute)
+	if _, ok := m.nonces["expired"]; ok || len(m.nonces) != 1 {
+		t.Errorf("store holds %d nonces, want the fresh one", len(m.nonces))
+	}
+}
+
+func TestNewNonceRateLimit(t *testing.T) {
+	s := &server{
+		config:       &Config{Authn: AuthnConfig{Replay: ReplayConfig{NoncesPerMinute: 2}}},
+		nonces:       newMemoryNonceStore(10),
+		nonceLimiter: newRateLimiter(RateLimitConfig{}),
+	}
+	get := func(client string) int {
+		w := httptest.NewRecorder()
+		s.getNonce(w, withIdentities(httptest.NewRequest(http.MethodGet, "/nonce", nil), client))
+		return w.Code
+	}
+	for i, want := range []int{http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests} {
+		if got := get("ci"); got != want {
+			t.Errorf("GET /nonce %d = %d, want %d", i, got, want)
+		}
+	}
+	if got := get("ops"); got != http.StatusNoContent {
+		t.Errorf("GET /nonce of another client = %d, want %d", got, http.StatusNoContent)
+	}
+}
+
+func TestReplayConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ReplayConfig
+		ok     bool
+	}{
+		{"disabled", ReplayConfig{}, true},
+		{"keys", ReplayConfig{Endpoints: []string{"/sign"}, Keys: []ReplayKeyConfig{{Client: "ci", KeyFile: "ci.pub"}}}, true},
+		{"no keys", ReplayConfig{Endpoints: []string{"/sign"}}, false},
+		{"no client", ReplayConfig{Endpoints: []string{"/sign"}, Keys: []ReplayKeyConfig{{KeyFile: "ci.pub"}}}, false},
+		{"maxNonces", ReplayConfig{MaxNonces: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package signer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// RetentionConfig deletes the inventory records some time after the
+// certificates expire. Deleted records can be exported to an object store
+// first, and the file compacted afterwards.
+type RetentionConfig struct {
+	KeepAfterExpiry string             `yaml:"keepAfterExpiry"`
+	Interval        string             `yaml:"interval"`
+	Compact         bool               `yaml:"compact"`
+	Export          *ObjectStoreConfig `yaml:"export"`
+}
+
+// Enabled returns true if a retention is configured.
+func (c RetentionConfig) Enabled() bool {
+	return c.KeepAfterExpiry != ""
+}
+
+// GetKeepAfterExpiry returns how long records are kept after the
+// certificates expire.
+func (c RetentionConfig) GetKeepAfterExpiry() time.Duration {
+	d, _ := time.ParseDuration(c.KeepAfterExpiry)
+	return d
+}
+
+// GetInterval returns how often the retention runs, defaults to 24h if not
+// specified or invalid.
+func (c RetentionConfig) GetInterval() time.Duration {
+	if d, err := time.ParseDuration(c.Interval); err == nil && d > 0 {
+		return d
+	}
+
+	return 24 * time.Hour
+}
+
+// Validate checks the durations and the export store.
+func (c RetentionConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if d, err := time.ParseDuration(c.KeepAfterExpiry); err != nil || d < 0 {
+		return errors.Errorf("invalid inventory retention keepAfterExpiry %q", c.KeepAfterExpiry)
+	}
+	if c.Interval != "" {
+		if d, err := time.ParseDuration(c.Interval); err != nil || d <= 0 {
+			return errors.Errorf("invalid inventory retention interval %q", c.Interval)
+		}
+	}
+	if c.Export != nil {
+		return c.Export.Validate()
+	}
+
+	return nil
+}
+
+// Validate checks the store, the encryption, the retention and the export
+// of the inventory.
+func (c InventoryConfig) Validate() error {
+	if c.Path != "" && c.Postgres.Enabled() {
+		return errors.New("inventory path and postgres cannot both be set")
+	}
+	if err := c.Encryption.Validate(); err != nil {
+		return err
+	}
+	if c.Export != nil {
+		if err := c.Export.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return c.Retention.Validate()
+}
+
+// errScanDone stops a ForEach once enough keys were read.
+var errScanDone = errors.New("scan done")
+
+// Expired returns the records of the certificates that expired before t
+// with a serial after the cursor, at most limit of them. next is the cursor
+// of the following page, empty once the bucket was read to the end.
+func (inv *inventory) Expired(t time.Time, cursor string, limit int) (recs []certificateRecord, next string, err error) {
+	err = inv.view(func(tx store.Tx) error {
+		return tx.Bucket(certificatesBucket).ForEachAfter([]byte(cursor), func(k, v []byte) error {
+			var rec certificateRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if rec.NotAfter.Before(t) {
+				recs = append(recs, rec)
+			}
+			if len(recs) >= limit {
+				next = string(k)
+				return errScanDone
+			}
+			return nil
+		})
+	})
+	if err == errScanDone {
+		err = nil
+	}
+
+	return recs, next, err
+}
+
+// Delete removes the records and their fingerprint index, and the failure
+// counters of the days before t.
+func (inv *inventory) Delete(recs []certificateRecord, t time.Time) error {
+	day := []byte(t.UTC().Format(time.DateOnly))
+	return inv.update(func(tx store.Tx) error {
+		certs, fps := tx.Bucket(certificatesBucket), tx.Bucket(fingerprintsBucket)
+		for _, rec := range recs {
+			if err := certs.Delete([]byte(rec.Serial)); err != nil {
+				return err
+			}
+			if err := fps.Delete([]byte(rec.Fingerprint)); err != nil {
+				return err
+			}
+		}
+
+		failures := tx.Bucket(failuresBucket)
+		var old [][]byte
+		err := failures.ForEach(func(k, _ []byte) error {
+			if bytes.Compare(k, day) < 0 {
+				old = append(old, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := failures.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Compact rewrites the inventory file to release the space of the deleted
+// records. Requests wait for the compaction to finish. Postgres reclaims the
+// space with its autovacuum.
+func (inv *inventory) Compact() error {
+	if c, ok := inv.store.(interface{ Compact() error }); ok {
+		return c.Compact()
+	}
+
+	return nil
+}
+
+// runRetention deletes the records past the retention, in batches, after
+// exporting them as gzipped JSON lines if an export store is configured.
+func (s *server) runRetention(ctx context.Context) error {
+	cfg := s.config.Inventory.Retention
+	var store objectStore
+	if cfg.Export != nil {
+		var err error
+		if store, err = newObjectStore(*cfg.Export); err != nil {
+			return err
+		}
+	}
+
+	cutoff := time.Now().Add(-cfg.GetKeepAfterExpiry())
+	var deleted int
+	var cursor string
+	for ctx.Err() == nil {
+		recs, next, err := s.inventory.Expired(cutoff, cursor, 1000)
+		if err == nil && len(recs) > 0 {
+			if err = s.exportAndDelete(ctx, store, recs, cutoff); err == nil {
+				deleted += len(recs)
+			}
+		}
+		if err != nil || next == "" {
+			if err == nil && deleted > 0 && cfg.Compact {
+				err = s.inventory.Compact()
+			}
+			if deleted > 0 {
+				logFor("inventory").WithField("deleted", deleted).Info("Deleted inventory records past the retention")
+			}
+			return err
+		}
+
+		cursor = next
+	}
+
+	return ctx.Err()
+}
+
+// exportAndDelete deletes a batch of records past the retention, after
+// exporting them if an export store is configured.
+func (s *server) exportAndDelete(ctx context.Context, store objectStore, recs []certificateRecord, cutoff time.Time) error {
+	if store != nil {
+		data, err := encodeRecordsJSONL(recs)
+		if err != nil {
+			return err
+		}
+		key := "retention/" + time.Now().UTC().Format("20060102T150405.000000000Z") + ".jsonl.gz"
+		if err := store.Put(ctx, key, "application/gzip", data); err != nil {
+			return errors.Wrap(err, "error exporting inventory records")
+		}
+		logFor("inventory").WithFields(log.Fields{
+			"key":     key,
+			"records": len(recs),
+		}).Info("Exported inventory records before deletion")
+	}
+
+	return s.inventory.Delete(recs, cutoff)
+}
+
+// encodeRecordsJSONL returns the records as gzipped JSON lines.
+func encodeRecordsJSONL(recs []certificateRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for i := range recs {
+		recs[i].Status = recs[i].status(time.Now())
+		if err := enc.Encode(&recs[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,82 @@
+package signer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInventoryExpiredCursor(t *testing.T) {
+	inv := newTestInventory(t)
+	now := time.Now()
+	for i := 10; i < 35; i++ {
+		notAfter := now.Add(-time.Hour)
+		if i%5 == 0 {
+			notAfter = now.Add(time.Hour)
+		}
+		rec := &certificateRecord{Serial: strconv.Itoa(i), Fingerprint: "fp" + strconv.Itoa(i), NotAfter: notAfter}
+		if err := inv.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var cursor string
+	var pages, total int
+	for {
+		recs, next, err := inv.Expired(now, cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) > 7 {
+			t.Fatalf("Expired() = %d records, want at most 7", len(recs))
+		}
+		pages++
+		total += len(recs)
+		if next == "" {
+			break
+		}
+		if next <= cursor {
+			t.Fatalf("Expired() cursor %q did not advance from %q", next, cursor)
+		}
+		cursor = next
+	}
+	if total != 20 || pages != 3 {
+		t.Fatalf("Expired() = %d records in %d pages, want 20 in 3", total, pages)
+	}
+}
+
+func TestBoltStoreCompact(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.Put(&certificateRecord{Serial: "1", Fingerprint: "fp1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := inv.Get("1"); err != nil || rec == nil {
+		t.Fatalf("Get() after Compact() = %v, %v", rec, err)
+	}
+}
+
+func TestRetentionInterval(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     time.Duration
+		valid    bool
+	}{
+		{"", 24 * time.Hour, true},
+		{"1h", time.Hour, true},
+		{"0s", 24 * time.Hour, false},
+		{"-1h", 24 * time.Hour, false},
+		{"daily", 24 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		c := RetentionConfig{KeepAfterExpiry: "720h", Interval: tt.interval}
+		if got := c.GetInterval(); got != tt.want {
+			t.Errorf("%q: GetInterval() = %s, want %s", tt.interval, got, tt.want)
+		}
+		if err := c.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%q: Validate() = %v, want valid %v", tt.interval, err, tt.valid)
+		}
+	}
+}
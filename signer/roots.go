@@ -0,0 +1,115 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+)
+
+// GetRootCAPaths returns the files of the trusted upstream roots: rootCAPath
+// followed by the additional roots accepted during a root rotation.
+func (c Config) GetRootCAPaths() []string {
+	return append([]string{c.GetRootCAPath()}, c.AdditionalRootCAPaths...)
+}
+
+// readRootBundle returns the concatenated PEM files of the trusted roots.
+func readRootBundle(config *Config) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, path := range config.GetRootCAPaths() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading root certificate")
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readTrustedRoots returns every certificate in the files of the trusted
+// roots.
+func readTrustedRoots(config *Config) ([]*x509.Certificate, error) {
+	data, err := readRootBundle(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing root certificate")
+		}
+		roots = append(roots, cert)
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("no root certificates found")
+	}
+
+	return roots, nil
+}
+
+// upstreamRootOption returns the option trusting the roots of the upstream
+// CA, the root file and the additional roots during a rotation: a transport
+// trusting them, shared by all the upstream clients.
+func upstreamRootOption(config *Config) (ca.ClientOption, error) {
+	bundle, err := readRootBundle(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return upstreamTransportOption(config.Upstream, bundle)
+}
+
+// chainRoot returns the trusted root that signed the chain, or is its last
+// certificate, or nil if none of the roots did.
+func chainRoot(chain []api.Certificate, roots []*x509.Certificate) *x509.Certificate {
+	if len(chain) == 0 {
+		return nil
+	}
+
+	last := chain[len(chain)-1].Certificate
+	for _, root := range roots {
+		if last.Equal(root) {
+			return root
+		}
+	}
+	for _, root := range roots {
+		if last.CheckSignatureFrom(root) == nil {
+			return root
+		}
+	}
+
+	return nil
+}
+
+// responseChain returns the chain of a sign response, leaf first.
+func responseChain(resp *api.SignResponse) []api.Certificate {
+	if len(resp.CertChainPEM) > 0 {
+		return resp.CertChainPEM
+	}
+	return []api.Certificate{resp.ServerPEM, resp.CaPEM}
+}
+
+// rootFingerprint returns the SHA-256 fingerprint of the root that signed
+// the chain of resp, or an empty string if it is not a trusted root.
+func (s *server) rootFingerprint(resp *api.SignResponse) string {
+	root := chainRoot(responseChain(resp), s.trustedRoots)
+	if root == nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(root.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,542 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+var (
+	policyRulesBucket   = []byte("policyRules")
+	policyHistoryBucket = []byte("policyHistory")
+)
+
+// errRuleVersionConflict is returned when the next version of a runtime
+// rule was stored by another replica during a change.
+var errRuleVersionConflict = errors.New("policy rule version conflict")
+
+// Positions of the runtime rules relative to the rules of the config file.
+const (
+	rulePositionBefore = "before"
+	rulePositionAfter  = "after"
+)
+
+// Changes recorded in the history of the runtime rules.
+const (
+	ruleCreated  = "created"
+	ruleUpdated  = "updated"
+	ruleDisabled = "disabled"
+	ruleEnabled  = "enabled"
+	ruleDeleted  = "deleted"
+	ruleRestored = "restored"
+)
+
+// storedRule is a policy rule managed with the admin API and stored in the
+// inventory. Deleted rules are kept, with their history, until restored.
+type storedRule struct {
+	policy.Rule
+	Position  string    `json:"position"`
+	Disabled  bool      `json:"disabled"`
+	Deleted   bool      `json:"deleted"`
+	Version   int       `json:"version"`
+	Created   time.Time `json:"created"`
+	CreatedBy []string  `json:"createdBy"`
+	Updated   time.Time `json:"updated"`
+	UpdatedBy []string  `json:"updatedBy"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// active returns true if the rule is evaluated.
+func (r *storedRule) active() bool {
+	return !r.Disabled && !r.Deleted
+}
+
+// ruleRevision is a version of a runtime rule and the change that made it.
+type ruleRevision struct {
+	Change string     `json:"change"`
+	Rule   storedRule `json:"rule"`
+}
+
+// RuleRequest is the body of POST /admin/policy/rules and PUT
+// /admin/policy/rules/{id}. Version, if set, must be the current version
+// of the rule updated.
+type RuleRequest struct {
+	policy.Rule
+	Position string `json:"position"`
+	Disabled bool   `json:"disabled"`
+	Version  int    `json:"version"`
+	Comment  string `json:"comment"`
+}
+
+// RuleChangeRequest is the optional body of the disable, enable, restore
+// and delete requests.
+type RuleChangeRequest struct {
+	Comment string `json:"comment"`
+}
+
+func historyKey(id string, version int) []byte {
+	return []byte(fmt.Sprintf("%s\x00%08d", id, version))
+}
+
+// ChangePolicyRule reads the runtime rule id, applies fn to it and stores
+// the result as the next version with its revision, in a single
+// transaction. exists is false if the rule is not stored yet. The update
+// fails with a conflict if the version was stored meanwhile.
+func (inv *inventory) ChangePolicyRule(id string, fn func(r *storedRule, exists bool) (string, error)) (*storedRule, error) {
+	var r storedRule
+	err := inv.update(func(tx store.Tx) error {
+		rules, history := tx.Bucket(policyRulesBucket), tx.Bucket(policyHistoryBucket)
+		r = storedRule{}
+		v := rules.Get([]byte(id))
+		if v != nil {
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+		}
+		change, err := fn(&r, v != nil)
+		if err != nil {
+			return err
+		}
+
+		r.Version++
+		key := historyKey(r.ID, r.Version)
+		if history.Get(key) != nil {
+			return errRuleVersionConflict
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		rev, err := json.Marshal(ruleRevision{Change: change, Rule: r})
+		if err != nil {
+			return err
+		}
+		if err := rules.Put([]byte(r.ID), data); err != nil {
+			return err
+		}
+		return history.Put(key, rev)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// PolicyRules returns the runtime rules, including the deleted ones.
+func (inv *inventory) PolicyRules() ([]*storedRule, error) {
+	rules := []*storedRule{}
+	err := inv.view(func(tx store.Tx) error {
+		return tx.Bucket(policyRulesBucket).ForEach(func(_, v []byte) error {
+			r := new(storedRule)
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			rules = append(rules, r)
+			return nil
+		})
+	})
+
+	return rules, err
+}
+
+// PolicyRuleHistory returns the revisions of a runtime rule, oldest first.
+func (inv *inventory) PolicyRuleHistory(id string) ([]ruleRevision, error) {
+	revisions := []ruleRevision{}
+	prefix := []byte(id + "\x00")
+	err := inv.view(func(tx store.Tx) error {
+		return tx.Bucket(policyHistoryBucket).ForEachPrefix(prefix, func(_, v []byte) error {
+			var rev ruleRevision
+			if err := json.Unmarshal(v, &rev); err != nil {
+				return err
+			}
+			revisions = append(revisions, rev)
+			return nil
+		})
+	})
+
+	return revisions, err
+}
+
+// runtimePolicy holds the runtime rules evaluated with the policy of the
+// config file. Changes are written to the inventory before they apply, so
+// the rules survive restarts. With a BoltDB inventory each replica has its
+// own rules; with Postgres the replicas reload them periodically.
+type runtimePolicy struct {
+	inv *inventory
+
+	mu    sync.RWMutex
+	rules []*storedRule
+}
+
+// loadRuntimePolicy loads the runtime rules from the inventory.
+func loadRuntimePolicy(inv *inventory) (*runtimePolicy, error) {
+	rules, err := inv.PolicyRules()
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading policy rules")
+	}
+	p := &runtimePolicy{inv: inv}
+	p.set(rules)
+
+	return p, nil
+}
+
+// reload reads the rules changed by the other replicas sharing the store.
+func (p *runtimePolicy) reload(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rules, err := p.inv.PolicyRules()
+	if err != nil {
+		return errors.Wrap(err, "error loading policy rules")
+	}
+	p.set(rules)
+
+	return nil
+}
+
+// set replaces the rules, sorted by creation time.
+func (p *runtimePolicy) set(rules []*storedRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Created.Before(rules[j].Created)
+	})
+	p.rules = rules
+}
+
+// apply returns the policy with the active runtime rules before or after
+// its rules.
+func (p *runtimePolicy) apply(base policy.Config) policy.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.rules) == 0 {
+		return base
+	}
+
+	var before, after []policy.Rule
+	for _, r := range p.rules {
+		switch {
+		case !r.active():
+		case r.Position == rulePositionBefore:
+			before = append(before, r.Rule)
+		default:
+			after = append(after, r.Rule)
+		}
+	}
+	rules := make([]policy.Rule, 0, len(before)+len(base.Rules)+len(after))
+	rules = append(append(append(rules, before...), base.Rules...), after...)
+	base.Rules = rules
+
+	return base
+}
+
+// get returns a copy of the rule id.
+func (p *runtimePolicy) get(id string) (storedRule, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, r := range p.rules {
+		if r.ID == id {
+			return *r, true
+		}
+	}
+
+	return storedRule{}, false
+}
+
+// list returns copies of the rules, without the deleted ones unless
+// deleted is set.
+func (p *runtimePolicy) list(deleted bool) []storedRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	rules := []storedRule{}
+	for _, r := range p.rules {
+		if deleted || !r.Deleted {
+			rules = append(rules, *r)
+		}
+	}
+
+	return rules
+}
+
+// change applies fn to the stored rule id, or a new rule if id does not
+// exist and create is set, stores the result as a new version and applies
+// it. fn returns the change recorded in the history. The rule is read and
+// written in the same transaction, so a change made meanwhile by another
+// replica is not lost: fn sees it, or the change fails with a conflict.
+func (p *runtimePolicy) change(id string, create bool, by []string, fn func(r *storedRule) (string, error)) (*storedRule, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now().UTC()
+	r, err := p.inv.ChangePolicyRule(id, func(r *storedRule, exists bool) (string, error) {
+		switch {
+		case exists:
+		case create:
+			*r = storedRule{Created: now, CreatedBy: by}
+		default:
+			return "", errs.NotFound("policy rule %q not found", id)
+		}
+
+		change, err := fn(r)
+		if err != nil {
+			return "", err
+		}
+		r.Updated, r.UpdatedBy = now, by
+		return change, nil
+	})
+	switch {
+	case errors.Is(err, errRuleVersionConflict), errors.Is(err, store.ErrConflict):
+		return nil, errs.New(http.StatusConflict, "policy rule %q was changed meanwhile, retry", id)
+	case err != nil:
+		var sc render.StatusCodedError
+		if errors.As(err, &sc) {
+			return nil, err
+		}
+		return nil, errs.InternalServerErr(err)
+	}
+
+	rules := append([]*storedRule{}, p.rules...)
+	i := slices.IndexFunc(rules, func(rule *storedRule) bool { return rule.ID == id })
+	if i >= 0 {
+		rules[i] = r
+	} else {
+		rules = append(rules, r)
+	}
+	p.set(rules)
+
+	return r, nil
+}
+
+// validateRuntimeRule checks a runtime rule like the rules of the config
+// file. Its id must not be used by the config file.
+func (s *server) validateRuntimeRule(req *RuleRequest) error {
+	switch req.Position {
+	case "":
+		req.Position = rulePositionAfter
+	case rulePositionBefore, rulePositionAfter:
+	default:
+		return errs.BadRequest("invalid position %q, must be before or after", req.Position)
+	}
+	if err := (policy.Config{Rules: []policy.Rule{req.Rule}}).Validate(); err != nil {
+		return errs.BadRequestErr(err, "invalid policy rule: %v", err)
+	}
+	if len(req.Groups) > 0 && s.directory == nil {
+		return errs.BadRequest("policy rules with groups require a directory")
+	}
+	static := s.config.Policy.Rules
+	if s.config.Canary.Policy != nil {
+		static = append(append([]policy.Rule{}, static...), s.config.Canary.Policy.Rules...)
+	}
+	for _, rule := range static {
+		if rule.ID == req.ID {
+			return errs.New(http.StatusConflict, "policy rule %q is defined in the config file", req.ID)
+		}
+	}
+
+	return nil
+}
+
+// decodeRuleChange decodes the optional body of a rule change.
+func decodeRuleChange(r *http.Request) (RuleChangeRequest, error) {
+	var body RuleChangeRequest
+	if r.ContentLength == 0 {
+		return body, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return body, errs.BadRequestErr(err, "error reading request body")
+	}
+
+	return body, nil
+}
+
+// logRuleChange logs a change of a runtime rule.
+func logRuleChange(r *http.Request, change string, rule *storedRule) {
+	logFor("admin").WithFields(log.Fields{
+		"client":  clientIdentities(r),
+		"rule":    rule.ID,
+		"version": rule.Version,
+		"comment": rule.Comment,
+	}).Warnf("Policy rule %s", change)
+}
+
+// listPolicyRules returns the policy: the default action and mode, the
+// rules of the config file and the runtime rules, with the deleted ones if
+// the deleted query parameter is true.
+func (s *server) listPolicyRules(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, map[string]interface{}{
+		"defaultAction": s.config.Policy.GetDefaultAction(),
+		"defaultMode":   s.config.Policy.DefaultMode,
+		"static":        append([]policy.Rule{}, s.config.Policy.Rules...),
+		"runtime":       s.policyRules.list(r.URL.Query().Get("deleted") == "true"),
+	})
+}
+
+// getPolicyRule returns a runtime rule.
+func (s *server) getPolicyRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := s.policyRules.get(r.PathValue("id"))
+	if !ok {
+		render.Error(w, r, errs.NotFound("policy rule %q not found", r.PathValue("id")))
+		return
+	}
+
+	render.JSON(w, r, rule)
+}
+
+// getPolicyRuleHistory returns the versions of a runtime rule, oldest
+// first.
+func (s *server) getPolicyRuleHistory(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := s.policyRules.get(id); !ok {
+		render.Error(w, r, errs.NotFound("policy rule %q not found", id))
+		return
+	}
+	revisions, err := s.inventory.PolicyRuleHistory(id)
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	render.JSON(w, r, revisions)
+}
+
+// createPolicyRule creates a runtime rule.
+func (s *server) createPolicyRule(w http.ResponseWriter, r *http.Request) {
+	var body RuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+	if err := s.validateRuntimeRule(&body); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	rule, err := s.policyRules.change(body.ID, true, clientIdentities(r), func(rule *storedRule) (string, error) {
+		switch {
+		case rule.Deleted:
+			return "", errs.New(http.StatusConflict, "policy rule %q is deleted, restore it or use another id", body.ID)
+		case rule.Version > 0:
+			return "", errs.New(http.StatusConflict, "policy rule %q already exists", body.ID)
+		}
+		rule.Rule, rule.Position, rule.Disabled, rule.Comment = body.Rule, body.Position, body.Disabled, body.Comment
+		return ruleCreated, nil
+	})
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	logRuleChange(r, ruleCreated, rule)
+	render.JSONStatus(w, r, rule, http.StatusCreated)
+}
+
+// updatePolicyRule replaces a runtime rule.
+func (s *server) updatePolicyRule(w http.ResponseWriter, r *http.Request) {
+	var body RuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+	id := r.PathValue("id")
+	if body.ID == "" {
+		body.ID = id
+	}
+	if body.ID != id {
+		render.Error(w, r, errs.BadRequest("rule id %q does not match the path", body.ID))
+		return
+	}
+	if err := s.validateRuntimeRule(&body); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	rule, err := s.policyRules.change(id, false, clientIdentities(r), func(rule *storedRule) (string, error) {
+		switch {
+		case rule.Deleted:
+			return "", errs.New(http.StatusConflict, "policy rule %q is deleted, restore it first", id)
+		case body.Version != 0 && body.Version != rule.Version:
+			return "", errs.New(http.StatusConflict, "policy rule %q is at version %d, not %d", id, rule.Version, body.Version)
+		}
+		rule.Rule, rule.Position, rule.Disabled, rule.Comment = body.Rule, body.Position, body.Disabled, body.Comment
+		return ruleUpdated, nil
+	})
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	logRuleChange(r, ruleUpdated, rule)
+	render.JSON(w, r, rule)
+}
+
+// changePolicyRule disables, enables or restores a runtime rule.
+func (s *server) changePolicyRule(w http.ResponseWriter, r *http.Request) {
+	var change string
+	switch r.PathValue("action") {
+	case "disable":
+		change = ruleDisabled
+	case "enable":
+		change = ruleEnabled
+	case "restore":
+		change = ruleRestored
+	default:
+		render.Error(w, r, errs.NotFound("unknown action %q", r.PathValue("action")))
+		return
+	}
+	s.applyRuleChange(w, r, change)
+}
+
+// deletePolicyRule soft-deletes a runtime rule: it is no longer evaluated
+// and can be restored.
+func (s *server) deletePolicyRule(w http.ResponseWriter, r *http.Request) {
+	s.applyRuleChange(w, r, ruleDeleted)
+}
+
+func (s *server) applyRuleChange(w http.ResponseWriter, r *http.Request, change string) {
+	body, err := decodeRuleChange(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	id := r.PathValue("id")
+
+	rule, err := s.policyRules.change(id, false, clientIdentities(r), func(rule *storedRule) (string, error) {
+		if rule.Deleted != (change == ruleRestored) {
+			if rule.Deleted {
+				return "", errs.New(http.StatusConflict, "policy rule %q is deleted, restore it first", id)
+			}
+			return "", errs.New(http.StatusConflict, "policy rule %q is not deleted", id)
+		}
+		switch change {
+		case ruleDisabled:
+			rule.Disabled = true
+		case ruleEnabled:
+			rule.Disabled = false
+		case ruleDeleted:
+			rule.Deleted = true
+		case ruleRestored:
+			rule.Deleted = false
+		}
+		rule.Comment = body.Comment
+		return change, nil
+	})
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	logRuleChange(r, change, rule)
+	render.JSON(w, r, rule)
+}
@@ -0,0 +1,168 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+func TestUpdatePolicyRuleStaleVersion(t *testing.T) {
+	inv := newTestInventory(t)
+	replica := func() *server {
+		p, err := loadRuntimePolicy(inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &server{config: &Config{}, inventory: inv, policyRules: p}
+	}
+	call := func(s *server, handler http.HandlerFunc, method, body string) int {
+		r := withIdentities(httptest.NewRequest(method, "/admin/policy/rules/web", strings.NewReader(body)), "admin")
+		r.SetPathValue("id", "web")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// Two replicas sharing the store: b does not see the update of a until
+	// it reloads, but its change is checked against the stored version.
+	a, b := replica(), replica()
+	if code := call(a, a.createPolicyRule, http.MethodPost, `{"id":"web","action":"allow","sans":["*.example.com"]}`); code != http.StatusCreated {
+		t.Fatalf("create status = %d, want %d", code, http.StatusCreated)
+	}
+	if code := call(b, b.updatePolicyRule, http.MethodPut, `{"action":"deny","sans":["*.example.com"],"version":1}`); code != http.StatusOK {
+		t.Fatalf("update status = %d, want %d", code, http.StatusOK)
+	}
+	if code := call(a, a.updatePolicyRule, http.MethodPut, `{"action":"allow","sans":["*.example.org"],"version":1}`); code != http.StatusConflict {
+		t.Fatalf("stale update status = %d, want %d", code, http.StatusConflict)
+	}
+
+	// A change without a version applies to the stored rule, not to the
+	// copy of the replica.
+	if code := call(a, a.deletePolicyRule, http.MethodDelete, ""); code != http.StatusOK {
+		t.Fatalf("delete status = %d, want %d", code, http.StatusOK)
+	}
+	rules, err := inv.PolicyRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Version != 3 || rules[0].Action != "deny" || !rules[0].Deleted {
+		t.Fatalf("stored rule = %+v, want version 3 of the denial, deleted", rules[0])
+	}
+	history, err := inv.PolicyRuleHistory("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[2].Change != ruleDeleted {
+		t.Errorf("history = %+v, want created, updated and deleted", history)
+	}
+}
+
+func TestChangePolicyRuleNotFound(t *testing.T) {
+	p, err := loadRuntimePolicy(newTestInventory(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.change("web", false, nil, func(r *storedRule) (string, error) {
+		return ruleDisabled, nil
+	})
+	if sc, ok := err.(interface{ StatusCode() int }); !ok || sc.StatusCode() != http.StatusNotFound {
+		t.Fatalf("change() error = %v, want not found", err)
+	}
+}
+
+func TestRuntimePolicyRules(t *testing.T) {
+	inv := newTestInventory(t)
+	p, err := loadRuntimePolicy(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: &Config{Policy: policy.Config{Rules: []policy.Rule{
+		{ID: "static", Action: "allow", SANs: []string{"*.example.com"}},
+	}}}, inventory: inv, policyRules: p}
+	call := func(handler http.HandlerFunc, method, id, action, body string) *httptest.ResponseRecorder {
+		r := withIdentities(httptest.NewRequest(method, "/admin/policy/rules/"+id, strings.NewReader(body)), "admin")
+		r.SetPathValue("id", id)
+		r.SetPathValue("action", action)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		id      string
+		action  string
+		body    string
+		status  int
+	}{
+		{"static id", s.createPolicyRule, "", "", `{"id":"static","action":"deny","sans":["*"]}`, http.StatusConflict},
+		{"position", s.createPolicyRule, "", "", `{"id":"freeze","action":"deny","sans":["*"],"position":"first"}`, http.StatusBadRequest},
+		{"invalid rule", s.createPolicyRule, "", "", `{"id":"freeze","action":"block","sans":["*"]}`, http.StatusBadRequest},
+		{"freeze", s.createPolicyRule, "", "", `{"id":"freeze","action":"deny","sans":["*.prod.example.com"],"position":"before"}`, http.StatusCreated},
+		{"exists", s.createPolicyRule, "", "", `{"id":"freeze","action":"deny","sans":["*"]}`, http.StatusConflict},
+		{"lab", s.createPolicyRule, "", "", `{"id":"lab","action":"allow","sans":["*.lab.example.com"]}`, http.StatusCreated},
+		{"id mismatch", s.updatePolicyRule, "lab", "", `{"id":"other","action":"allow","sans":["*"]}`, http.StatusBadRequest},
+		{"disable", s.changePolicyRule, "lab", "disable", `{"comment":"lab closed"}`, http.StatusOK},
+		{"action", s.changePolicyRule, "lab", "archive", "", http.StatusNotFound},
+		{"restore live", s.changePolicyRule, "lab", "restore", "", http.StatusConflict},
+		{"unknown", s.deletePolicyRule, "missing", "", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := call(tt.handler, http.MethodPost, tt.id, tt.action, tt.body); w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	var ids []string
+	for _, r := range p.apply(s.config.Policy).Rules {
+		ids = append(ids, r.ID)
+	}
+	if !sameStrings(ids, []string{"freeze", "static"}) || ids[0] != "freeze" {
+		t.Errorf("apply() rules = %v, want freeze before static, lab disabled", ids)
+	}
+
+	for _, step := range []struct {
+		handler http.HandlerFunc
+		action  string
+		status  int
+	}{
+		{s.deletePolicyRule, "", http.StatusOK},
+		{s.changePolicyRule, "enable", http.StatusConflict},
+		{s.updatePolicyRule, "", http.StatusConflict},
+	} {
+		if w := call(step.handler, http.MethodPost, "lab", step.action, `{"action":"allow","sans":["*"]}`); w.Code != step.status {
+			t.Errorf("lab %s: status = %d, want %d: %s", step.action, w.Code, step.status, w.Body)
+		}
+	}
+	if rules := p.list(false); len(rules) != 1 || rules[0].ID != "freeze" {
+		t.Errorf("list(false) = %+v, want only freeze", rules)
+	}
+	if rules := p.list(true); len(rules) != 2 {
+		t.Errorf("list(true) = %+v, want the deleted rule too", rules)
+	}
+	if w := call(s.changePolicyRule, http.MethodPost, "lab", "restore", ""); w.Code != http.StatusOK {
+		t.Errorf("restore status = %d: %s", w.Code, w.Body)
+	}
+
+	w := call(s.getPolicyRuleHistory, http.MethodGet, "lab", "", "")
+	var history []ruleRevision
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	for _, h := range history {
+		changes = append(changes, h.Change)
+	}
+	if want := []string{ruleCreated, ruleDisabled, ruleDeleted, ruleRestored}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("history = %v, want %v", changes, want)
+	}
+	if history[1].Rule.Comment != "lab closed" || !history[1].Rule.Disabled || history[1].Rule.Version != 2 {
+		t.Errorf("disabled revision = %+v", history[1].Rule)
+	}
+}
@@ -0,0 +1,84 @@
+package signer
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/errs"
+)
+
+// Sensitivities of profiles and intermediates, reported as the severity of
+// the hook events and the audit logs.
+const (
+	sensitivityRoutine = "routine"
+	sensitivityHigh    = "high"
+)
+
+// validateSensitivity checks the sensitivity and required metadata keys of
+// what, a profile or the intermediates.
+func validateSensitivity(what, sensitivity string, required []string) error {
+	switch sensitivity {
+	case "", sensitivityRoutine, sensitivityHigh:
+	default:
+		return errors.Errorf("invalid sensitivity %q for %s, must be routine or high", sensitivity, what)
+	}
+	for _, k := range required {
+		if !metadataKeyRegexp.MatchString(k) {
+			return errors.Errorf("invalid required metadata key %q for %s", k, what)
+		}
+	}
+
+	return nil
+}
+
+// checkRequiredMetadata returns a 400 error naming the first metadata key
+// of required missing or empty in md.
+func checkRequiredMetadata(md map[string]string, required []string, what string) error {
+	for _, k := range required {
+		if md[k] == "" {
+			return errs.BadRequest("metadata %q is required for %s certificates", k, what)
+		}
+	}
+
+	return nil
+}
+
+// GetSensitivity returns the sensitivity of the profile, defaults to
+// routine.
+func (c ProfileConfig) GetSensitivity() string {
+	if c.Sensitivity != "" {
+		return c.Sensitivity
+	}
+
+	return sensitivityRoutine
+}
+
+// GetSensitivity returns the sensitivity of the intermediates, defaults to
+// high.
+func (c IntermediateConfig) GetSensitivity() string {
+	if c.Sensitivity != "" {
+		return c.Sensitivity
+	}
+
+	return sensitivityHigh
+}
+
+// alert audits the issuance of a high-sensitivity certificate: it is logged
+// as a warning, counted and delivered to the alert hooks right away.
+func (s *server) alert(event hookEvent) {
+	what := event.Profile
+	if what == "" {
+		what = event.Endpoint
+	}
+	highSensitivityIssued.WithLabelValues(what, s.tenantFor(event.Client)).Inc()
+	logFor("audit").WithFields(log.Fields{
+		"severity":  event.Severity,
+		"requestId": event.RequestID,
+		"client":    event.Client,
+		"endpoint":  event.Endpoint,
+		"profile":   event.Profile,
+		"subject":   event.Subject,
+		"serial":    event.Serial,
+		"metadata":  event.Metadata,
+	}).Warn("Issued high-sensitivity certificate")
+	s.hooks.Fire(hookAlert, event)
+}
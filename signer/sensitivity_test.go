@@ -0,0 +1,99 @@
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/api"
+)
+
+func TestValidateSensitivity(t *testing.T) {
+	tests := []struct {
+		sensitivity string
+		required    []string
+		ok          bool
+	}{
+		{"", nil, true},
+		{"high", []string{"ticket", "team"}, true},
+		{"critical", nil, false},
+		{"routine", []string{"not a key"}, false},
+	}
+	for _, tt := range tests {
+		if err := validateSensitivity("profile", tt.sensitivity, tt.required); (err == nil) != tt.ok {
+			t.Errorf("%q %v: validateSensitivity() = %v, want ok %v", tt.sensitivity, tt.required, err, tt.ok)
+		}
+	}
+
+	if got := (ProfileConfig{}).GetSensitivity(); got != sensitivityRoutine {
+		t.Errorf("ProfileConfig.GetSensitivity() = %q, want routine", got)
+	}
+	if got := (IntermediateConfig{}).GetSensitivity(); got != sensitivityHigh {
+		t.Errorf("IntermediateConfig.GetSensitivity() = %q, want high", got)
+	}
+}
+
+func TestRequiredMetadata(t *testing.T) {
+	s := newApprovalTestServer()
+	s.config.Profiles[0].RequiredMetadata = []string{"ticket"}
+	r, request := newPolicyTestRequest(t, "ci", "release.example.com")
+	request.Profile = profileCodeSigning
+	if _, err := s.requestApproval(r, generationStable, request); errorStatus(err) != http.StatusBadRequest || !strings.Contains(err.Error(), `"ticket"`) {
+		t.Errorf("requestApproval() without the required metadata = %v, want 400", err)
+	}
+	request.Metadata = map[string]string{"ticket": "SEC-1"}
+	if _, err := s.requestApproval(r, generationStable, request); err != nil {
+		t.Errorf("requestApproval() with the required metadata = %v", err)
+	}
+
+	s = &server{config: &Config{Intermediate: IntermediateConfig{Enabled: true, AllowedClients: []string{"pki"}, RequiredMetadata: []string{"ticket"}}}}
+	w := httptest.NewRecorder()
+	s.signIntermediate(w, withIdentities(httptest.NewRequest(http.MethodPost, "/sign/intermediate", strings.NewReader(`{"csr":`+mustJSON(t, newTestCSR(t, "Sub CA"))+`}`)), "pki"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("signIntermediate() without the required metadata = %d, want 400: %s", w.Code, w.Body)
+	}
+}
+
+func TestAlertHighSensitivity(t *testing.T) {
+	events := make(chan hookEvent, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e hookEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer srv.Close()
+	root, rootKey := newTestCert(t, "Root CA")
+	leaf, _ := issueTestCert(t, root, rootKey, "release.example.com", false)
+	s := &server{config: &Config{}, hooks: newHookRunner([]HookConfig{{Name: "pager", Events: []string{hookAlert}, URL: srv.URL}})}
+	alerts := highSensitivityIssued.WithLabelValues(profileCodeSigning, s.tenantFor([]string{"ci"}))
+	before := testutil.ToFloat64(alerts)
+
+	r, request := newPolicyTestRequest(t, "ci", "release.example.com")
+	request.Profile = profileCodeSigning
+	resp := &api.SignResponse{ServerPEM: api.NewCertificate(leaf), CaPEM: api.NewCertificate(root)}
+	s.issued(newHookEvent(r, generationStable, request), resp)
+	event := newHookEvent(r, generationStable, request)
+	event.Severity = sensitivityHigh
+	s.issued(event, resp)
+
+	select {
+	case e := <-events:
+		if e.Event != hookAlert || e.Severity != sensitivityHigh || e.Serial != leaf.SerialNumber.String() {
+			t.Errorf("alert hook received %+v, want the high-sensitivity issuance", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("alert hook was not called")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("alert hook received an unexpected %s event of severity %s", e.Event, e.Severity)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := testutil.ToFloat64(alerts) - before; got != 1 {
+		t.Errorf("high-sensitivity issuances counted = %v, want 1", got)
+	}
+}
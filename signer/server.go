@@ -0,0 +1,645 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// server holds the state shared by the signer HTTP handlers.
+type server struct {
+	config       *Config
+	provisioner  *ca.Provisioner
+	intermediate *ca.Provisioner
+	canary       *ca.Provisioner
+	secondary    *ca.Provisioner
+	limiter      rateLimiter
+	priority     *priorityScheduler
+	cache        *upstreamCache
+	jobs         jobRunner
+	passthrough  PassthroughConfig
+	lifecycle    lifecycle
+	hooks        *hookRunner
+	emails       *emailVerifier
+	approvals    *approvalStore
+	inventory    *inventory
+	policyRules  *runtimePolicy
+	revocation   *revocationChecker
+	cloud        *cloudVerifier
+	oidc         *oidcVerifier
+	directory    *directory
+	trustedRoots []*x509.Certificate
+	anomalies    *anomalyDetector
+	monitor      *upstreamMonitor
+	renewals     *renewalHub
+	ct           *ctSubmitter
+	tsa          *timestamper
+	mirror       *mirror
+	nonces       nonceStore
+
+	maintenanceMode maintenanceMode
+
+	authTokens   []authToken
+	replayKeys   map[string]replayKey
+	nonceLimiter rateLimiter
+
+	upstreamMu sync.RWMutex
+	refreshMu  sync.Mutex
+	refreshed  map[string]time.Time
+}
+
+// newServer returns a server issuing with the given provisioner and trusting
+// the given roots.
+func newServer(config *Config, provisioner *ca.Provisioner, roots []*x509.Certificate) (*server, error) {
+	s := &server{config: config, provisioner: provisioner, trustedRoots: roots}
+	var err error
+	if s.authTokens, err = loadAuthTokens(config.Authn); err != nil {
+		return nil, err
+	}
+	if s.replayKeys, err = loadReplayKeys(config.Authn.Replay); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewHandler returns the HTTP handler of the signer endpoints for a
+// configuration, issuing with the given provisioner. Unlike Main it does not
+// open the inventory, run the background jobs or listen, so it can be served
+// in process, e.g. by the testsigner package.
+func NewHandler(config *Config, provisioner *ca.Provisioner, roots []*x509.Certificate) (http.Handler, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	s, err := newServer(config, provisioner, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.routes(), nil
+}
+
+// routes returns the HTTP handler serving all the signer endpoints.
+func (s *server) routes() http.Handler {
+	if s.config.RateLimit.Enabled() {
+		s.limiter = newRateLimiter(s.config.RateLimit)
+	}
+	if s.config.Priority.Enabled() {
+		s.priority = newPriorityScheduler(s.config.Priority)
+	}
+
+	if s.config.featureEnabled(featurePassthrough) {
+		s.passthrough = s.config.Passthrough
+	}
+	s.cache = newUpstreamCache(s.config.Cache, s.config.Timeouts.GetRead())
+	s.hooks = newHookRunner(s.config.Hooks)
+	if s.config.Anomalies.Enabled {
+		s.anomalies = newAnomalyDetector(s.config.Anomalies)
+	}
+	if len(s.config.Authn.OIDC) > 0 {
+		s.oidc = newOIDCVerifier(s.config.Authn.OIDC)
+	}
+	if c := s.config.ClientAuth.Revocation; c.Enabled() {
+		s.revocation = newRevocationChecker(c, s.inventory)
+	}
+
+	mux := http.NewServeMux()
+	if s.config.Authn.Replay.Enabled() {
+		s.nonces = newNonceStore(s.config.Authn.Replay)
+		s.nonceLimiter = newRateLimiter(RateLimitConfig{Backend: s.config.Authn.Replay.Backend, Redis: s.config.Authn.Replay.Redis})
+		mux.HandleFunc("GET /nonce", s.getNonce)
+	}
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/health", s.health)
+	mux.HandleFunc("/roots", s.roots)
+	mux.HandleFunc("/provisioners", s.provisioners)
+	if s.monitor != nil {
+		mux.HandleFunc("GET /status", s.monitor.status)
+	}
+	mux.HandleFunc("/sign", s.maintenance(s.rateLimit(s.mirrored(s.timed(s.prioritize(s.sign))))))
+	mux.HandleFunc("POST /sign/raw", s.maintenance(s.rateLimit(s.mirrored(s.timed(s.prioritize(s.sign))))))
+	mux.HandleFunc("/policy/evaluate", s.evaluatePolicy)
+	mux.HandleFunc("GET /profiles", s.listProfiles)
+	if s.config.Renewal.Stream.Enabled && s.config.featureEnabled(featureRenewalStream) {
+		s.renewals = newRenewalHub(s.config.Renewal.Stream)
+		mux.HandleFunc("GET /renewals/stream", s.renewalStream)
+		if s.config.Admin.Enabled() {
+			mux.HandleFunc("POST /admin/renewals", s.admin(s.pushRenewal))
+		}
+	}
+	mux.Handle("/metrics", promhttp.Handler())
+	if s.intermediate != nil {
+		mux.HandleFunc("/sign/intermediate", s.maintenance(s.rateLimit(s.timed(s.prioritize(s.signIntermediate)))))
+	}
+	if s.config.EmailVerification.Enabled {
+		s.emails = newEmailVerifier(s.config.EmailVerification)
+		mux.HandleFunc("/email/challenge", s.rateLimit(s.emails.challenge))
+		mux.HandleFunc("/email/verify", s.rateLimit(s.emails.verify))
+	}
+	if s.config.SMIME.Enabled {
+		mux.HandleFunc("/sign/smime", s.maintenance(s.rateLimit(s.timed(s.prioritize(s.signSMIME)))))
+	}
+	if s.tsa != nil {
+		mux.HandleFunc("POST /tsa", s.rateLimit(s.timestamp))
+	}
+	if s.config.Keygen.Enabled && s.config.featureEnabled(featureKeygen) {
+		mux.HandleFunc("/sign/keygen", s.maintenance(s.rateLimit(s.timed(s.prioritize(s.signKeygen)))))
+	}
+	if s.config.Batch.Enabled && s.config.featureEnabled(featureBatch) {
+		mux.HandleFunc("POST /sign/batch", s.maintenance(s.rateLimit(s.timed(s.prioritize(s.signBatch)))))
+	}
+	if s.config.CloudIdentity.Enabled() && s.config.featureEnabled(featureCloudIdentity) {
+		s.cloud = newCloudVerifier(s.config.CloudIdentity)
+		mux.HandleFunc("POST /sign/cloud", s.maintenance(s.rateLimit(s.timed(s.prioritize(s.signCloud)))))
+	}
+	if s.inventory != nil {
+		mux.HandleFunc("GET /certificates/{serial}", s.getCertificate)
+		mux.HandleFunc("GET /certificates/by-fingerprint/{sha256}", s.getCertificateByFingerprint)
+		mux.HandleFunc("GET /stats", s.stats)
+		if len(s.config.Quotas) > 0 {
+			mux.HandleFunc("GET /quotas", s.listQuotas)
+			mux.HandleFunc("GET /quotas/{team}", s.getQuota)
+		}
+		mux.HandleFunc("POST /report-compromise", s.rateLimit(s.reportCompromise))
+	}
+	if len(s.config.Profiles) > 0 && s.config.featureEnabled(featureApprovals) {
+		s.approvals = newApprovalStore(s.inventory, s.config.Profiles)
+		mux.HandleFunc("GET /approvals", s.listApprovals)
+		mux.HandleFunc("GET /approvals/{id}", s.getApproval)
+		mux.HandleFunc("POST /approvals/{id}/{action}", s.maintenance(s.decideApproval))
+	}
+	if s.config.Admin.Enabled() {
+		mux.HandleFunc("GET /admin/maintenance", s.admin(s.getMaintenance))
+		mux.HandleFunc("PUT /admin/maintenance", s.admin(s.putMaintenance))
+		mux.HandleFunc("POST /admin/drain", s.admin(s.drain))
+		mux.HandleFunc("GET /config", s.admin(s.getConfig))
+		mux.HandleFunc("GET /admin/support-bundle", s.admin(s.supportBundle))
+		if s.config.CrossSign.Enabled() {
+			mux.HandleFunc("POST /admin/cross-sign", s.admin(s.crossSign))
+		}
+		if s.config.StepAdmin.Enabled() {
+			mux.HandleFunc("GET /admin/step/provisioners", s.stepAdmin(stepAdminListProvisioners, s.listStepProvisioners))
+			mux.HandleFunc("GET /admin/step/policy", s.stepAdmin(stepAdminGetPolicy, s.getStepPolicy))
+			mux.HandleFunc("PUT /admin/step/policy", s.stepAdmin(stepAdminUpdatePolicy, s.putStepPolicy))
+			mux.HandleFunc("GET /admin/step/provisioners/{name}/policy", s.stepAdmin(stepAdminGetPolicy, s.getStepPolicy))
+			mux.HandleFunc("PUT /admin/step/provisioners/{name}/policy", s.stepAdmin(stepAdminUpdatePolicy, s.putStepPolicy))
+		}
+		if s.inventory != nil {
+			mux.HandleFunc("GET /admin/backup", s.admin(s.backup))
+			mux.HandleFunc("GET /admin/usage", s.admin(s.usage))
+			mux.HandleFunc("GET /admin/campaigns", s.admin(s.listCampaigns))
+			mux.HandleFunc("POST /admin/campaigns", s.admin(s.createCampaign))
+			mux.HandleFunc("GET /admin/campaigns/{id}", s.admin(s.getCampaign))
+			mux.HandleFunc("DELETE /admin/campaigns/{id}", s.admin(s.deleteCampaign))
+			mux.HandleFunc("GET /admin/policy/rules", s.admin(s.listPolicyRules))
+			mux.HandleFunc("POST /admin/policy/rules", s.admin(s.createPolicyRule))
+			mux.HandleFunc("GET /admin/policy/rules/{id}", s.admin(s.getPolicyRule))
+			mux.HandleFunc("PUT /admin/policy/rules/{id}", s.admin(s.updatePolicyRule))
+			mux.HandleFunc("DELETE /admin/policy/rules/{id}", s.admin(s.deletePolicyRule))
+			mux.HandleFunc("GET /admin/policy/rules/{id}/history", s.admin(s.getPolicyRuleHistory))
+			mux.HandleFunc("POST /admin/policy/rules/{id}/{action}", s.admin(s.changePolicyRule))
+		}
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		logFor("server").WithField("path", r.URL.Path).Error("Bad Request: 404 Not Found")
+		http.NotFound(w, r)
+	})
+
+	// The middlewares, from the outermost, which sees the requests first and
+	// the responses last:
+	//   - requestIDs, so every response and log line has a request ID;
+	//   - compression, which decompresses the bodies read by the following
+	//     ones and compresses every response, problem details included;
+	//   - problemJSON, rewriting the errors of all the following ones;
+	//   - recoverer, turning panics into 500 errors;
+	//   - versioned, so the paths matched from there on are unversioned;
+	//   - requestTimeout, bounding the checks below, e.g. CRLs and OIDC;
+	//   - trustedHeader, clientRevocation and authenticate, establishing the
+	//     client identities;
+	//   - replayProtect, checking the signing keys against these identities;
+	//   - deprecated, only flagging the requests that were accepted.
+	middlewares := []func(http.Handler) http.Handler{
+		requestIDs, s.compression, problemJSON, recoverer, versioned, s.requestTimeout,
+		s.trustedHeader, s.clientRevocation, s.authenticate, s.replayProtect, s.deprecated,
+	}
+	var handler http.Handler = mux
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// sign issues a leaf certificate for the CSR in the request body, a
+// SignRequest or, on /sign/raw, the CSR itself in DER or PEM.
+func (s *server) sign(w http.ResponseWriter, r *http.Request) {
+	generation := s.generationFor(r)
+	opts, err := parseBundleOptions(r)
+	if err != nil {
+		s.countSign(clientIdentities(r), generation, "invalid", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	decode := decodeSignRequest
+	if r.URL.Path == "/sign/raw" {
+		decode = decodeRawSignRequest
+	}
+	request, err := decode(r)
+	if err != nil {
+		s.countSign(clientIdentities(r), generation, "invalid", err)
+		render.Error(w, r, err)
+		return
+	}
+
+	if err := s.checkPolicy(r, generation, request); err != nil {
+		result := "error"
+		if _, ok := err.(*policyError); ok {
+			result = "denied"
+		}
+		s.countSign(clientIdentities(r), generation, result, err)
+		render.Error(w, r, err)
+		return
+	}
+
+	if request.Profile != "" {
+		a, err := s.requestApproval(r, generation, request)
+		if err != nil {
+			s.releaseQuota(clientIdentities(r))
+			s.countSign(clientIdentities(r), generation, "denied", err)
+			render.Error(w, r, err)
+			return
+		}
+		s.countSign(clientIdentities(r), generation, "pending", nil)
+		render.JSONStatus(w, r, a, http.StatusAccepted)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.Timeouts.GetSign())
+	defer cancel()
+
+	dual := s.startDualIssuance(ctx, clientIdentities(r), request)
+	resp, err := s.issueWith(ctx, s.upstreamFor(generation), request, nil)
+	if err != nil {
+		dual.wait(nil, requestID(r))
+		s.releaseQuota(clientIdentities(r))
+		s.countSign(clientIdentities(r), generation, "error", err)
+		render.Error(w, r, err)
+		return
+	}
+	secondary := dual.wait(resp, requestID(r))
+
+	logFor("server").WithFields(log.Fields{
+		"request":  requestID(r),
+		"client":   clientIdentities(r),
+		"subject":  request.CsrPEM.Subject.CommonName,
+		"serial":   resp.ServerPEM.Certificate.SerialNumber.String(),
+		"metadata": request.Metadata,
+	}).Info("Issued certificate")
+	s.countSign(clientIdentities(r), generation, "issued", nil)
+	event := newHookEvent(r, generation, request)
+	if secondary != nil {
+		event.SecondarySerial = secondary.ServerPEM.Certificate.SerialNumber.String()
+		s.storeSecondary(event, resp, secondary)
+		if s.config.DualIssuance.GetMode() != dualIssuanceReturn {
+			secondary = nil
+		}
+	}
+	s.issued(event, resp)
+	s.writeSignResponse(w, r, resp, request.scts, secondary, opts, http.StatusCreated)
+}
+
+// signIntermediate issues a CA certificate for the CSR in the request body.
+// Only clients listed in intermediate.allowedClients or in a delegation may
+// call it, and the path length and name constraints are always set by the
+// signer.
+func (s *server) signIntermediate(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config.Intermediate
+	maxPathLen, constraints, ok := cfg.grantFor(r)
+	if !ok {
+		logFor("server").WithField("client", clientIdentities(r)).Warn("Forbidden: client not allowed to request intermediates")
+		render.Error(w, r, errs.Forbidden("client is not allowed to request intermediate certificates"))
+		return
+	}
+	if cfg.RequireConstraints && constraints.IsEmpty() {
+		logFor("server").WithField("client", clientIdentities(r)).Warn("Forbidden: no name constraints granted to the client")
+		render.Error(w, r, errs.Forbidden("intermediate certificates require name constraints, none are granted to the client"))
+		return
+	}
+
+	opts, err := parseBundleOptions(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	request, err := decodeSignRequest(r)
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	if request.Profile != "" {
+		render.Error(w, r, errs.BadRequest("profiles are not supported for intermediates"))
+		return
+	}
+
+	if err := checkRequiredMetadata(request.Metadata, cfg.RequiredMetadata, "intermediate"); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	generation := s.generationFor(r)
+	if err := s.checkPolicy(r, generation, request); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	if err := limitNotAfter(request, cfg.GetMaxDuration()); err != nil {
+		s.releaseQuota(clientIdentities(r))
+		render.Error(w, r, err)
+		return
+	}
+
+	data, err := json.Marshal(intermediateTemplateData(maxPathLen, constraints))
+	if err != nil {
+		s.releaseQuota(clientIdentities(r))
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.Timeouts.GetSign())
+	defer cancel()
+
+	resp, err := s.issueWith(ctx, upstreamIntermediate, request, data)
+	if err != nil {
+		s.releaseQuota(clientIdentities(r))
+		render.Error(w, r, err)
+		return
+	}
+
+	if err := verifyCAGrant(resp.ServerPEM.Certificate, maxPathLen, constraints); err != nil {
+		logFor("server").WithField("error", err).Error("Upstream CA did not apply the granted path length and name constraints")
+		s.revokeRejected(ctx, upstreamIntermediate, resp.ServerPEM.Certificate, "intermediate does not match the grant")
+		s.releaseQuota(clientIdentities(r))
+		render.Error(w, r, errs.Wrap(http.StatusBadGateway, err, "upstream CA did not apply the granted path length and name constraints"))
+		return
+	}
+
+	logFor("server").WithFields(log.Fields{
+		"client":          clientIdentities(r),
+		"subject":         request.CsrPEM.Subject.CommonName,
+		"maxPathLen":      maxPathLen,
+		"nameConstraints": constraints,
+		"metadata":        request.Metadata,
+	}).Info("Issued intermediate certificate")
+	event := newHookEvent(r, generation, request)
+	event.Severity = cfg.GetSensitivity()
+	s.issued(event, resp)
+
+	s.writeSignResponse(w, r, resp, request.scts, nil, opts, http.StatusCreated)
+}
+
+// EvaluateRequest is the body of POST /policy/evaluate. Identities default to
+// the names in the client certificate.
+type EvaluateRequest struct {
+	CsrPEM     api.CertificateRequest `json:"csr"`
+	Identities []string               `json:"identities"`
+	Groups     []string               `json:"groups"`
+}
+
+// evaluatePolicy returns the policy decision for a CSR without issuing
+// anything.
+func (s *server) evaluatePolicy(w http.ResponseWriter, r *http.Request) {
+	var body EvaluateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+
+	request := &SignRequest{CsrPEM: body.CsrPEM}
+	if err := request.Validate(); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	// Other identities and groups can only be evaluated by admins, so
+	// clients cannot probe what the others are allowed.
+	own := clientIdentities(r)
+	foreign := len(body.Groups) > 0
+	for _, id := range body.Identities {
+		foreign = foreign || !slices.Contains(own, id)
+	}
+	if foreign && !clientAllowed(r, s.config.Admin.Clients) {
+		logFor("policy").WithField("client", own).Warn("Forbidden: policy evaluation of other identities")
+		render.Error(w, r, errs.Forbidden("only admins can evaluate the policy for other identities or groups"))
+		return
+	}
+	identities := body.Identities
+	if len(identities) == 0 {
+		identities = own
+	}
+	p := s.policyFor(s.generationFor(r))
+	groups := body.Groups
+	if len(groups) == 0 {
+		var err error
+		if groups, err = s.groupsFor(r.Context(), p, identities); err != nil {
+			render.Error(w, r, errs.New(http.StatusServiceUnavailable, "error resolving the directory groups"))
+			return
+		}
+	}
+
+	render.JSON(w, r, p.Evaluate(identities, groups, requestNames(request)))
+}
+
+// checkPolicy runs every check of a sign request before it is issued, and
+// returns a policyError if one denies it.
+func (s *server) checkPolicy(r *http.Request, generation string, request *SignRequest) error {
+	defer timePhase(r.Context(), phasePolicy)()
+	clients := clientIdentities(r)
+	attrs := s.config.CSRAttributes.checkCSRAttributes(request)
+	if attrs.Allowed {
+		attrs = s.config.Extensions.checkExtensions(clients, request)
+	}
+	if attrs.Allowed {
+		attrs = s.passthrough.checkPassthrough(clients, request)
+	}
+	if attrs.Allowed {
+		attrs = s.config.Keys.checkKeys(clients, request)
+	}
+	event := newHookEvent(r, generation, request)
+	p := s.policyFor(generation)
+	groups, err := s.groupsFor(r.Context(), p, clients)
+	if err != nil {
+		logFor("policy").WithFields(log.Fields{
+			"client": clients,
+			"error":  err,
+		}).Error("Error resolving the directory groups")
+		return errs.New(http.StatusServiceUnavailable, "error resolving the directory groups")
+	}
+	d := p.Evaluate(clients, groups, requestNames(request))
+	if d.Allowed && !attrs.Allowed {
+		attrs.Matched, attrs.Reported = d.Matched, d.Reported
+		d = attrs
+	}
+	if d.Allowed && s.config.DNSCheck.Enabled {
+		dns := s.config.DNSCheck.checkDNS(r.Context(), clients, request)
+		dns.Matched, dns.Reported = d.Matched, d.Reported
+		d = dns
+	}
+	if d.Allowed && s.emails != nil {
+		email := s.emails.checkEmails(clients, request)
+		email.Matched, email.Reported = d.Matched, d.Reported
+		d = email
+	}
+	for _, rd := range d.Reported {
+		policyReportedDenials.WithLabelValues(rd.RuleID, generation, s.tenantFor(clients)).Inc()
+		logFor("policy").WithFields(log.Fields{
+			"client":     clients,
+			"rule":       rd.RuleID,
+			"san":        rd.SAN,
+			"generation": generation,
+		}).Warn("Report-only policy rule would have denied the request")
+	}
+	if d.Allowed {
+		if err := s.checkQuota(clients); err != nil {
+			return err
+		}
+		err := s.hooks.PreSign(r.Context(), event)
+		if err != nil {
+			s.releaseQuota(clients)
+		}
+		if pe, ok := err.(*policyError); ok {
+			logFor("policy").WithFields(log.Fields{
+				"client":     clients,
+				"rule":       pe.RuleID,
+				"reason":     pe.Reason,
+				"generation": generation,
+			}).Warn("Forbidden: request denied by hook")
+			event.Decision = &pe.Decision
+			s.hooks.Fire(hookDenial, event)
+		}
+		return err
+	}
+
+	policyDenials.WithLabelValues(d.RuleID, generation, s.tenantFor(clients)).Inc()
+	logFor("policy").WithFields(log.Fields{
+		"client":     clients,
+		"rule":       d.RuleID,
+		"san":        d.SAN,
+		"generation": generation,
+	}).Warn("Forbidden: request denied by policy")
+	event.Decision = &d
+	s.hooks.Fire(hookDenial, event)
+
+	return &policyError{Decision: d}
+}
+
+// limitNotAfter defaults the lifetime of the request to limit, and fails if
+// the requested one is longer.
+func limitNotAfter(request *SignRequest, limit time.Duration) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	switch {
+	case request.NotAfter.IsZero():
+		request.NotAfter.SetDuration(limit)
+	case request.NotAfter.RelativeTime(now).Sub(now) > limit:
+		return errs.BadRequest("notAfter exceeds the maximum lifetime of %s", limit)
+	}
+
+	return nil
+}
+
+// decodeSignRequest reads and validates the SignRequest in the body of r.
+func decodeSignRequest(r *http.Request) (*SignRequest, error) {
+	var request SignRequest
+	endDecode := timePhase(r.Context(), phaseDecode)
+	err := json.NewDecoder(io.LimitReader(r.Body, maxSignRequestSize)).Decode(&request)
+	endDecode()
+	if err != nil {
+		return nil, errs.BadRequestErr(err, "error reading request body")
+	}
+
+	defer timePhase(r.Context(), phaseValidate)()
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// issue mints a token for the SANs in the CSR and asks the upstream CA to sign
+// it using the given provisioner. The optional templateData is forwarded to
+// the provisioner templates as .Insecure.User, and the notBefore of the
+// request if it was passed through.
+func issue(ctx context.Context, p *ca.Provisioner, request *SignRequest, templateData json.RawMessage) (*api.SignResponse, error) {
+	sans := requestSANs(request)
+	subject := request.CsrPEM.Subject.CommonName
+	if subject == "" {
+		subject = generateSubject(sans)
+	}
+
+	endToken := timePhase(ctx, phaseToken)
+	token, err := signToken(p, subject, sans...)
+	endToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var notBefore api.TimeDuration
+	if request.notBefore {
+		notBefore = request.NotBefore
+	}
+
+	defer timePhase(ctx, phaseUpstream)()
+	resp, err := p.SignWithContext(ctx, &api.SignRequest{
+		CsrPEM:       request.CsrPEM,
+		OTT:          token,
+		NotAfter:     request.NotAfter,
+		NotBefore:    notBefore,
+		TemplateData: templateData,
+	})
+	return resp, upstreamError(ctx, err)
+}
+
+// requestSANs returns the DNS, email, IP and URI SANs in the CSR.
+func requestSANs(request *SignRequest) []string {
+	csr := request.CsrPEM
+	sans := append([]string{}, csr.DNSNames...)
+	sans = append(sans, csr.EmailAddresses...)
+	for _, ip := range csr.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range csr.URIs {
+		sans = append(sans, u.String())
+	}
+
+	return sans
+}
+
+// requestNames returns the SANs in the CSR and its common name, if it is not
+// already one of the SANs.
+func requestNames(request *SignRequest) []string {
+	names := requestSANs(request)
+	if cn := request.CsrPEM.Subject.CommonName; cn != "" && !policy.ContainsAny(names, []string{cn}) {
+		names = append(names, cn)
+	}
+
+	return names
+}
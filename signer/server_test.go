@@ -0,0 +1,182 @@
+package signer
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+func TestEvaluatePolicyOtherIdentities(t *testing.T) {
+	s := &server{config: &Config{
+		Admin: AdminConfig{Clients: []string{"admin"}},
+		Policy: policy.Config{Rules: []policy.Rule{
+			{ID: "web", Action: "allow", Clients: []string{"web"}, SANs: []string{"*.example.com"}},
+		}},
+	}}
+	body := func(ids ...string) string {
+		b, _ := json.Marshal(map[string]interface{}{"csr": newTestCSR(t, "www.example.com"), "identities": ids})
+		return string(b)
+	}
+
+	tests := []struct {
+		name   string
+		client string
+		body   string
+		status int
+	}{
+		{"own identity", "web", body(), http.StatusOK},
+		{"own identity listed", "web", body("web"), http.StatusOK},
+		{"other identity", "other", body("web"), http.StatusForbidden},
+		{"other groups", "web", `{"csr":` + mustJSON(t, newTestCSR(t, "www.example.com")) + `,"groups":["ops"]}`, http.StatusForbidden},
+		{"admin", "admin", body("web"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withIdentities(httptest.NewRequest(http.MethodPost, "/policy/evaluate", strings.NewReader(tt.body)), tt.client)
+			w := httptest.NewRecorder()
+			s.evaluatePolicy(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func mustJSON(t testing.TB, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestIntermediateGrant(t *testing.T) {
+	team := NameConstraints{PermittedDNSDomains: []string{".team.example.com"}}
+	c := IntermediateConfig{
+		AllowedClients:  []string{"pki", "team-ca"},
+		MaxPathLen:      1,
+		NameConstraints: NameConstraints{PermittedDNSDomains: []string{".example.com"}},
+		Delegations:     []Delegation{{Clients: []string{"team-ca"}, NameConstraints: team}},
+	}
+	tests := []struct {
+		client     string
+		ok         bool
+		maxPathLen int
+		domains    []string
+	}{
+		{"pki", true, 1, []string{".example.com"}},
+		{"team-ca", true, 0, []string{".team.example.com"}},
+		{"web", false, 0, nil},
+	}
+	for _, tt := range tests {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign/intermediate", nil), tt.client)
+		maxPathLen, nc, ok := c.grantFor(r)
+		if ok != tt.ok || maxPathLen != tt.maxPathLen || !sameStrings(nc.PermittedDNSDomains, tt.domains) {
+			t.Errorf("%s: grantFor() = %d, %v, %v, want %d, %v, %v", tt.client, maxPathLen, nc.PermittedDNSDomains, ok, tt.maxPathLen, tt.domains, tt.ok)
+		}
+	}
+}
+
+func TestIntermediateTemplateData(t *testing.T) {
+	data := intermediateTemplateData(0, NameConstraints{})
+	if data["isCA"] != true || data["maxPathLen"] != 0 || data["nameConstraints"] != nil {
+		t.Errorf("intermediateTemplateData() without constraints = %v", data)
+	}
+	data = intermediateTemplateData(1, NameConstraints{ExcludedDNSDomains: []string{"prod.example.com"}})
+	nc, _ := data["nameConstraints"].(map[string]interface{})
+	if nc["critical"] != true || !sameStrings(nc["excludedDNSDomains"].([]string), []string{"prod.example.com"}) {
+		t.Errorf("intermediateTemplateData() nameConstraints = %v", nc)
+	}
+}
+
+func TestSignIntermediateRejected(t *testing.T) {
+	s := &server{config: &Config{Intermediate: IntermediateConfig{Enabled: true, AllowedClients: []string{"pki"}}}}
+	tests := []struct {
+		name   string
+		client string
+		body   string
+		status int
+	}{
+		{"not allowed", "web", `{"csr":` + mustJSON(t, newTestCSR(t, "Sub CA")) + `}`, http.StatusForbidden},
+		{"profile", "pki", `{"csr":` + mustJSON(t, newTestCSR(t, "Sub CA")) + `,"profile":"server"}`, http.StatusBadRequest},
+		{"malformed", "pki", `{"csr":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign/intermediate", strings.NewReader(tt.body)), tt.client)
+		w := httptest.NewRecorder()
+		s.signIntermediate(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestSignIntermediate(t *testing.T) {
+	team := NameConstraints{PermittedDNSDomains: []string{".team.example.com"}}
+	c := IntermediateConfig{
+		Enabled:        true,
+		AllowedClients: []string{"pki"},
+		MaxPathLen:     1,
+		Delegations:    []Delegation{{Clients: []string{"team-ca"}, NameConstraints: team}},
+	}
+	honoring := newTestUpstreamWithOptions(t, &provisioner.Options{X509: &provisioner.X509Options{Template: testCATemplate}})
+	ignoring := newTestUpstream(t)
+
+	tests := []struct {
+		name       string
+		upstream   *testUpstream
+		client     string
+		require    bool
+		status     int
+		maxPathLen int
+		domains    []string
+	}{
+		{"path length", honoring, "pki", false, http.StatusCreated, 1, nil},
+		{"delegation", honoring, "team-ca", false, http.StatusCreated, 0, []string{".team.example.com"}},
+		{"required constraints", honoring, "team-ca", true, http.StatusCreated, 0, []string{".team.example.com"}},
+		{"required constraints missing", honoring, "pki", true, http.StatusForbidden, 0, nil},
+		{"template ignored", ignoring, "pki", false, http.StatusBadGateway, 0, nil},
+		{"constraints ignored", ignoring, "team-ca", false, http.StatusBadGateway, 0, nil},
+	}
+	for _, tt := range tests {
+		c.RequireConstraints = tt.require
+		s := &server{
+			config:       &Config{Intermediate: c},
+			hooks:        newHookRunner(nil),
+			intermediate: tt.upstream.provisioner,
+			trustedRoots: []*x509.Certificate{tt.upstream.root},
+		}
+		before := len(tt.upstream.revocations())
+		body := `{"csr":` + mustJSON(t, newTestCSR(t, "Sub CA")) + `,"notAfter":"1h"}`
+		r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign/intermediate", strings.NewReader(body)), tt.client)
+		w := httptest.NewRecorder()
+		s.signIntermediate(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if revoked := len(tt.upstream.revocations()) - before; revoked != map[bool]int{true: 1}[tt.status == http.StatusBadGateway] {
+			t.Errorf("%s: %d certificates revoked", tt.name, revoked)
+		}
+		if tt.status != http.StatusCreated {
+			continue
+		}
+		var resp api.SignResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		cert := resp.ServerPEM.Certificate
+		if !cert.IsCA || cert.MaxPathLen != tt.maxPathLen || !sameStrings(cert.PermittedDNSDomains, tt.domains) {
+			t.Errorf("%s: issued CA %v, path length %d, domains %v", tt.name, cert.IsCA, cert.MaxPathLen, cert.PermittedDNSDomains)
+		}
+	}
+}
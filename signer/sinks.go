@@ -0,0 +1,218 @@
+package signer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// LogOutputConfig configures a log sink. Type is stdout, stderr, file, syslog
+// or journald.
+type LogOutputConfig struct {
+	Type string `yaml:"type"`
+
+	// File options.
+	Path        string `yaml:"path"`
+	MaxSizeMB   int    `yaml:"maxSizeMB"`
+	RotateEvery string `yaml:"rotateEvery"`
+	MaxBackups  int    `yaml:"maxBackups"`
+
+	// Syslog options, an empty network uses the local syslog.
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+// GetTag returns the syslog tag and journald identifier, defaults to
+// "ca-signer".
+func (c LogOutputConfig) GetTag() string {
+	if c.Tag != "" {
+		return c.Tag
+	}
+
+	return "ca-signer"
+}
+
+// Validate checks the output type and options.
+func (c LogOutputConfig) Validate() error {
+	switch c.Type {
+	case "stdout", "stderr", "syslog", "journald":
+		return nil
+	case "file":
+		if c.Path == "" {
+			return errors.New("file log output requires a path")
+		}
+		if c.RotateEvery != "" {
+			if _, err := time.ParseDuration(c.RotateEvery); err != nil {
+				return errors.Wrap(err, "invalid file log output rotateEvery")
+			}
+		}
+		return nil
+	default:
+		return errors.Errorf("invalid log output type %q", c.Type)
+	}
+}
+
+// logSink receives formatted log entries.
+type logSink interface {
+	Write(level log.Level, b []byte) error
+}
+
+// newLogSink opens the sink of an output.
+func newLogSink(c LogOutputConfig) (logSink, error) {
+	switch c.Type {
+	case "stdout":
+		return writerSink{os.Stdout}, nil
+	case "stderr":
+		return writerSink{os.Stderr}, nil
+	case "file":
+		return newRotatingFile(c)
+	case "syslog":
+		return newSyslogSink(c)
+	case "journald":
+		return newJournaldSink(c)
+	default:
+		return nil, errors.Errorf("invalid log output type %q", c.Type)
+	}
+}
+
+type writerSink struct {
+	w *os.File
+}
+
+func (s writerSink) Write(_ log.Level, b []byte) error {
+	_, err := s.w.Write(b)
+	return err
+}
+
+// dispatchFormatter formats the entries once and writes them to every sink.
+// It returns no bytes, so the logger output itself is unused.
+type dispatchFormatter struct {
+	next  log.Formatter
+	sinks []logSink
+}
+
+func (f *dispatchFormatter) Format(e *log.Entry) ([]byte, error) {
+	b, err := f.next.Format(e)
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+
+	for _, s := range f.sinks {
+		if err := s.Write(e.Level, b); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing log entry: %v\n", err)
+		}
+	}
+
+	return nil, nil
+}
+
+// rotatingFile is a log file rotated when it reaches a size or age. Rotated
+// files get a timestamp suffix, and only maxBackups of them are kept.
+type rotatingFile struct {
+	path        string
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newRotatingFile(c LogOutputConfig) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       c.Path,
+		maxSize:    int64(c.MaxSizeMB) * 1024 * 1024,
+		maxBackups: c.MaxBackups,
+	}
+	if c.RotateEvery != "" {
+		r.rotateEvery, _ = time.ParseDuration(c.RotateEvery)
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) Write(_ log.Level, b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if (r.maxSize > 0 && r.size+int64(len(b)) > r.maxSize) ||
+		(r.rotateEvery > 0 && time.Since(r.openedAt) > r.rotateEvery) {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return errors.Wrap(err, "error opening log file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size, r.openedAt = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	backup := r.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return errors.Wrap(err, "error rotating log file")
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	if r.maxBackups > 0 {
+		backups, _ := filepath.Glob(r.path + ".*")
+		sort.Strings(backups)
+		for len(backups) > r.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+
+	return nil
+}
+
+// journaldPriority returns the syslog priority of a level.
+func journaldPriority(level log.Level) int {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return 2
+	case log.ErrorLevel:
+		return 3
+	case log.WarnLevel:
+		return 4
+	case log.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func trimNewline(b []byte) string {
+	return strings.TrimRight(string(b), "\n")
+}
@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package signer
+
+import (
+	"github.com/pkg/errors"
+)
+
+func newSyslogSink(LogOutputConfig) (logSink, error) {
+	return nil, errors.New("syslog log output is not supported on this platform")
+}
+
+func newJournaldSink(LogOutputConfig) (logSink, error) {
+	return nil, errors.New("journald log output is not supported on this platform")
+}
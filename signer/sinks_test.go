@@ -0,0 +1,87 @@
+package signer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogOutputConfigValidate(t *testing.T) {
+	tests := []struct {
+		c  LogOutputConfig
+		ok bool
+	}{
+		{LogOutputConfig{Type: "stdout"}, true},
+		{LogOutputConfig{Type: "journald"}, true},
+		{LogOutputConfig{Type: "file", Path: "/var/log/ca-signer.log", RotateEvery: "24h"}, true},
+		{LogOutputConfig{Type: "file"}, false},
+		{LogOutputConfig{Type: "file", Path: "/var/log/ca-signer.log", RotateEvery: "daily"}, false},
+		{LogOutputConfig{Type: "kafka"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v, want ok %v", tt.c, err, tt.ok)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca-signer.log")
+	r, err := newRotatingFile(LogOutputConfig{Type: "file", Path: path, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.maxSize = 10
+
+	for _, line := range []string{"entry 1\n", "entry 2\n", "entry 3\n", "entry 4\n"} {
+		if err := r.Write(log.InfoLevel, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		// The backups are named after the rotation time in milliseconds.
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "entry 4\n" {
+		t.Errorf("log file = %q, want the last entry", data)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want 2", backups)
+	}
+	if data, _ := os.ReadFile(backups[1]); string(data) != "entry 3\n" {
+		t.Errorf("latest backup = %q, want %q", data, "entry 3\n")
+	}
+}
+
+type recordingSink struct {
+	levels  []log.Level
+	entries []string
+}
+
+func (s *recordingSink) Write(level log.Level, b []byte) error {
+	s.levels = append(s.levels, level)
+	s.entries = append(s.entries, string(b))
+	return nil
+}
+
+func TestDispatchFormatter(t *testing.T) {
+	a, b := &recordingSink{}, &recordingSink{}
+	f := &dispatchFormatter{next: &log.TextFormatter{DisableTimestamp: true}, sinks: []logSink{a, b}}
+	out, err := f.Format(&log.Entry{Logger: log.New(), Level: log.WarnLevel, Message: "upstream slow"})
+	if err != nil || len(out) != 0 {
+		t.Fatalf("Format() = %q, %v, want no output", out, err)
+	}
+	for _, s := range []*recordingSink{a, b} {
+		if len(s.entries) != 1 || s.levels[0] != log.WarnLevel || !strings.Contains(s.entries[0], "upstream slow") {
+			t.Errorf("sink got %q at %v, want the warning", s.entries, s.levels)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//go:build !windows && !plan9
+
+package signer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/syslog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(c LogOutputConfig) (logSink, error) {
+	w, err := syslog.Dial(c.Network, c.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, c.GetTag())
+	if err != nil {
+		return nil, errors.Wrap(err, "error connecting to syslog")
+	}
+
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(level log.Level, b []byte) error {
+	msg := trimNewline(b)
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return s.w.Crit(msg)
+	case log.ErrorLevel:
+		return s.w.Err(msg)
+	case log.WarnLevel:
+		return s.w.Warning(msg)
+	case log.InfoLevel:
+		return s.w.Info(msg)
+	default:
+		return s.w.Debug(msg)
+	}
+}
+
+// journaldSink writes entries to journald using its native protocol.
+type journaldSink struct {
+	conn *net.UnixConn
+	tag  string
+}
+
+func newJournaldSink(c LogOutputConfig) (logSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.Wrap(err, "error connecting to journald")
+	}
+
+	return &journaldSink{conn: conn, tag: c.GetTag()}, nil
+}
+
+func (s *journaldSink) Write(level log.Level, b []byte) error {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "MESSAGE", trimNewline(b))
+	writeJournaldField(&buf, "PRIORITY", strconv.Itoa(journaldPriority(level)))
+	writeJournaldField(&buf, "SYSLOG_IDENTIFIER", s.tag)
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// writeJournaldField encodes a field, using the binary form for values with
+// newlines.
+func writeJournaldField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
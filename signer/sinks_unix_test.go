@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package signer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteJournaldField(t *testing.T) {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "PRIORITY", "6")
+	writeJournaldField(&buf, "MESSAGE", "a\nb")
+	want := "PRIORITY=6\nMESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if got := buf.String(); got != want {
+		t.Errorf("writeJournaldField() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,201 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// SMIMEConfig configures POST /sign/smime, which generates a key and an
+// S/MIME certificate for an email address and returns them as PKCS#12.
+type SMIMEConfig struct {
+	Enabled             bool     `yaml:"enabled"`
+	Domains             []string `yaml:"domains"`
+	RequireVerification *bool    `yaml:"requireVerification"`
+	KeyType             string   `yaml:"keyType"`
+	Duration            string   `yaml:"duration"`
+	LegacyPKCS12        bool     `yaml:"legacyPKCS12"`
+}
+
+// GetRequireVerification returns whether the address must be verified with
+// the email verification flow first, defaults to true.
+func (c SMIMEConfig) GetRequireVerification() bool {
+	return c.RequireVerification == nil || *c.RequireVerification
+}
+
+// GetKeyType returns the type of the generated keys, "RSA" (default, 2048
+// bits, for mail client compatibility) or "EC" (P-256).
+func (c SMIMEConfig) GetKeyType() string {
+	if c.KeyType != "" {
+		return c.KeyType
+	}
+
+	return "RSA"
+}
+
+// Validate checks the key type and the email verification requirement.
+func (c SMIMEConfig) Validate(emails EmailVerificationConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Domains) == 0 {
+		return errors.New("smime requires a list of domains")
+	}
+	if t := c.GetKeyType(); t != "RSA" && t != "EC" {
+		return errors.Errorf("invalid smime keyType %q", t)
+	}
+	if c.Duration != "" {
+		if _, err := time.ParseDuration(c.Duration); err != nil {
+			return errors.Wrap(err, "invalid smime duration")
+		}
+	}
+	if c.GetRequireVerification() && !emails.Enabled {
+		return errors.New("smime requires emailVerification to be enabled, or requireVerification set to false")
+	}
+
+	return nil
+}
+
+// smimeTemplateData is passed to the upstream provisioner template as
+// .Insecure.User when signing S/MIME certificates.
+func smimeTemplateData() map[string]interface{} {
+	return map[string]interface{}{
+		"profile":     "smime",
+		"keyUsage":    []string{"digitalSignature", "keyEncipherment"},
+		"extKeyUsage": []string{"emailProtection"},
+	}
+}
+
+// SMIMERequest is the body of POST /sign/smime.
+type SMIMERequest struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// signSMIME generates a key and issues an S/MIME certificate for the email
+// address in the request. The key, certificate and chain are returned as a
+// PKCS#12 file encrypted with the password in the request.
+func (s *server) signSMIME(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config.SMIME
+	var body SMIMERequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	i := strings.LastIndex(email, "@")
+	if i <= 0 {
+		render.Error(w, r, errs.BadRequest("invalid email address"))
+		return
+	}
+	if !inZones(email[i+1:], cfg.Domains) {
+		render.Error(w, r, errs.Forbidden("email domain is not allowed for S/MIME certificates"))
+		return
+	}
+	if len(body.Password) < 8 {
+		render.Error(w, r, errs.BadRequest("password must have at least 8 characters"))
+		return
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = email
+	}
+	key, csr, err := newKeyAndRequest(cfg.GetKeyType(), name, []string{email})
+	if err != nil {
+		render.Error(w, r, err)
+		return
+	}
+	request := &SignRequest{CsrPEM: api.CertificateRequest{CertificateRequest: csr}}
+	if d, err := time.ParseDuration(cfg.Duration); err == nil {
+		request.NotAfter.SetDuration(d)
+	}
+
+	generation := s.generationFor(r)
+	if err := s.checkPolicy(r, generation, request); err != nil {
+		render.Error(w, r, err)
+		return
+	}
+
+	data, err := json.Marshal(smimeTemplateData())
+	if err != nil {
+		s.releaseQuota(clientIdentities(r))
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.Timeouts.GetSign())
+	defer cancel()
+
+	resp, err := s.issueWith(ctx, s.upstreamFor(generation), request, data)
+	if err != nil {
+		s.releaseQuota(clientIdentities(r))
+		render.Error(w, r, err)
+		return
+	}
+
+	cert := resp.ServerPEM.Certificate
+	if !hasExtKeyUsage(cert, x509.ExtKeyUsageEmailProtection) {
+		logFor("server").Error("Upstream CA did not set the emailProtection extended key usage")
+		render.Error(w, r, errs.New(http.StatusBadGateway, "upstream CA did not apply the S/MIME profile"))
+		return
+	}
+
+	chain := caCertificates(cert, resp.CertChainPEM)
+	encoder := pkcs12.Modern
+	if cfg.LegacyPKCS12 {
+		encoder = pkcs12.LegacyRC2
+	}
+	pfx, err := encoder.Encode(key, cert, chain, body.Password)
+	if err != nil {
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	logFor("server").WithFields(log.Fields{
+		"client": clientIdentities(r),
+		"email":  email,
+		"serial": cert.SerialNumber.String(),
+	}).Info("Issued S/MIME certificate")
+	s.issued(newHookEvent(r, generation, request), resp)
+
+	s.setCertificateHeaders(w, resp)
+	w.Header().Set("Content-Type", "application/x-pkcs12")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+email+`.p12"`)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(pfx)
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+
+	return false
+}
+
+// caCertificates returns the certificates of chain other than the leaf cert.
+func caCertificates(cert *x509.Certificate, chain []api.Certificate) []*x509.Certificate {
+	var cas []*x509.Certificate
+	for _, c := range chain {
+		if !c.Certificate.Equal(cert) {
+			cas = append(cas, c.Certificate)
+		}
+	}
+
+	return cas
+}
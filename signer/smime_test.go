@@ -0,0 +1,25 @@
+package signer
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/smallstep/certificates/api"
+)
+
+func TestCACertificates(t *testing.T) {
+	leaf, _ := newTestCert(t, "alice@example.com")
+	ca, _ := newTestCert(t, "Intermediate CA")
+
+	// The chain is decoded from the response, its leaf is a copy of cert.
+	copied, err := x509.ParseCertificate(leaf.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := []api.Certificate{{Certificate: copied}, {Certificate: ca}}
+
+	cas := caCertificates(leaf, chain)
+	if len(cas) != 1 || !cas[0].Equal(ca) {
+		t.Fatalf("caCertificates() = %d certificates, want only the intermediate", len(cas))
+	}
+}
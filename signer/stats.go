@@ -0,0 +1,255 @@
+package signer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// countSign counts a sign request in the metrics and, for failed requests,
+// in the daily failure counters of the inventory.
+func (s *server) countSign(clients []string, generation, result string, err error) {
+	signRequests.WithLabelValues(generation, result, s.tenantFor(clients)).Inc()
+	if err == nil || s.inventory == nil {
+		return
+	}
+
+	s.inventory.RecordFailure(time.Now(), errorCause(err))
+}
+
+// errorCause returns a short cause for a failed request: the policy rule of a
+// denial, or the HTTP status of other errors.
+func errorCause(err error) string {
+	var pe *policyError
+	if errors.As(err, &pe) {
+		return "denied: " + pe.RuleID
+	}
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		return "quota: " + qe.Team
+	}
+	var sc render.StatusCodedError
+	if errors.As(err, &sc) {
+		return strconv.Itoa(sc.StatusCode()) + " " + http.StatusText(sc.StatusCode())
+	}
+
+	return "500 " + http.StatusText(http.StatusInternalServerError)
+}
+
+// failureFlushInterval is the interval between the writes of the failure
+// counters to the store.
+const failureFlushInterval = 10 * time.Second
+
+// failureCounts are the failures counted in memory until they are flushed to
+// the store, so a burst of failed requests does not take a write transaction
+// per request.
+type failureCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// RecordFailure counts a failure cause on the day of t. The count is written
+// to the store by the next FlushFailures.
+func (inv *inventory) RecordFailure(t time.Time, cause string) {
+	key := t.UTC().Format(time.DateOnly) + "\x00" + cause
+	inv.failures.mu.Lock()
+	defer inv.failures.mu.Unlock()
+	if inv.failures.counts == nil {
+		inv.failures.counts = map[string]uint64{}
+	}
+	inv.failures.counts[key]++
+}
+
+// FlushFailures adds the failures counted since the last flush to the
+// counters in the store. They are kept for the next flush if it fails.
+func (inv *inventory) FlushFailures(context.Context) error {
+	inv.failures.mu.Lock()
+	counts := inv.failures.counts
+	inv.failures.counts = nil
+	inv.failures.mu.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	err := inv.update(func(tx store.Tx) error {
+		b := tx.Bucket(failuresBucket)
+		for key, inc := range counts {
+			var n uint64
+			if v := b.Get([]byte(key)); len(v) == 8 {
+				n = binary.BigEndian.Uint64(v)
+			}
+			if err := b.Put([]byte(key), binary.BigEndian.AppendUint64(nil, n+inc)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		inv.failures.mu.Lock()
+		if inv.failures.counts == nil {
+			inv.failures.counts = map[string]uint64{}
+		}
+		for key, inc := range counts {
+			inv.failures.counts[key] += inc
+		}
+		inv.failures.mu.Unlock()
+		inventoryErrors.Inc()
+		return errors.Wrap(err, "error recording failures in the inventory")
+	}
+
+	return nil
+}
+
+// issuanceStats are the aggregate statistics returned by GET /stats.
+type issuanceStats struct {
+	From                   time.Time        `json:"from"`
+	To                     time.Time        `json:"to"`
+	Total                  int              `json:"total"`
+	ByDay                  map[string]int   `json:"byDay"`
+	ByRequester            map[string]int   `json:"byRequester"`
+	ByDomain               map[string]int   `json:"byDomain"`
+	AverageLifetimeSeconds float64          `json:"averageLifetimeSeconds"`
+	TopErrors              []errorCauseStat `json:"topErrors"`
+}
+
+type errorCauseStat struct {
+	Cause string `json:"cause"`
+	Count int    `json:"count"`
+}
+
+// Stats aggregates the certificates issued and the failures since from.
+// Requesters are the first identity of the client, and domains the
+// registrable domain of the DNS SANs.
+func (inv *inventory) Stats(from, to time.Time) (*issuanceStats, error) {
+	st := &issuanceStats{
+		From:        from,
+		To:          to,
+		ByDay:       map[string]int{},
+		ByRequester: map[string]int{},
+		ByDomain:    map[string]int{},
+		TopErrors:   []errorCauseStat{},
+	}
+
+	var lifetime time.Duration
+	err := inv.view(func(tx store.Tx) error {
+		err := tx.Bucket(certificatesBucket).ForEach(func(_, v []byte) error {
+			var rec certificateRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			issued := rec.Metadata.IssuedAt
+			if issued.Before(from) || issued.After(to) || rec.Metadata.PrimarySerial != "" {
+				return nil
+			}
+
+			st.Total++
+			st.ByDay[issued.UTC().Format(time.DateOnly)]++
+			requester := "unknown"
+			if len(rec.Metadata.Client) > 0 {
+				requester = rec.Metadata.Client[0]
+			}
+			st.ByRequester[requester]++
+			for _, d := range registrableDomains(rec.SANs) {
+				st.ByDomain[d]++
+			}
+			lifetime += rec.NotAfter.Sub(rec.NotBefore)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		causes := map[string]int{}
+		err = tx.Bucket(failuresBucket).ForEach(func(k, v []byte) error {
+			day, cause, ok := strings.Cut(string(k), "\x00")
+			if ok && len(v) == 8 && day >= from.UTC().Format(time.DateOnly) && day <= to.UTC().Format(time.DateOnly) {
+				causes[cause] += int(binary.BigEndian.Uint64(v))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for cause, n := range causes {
+			st.TopErrors = append(st.TopErrors, errorCauseStat{Cause: cause, Count: n})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if st.Total > 0 {
+		st.AverageLifetimeSeconds = lifetime.Seconds() / float64(st.Total)
+	}
+	sort.Slice(st.TopErrors, func(i, j int) bool {
+		if st.TopErrors[i].Count != st.TopErrors[j].Count {
+			return st.TopErrors[i].Count > st.TopErrors[j].Count
+		}
+		return st.TopErrors[i].Cause < st.TopErrors[j].Cause
+	})
+	if len(st.TopErrors) > 10 {
+		st.TopErrors = st.TopErrors[:10]
+	}
+
+	return st, nil
+}
+
+// registrableDomains returns the distinct registrable domains of the DNS
+// names in sans.
+func registrableDomains(sans []string) []string {
+	var domains []string
+	for _, san := range sans {
+		if strings.ContainsAny(san, "@:/") || strings.Count(san, ".") == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(san, "*.")
+		d, err := publicsuffix.EffectiveTLDPlusOne(name)
+		if err != nil {
+			d = name
+		}
+		if !slices.Contains(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+
+	return domains
+}
+
+// stats returns the issuance statistics of the last days, 30 by default.
+func (s *server) stats(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 3660 {
+			render.Error(w, r, errs.BadRequest("invalid days %q", v))
+			return
+		}
+		days = n
+	}
+
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -days)
+	st, err := s.inventory.Stats(from, to)
+	if err != nil {
+		logFor("inventory").WithField("error", err).Error("Error computing stats")
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	render.JSON(w, r, st)
+}
@@ -0,0 +1,59 @@
+package signer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlushFailures(t *testing.T) {
+	inv := newTestInventory(t)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		inv.RecordFailure(now, "denied: internal")
+	}
+	inv.RecordFailure(now, "502 Bad Gateway")
+
+	st, err := inv.Stats(now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.TopErrors) != 0 {
+		t.Fatalf("TopErrors = %v before the flush, want none", st.TopErrors)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := inv.FlushFailures(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		inv.RecordFailure(now, "502 Bad Gateway")
+	}
+	st, err = inv.Stats(now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []errorCauseStat{{Cause: "denied: internal", Count: 3}, {Cause: "502 Bad Gateway", Count: 2}}
+	if !reflect.DeepEqual(st.TopErrors, want) {
+		t.Fatalf("TopErrors = %v, want %v", st.TopErrors, want)
+	}
+}
+
+func TestFlushFailuresError(t *testing.T) {
+	inv := &inventory{store: failingStore{}}
+	inv.RecordFailure(time.Now(), "502 Bad Gateway")
+	if err := inv.FlushFailures(context.Background()); err == nil {
+		t.Fatal("FlushFailures() error = nil, want the store error")
+	}
+	if len(inv.failures.counts) != 1 {
+		t.Fatalf("failures = %v, want the count kept for the next flush", inv.failures.counts)
+	}
+}
+
+func TestRegistrableDomains(t *testing.T) {
+	got := registrableDomains([]string{"a.example.com", "*.b.example.com", "example.co.uk", "x.example.co.uk", "user@example.com", "localhost"})
+	want := []string{"example.com", "example.co.uk"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("registrableDomains() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,225 @@
+package signer
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/linkedca"
+	"go.step.sm/crypto/pemutil"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Operations of the step-ca admin API proxied by the signer.
+const (
+	stepAdminListProvisioners = "listProvisioners"
+	stepAdminGetPolicy        = "getPolicy"
+	stepAdminUpdatePolicy     = "updatePolicy"
+)
+
+// maxStepPolicySize is the maximum size of a policy update.
+const maxStepPolicySize = 1 << 20
+
+// StepAdminConfig proxies selected operations of the step-ca admin API
+// under /admin/step, so the admin clients of the signer manage the upstream
+// CA through the signer. The signer authenticates to step-ca as the admin
+// of the certificate, issued by an x5c provisioner of the CA; the files are
+// read on every operation so the certificate can be renewed in place.
+type StepAdminConfig struct {
+	CertFile     string   `yaml:"certFile"`
+	KeyFile      string   `yaml:"keyFile"`
+	PasswordFile string   `yaml:"passwordFile"`
+	Operations   []string `yaml:"operations"`
+}
+
+// Enabled returns true if the admin API of step-ca is proxied.
+func (c StepAdminConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// Validate checks the admin credentials and the operations.
+func (c StepAdminConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.KeyFile == "" {
+		return errors.New("stepAdmin requires a keyFile")
+	}
+	if len(c.Operations) == 0 {
+		return errors.New("stepAdmin requires operations")
+	}
+	for _, op := range c.Operations {
+		switch op {
+		case stepAdminListProvisioners, stepAdminGetPolicy, stepAdminUpdatePolicy:
+		default:
+			return errors.Errorf("invalid stepAdmin operation %q, must be listProvisioners, getPolicy or updatePolicy", op)
+		}
+	}
+
+	return nil
+}
+
+// allows returns true if the operation is proxied.
+func (c StepAdminConfig) allows(op string) bool {
+	return slices.Contains(c.Operations, op)
+}
+
+// stepAdminClient returns a client of the step-ca admin API authenticated
+// with the admin certificate.
+func (s *server) stepAdminClient() (*ca.AdminClient, error) {
+	c := s.config.StepAdmin
+	certs, err := pemutil.ReadCertificateBundle(c.CertFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading stepAdmin certFile")
+	}
+	var opts []pemutil.Options
+	if c.PasswordFile != "" {
+		opts = append(opts, pemutil.WithPasswordFile(c.PasswordFile))
+	}
+	key, err := pemutil.Read(c.KeyFile, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading stepAdmin keyFile")
+	}
+	rootOption, err := upstreamRootOption(s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	return ca.NewAdminClient(s.config.CaURL, rootOption, ca.WithAdminX5C(certs, key, ""))
+}
+
+// stepAdminError maps an error of the step-ca admin API to the response of
+// the signer: the client errors of step-ca are returned as they are, the
+// others are upstream failures.
+func stepAdminError(err error) error {
+	var adminErr *ca.AdminClientError
+	if errors.As(err, &adminErr) {
+		switch adminErr.Type {
+		case "badRequest":
+			return errs.BadRequest("%s", adminErr.Message)
+		case "notFound", "deleted":
+			return errs.NotFound("%s", adminErr.Message)
+		case "conflict":
+			return errs.New(http.StatusConflict, "%s", adminErr.Message)
+		}
+	}
+
+	return errs.New(http.StatusBadGateway, "step-ca admin API error")
+}
+
+// stepAdmin runs an operation of the step-ca admin API for an admin client,
+// if the operation is proxied, and audits it.
+func (s *server) stepAdmin(op string, fn func(*ca.AdminClient, *http.Request) (any, log.Fields, error)) http.HandlerFunc {
+	return s.admin(func(w http.ResponseWriter, r *http.Request) {
+		if !s.config.StepAdmin.allows(op) {
+			render.Error(w, r, errs.Forbidden("step-ca admin operation %s is not allowed", op))
+			return
+		}
+		fields := log.Fields{
+			"requestId": requestID(r),
+			"client":    clientIdentities(r),
+			"operation": op,
+		}
+		client, err := s.stepAdminClient()
+		var result any
+		var audit log.Fields
+		if err != nil {
+			err = errs.InternalServerErr(err)
+		} else {
+			result, audit, err = fn(client, r)
+		}
+		for k, v := range audit {
+			fields[k] = v
+		}
+		if err != nil {
+			stepAdminOperations.WithLabelValues(op, "error").Inc()
+			fields["error"] = err
+			logFor("audit").WithFields(fields).Warn("Failed step-ca admin operation")
+			if _, ok := err.(*errs.Error); !ok {
+				err = stepAdminError(err)
+			}
+			render.Error(w, r, err)
+			return
+		}
+		stepAdminOperations.WithLabelValues(op, "success").Inc()
+		level := log.InfoLevel
+		if op == stepAdminUpdatePolicy {
+			level = log.WarnLevel
+		}
+		logFor("audit").WithFields(fields).Log(level, "Ran step-ca admin operation")
+
+		if m, ok := result.(*linkedca.Policy); ok {
+			b, err := protojson.Marshal(m)
+			if err != nil {
+				render.Error(w, r, errs.InternalServerErr(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+			return
+		}
+		render.JSON(w, r, result)
+	})
+}
+
+// listStepProvisioners returns the provisioners of step-ca, with their
+// admin-only details.
+func (s *server) listStepProvisioners(client *ca.AdminClient, r *http.Request) (any, log.Fields, error) {
+	provisioners, err := client.GetProvisioners()
+	return provisioners, nil, err
+}
+
+// getStepPolicy returns the policy of the authority, or of the provisioner
+// in the path.
+func (s *server) getStepPolicy(client *ca.AdminClient, r *http.Request) (any, log.Fields, error) {
+	if name := r.PathValue("name"); name != "" {
+		p, err := client.GetProvisionerPolicy(name)
+		return p, log.Fields{"provisioner": name}, err
+	}
+	p, err := client.GetAuthorityPolicy()
+	return p, nil, err
+}
+
+// putStepPolicy sets the policy of the authority, or of the provisioner in
+// the path, to the policy of the body in the JSON format of step-ca. The
+// previous and new policies are audited.
+func (s *server) putStepPolicy(client *ca.AdminClient, r *http.Request) (any, log.Fields, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxStepPolicySize))
+	if err != nil {
+		return nil, nil, errs.BadRequestErr(err, "error reading request body")
+	}
+	policy := new(linkedca.Policy)
+	if err := protojson.Unmarshal(body, policy); err != nil {
+		return nil, nil, errs.BadRequestErr(err, "invalid step-ca policy: %v", err)
+	}
+
+	name := r.PathValue("name")
+	get, create, update := client.GetAuthorityPolicy, client.CreateAuthorityPolicy, client.UpdateAuthorityPolicy
+	fields := log.Fields{"policy": string(body)}
+	if name != "" {
+		fields["provisioner"] = name
+		get = func() (*linkedca.Policy, error) { return client.GetProvisionerPolicy(name) }
+		create = func(p *linkedca.Policy) (*linkedca.Policy, error) { return client.CreateProvisionerPolicy(name, p) }
+		update = func(p *linkedca.Policy) (*linkedca.Policy, error) { return client.UpdateProvisionerPolicy(name, p) }
+	}
+
+	// step-ca distinguishes creating a policy from updating it.
+	previous, err := get()
+	var adminErr *ca.AdminClientError
+	switch {
+	case err == nil:
+		b, _ := protojson.Marshal(previous)
+		fields["previous"] = string(b)
+		policy, err = update(policy)
+	case errors.As(err, &adminErr) && adminErr.Type == "notFound" && strings.HasSuffix(adminErr.Message, "policy does not exist"):
+		policy, err = create(policy)
+	}
+
+	return policy, fields, err
+}
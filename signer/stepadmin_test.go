@@ -0,0 +1,195 @@
+package signer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/smallstep/certificates/ca"
+)
+
+func TestStepAdminConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    StepAdminConfig
+		ok   bool
+	}{
+		{"disabled", StepAdminConfig{}, true},
+		{"valid", StepAdminConfig{CertFile: "admin.crt", KeyFile: "admin.key", Operations: []string{stepAdminListProvisioners, stepAdminGetPolicy, stepAdminUpdatePolicy}}, true},
+		{"no key", StepAdminConfig{CertFile: "admin.crt", Operations: []string{stepAdminGetPolicy}}, false},
+		{"no operations", StepAdminConfig{CertFile: "admin.crt", KeyFile: "admin.key"}, false},
+		{"operation", StepAdminConfig{CertFile: "admin.crt", KeyFile: "admin.key", Operations: []string{"removeAdmin"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestStepAdminError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&ca.AdminClientError{Type: "badRequest", Message: "invalid policy"}, http.StatusBadRequest},
+		{&ca.AdminClientError{Type: "notFound", Message: "provisioner not found"}, http.StatusNotFound},
+		{&ca.AdminClientError{Type: "conflict", Message: "policy exists"}, http.StatusConflict},
+		{&ca.AdminClientError{Type: "unauthorized", Message: "bad token"}, http.StatusBadGateway},
+		{io.ErrUnexpectedEOF, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		if got := errorStatus(stepAdminError(tt.err)); got != tt.status {
+			t.Errorf("stepAdminError(%v) status = %d, want %d", tt.err, got, tt.status)
+		}
+	}
+}
+
+// fakeStepAdmin is a step-ca admin API with an authority policy, and a
+// provisioner without policy.
+type fakeStepAdmin struct {
+	*httptest.Server
+	policy string
+	writes []string
+}
+
+func newFakeStepAdmin(t *testing.T) (*fakeStepAdmin, *Config) {
+	t.Helper()
+	root, rootKey := newTestCert(t, "Test Root CA")
+	serverCert, serverKey := issueTestCert(t, root, rootKey, "127.0.0.1", false)
+	admin, adminKey := issueTestCert(t, root, rootKey, "admin", false)
+
+	f := &fakeStepAdmin{}
+	mux := http.NewServeMux()
+	adminError := func(w http.ResponseWriter, status int, typ, message string) {
+		w.WriteHeader(status)
+		io.WriteString(w, `{"type":"`+typ+`","message":"`+message+`"}`)
+	}
+	mux.HandleFunc("GET /admin/provisioners", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"provisioners":[{"type":"ACME","name":"acme"}],"nextCursor":""}`)
+	})
+	mux.HandleFunc("/admin/policy", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && f.policy == "":
+			adminError(w, http.StatusNotFound, "notFound", "authority policy does not exist")
+		case r.Method == http.MethodGet:
+			io.WriteString(w, f.policy)
+		case r.Method == http.MethodPost && f.policy != "", r.Method == http.MethodPut && f.policy == "":
+			adminError(w, http.StatusConflict, "conflict", "unexpected "+r.Method)
+		default:
+			b, _ := io.ReadAll(r.Body)
+			f.policy = string(b)
+			f.writes = append(f.writes, r.Method)
+			io.WriteString(w, f.policy)
+		}
+	})
+	mux.HandleFunc("/admin/provisioners/{name}/policy", func(w http.ResponseWriter, r *http.Request) {
+		adminError(w, http.StatusNotFound, "notFound", "provisioner "+r.PathValue("name")+" not found")
+	})
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			adminError(w, http.StatusUnauthorized, "unauthorized", "missing token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	f.TLS = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+	}
+	f.StartTLS()
+	t.Cleanup(f.Close)
+
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalECPrivateKey(adminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		CaURL:      f.URL,
+		RootCAPath: filepath.Join(dir, "root_ca.crt"),
+		Admin:      AdminConfig{Clients: []string{"admin"}},
+		StepAdmin: StepAdminConfig{
+			CertFile:   filepath.Join(dir, "admin.crt"),
+			KeyFile:    filepath.Join(dir, "admin.key"),
+			Operations: []string{stepAdminListProvisioners, stepAdminGetPolicy, stepAdminUpdatePolicy},
+		},
+	}
+	for name, block := range map[string]*pem.Block{
+		config.RootCAPath:         {Type: "CERTIFICATE", Bytes: root.Raw},
+		config.StepAdmin.CertFile: {Type: "CERTIFICATE", Bytes: admin.Raw},
+		config.StepAdmin.KeyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := writeFile(name, string(pem.EncodeToMemory(block))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return f, config
+}
+
+func TestStepAdmin(t *testing.T) {
+	f, config := newFakeStepAdmin(t)
+	s := &server{config: config}
+	handlers := map[string]http.HandlerFunc{
+		"list": s.stepAdmin(stepAdminListProvisioners, s.listStepProvisioners),
+		"get":  s.stepAdmin(stepAdminGetPolicy, s.getStepPolicy),
+		"put":  s.stepAdmin(stepAdminUpdatePolicy, s.putStepPolicy),
+	}
+	updated := stepAdminOperations.WithLabelValues(stepAdminUpdatePolicy, "success")
+	before := testutil.ToFloat64(updated)
+
+	policy := `{"x509":{"allow":{"dns":["*.example.com"]}}}`
+	tests := []struct {
+		name, handler, client, provisioner, body string
+		status                                   int
+		want                                     string
+	}{
+		{"not admin", "list", "web", "", "", http.StatusForbidden, ""},
+		{"list", "list", "admin", "", "", http.StatusOK, `"name":"acme"`},
+		{"no policy", "get", "admin", "", "", http.StatusNotFound, ""},
+		{"create", "put", "admin", "", policy, http.StatusOK, "*.example.com"},
+		{"update", "put", "admin", "", `{"x509":{"allow":{"dns":["*.internal"]}}}`, http.StatusOK, "*.internal"},
+		{"get", "get", "admin", "", "", http.StatusOK, "*.internal"},
+		{"invalid", "put", "admin", "", `{"x509":{"allow":"*"}}`, http.StatusBadRequest, ""},
+		{"unknown provisioner", "get", "admin", "missing", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		r := withIdentities(httptest.NewRequest(http.MethodGet, "/admin/step/policy", strings.NewReader(tt.body)), tt.client)
+		if tt.provisioner != "" {
+			r.SetPathValue("name", tt.provisioner)
+		}
+		w := httptest.NewRecorder()
+		handlers[tt.handler](w, r)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: status = %d, want %d containing %q: %s", tt.name, w.Code, tt.status, tt.want, w.Body)
+		}
+	}
+	if got := strings.Join(f.writes, ","); got != "POST,PUT" {
+		t.Errorf("policy writes = %s, want POST,PUT", got)
+	}
+	if got := testutil.ToFloat64(updated) - before; got != 2 {
+		t.Errorf("policy updates counted = %v, want 2", got)
+	}
+
+	s.config.StepAdmin.Operations = []string{stepAdminGetPolicy}
+	w := httptest.NewRecorder()
+	handlers["put"](w, withIdentities(httptest.NewRequest(http.MethodPut, "/admin/step/policy", strings.NewReader(policy)), "admin"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("operation not allowed: status = %d, want 403", w.Code)
+	}
+
+	s.config.StepAdmin.KeyFile = filepath.Join(t.TempDir(), "missing.key")
+	w = httptest.NewRecorder()
+	handlers["get"](w, withIdentities(httptest.NewRequest(http.MethodGet, "/admin/step/policy", nil), "admin"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("missing key: status = %d, want 500", w.Code)
+	}
+}
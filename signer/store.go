@@ -0,0 +1,153 @@
+package signer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+var approvalsBucket = []byte("approvals")
+
+// storeBuckets are the buckets of the store, created when it is opened.
+var storeBuckets = [][]byte{
+	certificatesBucket, fingerprintsBucket, failuresBucket, usageBucket,
+	campaignsBucket, policyRulesBucket, policyHistoryBucket, configBucket,
+	approvalsBucket, keysBucket,
+}
+
+// PostgresConfig configures a Postgres store. The password is read from
+// passwordFile if it is not in the URL.
+type PostgresConfig struct {
+	URL          string `yaml:"url"`
+	PasswordFile string `yaml:"passwordFile"`
+	MaxConns     int    `yaml:"maxConns"`
+}
+
+// Enabled returns true if a Postgres store is configured.
+func (c PostgresConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+// GetMaxConns returns the maximum number of connections, defaults to 10.
+func (c PostgresConfig) GetMaxConns() int {
+	if c.MaxConns > 0 {
+		return c.MaxConns
+	}
+
+	return 10
+}
+
+// openStore opens the Postgres store if configured, the BoltDB file
+// otherwise.
+func openStore(c InventoryConfig) (store.Store, error) {
+	if !c.Postgres.Enabled() {
+		return store.OpenBolt(c.Path, storeBuckets)
+	}
+
+	var password []byte
+	if c.Postgres.PasswordFile != "" {
+		var err error
+		if password, err = readPasswordFromFile(c.Postgres.PasswordFile); err != nil {
+			return nil, errors.Wrap(err, "error reading postgres password")
+		}
+	}
+
+	return store.OpenPostgres(c.Postgres.URL, string(password), c.Postgres.GetMaxConns())
+}
+
+// runStoreCommand implements "ca-signer store migrate", copying a BoltDB
+// inventory to Postgres or back, and "ca-signer store rotate-key". The
+// signers must be stopped during a migration.
+func runStoreCommand(args []string) int {
+	if len(args) > 0 && args[0] == "rotate-key" {
+		return runRotateKeyCommand(args[1:])
+	}
+	if len(args) == 0 || args[0] != "migrate" {
+		fmt.Fprintln(os.Stderr, "usage: ca-signer store migrate --from <file|postgres://...> --to <file|postgres://...>")
+		fmt.Fprintln(os.Stderr, "       ca-signer store rotate-key --config <file> [--prune]")
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("store migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "BoltDB file or Postgres URL to copy from")
+	to := fs.String("to", "", "BoltDB file or Postgres URL to copy to")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if *from == "" || *to == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	src, err := store.OpenURL(*from, storeBuckets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening %s: %v\n", *from, err)
+		return 1
+	}
+	defer src.Close()
+	dst, err := store.OpenURL(*to, storeBuckets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening %s: %v\n", *to, err)
+		return 1
+	}
+	defer dst.Close()
+
+	if err := store.Migrate(src, dst, storeBuckets, func(bucket string, n int) {
+		fmt.Printf("%s: %d keys\n", bucket, n)
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error migrating store: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runRotateKeyCommand implements "ca-signer store rotate-key": it creates a
+// new data key for the inventory configured in the config file and
+// re-encrypts all the values with it, including the plaintext values
+// written before the encryption was enabled. With --prune it deletes the
+// former keys instead.
+func runRotateKeyCommand(args []string) int {
+	fs := flag.NewFlagSet("store rotate-key", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "path to the signer configuration")
+	prune := fs.Bool("prune", false, "re-encrypt with the current data key and delete the former ones, once all the signers restarted after the rotation")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+		return exitUsage
+	}
+	if !config.Inventory.Enabled() || !config.Inventory.Encryption.Enabled() {
+		fmt.Fprintln(os.Stderr, "the inventory encryption is not configured")
+		return exitUsage
+	}
+
+	db, err := openStore(config.Inventory)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening inventory: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+	encrypted, err := newEncryptedStore(db, config.Inventory.Encryption)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading inventory encryption: %v\n", err)
+		return 1
+	}
+
+	if err := encrypted.reencrypt(*prune, func(bucket string, n int) {
+		fmt.Printf("%s: %d keys\n", bucket, n)
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error rotating data key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("current data key: %s\n", encrypted.keys.current)
+
+	return 0
+}
@@ -0,0 +1,304 @@
+package signer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+
+	"github.com/Fyve-Labs/ca-signer/store"
+)
+
+// recentLogSize is the number of log entries kept for the support bundles.
+const recentLogSize = 2000
+
+// recentLogs keeps the last formatted log entries of every component, after
+// their redaction.
+var recentLogs = &logRing{entries: make([][]byte, recentLogSize)}
+
+// logRing is a ring buffer of formatted log entries.
+type logRing struct {
+	mu      sync.Mutex
+	entries [][]byte
+	next    int
+	full    bool
+}
+
+func (l *logRing) add(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = append([]byte(nil), b...)
+	l.next = (l.next + 1) % len(l.entries)
+	l.full = l.full || l.next == 0
+}
+
+// WriteTo writes the entries, oldest first.
+func (l *logRing) WriteTo(w io.Writer) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := l.entries[:l.next]
+	if l.full {
+		entries = append(append([][]byte(nil), l.entries[l.next:]...), entries...)
+	}
+	var n int64
+	for _, e := range entries {
+		m, err := w.Write(e)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// recordingFormatter keeps the entries formatted by next in recentLogs.
+type recordingFormatter struct {
+	next log.Formatter
+}
+
+func (f *recordingFormatter) Format(e *log.Entry) ([]byte, error) {
+	b, err := f.next.Format(e)
+	if err == nil && len(b) > 0 {
+		recentLogs.add(b)
+	}
+
+	return b, err
+}
+
+// supportBundleInfo is the info.json file of the support bundles.
+type supportBundleInfo struct {
+	Created     time.Time         `json:"created"`
+	Version     string            `json:"version"`
+	Commit      string            `json:"commit"`
+	GoVersion   string            `json:"goVersion"`
+	Platform    string            `json:"platform"`
+	Hostname    string            `json:"hostname"`
+	Goroutines  int               `json:"goroutines"`
+	Maintenance maintenanceStatus `json:"maintenance"`
+}
+
+// supportBundleStore is the store.json file of the support bundles.
+type supportBundleStore struct {
+	Store   string                       `json:"store"`
+	Shared  bool                         `json:"shared"`
+	Buckets map[string]supportBundleSize `json:"buckets"`
+}
+
+type supportBundleSize struct {
+	Keys  int `json:"keys"`
+	Bytes int `json:"bytes"`
+}
+
+// supportBundle returns a gzip compressed tar archive to attach to incident
+// tickets: the build and host info, the effective configuration and the
+// recent logs, both redacted, the sizes of the store buckets, a dump of the
+// goroutines and the last status of the upstream CAs. Sections that cannot
+// be gathered are listed in errors.txt.
+func (s *server) supportBundle(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	dir := "ca-signer-support-" + now.Format("20060102T150405Z")
+	var failures []string
+	files := map[string]func(io.Writer) error{
+		"info.json": func(w io.Writer) error {
+			hostname, _ := os.Hostname()
+			return writeJSONFile(w, supportBundleInfo{
+				Created:     now,
+				Version:     Version,
+				Commit:      Commit,
+				GoVersion:   runtime.Version(),
+				Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+				Hostname:    hostname,
+				Goroutines:  runtime.NumGoroutine(),
+				Maintenance: s.maintenanceMode.status(),
+			})
+		},
+		"config.yaml": func(w io.Writer) error {
+			b, err := yaml.Marshal(renderConfig(s.config, true))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(b)
+			return err
+		},
+		"logs.txt": func(w io.Writer) error {
+			_, err := recentLogs.WriteTo(w)
+			return err
+		},
+		"goroutines.txt": func(w io.Writer) error {
+			return pprof.Lookup("goroutine").WriteTo(w, 2)
+		},
+		"upstreams.json": func(w io.Writer) error {
+			if s.monitor == nil {
+				return errors.New("the upstream monitor is not running")
+			}
+			return writeJSONFile(w, s.monitor.lastStatus())
+		},
+		"store.json": func(w io.Writer) error {
+			if s.inventory == nil {
+				return errors.New("the inventory is not configured")
+			}
+			st, err := storeSizes(s.inventory.store)
+			if err != nil {
+				return err
+			}
+			st.Shared = s.inventory.shared
+			return writeJSONFile(w, st)
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+dir+`.tar.gz"`)
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	add := func(name string, b []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: dir + "/" + name, Mode: 0o600, Size: int64(len(b)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+
+	logger := logFor("admin").WithField("client", clientIdentities(r))
+	for _, name := range []string{"info.json", "config.yaml", "logs.txt", "goroutines.txt", "upstreams.json", "store.json"} {
+		var buf bytes.Buffer
+		if err := files[name](&buf); err != nil {
+			failures = append(failures, name+": "+redactString(err.Error()))
+			continue
+		}
+		if err := add(name, buf.Bytes()); err != nil {
+			logger.WithField("error", err).Error("Error writing support bundle")
+			return
+		}
+	}
+	if len(failures) > 0 {
+		if err := add("errors.txt", []byte(strings.Join(failures, "\n")+"\n")); err != nil {
+			logger.WithField("error", err).Error("Error writing support bundle")
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		logger.WithField("error", err).Error("Error writing support bundle")
+		return
+	}
+	if err := zw.Close(); err != nil {
+		logger.WithField("error", err).Error("Error writing support bundle")
+		return
+	}
+	logger.WithField("errors", failures).Info("Support bundle downloaded")
+}
+
+func writeJSONFile(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// storeSizes returns the number of keys and the size of every bucket of
+// store, read in a single transaction.
+func storeSizes(db store.Store) (*supportBundleStore, error) {
+	st := &supportBundleStore{Store: storeKind(db), Buckets: map[string]supportBundleSize{}}
+	err := rawStore(db).View(func(tx store.Tx) error {
+		for _, name := range storeBuckets {
+			var size supportBundleSize
+			err := tx.Bucket(name).ForEach(func(k, v []byte) error {
+				size.Keys++
+				size.Bytes += len(k) + len(v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			st.Buckets[string(name)] = size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading store")
+	}
+
+	return st, nil
+}
+
+// runSupportBundleCommand implements "ca-signer support-bundle". It
+// downloads a support bundle from the admin API of a running signer.
+func runSupportBundleCommand(args []string) int {
+	var o benchOptions
+	fs := flag.NewFlagSet("support-bundle", flag.ContinueOnError)
+	out := fs.String("out", "", "archive to write, defaults to ca-signer-support-<time>.tar.gz")
+	fs.StringVar(&o.target, "signer", "", "base URL of the running signer, e.g. https://ca-signer:4443")
+	fs.StringVar(&o.cert, "cert", "", "admin client certificate for mTLS")
+	fs.StringVar(&o.key, "key", "", "admin client key for mTLS")
+	fs.StringVar(&o.root, "root", "", "root certificate trusted for the signer, defaults to the system roots")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if o.target == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	name, err := downloadSupportBundle(o, *out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error downloading support bundle: %v\n", err)
+		return exitError
+	}
+	fmt.Printf("support bundle written to %s\n", name)
+
+	return 0
+}
+
+func downloadSupportBundle(o benchOptions, out string) (string, error) {
+	o.concurrency = 1
+	client, err := benchClient(o)
+	if err != nil {
+		return "", err
+	}
+	client.Timeout = time.Minute
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, strings.TrimSuffix(o.target, "/")+"/admin/support-bundle", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", errors.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	if out == "" {
+		out = "ca-signer-support-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	}
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(out)
+		return "", err
+	}
+
+	return out, f.Close()
+}
@@ -0,0 +1,257 @@
+package signer
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// tenantOther is the tenant of the clients not listed by any tenant. The
+// tenant label of the metrics is bounded by the configured tenants.
+const tenantOther = "other"
+
+// TenantConfig groups client identities in a tenant, for the tenant label of
+// the metrics and the usage reports.
+type TenantConfig struct {
+	Name    string   `yaml:"name"`
+	Clients []string `yaml:"clients"`
+}
+
+// Validate checks the name and the clients.
+func (c TenantConfig) Validate() error {
+	if c.Name == "" || c.Name == tenantOther {
+		return errors.Errorf("invalid tenant name %q", c.Name)
+	}
+	if len(c.Clients) == 0 {
+		return errors.Errorf("tenant %q has no clients", c.Name)
+	}
+
+	return nil
+}
+
+// tenantFor returns the first tenant listing one of the client identities,
+// or "other".
+func tenantFor(tenants []TenantConfig, clients []string) string {
+	for _, t := range tenants {
+		if policy.ContainsAny(t.Clients, clients) {
+			return t.Name
+		}
+	}
+
+	return tenantOther
+}
+
+// tenantFor returns the tenant of the client identities.
+func (s *server) tenantFor(clients []string) string {
+	return tenantFor(s.config.Tenants, clients)
+}
+
+// usageReport is the usage of the signer by tenant over a calendar month
+// (UTC), from the inventory records.
+type usageReport struct {
+	Month     string        `json:"month"`
+	Generated time.Time     `json:"generated"`
+	Tenants   []tenantUsage `json:"tenants"`
+}
+
+// tenantUsage is the usage of a tenant: the certificates issued in the
+// month, their cumulated lifetime, and the certificates revoked in the
+// month.
+type tenantUsage struct {
+	Tenant           string         `json:"tenant"`
+	Issued           int            `json:"issued"`
+	Revoked          int            `json:"revoked"`
+	CertificateHours float64        `json:"certificateHours"`
+	Endpoints        map[string]int `json:"endpoints,omitempty"`
+	Profiles         map[string]int `json:"profiles,omitempty"`
+}
+
+// usageColumns are the columns of the CSV usage reports.
+var usageColumns = []string{"month", "tenant", "issued", "revoked", "certificate_hours"}
+
+// parseUsageMonth parses a YYYY-MM month, and returns its first instant and
+// the one of the next month. An empty month is the previous month.
+func parseUsageMonth(month string, now time.Time) (string, time.Time, time.Time, error) {
+	var from time.Time
+	if month == "" {
+		now = now.UTC()
+		from = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	} else {
+		t, err := time.Parse("2006-01", month)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, errors.Errorf("invalid month %q, must be YYYY-MM", month)
+		}
+		from = t
+	}
+
+	return from.Format("2006-01"), from, from.AddDate(0, 1, 0), nil
+}
+
+// UsageReport returns the usage by tenant of a month. Every configured
+// tenant is listed, records deleted by the retention and the secondary
+// certificates of dual issuances are not counted.
+func (inv *inventory) UsageReport(tenants []TenantConfig, month string, now time.Time) (*usageReport, error) {
+	month, from, to, err := parseUsageMonth(month, now)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]*tenantUsage{}
+	get := func(name string) *tenantUsage {
+		if usage[name] == nil {
+			usage[name] = &tenantUsage{Tenant: name, Endpoints: map[string]int{}, Profiles: map[string]int{}}
+		}
+		return usage[name]
+	}
+	for _, t := range tenants {
+		get(t.Name)
+	}
+	if err := inv.All(func(rec *certificateRecord) error {
+		u := get(tenantFor(tenants, rec.Metadata.Client))
+		if rec.Metadata.PrimarySerial != "" {
+			// Secondary certificates of dual issuances are not usage.
+			return nil
+		}
+		if t := rec.Metadata.IssuedAt; !t.Before(from) && t.Before(to) {
+			u.Issued++
+			u.CertificateHours += rec.NotAfter.Sub(rec.NotBefore).Hours()
+			u.Endpoints[rec.Metadata.Endpoint]++
+			if rec.Metadata.Profile != "" {
+				u.Profiles[rec.Metadata.Profile]++
+			}
+		}
+		if t := rec.RevokedAt; t != nil && !t.Before(from) && t.Before(to) {
+			u.Revoked++
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	report := &usageReport{Month: month, Generated: now.UTC(), Tenants: []tenantUsage{}}
+	for _, u := range usage {
+		if u.Issued > 0 || u.Revoked > 0 || u.Tenant != tenantOther {
+			report.Tenants = append(report.Tenants, *u)
+		}
+	}
+	slices.SortFunc(report.Tenants, func(a, b tenantUsage) int {
+		return cmp.Compare(a.Tenant, b.Tenant)
+	})
+
+	return report, nil
+}
+
+// writeCSV writes the report as CSV, one row per tenant.
+func (r *usageReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(usageColumns)
+	for _, u := range r.Tenants {
+		cw.Write([]string{
+			r.Month, u.Tenant, strconv.Itoa(u.Issued), strconv.Itoa(u.Revoked),
+			strconv.FormatFloat(u.CertificateHours, 'f', 2, 64),
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// usage returns the usage report of the month in the month query parameter,
+// the previous month by default, as JSON or, with format=csv, as CSV.
+func (s *server) usage(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		render.Error(w, r, errs.BadRequest("invalid format %q, must be json or csv", format))
+		return
+	}
+
+	month := r.URL.Query().Get("month")
+	if _, _, _, err := parseUsageMonth(month, time.Now()); err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "%s", err))
+		return
+	}
+
+	report, err := s.inventory.UsageReport(s.config.Tenants, month, time.Now())
+	if err != nil {
+		logFor("inventory").WithField("error", err).Error("Error computing the usage report")
+		render.Error(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=ca-signer-usage-%s.csv", report.Month))
+		report.writeCSV(w)
+		return
+	}
+	render.JSON(w, r, report)
+}
+
+// runUsageCommand implements "ca-signer usage", which prints the usage
+// report of a month from the inventory of the config.
+func runUsageCommand(args []string) int {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "path to the signer configuration")
+	month := fs.String("month", "", "month of the report, YYYY-MM (default the previous month)")
+	format := fs.String("format", "json", "output format, json or csv")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *configFile == "" || (*format != "json" && *format != "csv") {
+		fs.Usage()
+		return exitUsage
+	}
+	if _, _, _, err := parseUsageMonth(*month, time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+		return exitUsage
+	}
+	if !config.Inventory.Enabled() {
+		fmt.Fprintln(os.Stderr, "the inventory is not configured")
+		return exitUsage
+	}
+	inv, err := openInventory(config.Inventory)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening inventory: %v\n", err)
+		return exitError
+	}
+	defer inv.Close()
+
+	report, err := inv.UsageReport(config.Tenants, *month, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error computing the usage report: %v\n", err)
+		return exitError
+	}
+	if *format == "csv" {
+		err = report.writeCSV(os.Stdout)
+	} else {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing the usage report: %v\n", err)
+		return exitError
+	}
+
+	return 0
+}
@@ -0,0 +1,194 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTenantConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    TenantConfig
+		ok   bool
+	}{
+		{"valid", TenantConfig{Name: "payments", Clients: []string{"web"}}, true},
+		{"no name", TenantConfig{Clients: []string{"web"}}, false},
+		{"other", TenantConfig{Name: tenantOther, Clients: []string{"web"}}, false},
+		{"no clients", TenantConfig{Name: "payments"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestTenantFor(t *testing.T) {
+	tenants := []TenantConfig{
+		{Name: "payments", Clients: []string{"web", "billing"}},
+		{Name: "platform", Clients: []string{"ci", "web"}},
+	}
+	tests := []struct {
+		clients []string
+		want    string
+	}{
+		{[]string{"billing"}, "payments"},
+		{[]string{"web"}, "payments"},
+		{[]string{"runner", "ci"}, "platform"},
+		{[]string{"unknown"}, tenantOther},
+		{nil, tenantOther},
+	}
+	for _, tt := range tests {
+		if got := tenantFor(tenants, tt.clients); got != tt.want {
+			t.Errorf("tenantFor(%v) = %s, want %s", tt.clients, got, tt.want)
+		}
+	}
+
+	s := &server{config: &Config{Tenants: tenants}}
+	issued := signRequests.WithLabelValues(generationStable, "issued", "platform")
+	before := testutil.ToFloat64(issued)
+	s.countSign([]string{"ci"}, generationStable, "issued", nil)
+	if got := testutil.ToFloat64(issued) - before; got != 1 {
+		t.Errorf("sign requests counted for the tenant = %v, want 1", got)
+	}
+}
+
+func TestParseUsageMonth(t *testing.T) {
+	now := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		month    string
+		want     string
+		from, to time.Time
+		ok       bool
+	}{
+		{"", "2023-12", time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2024-02", "2024-02", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2024-13", "", time.Time{}, time.Time{}, false},
+		{"January", "", time.Time{}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		month, from, to, err := parseUsageMonth(tt.month, now)
+		if (err == nil) != tt.ok || month != tt.want || !from.Equal(tt.from) || !to.Equal(tt.to) {
+			t.Errorf("parseUsageMonth(%q) = %s, %v, %v, %v, want %s, %v, %v", tt.month, month, from, to, err, tt.want, tt.from, tt.to)
+		}
+	}
+}
+
+// newUsageTestInventory returns an inventory with certificates issued and
+// revoked in March 2024 and around it.
+func newUsageTestInventory(t *testing.T) *inventory {
+	t.Helper()
+	inv := newTestInventory(t)
+	march := time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC)
+	revoked := march.AddDate(0, 0, 5)
+	for _, rec := range []*certificateRecord{
+		{Serial: "1", Metadata: issuanceMetadata{IssuedAt: march, Client: []string{"web"}, Endpoint: "sign"}},
+		{Serial: "2", Metadata: issuanceMetadata{IssuedAt: march, Client: []string{"billing"}, Endpoint: "approvals", Profile: "code-signing"}},
+		{Serial: "3", Metadata: issuanceMetadata{IssuedAt: march, Client: []string{"web"}, Endpoint: "sign", PrimarySerial: "1"}},
+		{Serial: "4", Metadata: issuanceMetadata{IssuedAt: march.AddDate(0, -1, 0), Client: []string{"web"}, Endpoint: "sign"}, RevokedAt: &revoked},
+		{Serial: "5", Metadata: issuanceMetadata{IssuedAt: march, Client: []string{"runner"}, Endpoint: "sign"}},
+		{Serial: "6", Metadata: issuanceMetadata{IssuedAt: march.AddDate(0, 1, 0), Client: []string{"web"}, Endpoint: "sign"}},
+	} {
+		rec.Fingerprint = "fp" + rec.Serial
+		rec.NotBefore, rec.NotAfter = rec.Metadata.IssuedAt, rec.Metadata.IssuedAt.Add(24*time.Hour)
+		if err := inv.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return inv
+}
+
+func TestUsageReport(t *testing.T) {
+	inv := newUsageTestInventory(t)
+	tenants := []TenantConfig{
+		{Name: "payments", Clients: []string{"web", "billing"}},
+		{Name: "platform", Clients: []string{"ci"}},
+	}
+	now := time.Date(2024, time.April, 2, 0, 0, 0, 0, time.UTC)
+
+	report, err := inv.UsageReport(tenants, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Month != "2024-03" || len(report.Tenants) != 3 {
+		t.Fatalf("UsageReport() = %+v", report)
+	}
+	other, payments, platform := report.Tenants[0], report.Tenants[1], report.Tenants[2]
+	if payments.Tenant != "payments" || payments.Issued != 2 || payments.Revoked != 1 || payments.CertificateHours != 48 ||
+		payments.Endpoints["sign"] != 1 || payments.Endpoints["approvals"] != 1 || payments.Profiles["code-signing"] != 1 {
+		t.Errorf("payments usage = %+v", payments)
+	}
+	if other.Tenant != tenantOther || other.Issued != 1 {
+		t.Errorf("other usage = %+v", other)
+	}
+	if platform.Tenant != "platform" || platform.Issued != 0 || platform.Revoked != 0 {
+		t.Errorf("platform usage = %+v", platform)
+	}
+
+	var buf bytes.Buffer
+	if err := report.writeCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "month,tenant,issued,revoked,certificate_hours\n2024-03,other,1,0,24.00\n2024-03,payments,2,1,48.00\n2024-03,platform,0,0,0.00\n"
+	if buf.String() != want {
+		t.Errorf("writeCSV() = %q, want %q", buf.String(), want)
+	}
+
+	if report, err := inv.UsageReport(tenants, "2023-01", now); err != nil || len(report.Tenants) != 2 {
+		t.Errorf("UsageReport() of an empty month = %+v, %v, want the configured tenants only", report, err)
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	s := &server{config: &Config{Tenants: []TenantConfig{{Name: "payments", Clients: []string{"web"}}}}, inventory: newUsageTestInventory(t)}
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"?month=2024-03", http.StatusOK, `"tenant":"payments","issued":1,"revoked":1`},
+		{"?month=2024-03&format=csv", http.StatusOK, "2024-03,payments,1,1,24.00"},
+		{"?format=xml", http.StatusBadRequest, ""},
+		{"?month=2024", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.usage(w, httptest.NewRequest(http.MethodGet, "/admin/usage"+tt.query, nil))
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: status = %d, want %d: %s", tt.query, w.Code, tt.status, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.usage(w, httptest.NewRequest(http.MethodGet, "/admin/usage?format=csv&month=2024-03", nil))
+	if ct, cd := w.Header().Get("Content-Type"), w.Header().Get("Content-Disposition"); ct != "text/csv" || !strings.Contains(cd, "ca-signer-usage-2024-03.csv") {
+		t.Errorf("CSV headers = %q, %q", ct, cd)
+	}
+	var report usageReport
+	w = httptest.NewRecorder()
+	s.usage(w, httptest.NewRequest(http.MethodGet, "/admin/usage", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || report.Month != time.Now().UTC().AddDate(0, 0, -time.Now().UTC().Day()).Format("2006-01") {
+		t.Errorf("default report = %+v, %v, want the previous month", report, err)
+	}
+}
+
+func TestRunUsageCommandUsage(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"-config", "signer.yaml", "-format", "xml"},
+		{"-config", "signer.yaml", "-month", "March"},
+		{"-config", "missing.yaml"},
+	} {
+		if got := runUsageCommand(args); got != exitUsage {
+			t.Errorf("runUsageCommand(%q) = %d, want %d", args, got, exitUsage)
+		}
+	}
+}
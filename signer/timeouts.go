@@ -0,0 +1,130 @@
+package signer
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// requestTimeoutHeader is the header clients set to a tighter deadline than
+// the timeouts of the signer.
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// TimeoutsConfig configures the timeouts of the upstream calls. They apply
+// on top of the request context, so a client disconnecting also cancels the
+// upstream call.
+type TimeoutsConfig struct {
+	Sign       string `yaml:"sign"`
+	Read       string `yaml:"read"`
+	MaxRequest string `yaml:"maxRequest"`
+}
+
+// GetSign returns the timeout of the sign calls, defaults to 30s.
+func (c TimeoutsConfig) GetSign() time.Duration {
+	if d, err := time.ParseDuration(c.Sign); err == nil && d > 0 {
+		return d
+	}
+
+	return 30 * time.Second
+}
+
+// GetRead returns the timeout of the health, roots and provisioners calls,
+// defaults to 10s.
+func (c TimeoutsConfig) GetRead() time.Duration {
+	if d, err := time.ParseDuration(c.Read); err == nil && d > 0 {
+		return d
+	}
+
+	return 10 * time.Second
+}
+
+// GetMaxRequest returns the longest deadline clients can set with
+// X-Request-Timeout, defaults to 5m.
+func (c TimeoutsConfig) GetMaxRequest() time.Duration {
+	if d, err := time.ParseDuration(c.MaxRequest); err == nil && d > 0 {
+		return d
+	}
+
+	return 5 * time.Minute
+}
+
+// Validate checks that the timeouts are positive durations.
+func (c TimeoutsConfig) Validate() error {
+	timeouts := []struct{ name, value string }{
+		{"sign", c.Sign},
+		{"read", c.Read},
+		{"maxRequest", c.MaxRequest},
+	}
+	for _, t := range timeouts {
+		if t.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(t.value); err != nil || d <= 0 {
+			return errors.Errorf("invalid timeouts %s %q", t.name, t.value)
+		}
+	}
+
+	return nil
+}
+
+// parseRequestTimeout parses an X-Request-Timeout value: a duration, e.g.
+// "2.5s", or a number of seconds.
+func parseRequestTimeout(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		secs, serr := strconv.ParseFloat(value, 64)
+		if serr != nil {
+			return 0, err
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, errors.New("timeout must be positive")
+	}
+
+	return d, nil
+}
+
+// requestTimeout sets the deadline of the request context from the
+// X-Request-Timeout header, bounded by timeouts.maxRequest. The upstream
+// calls derive their context from the request, so they stop at the earlier of
+// this deadline and their own timeout.
+func (s *server) requestTimeout(next http.Handler) http.Handler {
+	limit := s.config.Timeouts.GetMaxRequest()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(requestTimeoutHeader)
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		d, err := parseRequestTimeout(value)
+		if err != nil {
+			render.Error(w, r, errs.BadRequestErr(err, "invalid %s %q", requestTimeoutHeader, value))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), min(d, limit))
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// upstreamError maps context errors of an upstream call to 504 Gateway
+// Timeout, other errors are returned as is.
+func upstreamError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errs.Wrap(http.StatusGatewayTimeout, err, "timeout waiting for the upstream CA")
+	}
+
+	return err
+}
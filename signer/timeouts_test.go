@@ -0,0 +1,124 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/api/render"
+)
+
+func TestParseRequestTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"2.5s", 2500 * time.Millisecond, true},
+		{"3", 3 * time.Second, true},
+		{"0.25", 250 * time.Millisecond, true},
+		{"0", 0, false},
+		{"-1s", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRequestTimeout(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRequestTimeout(%q) = %v, %v, want %v, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := &server{config: &Config{Timeouts: TimeoutsConfig{MaxRequest: "1m"}}}
+	var remaining time.Duration
+	handler := s.requestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remaining = -1
+		if deadline, ok := r.Context().Deadline(); ok {
+			remaining = time.Until(deadline)
+		}
+	}))
+
+	tests := []struct {
+		value    string
+		status   int
+		min, max time.Duration
+	}{
+		{"", http.StatusOK, -1, -1},
+		{"10s", http.StatusOK, 9 * time.Second, 10 * time.Second},
+		{"1h", http.StatusOK, 59 * time.Second, time.Minute},
+		{"never", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		remaining = 0
+		r := httptest.NewRequest(http.MethodPost, "/sign", nil)
+		if tt.value != "" {
+			r.Header.Set(requestTimeoutHeader, tt.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status || remaining < tt.min || remaining > tt.max {
+			t.Errorf("%q: status %d, deadline in %v, want %d, in [%v, %v]", tt.value, w.Code, remaining, tt.status, tt.min, tt.max)
+		}
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	var sc render.StatusCodedError
+	if err := upstreamError(ctx, ctx.Err()); !errors.As(err, &sc) || sc.StatusCode() != http.StatusGatewayTimeout {
+		t.Errorf("upstreamError() after the deadline = %v, want 504", err)
+	}
+	other := errors.New("connection refused")
+	if err := upstreamError(context.Background(), other); err != other {
+		t.Errorf("upstreamError() = %v, want the error as is", err)
+	}
+}
+
+func TestTimeoutsConfig(t *testing.T) {
+	var c TimeoutsConfig
+	if c.GetSign() != 30*time.Second || c.GetRead() != 10*time.Second || c.GetMaxRequest() != 5*time.Minute {
+		t.Errorf("defaults = %v, %v, %v", c.GetSign(), c.GetRead(), c.GetMaxRequest())
+	}
+	c = TimeoutsConfig{Sign: "5s", Read: "2s", MaxRequest: "30s"}
+	if c.GetSign() != 5*time.Second || c.GetRead() != 2*time.Second || c.GetMaxRequest() != 30*time.Second {
+		t.Errorf("configured = %v, %v, %v", c.GetSign(), c.GetRead(), c.GetMaxRequest())
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	c = TimeoutsConfig{Sign: "0s", Read: "-1s", MaxRequest: "0"}
+	if c.GetSign() != 30*time.Second || c.GetRead() != 10*time.Second || c.GetMaxRequest() != 5*time.Minute {
+		t.Errorf("non-positive = %v, %v, %v", c.GetSign(), c.GetRead(), c.GetMaxRequest())
+	}
+	for _, c := range []TimeoutsConfig{{Sign: "0s"}, {Read: "-1s"}, {MaxRequest: "0"}, {Sign: "30"}} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%+v) error = nil", c)
+		}
+	}
+}
+
+func TestRequestTimeoutUpstream(t *testing.T) {
+	s := &server{config: &Config{}}
+	cache := newUpstreamCache(CacheConfig{}, time.Minute)
+	handler := s.requestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, _, err := cache.Get(r.Context(), "roots", func(ctx context.Context) (interface{}, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		render.Error(w, r, err)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/roots", nil)
+	r.Header.Set(requestTimeoutHeader, "0.05")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusGatewayTimeout || time.Since(start) > 10*time.Second {
+		t.Errorf("status %d after %v, want 504 at the client deadline", w.Code, time.Since(start))
+	}
+}
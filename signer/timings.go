@@ -0,0 +1,146 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Phases of a sign request.
+const (
+	phaseQueue    = "queue"
+	phaseDecode   = "decode"
+	phaseValidate = "validate"
+	phasePolicy   = "policy"
+	phaseToken    = "token"
+	phaseUpstream = "upstream"
+	phaseRender   = "render"
+)
+
+// TimingsConfig configures the phase timings of the sign requests.
+type TimingsConfig struct {
+	Header bool `yaml:"header"`
+}
+
+// phaseTimings collects the time spent in each phase of a request. Phases
+// run more than once, e.g. the upstream calls of a batch, are summed.
+type phaseTimings struct {
+	start time.Time
+
+	mu     sync.Mutex
+	names  []string
+	phases map[string]time.Duration
+}
+
+type timingsKey struct{}
+
+// timePhase starts timing a phase of the request of ctx, and returns the
+// function ending it. It does nothing for requests without timings.
+func timePhase(ctx context.Context, name string) func() {
+	t, _ := ctx.Value(timingsKey{}).(*phaseTimings)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+
+	return func() {
+		d := time.Since(start)
+		signPhaseDuration.WithLabelValues(name).Observe(d.Seconds())
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.phases[name]; !ok {
+			t.names = append(t.names, name)
+		}
+		t.phases[name] += d
+	}
+}
+
+// serverTiming returns the phases as a Server-Timing header value.
+func (t *phaseTimings) serverTiming() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parts := make([]string, 0, len(t.names)+1)
+	for _, name := range t.names {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.3f", name, durationMillis(t.phases[name])))
+	}
+	parts = append(parts, fmt.Sprintf("total;dur=%.3f", durationMillis(time.Since(t.start))))
+
+	return strings.Join(parts, ", ")
+}
+
+// fields returns the phases as log fields, in milliseconds.
+func (t *phaseTimings) fields() log.Fields {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fields := log.Fields{}
+	for _, name := range t.names {
+		fields[name+"_ms"] = durationMillis(t.phases[name])
+	}
+
+	return fields
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timed records the phase timings of a sign endpoint. They are observed by
+// ca_signer_sign_phase_duration_seconds, logged at debug level and, with
+// timings.header, returned in the Server-Timing header.
+func (s *server) timed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := &phaseTimings{start: time.Now(), phases: map[string]time.Duration{}}
+		r = r.WithContext(context.WithValue(r.Context(), timingsKey{}, t))
+		tw := &timingWriter{ResponseWriter: w, timings: t, header: s.config.Timings.Header}
+
+		next(tw, r)
+
+		logFor("server").WithFields(log.Fields{
+			"request":  requestID(r),
+			"path":     r.URL.Path,
+			"status":   tw.status,
+			"total_ms": durationMillis(time.Since(t.start)),
+		}).WithFields(t.fields()).Debug("Sign request timings")
+	}
+}
+
+// timingWriter adds the Server-Timing header with the phases completed
+// when the response starts.
+type timingWriter struct {
+	http.ResponseWriter
+	timings *phaseTimings
+	header  bool
+	status  int
+}
+
+func (t *timingWriter) WriteHeader(code int) {
+	if t.status != 0 {
+		return
+	}
+	t.status = code
+	if t.header {
+		t.Header().Set("Server-Timing", t.timings.serverTiming())
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *timingWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for the streamed responses.
+func (t *timingWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,96 @@
+package signer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// phaseSamples returns the number of durations observed for the phase.
+func phaseSamples(t *testing.T, phase string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "ca_signer_sign_phase_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == phase {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestTimePhase(t *testing.T) {
+	// Requests without timings are not timed.
+	timePhase(context.Background(), phasePolicy)()
+
+	timings := &phaseTimings{start: time.Now(), phases: map[string]time.Duration{}}
+	ctx := context.WithValue(context.Background(), timingsKey{}, timings)
+	before := phaseSamples(t, phaseUpstream)
+	for _, name := range []string{phaseDecode, phaseUpstream, phaseUpstream} {
+		end := timePhase(ctx, name)
+		time.Sleep(time.Millisecond)
+		end()
+	}
+
+	if !sameStrings(timings.names, []string{phaseDecode, phaseUpstream}) || timings.phases[phaseUpstream] < 2*time.Millisecond {
+		t.Errorf("phases = %v %v, want decode then upstream summed", timings.names, timings.phases)
+	}
+	fields := timings.fields()
+	if len(fields) != 2 || fields["upstream_ms"].(float64) < 2 {
+		t.Errorf("fields() = %v", fields)
+	}
+	if got := timings.serverTiming(); !regexp.MustCompile(`^decode;dur=\d+\.\d{3}, upstream;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`).MatchString(got) {
+		t.Errorf("serverTiming() = %q", got)
+	}
+	if got := phaseSamples(t, phaseUpstream) - before; got != 2 {
+		t.Errorf("upstream phase durations observed = %d, want 2", got)
+	}
+}
+
+func TestTimed(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		timePhase(r.Context(), phasePolicy)()
+		w.WriteHeader(http.StatusCreated)
+		timePhase(r.Context(), phaseRender)()
+		w.Write([]byte("{}"))
+	}
+	tests := []struct {
+		header bool
+		want   string
+	}{
+		{false, ""},
+		{true, `^policy;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`},
+	}
+	for _, tt := range tests {
+		s := &server{config: &Config{Timings: TimingsConfig{Header: tt.header}}}
+		w := httptest.NewRecorder()
+		s.timed(handler)(w, httptest.NewRequest(http.MethodPost, "/sign", nil))
+		got := w.Header().Get("Server-Timing")
+		if w.Code != http.StatusCreated || (tt.want == "" && got != "") || (tt.want != "" && !regexp.MustCompile(tt.want).MatchString(got)) {
+			t.Errorf("header %v: status = %d, Server-Timing = %q, want %q", tt.header, w.Code, got, tt.want)
+		}
+	}
+
+	s := &server{config: &Config{Timings: TimingsConfig{Header: true}}}
+	w := httptest.NewRecorder()
+	s.timed(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+		w.(http.Flusher).Flush()
+	})(w, httptest.NewRequest(http.MethodPost, "/sign", nil))
+	if w.Code != http.StatusOK || !w.Flushed || w.Header().Get("Server-Timing") == "" {
+		t.Errorf("implicit status = %d, flushed %v, Server-Timing %q", w.Code, w.Flushed, w.Header().Get("Server-Timing"))
+	}
+}
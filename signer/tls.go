@@ -0,0 +1,200 @@
+package signer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+)
+
+// newHTTPServer returns the TLS server for the signer. If serverCert and
+// serverKey are configured the server uses them, reloading them when they
+// change, otherwise it bootstraps its certificate from the CA and renews it
+// automatically. In both cases clients must present a certificate issued by
+// the CA, or by one of the CAs in clientAuth.caBundles if configured, unless
+// authn lets some endpoints be called without one.
+func newHTTPServer(ctx context.Context, config *Config, p *ca.Provisioner, handler http.Handler) (*http.Server, error) {
+	srv, err := newBaseServer(ctx, config, p, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCAs, err := newClientCAPool(config)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	if clientCAs != nil {
+		go clientCAs.Watch(ctx, 30*time.Second)
+		applyClientCAs(srv.TLSConfig, clientCAs)
+	}
+	if config.Authn.optionalClientCerts() {
+		applyOptionalClientCerts(srv.TLSConfig)
+	}
+	if err := applyTLSSettings(ctx, srv, config.TLS); err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+
+	return srv, nil
+}
+
+func newBaseServer(ctx context.Context, config *Config, p *ca.Provisioner, handler http.Handler) (*http.Server, error) {
+	base := &http.Server{
+		Addr:              config.GetAddresses()[0],
+		ReadHeaderTimeout: 15 * time.Second,
+		Handler:           handler,
+	}
+
+	if config.ServerCert == "" {
+		token, err := signToken(p, config.GetServiceName(), config.GetServerSANs()...)
+		if err != nil {
+			return nil, errors.Wrap(err, "error generating bootstrap token")
+		}
+		logFor("tls").WithFields(log.Fields{
+			"name": config.GetServiceName(),
+			"sans": config.GetServerSANs(),
+		}).Infof("Generated bootstrap token for signer")
+
+		return ca.BootstrapServer(ctx, token, base)
+	}
+
+	reloader, err := newCertReloader(config.ServerCert, config.ServerKey)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	go reloader.Watch(ctx, 30*time.Second)
+	logFor("tls").WithFields(log.Fields{
+		"cert": config.ServerCert,
+		"key":  config.ServerKey,
+	}).Info("Loaded server certificate")
+
+	clientCAs, err := loadCertPool(config.GetRootCAPaths()...)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+
+	base.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      clientCAs,
+	}
+
+	return base, nil
+}
+
+// certReloader serves a certificate and key pair from disk, reloading them
+// when the files change, e.g. when cert-manager renews them.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate implements tls.Config GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch checks the files every interval until ctx is done.
+func (r *certReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				logFor("tls").WithFields(log.Fields{
+					"cert":  r.certFile,
+					"error": err,
+				}).Error("Error reloading server certificate, keeping the previous one")
+			}
+		}
+	}
+}
+
+// reload loads the pair if any of the files changed since the last load.
+func (r *certReloader) reload() error {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "error loading server certificate")
+	}
+
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+
+	if r.cert.Leaf != nil {
+		logFor("tls").WithFields(log.Fields{
+			"cert":     r.certFile,
+			"notAfter": r.cert.Leaf.NotAfter,
+		}).Info("Reloaded server certificate")
+	}
+
+	return nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// loadCertPool returns a pool of the PEM certificates in the files, each of
+// which must have at least one.
+func loadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", f)
+		}
+	}
+
+	return pool, nil
+}
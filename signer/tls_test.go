@@ -0,0 +1,91 @@
+package signer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKeyPair writes a new certificate and key for cn, modified at
+// modTime.
+func writeTestKeyPair(t *testing.T, certFile, keyFile, cn string, modTime time.Time) {
+	t.Helper()
+	cert, key := newTestCert(t, cn)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	start := time.Now().Add(-time.Hour)
+	writeTestKeyPair(t, certFile, keyFile, "first", start)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := func() string {
+		cert, _ := r.GetCertificate(&tls.ClientHelloInfo{})
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	writeTestKeyPair(t, certFile, keyFile, "second", start.Add(time.Minute))
+	if err := r.reload(); err != nil || subject() != "second" {
+		t.Fatalf("reload() = %v, serving %s, want second", err, subject())
+	}
+
+	// A broken pair, e.g. written halfway, keeps the previous certificate.
+	if err := writeFile(keyFile, "broken"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil || subject() != "second" {
+		t.Errorf("reload() of a broken pair = %v, serving %s, want an error and second", err, subject())
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := t.TempDir()
+	ca, _ := newTestCert(t, "Test CA")
+	bundle, empty := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "empty.crt")
+	if err := writeFile(bundle, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(empty, "not a certificate\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := loadCertPool(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("Verify() with the pool = %v", err)
+	}
+	if _, err := loadCertPool(bundle, empty); err == nil {
+		t.Error("loadCertPool() of a file without certificates error = nil")
+	}
+	if _, err := loadCertPool(filepath.Join(dir, "missing.crt")); err == nil {
+		t.Error("loadCertPool() of a missing file error = nil")
+	}
+}
@@ -0,0 +1,205 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	stdlog "log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSConfig tunes the TLS sessions of the server.
+type TLSConfig struct {
+	SessionTickets       *bool  `yaml:"sessionTickets"`
+	SessionTicketKeyFile string `yaml:"sessionTicketKeyFile"`
+}
+
+// GetSessionTickets returns whether clients can resume sessions with
+// session tickets, defaults to true.
+func (c TLSConfig) GetSessionTickets() bool {
+	return c.SessionTickets == nil || *c.SessionTickets
+}
+
+// Validate checks the session ticket keys.
+func (c TLSConfig) Validate() error {
+	if c.SessionTicketKeyFile == "" {
+		return nil
+	}
+	if !c.GetSessionTickets() {
+		return errors.New("tls.sessionTicketKeyFile requires session tickets")
+	}
+	_, err := readSessionTicketKeys(c.SessionTicketKeyFile)
+	return err
+}
+
+// readSessionTicketKeys reads the session ticket keys of a file, one 32-byte
+// key in base64 per line. The first key encrypts new tickets, the others
+// only decrypt, so keys can be rotated without breaking resumptions.
+func readSessionTicketKeys(file string) ([][32]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading session ticket keys")
+	}
+	var keys [][32]byte
+	for i, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(b) != 32 {
+			return nil, errors.Errorf("invalid session ticket key on line %d of %s, must be 32 bytes in base64", i+1, file)
+		}
+		keys = append(keys, [32]byte(b))
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("no session ticket keys found in %s", file)
+	}
+
+	return keys, nil
+}
+
+// applyTLSSettings applies the session ticket settings and the handshake
+// metrics to the server. The handshakes are counted in VerifyConnection,
+// also set on the configs returned by GetConfigForClient, like the one of
+// the bootstrapped server, and the failures in the handshake errors logged
+// by the server.
+func applyTLSSettings(ctx context.Context, srv *http.Server, c TLSConfig) error {
+	cfg := srv.TLSConfig
+	cfg.SessionTicketsDisabled = !c.GetSessionTickets()
+	if c.SessionTicketKeyFile != "" {
+		keys, err := readSessionTicketKeys(c.SessionTicketKeyFile)
+		if err != nil {
+			return err
+		}
+		cfg.SetSessionTicketKeys(keys)
+		go watchSessionTicketKeys(ctx, cfg, c.SessionTicketKeyFile, 30*time.Second)
+	}
+
+	cfg.VerifyConnection = countHandshake(cfg.VerifyConnection)
+	if next := cfg.GetConfigForClient; next != nil {
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := next(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+			// Configs cloned from cfg, like the ones of applyClientCAs,
+			// already count the handshakes.
+			if c.VerifyConnection == nil || c.SessionTicketsDisabled != cfg.SessionTicketsDisabled {
+				c = c.Clone()
+				c.SessionTicketsDisabled = cfg.SessionTicketsDisabled
+				if c.VerifyConnection == nil {
+					c.VerifyConnection = countHandshake(nil)
+				}
+			}
+			return c, nil
+		}
+	}
+	srv.ErrorLog = stdlog.New(serverErrorLog{}, "", 0)
+
+	return nil
+}
+
+// watchSessionTicketKeys reloads the session ticket keys every interval
+// until ctx is done.
+func watchSessionTicketKeys(ctx context.Context, cfg *tls.Config, file string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, _ := os.ReadFile(file)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			data, err := os.ReadFile(file)
+			if err != nil || bytes.Equal(data, last) {
+				continue
+			}
+			keys, err := readSessionTicketKeys(file)
+			if err != nil {
+				logFor("tls").WithField("error", err).Error("Error reloading session ticket keys, keeping the previous ones")
+				continue
+			}
+			last = data
+			cfg.SetSessionTicketKeys(keys)
+			logFor("tls").WithField("keys", len(keys)).Info("Loaded session ticket keys")
+		}
+	}
+}
+
+// countHandshake wraps a VerifyConnection callback to count the
+// handshakes by version, cipher suite and resumption.
+func countHandshake(next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+		tlsHandshakes.WithLabelValues(tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite), strconv.FormatBool(cs.DidResume)).Inc()
+		return nil
+	}
+}
+
+// serverErrorLog receives the errors logged by the HTTP server. TLS
+// handshake errors are counted by reason and logged at debug level, as
+// scanners and probes cause many of them; other errors are logged as
+// warnings.
+type serverErrorLog struct{}
+
+func (serverErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if rest, ok := strings.CutPrefix(msg, "http: TLS handshake error from "); ok {
+		remote, err, _ := strings.Cut(rest, ": ")
+		reason := handshakeFailureReason(err)
+		tlsHandshakeFailures.WithLabelValues(reason).Inc()
+		logFor("tls").WithFields(log.Fields{
+			"remote": remote,
+			"reason": reason,
+			"error":  err,
+		}).Debug("TLS handshake failed")
+		return len(p), nil
+	}
+	logFor("server").Warn(strings.TrimPrefix(msg, "http: "))
+
+	return len(p), nil
+}
+
+// handshakeFailureReasons map the handshake errors to the reason label,
+// first match wins.
+var handshakeFailureReasons = []struct {
+	match, reason string
+}{
+	{"client didn't provide a certificate", "no_client_certificate"},
+	{"certificate signed by unknown authority", "unknown_authority"},
+	{"certificate has expired or is not yet valid", "expired_certificate"},
+	{"incompatible key usage", "bad_key_usage"},
+	{"failed to verify certificate", "bad_certificate"},
+	{"remote error: tls: bad certificate", "server_certificate_rejected"},
+	{"remote error: tls: unknown certificate authority", "server_certificate_rejected"},
+	{"remote error", "remote_error"},
+	{"unsupported versions", "protocol_version"},
+	{"protocol version", "protocol_version"},
+	{"no cipher suite", "no_cipher_suite"},
+	{"no application protocol", "no_application_protocol"},
+	{"does not look like a TLS handshake", "not_tls"},
+	{"i/o timeout", "timeout"},
+	{"EOF", "connection_closed"},
+	{"connection reset", "connection_closed"},
+}
+
+func handshakeFailureReason(err string) string {
+	for _, r := range handshakeFailureReasons {
+		if strings.Contains(err, r.match) {
+			return r.reason
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,181 @@
+package signer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeSessionTicketKeys writes n random session ticket keys to a file of
+// dir and returns its path.
+func writeSessionTicketKeys(t *testing.T, dir string, n int) string {
+	t.Helper()
+	var lines []string
+	for i := 0; i < n; i++ {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, base64.StdEncoding.EncodeToString(key[:]))
+	}
+	file := filepath.Join(dir, "tickets")
+	if err := writeFile(file, strings.Join(lines, "\n")+"\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	keys := writeSessionTicketKeys(t, dir, 2)
+	short := filepath.Join(dir, "short")
+	if err := writeFile(short, base64.StdEncoding.EncodeToString([]byte("short"))); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := writeFile(empty, "\n"); err != nil {
+		t.Fatal(err)
+	}
+	disabled := false
+
+	tests := []struct {
+		name string
+		c    TLSConfig
+		ok   bool
+	}{
+		{"default", TLSConfig{}, true},
+		{"keys", TLSConfig{SessionTicketKeyFile: keys}, true},
+		{"keys without tickets", TLSConfig{SessionTickets: &disabled, SessionTicketKeyFile: keys}, false},
+		{"short key", TLSConfig{SessionTicketKeyFile: short}, false},
+		{"no keys", TLSConfig{SessionTicketKeyFile: empty}, false},
+		{"missing", TLSConfig{SessionTicketKeyFile: filepath.Join(dir, "missing")}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	if got, err := readSessionTicketKeys(keys); err != nil || len(got) != 2 {
+		t.Errorf("readSessionTicketKeys() = %d keys, %v, want 2", len(got), err)
+	}
+	if !(TLSConfig{}).GetSessionTickets() || (TLSConfig{SessionTickets: &disabled}).GetSessionTickets() {
+		t.Error("GetSessionTickets() does not default to true")
+	}
+}
+
+func TestHandshakeFailureReason(t *testing.T) {
+	tests := []struct {
+		err  string
+		want string
+	}{
+		{"tls: client didn't provide a certificate", "no_client_certificate"},
+		{"tls: failed to verify certificate: x509: certificate signed by unknown authority", "unknown_authority"},
+		{"tls: failed to verify certificate: x509: certificate has expired or is not yet valid: current time", "expired_certificate"},
+		{"remote error: tls: bad certificate", "server_certificate_rejected"},
+		{"remote error: tls: handshake failure", "remote_error"},
+		{"tls: client offered only unsupported versions: [302 301]", "protocol_version"},
+		{"tls: first record does not look like a TLS handshake", "not_tls"},
+		{"read tcp 127.0.0.1:4443->127.0.0.1:5000: i/o timeout", "timeout"},
+		{"EOF", "connection_closed"},
+		{"something else", "other"},
+	}
+	for _, tt := range tests {
+		if got := handshakeFailureReason(tt.err); got != tt.want {
+			t.Errorf("handshakeFailureReason(%q) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestServerErrorLog(t *testing.T) {
+	failures := tlsHandshakeFailures.WithLabelValues("not_tls")
+	before := testutil.ToFloat64(failures)
+	msg := "http: TLS handshake error from 10.0.0.1:5000: tls: first record does not look like a TLS handshake\n"
+	if n, err := (serverErrorLog{}).Write([]byte(msg)); n != len(msg) || err != nil {
+		t.Errorf("Write() = %d, %v", n, err)
+	}
+	if _, err := (serverErrorLog{}).Write([]byte("http: Accept error: too many open files\n")); err != nil {
+		t.Errorf("Write() of another error = %v", err)
+	}
+	if got := testutil.ToFloat64(failures) - before; got != 1 {
+		t.Errorf("handshake failures counted = %v, want 1", got)
+	}
+}
+
+func TestApplyTLSSettings(t *testing.T) {
+	root, rootKey := newTestCert(t, "Test Root CA")
+	cert, key := issueTestCert(t, root, rootKey, "127.0.0.1", false)
+	hs := &http.Server{TLSConfig: &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := applyTLSSettings(ctx, hs, TLSConfig{SessionTicketKeyFile: writeSessionTicketKeys(t, t.TempDir(), 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = hs.TLSConfig
+	srv.Config.ErrorLog = hs.ErrorLog
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   &tls.Config{MinVersion: tls.VersionTLS13, RootCAs: pool, ClientSessionCache: tls.NewLRUClientSessionCache(1)},
+	}}
+	suite := tls.CipherSuiteName(tls.TLS_AES_128_GCM_SHA256)
+	full := tlsHandshakes.WithLabelValues("TLS 1.3", suite, "false")
+	resumed := tlsHandshakes.WithLabelValues("TLS 1.3", suite, "true")
+	beforeFull, beforeResumed := testutil.ToFloat64(full), testutil.ToFloat64(resumed)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if got := testutil.ToFloat64(full) - beforeFull; got != 1 {
+		t.Errorf("full handshakes counted = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(resumed) - beforeResumed; got != 1 {
+		t.Errorf("resumed handshakes counted = %v, want 1", got)
+	}
+
+	rejected := tlsHandshakeFailures.WithLabelValues("server_certificate_rejected")
+	before := testutil.ToFloat64(rejected)
+	if _, err := http.Get(srv.URL); err == nil {
+		t.Fatal("request without the root error = nil")
+	}
+	for deadline := time.Now().Add(time.Second); testutil.ToFloat64(rejected) == before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("rejected handshakes counted = %v, want 1", got)
+	}
+
+	disabled := false
+	hs = &http.Server{TLSConfig: &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{}, nil
+	}}}
+	if err := applyTLSSettings(ctx, hs, TLSConfig{SessionTickets: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := hs.TLSConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil || !c.SessionTicketsDisabled || c.VerifyConnection == nil || !hs.TLSConfig.SessionTicketsDisabled {
+		t.Errorf("GetConfigForClient() = %+v, %v, want session tickets disabled and handshakes counted", c, err)
+	}
+}
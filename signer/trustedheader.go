@@ -0,0 +1,219 @@
+package signer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// TrustedHeaderConfig accepts the client identity from a header set by a
+// trusted proxy, e.g. the X-Forwarded-Client-Cert header of an Envoy based
+// mesh. The header is only accepted from the listed proxy certificate
+// names and, if set, source networks. Source networks alone can be spoofed
+// by any workload in them, so they require InsecureSourceCIDRsOnly.
+type TrustedHeaderConfig struct {
+	Header                  string   `yaml:"header"`
+	Format                  string   `yaml:"format"`
+	SourceCIDRs             []string `yaml:"sourceCIDRs"`
+	ProxyClients            []string `yaml:"proxyClients"`
+	InsecureSourceCIDRsOnly bool     `yaml:"insecureSourceCIDRsOnly"`
+}
+
+// GetHeader returns the identity header, defaults to X-Forwarded-Client-Cert.
+func (c TrustedHeaderConfig) GetHeader() string {
+	if c.Header == "" {
+		return "X-Forwarded-Client-Cert"
+	}
+	return c.Header
+}
+
+// GetFormat returns the format of the header, "xfcc" (default) or "plain"
+// for a comma separated list of names.
+func (c TrustedHeaderConfig) GetFormat() string {
+	if c.Format == "" {
+		return "xfcc"
+	}
+	return c.Format
+}
+
+// Validate checks the format and that the trusted sources are restricted.
+func (c TrustedHeaderConfig) Validate() error {
+	if f := c.GetFormat(); f != "xfcc" && f != "plain" {
+		return errors.Errorf("invalid clientAuth.trustedHeader format %q", c.Format)
+	}
+	if len(c.ProxyClients) == 0 {
+		if len(c.SourceCIDRs) == 0 {
+			return errors.New("clientAuth.trustedHeader requires proxyClients")
+		}
+		if !c.InsecureSourceCIDRsOnly {
+			return errors.New("clientAuth.trustedHeader requires proxyClients, sourceCIDRs alone require insecureSourceCIDRsOnly")
+		}
+	}
+	if _, err := parseCIDRs(c.SourceCIDRs); err != nil {
+		return errors.Wrap(err, "invalid clientAuth.trustedHeader sourceCIDRs")
+	}
+
+	return nil
+}
+
+type identitiesKey struct{}
+
+// trustedHeader wraps next taking the client identities from the trusted
+// header. Requests carrying the header from an untrusted source are
+// rejected with 403 Forbidden.
+func (s *server) trustedHeader(next http.Handler) http.Handler {
+	c := s.config.ClientAuth.TrustedHeader
+	if c == nil {
+		return next
+	}
+	nets, _ := parseCIDRs(c.SourceCIDRs)
+	if len(c.ProxyClients) == 0 {
+		logFor("tls").WithField("sourceCIDRs", c.SourceCIDRs).Warn("The trusted identity header is accepted from any client of sourceCIDRs, configure proxyClients")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(c.GetHeader())
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		proxy := clientIdentities(r)
+		if !c.trusted(r, nets, proxy) {
+			trustedHeaderRejected.Inc()
+			logFor("tls").WithFields(log.Fields{
+				"remote": r.RemoteAddr,
+				"client": proxy,
+				"header": c.GetHeader(),
+			}).Warn("Forbidden: identity header from an untrusted source")
+			render.Error(w, r, errs.Forbidden("%s is not accepted from this source", c.GetHeader()))
+			return
+		}
+
+		var ids []string
+		if c.GetFormat() == "plain" {
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					ids = append(ids, name)
+				}
+			}
+		} else {
+			ids = parseXFCC(value)
+		}
+		if len(ids) == 0 {
+			render.Error(w, r, errs.BadRequest("%s has no client identity", c.GetHeader()))
+			return
+		}
+
+		logFor("tls").WithFields(log.Fields{
+			"proxy":  proxy,
+			"client": ids,
+		}).Debug("Using client identity from trusted header")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identitiesKey{}, ids)))
+	})
+}
+
+// trusted reports whether the request comes from a trusted proxy.
+func (c *TrustedHeaderConfig) trusted(r *http.Request, nets []*net.IPNet, proxy []string) bool {
+	if len(nets) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(stripZone(host)); ip == nil || !inCIDRs(ip, nets) {
+			return false
+		}
+	}
+	if len(c.ProxyClients) > 0 && !policy.ContainsAny(c.ProxyClients, proxy) {
+		return false
+	}
+
+	return true
+}
+
+// parseXFCC returns the identities in the last element of an
+// X-Forwarded-Client-Cert header, the one added by the nearest proxy: the
+// common name of the subject followed by the DNS and URI SANs.
+func parseXFCC(value string) []string {
+	elements := splitQuoted(value, ',')
+	if len(elements) == 0 {
+		return nil
+	}
+
+	var cn string
+	var dns, uris []string
+	for _, pair := range splitQuoted(elements[len(elements)-1], ';') {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "subject":
+			cn = subjectCommonName(v)
+		case "dns":
+			dns = append(dns, v)
+		case "uri":
+			if u, err := url.Parse(v); err == nil {
+				uris = append(uris, u.String())
+			}
+		}
+	}
+
+	var ids []string
+	if cn != "" {
+		ids = append(ids, cn)
+	}
+	return append(append(ids, dns...), uris...)
+}
+
+// splitQuoted splits s on sep outside double quotes.
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	var b strings.Builder
+	quoted, escaped := false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			if p := strings.TrimSpace(b.String()); p != "" {
+				parts = append(parts, p)
+			}
+			b.Reset()
+			continue
+		}
+		b.WriteRune(c)
+	}
+	if p := strings.TrimSpace(b.String()); p != "" {
+		parts = append(parts, p)
+	}
+
+	return parts
+}
+
+// subjectCommonName returns the CN of a subject in RFC 4514 form, e.g.
+// "CN=client,OU=team,O=example".
+func subjectCommonName(subject string) string {
+	for _, rdn := range splitQuoted(subject, ',') {
+		k, v, ok := strings.Cut(rdn, "=")
+		if ok && strings.EqualFold(strings.TrimSpace(k), "CN") {
+			return strings.ReplaceAll(strings.TrimSpace(v), `\`, "")
+		}
+	}
+
+	return ""
+}
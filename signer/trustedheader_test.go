@@ -0,0 +1,57 @@
+package signer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestTrustedHeaderConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TrustedHeaderConfig
+		wantErr bool
+	}{
+		{"proxy clients", TrustedHeaderConfig{ProxyClients: []string{"envoy"}}, false},
+		{"both", TrustedHeaderConfig{ProxyClients: []string{"envoy"}, SourceCIDRs: []string{"10.0.0.0/8"}}, false},
+		{"source cidrs only", TrustedHeaderConfig{SourceCIDRs: []string{"10.0.0.0/8"}}, true},
+		{"insecure source cidrs only", TrustedHeaderConfig{SourceCIDRs: []string{"10.0.0.0/8"}, InsecureSourceCIDRsOnly: true}, false},
+		{"none", TrustedHeaderConfig{InsecureSourceCIDRsOnly: true}, true},
+		{"invalid format", TrustedHeaderConfig{ProxyClients: []string{"envoy"}, Format: "json"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrustedHeader(t *testing.T) {
+	s := &server{config: &Config{ClientAuth: ClientAuthConfig{TrustedHeader: &TrustedHeaderConfig{
+		Format:       "plain",
+		ProxyClients: []string{"envoy"},
+	}}}}
+	var got []string
+	h := s.trustedHeader(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIdentities(r)
+	}))
+
+	r := withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), "envoy")
+	r.Header.Set("X-Forwarded-Client-Cert", "app, app.internal")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !reflect.DeepEqual(got, []string{"app", "app.internal"}) {
+		t.Fatalf("identities = %v, want the header identities", got)
+	}
+
+	r = withIdentities(httptest.NewRequest(http.MethodPost, "/sign", nil), "app")
+	r.Header.Set("X-Forwarded-Client-Cert", "admin")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d from another client, want 403", w.Code)
+	}
+}
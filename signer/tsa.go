@@ -0,0 +1,555 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// maxTimestampQuery is the maximum size of a timestamp query.
+const maxTimestampQuery = 64 << 10
+
+// PKIStatus values and PKIFailureInfo bits of RFC 3161.
+const (
+	tsaGranted   = 0
+	tsaRejection = 2
+
+	tsaBadAlg              = 0
+	tsaBadRequest          = 2
+	tsaBadDataFormat       = 5
+	tsaUnacceptedPolicy    = 15
+	tsaUnacceptedExtension = 16
+	tsaSystemFailure       = 25
+)
+
+var (
+	oidSignedData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCertificate2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidECDSAWithSHA256     = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidRSAWithSHA256       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+)
+
+// TSAConfig enables POST /tsa, an RFC 3161 timestamping authority. The
+// timestamp tokens are signed with a key generated by the signer, whose
+// certificate, with the critical timeStamping extended key usage, is issued
+// by the main provisioner and renewed after two thirds of its lifetime.
+type TSAConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Name     string   `yaml:"name"`
+	Policy   string   `yaml:"policy"`
+	KeyType  string   `yaml:"keyType"`
+	Duration string   `yaml:"duration"`
+	Accuracy string   `yaml:"accuracy"`
+	Clients  []string `yaml:"clients"`
+}
+
+// GetKeyType returns the type of the TSA key, "EC" (default, P-256) or
+// "RSA" (2048 bits).
+func (c TSAConfig) GetKeyType() string {
+	if c.KeyType != "" {
+		return c.KeyType
+	}
+
+	return "EC"
+}
+
+// GetDuration returns the lifetime of the TSA certificate, defaults to 720h.
+func (c TSAConfig) GetDuration() time.Duration {
+	if d, err := time.ParseDuration(c.Duration); err == nil {
+		return d
+	}
+
+	return 720 * time.Hour
+}
+
+// GetAccuracy returns the accuracy of the times in the tokens, defaults to
+// 1s.
+func (c TSAConfig) GetAccuracy() time.Duration {
+	if d, err := time.ParseDuration(c.Accuracy); err == nil {
+		return d
+	}
+
+	return time.Second
+}
+
+// Validate checks the name, the policy and the durations.
+func (c TSAConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Name == "" {
+		return errors.New("tsa requires a name")
+	}
+	if _, err := parseOID(c.Policy); err != nil {
+		return errors.Errorf("invalid tsa policy %q, must be an OID", c.Policy)
+	}
+	if t := c.GetKeyType(); t != "EC" && t != "RSA" {
+		return errors.Errorf("invalid tsa keyType %q, must be EC or RSA", t)
+	}
+	for _, d := range []struct{ name, value string }{{"duration", c.Duration}, {"accuracy", c.Accuracy}} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v <= 0 {
+			return errors.Errorf("invalid tsa %s %q", d.name, d.value)
+		}
+	}
+
+	return nil
+}
+
+// parseOID parses an OID in dotted form.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	if _, err := x509.ParseOID(s); err != nil {
+		return nil, err
+	}
+	var oid asn1.ObjectIdentifier
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, err
+		}
+		oid = append(oid, n)
+	}
+
+	return oid, nil
+}
+
+// timestamper holds the key and the certificate signing the timestamp
+// tokens.
+type timestamper struct {
+	config TSAConfig
+	policy asn1.ObjectIdentifier
+
+	mu    sync.RWMutex
+	key   crypto.Signer
+	cert  *x509.Certificate
+	renew time.Time
+}
+
+func newTimestamper(c TSAConfig) *timestamper {
+	policy, _ := parseOID(c.Policy)
+	return &timestamper{config: c, policy: policy}
+}
+
+// signer returns the current key and certificate, or nil if there is no
+// valid certificate.
+func (t *timestamper) signer() (crypto.Signer, *x509.Certificate) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.cert == nil || signerClock.Now().After(t.cert.NotAfter) {
+		return nil, nil
+	}
+
+	return t.key, t.cert
+}
+
+// renewTSA is the tsa-certificate job. It generates a new key and issues
+// its certificate when there is none, or two thirds of its lifetime have
+// passed.
+func (s *server) renewTSA(ctx context.Context) error {
+	t := s.tsa
+	t.mu.RLock()
+	due := t.cert == nil || !signerClock.Now().Before(t.renew)
+	t.mu.RUnlock()
+	if !due {
+		return nil
+	}
+
+	key, csr, err := newKeyAndRequest(t.config.GetKeyType(), t.config.Name, []string{t.config.Name})
+	if err != nil {
+		return err
+	}
+	request := &SignRequest{CsrPEM: api.CertificateRequest{CertificateRequest: csr}}
+	request.NotAfter.SetDuration(t.config.GetDuration())
+	data, err := json.Marshal(map[string]interface{}{
+		"profile":     "tsa",
+		"keyUsage":    []string{"digitalSignature"},
+		"extKeyUsage": []string{"timeStamping"},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeouts.GetSign())
+	defer cancel()
+	resp, err := s.issueWith(ctx, upstreamDefault, request, data)
+	if err != nil {
+		return errors.Wrap(err, "error issuing the TSA certificate")
+	}
+	cert := resp.ServerPEM.Certificate
+	if err := checkTSACertificate(cert); err != nil {
+		return errors.Wrap(err, "upstream CA did not apply the TSA profile")
+	}
+
+	t.mu.Lock()
+	t.key, t.cert = key, cert
+	t.renew = cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 2 / 3)
+	t.mu.Unlock()
+	logFor("tsa").WithFields(log.Fields{
+		"serial":   cert.SerialNumber.String(),
+		"notAfter": cert.NotAfter,
+	}).Info("Issued TSA certificate")
+
+	return nil
+}
+
+// checkTSACertificate checks that timeStamping is the only extended key
+// usage of the certificate, in a critical extension, as RFC 3161 requires.
+func checkTSACertificate(cert *x509.Certificate) error {
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageTimeStamping || len(cert.UnknownExtKeyUsage) > 0 {
+		return errors.New("certificate must only have the timeStamping extended key usage")
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 37}) && !ext.Critical {
+			return errors.New("extended key usage of the certificate must be critical")
+		}
+	}
+
+	return nil
+}
+
+type tsaMessageImprint struct {
+	Raw           asn1.RawContent
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// tsaRequest is a TimeStampReq, RFC 3161.
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     []pkix.Extension      `asn1:"optional,tag:0"`
+}
+
+type tsaStatusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional,omitempty"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+// tsaResponse is a TimeStampResp, RFC 3161.
+type tsaResponse struct {
+	Status tsaStatusInfo
+	Token  asn1.RawValue `asn1:"optional"`
+}
+
+type tsaAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// tstInfo is the content of a timestamp token, RFC 3161.
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint asn1.RawValue
+	SerialNumber   *big.Int
+	GenTime        asn1.RawValue
+	Accuracy       tsaAccuracy `asn1:"optional"`
+	Nonce          *big.Int    `asn1:"optional"`
+}
+
+// tsaGenTime returns t as a GeneralizedTime with microseconds, without the
+// trailing zeros of the fraction, as RFC 3161 requires. encoding/asn1 only
+// marshals whole seconds.
+func tsaGenTime(t time.Time) asn1.RawValue {
+	s := t.UTC().Truncate(time.Microsecond).Format("20060102150405.999999") + "Z"
+	return asn1.RawValue{Tag: asn1.TagGeneralizedTime, Bytes: []byte(s)}
+}
+
+// newTSAAccuracy returns the accuracy a, rounded up to the microsecond, in
+// seconds, millis and micros.
+func newTSAAccuracy(a time.Duration) tsaAccuracy {
+	a = (a + time.Microsecond - 1).Truncate(time.Microsecond)
+	return tsaAccuracy{
+		Seconds: int(a / time.Second),
+		Millis:  int(a % time.Second / time.Millisecond),
+		Micros:  int(a % time.Millisecond / time.Microsecond),
+	}
+}
+
+// tsaRejectionResponse returns a rejection with the failure bit and the reason.
+func tsaRejectionResponse(failure int, reason string) tsaResponse {
+	bits := make([]byte, failure/8+1)
+	bits[failure/8] = 0x80 >> (failure % 8)
+	return tsaResponse{Status: tsaStatusInfo{
+		Status:       tsaRejection,
+		StatusString: []asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte(reason)}},
+		FailInfo:     asn1.BitString{Bytes: bits, BitLength: failure + 1},
+	}}
+}
+
+// checkTimestampQuery returns the failure bit and reason if the query is
+// not supported.
+func (t *timestamper) checkTimestampQuery(req tsaRequest) (int, string, bool) {
+	if req.Version != 1 {
+		return tsaBadDataFormat, "unsupported version", false
+	}
+	sizes := []struct {
+		oid  asn1.ObjectIdentifier
+		size int
+	}{{oidSHA256, sha256.Size}, {oidSHA384, 48}, {oidSHA512, 64}}
+	ok := false
+	for _, h := range sizes {
+		if req.MessageImprint.HashAlgorithm.Algorithm.Equal(h.oid) {
+			if len(req.MessageImprint.HashedMessage) != h.size {
+				return tsaBadDataFormat, "invalid hashed message length", false
+			}
+			ok = true
+		}
+	}
+	if !ok {
+		return tsaBadAlg, "unsupported hash algorithm, must be SHA-256, SHA-384 or SHA-512", false
+	}
+	if len(req.ReqPolicy) > 0 && !req.ReqPolicy.Equal(t.policy) {
+		return tsaUnacceptedPolicy, "unaccepted policy", false
+	}
+	if len(req.Extensions) > 0 {
+		return tsaUnacceptedExtension, "extensions are not supported", false
+	}
+
+	return 0, "", true
+}
+
+// timestamp handles a timestamp query, application/timestamp-query, and
+// responds with a timestamp reply, application/timestamp-reply. Queries
+// the TSA does not support are rejected in the reply.
+func (s *server) timestamp(w http.ResponseWriter, r *http.Request) {
+	clients := clientIdentities(r)
+	if len(s.tsa.config.Clients) > 0 && !clientAllowed(r, s.tsa.config.Clients) {
+		timestamps.WithLabelValues("forbidden").Inc()
+		render.Error(w, r, errs.Forbidden("client is not allowed to request timestamps"))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxTimestampQuery))
+	if err != nil {
+		render.Error(w, r, errs.BadRequestErr(err, "error reading request body"))
+		return
+	}
+
+	reply := func(status int, resp tsaResponse, result string) {
+		b, err := asn1.Marshal(resp)
+		if err != nil {
+			render.Error(w, r, errs.InternalServerErr(err))
+			return
+		}
+		timestamps.WithLabelValues(result).Inc()
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		w.WriteHeader(status)
+		w.Write(b)
+	}
+
+	var req tsaRequest
+	if rest, err := asn1.Unmarshal(body, &req); err != nil || len(rest) > 0 {
+		reply(http.StatusOK, tsaRejectionResponse(tsaBadRequest, "malformed timestamp query"), "rejected")
+		return
+	}
+	if failure, reason, ok := s.tsa.checkTimestampQuery(req); !ok {
+		logFor("tsa").WithFields(log.Fields{
+			"client": clients,
+			"reason": reason,
+		}).Info("Rejected timestamp query")
+		reply(http.StatusOK, tsaRejectionResponse(failure, reason), "rejected")
+		return
+	}
+
+	key, cert := s.tsa.signer()
+	if key == nil {
+		reply(http.StatusServiceUnavailable, tsaRejectionResponse(tsaSystemFailure, "TSA certificate is not available"), "error")
+		return
+	}
+	token, serial, err := s.tsa.sign(key, cert, req)
+	if err != nil {
+		logFor("tsa").WithField("error", err).Error("Error signing timestamp token")
+		reply(http.StatusInternalServerError, tsaRejectionResponse(tsaSystemFailure, "error signing the timestamp token"), "error")
+		return
+	}
+
+	logFor("tsa").WithFields(log.Fields{
+		"requestId": requestID(r),
+		"client":    clients,
+		"serial":    serial.String(),
+	}).Info("Issued timestamp token")
+	reply(http.StatusOK, tsaResponse{Status: tsaStatusInfo{Status: tsaGranted}, Token: asn1.RawValue{FullBytes: token}}, "granted")
+}
+
+// sign returns the timestamp token of the query, a CMS SignedData with the
+// TSTInfo as content, and its serial number.
+func (t *timestamper) sign(key crypto.Signer, cert *x509.Certificate, req tsaRequest) ([]byte, *big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, nil, err
+	}
+	info := tstInfo{
+		Version:        1,
+		Policy:         t.policy,
+		MessageImprint: asn1.RawValue{FullBytes: req.MessageImprint.Raw},
+		SerialNumber:   serial,
+		GenTime:        tsaGenTime(signerClock.Now()),
+		Accuracy:       newTSAAccuracy(t.config.GetAccuracy()),
+		Nonce:          req.Nonce,
+	}
+	content, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var certs []*x509.Certificate
+	if req.CertReq {
+		certs = []*x509.Certificate{cert}
+	}
+	token, err := signCMS(key, cert, oidTSTInfo, content, certs)
+	return token, serial, err
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsEncapsulatedContent struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	Content          cmsEncapsulatedContent
+	Certificates     []asn1.RawValue `asn1:"optional,omitempty,tag:0"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// signCMS returns a CMS SignedData, RFC 5652, of the content signed with
+// SHA-256 by the key of cert, with the content type, message digest and
+// signing certificate, RFC 5035, signed attributes.
+func signCMS(key crypto.Signer, cert *x509.Certificate, contentType asn1.ObjectIdentifier, content []byte, certs []*x509.Certificate) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	certHash := sha256.Sum256(cert.Raw)
+	var attrs [][]byte
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, contentType},
+		{oidMessageDigest, digest[:]},
+		{oidSigningCertificate2, signingCertificateV2{Certs: []essCertIDv2{{CertHash: certHash[:]}}}},
+	} {
+		value, err := asn1.Marshal(a.value)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(cmsAttribute{Type: a.oid, Values: []asn1.RawValue{{FullBytes: value}}})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	// The attributes are signed in their DER encoding, a sorted SET OF.
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	signedAttrs, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(attrs, nil)})
+	if err != nil {
+		return nil, err
+	}
+
+	var sigAlg pkix.AlgorithmIdentifier
+	switch key.Public().(type) {
+	case *ecdsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	case *rsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidRSAWithSHA256, Parameters: asn1.NullRawValue}
+	default:
+		return nil, errors.Errorf("unsupported key type %T", key.Public())
+	}
+	attrsDigest := sha256.Sum256(signedAttrs)
+	signature, err := key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := cmsSignedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		Content:          cmsEncapsulatedContent{ContentType: contentType, Content: content},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			SID:                cmsIssuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, Serial: cert.SerialNumber},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: bytes.Join(attrs, nil)},
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+		}},
+	}
+	for _, c := range certs {
+		sd.Certificates = append(sd.Certificates, asn1.RawValue{FullBytes: c.Raw})
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
@@ -0,0 +1,169 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// A SHA-256 query of "hello timestamp\n", with a nonce and certReq, created
+// by the openssl command line tool:
+//
+//	openssl ts -query -data data.txt -sha256 -cert -out query.tsq
+const (
+	testTimestampQuery = "30430201013031300d060960864801650304020105000420455c2e3ac0a976e1f88e80e427e51c9879ef1a58dfc0c082f0215acb654941e302085e91e0e7028b63f60101ff"
+	testTimestampNonce = 0x5e91e0e7028b63f6
+)
+
+// newTestTimestamper returns a timestamper with a certificate issued by a
+// test CA, and the CA certificate.
+func newTestTimestamper(t *testing.T, c TSAConfig) (*timestamper, *x509.Certificate) {
+	t.Helper()
+	ca, caKey := newTestCert(t, "Test CA")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eku, err := asn1.Marshal([]asn1.ObjectIdentifier{{1, 3, 6, 1, 5, 5, 7, 3, 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		Subject:         pkix.Name{CommonName: c.Name},
+		DNSNames:        []string{c.Name},
+		NotBefore:       ca.NotBefore,
+		NotAfter:        ca.NotAfter,
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 37}, Critical: true, Value: eku}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTSACertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTimestamper(c)
+	ts.key, ts.cert = key, cert
+	return ts, ca
+}
+
+func TestNewTSAAccuracy(t *testing.T) {
+	tests := []struct {
+		accuracy time.Duration
+		want     tsaAccuracy
+	}{
+		{time.Second, tsaAccuracy{Seconds: 1}},
+		{1500 * time.Millisecond, tsaAccuracy{Seconds: 1, Millis: 500}},
+		{2*time.Second + 1, tsaAccuracy{Seconds: 2, Micros: 1}},
+		{1500500 * time.Nanosecond, tsaAccuracy{Millis: 1, Micros: 501}},
+		{999999001 * time.Nanosecond, tsaAccuracy{Seconds: 1}},
+		{250 * time.Nanosecond, tsaAccuracy{Micros: 1}},
+	}
+	for _, tt := range tests {
+		if got := newTSAAccuracy(tt.accuracy); got != tt.want {
+			t.Errorf("newTSAAccuracy(%v) = %+v, want %+v", tt.accuracy, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampOpenSSLQuery(t *testing.T) {
+	ts, ca := newTestTimestamper(t, TSAConfig{Enabled: true, Name: "tsa.example.com", Policy: "1.3.6.1.4.1.99999.1.1", Accuracy: "1500ms"})
+	s := &server{tsa: ts}
+	query, _ := hex.DecodeString(testTimestampQuery)
+	before := time.Now()
+	w := httptest.NewRecorder()
+	s.timestamp(w, httptest.NewRequest(http.MethodPost, "/tsa", bytes.NewReader(query)))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/timestamp-reply" {
+		t.Fatalf("timestamp() = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var resp tsaResponse
+	if _, err := asn1.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status.Status != tsaGranted {
+		t.Fatalf("reply = %+v, %v, want granted", resp.Status, err)
+	}
+	p7, err := pkcs7.Parse(resp.Token.FullBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if err := p7.VerifyWithChain(roots); err != nil {
+		t.Fatalf("VerifyWithChain() = %v", err)
+	}
+
+	var info struct {
+		Version        int
+		Policy         asn1.ObjectIdentifier
+		MessageImprint tsaMessageImprint
+		SerialNumber   *big.Int
+		GenTime        time.Time   `asn1:"generalized"`
+		Accuracy       tsaAccuracy `asn1:"optional"`
+		Nonce          *big.Int    `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(p7.Content, &info); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Policy.Equal(ts.policy) || info.Nonce.Uint64() != testTimestampNonce {
+		t.Errorf("TSTInfo policy, nonce = %v, %x", info.Policy, info.Nonce)
+	}
+	if want := (tsaAccuracy{Seconds: 1, Millis: 500}); info.Accuracy != want {
+		t.Errorf("TSTInfo accuracy = %+v, want %+v", info.Accuracy, want)
+	}
+	if info.GenTime.Before(before.Truncate(time.Microsecond)) || info.GenTime.After(time.Now()) {
+		t.Errorf("TSTInfo genTime = %v, want the time of the query", info.GenTime)
+	}
+
+	// The reply is verified by openssl too, when it is installed.
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		return
+	}
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"query.tsq": query,
+		"reply.tsr": w.Body.Bytes(),
+		"ca.crt":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+	}
+	for name, data := range files {
+		if err := writeFile(filepath.Join(dir, name), string(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(openssl, "ts", "-verify", "-queryfile", "query.tsq", "-in", "reply.tsr", "-CAfile", "ca.crt")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("openssl ts -verify: %v\n%s", err, out)
+	}
+	cmd = exec.Command(openssl, "ts", "-reply", "-in", "reply.tsr", "-text")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl ts -reply: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Accuracy: 0x01 seconds, 0x01F4 millis, unspecified micros") {
+		t.Errorf("openssl ts -reply accuracy, got:\n%s", out)
+	}
+}
@@ -0,0 +1,528 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment of a process started by an upgrade: the number of listeners
+// it inherits, from file descriptor 3, and the addresses they are bound
+// for. The three next descriptors are the pipes of the handoff.
+const (
+	envListenFDs   = "CA_SIGNER_LISTEN_FDS"
+	envListenAddrs = "CA_SIGNER_LISTEN_ADDRS"
+)
+
+// Messages of the parent process of an upgrade to the new process: the
+// parent stopped serving and releases its resources, or it resumed serving
+// as the new process asked.
+const (
+	handoffReleasing byte = 1
+	handoffResumed   byte = 2
+)
+
+// errUpgradeAborted is returned by takeOver when the parent resumed serving.
+var errUpgradeAborted = errors.New("previous process still running, upgrade aborted")
+
+// ShutdownConfig configures the graceful shutdowns and upgrades of the
+// signer.
+type ShutdownConfig struct {
+	Timeout        string `yaml:"timeout"`
+	UpgradeTimeout string `yaml:"upgradeTimeout"`
+}
+
+// GetTimeout returns how long the requests in progress are waited for on
+// shutdown, defaults to 30s.
+func (c ShutdownConfig) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+
+	return 30 * time.Second
+}
+
+// GetUpgradeTimeout returns how long the new process of an upgrade has to
+// load its configuration and provisioners, defaults to 60s.
+func (c ShutdownConfig) GetUpgradeTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.UpgradeTimeout); err == nil {
+		return d
+	}
+
+	return 60 * time.Second
+}
+
+// Validate checks the durations.
+func (c ShutdownConfig) Validate() error {
+	if c.Timeout != "" {
+		if _, err := time.ParseDuration(c.Timeout); err != nil {
+			return errors.Wrap(err, "invalid shutdown timeout")
+		}
+	}
+	if c.UpgradeTimeout != "" {
+		if _, err := time.ParseDuration(c.UpgradeTimeout); err != nil {
+			return errors.Wrap(err, "invalid shutdown upgradeTimeout")
+		}
+	}
+
+	return nil
+}
+
+// executable is the path the signer was started with, resolved at startup:
+// os.Executable would return the replaced binary after an upgrade.
+var executable = func() string {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return os.Args[0]
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}()
+
+// handoff holds what a process started by an upgrade inherits from its
+// parent.
+type handoff struct {
+	listeners map[string]net.Listener
+	// ready is closed once the process is ready to take over.
+	ready *os.File
+	// parent reads the messages of the parent process, and EOF once it has
+	// exited.
+	parent *os.File
+	// resume asks the parent process to resume serving.
+	resume *os.File
+}
+
+var (
+	inheritOnce sync.Once
+	inherited   *handoff
+)
+
+// inheritance returns the handoff of the parent process, or nil if the
+// process was not started by an upgrade.
+func inheritance() *handoff {
+	inheritOnce.Do(func() {
+		n, err := strconv.Atoi(os.Getenv(envListenFDs))
+		if err != nil || n < 0 {
+			return
+		}
+		addrs := strings.Split(os.Getenv(envListenAddrs), ",")
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenAddrs)
+
+		h := &handoff{listeners: map[string]net.Listener{}}
+		for i := 0; i < n; i++ {
+			f := os.NewFile(uintptr(3+i), "listener")
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil || i >= len(addrs) {
+				logFor("server").WithField("error", err).Warn("Ignoring an inherited listener")
+				continue
+			}
+			h.listeners[addrs[i]] = ln
+		}
+		h.ready = os.NewFile(uintptr(3+n), "ready")
+		h.parent = os.NewFile(uintptr(4+n), "parent")
+		h.resume = os.NewFile(uintptr(5+n), "resume")
+		inherited = h
+	})
+
+	return inherited
+}
+
+// takeListener returns the inherited listener bound for addr, if any.
+func takeListener(addr string) (net.Listener, bool) {
+	h := inheritance()
+	if h == nil {
+		return nil, false
+	}
+	ln, ok := h.listeners[addr]
+	delete(h.listeners, addr)
+
+	return ln, ok
+}
+
+// closeInheritedListeners closes the inherited listeners of addresses no
+// longer configured.
+func closeInheritedListeners() {
+	if h := inheritance(); h != nil {
+		for addr, ln := range h.listeners {
+			logFor("server").WithField("address", addr).Info("Closing the inherited listener of a removed address")
+			ln.Close()
+		}
+		h.listeners = nil
+	}
+}
+
+// takeOver tells the parent process of an upgrade that this process has
+// loaded its configuration and provisioners, then waits for the parent to
+// finish its requests and exit, so it releases the resources it holds
+// exclusively, such as the inventory. Meanwhile new connections wait in the
+// backlog of the listeners. If the parent is still serving after timeout,
+// it is told to resume and errUpgradeAborted is returned. It does nothing if
+// the process was not started by an upgrade.
+func takeOver(timeout time.Duration) error {
+	h := inheritance()
+	if h == nil {
+		return nil
+	}
+	h.ready.Write([]byte{1})
+	h.ready.Close()
+	defer h.resume.Close()
+
+	// messages is closed once the parent has exited.
+	messages := make(chan byte, 2)
+	go func() {
+		defer close(messages)
+		defer h.parent.Close()
+		var b [1]byte
+		for {
+			if n, _ := h.parent.Read(b[:]); n != 1 {
+				return
+			}
+			messages <- b[0]
+		}
+	}()
+
+	select {
+	case <-messages:
+	case <-time.After(timeout):
+		// The parent may release its resources meanwhile, its answer tells
+		// which process serves.
+		h.resume.Write([]byte{1})
+		if m := <-messages; m == handoffResumed {
+			logFor("server").WithField("timeout", timeout.String()).Error("Previous process still serving, it resumes")
+			return errUpgradeAborted
+		}
+	}
+
+	// Once releasing, the parent no longer serves.
+	select {
+	case <-waitClosed(messages):
+		logFor("server").Info("Took over from the previous process")
+	case <-time.After(timeout):
+		logFor("server").WithField("timeout", timeout.String()).Warn("Previous process still running, taking over anyway")
+	}
+
+	return nil
+}
+
+// waitClosed returns a channel closed once c is closed, discarding its
+// values.
+func waitClosed(c <-chan byte) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for range c {
+		}
+		close(done)
+	}()
+
+	return done
+}
+
+// parentPipe is the write end of the pipe telling the new process of an
+// upgrade that this process has exited. It is kept open until then.
+var parentPipe *os.File
+
+// upgradeHandoff is the parent side of an upgrade whose new process is
+// ready to take over.
+type upgradeHandoff struct {
+	// files are the listeners passed on, kept to resume serving.
+	files  []*os.File
+	parent *os.File
+	resume *os.File
+}
+
+// upgrade starts a new process of the executable with the same arguments,
+// passing it the listeners, and waits until it is ready to take over. If
+// it fails to start, it is killed and this process keeps serving.
+func upgrade(listeners []net.Listener, addrs []string, timeout time.Duration) (*upgradeHandoff, error) {
+	up := &upgradeHandoff{}
+	for _, ln := range listeners {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			up.close()
+			return nil, errors.Errorf("listener %s cannot be passed on", ln.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			up.close()
+			return nil, errors.Wrapf(err, "error passing on listener %s", ln.Addr())
+		}
+		up.files = append(up.files, f)
+	}
+
+	// The new process gets an end of each pipe, closed here once it started.
+	var child []*os.File
+	defer func() {
+		for _, f := range child {
+			f.Close()
+		}
+	}()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		up.close()
+		return nil, err
+	}
+	defer readyR.Close()
+	child = append(child, readyW)
+	parentR, parentW, err := os.Pipe()
+	if err != nil {
+		up.close()
+		return nil, err
+	}
+	child = append(child, parentR)
+	up.parent = parentW
+	resumeR, resumeW, err := os.Pipe()
+	if err != nil {
+		up.close()
+		return nil, err
+	}
+	child = append(child, resumeW)
+	up.resume = resumeR
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envListenFDs+"=") && !strings.HasPrefix(kv, envListenAddrs+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		envListenFDs+"="+strconv.Itoa(len(listeners)),
+		envListenAddrs+"="+strings.Join(addrs, ","))
+	cmd.ExtraFiles = append(append([]*os.File{}, up.files...), child...)
+	if err := cmd.Start(); err != nil {
+		up.close()
+		return nil, errors.Wrapf(err, "error starting %s", executable)
+	}
+	logFor("server").WithFields(log.Fields{
+		"executable": executable,
+		"pid":        cmd.Process.Pid,
+	}).Info("Started the new process of the upgrade")
+
+	for _, f := range child {
+		f.Close()
+	}
+	child = nil
+
+	ready := make(chan bool, 1)
+	go func() {
+		// The new process closes the pipe without writing if it exits.
+		var b [1]byte
+		n, _ := readyR.Read(b[:])
+		ready <- n == 1
+	}()
+	var ok bool
+	select {
+	case ok = <-ready:
+	case <-time.After(timeout):
+	}
+	if !ok {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		up.close()
+		return nil, errors.Errorf("new process %d did not start within %s", cmd.Process.Pid, timeout)
+	}
+	parentPipe = parentW
+
+	return up, nil
+}
+
+// handOver shuts srv down for the new process of the upgrade. It returns a
+// server resuming on the listeners if the new process asks for it before
+// the requests in progress are finished, or nil once this process releases
+// its resources.
+func (up *upgradeHandoff) handOver(srv *http.Server, timeout time.Duration, onShutdown []func()) (*http.Server, []net.Listener, error) {
+	resume := make(chan struct{})
+	go func() {
+		var b [1]byte
+		if n, _ := up.resume.Read(b[:]); n == 1 {
+			close(resume)
+		}
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- shutdown(srv, timeout)
+	}()
+
+	var err error
+	select {
+	case <-resume:
+	case err = <-done:
+		select {
+		case <-resume:
+		default:
+			up.parent.Write([]byte{handoffReleasing})
+			up.close()
+			return nil, nil, err
+		}
+	}
+
+	listeners, lerr := up.listeners()
+	if lerr != nil {
+		// The new process takes over.
+		up.parent.Write([]byte{handoffReleasing})
+		up.close()
+		return nil, nil, errors.Wrap(lerr, "error resuming")
+	}
+	up.parent.Write([]byte{handoffResumed})
+	up.close()
+	parentPipe.Close()
+	parentPipe = nil
+
+	return resumedServer(srv, onShutdown), listeners, nil
+}
+
+// listeners returns the listeners passed on, to resume serving.
+func (up *upgradeHandoff) listeners() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, f := range up.files {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// close closes the listeners passed on and the pipes of this process.
+func (up *upgradeHandoff) close() {
+	for _, f := range up.files {
+		f.Close()
+	}
+	up.files = nil
+	if up.parent != nil && up.parent != parentPipe {
+		up.parent.Close()
+	}
+	if up.resume != nil {
+		up.resume.Close()
+	}
+}
+
+// resumedServer returns a server with the configuration of srv, which
+// cannot serve again once shut down.
+func resumedServer(srv *http.Server, onShutdown []func()) *http.Server {
+	resumed := &http.Server{
+		Addr:              srv.Addr,
+		Handler:           srv.Handler,
+		TLSConfig:         srv.TLSConfig,
+		ReadTimeout:       srv.ReadTimeout,
+		ReadHeaderTimeout: srv.ReadHeaderTimeout,
+		WriteTimeout:      srv.WriteTimeout,
+		IdleTimeout:       srv.IdleTimeout,
+		MaxHeaderBytes:    srv.MaxHeaderBytes,
+		TLSNextProto:      srv.TLSNextProto,
+		ConnState:         srv.ConnState,
+		ErrorLog:          srv.ErrorLog,
+		BaseContext:       srv.BaseContext,
+		ConnContext:       srv.ConnContext,
+	}
+	for _, fn := range onShutdown {
+		resumed.RegisterOnShutdown(fn)
+	}
+
+	return resumed
+}
+
+// serve serves srv on the listeners until SIGTERM or SIGINT, which shut it
+// down gracefully, or SIGUSR2, which upgrades the signer: a new process of
+// the executable takes the listeners over, and this one shuts down once it
+// is ready, unless the new process gives up waiting for it. The onShutdown
+// functions are called when the server shuts down.
+func serve(srv *http.Server, config *Config, listeners []net.Listener, onShutdown ...func()) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	for _, fn := range onShutdown {
+		srv.RegisterOnShutdown(fn)
+	}
+	start := func() <-chan error {
+		errc := make(chan error, 1)
+		go func(srv *http.Server, listeners []net.Listener) {
+			errc <- serveTLS(srv, listeners)
+		}(srv, listeners)
+		sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+		return errc
+	}
+	errc := start()
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case sig := <-sigs:
+			if sig != syscall.SIGUSR2 {
+				logFor("server").WithField("signal", sig.String()).Info("Shutting down")
+				return shutdown(srv, config.Shutdown.GetTimeout())
+			}
+
+			sdNotify("RELOADING=1")
+			up, err := upgrade(listeners, config.GetAddresses(), config.Shutdown.GetUpgradeTimeout())
+			if err != nil {
+				logFor("server").WithField("error", err).Error("Error upgrading, still serving")
+				sdNotify("READY=1")
+				continue
+			}
+			logFor("server").WithField("signal", sig.String()).Info("Shutting down for the upgrade")
+			resumed, resumedListeners, err := up.handOver(srv, config.Shutdown.GetTimeout(), onShutdown)
+			if resumed == nil {
+				return err
+			}
+			logFor("server").Warn("The new process gave up waiting, resuming serving")
+			srv, listeners = resumed, resumedListeners
+			errc = start()
+		}
+	}
+}
+
+// shutdown stops accepting connections and waits for the requests in
+// progress, closing the connections still active after timeout.
+func shutdown(srv *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logFor("server").WithField("error", err).Warn("Closing the connections still active")
+		return srv.Close()
+	}
+
+	return nil
+}
+
+// sdNotify sends a state to systemd, if the signer runs as a notify
+// service. The new process of an upgrade sends its MAINPID, which requires
+// NotifyAccess=all.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		logFor("server").WithField("error", err).Warn("Error notifying systemd")
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
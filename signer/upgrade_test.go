@@ -0,0 +1,110 @@
+package signer
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestHandoff returns the parent side of an upgrade of a server on a
+// local listener, and the pipe ends of the new process.
+func newTestHandoff(t *testing.T, handler http.Handler) (up *upgradeHandoff, srv *http.Server, parent, resume *os.File) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentR, parentW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumeR, resumeW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		parentR.Close()
+		resumeW.Close()
+	})
+
+	srv = &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	parentPipe = parentW
+	t.Cleanup(func() { parentPipe = nil })
+
+	return &upgradeHandoff{files: []*os.File{f}, parent: parentW, resume: resumeR}, srv, parentR, resumeW
+}
+
+func readMessage(t *testing.T, f *os.File) byte {
+	t.Helper()
+	var b [1]byte
+	if _, err := io.ReadFull(f, b[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	return b[0]
+}
+
+func TestHandOver(t *testing.T) {
+	up, srv, parent, _ := newTestHandoff(t, http.NotFoundHandler())
+
+	resumed, listeners, err := up.handOver(srv, time.Second, nil)
+	if err != nil || resumed != nil || listeners != nil {
+		t.Fatalf("handOver() = %v, %v, %v, want the server released", resumed, listeners, err)
+	}
+	if m := readMessage(t, parent); m != handoffReleasing {
+		t.Errorf("message = %d, want %d", m, handoffReleasing)
+	}
+}
+
+func TestHandOverResume(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	up, srv, parent, resume := newTestHandoff(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	addr := up.files[0]
+	ln, err := net.FileListener(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String()
+	ln.Close()
+
+	// A request in progress holds the shutdown until the new process asks
+	// to resume.
+	go http.Get(url + "/slow")
+	<-started
+	go resume.Write([]byte{1})
+
+	resumed, listeners, err := up.handOver(srv, 5*time.Second, nil)
+	close(release)
+	if err != nil || resumed == nil || len(listeners) != 1 {
+		t.Fatalf("handOver() = %v, %v, %v, want a resumed server", resumed, listeners, err)
+	}
+	if m := readMessage(t, parent); m != handoffResumed {
+		t.Errorf("message = %d, want %d", m, handoffResumed)
+	}
+
+	go resumed.Serve(listeners[0])
+	defer resumed.Close()
+	resp, err := http.Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,296 @@
+package signer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+)
+
+// UpstreamConfig configures how the signer connects to the upstream CAs:
+// the resolution of their host names, the certificates they must present
+// and the connection pool.
+type UpstreamConfig struct {
+	Resolver string              `yaml:"resolver"`
+	Hosts    map[string][]string `yaml:"hosts"`
+	Pins     []string            `yaml:"pins"`
+	HTTP     UpstreamHTTPConfig  `yaml:"http"`
+}
+
+// UpstreamHTTPConfig tunes the HTTP client of the upstream CAs. The
+// connections are kept alive and shared by all the requests, and TLS
+// sessions are resumed, so a busy signer does not handshake with the CA for
+// every request.
+type UpstreamHTTPConfig struct {
+	MaxIdleConns        int    `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int    `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int    `yaml:"maxConnsPerHost"`
+	IdleConnTimeout     string `yaml:"idleConnTimeout"`
+	TLSHandshakeTimeout string `yaml:"tlsHandshakeTimeout"`
+	DialTimeout         string `yaml:"dialTimeout"`
+	KeepAlive           string `yaml:"keepAlive"`
+}
+
+// GetMaxIdleConns returns the maximum number of idle connections to all the
+// CAs, defaults to 100.
+func (c UpstreamHTTPConfig) GetMaxIdleConns() int {
+	if c.MaxIdleConns > 0 {
+		return c.MaxIdleConns
+	}
+
+	return 100
+}
+
+// GetMaxIdleConnsPerHost returns the maximum number of idle connections to
+// a CA, defaults to 32. The default of net/http, 2, makes concurrent
+// requests open and close connections all the time.
+func (c UpstreamHTTPConfig) GetMaxIdleConnsPerHost() int {
+	if c.MaxIdleConnsPerHost > 0 {
+		return c.MaxIdleConnsPerHost
+	}
+
+	return 32
+}
+
+// GetIdleConnTimeout returns how long an idle connection is kept, defaults
+// to 90s.
+func (c UpstreamHTTPConfig) GetIdleConnTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.IdleConnTimeout); err == nil {
+		return d
+	}
+
+	return 90 * time.Second
+}
+
+// GetTLSHandshakeTimeout returns the timeout of the TLS handshakes,
+// defaults to 10s.
+func (c UpstreamHTTPConfig) GetTLSHandshakeTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.TLSHandshakeTimeout); err == nil {
+		return d
+	}
+
+	return 10 * time.Second
+}
+
+// GetDialTimeout returns the timeout of the TCP connections, defaults to
+// 30s.
+func (c UpstreamHTTPConfig) GetDialTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.DialTimeout); err == nil {
+		return d
+	}
+
+	return 30 * time.Second
+}
+
+// GetKeepAlive returns the interval of the TCP keep-alive probes, defaults
+// to 30s.
+func (c UpstreamHTTPConfig) GetKeepAlive() time.Duration {
+	if d, err := time.ParseDuration(c.KeepAlive); err == nil {
+		return d
+	}
+
+	return 30 * time.Second
+}
+
+// Validate checks the limits and durations.
+func (c UpstreamHTTPConfig) Validate() error {
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		return errors.New("upstream http maxIdleConns, maxIdleConnsPerHost and maxConnsPerHost must be positive")
+	}
+	for name, v := range map[string]string{
+		"idleConnTimeout":     c.IdleConnTimeout,
+		"tlsHandshakeTimeout": c.TLSHandshakeTimeout,
+		"dialTimeout":         c.DialTimeout,
+		"keepAlive":           c.KeepAlive,
+	} {
+		if v == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(v); err != nil {
+			return errors.Wrapf(err, "invalid upstream http %s", name)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the resolver address, the static addresses, the pins and
+// the HTTP client.
+func (c UpstreamConfig) Validate() error {
+	if c.Resolver != "" {
+		if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+			return errors.Wrap(err, "invalid upstream resolver, must be host:port")
+		}
+	}
+	for host, addrs := range c.Hosts {
+		if len(addrs) == 0 {
+			return errors.Errorf("upstream host %q has no addresses", host)
+		}
+		for _, a := range addrs {
+			if net.ParseIP(a) == nil {
+				return errors.Errorf("invalid address %q for upstream host %q", a, host)
+			}
+		}
+	}
+	for _, p := range c.Pins {
+		if b, err := hex.DecodeString(normalizeFingerprint(p)); err != nil || len(b) != sha256.Size {
+			return errors.Errorf("invalid upstream pin %q, must be a SHA-256 fingerprint in hexadecimal", p)
+		}
+	}
+
+	return c.HTTP.Validate()
+}
+
+// normalizeFingerprint returns a fingerprint in lowercase hexadecimal
+// without colons.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+// upstreamTransport returns the transport of the upstream CA clients. It
+// trusts the roots in pool, resolves the hosts with the static addresses or
+// the resolver, and requires one of the certificates presented by the CA to
+// match a pin.
+func upstreamTransport(c UpstreamConfig, pool *x509.CertPool) *http.Transport {
+	dialer := &net.Dialer{Timeout: c.HTTP.GetDialTimeout(), KeepAlive: c.HTTP.GetKeepAlive()}
+	if c.Resolver != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, c.Resolver)
+			},
+		}
+	}
+
+	pins := make([]string, len(c.Pins))
+	for i, p := range c.Pins {
+		pins[i] = normalizeFingerprint(p)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		RootCAs:            pool,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			upstreamHandshakes.WithLabelValues(strconv.FormatBool(cs.DidResume)).Inc()
+			if len(pins) == 0 {
+				return nil
+			}
+			return verifyPins(cs, pins)
+		},
+	}
+
+	hosts := make(map[string][]string, len(c.Hosts))
+	for h, addrs := range c.Hosts {
+		hosts[strings.ToLower(h)] = addrs
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           hostsDialer(dialer, hosts),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          c.HTTP.GetMaxIdleConns(),
+		MaxIdleConnsPerHost:   c.HTTP.GetMaxIdleConnsPerHost(),
+		MaxConnsPerHost:       c.HTTP.MaxConnsPerHost,
+		IdleConnTimeout:       c.HTTP.GetIdleConnTimeout(),
+		TLSHandshakeTimeout:   c.HTTP.GetTLSHandshakeTimeout(),
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
+// hostsDialer dials the static addresses of the hosts in order, and the
+// other hosts with dialer.
+func hostsDialer(dialer *net.Dialer, hosts map[string][]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamDials.Inc()
+		ips, ok := hosts[strings.ToLower(host)]
+		if !ok {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// verifyPins checks that a certificate of the verified chain, or presented
+// by the server, has one of the pinned SHA-256 fingerprints. Pinning the
+// intermediate or the root survives the rotation of the CA's own
+// certificate.
+func verifyPins(cs tls.ConnectionState, pins []string) error {
+	certs := append([]*x509.Certificate{}, cs.PeerCertificates...)
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.Raw)
+		if policy.ContainsAny(pins, []string{hex.EncodeToString(sum[:])}) {
+			return nil
+		}
+	}
+
+	upstreamPinFailures.Inc()
+	var subject string
+	if len(cs.PeerCertificates) > 0 {
+		subject = cs.PeerCertificates[0].Subject.String()
+	}
+	logFor("server").WithFields(log.Fields{
+		"server":  cs.ServerName,
+		"subject": subject,
+	}).Error("Upstream CA certificate does not match the pinned fingerprints")
+	return errors.Errorf("certificate of %s does not match the pinned fingerprints", cs.ServerName)
+}
+
+// upstreamTransports are the transports of the upstream CA clients, by
+// configuration and roots, shared by the clients of all the upstreams and
+// by the clients created again when a provisioner is refreshed.
+var upstreamTransports = struct {
+	sync.Mutex
+	m map[string]*http.Transport
+}{m: map[string]*http.Transport{}}
+
+// upstreamTransportOption returns the client option using the upstream
+// transport trusting the roots in bundle.
+func upstreamTransportOption(c UpstreamConfig, bundle []byte) (ca.ClientOption, error) {
+	key := fmt.Sprintf("%+v\n%s", c, bundle)
+	upstreamTransports.Lock()
+	defer upstreamTransports.Unlock()
+	if tr, ok := upstreamTransports.m[key]; ok {
+		return ca.WithTransport(tr), nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no root certificates found")
+	}
+	tr := upstreamTransport(c, pool)
+	upstreamTransports.m[key] = tr
+
+	return ca.WithTransport(tr), nil
+}
@@ -0,0 +1,149 @@
+package signer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpstreamConfigValidate(t *testing.T) {
+	pin := strings.Repeat("ab:", 31) + "AB"
+	tests := []struct {
+		name string
+		c    UpstreamConfig
+		ok   bool
+	}{
+		{"default", UpstreamConfig{}, true},
+		{"all", UpstreamConfig{Resolver: "10.0.0.53:53", Hosts: map[string][]string{"ca.example.com": {"10.0.0.1", "fd00::1"}}, Pins: []string{pin}}, true},
+		{"resolver", UpstreamConfig{Resolver: "10.0.0.53"}, false},
+		{"no addresses", UpstreamConfig{Hosts: map[string][]string{"ca.example.com": nil}}, false},
+		{"host address", UpstreamConfig{Hosts: map[string][]string{"ca.example.com": {"ca.internal"}}}, false},
+		{"short pin", UpstreamConfig{Pins: []string{"abcd"}}, false},
+		{"http limits", UpstreamConfig{HTTP: UpstreamHTTPConfig{MaxConnsPerHost: -1}}, false},
+		{"http duration", UpstreamConfig{HTTP: UpstreamHTTPConfig{DialTimeout: "soon"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestHostsDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	dial := hostsDialer(&net.Dialer{}, map[string][]string{"ca.test": {"127.0.0.1"}})
+	conn, err := dial(context.Background(), "tcp", "CA.test:"+port)
+	if err != nil {
+		t.Fatalf("dial() of a static host = %v", err)
+	}
+	conn.Close()
+
+	ln.Close()
+	if _, err := dial(context.Background(), "tcp", "ca.test:"+port); err == nil {
+		t.Error("dial() of a closed port error = nil")
+	}
+}
+
+func TestUpstreamTransportPins(t *testing.T) {
+	up := newTestUpstream(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(up.root)
+	sum := sha256.Sum256(up.intermediate.Raw)
+	pin := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	tests := []struct {
+		name string
+		pins []string
+		ok   bool
+	}{
+		{"none", nil, true},
+		{"intermediate", []string{pin}, true},
+		{"other", []string{strings.Repeat("00", sha256.Size)}, false},
+	}
+	for _, tt := range tests {
+		client := &http.Client{Transport: upstreamTransport(UpstreamConfig{Pins: tt.pins}, pool)}
+		resp, err := client.Get(up.URL + "/health")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Get() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestUpstreamHTTPConfig(t *testing.T) {
+	tr := upstreamTransport(UpstreamConfig{}, x509.NewCertPool())
+	if tr.MaxIdleConns != 100 || tr.MaxIdleConnsPerHost != 32 || tr.MaxConnsPerHost != 0 || tr.IdleConnTimeout != 90*time.Second || tr.TLSHandshakeTimeout != 10*time.Second {
+		t.Errorf("default transport = %d, %d, %d, %v, %v", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost, tr.IdleConnTimeout, tr.TLSHandshakeTimeout)
+	}
+	c := UpstreamHTTPConfig{MaxIdleConns: 10, MaxIdleConnsPerHost: 5, MaxConnsPerHost: 8, IdleConnTimeout: "1m", TLSHandshakeTimeout: "2s", DialTimeout: "3s", KeepAlive: "15s"}
+	tr = upstreamTransport(UpstreamConfig{HTTP: c}, x509.NewCertPool())
+	if tr.MaxIdleConns != 10 || tr.MaxIdleConnsPerHost != 5 || tr.MaxConnsPerHost != 8 || tr.IdleConnTimeout != time.Minute || tr.TLSHandshakeTimeout != 2*time.Second {
+		t.Errorf("tuned transport = %d, %d, %d, %v, %v", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost, tr.IdleConnTimeout, tr.TLSHandshakeTimeout)
+	}
+	if c.GetDialTimeout() != 3*time.Second || c.GetKeepAlive() != 15*time.Second {
+		t.Errorf("dialer = %v, %v", c.GetDialTimeout(), c.GetKeepAlive())
+	}
+}
+
+func TestUpstreamTransportReuse(t *testing.T) {
+	up := newTestUpstream(t)
+	bundle := certPEM(up.root)
+	opt, err := upstreamTransportOption(UpstreamConfig{}, []byte(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upstreamTransportOption(UpstreamConfig{}, []byte(bundle)); err != nil {
+		t.Fatal(err)
+	}
+	tr := upstreamTransports.m[fmt.Sprintf("%+v\n%s", UpstreamConfig{}, bundle)]
+	if opt == nil || tr == nil {
+		t.Fatal("upstreamTransportOption() did not share the transport")
+	}
+	if _, err := upstreamTransportOption(UpstreamConfig{}, []byte("no roots")); err == nil {
+		t.Error("upstreamTransportOption() without roots error = nil")
+	}
+
+	client := &http.Client{Transport: tr}
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(up.URL + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	dials := testutil.ToFloat64(upstreamDials)
+	resumed := testutil.ToFloat64(upstreamHandshakes.WithLabelValues("true"))
+	get()
+	get()
+	if got := testutil.ToFloat64(upstreamDials) - dials; got != 1 {
+		t.Errorf("connections for two requests = %v, want 1", got)
+	}
+	tr.CloseIdleConnections()
+	get()
+	if got := testutil.ToFloat64(upstreamDials) - dials; got != 2 {
+		t.Errorf("connections after closing the idle ones = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(upstreamHandshakes.WithLabelValues("true")) - resumed; got != 1 {
+		t.Errorf("resumed handshakes = %v, want 1", got)
+	}
+}
@@ -0,0 +1,110 @@
+package signer
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/smallstep/certificates/api/render"
+	"github.com/smallstep/certificates/errs"
+)
+
+// apiVersionLatest is the API version served on the unversioned paths.
+const apiVersionLatest = 1
+
+// supportedAPIVersions are the versions the signer can serve.
+var supportedAPIVersions = map[int]bool{1: true}
+
+// apiMediaTypeRegexp matches the versioned media type in Accept, e.g.
+// application/vnd.ca-signer.v1+json.
+var apiMediaTypeRegexp = regexp.MustCompile(`^application/vnd\.ca-signer\.v([0-9]+)\+json$`)
+
+type apiVersionKey struct{}
+
+type versionedPathKey struct{}
+
+// apiVersion returns the API version negotiated for r.
+func apiVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return apiVersionLatest
+}
+
+// versionedPath returns true if r was sent to a path with a version prefix,
+// false for the unversioned aliases.
+func versionedPath(r *http.Request) bool {
+	v, _ := r.Context().Value(versionedPathKey{}).(bool)
+	return v
+}
+
+// versioned serves the API on the /v1 paths and, as an alias of the latest
+// version, on the unversioned paths. Clients can also request a version with
+// the application/vnd.ca-signer.v<N>+json media type in Accept.
+func versioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, err := negotiateAPIVersion(r)
+		if err != nil {
+			render.Error(w, r, err)
+			return
+		}
+
+		prefixed := false
+		if p, ok := strings.CutPrefix(r.URL.Path, "/v"+strconv.Itoa(version)); ok && strings.HasPrefix(p, "/") {
+			r = r.Clone(r.Context())
+			r.URL.Path = p
+			r.URL.RawPath = ""
+			prefixed = true
+		}
+
+		w.Header().Set("X-API-Version", strconv.Itoa(version))
+		ctx := context.WithValue(r.Context(), apiVersionKey{}, version)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, versionedPathKey{}, prefixed)))
+	})
+}
+
+// negotiateAPIVersion returns the version in the path, or the highest
+// supported version in Accept, or the latest one. Unsupported versions, or
+// Accept not listing the version of the path, return 406 Not Acceptable.
+func negotiateAPIVersion(r *http.Request) (int, error) {
+	pathVersion := 0
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/v"); ok {
+		digits, _, _ := strings.Cut(rest, "/")
+		if n, err := strconv.Atoi(digits); err == nil {
+			pathVersion = n
+		}
+	}
+
+	if pathVersion != 0 && !supportedAPIVersions[pathVersion] {
+		return 0, errs.New(http.StatusNotAcceptable, "API version %d is not supported", pathVersion)
+	}
+
+	var accepted []int
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		if m := apiMediaTypeRegexp.FindStringSubmatch(strings.TrimSpace(mediaType)); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			accepted = append(accepted, n)
+		}
+	}
+	if len(accepted) == 0 {
+		if pathVersion != 0 {
+			return pathVersion, nil
+		}
+		return apiVersionLatest, nil
+	}
+
+	version := 0
+	for _, n := range accepted {
+		if supportedAPIVersions[n] && (pathVersion == 0 || n == pathVersion) && n > version {
+			version = n
+		}
+	}
+	if version == 0 {
+		return 0, errs.New(http.StatusNotAcceptable, "none of the API versions in Accept is supported on this path")
+	}
+
+	return version, nil
+}
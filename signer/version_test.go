@@ -0,0 +1,68 @@
+package signer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateAPIVersion(t *testing.T) {
+	tests := []struct {
+		path, accept string
+		want         int
+		status       int
+	}{
+		{"/sign", "", 1, 0},
+		{"/v1/sign", "", 1, 0},
+		{"/sign", "application/json", 1, 0},
+		{"/sign", "application/vnd.ca-signer.v1+json", 1, 0},
+		{"/sign", "application/vnd.ca-signer.v2+json;q=1, application/vnd.ca-signer.v1+json;q=0.5", 1, 0},
+		{"/v1/sign", "application/vnd.ca-signer.v1+json", 1, 0},
+		{"/v2/sign", "", 0, http.StatusNotAcceptable},
+		{"/sign", "application/vnd.ca-signer.v2+json", 0, http.StatusNotAcceptable},
+		{"/version", "", 1, 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		got, err := negotiateAPIVersion(r)
+		if got != tt.want || errorStatus(err) != tt.status {
+			t.Errorf("%s %q: negotiateAPIVersion() = %d, %v, want %d, status %d", tt.path, tt.accept, got, err, tt.want, tt.status)
+		}
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	var path string
+	var version int
+	var prefixed bool
+	handler := versioned(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, version, prefixed = r.URL.Path, apiVersion(r), versionedPath(r)
+	}))
+
+	tests := []struct {
+		path, want string
+		prefixed   bool
+	}{
+		{"/v1/sign", "/sign", true},
+		{"/sign", "/sign", false},
+		{"/v1", "/v1", false},
+		{"/v10/sign", "", false},
+	}
+	for _, tt := range tests {
+		path = ""
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, nil))
+		if tt.want == "" {
+			if w.Code != http.StatusNotAcceptable || path != "" {
+				t.Errorf("%s: status = %d, want %d", tt.path, w.Code, http.StatusNotAcceptable)
+			}
+			continue
+		}
+		if path != tt.want || prefixed != tt.prefixed || version != 1 || w.Header().Get("X-API-Version") != "1" {
+			t.Errorf("%s: served %s, prefixed %v, version %d, want %s, prefixed %v, version 1", tt.path, path, prefixed, version, tt.want, tt.prefixed)
+		}
+	}
+}
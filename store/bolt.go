@@ -0,0 +1,169 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt is a Store in a BoltDB file. The lock protects the database while it
+// is replaced by a compacted copy.
+type Bolt struct {
+	path string
+	mu   sync.RWMutex
+	db   *bolt.DB
+}
+
+// OpenBolt opens or creates a BoltDB file with the given buckets.
+func OpenBolt(path string, buckets [][]byte) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening inventory")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error initializing inventory")
+	}
+
+	return &Bolt{path: path, db: db}, nil
+}
+
+func (s *Bolt) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *Bolt) Update(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *Bolt) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Close()
+}
+
+// Compact rewrites the file to release the space of the deleted keys.
+// Transactions wait for the compaction to finish.
+func (s *Bolt) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0o600, nil)
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, s.db, 64<<20); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	dst.Close()
+
+	// The original file is kept until the copy opens, and reopened if it
+	// cannot be swapped in.
+	old := s.path + ".old"
+	if err := s.db.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(s.path, old); err != nil {
+		os.Remove(tmp)
+		return s.reopen(err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return s.restore(old, err)
+	}
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return s.restore(old, err)
+	}
+	s.db = db
+	os.Remove(old)
+
+	return nil
+}
+
+// restore moves the original file back after a failed compaction and
+// reopens it.
+func (s *Bolt) restore(old string, cause error) error {
+	if err := os.Rename(old, s.path); err != nil {
+		return errors.Wrapf(cause, "error restoring inventory from %s: %v", old, err)
+	}
+
+	return s.reopen(cause)
+}
+
+// reopen reopens the file after a failed compaction, and returns cause.
+func (s *Bolt) reopen(cause error) error {
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return errors.Wrapf(cause, "error reopening inventory: %v", err)
+	}
+	s.db = db
+
+	return errors.Wrap(cause, "error compacting inventory")
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	return boltBucket{t.tx.Bucket(name)}
+}
+
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+func (b boltBucket) ForEachAfter(after []byte, fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	k, v := c.Seek(after)
+	if k != nil && bytes.Equal(k, after) {
+		k, v = c.Next()
+	}
+	for ; k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b boltBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
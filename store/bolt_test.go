@@ -0,0 +1,147 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testBucket = []byte("test")
+
+func newTestBolt(t *testing.T) *Bolt {
+	t.Helper()
+	s, err := OpenBolt(filepath.Join(t.TempDir(), "store.db"), [][]byte{testBucket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func put(t *testing.T, s Store, keys ...string) {
+	t.Helper()
+	err := s.Update(func(tx Tx) error {
+		for _, k := range keys {
+			if err := tx.Bucket(testBucket).Put([]byte(k), []byte("v"+k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltForEachAfter(t *testing.T) {
+	s := newTestBolt(t)
+	put(t, s, "a/1", "a/2", "b/1", "c/1")
+
+	tests := []struct {
+		name   string
+		scan   func(Bucket, func(k, v []byte) error) error
+		wanted []string
+	}{
+		{"after existing key", func(b Bucket, fn func(k, v []byte) error) error {
+			return b.ForEachAfter([]byte("a/2"), fn)
+		}, []string{"b/1", "c/1"}},
+		{"after missing key", func(b Bucket, fn func(k, v []byte) error) error {
+			return b.ForEachAfter([]byte("a/3"), fn)
+		}, []string{"b/1", "c/1"}},
+		{"after empty key", func(b Bucket, fn func(k, v []byte) error) error {
+			return b.ForEachAfter(nil, fn)
+		}, []string{"a/1", "a/2", "b/1", "c/1"}},
+		{"prefix", func(b Bucket, fn func(k, v []byte) error) error {
+			return b.ForEachPrefix([]byte("a/"), fn)
+		}, []string{"a/1", "a/2"}},
+		{"missing prefix", func(b Bucket, fn func(k, v []byte) error) error {
+			return b.ForEachPrefix([]byte("d/"), fn)
+		}, nil},
+	}
+	for _, tt := range tests {
+		var keys []string
+		err := s.View(func(tx Tx) error {
+			return tt.scan(tx.Bucket(testBucket), func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(keys, tt.wanted) {
+			t.Errorf("%s: keys = %v, want %v", tt.name, keys, tt.wanted)
+		}
+	}
+}
+
+func TestBoltCompact(t *testing.T) {
+	s := newTestBolt(t)
+	put(t, s, "1", "2")
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	var v []byte
+	s.View(func(tx Tx) error {
+		v = append(v, tx.Bucket(testBucket).Get([]byte("2"))...)
+		return nil
+	})
+	if string(v) != "v2" {
+		t.Errorf("Get() after Compact() = %q, want v2", v)
+	}
+}
+
+func TestBoltCompactRestore(t *testing.T) {
+	s := newTestBolt(t)
+	put(t, s, "1")
+
+	// The copy cannot be swapped in while a directory is in its way.
+	if err := os.Mkdir(s.path+".old", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.path+".old/x", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(); err == nil {
+		t.Fatal("Compact() error = nil, want the rename error")
+	}
+
+	var v []byte
+	s.View(func(tx Tx) error {
+		v = append(v, tx.Bucket(testBucket).Get([]byte("1"))...)
+		return nil
+	})
+	if string(v) != "v1" {
+		t.Errorf("Get() after a failed Compact() = %q, want the original store", v)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src, dst := newTestBolt(t), newTestBolt(t)
+	put(t, src, "1", "2", "3")
+	put(t, dst, "1")
+
+	copied := map[string]int{}
+	if err := Migrate(src, dst, [][]byte{testBucket}, func(bucket string, n int) {
+		copied[bucket] = n
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if copied["test"] != 3 {
+		t.Errorf("copied = %v, want 3 keys of test", copied)
+	}
+
+	var n int
+	dst.View(func(tx Tx) error {
+		return tx.Bucket(testBucket).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		})
+	})
+	if n != 3 {
+		t.Errorf("destination has %d keys, want 3", n)
+	}
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pkg/errors"
+)
+
+const (
+	// pgTxTimeout bounds a transaction of the Postgres store.
+	pgTxTimeout = 30 * time.Second
+	// pgTxRetries is how many times a conflicting update is retried.
+	pgTxRetries = 5
+	// pgPageSize is the number of keys read per query by ForEach.
+	pgPageSize = 500
+)
+
+// pgReadOnly are the options of the read-only transactions.
+var pgReadOnly = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+const pgSchema = `CREATE TABLE IF NOT EXISTS ca_signer_store (
+	bucket text NOT NULL,
+	key bytea NOT NULL,
+	value bytea NOT NULL,
+	PRIMARY KEY (bucket, key)
+)`
+
+// Postgres is a Store in a Postgres table shared by the replicas. Updates
+// are serializable, and retried when they conflict with another replica.
+type Postgres struct {
+	db *sql.DB
+}
+
+// OpenPostgres connects to Postgres with at most maxConns connections, and
+// creates the table of the store if it does not exist. password is used if
+// the URL has none.
+func OpenPostgres(url, password string, maxConns int) (*Postgres, error) {
+	cfg, err := pgx.ParseConfig(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing postgres url")
+	}
+	if cfg.Password == "" {
+		cfg.Password = password
+	}
+
+	db := stdlib.OpenDB(*cfg)
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), pgTxTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, pgSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error initializing postgres store")
+	}
+
+	return &Postgres{db: db}, nil
+}
+
+func (s *Postgres) View(fn func(Tx) error) error {
+	return s.run(pgReadOnly, fn)
+}
+
+// ViewContext runs fn in a read-only transaction bounded by ctx instead of
+// pgTxTimeout, for reads longer than a request such as snapshots. The
+// transaction reads a single snapshot of the table however long it runs.
+func (s *Postgres) ViewContext(ctx context.Context, fn func(Tx) error) error {
+	return s.runContext(ctx, pgReadOnly, fn)
+}
+
+func (s *Postgres) Update(fn func(Tx) error) error {
+	var err error
+	for i := 0; i < pgTxRetries; i++ {
+		if err = s.run(&sql.TxOptions{Isolation: sql.LevelSerializable}, fn); !pgConflict(err) {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+
+	return errors.Wrap(ErrConflict, err.Error())
+}
+
+func (s *Postgres) Close() error {
+	return s.db.Close()
+}
+
+// run runs fn in a transaction, committed if fn and all the statements
+// succeed.
+func (s *Postgres) run(opts *sql.TxOptions, fn func(Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pgTxTimeout)
+	defer cancel()
+
+	return s.runContext(ctx, opts, fn)
+}
+
+func (s *Postgres) runContext(ctx context.Context, opts *sql.TxOptions, fn func(Tx) error) error {
+	sqlTx, err := s.db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	tx := &pgTx{ctx: ctx, tx: sqlTx}
+	if err := fn(tx); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	if tx.err != nil {
+		sqlTx.Rollback()
+		return tx.err
+	}
+
+	return sqlTx.Commit()
+}
+
+// pgConflict returns true if err is a serialization failure or a deadlock,
+// after which the transaction can be retried.
+func pgConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+// pgTx is a transaction of the Postgres store. err records the first error
+// of a Get, which cannot return it.
+type pgTx struct {
+	ctx context.Context
+	tx  *sql.Tx
+	err error
+}
+
+func (t *pgTx) Bucket(name []byte) Bucket {
+	return &pgBucket{tx: t, name: string(name)}
+}
+
+type pgBucket struct {
+	tx   *pgTx
+	name string
+}
+
+func (b *pgBucket) Get(key []byte) []byte {
+	var value []byte
+	err := b.tx.tx.QueryRowContext(b.tx.ctx,
+		`SELECT value FROM ca_signer_store WHERE bucket = $1 AND key = $2`, b.name, key).Scan(&value)
+	if err != nil {
+		if err != sql.ErrNoRows && b.tx.err == nil {
+			b.tx.err = err
+		}
+		return nil
+	}
+
+	return value
+}
+
+func (b *pgBucket) Put(key, value []byte) error {
+	_, err := b.tx.tx.ExecContext(b.tx.ctx,
+		`INSERT INTO ca_signer_store (bucket, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = EXCLUDED.value`, b.name, key, value)
+	return err
+}
+
+func (b *pgBucket) Delete(key []byte) error {
+	_, err := b.tx.tx.ExecContext(b.tx.ctx,
+		`DELETE FROM ca_signer_store WHERE bucket = $1 AND key = $2`, b.name, key)
+	return err
+}
+
+func (b *pgBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.scan(nil, nil, true, fn)
+}
+
+func (b *pgBucket) ForEachAfter(after []byte, fn func(k, v []byte) error) error {
+	return b.scan(nil, after, false, fn)
+}
+
+func (b *pgBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	return b.scan(prefix, prefix, true, fn)
+}
+
+// scan calls fn for the keys starting with prefix from the key after,
+// included if first is true, reading them in pages so fn can run other
+// statements in the transaction.
+func (b *pgBucket) scan(prefix, after []byte, first bool, fn func(k, v []byte) error) error {
+	after = append([]byte{}, after...)
+	for {
+		rows, err := b.tx.tx.QueryContext(b.tx.ctx,
+			`SELECT key, value FROM ca_signer_store WHERE bucket = $1 AND (key > $2 OR ($3 AND key = $2))
+			ORDER BY key LIMIT $4`, b.name, after, first, pgPageSize)
+		if err != nil {
+			return err
+		}
+		var page [][2][]byte
+		for rows.Next() {
+			var k, v []byte
+			if err := rows.Scan(&k, &v); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, [2][]byte{k, v})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, kv := range page {
+			if !bytes.HasPrefix(kv[0], prefix) {
+				return nil
+			}
+			if err := fn(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+		if len(page) < pgPageSize {
+			return nil
+		}
+		after, first = page[len(page)-1][0], false
+	}
+}
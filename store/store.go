@@ -0,0 +1,113 @@
+// Package store persists the state of the signer in buckets of keys and
+// values ordered by key, read and written in transactions: a BoltDB file
+// for single node deployments, or a Postgres table shared by the replicas.
+package store
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultMaxConns is the maximum number of Postgres connections of a store
+// opened from a URL.
+const defaultMaxConns = 10
+
+// ErrConflict is returned by Update when the transaction still conflicts
+// with other replicas after the retries.
+var ErrConflict = errors.New("transaction conflicts with another replica")
+
+// Store persists the state of the signer: the issued certificates and their
+// revocations, the counters, the runtime policy rules and the pending
+// approvals. Bolt is a local file for single node deployments, Postgres is
+// shared by all the replicas.
+type Store interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(Tx) error) error
+	// Update runs fn in a read-write transaction, committed if fn returns
+	// nil. fn may run more than once if the transaction conflicts with
+	// another replica.
+	Update(fn func(Tx) error) error
+	Close() error
+}
+
+// Tx is a transaction of a Store.
+type Tx interface {
+	// Bucket returns one of the buckets the store was opened with.
+	Bucket(name []byte) Bucket
+}
+
+// Bucket is a bucket of a transaction. The keys and values it returns
+// are only valid until the end of the transaction.
+type Bucket interface {
+	// Get returns the value of key, or nil if it does not exist.
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// ForEach calls fn for each key in order, and stops at the first error.
+	// fn must not modify the bucket.
+	ForEach(fn func(k, v []byte) error) error
+	// ForEachAfter calls fn for each key greater than after, in order, to
+	// resume a scan where a previous transaction stopped.
+	ForEachAfter(after []byte, fn func(k, v []byte) error) error
+	// ForEachPrefix calls fn for each key starting with prefix, in order.
+	ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error
+}
+
+// OpenURL opens a store from the command line: a postgres:// URL or the
+// path of a BoltDB file with the given buckets.
+func OpenURL(s string, buckets [][]byte) (Store, error) {
+	if strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://") {
+		return OpenPostgres(s, "", defaultMaxConns)
+	}
+
+	return OpenBolt(s, buckets)
+}
+
+// MigrateBatch is the number of keys copied per transaction.
+const MigrateBatch = 1000
+
+// Migrate copies the buckets of src to dst, overwriting the keys that
+// already exist, and reports the number of keys copied per bucket.
+func Migrate(src, dst Store, buckets [][]byte, progress func(bucket string, n int)) error {
+	for _, name := range buckets {
+		var batch [][2][]byte
+		var n int
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			err := dst.Update(func(tx Tx) error {
+				b := tx.Bucket(name)
+				for _, kv := range batch {
+					if err := b.Put(kv[0], kv[1]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			n += len(batch)
+			batch = batch[:0]
+			return err
+		}
+
+		err := src.View(func(tx Tx) error {
+			return tx.Bucket(name).ForEach(func(k, v []byte) error {
+				batch = append(batch, [2][]byte{append([]byte{}, k...), append([]byte{}, v...)})
+				if len(batch) < MigrateBatch {
+					return nil
+				}
+				return flush()
+			})
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error copying bucket %s", name)
+		}
+		progress(string(name), n)
+	}
+
+	return nil
+}
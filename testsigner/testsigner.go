@@ -0,0 +1,481 @@
+// Package testsigner runs the signer in process with a throwaway CA, so
+// services calling the signer API can be tested without a signer, a step-ca
+// or the network.
+//
+// The signer is the production handler of the signer package, backed by an
+// in-memory step-ca authority with a JWK provisioner. Every endpoint enabled
+// by the default configuration is served, with the same responses and
+// headers as a deployed signer, also under the /v1 prefix.
+//
+//	s := testsigner.Start(t)
+//	client := s.Client("my-service")
+//	resp, err := client.Post(s.URL+"/v1/sign", "application/json", body)
+package testsigner
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/config"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/certificates/db"
+	"go.step.sm/crypto/jose"
+
+	"github.com/Fyve-Labs/ca-signer/policy"
+	"github.com/Fyve-Labs/ca-signer/signer"
+)
+
+const (
+	provisionerName     = "testsigner"
+	provisionerPassword = "testsigner"
+)
+
+// Authorizer decides whether a client may be issued a certificate for a
+// CSR. Returning an error denies the request with 403 Forbidden and the
+// error as message.
+type Authorizer func(clients []string, csr *x509.CertificateRequest) error
+
+// Option configures the test signer.
+type Option func(*Signer)
+
+// WithLifetime sets the default lifetime of the issued certificates, 24h by
+// default.
+func WithLifetime(d time.Duration) Option {
+	return func(s *Signer) {
+		s.lifetime = d
+	}
+}
+
+// WithAuthorizer sets the authorizer of the sign requests. By default every
+// request is allowed.
+func WithAuthorizer(fn Authorizer) Option {
+	return func(s *Signer) {
+		s.authorize = fn
+	}
+}
+
+// WithoutClientAuth lets clients call the signer without a certificate.
+func WithoutClientAuth() Option {
+	return func(s *Signer) {
+		s.clientAuth = tls.VerifyClientCertIfGiven
+	}
+}
+
+// Signer is a running test signer.
+type Signer struct {
+	// URL is the base URL of the signer, e.g. https://127.0.0.1:36423.
+	URL string
+	// Root and Intermediate are the certificates of the throwaway CA.
+	Root         *x509.Certificate
+	Intermediate *x509.Certificate
+
+	t          testing.TB
+	server     *httptest.Server
+	upstream   *httptest.Server
+	interKey   crypto.Signer
+	lifetime   time.Duration
+	authorize  Authorizer
+	clientAuth tls.ClientAuthType
+	db         *recordingDB
+}
+
+// Start creates a throwaway CA and starts a signer using it. The signer is
+// stopped when the test finishes, and errors fail the test.
+func Start(t testing.TB, opts ...Option) *Signer {
+	t.Helper()
+	s := &Signer{t: t, lifetime: 24 * time.Hour, clientAuth: tls.RequireAndVerifyClientCert}
+	for _, opt := range opts {
+		opt(s)
+	}
+	t.Cleanup(s.Close)
+	if err := s.start(); err != nil {
+		t.Fatalf("testsigner: %v", err)
+	}
+
+	return s
+}
+
+func (s *Signer) start() error {
+	if err := s.newCA(); err != nil {
+		return err
+	}
+	serverKey, serverCert, err := s.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "testsigner"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: localhostIPs(),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return err
+	}
+	serverTLS := tls.Certificate{
+		Certificate: [][]byte{serverCert.Raw, s.Intermediate.Raw},
+		PrivateKey:  serverKey,
+		Leaf:        serverCert,
+	}
+
+	kid, err := s.startUpstream(serverTLS)
+	if err != nil {
+		return err
+	}
+	p, err := ca.NewProvisioner(provisionerName, kid, s.upstream.URL, []byte(provisionerPassword),
+		ca.WithTransport(&http.Transport{TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    s.RootPool(),
+		}}))
+	if err != nil {
+		return err
+	}
+	handler, err := signer.NewHandler(&signer.Config{
+		CaURL:  s.upstream.URL,
+		Policy: policy.Config{DefaultAction: "allow"},
+	}, p, []*x509.Certificate{s.Root})
+	if err != nil {
+		return err
+	}
+
+	s.server = httptest.NewUnstartedServer(s.authorized(handler))
+	s.server.TLS = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{serverTLS},
+		ClientAuth:   s.clientAuth,
+		ClientCAs:    s.RootPool(),
+	}
+	s.server.StartTLS()
+	s.URL = s.server.URL
+
+	return nil
+}
+
+// startUpstream starts the in-memory step-ca issuing with the intermediate,
+// and returns the key ID of its JWK provisioner.
+func (s *Signer) startUpstream(cert tls.Certificate) (string, error) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	if err != nil {
+		return "", err
+	}
+	enc, err := jose.EncryptJWK(jwk, []byte(provisionerPassword))
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := enc.CompactSerialize()
+	if err != nil {
+		return "", err
+	}
+	pub := jwk.Public()
+	maxDur := max(s.lifetime, 24*time.Hour)
+
+	s.db = &recordingDB{}
+	if s.db.AuthDB, err = db.New(nil); err != nil {
+		return "", err
+	}
+	auth, err := authority.NewEmbedded(
+		authority.WithConfig(&config.Config{
+			AuthorityConfig: &config.AuthConfig{
+				Provisioners: provisioner.List{&provisioner.JWK{
+					Type:         "JWK",
+					Name:         provisionerName,
+					Key:          &pub,
+					EncryptedKey: encrypted,
+					Claims: &provisioner.Claims{
+						DefaultTLSDur: &provisioner.Duration{Duration: s.lifetime},
+						MaxTLSDur:     &provisioner.Duration{Duration: maxDur},
+					},
+				}},
+			},
+		}),
+		authority.WithX509RootCerts(s.Root),
+		authority.WithX509Signer(s.Intermediate, s.interKey),
+		authority.WithDatabase(s.db),
+		authority.WithQuietInit(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	mux := chi.NewRouter()
+	api.Route(mux)
+	mux.Route("/1.0", func(r chi.Router) {
+		api.Route(r)
+	})
+	s.upstream = httptest.NewUnstartedServer(mux)
+	s.upstream.Config.BaseContext = func(net.Listener) context.Context {
+		return authority.NewContext(context.Background(), auth)
+	}
+	s.upstream.TLS = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	s.upstream.StartTLS()
+
+	return pub.KeyID, nil
+}
+
+// Close stops the signer and its CA.
+func (s *Signer) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+	if s.upstream != nil {
+		s.upstream.Close()
+	}
+}
+
+// Client returns an HTTP client trusting the signer and authenticating with
+// a client certificate for the given name, used as common name and DNS SAN.
+func (s *Signer) Client(name string) *http.Client {
+	s.t.Helper()
+	cert, err := s.ClientCertificate(name)
+	if err != nil {
+		s.t.Fatalf("testsigner: %v", err)
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		RootCAs:      s.RootPool(),
+		Certificates: []tls.Certificate{cert},
+	}}}
+}
+
+// ClientCertificate issues a client certificate for the given name.
+func (s *Signer) ClientCertificate(name string) (tls.Certificate, error) {
+	key, cert, err := s.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw, s.Intermediate.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, nil
+}
+
+// RootPool returns a pool with the root of the CA.
+func (s *Signer) RootPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Root)
+	return pool
+}
+
+// RootPEM returns the root of the CA in PEM.
+func (s *Signer) RootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Root.Raw})
+}
+
+// Issued returns the certificates issued by the CA through the signer, in
+// order.
+func (s *Signer) Issued() []*x509.Certificate {
+	return s.db.certificates()
+}
+
+// recordingDB is the in-memory database of the step-ca, recording the
+// issued certificates.
+type recordingDB struct {
+	db.AuthDB
+
+	mu     sync.Mutex
+	issued []*x509.Certificate
+}
+
+func (d *recordingDB) StoreCertificateChain(chain ...*x509.Certificate) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.issued = append(d.issued, chain[0])
+	return nil
+}
+
+func (d *recordingDB) certificates() []*x509.Certificate {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]*x509.Certificate{}, d.issued...)
+}
+
+func (s *Signer) newCA() error {
+	now := time.Now()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "testsigner Root CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, root, root, rootKey.Public(), rootKey)
+	if err != nil {
+		return err
+	}
+	if s.Root, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+
+	interKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	inter := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "testsigner Intermediate CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err = x509.CreateCertificate(rand.Reader, inter, s.Root, interKey.Public(), rootKey)
+	if err != nil {
+		return err
+	}
+	if s.Intermediate, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+	s.interKey = interKey
+
+	return nil
+}
+
+// issue signs the template with the intermediate for a new key, used for
+// the TLS certificates of the servers and the clients.
+func (s *Signer) issue(tmpl *x509.Certificate) (crypto.Signer, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = now.Add(-time.Minute)
+	tmpl.NotAfter = now.Add(s.lifetime)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.Intermediate, key.Public(), s.interKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+
+	return key, cert, err
+}
+
+// authorized wraps the signer handler with the authorizer, if any, for the
+// sign requests.
+func (s *Signer) authorized(next http.Handler) http.Handler {
+	if s.authorize == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v1")
+		if r.Method != http.MethodPost || (path != "/sign" && path != "/sign/raw") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "error reading request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		if csr := requestCSR(path, data); csr != nil {
+			if err := s.authorize(clientIdentities(r), csr); err != nil {
+				writeError(w, http.StatusForbidden, err.Error())
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestCSR returns the CSR of a sign request, or nil if it cannot be
+// parsed, leaving the error to the signer.
+func requestCSR(path string, data []byte) *x509.CertificateRequest {
+	if path == "/sign/raw" {
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		csr, _ := x509.ParseCertificateRequest(data)
+		return csr
+	}
+
+	var body struct {
+		CsrPEM api.CertificateRequest `json:"csr"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		return nil
+	}
+	return body.CsrPEM.CertificateRequest
+}
+
+// clientIdentities returns the common name and SANs of the client
+// certificate.
+func clientIdentities(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+
+	return ids
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"status": status, "message": msg})
+}
+
+// ErrDenied can be returned by authorizers that do not need a specific
+// message.
+var ErrDenied = errors.New("request denied by the test signer")
+
+func localhostIPs() []net.IP {
+	return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+}
@@ -0,0 +1,170 @@
+package testsigner
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/api"
+)
+
+func newCSR(t *testing.T, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func signBody(t *testing.T, name string) *bytes.Reader {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{"csr": string(newCSR(t, name))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.NewReader(data)
+}
+
+func TestSign(t *testing.T) {
+	s := Start(t, WithLifetime(time.Hour))
+	client := s.Client("my-service")
+
+	resp, err := client.Post(s.URL+"/v1/sign", "application/json", signBody(t, "my-service.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if resp.Header.Get("X-Certificate-Serial") == "" {
+		t.Error("X-Certificate-Serial is not set")
+	}
+
+	var body api.SignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	cert := body.ServerPEM.Certificate
+	if cert == nil || cert.DNSNames[0] != "my-service.example.com" {
+		t.Fatalf("certificate = %v, want my-service.example.com", cert)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         s.RootPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err == nil {
+		t.Error("certificate verified without the intermediate")
+	}
+	if err := cert.CheckSignatureFrom(s.Intermediate); err != nil {
+		t.Errorf("certificate is not signed by the intermediate: %v", err)
+	}
+	if d := cert.NotAfter.Sub(cert.NotBefore); d > time.Hour+time.Minute {
+		t.Errorf("lifetime = %v, want 1h", d)
+	}
+
+	issued := s.Issued()
+	if len(issued) != 1 || !issued[0].Equal(cert) {
+		t.Errorf("Issued() = %d certificates, want the signed certificate", len(issued))
+	}
+}
+
+func TestSignRaw(t *testing.T) {
+	s := Start(t)
+
+	resp, err := s.Client("my-service").Post(s.URL+"/sign/raw", "application/pkcs10", bytes.NewReader(newCSR(t, "raw.example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if n := len(s.Issued()); n != 1 {
+		t.Errorf("Issued() = %d certificates, want 1", n)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	var clients []string
+	s := Start(t, WithAuthorizer(func(c []string, csr *x509.CertificateRequest) error {
+		clients = c
+		if csr.Subject.CommonName != "allowed.example.com" {
+			return ErrDenied
+		}
+		return nil
+	}))
+	client := s.Client("my-service")
+
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"allowed.example.com", http.StatusCreated},
+		{"denied.example.com", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		resp, err := client.Post(s.URL+"/sign", "application/json", signBody(t, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	if len(clients) == 0 || clients[0] != "my-service" {
+		t.Errorf("clients = %v, want my-service", clients)
+	}
+	if n := len(s.Issued()); n != 1 {
+		t.Errorf("Issued() = %d certificates, want 1", n)
+	}
+}
+
+func anonymousClient(s *Signer) *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    s.RootPool(),
+	}}}
+}
+
+func TestClientAuth(t *testing.T) {
+	s := Start(t)
+	if resp, err := anonymousClient(s).Get(s.URL + "/healthz"); err == nil {
+		resp.Body.Close()
+		t.Fatal("request without a client certificate succeeded")
+	}
+
+	s = Start(t, WithoutClientAuth())
+	resp, err := anonymousClient(s).Get(s.URL + "/roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var roots api.RootsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&roots); err != nil {
+		t.Fatal(err)
+	}
+	if len(roots.Certificates) != 1 || !roots.Certificates[0].Certificate.Equal(s.Root) {
+		t.Errorf("roots = %v, want the test root", roots.Certificates)
+	}
+}